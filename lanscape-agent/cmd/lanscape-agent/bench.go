@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jhead/lanscape/lanscape-agent/internal/agent"
+)
+
+// runBench implements `lanscape-agent bench`
+func runBench(args []string) {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	peer := fs.String("peer", "", "Peer ID of the remote agent to benchmark against (required)")
+	path := fs.String("path", "both", "Candidate path to measure: tailscale, direct, any, or both")
+	signalingURL := fs.String("signaling-url", "ws://localhost:8081", "Signaling server URL")
+	topic := fs.String("topic", "lanscape-chat", "Signaling topic")
+	dataDir := fs.String("data-dir", agent.DefaultDataDir(), "Directory for persistent agent state (identity key)")
+	duration := fs.Duration("duration", 10*time.Second, "Duration of the throughput phase")
+	size := fs.Int("size", 16*1024, "Message size in bytes for the throughput phase")
+	pings := fs.Int("pings", 50, "Number of pings for the RTT phase")
+	probes := fs.Int("probes", 500, "Number of probes for the loss phase")
+	timeout := fs.Duration("timeout", 30*time.Second, "Time to wait for the peer to connect")
+	output := fs.String("output", "", "Write results as JSON to this file")
+	logLevel := fs.String("log-level", "warn", "Log level (debug, info, warn, error)")
+	fs.Parse(args)
+
+	if *peer == "" {
+		fmt.Fprintln(os.Stderr, "bench: --peer is required")
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(*logLevel)); err != nil {
+		level = slog.LevelWarn
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
+		Level: level,
+	}))
+
+	var paths []string
+	switch *path {
+	case "both":
+		paths = []string{agent.BenchPathTailscale, agent.BenchPathDirect}
+	case agent.BenchPathTailscale, agent.BenchPathDirect, agent.BenchPathAny:
+		paths = []string{*path}
+	default:
+		fmt.Fprintf(os.Stderr, "bench: unknown path %q\n", *path)
+		os.Exit(2)
+	}
+
+	identity, err := agent.LoadOrCreateIdentity(*dataDir)
+	if err != nil {
+		logger.Error("failed to load identity", "error", err)
+		os.Exit(1)
+	}
+
+	tailscaleInfo, err := agent.GetTailscaleInfo()
+	if err != nil {
+		logger.Warn("failed to get Tailscale info", "error", err)
+		tailscaleInfo = nil
+	}
+
+	var results []*agent.BenchResult
+	for _, p := range paths {
+		fmt.Fprintf(os.Stderr, "benchmarking %s path against %s...\n", p, *peer)
+
+		phases := *duration + time.Duration(*pings)*2*time.Second + 10*time.Second
+		ctx, cancel := context.WithTimeout(context.Background(), *timeout+phases)
+		result, err := agent.RunBench(ctx, agent.BenchConfig{
+			SignalingURL:  *signalingURL,
+			Topic:         *topic,
+			PeerID:        *peer,
+			Path:          p,
+			Duration:      *duration,
+			MessageSize:   *size,
+			Pings:         *pings,
+			Probes:        *probes,
+			TailscaleInfo: tailscaleInfo,
+			Identity:      identity,
+			Logger:        logger,
+		})
+		cancel()
+		if err != nil {
+			logger.Error("benchmark failed", "path", p, "error", err)
+			continue
+		}
+		results = append(results, result)
+	}
+
+	if len(results) == 0 {
+		os.Exit(1)
+	}
+
+	printBenchResults(results)
+
+	if *output != "" {
+		data, err := json.MarshalIndent(results, "", "  ")
+		if err != nil {
+			logger.Error("failed to marshal results", "error", err)
+			os.Exit(1)
+		}
+		if err := os.WriteFile(*output, data, 0644); err != nil {
+			logger.Error("failed to write results", "error", err)
+			os.Exit(1)
+		}
+	}
+}
+
+// printBenchResults prints benchmark results as a table
+func printBenchResults(results []*agent.BenchResult) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PATH\tREMOTE\tTAILSCALE\tRTT MIN/AVG/P95/MAX (ms)\tTHROUGHPUT (Mbps)\tLOSS")
+	for _, r := range results {
+		fmt.Fprintf(w, "%s\t%s\t%t\t%.2f/%.2f/%.2f/%.2f\t%.2f\t%.1f%% (%d/%d)\n",
+			r.Path,
+			r.RemoteCandidate,
+			r.OverTailscale,
+			r.RTT.MinMs, r.RTT.AvgMs, r.RTT.P95Ms, r.RTT.MaxMs,
+			r.Throughput.Mbps,
+			r.Loss.Ratio*100, r.Loss.Sent-r.Loss.Received, r.Loss.Sent,
+		)
+	}
+	w.Flush()
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/jhead/lanscape/lanscape-agent/internal/agent"
+	"github.com/jhead/lanscape/lanscape-agent/pkg/protocol"
+)
+
+// runDrop implements `lanscape-agent drop`
+func runDrop(args []string) {
+	fs := flag.NewFlagSet("drop", flag.ExitOnError)
+	peer := fs.String("peer", "", "Peer ID of the remote agent (required)")
+	text := fs.String("text", "", "Text to send (use - to read stdin)")
+	link := fs.String("link", "", "Link to send")
+	file := fs.String("file", "", "File to send (at most 1MB)")
+	signalingURL := fs.String("signaling-url", "ws://localhost:8081", "Signaling server URL")
+	topic := fs.String("topic", "lanscape-chat", "Signaling topic")
+	dataDir := fs.String("data-dir", agent.DefaultDataDir(), "Directory for persistent agent state (identity key)")
+	timeout := fs.Duration("timeout", time.Minute, "Time to wait for the peer and delivery")
+	logLevel := fs.String("log-level", "warn", "Log level (debug, info, warn, error)")
+	fs.Parse(args)
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(*logLevel)); err != nil {
+		level = slog.LevelWarn
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
+		Level: level,
+	}))
+
+	var drop protocol.Drop
+	switch {
+	case *file != "":
+		data, err := os.ReadFile(*file)
+		if err != nil {
+			logger.Error("failed to read file", "error", err)
+			os.Exit(1)
+		}
+		drop = protocol.Drop{
+			Kind: agent.DropKindFile,
+			Name: filepath.Base(*file),
+			MIME: mime.TypeByExtension(filepath.Ext(*file)),
+			Data: data,
+		}
+	case *link != "":
+		drop = protocol.Drop{Kind: agent.DropKindLink, Data: []byte(*link)}
+	case *text == "-":
+		data, err := io.ReadAll(io.LimitReader(os.Stdin, agent.MaxDropSize+1))
+		if err != nil {
+			logger.Error("failed to read stdin", "error", err)
+			os.Exit(1)
+		}
+		drop = protocol.Drop{Kind: agent.DropKindText, Data: data}
+	case *text != "":
+		drop = protocol.Drop{Kind: agent.DropKindText, Data: []byte(*text)}
+	}
+
+	if *peer == "" || len(drop.Data) == 0 {
+		fmt.Fprintln(os.Stderr, "drop: --peer and one of --text, --link, or --file are required")
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	identity, err := agent.LoadOrCreateIdentity(*dataDir)
+	if err != nil {
+		logger.Error("failed to load identity", "error", err)
+		os.Exit(1)
+	}
+
+	tailscaleInfo, err := agent.GetTailscaleInfo()
+	if err != nil {
+		logger.Warn("failed to get Tailscale info", "error", err)
+		tailscaleInfo = nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	err = agent.RunDrop(ctx, agent.DropConfig{
+		SignalingURL:  *signalingURL,
+		Topic:         *topic,
+		PeerID:        *peer,
+		Drop:          drop,
+		TailscaleInfo: tailscaleInfo,
+		Identity:      identity,
+		Logger:        logger,
+	})
+	if err != nil {
+		logger.Error("drop failed", "error", err)
+		os.Exit(1)
+	}
+	fmt.Printf("delivered %s (%d bytes) to %s\n", drop.Kind, len(drop.Data), *peer)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/jhead/lanscape/lanscape-agent/internal/agent"
+	"github.com/jhead/lanscape/lanscape-agent/pkg/protocol"
+)
+
+// runForward implements `lanscape-agent forward`
+func runForward(args []string) {
+	fs := flag.NewFlagSet("forward", flag.ExitOnError)
+	peer := fs.String("peer", "", "Peer ID of the remote agent (required)")
+	listen := fs.String("listen", "127.0.0.1:0", "Local address to listen on")
+	target := fs.String("target", "", "Target on the peer: port or host:port (required)")
+	udp := fs.Bool("udp", false, "Forward UDP instead of TCP")
+	signalingURL := fs.String("signaling-url", "ws://localhost:8081", "Signaling server URL")
+	topic := fs.String("topic", "lanscape-chat", "Signaling topic")
+	dataDir := fs.String("data-dir", agent.DefaultDataDir(), "Directory for persistent agent state (identity key)")
+	logLevel := fs.String("log-level", "warn", "Log level (debug, info, warn, error)")
+	fs.Parse(args)
+
+	if *peer == "" || *target == "" {
+		fmt.Fprintln(os.Stderr, "forward: --peer and --target are required")
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(*logLevel)); err != nil {
+		level = slog.LevelWarn
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
+		Level: level,
+	}))
+
+	identity, err := agent.LoadOrCreateIdentity(*dataDir)
+	if err != nil {
+		logger.Error("failed to load identity", "error", err)
+		os.Exit(1)
+	}
+
+	tailscaleInfo, err := agent.GetTailscaleInfo()
+	if err != nil {
+		logger.Warn("failed to get Tailscale info", "error", err)
+		tailscaleInfo = nil
+	}
+
+	proto := "tcp"
+	if *udp {
+		proto = "udp"
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	err = agent.RunForward(ctx, agent.ForwardConfig{
+		SignalingURL: *signalingURL,
+		Topic:        *topic,
+		Forward: protocol.Forward{
+			PeerID:   *peer,
+			Protocol: proto,
+			Listen:   *listen,
+			Target:   *target,
+		},
+		TailscaleInfo: tailscaleInfo,
+		Identity:      identity,
+		Logger:        logger,
+	}, func(f protocol.Forward) {
+		fmt.Printf("forwarding %s %s -> %s:%s (ctrl-c to stop)\n", f.Protocol, f.Listen, f.PeerID, f.Target)
+	})
+	if err != nil {
+		logger.Error("forward failed", "error", err)
+		os.Exit(1)
+	}
+}
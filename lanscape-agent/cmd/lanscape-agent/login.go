@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/jhead/lanscape/lanscape-agent/internal/agent"
+)
+
+// runLogin implements `lanscape-agent login`
+func runLogin(args []string) {
+	fs := flag.NewFlagSet("login", flag.ExitOnError)
+	server := fs.String("server", "http://localhost:8080", "lanscaped URL")
+	dataDir := fs.String("data-dir", agent.DefaultDataDir(), "Directory for persistent agent state (identity key)")
+	name := fs.String("name", "", "Name for this agent in your account (default: hostname)")
+	fs.Parse(args)
+
+	if *name == "" {
+		*name, _ = os.Hostname()
+	}
+
+	identity, err := agent.LoadOrCreateIdentity(*dataDir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "login: failed to load identity: %v\n", err)
+		os.Exit(1)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	enrollment, err := agent.Login(ctx, *server, identity, *name, func(code agent.DeviceCode) {
+		fmt.Printf("To sign in, open %s and enter the code %s\n", code.VerificationURI, code.UserCode)
+		fmt.Printf("Or open %s\n", code.VerificationURIComplete)
+		fmt.Println("Waiting for approval...")
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "login: %v\n", err)
+		os.Exit(1)
+	}
+	credentials, err := agent.LoadCredentialCache(*dataDir, identity)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "login: %v\n", err)
+		os.Exit(1)
+	}
+	if err := agent.SaveEnrollment(*dataDir, credentials, enrollment); err != nil {
+		fmt.Fprintf(os.Stderr, "login: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Signed in as %s; agent %q (%s) is registered with your account\n", enrollment.Username, *name, identity.Fingerprint())
+}
@@ -2,20 +2,88 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"log/slog"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/jhead/lanscape/lanscape-agent/internal/agent"
+	"github.com/jhead/lanscape/signaling/pkg/buildinfo"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "bench" {
+		runBench(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		runReplay(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "forward" {
+		runForward(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "drop" {
+		runDrop(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "login" {
+		runLogin(os.Args[2:])
+		return
+	}
+
 	// Parse flags
 	wsAddr := flag.String("ws-addr", "localhost:8082", "WebSocket server address")
 	signalingURL := flag.String("signaling-url", "ws://localhost:8081", "Signaling server URL")
 	topic := flag.String("topic", "lanscape-chat", "Signaling topic")
+	dataDir := flag.String("data-dir", agent.DefaultDataDir(), "Directory for persistent agent state (identity key)")
+	name := flag.String("name", "", "Name advertised to peers (default: hostname)")
+	requireVerification := flag.Bool("require-verification", false, "Block data exchange with new or changed peer identities until confirmed in the browser")
+	record := flag.String("record", "", "Record bridge traffic envelopes to this file")
+	recordBodies := flag.Bool("record-bodies", false, "Include full message bodies in the recording (required for replay)")
+	recordMaxSize := flag.Int64("record-max-size", 64, "Rotate the recording file after this many megabytes (0 disables rotation)")
+	recordMaxFiles := flag.Int("record-max-files", 3, "Number of rotated recording files to keep")
+	maxSessions := flag.Int("max-sessions", 16, "Maximum concurrent browser sessions; the least recently active is closed when exceeded (0 is unlimited)")
+	maxPeers := flag.Int("max-peers", 64, "Maximum peer connections per session; the least recently active is closed when exceeded (0 is unlimited)")
+	maxTopicPeers := flag.Int("max-topic-peers", 0, "Maximum peers each session connects to in its topic; the rest are refused and reported to the browser (0 is unlimited)")
+	sdpHook := flag.String("sdp-hook", "", "Command that rewrites SDP: reads it on stdin, prints the replacement on stdout")
+	allowForward := flag.String("allow-forward", "", "Comma-separated targets peers may forward to: port, host:port, or * (default: none)")
+	var services serviceFlags
+	flag.Var(&services, "service", "Advertise a local service to peers as name=port[/udp] (repeatable)")
+	mdnsServices := flag.Bool("mdns-services", false, "Also advertise services this host announces over mDNS")
+	crashDir := flag.String("crash-dir", "", "Directory for crash logs (default: <data-dir>/crashes)")
+	crashReport := flag.Bool("crash-report", false, "Opt in to submitting anonymized crash reports to -crash-report-url")
+	crashReportURL := flag.String("crash-report-url", "", "Endpoint that receives anonymized crash reports as JSON")
+	configPath := flag.String("config", "", "JSON file of per-topic and per-peer overrides (default: <data-dir>/config.json; reload with SIGHUP or the reload message)")
+	stableID := flag.Bool("stable-id", false, "Use a peer ID derived from the identity key, stable across restarts")
+	muxSignaling := flag.Bool("mux-signaling", false, "Share one multiplexed signaling connection between browser sessions")
+	attestation := flag.String("attestation", credentialPath("attestation"), "File holding this agent's lanscaped membership attestation, advertised to peers (default: the attestation systemd credential if set, or for an enrolled agent, fetched from lanscaped for -attestation-network)")
+	attestationJWKS := flag.String("attestation-jwks", "", "lanscaped JWKS URL; when set, peers must present a valid attestation for -attestation-network")
+	attestationNetwork := flag.String("attestation-network", "", "lanscaped network peers must be members of; an enrolled agent fetches its own attestation for it")
+	revocationURL := flag.String("revocation-url", "", "lanscaped list of revoked identity keys to reject peers by (default: the enrolled server's, see login)")
+	usageReportURL := flag.String("usage-report-url", "", "lanscaped endpoint that receives periodic usage reports, e.g. https://host/v1/networks/1/usage")
+	usageToken := flag.String("usage-token", credentialPath("usage-token"), "File holding the lanscaped access token for usage reports, re-read before each report (default: the usage-token systemd credential, if set)")
+	usageInterval := flag.Duration("usage-interval", 5*time.Minute, "How often to report usage")
+	storeForward := flag.Bool("store-forward", false, "Queue messages for known peers that are offline and deliver them when they reconnect")
+	storeForwardMaxSize := flag.Int64("store-forward-max-size", 16, "Maximum megabytes of queued messages across all peers")
+	storeForwardTTL := flag.Duration("store-forward-ttl", 7*24*time.Hour, "How long a queued message waits for its peer")
+	simulate := flag.Bool("simulate", false, "Connect browser sessions on this agent to each other in memory, without signaling or WebRTC (development)")
+	notify := flag.Bool("notify", false, "Show desktop notifications for peer connects/disconnects, incoming drops, and verification prompts")
+	faultKillInterval := flag.Duration("fault-kill-interval", 0, "Close a random peer's data channel this often on average, for resilience testing (default: never)")
+	faultSeed := flag.Int64("fault-seed", 0, "Seed for -fault-kill-interval, to repeat a run (default: random, logged)")
+	strictLocal := flag.Bool("strict-local", false, "Bind the browser WebSocket to 127.0.0.1, refuse non-loopback clients and those without the local token (<data-dir>/local-token), and log each client's process where supported")
 	logLevel := flag.String("log-level", "info", "Log level (debug, info, warn, error)")
+	version := flag.Bool("version", false, "Print the version and exit")
 	flag.Parse()
 
+	if *version {
+		fmt.Println("lanscape-agent", buildinfo.Get())
+		return
+	}
+
 	// Set up logger
 	var level slog.Level
 	switch *logLevel {
@@ -46,11 +114,73 @@ func main() {
 
 	// Create agent
 	cfg := agent.Config{
-		WebSocketAddr:  *wsAddr,
-		SignalingURL:   *signalingURL,
-		Topic:          *topic,
-		TailscaleInfo:  tailscaleInfo,
-		Logger:         logger,
+		WebSocketAddr: *wsAddr,
+		SignalingURL:  *signalingURL,
+		Topic:         *topic,
+		DataDir:       *dataDir,
+		Name:          *name,
+		TailscaleInfo: tailscaleInfo,
+		Logger:        logger,
+
+		RequireVerification: *requireVerification,
+		Record: agent.RecorderConfig{
+			Path:          *record,
+			IncludeBodies: *recordBodies,
+			MaxSize:       *recordMaxSize * 1024 * 1024,
+			MaxFiles:      *recordMaxFiles,
+		},
+		Limits: agent.SupervisorLimits{
+			MaxSessions:        *maxSessions,
+			MaxPeersPerSession: *maxPeers,
+		},
+		Crash: agent.CrashConfig{
+			Dir:       *crashDir,
+			Report:    *crashReport,
+			ReportURL: *crashReportURL,
+		},
+	}
+
+	cfg.SnoopMDNS = *mdnsServices
+	cfg.Notify = *notify
+	cfg.ConfigPath = *configPath
+	cfg.MuxSignaling = *muxSignaling
+	cfg.StableID = *stableID
+	cfg.MaxTopicPeers = *maxTopicPeers
+	cfg.Simulate = *simulate
+	cfg.StrictLocal = *strictLocal
+	cfg.Faults = agent.FaultConfig{
+		KillInterval: *faultKillInterval,
+		Seed:         *faultSeed,
+	}
+	cfg.RevocationURL = *revocationURL
+	cfg.Usage = agent.UsageConfig{
+		ReportURL: *usageReportURL,
+		TokenPath: *usageToken,
+		Interval:  *usageInterval,
+	}
+	cfg.Outbox = agent.OutboxConfig{
+		Enabled: *storeForward,
+		MaxSize: *storeForwardMaxSize * 1024 * 1024,
+		TTL:     *storeForwardTTL,
+	}
+	cfg.Attestation = agent.AttestationConfig{
+		Path:    *attestation,
+		JWKSURL: *attestationJWKS,
+		Network: *attestationNetwork,
+	}
+	for _, s := range services {
+		service, err := agent.ParseService(s)
+		if err != nil {
+			logger.Error("invalid -service flag", "error", err)
+			os.Exit(2)
+		}
+		cfg.Services = append(cfg.Services, service)
+	}
+	if *allowForward != "" {
+		cfg.ForwardAllow = strings.Split(*allowForward, ",")
+	}
+	if *sdpHook != "" {
+		cfg.SDPHooks = append(cfg.SDPHooks, agent.CommandSDPHook(*sdpHook))
 	}
 
 	ag, err := agent.NewAgent(cfg)
@@ -66,3 +196,27 @@ func main() {
 	}
 }
 
+// serviceFlags collects repeated -service flags
+type serviceFlags []string
+
+func (s *serviceFlags) String() string { return strings.Join(*s, ",") }
+
+func (s *serviceFlags) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+// credentialPath returns the path of the systemd credential name, which
+// LoadCredential=name:/path places in $CREDENTIALS_DIRECTORY, so flags naming
+// secret files default to it. It returns an empty string if there is none.
+func credentialPath(name string) string {
+	dir := os.Getenv("CREDENTIALS_DIRECTORY")
+	if dir == "" {
+		return ""
+	}
+	path := filepath.Join(dir, name)
+	if _, err := os.Stat(path); err != nil {
+		return ""
+	}
+	return path
+}
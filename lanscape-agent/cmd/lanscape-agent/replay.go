@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+
+	"github.com/jhead/lanscape/lanscape-agent/internal/agent"
+)
+
+// runReplay implements `lanscape-agent replay`
+func runReplay(args []string) {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	file := fs.String("file", "", "Recording file to replay (required)")
+	session := fs.Int64("session", 1, "Session number within the recording to replay")
+	realtime := fs.Bool("realtime", false, "Preserve the original timing between records")
+	logLevel := fs.String("log-level", "warn", "Log level (debug, info, warn, error)")
+	fs.Parse(args)
+
+	if *file == "" {
+		fmt.Fprintln(os.Stderr, "replay: --file is required")
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(*logLevel)); err != nil {
+		level = slog.LevelWarn
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
+		Level: level,
+	}))
+
+	f, err := os.Open(*file)
+	if err != nil {
+		logger.Error("failed to open recording", "error", err)
+		os.Exit(1)
+	}
+	defer f.Close()
+
+	// The bridge runs against a WebRTC manager with no peers, so outbound
+	// peer traffic is dropped and only browser-bound messages are compared
+	webrtc, err := agent.NewWebRTCManager(nil, logger)
+	if err != nil {
+		logger.Error("failed to create WebRTC manager", "error", err)
+		os.Exit(1)
+	}
+	bridge := agent.NewBridge(webrtc, nil, false, logger)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	result, err := agent.Replay(ctx, f, *session, bridge, *realtime)
+	if err != nil {
+		logger.Error("replay failed", "error", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("replayed %d records (%d skipped without bodies)\n", result.Replayed, result.Skipped)
+	fmt.Printf("browser messages: %d recorded, %d produced\n", result.Expected, result.Produced)
+	for _, m := range result.Mismatches {
+		got, _ := json.Marshal(m.Got)
+		fmt.Printf("mismatch #%d: expected %s %s (%s), got %s\n", m.Index, m.Expected.Type, m.Expected.PeerID, m.Expected.Hash, got)
+	}
+
+	if len(result.Mismatches) > 0 {
+		os.Exit(1)
+	}
+}
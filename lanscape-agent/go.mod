@@ -3,14 +3,20 @@ module github.com/jhead/lanscape/lanscape-agent
 go 1.23
 
 require (
+	github.com/golang-jwt/jwt/v5 v5.3.0
 	github.com/jhead/lanscape/signaling v0.0.0
+	github.com/oklog/ulid/v2 v2.1.1
+	github.com/pion/rtcp v1.2.14
 	github.com/pion/webrtc/v4 v4.0.0
+	golang.org/x/crypto v0.28.0
+	golang.org/x/net v0.29.0
+	golang.org/x/sys v0.26.0
 	nhooyr.io/websocket v1.8.17
 )
 
 require (
+	github.com/fxamacker/cbor/v2 v2.9.0 // indirect
 	github.com/google/uuid v1.6.0 // indirect
-	github.com/oklog/ulid/v2 v2.1.1 // indirect
 	github.com/pion/datachannel v1.5.9 // indirect
 	github.com/pion/dtls/v3 v3.0.3 // indirect
 	github.com/pion/ice/v4 v4.0.2 // indirect
@@ -18,7 +24,6 @@ require (
 	github.com/pion/logging v0.2.2 // indirect
 	github.com/pion/mdns/v2 v2.0.7 // indirect
 	github.com/pion/randutil v0.1.0 // indirect
-	github.com/pion/rtcp v1.2.14 // indirect
 	github.com/pion/rtp v1.8.9 // indirect
 	github.com/pion/sctp v1.8.33 // indirect
 	github.com/pion/sdp/v3 v3.0.9 // indirect
@@ -27,9 +32,7 @@ require (
 	github.com/pion/transport/v3 v3.0.7 // indirect
 	github.com/pion/turn/v4 v4.0.0 // indirect
 	github.com/wlynxg/anet v0.0.3 // indirect
-	golang.org/x/crypto v0.28.0 // indirect
-	golang.org/x/net v0.29.0 // indirect
-	golang.org/x/sys v0.26.0 // indirect
+	github.com/x448/float16 v0.8.4 // indirect
 )
 
 replace github.com/jhead/lanscape/signaling => ../signaling
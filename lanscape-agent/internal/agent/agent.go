@@ -2,27 +2,127 @@ package agent
 
 import (
 	"context"
+	"fmt"
 	"log/slog"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"syscall"
 	"time"
+
+	"github.com/jhead/lanscape/lanscape-agent/pkg/protocol"
+	"github.com/jhead/lanscape/signaling/pkg/buildinfo"
+	"github.com/jhead/lanscape/signaling/pkg/signaling"
 )
 
+// revocationRefreshInterval is how often the revoked key list is refetched
+const revocationRefreshInterval = 5 * time.Minute
+
 // Agent orchestrates all components
 type Agent struct {
 	wsServer      *WebSocketServer
 	tailscaleInfo *TailscaleInfo
+	identity      *Identity
+	recorder      *Recorder
+	supervisor    *Supervisor
+	services      *ServiceRegistry
+	overrides     *OverrideStore
+	usage         *UsageReporter
+	revocations   *RevocationList
+	topicKeys     *TopicKeys
+	snoopMDNS     bool
+	cancel        context.CancelFunc
 	logger        *slog.Logger
 }
 
 // Config holds agent configuration
 type Config struct {
-	WebSocketAddr  string
-	SignalingURL   string
-	Topic          string
-	TailscaleInfo  *TailscaleInfo
-	Logger         *slog.Logger
+	WebSocketAddr string
+	SignalingURL  string
+	Topic         string
+	DataDir       string
+	Name          string
+	TailscaleInfo *TailscaleInfo
+	Logger        *slog.Logger
+
+	// RequireVerification blocks data exchange with new or changed peer
+	// identities until the browser confirms them
+	RequireVerification bool
+
+	// Record enables session recording of bridge traffic when Path is set
+	Record RecorderConfig
+
+	// Limits caps browser sessions and peers per session (zero is unlimited)
+	Limits SupervisorLimits
+
+	// SDPHooks inspect or rewrite SDP before it is applied to any peer connection
+	SDPHooks []SDPHook
+
+	// ForwardAllow lists the targets peers may open through port forwarding:
+	// "port" (localhost), "host:port", or "*"
+	ForwardAllow []string
+
+	// Services are advertised to peers in signaling metadata
+	Services []protocol.Service
+	// SnoopMDNS also advertises services this host announces over mDNS
+	SnoopMDNS bool
+
+	// Crash controls where recovered panics are logged and whether
+	// anonymized reports are submitted (opt-in). Dir defaults to
+	// <data-dir>/crashes.
+	Crash CrashConfig
+
+	// Notify raises desktop notifications for peer connects/disconnects,
+	// incoming drops, and verification prompts
+	Notify bool
+
+	// ConfigPath is a JSON file of per-topic and per-peer overrides,
+	// reloaded by the browser "reload" message or SIGHUP. Peers blocked from
+	// the browser are saved here. Defaults to <data-dir>/config.json.
+	ConfigPath string
+
+	// MuxSignaling shares multiplexed signaling connections between browser
+	// sessions instead of dialing one per session (requires a signaling
+	// server with the /ws endpoint)
+	MuxSignaling bool
+
+	// StableID requests a peer ID derived from the identity key instead of a
+	// random one, so peers can address this agent across restarts
+	StableID bool
+
+	// MaxTopicPeers caps the peers each session connects to in its topic;
+	// the rest are left unconnected and reported to the browser. 0 is
+	// unlimited. The topic's maxPeers override takes precedence.
+	MaxTopicPeers int
+
+	// Attestation configures lanscaped membership attestations: the one this
+	// agent advertises and whether peers must present their own
+	Attestation AttestationConfig
+
+	// RevocationURL is lanscaped's list of revoked identity keys; peers
+	// presenting one are rejected. Defaults to the enrolled server's list.
+	RevocationURL string
+
+	// Usage reports bytes and messages per peer and topic to lanscaped
+	// periodically when ReportURL is set
+	Usage UsageConfig
+
+	// Outbox configures store-and-forward: when enabled, the browser can
+	// queue messages on disk for known peers that are offline
+	Outbox OutboxConfig
+
+	// Simulate connects this agent's browser sessions to each other in
+	// memory instead of through signaling and WebRTC, for development
+	Simulate bool
+
+	// Faults injects failures for resilience testing
+	Faults FaultConfig
+
+	// StrictLocal binds the browser WebSocket to 127.0.0.1, refuses clients
+	// on other addresses and those without the local token from the data
+	// directory, and logs every client with its process where the platform
+	// allows
+	StrictLocal bool
 }
 
 // NewAgent creates a new agent
@@ -30,34 +130,248 @@ func NewAgent(config Config) (*Agent, error) {
 	if config.Logger == nil {
 		config.Logger = slog.Default()
 	}
+	if config.DataDir == "" {
+		config.DataDir = DefaultDataDir()
+	}
+
+	// Load or create the persistent identity shared by all sessions
+	identity, err := LoadOrCreateIdentity(config.DataDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load identity: %w", err)
+	}
+	config.Logger.Info("loaded agent identity", "fingerprint", identity.Fingerprint(), "dataDir", config.DataDir)
+
+	certificate, err := LoadOrCreateCertificate(config.DataDir)
+	if err != nil {
+		return nil, err
+	}
+
+	credentials, err := LoadCredentialCache(config.DataDir, identity)
+	if err != nil {
+		return nil, err
+	}
+
+	// An enrolled identity joins with its stable peer ID so peers map back
+	// to the lanscaped account the key is registered with
+	enrollment, err := LoadEnrollment(config.DataDir, credentials)
+	if err != nil {
+		return nil, err
+	}
+	if enrollment != nil {
+		config.StableID = true
+		config.Logger.Info("agent identity enrolled with lanscaped", "server", enrollment.Server, "user", enrollment.Username)
+		if enrollment.Token == "" {
+			config.Logger.Warn("device token has expired; run lanscape-agent login again")
+		}
+	}
+
+	trustStore, err := LoadTrustStore(config.DataDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load trust store: %w", err)
+	}
+
+	if config.Name == "" {
+		config.Name, _ = os.Hostname()
+	}
+
+	var recorder *Recorder
+	if config.Record.Path != "" {
+		recorder, err = NewRecorder(config.Record)
+		if err != nil {
+			return nil, err
+		}
+		config.Logger.Info("recording bridge traffic", "path", config.Record.Path, "bodies", config.Record.IncludeBodies)
+	}
+
+	if config.Crash.Dir == "" {
+		config.Crash.Dir = filepath.Join(config.DataDir, "crashes")
+	}
+	crash, err := NewCrashReporter(config.Crash, config.Logger)
+	if err != nil {
+		return nil, err
+	}
+	if config.Crash.Report {
+		config.Logger.Info("crash reporting enabled", "url", config.Crash.ReportURL)
+	}
+
+	if config.ConfigPath == "" {
+		config.ConfigPath = filepath.Join(config.DataDir, "config.json")
+	}
+	overrides, err := LoadOverrides(config.ConfigPath, config.Logger)
+	if err != nil {
+		return nil, err
+	}
+
+	var attestation string
+	if config.Attestation.Path != "" {
+		if attestation, err = LoadAttestation(config.Attestation.Path); err != nil {
+			return nil, err
+		}
+	} else if enrollment != nil && config.Attestation.Network != "" {
+		attestation = loadGrant(enrollment, identity, credentials, config.Attestation.Network, config.Logger)
+	}
+	var attestations *AttestationVerifier
+	if config.Attestation.JWKSURL != "" {
+		attestations, err = NewAttestationVerifier(config.Attestation.JWKSURL, config.Attestation.Network, config.Logger)
+		if err != nil {
+			return nil, err
+		}
+		attestations.UseCache(credentials)
+		config.Logger.Info("requiring peer attestations", "network", config.Attestation.Network, "jwks", config.Attestation.JWKSURL)
+	}
+
+	var topicKeys *TopicKeys
+	if enrollment != nil && config.Attestation.Network != "" {
+		topicKeys = NewTopicKeys(enrollment, identity, config.Attestation.Network, config.Logger)
+		config.Logger.Info("fetching topic keys for sealed group messages", "network", config.Attestation.Network)
+	}
+
+	if config.RevocationURL == "" && enrollment != nil {
+		config.RevocationURL = enrollment.Server + "/v1/agents/revoked"
+	}
+	var revocations *RevocationList
+	if config.RevocationURL != "" {
+		revocations = signaling.NewRevocationList(config.RevocationURL, config.Logger)
+		config.Logger.Info("rejecting revoked peer identities", "url", config.RevocationURL)
+	}
+
+	var usageMeter *UsageMeter
+	var usageReporter *UsageReporter
+	if config.Usage.ReportURL != "" {
+		usageMeter = NewUsageMeter()
+		usageReporter = NewUsageReporter(usageMeter, config.Usage, config.Logger)
+		config.Logger.Info("reporting usage", "url", config.Usage.ReportURL, "interval", usageReporter.config.Interval)
+	}
+
+	outbox, err := LoadOutbox(config.DataDir, config.Outbox, config.Logger)
+	if err != nil {
+		return nil, err
+	}
+	if config.Outbox.Enabled {
+		config.Logger.Info("store-and-forward enabled", "maxSize", outbox.config.MaxSize, "ttl", outbox.config.TTL)
+	}
+
+	var simulation *SimNetwork
+	if config.Simulate {
+		simulation = NewSimNetwork(config.Logger)
+		config.Logger.Warn("simulation mode: browser sessions are connected in memory, signaling is not used")
+	}
+
+	var signalingMux *SignalingMux
+	if config.MuxSignaling {
+		signalingMux = NewSignalingMux(config.SignalingURL, config.Logger)
+	}
+
+	supervisor := NewSupervisor(config.Limits, config.Logger)
+	supervisor.SetCrashReporter(crash)
+
+	var notifier Notifier
+	if config.Notify {
+		notifier, err = NewDesktopNotifier()
+		if err != nil {
+			config.Logger.Warn("desktop notifications unavailable", "error", err)
+			notifier = nil
+		}
+	}
+	services := NewServiceRegistry(config.Services, config.Logger)
+
+	wsAddr := config.WebSocketAddr
+	var localToken string
+	if config.StrictLocal {
+		if wsAddr, err = strictLocalAddr(wsAddr); err != nil {
+			return nil, err
+		}
+		if localToken, err = LoadOrCreateLocalToken(config.DataDir); err != nil {
+			return nil, err
+		}
+		config.Logger.Info("strict local mode: clients must be on 127.0.0.1 and present the local token", "tokenFile", LocalTokenPath(config.DataDir))
+	}
 
 	// Create WebSocket server (each connection will create its own session)
 	wsServer := NewWebSocketServer(
-		config.WebSocketAddr,
-		config.SignalingURL,
-		config.Topic,
-		config.TailscaleInfo,
+		wsAddr,
+		SessionConfig{
+			SignalingURL:        config.SignalingURL,
+			Topic:               config.Topic,
+			Name:                config.Name,
+			TailscaleInfo:       config.TailscaleInfo,
+			Identity:            identity,
+			Certificate:         certificate,
+			TrustStore:          trustStore,
+			RequireVerification: config.RequireVerification,
+			Recorder:            recorder,
+			Supervisor:          supervisor,
+			SDPHooks:            config.SDPHooks,
+			ForwardAllow:        config.ForwardAllow,
+			Services:            services,
+			Notifier:            notifier,
+			Overrides:           overrides,
+			SignalingMux:        signalingMux,
+			StableID:            config.StableID,
+			MaxTopicPeers:       config.MaxTopicPeers,
+			Attestation:         attestation,
+			Attestations:        attestations,
+			Revocations:         revocations,
+			TopicKeys:           topicKeys,
+			Usage:               usageMeter,
+			Outbox:              outbox,
+			Simulation:          simulation,
+			Faults:              NewFaultInjector(config.Faults, config.Logger),
+		},
 		config.Logger,
 	)
+	wsServer.localToken = localToken
 
 	return &Agent{
 		wsServer:      wsServer,
 		tailscaleInfo: config.TailscaleInfo,
+		identity:      identity,
+		recorder:      recorder,
+		supervisor:    supervisor,
+		services:      services,
+		overrides:     overrides,
+		usage:         usageReporter,
+		revocations:   revocations,
+		topicKeys:     topicKeys,
+		snoopMDNS:     config.SnoopMDNS,
 		logger:        config.Logger,
 	}, nil
 }
 
 // Start starts the agent
 func (a *Agent) Start() error {
-	a.logger.Info("starting agent")
+	a.logger.Info("starting agent", "version", buildinfo.Get().Version)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	a.cancel = cancel
+
+	if a.snoopMDNS {
+		a.supervisor.Go("mdns-snoop", func() {
+			if err := a.services.SnoopMDNS(ctx); err != nil {
+				a.logger.Warn("mDNS service snooping stopped", "error", err)
+			}
+		})
+	}
+
+	if a.usage != nil {
+		a.supervisor.Go("usage-reporter", func() { a.usage.Run(ctx) })
+	}
+
+	if a.revocations != nil {
+		a.supervisor.Go("revocation-refresh", func() { a.revocations.Run(ctx, revocationRefreshInterval) })
+	}
+
+	if a.topicKeys != nil {
+		a.supervisor.Go("topic-key-refresh", func() { a.topicKeys.Run(ctx, topicKeyRefreshInterval) })
+	}
 
 	// Start WebSocket server in goroutine
 	// Each browser connection will create its own session with signaling
-	go func() {
+	a.supervisor.Go("websocket-server", func() {
 		if err := a.wsServer.Start(); err != nil {
 			a.logger.Error("WebSocket server error", "error", err)
 		}
-	}()
+	})
 
 	// Wait a bit for server to start
 	time.Sleep(100 * time.Millisecond)
@@ -70,12 +384,21 @@ func (a *Agent) Start() error {
 // Stop stops the agent
 func (a *Agent) Stop(ctx context.Context) error {
 	a.logger.Info("stopping agent")
+	if a.cancel != nil {
+		a.cancel()
+	}
 
 	// Stop WebSocket server (this will disconnect all sessions)
 	if err := a.wsServer.Stop(ctx); err != nil {
 		a.logger.Warn("error stopping WebSocket server", "error", err)
 	}
 
+	if a.recorder != nil {
+		if err := a.recorder.Close(); err != nil {
+			a.logger.Warn("error closing recording", "error", err)
+		}
+	}
+
 	return nil
 }
 
@@ -85,11 +408,18 @@ func (a *Agent) Run() error {
 		return err
 	}
 
-	// Wait for interrupt signal
+	// Wait for interrupt signal, reloading config overrides on SIGHUP
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
 
-	<-sigChan
+	for sig := range sigChan {
+		if sig != syscall.SIGHUP {
+			break
+		}
+		if err := a.overrides.Reload(); err != nil {
+			a.logger.Warn("failed to reload config", "error", err)
+		}
+	}
 	a.logger.Info("received interrupt signal")
 
 	// Graceful shutdown
@@ -98,5 +428,3 @@ func (a *Agent) Run() error {
 
 	return a.Stop(shutdownCtx)
 }
-
-
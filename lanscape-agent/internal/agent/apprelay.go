@@ -0,0 +1,220 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/jhead/lanscape/signaling/pkg/signaling"
+	"github.com/oklog/ulid/v2"
+)
+
+// appRelayMsgPrefix starts the message ID of every app-relay, which also
+// names the target so errors the server reports can be attributed to it
+const appRelayMsgPrefix = "app-relay/"
+
+var errAppRelayUnsupported = errors.New("signaling server does not accept app-relays")
+
+// appRelayPayload is the payload of an app-relay: application data, sealed
+// with the network's topic key when the agent has one
+type appRelayPayload struct {
+	Data   []byte `json:"data"`
+	Sealed bool   `json:"sealed,omitempty"`
+}
+
+// AppRelay carries small application payloads through the signaling server
+// to peers WebRTC could not connect to at all, so collaboration with them
+// degrades to a trickle instead of stopping. The server bounds the size and
+// rate of app-relays and only accepts them in topics whose ACL permits it.
+// Payloads are sealed with the topic key when the agent has one; otherwise
+// the signaling server can read them.
+type AppRelay struct {
+	signaling *SignalingClient
+	keys      *TopicKeys
+	logger    *slog.Logger
+
+	// ready reports whether data may be exchanged with a peer; onReceive is
+	// given the data of each app-relay from a ready peer; onFallback is told
+	// when a peer starts being reached through the server; onError is told
+	// when the server refuses an app-relay
+	ready      func(peerID string) bool
+	onReceive  func(peerID string, data []byte, sealed bool)
+	onFallback func(peerID string)
+	onError    func(peerID, code string)
+
+	mu       sync.Mutex
+	fallback map[string]bool // peers reached through the server
+}
+
+// NewAppRelay creates the app-relay fallback for a session's peers. keys,
+// when set, seals payloads; nil sends them as they are.
+func NewAppRelay(c *SignalingClient, keys *TopicKeys, logger *slog.Logger) *AppRelay {
+	r := &AppRelay{
+		signaling: c,
+		keys:      keys,
+		logger:    logger,
+		fallback:  make(map[string]bool),
+	}
+	c.appRelay = r
+	c.webrtc.SetOnPeerFailed(r.failed)
+	return r
+}
+
+// Send relays data to a peer through the signaling server. It fails without
+// sending if the server does not accept app-relays or the payload exceeds
+// its limit; refusals by the server are reported to onError.
+func (r *AppRelay) Send(peerID string, data []byte) error {
+	hints := r.signaling.Hints()
+	if hints == nil || !slices.Contains(hints.Features, signaling.AppRelayType) {
+		return errAppRelayUnsupported
+	}
+	if r.ready != nil && !r.ready(peerID) {
+		return fmt.Errorf("peer not verified: %s", peerID)
+	}
+
+	payload := appRelayPayload{Data: data}
+	if r.keys != nil {
+		sealed, err := r.keys.Seal(data)
+		if err != nil {
+			return err
+		}
+		payload = appRelayPayload{Data: sealed, Sealed: true}
+	}
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	if len(raw) > hints.AppRelayMaxSize {
+		return fmt.Errorf("app-relay of %d bytes exceeds the signaling server's %d byte limit", len(raw), hints.AppRelayMaxSize)
+	}
+
+	return r.signaling.send(signaling.InboundMessage{
+		Type:    signaling.AppRelayType,
+		To:      peerID,
+		Payload: raw,
+		MsgID:   appRelayMsgPrefix + peerID + "/" + ulid.Make().String(),
+	})
+}
+
+// broadcast relays data to the fallback peers accepted by include (nil
+// includes all), logging the ones it could not be sent to
+func (r *AppRelay) broadcast(data []byte, include func(peerID string) bool) {
+	for _, peerID := range r.peers() {
+		if include != nil && !include(peerID) {
+			continue
+		}
+		if err := r.Send(peerID, data); err != nil {
+			r.logger.Warn("failed to relay data through signaling", "peer", peerID, "size", len(data), "error", err)
+		}
+	}
+}
+
+// receive delivers an app-relay from a peer
+func (r *AppRelay) receive(peerID string, raw json.RawMessage) {
+	if r == nil {
+		return
+	}
+	if r.ready != nil && !r.ready(peerID) {
+		r.logger.Debug("dropping app-relay from unverified peer", "peer", peerID, "size", len(raw))
+		return
+	}
+	var payload appRelayPayload
+	if err := json.Unmarshal(raw, &payload); err != nil || len(payload.Data) == 0 {
+		r.logger.Warn("dropping invalid app-relay", "peer", peerID, "size", len(raw), "error", err)
+		return
+	}
+
+	data := payload.Data
+	switch {
+	case payload.Sealed && r.keys == nil:
+		r.logger.Warn("dropping sealed app-relay without topic keys", "peer", peerID)
+		return
+	case payload.Sealed:
+		var err error
+		if data, err = r.keys.Open(r.signaling.ctx, payload.Data); err != nil {
+			r.logger.Warn("dropping app-relay", "peer", peerID, "size", len(raw), "error", err)
+			return
+		}
+	case r.keys != nil:
+		// Members of a network with topic keys seal every app-relay
+		r.logger.Warn("dropping unsealed app-relay", "peer", peerID)
+		return
+	}
+	if r.onReceive != nil {
+		r.onReceive(peerID, data, payload.Sealed)
+	}
+}
+
+// handleError reports an app-relay the server refused, returning false if
+// msgID is not an app-relay's
+func (r *AppRelay) handleError(code, msgID string) bool {
+	rest, ok := strings.CutPrefix(msgID, appRelayMsgPrefix)
+	if r == nil || !ok {
+		return false
+	}
+	peerID, _, _ := strings.Cut(rest, "/")
+	r.logger.Warn("signaling server refused app-relay", "peer", peerID, "code", code)
+	if r.onError != nil {
+		r.onError(peerID, code)
+	}
+	return true
+}
+
+// failed falls back to the signaling server for a peer WebRTC could not
+// connect to, if the server accepts app-relays
+func (r *AppRelay) failed(peerID string) {
+	hints := r.signaling.Hints()
+	if hints == nil || !slices.Contains(hints.Features, signaling.AppRelayType) {
+		return
+	}
+	r.mu.Lock()
+	r.fallback[peerID] = true
+	r.mu.Unlock()
+	r.logger.Info("peer connection failed, relaying data through signaling", "peer", peerID, "maxSize", hints.AppRelayMaxSize)
+	if r.onFallback != nil {
+		r.onFallback(peerID)
+	}
+}
+
+// connected stops falling back for a peer WebRTC has since connected to
+func (r *AppRelay) connected(peerID string) {
+	r.forget(peerID)
+}
+
+// forget stops falling back for a peer, such as one that left the topic
+func (r *AppRelay) forget(peerID string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.fallback, peerID)
+}
+
+// active reports whether data to a peer goes through the signaling server
+func (r *AppRelay) active(peerID string) bool {
+	if r == nil {
+		return false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.fallback[peerID]
+}
+
+// peers returns the peers reached through the signaling server
+func (r *AppRelay) peers() []string {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	peers := make([]string, 0, len(r.fallback))
+	for peerID := range r.fallback {
+		peers = append(peers, peerID)
+	}
+	return peers
+}
@@ -0,0 +1,212 @@
+package agent
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// attestationAudience marks lanscaped tokens that attest topic membership
+const attestationAudience = "lanscape-attestation"
+
+// jwksRefreshInterval rate-limits JWKS refetches triggered by unknown key IDs
+const jwksRefreshInterval = time.Minute
+
+// AttestationConfig configures membership attestations. Attestations are
+// issued by lanscaped and bind this agent's identity key to a user and
+// network; peers exchange them in signaling metadata.
+type AttestationConfig struct {
+	// Path is a file holding this agent's attestation, advertised to peers
+	Path string
+	// JWKSURL is lanscaped's key set. When set, peers must present a valid
+	// attestation for Network before a connection is accepted.
+	JWKSURL string
+	// Network is the lanscaped network peers must belong to
+	Network string
+}
+
+// Attestation is a verified membership attestation
+type Attestation struct {
+	UserID    int64  `json:"user_id"`
+	Username  string `json:"username"`
+	Network   string `json:"network"`
+	PublicKey string `json:"public_key"`
+	jwt.RegisteredClaims
+}
+
+// LoadAttestation reads this agent's attestation token from path
+func LoadAttestation(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read attestation: %w", err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// AttestationVerifier checks peer attestations against lanscaped's JWKS. A
+// compromised signaling server can relay metadata but cannot mint
+// attestations, so it cannot introduce peers that are not network members.
+type AttestationVerifier struct {
+	mu        sync.Mutex
+	jwksURL   string
+	network   string
+	keys      map[string]*rsa.PublicKey // kid -> key
+	lastFetch time.Time
+	client    *http.Client
+	cache     *CredentialCache
+	logger    *slog.Logger
+}
+
+// NewAttestationVerifier creates a verifier for attestations in network
+func NewAttestationVerifier(jwksURL, network string, logger *slog.Logger) (*AttestationVerifier, error) {
+	if network == "" {
+		return nil, fmt.Errorf("attestation network required")
+	}
+	return &AttestationVerifier{
+		jwksURL: jwksURL,
+		network: network,
+		keys:    make(map[string]*rsa.PublicKey),
+		client:  &http.Client{Timeout: 10 * time.Second},
+		logger:  logger,
+	}, nil
+}
+
+// UseCache keeps the last fetched key set in cache and falls back to it
+// while lanscaped is unreachable
+func (v *AttestationVerifier) UseCache(cache *CredentialCache) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.cache = cache
+}
+
+// Verify checks that token is a current attestation for the verifier's
+// network, signed by lanscaped, and bound to publicKey
+func (v *AttestationVerifier) Verify(token, publicKey string) (*Attestation, error) {
+	if token == "" {
+		return nil, fmt.Errorf("peer did not present an attestation")
+	}
+
+	var claims Attestation
+	_, err := jwt.ParseWithClaims(token, &claims, v.key,
+		jwt.WithValidMethods([]string{jwt.SigningMethodRS256.Alg()}),
+		jwt.WithAudience(attestationAudience),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("invalid attestation: %w", err)
+	}
+
+	if claims.Network != v.network {
+		return nil, fmt.Errorf("attestation is for network %q, not %q", claims.Network, v.network)
+	}
+	if claims.PublicKey != publicKey {
+		return nil, fmt.Errorf("attestation is for a different identity key")
+	}
+	return &claims, nil
+}
+
+// key returns the verification key for a token, refreshing the JWKS when the
+// key ID is unknown
+func (v *AttestationVerifier) key(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if key, ok := v.keys[kid]; ok {
+		return key, nil
+	}
+	if time.Since(v.lastFetch) < jwksRefreshInterval {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	if err := v.fetch(); err != nil {
+		return nil, err
+	}
+	if key, ok := v.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// jwk is an RSA JSON Web Key as served by lanscaped
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// fetch replaces the cached keys with the current JWKS, or with the key set
+// in the credential cache if lanscaped cannot be reached. Caller must hold
+// v.mu.
+func (v *AttestationVerifier) fetch() error {
+	v.lastFetch = time.Now()
+
+	set, err := v.download()
+	if err != nil {
+		cached, ok := v.cache.jwks()
+		if !ok {
+			return err
+		}
+		v.keys = parseJWKS(cached)
+		v.logger.Warn("lanscaped unreachable, using cached attestation keys", "url", v.jwksURL, "keys", len(v.keys), "error", err)
+		return nil
+	}
+	if err := v.cache.setJWKS(set); err != nil {
+		v.logger.Warn("failed to cache attestation keys", "error", err)
+	}
+
+	v.keys = parseJWKS(set)
+	v.logger.Info("fetched attestation keys", "url", v.jwksURL, "keys", len(v.keys))
+	return nil
+}
+
+// download fetches the JWKS
+func (v *AttestationVerifier) download() ([]jwk, error) {
+	resp, err := v.client.Get(v.jwksURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch JWKS: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch JWKS: status %d", resp.StatusCode)
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, fmt.Errorf("failed to parse JWKS: %w", err)
+	}
+	return set.Keys, nil
+}
+
+// parseJWKS returns the RSA keys in a key set by key ID
+func parseJWKS(set []jwk) map[string]*rsa.PublicKey {
+	keys := make(map[string]*rsa.PublicKey, len(set))
+	for _, k := range set {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			continue
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			continue
+		}
+		keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	return keys
+}
@@ -0,0 +1,390 @@
+package agent
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	benchChannelLabel      = "lanscape-bench"
+	benchLossyChannelLabel = "lanscape-bench-lossy"
+
+	// Frame kinds; every frame starts with kind (1 byte) and seq (4 bytes)
+	benchFramePing  = 'p'
+	benchFrameData  = 'd'
+	benchFrameProbe = 'l'
+	benchFrameAck   = 'a'
+
+	benchHeaderSize     = 5
+	benchBufferHigh     = 4 * 1024 * 1024
+	benchBufferLow      = 1 * 1024 * 1024
+	benchProbeInterval  = 10 * time.Millisecond
+	benchResponseWindow = 2 * time.Second
+)
+
+// Bench paths select which ICE candidates the benchmark may use
+const (
+	BenchPathAny       = "any"
+	BenchPathTailscale = "tailscale"
+	BenchPathDirect    = "direct"
+)
+
+// Tailscale assigns addresses from the CGNAT range and a fixed ULA prefix
+var tailscaleNets = []*net.IPNet{
+	mustParseCIDR("100.64.0.0/10"),
+	mustParseCIDR("fd7a:115c:a1e0::/48"),
+}
+
+// BenchConfig configures a data channel benchmark against a single peer
+type BenchConfig struct {
+	SignalingURL  string
+	Topic         string
+	PeerID        string
+	Path          string
+	Duration      time.Duration
+	MessageSize   int
+	Pings         int
+	Probes        int
+	TailscaleInfo *TailscaleInfo
+	Identity      *Identity
+	Logger        *slog.Logger
+}
+
+// BenchResult holds the measurements from one benchmark run
+type BenchResult struct {
+	Path            string         `json:"path"`
+	LocalCandidate  string         `json:"localCandidate"`
+	RemoteCandidate string         `json:"remoteCandidate"`
+	OverTailscale   bool           `json:"overTailscale"`
+	RTT             BenchRTT       `json:"rtt"`
+	Throughput      BenchTransfer  `json:"throughput"`
+	Loss            BenchLossStats `json:"loss"`
+}
+
+// BenchRTT summarizes round-trip times in milliseconds
+type BenchRTT struct {
+	Samples int     `json:"samples"`
+	MinMs   float64 `json:"minMs"`
+	AvgMs   float64 `json:"avgMs"`
+	P95Ms   float64 `json:"p95Ms"`
+	MaxMs   float64 `json:"maxMs"`
+}
+
+// BenchTransfer summarizes the reliable-channel throughput phase
+type BenchTransfer struct {
+	BytesSent  int64   `json:"bytesSent"`
+	BytesAcked int64   `json:"bytesAcked"`
+	Seconds    float64 `json:"seconds"`
+	Mbps       float64 `json:"mbps"`
+}
+
+// BenchLossStats summarizes the unreliable-channel probe phase
+type BenchLossStats struct {
+	Sent     int     `json:"sent"`
+	Received int     `json:"received"`
+	Ratio    float64 `json:"ratio"`
+}
+
+// RunBench connects to the configured topic, waits for the target peer, and
+// measures RTT, throughput, and loss over dedicated benchmark data channels.
+// The remote agent answers benchmark frames automatically.
+func RunBench(ctx context.Context, config BenchConfig) (*BenchResult, error) {
+	logger := config.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	tailscaleInfo := config.TailscaleInfo
+	var ipFilter func(net.IP) bool
+	switch config.Path {
+	case BenchPathTailscale:
+		ipFilter = isTailscaleIP
+	case BenchPathDirect:
+		// NAT 1:1 mapping would rewrite host candidates to the Tailscale IP
+		tailscaleInfo = nil
+		ipFilter = func(ip net.IP) bool { return !isTailscaleIP(ip) }
+	case "", BenchPathAny:
+		config.Path = BenchPathAny
+	default:
+		return nil, fmt.Errorf("unknown bench path: %s", config.Path)
+	}
+
+	m, err := newWebRTCManager(tailscaleInfo, ipFilter, logger)
+	if err != nil {
+		return nil, err
+	}
+	defer m.CloseAll()
+
+	client, err := dialPeer(ctx, m, config.SignalingURL, config.Topic, config.Identity, config.PeerID, logger)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Disconnect()
+
+	result := &BenchResult{Path: config.Path}
+	if peer, err := m.GetPeerConnection(config.PeerID); err == nil {
+		if pair, err := peer.PC.SCTP().Transport().ICETransport().GetSelectedCandidatePair(); err == nil && pair != nil {
+			result.LocalCandidate = fmt.Sprintf("%s %s:%d", pair.Local.Typ, pair.Local.Address, pair.Local.Port)
+			result.RemoteCandidate = fmt.Sprintf("%s %s:%d", pair.Remote.Typ, pair.Remote.Address, pair.Remote.Port)
+			result.OverTailscale = isTailscaleIP(net.ParseIP(pair.Remote.Address))
+		}
+	}
+
+	ordered := true
+	reliable, err := openBenchChannel(ctx, m, config.PeerID, benchChannelLabel, &webrtc.DataChannelInit{Ordered: &ordered})
+	if err != nil {
+		return nil, err
+	}
+	defer reliable.Close()
+
+	unordered := false
+	noRetransmits := uint16(0)
+	lossy, err := openBenchChannel(ctx, m, config.PeerID, benchLossyChannelLabel, &webrtc.DataChannelInit{
+		Ordered:        &unordered,
+		MaxRetransmits: &noRetransmits,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer lossy.Close()
+
+	if result.RTT, err = benchRTT(ctx, reliable, config.Pings); err != nil {
+		return nil, fmt.Errorf("rtt phase failed: %w", err)
+	}
+	if result.Throughput, err = benchThroughput(ctx, reliable, config.Duration, config.MessageSize); err != nil {
+		return nil, fmt.Errorf("throughput phase failed: %w", err)
+	}
+	if result.Loss, err = benchLoss(ctx, lossy, config.Probes); err != nil {
+		return nil, fmt.Errorf("loss phase failed: %w", err)
+	}
+
+	return result, nil
+}
+
+// openBenchChannel creates a benchmark data channel and waits for it to open
+func openBenchChannel(ctx context.Context, m *WebRTCManager, peerID, label string, init *webrtc.DataChannelInit) (*webrtc.DataChannel, error) {
+	dc, err := m.CreateDataChannel(peerID, label, init)
+	if err != nil {
+		return nil, err
+	}
+
+	opened := make(chan struct{})
+	dc.OnOpen(func() { close(opened) })
+
+	select {
+	case <-opened:
+		return dc, nil
+	case <-ctx.Done():
+		dc.Close()
+		return nil, fmt.Errorf("data channel %q did not open: %w", label, ctx.Err())
+	}
+}
+
+// benchRTT sends sequential pings and measures their round trips
+func benchRTT(ctx context.Context, dc *webrtc.DataChannel, count int) (BenchRTT, error) {
+	replies := make(chan uint32, 1)
+	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		if len(msg.Data) >= benchHeaderSize && msg.Data[0] == benchFramePing {
+			select {
+			case replies <- binary.BigEndian.Uint32(msg.Data[1:5]):
+			default:
+			}
+		}
+	})
+
+	var samples []time.Duration
+	for seq := uint32(0); seq < uint32(count); seq++ {
+		start := time.Now()
+		if err := dc.Send(benchFrame(benchFramePing, seq, benchHeaderSize)); err != nil {
+			return BenchRTT{}, err
+		}
+
+		timer := time.NewTimer(benchResponseWindow)
+		select {
+		case got := <-replies:
+			if got == seq {
+				samples = append(samples, time.Since(start))
+			}
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return BenchRTT{}, ctx.Err()
+		}
+		timer.Stop()
+	}
+
+	return summarizeRTT(samples), nil
+}
+
+// benchThroughput saturates the reliable channel for the given duration
+func benchThroughput(ctx context.Context, dc *webrtc.DataChannel, duration time.Duration, size int) (BenchTransfer, error) {
+	if size < benchHeaderSize {
+		size = benchHeaderSize
+	}
+
+	var mu sync.Mutex
+	var acked int64
+	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		if len(msg.Data) >= benchHeaderSize+8 && msg.Data[0] == benchFrameAck {
+			mu.Lock()
+			acked = int64(binary.BigEndian.Uint64(msg.Data[benchHeaderSize:]))
+			mu.Unlock()
+		}
+	})
+
+	drained := make(chan struct{}, 1)
+	dc.SetBufferedAmountLowThreshold(benchBufferLow)
+	dc.OnBufferedAmountLow(func() {
+		select {
+		case drained <- struct{}{}:
+		default:
+		}
+	})
+
+	var sent int64
+	start := time.Now()
+	deadline := start.Add(duration)
+	for seq := uint32(0); time.Now().Before(deadline); seq++ {
+		if dc.BufferedAmount() > benchBufferHigh {
+			select {
+			case <-drained:
+			case <-time.After(benchResponseWindow):
+			case <-ctx.Done():
+				return BenchTransfer{}, ctx.Err()
+			}
+			continue
+		}
+		if err := dc.Send(benchFrame(benchFrameData, seq, size)); err != nil {
+			return BenchTransfer{}, err
+		}
+		sent += int64(size)
+	}
+
+	// Give in-flight acks a moment to arrive before measuring
+	time.Sleep(benchResponseWindow / 4)
+	elapsed := time.Since(start).Seconds()
+
+	mu.Lock()
+	defer mu.Unlock()
+	return BenchTransfer{
+		BytesSent:  sent,
+		BytesAcked: acked,
+		Seconds:    elapsed,
+		Mbps:       float64(acked) * 8 / elapsed / 1e6,
+	}, nil
+}
+
+// benchLoss sends paced probes on an unreliable channel and counts the echoes
+func benchLoss(ctx context.Context, dc *webrtc.DataChannel, count int) (BenchLossStats, error) {
+	var mu sync.Mutex
+	seen := make(map[uint32]bool)
+	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		if len(msg.Data) >= benchHeaderSize && msg.Data[0] == benchFrameProbe {
+			mu.Lock()
+			seen[binary.BigEndian.Uint32(msg.Data[1:5])] = true
+			mu.Unlock()
+		}
+	})
+
+	ticker := time.NewTicker(benchProbeInterval)
+	defer ticker.Stop()
+	for seq := uint32(0); seq < uint32(count); seq++ {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return BenchLossStats{}, ctx.Err()
+		}
+		if err := dc.Send(benchFrame(benchFrameProbe, seq, benchHeaderSize)); err != nil {
+			return BenchLossStats{}, err
+		}
+	}
+	time.Sleep(benchResponseWindow)
+
+	mu.Lock()
+	defer mu.Unlock()
+	stats := BenchLossStats{Sent: count, Received: len(seen)}
+	if count > 0 {
+		stats.Ratio = 1 - float64(stats.Received)/float64(count)
+	}
+	return stats, nil
+}
+
+// handleBenchChannel answers benchmark frames from a remote bench run
+func (m *WebRTCManager) handleBenchChannel(peerID string, dc *webrtc.DataChannel) {
+	m.logger.Info("answering benchmark channel", "peer", peerID, "label", dc.Label())
+
+	var received int64
+	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		if len(msg.Data) < benchHeaderSize {
+			return
+		}
+		switch msg.Data[0] {
+		case benchFramePing, benchFrameProbe:
+			_ = dc.Send(msg.Data)
+		case benchFrameData:
+			received += int64(len(msg.Data))
+			ack := benchFrame(benchFrameAck, binary.BigEndian.Uint32(msg.Data[1:5]), benchHeaderSize+8)
+			binary.BigEndian.PutUint64(ack[benchHeaderSize:], uint64(received))
+			_ = dc.Send(ack)
+		}
+	})
+}
+
+// benchFrame builds a benchmark frame of the given size
+func benchFrame(kind byte, seq uint32, size int) []byte {
+	frame := make([]byte, size)
+	frame[0] = kind
+	binary.BigEndian.PutUint32(frame[1:5], seq)
+	return frame
+}
+
+// summarizeRTT computes min/avg/p95/max from RTT samples
+func summarizeRTT(samples []time.Duration) BenchRTT {
+	if len(samples) == 0 {
+		return BenchRTT{}
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+
+	var total time.Duration
+	for _, s := range samples {
+		total += s
+	}
+	ms := func(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+
+	return BenchRTT{
+		Samples: len(samples),
+		MinMs:   ms(samples[0]),
+		AvgMs:   ms(total / time.Duration(len(samples))),
+		P95Ms:   ms(samples[(len(samples)*95)/100]),
+		MaxMs:   ms(samples[len(samples)-1]),
+	}
+}
+
+// isTailscaleIP reports whether ip belongs to a Tailscale address range
+func isTailscaleIP(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range tailscaleNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func mustParseCIDR(s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
@@ -1,31 +1,71 @@
 package agent
 
 import (
+	"context"
+	"fmt"
 	"log/slog"
+	"sort"
 	"sync"
 
 	"github.com/jhead/lanscape/lanscape-agent/pkg/protocol"
 	"github.com/pion/webrtc/v4"
 )
 
+// BrowserHandler handles one type of browser message
+type BrowserHandler func(ctx context.Context, msg protocol.BrowserMessage) error
+
 // Bridge bridges WebRTC data channels to WebSocket messages
 type Bridge struct {
-	mu              sync.RWMutex
-	dataChannels    map[string]interface{} // *webrtc.DataChannel (not exported)
-	browserSend     func(msg protocol.AgentMessage) error
-	logger          *slog.Logger
-	webrtc          *WebRTCManager
-	signaling       *SignalingClient
+	mu           sync.RWMutex
+	dataChannels map[string]interface{} // DataChannel
+	browserSend  func(msg protocol.AgentMessage) error
+	logger       *slog.Logger
+	webrtc       *WebRTCManager
+	signaling    *SignalingClient
+
+	trustStore          *TrustStore
+	requireVerification bool
+	identities          map[string]PeerIdentity // peer ID -> checked identity
+	certificates        map[string]string       // peer ID -> DTLS certificate fingerprint
+	pending             map[string]bool         // peers awaiting browser confirmation
+
+	recorder *Recorder
+	session  int64
+	notifier Notifier
+
+	// rejections notifies peers whose messages fail schema validation
+	rejections *Rejections
+	// storeForward delivers queued messages when peers become ready
+	storeForward *StoreForward
+	// latency probes peers for best-peer rankings
+	latency *LatencyMonitor
+	// appRelay reaches peers WebRTC could not connect to through signaling
+	appRelay *AppRelay
+
+	handlers map[string]BrowserHandler  // browser message type -> handler
+	groups   map[string]map[string]bool // group name -> member peer IDs
 }
 
 // NewBridge creates a new bridge
-func NewBridge(webrtc *WebRTCManager, logger *slog.Logger) *Bridge {
+func NewBridge(webrtc *WebRTCManager, trustStore *TrustStore, requireVerification bool, logger *slog.Logger) *Bridge {
 	b := &Bridge{
-		dataChannels: make(map[string]interface{}),
-		logger:       logger,
-		webrtc:       webrtc,
+		dataChannels:        make(map[string]interface{}),
+		logger:              logger,
+		webrtc:              webrtc,
+		trustStore:          trustStore,
+		requireVerification: requireVerification,
+		identities:          make(map[string]PeerIdentity),
+		certificates:        make(map[string]string),
+		pending:             make(map[string]bool),
+		handlers:            make(map[string]BrowserHandler),
+		groups:              make(map[string]map[string]bool),
 	}
 
+	b.RegisterHandler(protocol.MessageTypeData, b.handleData)
+	b.RegisterHandler(protocol.MessageTypeVerifyPeer, b.handleVerifyPeer)
+	b.RegisterHandler(protocol.MessageTypeCapabilities, b.handleCapabilities)
+	b.RegisterHandler(protocol.MessageTypeSetGroup, b.handleSetGroup)
+
 	// Set up WebRTC callbacks
 	webrtc.SetOnDataChannel(func(peerID string, dc interface{}) {
 		if dc != nil {
@@ -51,9 +91,19 @@ func (b *Bridge) SetBrowserSend(fn func(msg protocol.AgentMessage) error) {
 	b.browserSend = fn
 }
 
+// SetRecorder records this bridge's traffic under a new session number
+func (b *Bridge) SetRecorder(r *Recorder) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.recorder = r
+	if r != nil {
+		b.session = r.NextSession()
+	}
+}
+
 // handleDataChannel handles a new data channel
 func (b *Bridge) handleDataChannel(peerID string, dcInterface interface{}) {
-	dc, ok := dcInterface.(*webrtc.DataChannel)
+	dc, ok := dcInterface.(DataChannel)
 	if !ok || dc == nil {
 		return
 	}
@@ -77,14 +127,19 @@ func (b *Bridge) handleDataChannel(peerID string, dcInterface interface{}) {
 			Type:   protocol.MessageTypePeerConnected,
 			PeerID: peerID,
 		})
+		b.storeForward.flush(peerID)
+		b.latency.start(peerID)
 	}
 
 	dc.OnOpen(func() {
 		b.logger.Info("data channel opened", "peer", peerID)
+		b.notify("Peer connected", b.peerName(peerID)+" connected")
 		b.sendToBrowser(protocol.AgentMessage{
 			Type:   protocol.MessageTypePeerConnected,
 			PeerID: peerID,
 		})
+		b.storeForward.flush(peerID)
+		b.latency.start(peerID)
 	})
 
 	dc.OnClose(func() {
@@ -101,64 +156,417 @@ func (b *Bridge) handleDataChannel(peerID string, dcInterface interface{}) {
 
 // handleDataChannelMessage handles a message from a data channel
 func (b *Bridge) handleDataChannelMessage(peerID string, data []byte) {
-	b.logger.Info("received data channel message", "peer", peerID, "size", len(data))
+	b.handlePeerData(peerID, data, false, false)
+}
+
+// handlePeerData delivers application data from a peer to the browser.
+// sealed marks data that arrived encrypted with the topic key, relayed data
+// that came through the signaling server.
+func (b *Bridge) handlePeerData(peerID string, data []byte, sealed, relayed bool) {
+	ok, err := b.acceptPeerData(peerID, data)
+	if err != nil && b.rejections != nil {
+		b.rejections.Reject(peerID, err.Error())
+	}
+	if !ok {
+		return
+	}
+	b.logger.Info("received data channel message", "peer", peerID, "size", len(data), "sealed", sealed, "relayed", relayed)
 	// Send data as []byte - Go's JSON encoder will base64-encode it
 	b.sendToBrowser(protocol.AgentMessage{
-		Type:   protocol.MessageTypeData,
-		PeerID: peerID,
-		Data:   data,
+		Type:    protocol.MessageTypeData,
+		PeerID:  peerID,
+		Data:    data,
+		Sealed:  sealed,
+		Relayed: relayed,
 	})
 }
 
+// acceptPeerData records application data received from a peer and reports
+// whether it may reach the browser. Data from an unverified or blocked peer
+// is dropped; data failing the topic schema is dropped with the error.
+func (b *Bridge) acceptPeerData(peerID string, data []byte) (bool, error) {
+	if r, session := b.recording(); r != nil {
+		r.RecordPeer(session, RecordPeerIn, peerID, data)
+	}
+	if b.isPending(peerID) {
+		b.logger.Debug("dropping data from unverified peer", "peer", peerID, "size", len(data))
+		return false, nil
+	}
+	if b.webrtc.IsBlocked(peerID) {
+		b.logger.Debug("dropping data from blocked peer", "peer", peerID, "size", len(data))
+		return false, nil
+	}
+	if err := b.webrtc.checkSchema(data); err != nil {
+		b.logger.Warn("rejecting invalid message", "peer", peerID, "size", len(data), "error", err)
+		return false, err
+	}
+	b.webrtc.TouchPeer(peerID)
+	b.webrtc.recordReceived(peerID, len(data))
+	return true, nil
+}
+
 // handlePeerConnected handles when a peer connects
 func (b *Bridge) handlePeerConnected(peerID string) {
 	b.logger.Info("peer connected", "peer", peerID)
+	b.appRelay.connected(peerID)
+	b.checkCertificate(peerID)
 	// Wait for data channel to be ready
 	// The data channel open event will send the peer-connected message
 }
 
+// checkCertificate compares the DTLS certificate a verified peer presented
+// with the one pinned for its key. The first certificate seen for a trusted
+// key is pinned; a different one is reported to the browser and, like a
+// changed key, never pinned without confirmation.
+func (b *Bridge) checkCertificate(peerID string) {
+	if b.trustStore == nil {
+		return
+	}
+	b.mu.RLock()
+	identity, ok := b.identities[peerID]
+	pending := b.pending[peerID]
+	b.mu.RUnlock()
+	if !ok || !identity.Verified {
+		return
+	}
+	certificate := b.webrtc.remoteCertificate(peerID)
+	if certificate == "" {
+		return
+	}
+
+	b.mu.Lock()
+	b.certificates[peerID] = certificate
+	b.mu.Unlock()
+
+	switch b.trustStore.CheckCertificate(identity.PublicKey, certificate) {
+	case TrustStatusTrusted:
+		return
+	case TrustStatusNew:
+		// Pinned with the key once the browser confirms a pending peer
+		if pending || b.trustStore.Check(identity.Name, identity.PublicKey) != TrustStatusTrusted {
+			return
+		}
+		if err := b.trustStore.PinCertificate(identity.PublicKey, certificate); err != nil {
+			b.logger.Warn("failed to pin peer certificate", "peer", peerID, "error", err)
+		}
+		return
+	}
+
+	b.logger.Warn("peer DTLS certificate changed", "peer", peerID, "name", identity.Name, "certificate", certificate)
+	if b.requireVerification {
+		b.mu.Lock()
+		b.pending[peerID] = true
+		b.mu.Unlock()
+		b.notify("Verify peer", identity.Name+" presented a new certificate and is waiting for confirmation")
+	}
+
+	msg := protocol.AgentMessage{
+		Type:        protocol.MessageTypePeerVerification,
+		PeerID:      peerID,
+		Name:        identity.Name,
+		Status:      string(TrustStatusCertificateChanged),
+		Certificate: certificate,
+	}
+	if publicKey, err := ParsePublicKey(identity.PublicKey); err == nil {
+		msg.Fingerprint = Fingerprint(publicKey)
+	}
+	b.sendToBrowser(msg)
+}
+
 // handlePeerClosed handles when a peer disconnects
 func (b *Bridge) handlePeerClosed(peerID string) {
 	b.logger.Info("peer closed", "peer", peerID)
+	name := b.peerName(peerID)
 	b.mu.Lock()
 	delete(b.dataChannels, peerID)
+	delete(b.identities, peerID)
+	delete(b.certificates, peerID)
+	delete(b.pending, peerID)
+	for _, members := range b.groups {
+		delete(members, peerID)
+	}
 	b.mu.Unlock()
+	if b.rejections != nil {
+		b.rejections.forget(peerID)
+	}
+	b.latency.stop(peerID)
+	b.notify("Peer disconnected", name+" disconnected")
 	b.sendToBrowser(protocol.AgentMessage{
 		Type:   protocol.MessageTypePeerDisconnected,
 		PeerID: peerID,
 	})
 }
 
-// HandleBrowserMessage handles a message from the browser
-func (b *Bridge) HandleBrowserMessage(msg protocol.BrowserMessage) error {
-	b.logger.Info("received browser message", "type", msg.Type, "peerId", msg.PeerID, "dataSize", len(msg.Data))
+// handlePeerIdentity evaluates a peer's identity against the trust store and
+// reports it to the browser. New keys are pinned automatically unless
+// verification is required; changed keys are never pinned without confirmation.
+func (b *Bridge) handlePeerIdentity(peerID string, identity PeerIdentity) {
+	status := TrustStatusUnsigned
+	if b.trustStore != nil && identity.Verified {
+		status = b.trustStore.Check(identity.Name, identity.PublicKey)
+	}
 
-	switch msg.Type {
-	case protocol.MessageTypeData:
-		if len(msg.Data) == 0 {
-			b.logger.Warn("received empty data message")
-			return nil
+	needsConfirmation := b.requireVerification && status != TrustStatusTrusted
+	if status == TrustStatusNew && !b.requireVerification {
+		if err := b.trustStore.Pin(identity.Name, identity.PublicKey); err != nil {
+			b.logger.Warn("failed to pin peer identity", "peer", peerID, "error", err)
 		}
+	}
 
-		// Data is already []byte from JSON unmarshaling (base64 decoded by Go)
-		data := msg.Data
+	b.mu.Lock()
+	b.identities[peerID] = identity
+	if needsConfirmation {
+		b.pending[peerID] = true
+	} else {
+		delete(b.pending, peerID)
+	}
+	b.mu.Unlock()
 
-		b.logger.Info("sending data to peer", "peer", msg.PeerID, "size", len(data), "isBroadcast", msg.PeerID == "")
+	if status == TrustStatusChanged {
+		b.logger.Warn("peer identity key changed", "peer", peerID, "name", identity.Name)
+	}
+	if needsConfirmation {
+		b.notify("Verify peer", fmt.Sprintf("%s (%s identity) is waiting for confirmation", identity.Name, status))
+	}
+
+	msg := protocol.AgentMessage{
+		Type:   protocol.MessageTypePeerVerification,
+		PeerID: peerID,
+		Name:   identity.Name,
+		Status: string(status),
+	}
+	if publicKey, err := ParsePublicKey(identity.PublicKey); err == nil {
+		msg.Fingerprint = Fingerprint(publicKey)
+	}
+	b.sendToBrowser(msg)
+}
 
-		if msg.PeerID == "" {
-			// Broadcast to all peers
-			b.webrtc.BroadcastData(data)
-		} else {
-			// Send to specific peer
-			if err := b.webrtc.SendData(msg.PeerID, data); err != nil {
-				b.logger.Warn("failed to send data to peer", "peer", msg.PeerID, "error", err)
-				return err
+// handleVerifyPeer applies the browser's decision on a pending peer identity
+func (b *Bridge) handleVerifyPeer(ctx context.Context, msg protocol.BrowserMessage) error {
+	b.mu.Lock()
+	identity, ok := b.identities[msg.PeerID]
+	certificate := b.certificates[msg.PeerID]
+	b.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("no identity to verify for peer: %s", msg.PeerID)
+	}
+
+	if !msg.Accept {
+		b.logger.Info("browser rejected peer identity", "peer", msg.PeerID)
+		b.webrtc.ClosePeer(msg.PeerID)
+		return nil
+	}
+
+	if identity.Verified && b.trustStore != nil {
+		if err := b.trustStore.Pin(identity.Name, identity.PublicKey); err != nil {
+			return fmt.Errorf("failed to pin peer identity: %w", err)
+		}
+		if certificate != "" {
+			if err := b.trustStore.PinCertificate(identity.PublicKey, certificate); err != nil {
+				return fmt.Errorf("failed to pin peer certificate: %w", err)
 			}
 		}
-	default:
+	}
+
+	b.mu.Lock()
+	delete(b.pending, msg.PeerID)
+	b.mu.Unlock()
+
+	b.logger.Info("browser confirmed peer identity", "peer", msg.PeerID, "name", identity.Name)
+	b.storeForward.flush(msg.PeerID)
+	return nil
+}
+
+// SetNotifier enables desktop notifications for peer and transfer events
+func (b *Bridge) SetNotifier(notifier Notifier) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.notifier = notifier
+}
+
+// notify raises a desktop notification in the background if a notifier is set
+func (b *Bridge) notify(title, body string) {
+	b.mu.RLock()
+	notifier := b.notifier
+	b.mu.RUnlock()
+	if notifier == nil {
+		return
+	}
+
+	b.webrtc.supervisor.Go("notify", func() {
+		if err := notifier.Notify(title, body); err != nil {
+			b.logger.Debug("failed to show notification", "error", err)
+		}
+	})
+}
+
+// peerName returns a peer's identity name, or its ID if the name is not known
+func (b *Bridge) peerName(peerID string) string {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if identity, ok := b.identities[peerID]; ok && identity.Name != "" {
+		return identity.Name
+	}
+	return peerID
+}
+
+// isPending reports whether data exchange with a peer is blocked pending confirmation
+func (b *Bridge) isPending(peerID string) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.pending[peerID]
+}
+
+// RegisterHandler registers the handler for a browser message type,
+// replacing any existing handler for that type
+func (b *Bridge) RegisterHandler(msgType string, fn BrowserHandler) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handlers[msgType] = fn
+}
+
+// Capabilities returns the browser message types this bridge handles
+func (b *Bridge) Capabilities() []string {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	types := make([]string, 0, len(b.handlers))
+	for msgType := range b.handlers {
+		types = append(types, msgType)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// HandleBrowserMessage dispatches a message from the browser to its registered
+// handler. ctx bounds any waiting the handler does, such as on full send queues.
+func (b *Bridge) HandleBrowserMessage(ctx context.Context, msg protocol.BrowserMessage) error {
+	b.logger.Info("received browser message", "type", msg.Type, "peerId", msg.PeerID, "dataSize", len(msg.Data))
+	if r, session := b.recording(); r != nil {
+		r.RecordBrowser(session, RecordBrowserIn, msg.Type, msg.PeerID, msg, len(msg.Data))
+	}
+
+	b.mu.RLock()
+	handler, ok := b.handlers[msg.Type]
+	b.mu.RUnlock()
+
+	if !ok {
+		// Tell the browser what is supported so it can fall back
 		b.logger.Warn("unknown browser message type", "type", msg.Type)
+		b.sendToBrowser(protocol.AgentMessage{
+			Type:         protocol.MessageTypeError,
+			Error:        fmt.Sprintf("unsupported message type: %s", msg.Type),
+			Capabilities: b.Capabilities(),
+		})
+		return nil
+	}
+
+	return handler(ctx, msg)
+}
+
+// handleData sends browser data to one peer, a group, or broadcasts it when neither is given
+func (b *Bridge) handleData(ctx context.Context, msg protocol.BrowserMessage) error {
+	if len(msg.Data) == 0 {
+		b.logger.Warn("received empty data message")
+		return nil
+	}
+
+	// Data is already []byte from JSON unmarshaling (base64 decoded by Go)
+	data := msg.Data
+
+	b.logger.Info("sending data to peer", "peer", msg.PeerID, "group", msg.Group, "size", len(data), "isBroadcast", msg.PeerID == "" && msg.Group == "")
+
+	if r, session := b.recording(); r != nil {
+		r.RecordPeer(session, RecordPeerOut, msg.PeerID, data)
 	}
 
+	if msg.Group != "" {
+		b.mu.RLock()
+		_, ok := b.groups[msg.Group]
+		b.mu.RUnlock()
+		if !ok {
+			return fmt.Errorf("unknown group: %s", msg.Group)
+		}
+
+		// Send to group members that aren't awaiting verification
+		include := func(peerID string) bool {
+			return b.inGroup(msg.Group, peerID) && !b.isPending(peerID)
+		}
+		seq, err := b.webrtc.BroadcastDataTo(ctx, data, include)
+		b.appRelay.broadcast(data, include)
+		if err != nil {
+			return fmt.Errorf("broadcast %d to group %s incomplete: %w", seq, msg.Group, err)
+		}
+		b.sendToBrowser(protocol.AgentMessage{Type: protocol.MessageTypeSent, Group: msg.Group, Seq: seq})
+		return nil
+	}
+
+	if msg.PeerID == "" {
+		// Broadcast to all peers that aren't awaiting verification
+		include := func(peerID string) bool {
+			return !b.isPending(peerID)
+		}
+		seq, err := b.webrtc.BroadcastDataTo(ctx, data, include)
+		b.appRelay.broadcast(data, include)
+		if err != nil {
+			return fmt.Errorf("broadcast %d incomplete: %w", seq, err)
+		}
+		b.sendToBrowser(protocol.AgentMessage{Type: protocol.MessageTypeSent, Seq: seq})
+		return nil
+	}
+
+	if b.isPending(msg.PeerID) {
+		return fmt.Errorf("peer not verified: %s", msg.PeerID)
+	}
+	// Peers WebRTC could not connect to are reached through signaling
+	if b.appRelay.active(msg.PeerID) {
+		return b.appRelay.Send(msg.PeerID, data)
+	}
+	// Send to specific peer
+	if err := b.webrtc.SendData(ctx, msg.PeerID, data); err != nil {
+		b.logger.Warn("failed to send data to peer", "peer", msg.PeerID, "error", err)
+		return err
+	}
+	return nil
+}
+
+// handleSetGroup defines a named peer group, or deletes it when no peers are given
+func (b *Bridge) handleSetGroup(ctx context.Context, msg protocol.BrowserMessage) error {
+	if msg.Group == "" {
+		return fmt.Errorf("set-group requires a group name")
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if len(msg.Peers) == 0 {
+		delete(b.groups, msg.Group)
+		b.logger.Info("deleted peer group", "group", msg.Group)
+		return nil
+	}
+
+	members := make(map[string]bool, len(msg.Peers))
+	for _, peerID := range msg.Peers {
+		members[peerID] = true
+	}
+	b.groups[msg.Group] = members
+	b.logger.Info("set peer group", "group", msg.Group, "members", len(members))
+	return nil
+}
+
+// inGroup reports whether a peer is a member of a group
+func (b *Bridge) inGroup(group, peerID string) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.groups[group][peerID]
+}
+
+// handleCapabilities reports the supported browser message types
+func (b *Bridge) handleCapabilities(ctx context.Context, msg protocol.BrowserMessage) error {
+	b.sendToBrowser(protocol.AgentMessage{
+		Type:         protocol.MessageTypeCapabilities,
+		Capabilities: b.Capabilities(),
+	})
 	return nil
 }
 
@@ -174,8 +582,13 @@ func (b *Bridge) sendWelcome(selfID string) {
 func (b *Bridge) sendToBrowser(msg protocol.AgentMessage) {
 	b.mu.RLock()
 	send := b.browserSend
+	recorder, session := b.recorder, b.session
 	b.mu.RUnlock()
 
+	if recorder != nil {
+		recorder.RecordBrowser(session, RecordBrowserOut, msg.Type, msg.PeerID, msg, len(msg.Data))
+	}
+
 	if send != nil {
 		if err := send(msg); err != nil {
 			b.logger.Error("failed to send message to browser", "error", err)
@@ -183,6 +596,13 @@ func (b *Bridge) sendToBrowser(msg protocol.AgentMessage) {
 	}
 }
 
+// recording returns the recorder and session number, if recording is enabled
+func (b *Bridge) recording() (*Recorder, int64) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.recorder, b.session
+}
+
 // GetConnectedPeers returns the list of connected peer IDs
 func (b *Bridge) GetConnectedPeers() []string {
 	b.mu.RLock()
@@ -190,7 +610,7 @@ func (b *Bridge) GetConnectedPeers() []string {
 
 	var peers []string
 	for peerID, dcInterface := range b.dataChannels {
-		dc, ok := dcInterface.(*webrtc.DataChannel)
+		dc, ok := dcInterface.(DataChannel)
 		if ok && dc != nil && dc.ReadyState() == webrtc.DataChannelStateOpen {
 			peers = append(peers, peerID)
 		}
@@ -198,4 +618,3 @@ func (b *Bridge) GetConnectedPeers() []string {
 
 	return peers
 }
-
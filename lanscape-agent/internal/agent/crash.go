@@ -0,0 +1,148 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/jhead/lanscape/signaling/pkg/buildinfo"
+)
+
+const crashReportTimeout = 10 * time.Second
+
+// CrashConfig configures crash capture. Crashes are always written to Dir
+// when it is set; they are only submitted to ReportURL when Report is true.
+type CrashConfig struct {
+	Dir       string
+	ReportURL string
+	Report    bool
+}
+
+// CrashReport is an anonymized crash report. It carries no peer IDs,
+// addresses, hostnames, or message contents.
+type CrashReport struct {
+	Time      time.Time `json:"time"`
+	Goroutine string    `json:"goroutine"`
+	Panic     string    `json:"panic"`
+	Stack     string    `json:"stack"`
+	GoVersion string    `json:"goVersion"`
+	OS        string    `json:"os"`
+	Arch      string    `json:"arch"`
+	Version   string    `json:"version,omitempty"`
+}
+
+// CrashReporter recovers panics in agent goroutines, writes them to a local
+// crash log, and optionally submits anonymized reports
+type CrashReporter struct {
+	config CrashConfig
+	client *http.Client
+	logger *slog.Logger
+}
+
+// NewCrashReporter creates a crash reporter, creating the crash directory if needed
+func NewCrashReporter(config CrashConfig, logger *slog.Logger) (*CrashReporter, error) {
+	if config.Dir != "" {
+		if err := os.MkdirAll(config.Dir, 0700); err != nil {
+			return nil, fmt.Errorf("failed to create crash directory: %w", err)
+		}
+	}
+	if config.Report && config.ReportURL == "" {
+		return nil, fmt.Errorf("crash reporting enabled without a report URL")
+	}
+	return &CrashReporter{
+		config: config,
+		client: &http.Client{Timeout: crashReportTimeout},
+		logger: logger,
+	}, nil
+}
+
+// Recover must be deferred directly. It stops a panic in the current
+// goroutine and records it. A nil reporter lets the panic propagate.
+func (c *CrashReporter) Recover(name string) {
+	if c == nil {
+		return
+	}
+	if v := recover(); v != nil {
+		c.capture(name, v, debug.Stack())
+	}
+}
+
+// capture records a recovered panic
+func (c *CrashReporter) capture(name string, v any, stack []byte) {
+	c.logger.Error("recovered panic", "goroutine", name, "panic", fmt.Sprint(v))
+
+	now := time.Now().UTC()
+	if c.config.Dir != "" {
+		path := filepath.Join(c.config.Dir, fmt.Sprintf("crash-%s-%s.log", now.Format("20060102T150405.000"), name))
+		content := fmt.Sprintf("time: %s\ngoroutine: %s\npanic: %v\n\n%s", now.Format(time.RFC3339Nano), name, v, stack)
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			c.logger.Warn("failed to write crash log", "error", err)
+		} else {
+			c.logger.Error("wrote crash log", "path", path)
+		}
+	}
+
+	if !c.config.Report {
+		return
+	}
+
+	report := CrashReport{
+		Time:      now,
+		Goroutine: name,
+		Panic:     anonymize(fmt.Sprint(v)),
+		Stack:     anonymize(string(stack)),
+		GoVersion: runtime.Version(),
+		OS:        runtime.GOOS,
+		Arch:      runtime.GOARCH,
+		Version:   buildinfo.Get().Version,
+	}
+	go c.submit(report)
+}
+
+// submit posts a crash report to the configured endpoint
+func (c *CrashReporter) submit(report CrashReport) {
+	body, err := json.Marshal(report)
+	if err != nil {
+		return
+	}
+	resp, err := c.client.Post(c.config.ReportURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		c.logger.Warn("failed to submit crash report", "error", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		c.logger.Warn("crash report rejected", "status", resp.StatusCode)
+	}
+}
+
+var (
+	anonIPv4    = regexp.MustCompile(`\b\d{1,3}(\.\d{1,3}){3}(:\d+)?\b`)
+	anonIPv6    = regexp.MustCompile(`\[?\b[0-9a-fA-F]{0,4}(:[0-9a-fA-F]{0,4}){2,7}\b\]?(:\d+)?`)
+	anonULID    = regexp.MustCompile(`\b[0-9A-HJKMNP-TV-Z]{26}\b`)
+	anonPointer = regexp.MustCompile(`0x[0-9a-f]{6,}`)
+)
+
+// anonymize strips addresses, IDs, pointers, and the home directory from crash text
+func anonymize(s string) string {
+	if home, err := os.UserHomeDir(); err == nil && home != "" {
+		s = strings.ReplaceAll(s, home, "~")
+	}
+	if hostname, err := os.Hostname(); err == nil && hostname != "" {
+		s = strings.ReplaceAll(s, hostname, "<host>")
+	}
+	s = anonULID.ReplaceAllString(s, "<id>")
+	s = anonIPv4.ReplaceAllString(s, "<addr>")
+	s = anonIPv6.ReplaceAllString(s, "<addr>")
+	s = anonPointer.ReplaceAllString(s, "0x?")
+	return s
+}
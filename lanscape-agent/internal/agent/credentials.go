@@ -0,0 +1,239 @@
+package agent
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	credentialsFileName = "credentials.enc"
+
+	// credentialKeyLabel separates the cache key from other uses of the
+	// identity key
+	credentialKeyLabel = "lanscape-agent credential cache v1"
+
+	// jwksCacheLifetime bounds how long cached attestation keys are trusted
+	// without reaching lanscaped, so a rotated-out key stops working offline
+	jwksCacheLifetime = 7 * 24 * time.Hour
+
+	// grantFetchTimeout bounds how long startup waits on lanscaped before
+	// falling back to a cached grant
+	grantFetchTimeout = 10 * time.Second
+)
+
+// CredentialCache keeps the last valid lanscaped credentials on disk so an
+// agent cut off from lanscaped can keep connecting to peers on its LAN: the
+// device token, topic grants (membership attestations, by network), and the
+// keys that verify peer attestations. Every entry has an explicit expiry and
+// is not returned after it. The file is encrypted with a key derived from
+// the agent identity, so it is useless without identity.pem.
+type CredentialCache struct {
+	mu   sync.Mutex
+	path string
+	aead cipher.AEAD
+	data cachedCredentials
+}
+
+// cachedCredentials is the decrypted content of the cache file
+type cachedCredentials struct {
+	Token  *cachedCredential           `json:"token,omitempty"`
+	Grants map[string]cachedCredential `json:"grants,omitempty"`
+	JWKS   *cachedJWKS                 `json:"jwks,omitempty"`
+}
+
+// cachedCredential is a token and when it stops being valid
+type cachedCredential struct {
+	Value     string    `json:"value"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// cachedJWKS is lanscaped's attestation key set as last fetched
+type cachedJWKS struct {
+	Keys      []jwk     `json:"keys"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// LoadCredentialCache loads the credential cache from dir, starting empty if
+// none exists. A cache that cannot be decrypted, e.g. because the identity
+// was replaced, is discarded.
+func LoadCredentialCache(dir string, identity *Identity) (*CredentialCache, error) {
+	key := sha256.Sum256(append([]byte(credentialKeyLabel), identity.privateKey.Seed()...))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	c := &CredentialCache{path: filepath.Join(dir, credentialsFileName), aead: aead}
+
+	sealed, err := os.ReadFile(c.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read credential cache: %w", err)
+	}
+	nonceSize := aead.NonceSize()
+	if len(sealed) < nonceSize {
+		return c, nil
+	}
+	data, err := aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], nil)
+	if err != nil {
+		return c, nil
+	}
+	if err := json.Unmarshal(data, &c.data); err != nil {
+		return nil, fmt.Errorf("failed to parse credential cache: %w", err)
+	}
+	return c, nil
+}
+
+// Token returns the cached lanscaped token if it has not expired
+func (c *CredentialCache) Token() (string, time.Time, bool) {
+	if c == nil {
+		return "", time.Time{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.data.Token == nil || !time.Now().Before(c.data.Token.ExpiresAt) {
+		return "", time.Time{}, false
+	}
+	return c.data.Token.Value, c.data.Token.ExpiresAt, true
+}
+
+// SetToken caches a lanscaped token valid until expiresAt
+func (c *CredentialCache) SetToken(token string, expiresAt time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.data.Token = &cachedCredential{Value: token, ExpiresAt: expiresAt}
+	return c.save()
+}
+
+// Grant returns the cached attestation for network if it has not expired
+func (c *CredentialCache) Grant(network string) (string, time.Time, bool) {
+	if c == nil {
+		return "", time.Time{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	grant, ok := c.data.Grants[network]
+	if !ok || !time.Now().Before(grant.ExpiresAt) {
+		return "", time.Time{}, false
+	}
+	return grant.Value, grant.ExpiresAt, true
+}
+
+// SetGrant caches the attestation for network, valid until expiresAt
+func (c *CredentialCache) SetGrant(network, attestation string, expiresAt time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.data.Grants == nil {
+		c.data.Grants = make(map[string]cachedCredential)
+	}
+	c.data.Grants[network] = cachedCredential{Value: attestation, ExpiresAt: expiresAt}
+	return c.save()
+}
+
+// jwks returns the cached attestation keys if they have not expired
+func (c *CredentialCache) jwks() ([]jwk, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.data.JWKS == nil || !time.Now().Before(c.data.JWKS.ExpiresAt) {
+		return nil, false
+	}
+	return c.data.JWKS.Keys, true
+}
+
+// setJWKS caches freshly fetched attestation keys for jwksCacheLifetime
+func (c *CredentialCache) setJWKS(keys []jwk) error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.data.JWKS = &cachedJWKS{Keys: keys, ExpiresAt: time.Now().Add(jwksCacheLifetime)}
+	return c.save()
+}
+
+// save drops expired entries and writes the cache atomically. Caller must
+// hold c.mu.
+func (c *CredentialCache) save() error {
+	now := time.Now()
+	if c.data.Token != nil && !now.Before(c.data.Token.ExpiresAt) {
+		c.data.Token = nil
+	}
+	for network, grant := range c.data.Grants {
+		if !now.Before(grant.ExpiresAt) {
+			delete(c.data.Grants, network)
+		}
+	}
+	if c.data.JWKS != nil && !now.Before(c.data.JWKS.ExpiresAt) {
+		c.data.JWKS = nil
+	}
+
+	data, err := json.Marshal(c.data)
+	if err != nil {
+		return fmt.Errorf("failed to marshal credential cache: %w", err)
+	}
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	sealed := c.aead.Seal(nonce, nonce, data, nil)
+
+	if err := os.MkdirAll(filepath.Dir(c.path), 0700); err != nil {
+		return fmt.Errorf("failed to create data directory: %w", err)
+	}
+	tmp := c.path + ".tmp"
+	if err := os.WriteFile(tmp, sealed, 0600); err != nil {
+		return fmt.Errorf("failed to write credential cache: %w", err)
+	}
+	return os.Rename(tmp, c.path)
+}
+
+// loadGrant returns this agent's attestation for network, fetched from
+// lanscaped and cached, or the cached one if lanscaped is unreachable. A
+// grant lanscaped refuses, e.g. because the key was revoked, is not replaced
+// from the cache. It returns empty if no attestation is available.
+func loadGrant(e *Enrollment, identity *Identity, credentials *CredentialCache, network string, logger *slog.Logger) string {
+	ctx, cancel := context.WithTimeout(context.Background(), grantFetchTimeout)
+	defer cancel()
+
+	attestation, expiresAt, err := FetchGrant(ctx, e, identity, network)
+	if err == nil {
+		if err := credentials.SetGrant(network, attestation, expiresAt); err != nil {
+			logger.Warn("failed to cache attestation", "error", err)
+		}
+		logger.Info("fetched attestation from lanscaped", "network", network, "expiresAt", expiresAt)
+		return attestation
+	}
+
+	var unreachable *url.Error
+	if !errors.As(err, &unreachable) {
+		logger.Warn("failed to get attestation, peers requiring one will reject this agent", "network", network, "error", err)
+		return ""
+	}
+	attestation, expiresAt, ok := credentials.Grant(network)
+	if !ok {
+		logger.Warn("failed to get attestation, peers requiring one will reject this agent", "network", network, "error", err)
+		return ""
+	}
+	logger.Warn("lanscaped unreachable, using cached attestation", "network", network, "expiresAt", expiresAt, "error", err)
+	return attestation
+}
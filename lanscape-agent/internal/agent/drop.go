@@ -0,0 +1,250 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/jhead/lanscape/lanscape-agent/pkg/protocol"
+	"github.com/oklog/ulid/v2"
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	dropChannelLabel = "lanscape-drop"
+
+	// MaxDropSize is the largest payload accepted on the drop channel
+	MaxDropSize = 1024 * 1024
+
+	dropChunkSize = 16 * 1024
+	dropTimeout   = 30 * time.Second
+	dropAck       = "ok"
+)
+
+// Drop kinds
+const (
+	DropKindText = "text"
+	DropKindLink = "link"
+	DropKindFile = "file"
+)
+
+// Drops delivers small payloads (clipboard text, links, files) between agents
+// over a short-lived data channel per drop, independent of application
+// traffic. The sender writes a JSON header followed by binary chunks; the
+// receiver acknowledges once the whole payload has arrived.
+type Drops struct {
+	webrtc    *WebRTCManager
+	onReceive func(peerID string, drop protocol.Drop)
+	logger    *slog.Logger
+}
+
+// NewDrops creates the drop subsystem; onReceive is called for each drop from a peer
+func NewDrops(m *WebRTCManager, onReceive func(peerID string, drop protocol.Drop), logger *slog.Logger) *Drops {
+	d := &Drops{webrtc: m, onReceive: onReceive, logger: logger}
+	m.HandleDataChannelLabel(dropChannelLabel, d.handleChannel)
+	return d
+}
+
+// validateDrop fills in defaults and checks a drop before sending
+func validateDrop(drop *protocol.Drop) error {
+	switch drop.Kind {
+	case "":
+		drop.Kind = DropKindText
+	case DropKindText, DropKindLink, DropKindFile:
+	default:
+		return fmt.Errorf("unknown drop kind: %s", drop.Kind)
+	}
+	if len(drop.Data) == 0 {
+		return errors.New("drop is empty")
+	}
+	if len(drop.Data) > MaxDropSize {
+		return fmt.Errorf("drop is %d bytes, limit is %d", len(drop.Data), MaxDropSize)
+	}
+	if drop.ID == "" {
+		drop.ID = ulid.Make().String()
+	}
+	drop.Size = len(drop.Data)
+	return nil
+}
+
+// Send delivers a drop to one peer and waits for its acknowledgement
+func (d *Drops) Send(ctx context.Context, peerID string, drop protocol.Drop) error {
+	if err := validateDrop(&drop); err != nil {
+		return err
+	}
+
+	ordered := true
+	dc, err := d.webrtc.CreateDataChannel(peerID, dropChannelLabel, &webrtc.DataChannelInit{Ordered: &ordered})
+	if err != nil {
+		return err
+	}
+	defer dc.Close()
+
+	opened := make(chan struct{})
+	acked := make(chan struct{})
+	var once sync.Once
+	dc.OnOpen(func() { close(opened) })
+	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		if msg.IsString && string(msg.Data) == dropAck {
+			once.Do(func() { close(acked) })
+		}
+	})
+
+	ctx, cancel := context.WithTimeout(ctx, dropTimeout)
+	defer cancel()
+
+	select {
+	case <-opened:
+	case <-ctx.Done():
+		return fmt.Errorf("drop channel to %s did not open: %w", peerID, ctx.Err())
+	}
+
+	header := drop
+	header.Data = nil
+	headerJSON, err := json.Marshal(header)
+	if err != nil {
+		return fmt.Errorf("failed to marshal drop header: %w", err)
+	}
+	if err := dc.SendText(string(headerJSON)); err != nil {
+		return err
+	}
+	for off := 0; off < len(drop.Data); off += dropChunkSize {
+		end := min(off+dropChunkSize, len(drop.Data))
+		if err := dc.Send(drop.Data[off:end]); err != nil {
+			return err
+		}
+	}
+
+	select {
+	case <-acked:
+		d.logger.Info("drop delivered", "peer", peerID, "id", drop.ID, "kind", drop.Kind, "size", drop.Size)
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("drop to %s was not acknowledged: %w", peerID, ctx.Err())
+	}
+}
+
+// handleChannel receives one drop from a peer
+func (d *Drops) handleChannel(peerID string, dc *webrtc.DataChannel) {
+	var mu sync.Mutex
+	var header *protocol.Drop
+	var data []byte
+
+	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if header == nil {
+			var h protocol.Drop
+			if !msg.IsString || json.Unmarshal(msg.Data, &h) != nil || h.Size <= 0 || h.Size > MaxDropSize {
+				d.logger.Warn("rejecting invalid drop", "peer", peerID)
+				dc.Close()
+				return
+			}
+			header = &h
+			data = make([]byte, 0, h.Size)
+			return
+		}
+
+		if len(data)+len(msg.Data) > header.Size {
+			d.logger.Warn("rejecting oversized drop", "peer", peerID, "id", header.ID)
+			dc.Close()
+			return
+		}
+		data = append(data, msg.Data...)
+		if len(data) < header.Size {
+			return
+		}
+
+		drop := *header
+		drop.Data = data
+		header = nil
+		dc.SendText(dropAck)
+
+		d.logger.Info("received drop", "peer", peerID, "id", drop.ID, "kind", drop.Kind, "size", drop.Size)
+		if d.onReceive != nil {
+			d.onReceive(peerID, drop)
+		}
+	})
+}
+
+// registerHandlers adds the drop browser message to a bridge. Drops go to
+// the listed peers, the given peer, or every verified peer.
+func (d *Drops) registerHandlers(b *Bridge) {
+	b.RegisterHandler(protocol.MessageTypeDrop, func(ctx context.Context, msg protocol.BrowserMessage) error {
+		if msg.Drop == nil {
+			return errors.New("drop requires a payload")
+		}
+		drop := *msg.Drop
+		if err := validateDrop(&drop); err != nil {
+			return err
+		}
+
+		peers := msg.Peers
+		if msg.PeerID != "" {
+			peers = []string{msg.PeerID}
+		}
+		if len(peers) == 0 {
+			peers = b.GetConnectedPeers()
+		}
+
+		for _, peerID := range peers {
+			if b.isPending(peerID) {
+				continue
+			}
+			d.webrtc.supervisor.Go("drop-send", func() {
+				status := protocol.DropStatusDelivered
+				errMsg := ""
+				if err := d.Send(context.Background(), peerID, drop); err != nil {
+					d.logger.Warn("failed to deliver drop", "peer", peerID, "error", err)
+					status, errMsg = protocol.DropStatusFailed, err.Error()
+				}
+				b.sendToBrowser(protocol.AgentMessage{
+					Type:   protocol.MessageTypeDropStatus,
+					PeerID: peerID,
+					Drop:   &protocol.Drop{ID: drop.ID, Kind: drop.Kind, Name: drop.Name, Size: drop.Size},
+					Status: status,
+					Error:  errMsg,
+				})
+			})
+		}
+		return nil
+	})
+}
+
+// DropConfig configures a standalone drop sent from the CLI
+type DropConfig struct {
+	SignalingURL  string
+	Topic         string
+	PeerID        string
+	Drop          protocol.Drop
+	TailscaleInfo *TailscaleInfo
+	Identity      *Identity
+	Logger        *slog.Logger
+}
+
+// RunDrop joins the topic without a browser, waits for the peer, and sends one drop
+func RunDrop(ctx context.Context, config DropConfig) error {
+	logger := config.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	m, err := NewWebRTCManager(config.TailscaleInfo, logger)
+	if err != nil {
+		return err
+	}
+	defer m.CloseAll()
+
+	client, err := dialPeer(ctx, m, config.SignalingURL, config.Topic, config.Identity, config.PeerID, logger)
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect()
+
+	return NewDrops(m, nil, logger).Send(ctx, config.PeerID, config.Drop)
+}
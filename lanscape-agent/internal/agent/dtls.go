@@ -0,0 +1,106 @@
+package agent
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	certificateFileName = "dtls.pem"
+
+	// certificateLifetime is long because peers pin the certificate; a new
+	// one is reported to them as a change
+	certificateLifetime = 10 * 365 * 24 * time.Hour
+)
+
+// LoadOrCreateCertificate loads the DTLS certificate from dir, generating and
+// persisting a new one if none exists or it has expired. Pion would otherwise
+// generate a certificate per connection, leaving peers nothing to pin.
+func LoadOrCreateCertificate(dir string) (*webrtc.Certificate, error) {
+	path := filepath.Join(dir, certificateFileName)
+
+	data, err := os.ReadFile(path)
+	if err == nil {
+		cert, err := webrtc.CertificateFromPEM(string(data))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse DTLS certificate: %w", err)
+		}
+		if time.Now().Before(cert.Expires()) {
+			return cert, nil
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read DTLS certificate: %w", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate DTLS key: %w", err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 127))
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate DTLS certificate serial: %w", err)
+	}
+	now := time.Now()
+	cert, err := webrtc.NewCertificate(key, x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "lanscape-agent"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(certificateLifetime),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create DTLS certificate: %w", err)
+	}
+
+	pemData, err := cert.PEM()
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode DTLS certificate: %w", err)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create data directory: %w", err)
+	}
+	if err := os.WriteFile(path, []byte(pemData), 0600); err != nil {
+		return nil, fmt.Errorf("failed to write DTLS certificate: %w", err)
+	}
+	return cert, nil
+}
+
+// CertificateFingerprint returns the hex-encoded SHA-256 of a DER certificate
+func CertificateFingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
+
+// useCertificate makes every peer connection present cert instead of a
+// per-connection certificate
+func (m *WebRTCManager) useCertificate(cert *webrtc.Certificate) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.certificate = cert
+}
+
+// remoteCertificate returns the fingerprint of the DTLS certificate a peer
+// presented, or empty if the handshake has not completed
+func (m *WebRTCManager) remoteCertificate(peerID string) string {
+	peer, err := m.GetPeerConnection(peerID)
+	if err != nil || peer.PC == nil || peer.PC.SCTP() == nil {
+		return ""
+	}
+	der := peer.PC.SCTP().Transport().GetRemoteCertificate()
+	if len(der) == 0 {
+		return ""
+	}
+	return CertificateFingerprint(der)
+}
@@ -0,0 +1,295 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jhead/lanscape/signaling/pkg/buildinfo"
+)
+
+const enrollmentFileName = "enrollment.json"
+
+// Enrollment records that this agent's identity key is registered with a
+// lanscaped account. Token is a device token for the lanscaped API; it is
+// kept in the encrypted credential cache, not in the enrollment file, and is
+// empty once it has expired.
+type Enrollment struct {
+	Server    string    `json:"server"`
+	Username  string    `json:"username"`
+	AgentID   int64     `json:"agentId"`
+	Token     string    `json:"-"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// DeviceCode is a pending lanscaped sign-in: the user approves UserCode at
+// VerificationURI while the agent polls for its token
+type DeviceCode struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval"`
+}
+
+// LoadEnrollment loads the enrollment from dir, with its token from
+// credentials, or returns nil if the agent has not signed in
+func LoadEnrollment(dir string, credentials *CredentialCache) (*Enrollment, error) {
+	data, err := os.ReadFile(filepath.Join(dir, enrollmentFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read enrollment: %w", err)
+	}
+	var e Enrollment
+	if err := json.Unmarshal(data, &e); err != nil {
+		return nil, fmt.Errorf("failed to parse enrollment: %w", err)
+	}
+	e.Token, _, _ = credentials.Token()
+	return &e, nil
+}
+
+// SaveEnrollment writes the enrollment to dir and its token to credentials
+func SaveEnrollment(dir string, credentials *CredentialCache, e *Enrollment) error {
+	if err := credentials.SetToken(e.Token, e.ExpiresAt); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(e, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create data directory: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, enrollmentFileName), data, 0600); err != nil {
+		return fmt.Errorf("failed to write enrollment: %w", err)
+	}
+	return nil
+}
+
+// Login signs the agent in to lanscaped with the device-code flow and
+// registers its identity key with the approving user's account. prompt is
+// called once with the code the user must approve.
+func Login(ctx context.Context, server string, identity *Identity, name string, prompt func(code DeviceCode)) (*Enrollment, error) {
+	server = strings.TrimSuffix(server, "/")
+	client := &http.Client{Timeout: 30 * time.Second}
+
+	var code DeviceCode
+	if err := requestJSON(ctx, client, http.MethodPost, server+"/v1/device/code", "", nil, &code); err != nil {
+		return nil, fmt.Errorf("failed to start sign-in: %w", err)
+	}
+	prompt(code)
+
+	token, err := pollDeviceToken(ctx, client, server, code)
+	if err != nil {
+		return nil, err
+	}
+
+	var registered struct {
+		ID int64 `json:"id"`
+	}
+	err = requestJSON(ctx, client, http.MethodPost, server+"/v1/me/agents", token.Token, map[string]string{
+		"public_key": identity.PublicKeyString(),
+		"name":       name,
+		"version":    buildinfo.Get().Version,
+	}, &registered)
+	if err != nil {
+		return nil, fmt.Errorf("failed to register agent identity: %w", err)
+	}
+
+	expiresAt, _ := time.Parse(time.RFC3339, token.ExpiresAt)
+	return &Enrollment{
+		Server:    server,
+		Username:  token.Username,
+		AgentID:   registered.ID,
+		Token:     token.Token,
+		ExpiresAt: expiresAt,
+	}, nil
+}
+
+// deviceToken is lanscaped's answer to a token poll
+type deviceToken struct {
+	Token     string `json:"token"`
+	Username  string `json:"username"`
+	ExpiresAt string `json:"expires_at"`
+	Error     string `json:"error"`
+}
+
+// pollDeviceToken polls until the user approves the code, it expires, or ctx
+// is done
+func pollDeviceToken(ctx context.Context, client *http.Client, server string, code DeviceCode) (*deviceToken, error) {
+	interval := time.Duration(code.Interval) * time.Second
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	deadline := time.Now().Add(time.Duration(code.ExpiresIn) * time.Second)
+
+	for time.Now().Before(deadline) {
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+		var token deviceToken
+		err := requestJSON(ctx, client, http.MethodPost, server+"/v1/device/token", "", map[string]string{"device_code": code.DeviceCode}, &token)
+		switch {
+		case token.Error == "authorization_pending":
+			continue
+		case token.Error == "expired_token":
+			return nil, errors.New("sign-in code expired before it was approved")
+		case err != nil:
+			return nil, fmt.Errorf("failed to get token: %w", err)
+		}
+		return &token, nil
+	}
+	return nil, errors.New("sign-in code expired before it was approved")
+}
+
+// FetchGrant asks lanscaped for an attestation that this agent belongs to
+// the named network, returning it with its expiry
+func FetchGrant(ctx context.Context, e *Enrollment, identity *Identity, network string) (string, time.Time, error) {
+	if e.Token == "" {
+		return "", time.Time{}, errors.New("device token has expired; run lanscape-agent login again")
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+
+	networkID, err := lookupNetwork(ctx, client, e, network)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	var issued struct {
+		Attestation string `json:"attestation"`
+		ExpiresAt   string `json:"expires_at"`
+	}
+	err = requestJSON(ctx, client, http.MethodPost, e.Server+"/v1/attestations", e.Token, map[string]any{
+		"network_id": networkID,
+		"public_key": identity.PublicKeyString(),
+	}, &issued)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to get attestation: %w", err)
+	}
+	expiresAt, err := time.Parse(time.RFC3339, issued.ExpiresAt)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("invalid attestation expiry: %w", err)
+	}
+	return issued.Attestation, expiresAt, nil
+}
+
+// lookupNetwork returns the ID of the named network the enrolled user is a
+// member of
+func lookupNetwork(ctx context.Context, client *http.Client, e *Enrollment, network string) (int64, error) {
+	networks, err := listNetworks(ctx, client, e.Server, e.Token)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list networks: %w", err)
+	}
+	for _, n := range networks.Networks {
+		if n.Name == network {
+			return n.ID, nil
+		}
+	}
+	return 0, fmt.Errorf("%s is not a member of network %q", e.Username, network)
+}
+
+// networkList is lanscaped's list of the networks a user can see
+type networkList struct {
+	Networks []struct {
+		ID   int64  `json:"id"`
+		Name string `json:"name"`
+	} `json:"networks"`
+}
+
+// networksCache keeps the last network list with its ETag, so refreshing
+// grants only downloads the list again when it changed
+var networksCache struct {
+	sync.Mutex
+	url, token, etag string
+	list             networkList
+}
+
+// listNetworks fetches the networks the user can see, revalidating the
+// cached list if there is one and backing off if rate limited
+func listNetworks(ctx context.Context, client *http.Client, server, token string) (networkList, error) {
+	url := server + "/v1/networks"
+	networksCache.Lock()
+	defer networksCache.Unlock()
+
+	resp, err := doWithBackoff(ctx, client, func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		if networksCache.etag != "" && networksCache.url == url && networksCache.token == token {
+			req.Header.Set("If-None-Match", networksCache.etag)
+		}
+		return req, nil
+	})
+	if err != nil {
+		return networkList{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified {
+		return networksCache.list, nil
+	}
+	if resp.StatusCode/100 != 2 {
+		return networkList{}, fmt.Errorf("%s returned status %d", url, resp.StatusCode)
+	}
+	var list networkList
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return networkList{}, fmt.Errorf("failed to decode response: %w", err)
+	}
+	networksCache.url, networksCache.token = url, token
+	networksCache.etag, networksCache.list = resp.Header.Get("ETag"), list
+	return list, nil
+}
+
+// requestJSON sends body as JSON and decodes the response into out. A JSON
+// error response is decoded into out as well before the status error is
+// returned. Rate limited requests are retried as by doWithBackoff.
+func requestJSON(ctx context.Context, client *http.Client, method, url, token string, body, out any) error {
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	resp, err := doWithBackoff(ctx, client, func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(payload))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		return req, nil
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return fmt.Errorf("failed to decode response: %w", err)
+		}
+	}
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s returned status %d", url, resp.StatusCode)
+	}
+	return nil
+}
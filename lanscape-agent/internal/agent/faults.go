@@ -0,0 +1,104 @@
+package agent
+
+import (
+	"log/slog"
+	"math/rand"
+	"slices"
+	"sync"
+	"time"
+)
+
+// FaultConfig injects failures for resilience testing, so reconnect and
+// retry logic in the agent, peers, and browser can be exercised on purpose
+type FaultConfig struct {
+	// KillInterval is the mean time between closing the data channel of a
+	// random peer in each session; 0 disables it
+	KillInterval time.Duration
+	// Seed seeds the random choices, so a failing run can be repeated; 0
+	// picks a random seed, which is logged
+	Seed int64
+}
+
+// FaultInjector carries out a FaultConfig for every browser session. A nil
+// FaultInjector injects nothing.
+type FaultInjector struct {
+	config FaultConfig
+	logger *slog.Logger
+
+	mu   sync.Mutex
+	rand *rand.Rand
+}
+
+// NewFaultInjector creates an injector for config, or returns nil if it
+// injects nothing
+func NewFaultInjector(config FaultConfig, logger *slog.Logger) *FaultInjector {
+	if config.KillInterval <= 0 {
+		return nil
+	}
+	if config.Seed == 0 {
+		config.Seed = time.Now().UnixNano()
+	}
+	logger.Warn("injecting faults; do not use in production", "killInterval", config.KillInterval, "seed", config.Seed)
+	return &FaultInjector{
+		config: config,
+		logger: logger,
+		rand:   rand.New(rand.NewSource(config.Seed)),
+	}
+}
+
+// run closes the data channel of a random peer of m at random intervals
+// averaging KillInterval, until m is closed
+func (f *FaultInjector) run(m *WebRTCManager) {
+	for {
+		timer := time.NewTimer(f.nextKill())
+		select {
+		case <-timer.C:
+		case <-m.ctx.Done():
+			timer.Stop()
+			return
+		}
+
+		peerIDs := m.PeerIDs()
+		if len(peerIDs) == 0 {
+			continue
+		}
+		// Sorted, so the same seed picks the same peer for the same peers
+		slices.Sort(peerIDs)
+		peerID := peerIDs[f.intn(len(peerIDs))]
+		if m.killDataChannel(peerID) {
+			f.logger.Warn("fault injection closed data channel", "peer", peerID)
+		}
+	}
+}
+
+// nextKill returns the wait before the next kill, exponentially distributed
+// so kills arrive like independent failures
+func (f *FaultInjector) nextKill() time.Duration {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return time.Duration(f.rand.ExpFloat64() * float64(f.config.KillInterval))
+}
+
+// intn returns a random number in [0, n)
+func (f *FaultInjector) intn(n int) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.rand.Intn(n)
+}
+
+// killDataChannel closes a peer's application data channel, leaving the
+// peer connection up, and reports whether it had one
+func (m *WebRTCManager) killDataChannel(peerID string) bool {
+	peer, err := m.GetPeerConnection(peerID)
+	if err != nil {
+		return false
+	}
+	peer.mu.Lock()
+	dc, ok := peer.DataChannel.(DataChannel)
+	peer.mu.Unlock()
+	if !ok || dc == nil {
+		return false
+	}
+	dc.Close()
+	return true
+}
@@ -0,0 +1,720 @@
+package agent
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jhead/lanscape/lanscape-agent/pkg/protocol"
+	"github.com/oklog/ulid/v2"
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	forwardChannelLabel = "lanscape-forward"
+
+	// Frame kinds; every frame starts with kind (1 byte) and stream ID (4 bytes)
+	forwardFrameOpen     = 1 // payload: "tcp:host:port" or "udp:host:port"
+	forwardFrameOpenOK   = 2
+	forwardFrameOpenFail = 3 // payload: error message
+	forwardFrameData     = 4 // payload: bytes (one datagram for UDP)
+	forwardFrameWindow   = 5 // payload: uint32 bytes of credit returned
+	forwardFrameClose    = 6
+
+	forwardHeaderSize    = 5
+	forwardChunkSize     = 16 * 1024
+	forwardInitialWindow = 256 * 1024
+	forwardBufferHigh    = 1024 * 1024
+	forwardBufferLow     = 256 * 1024
+	forwardOpenTimeout   = 10 * time.Second
+	forwardUDPIdle       = 60 * time.Second
+)
+
+// Forwarder tunnels local TCP/UDP ports to peers over a dedicated data
+// channel per peer, multiplexing connections as streams with per-stream
+// credit-based flow control. It also serves streams opened by peers, dialing
+// only targets in the allow list.
+type Forwarder struct {
+	mu        sync.Mutex
+	webrtc    *WebRTCManager
+	allow     []string
+	services  *ServiceRegistry
+	tunnels   map[string]*forwardTunnel // peer ID -> tunnel we opened
+	listeners map[string]*forwardListener
+	logger    *slog.Logger
+
+	// resolveService looks up a service advertised by a peer
+	resolveService func(peerID, name string) (protocol.Service, bool)
+}
+
+// forwardListener is an active local forward
+type forwardListener struct {
+	spec protocol.Forward
+	tcp  net.Listener
+	udp  net.PacketConn
+}
+
+// NewForwarder creates a forwarder. allow lists the targets peers may open
+// on this machine: "port" (localhost), "host:port", or "*" for any. Ports of
+// services in the registry are always allowed.
+func NewForwarder(m *WebRTCManager, allow []string, services *ServiceRegistry, logger *slog.Logger) *Forwarder {
+	f := &Forwarder{
+		webrtc:    m,
+		allow:     allow,
+		services:  services,
+		tunnels:   make(map[string]*forwardTunnel),
+		listeners: make(map[string]*forwardListener),
+		logger:    logger,
+	}
+	m.HandleDataChannelLabel(forwardChannelLabel, f.handleChannel)
+	return f
+}
+
+// Start listens locally and forwards each connection to spec.Target on spec.PeerID.
+// It returns the spec with its ID and actual listen address filled in.
+func (f *Forwarder) Start(spec protocol.Forward) (protocol.Forward, error) {
+	if spec.Service != "" && spec.Target == "" && f.resolveService != nil {
+		service, ok := f.resolveService(spec.PeerID, spec.Service)
+		if !ok {
+			return spec, fmt.Errorf("peer %s does not advertise service %q", spec.PeerID, spec.Service)
+		}
+		spec.Protocol = service.Protocol
+		spec.Target = strconv.Itoa(service.Port)
+	}
+	if spec.PeerID == "" || spec.Target == "" {
+		return spec, fmt.Errorf("forward requires a peer and target")
+	}
+	if spec.Protocol == "" {
+		spec.Protocol = "tcp"
+	}
+	if spec.Listen == "" {
+		spec.Listen = "127.0.0.1:0"
+	}
+	spec.Listen = normalizeForwardAddr(spec.Listen)
+	spec.Target = normalizeForwardAddr(spec.Target)
+	spec.ID = ulid.Make().String()
+
+	l := &forwardListener{}
+	switch spec.Protocol {
+	case "tcp":
+		ln, err := net.Listen("tcp", spec.Listen)
+		if err != nil {
+			return spec, fmt.Errorf("failed to listen: %w", err)
+		}
+		l.tcp = ln
+		spec.Listen = ln.Addr().String()
+	case "udp":
+		pc, err := net.ListenPacket("udp", spec.Listen)
+		if err != nil {
+			return spec, fmt.Errorf("failed to listen: %w", err)
+		}
+		l.udp = pc
+		spec.Listen = pc.LocalAddr().String()
+	default:
+		return spec, fmt.Errorf("unsupported forward protocol: %s", spec.Protocol)
+	}
+	l.spec = spec
+
+	f.mu.Lock()
+	f.listeners[spec.ID] = l
+	f.mu.Unlock()
+
+	if l.tcp != nil {
+		go f.acceptTCP(l)
+	} else {
+		go f.serveUDP(l)
+	}
+
+	f.logger.Info("forwarding port", "id", spec.ID, "protocol", spec.Protocol, "listen", spec.Listen, "peer", spec.PeerID, "target", spec.Target)
+	return spec, nil
+}
+
+// Stop closes a local forward. Established connections stay open until either end closes them.
+func (f *Forwarder) Stop(id string) error {
+	f.mu.Lock()
+	l, ok := f.listeners[id]
+	delete(f.listeners, id)
+	f.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("unknown forward: %s", id)
+	}
+
+	if l.tcp != nil {
+		l.tcp.Close()
+	}
+	if l.udp != nil {
+		l.udp.Close()
+	}
+	f.logger.Info("stopped forwarding port", "id", id)
+	return nil
+}
+
+// List returns the active local forwards
+func (f *Forwarder) List() []protocol.Forward {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	forwards := make([]protocol.Forward, 0, len(f.listeners))
+	for _, l := range f.listeners {
+		forwards = append(forwards, l.spec)
+	}
+	return forwards
+}
+
+// Close stops all forwards and tunnels
+func (f *Forwarder) Close() {
+	for _, spec := range f.List() {
+		f.Stop(spec.ID)
+	}
+
+	f.mu.Lock()
+	tunnels := f.tunnels
+	f.tunnels = make(map[string]*forwardTunnel)
+	f.mu.Unlock()
+	for _, t := range tunnels {
+		t.close()
+	}
+}
+
+// acceptTCP opens a stream for each accepted connection
+func (f *Forwarder) acceptTCP(l *forwardListener) {
+	for {
+		conn, err := l.tcp.Accept()
+		if err != nil {
+			return
+		}
+		f.webrtc.supervisor.Go("forward-conn", func() {
+			t, err := f.tunnel(l.spec.PeerID)
+			if err != nil {
+				f.logger.Warn("failed to open forward tunnel", "peer", l.spec.PeerID, "error", err)
+				conn.Close()
+				return
+			}
+			s, err := t.open("tcp:"+l.spec.Target, conn.Write, func() { conn.Close() })
+			if err != nil {
+				f.logger.Warn("failed to open forwarded connection", "target", l.spec.Target, "error", err)
+				conn.Close()
+				return
+			}
+			s.pump(conn)
+		})
+	}
+}
+
+// serveUDP maps each local source address to a stream
+func (f *Forwarder) serveUDP(l *forwardListener) {
+	var mu sync.Mutex
+	streams := make(map[string]*forwardStream)
+
+	buf := make([]byte, 64*1024)
+	for {
+		n, addr, err := l.udp.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		mu.Lock()
+		s, ok := streams[addr.String()]
+		mu.Unlock()
+		if !ok {
+			t, err := f.tunnel(l.spec.PeerID)
+			if err != nil {
+				f.logger.Warn("failed to open forward tunnel", "peer", l.spec.PeerID, "error", err)
+				continue
+			}
+			key := addr.String()
+			s, err = t.open("udp:"+l.spec.Target, func(b []byte) (int, error) {
+				return l.udp.WriteTo(b, addr)
+			}, func() {
+				mu.Lock()
+				delete(streams, key)
+				mu.Unlock()
+			})
+			if err != nil {
+				f.logger.Warn("failed to open forwarded datagram stream", "target", l.spec.Target, "error", err)
+				continue
+			}
+			mu.Lock()
+			streams[key] = s
+			mu.Unlock()
+		}
+
+		if err := s.sendData(append([]byte(nil), buf[:n]...)); err != nil {
+			s.close(true)
+		}
+	}
+}
+
+// tunnel returns the outbound tunnel to a peer, opening its data channel if needed
+func (f *Forwarder) tunnel(peerID string) (*forwardTunnel, error) {
+	f.mu.Lock()
+	if t, ok := f.tunnels[peerID]; ok && !t.isClosed() {
+		f.mu.Unlock()
+		return t, nil
+	}
+	f.mu.Unlock()
+
+	ordered := true
+	dc, err := f.webrtc.CreateDataChannel(peerID, forwardChannelLabel, &webrtc.DataChannelInit{Ordered: &ordered})
+	if err != nil {
+		return nil, err
+	}
+	t := newForwardTunnel(f, peerID, dc)
+
+	ctx, cancel := context.WithTimeout(context.Background(), forwardOpenTimeout)
+	defer cancel()
+	select {
+	case <-t.opened:
+	case <-ctx.Done():
+		dc.Close()
+		return nil, fmt.Errorf("forward channel to %s did not open", peerID)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if existing, ok := f.tunnels[peerID]; ok && !existing.isClosed() {
+		// Lost a race with another connection; use the existing tunnel
+		dc.Close()
+		return existing, nil
+	}
+	f.tunnels[peerID] = t
+	return t, nil
+}
+
+// handleChannel serves a forward channel opened by a peer
+func (f *Forwarder) handleChannel(peerID string, dc *webrtc.DataChannel) {
+	f.logger.Info("peer opened forward channel", "peer", peerID)
+	newForwardTunnel(f, peerID, dc)
+}
+
+// allowed reports whether peers may open a stream to target
+func (f *Forwarder) allowed(proto, target string) bool {
+	if f.services != nil && f.services.Offers(proto, target) {
+		return true
+	}
+	for _, a := range f.allow {
+		if a == "*" || normalizeForwardAddr(a) == target {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeForwardAddr turns a bare port into a localhost address
+func normalizeForwardAddr(addr string) string {
+	if !strings.Contains(addr, ":") {
+		return "127.0.0.1:" + addr
+	}
+	return addr
+}
+
+// isLoopbackAddr reports whether a listen address (or bare port) is on a
+// loopback interface
+func isLoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(normalizeForwardAddr(addr))
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// forwardTunnel multiplexes streams over one data channel
+type forwardTunnel struct {
+	f       *Forwarder
+	peerID  string
+	dc      *webrtc.DataChannel
+	opened  chan struct{}
+	drained chan struct{}
+
+	mu      sync.Mutex
+	sendMu  sync.Mutex
+	streams map[uint32]*forwardStream
+	nextID  uint32
+	closed  bool
+}
+
+func newForwardTunnel(f *Forwarder, peerID string, dc *webrtc.DataChannel) *forwardTunnel {
+	t := &forwardTunnel{
+		f:       f,
+		peerID:  peerID,
+		dc:      dc,
+		opened:  make(chan struct{}),
+		drained: make(chan struct{}, 1),
+		streams: make(map[uint32]*forwardStream),
+	}
+
+	var once sync.Once
+	markOpen := func() { once.Do(func() { close(t.opened) }) }
+	dc.OnOpen(markOpen)
+	if dc.ReadyState() == webrtc.DataChannelStateOpen {
+		markOpen()
+	}
+	dc.SetBufferedAmountLowThreshold(forwardBufferLow)
+	dc.OnBufferedAmountLow(func() {
+		select {
+		case t.drained <- struct{}{}:
+		default:
+		}
+	})
+	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		t.handleFrame(msg.Data)
+	})
+	dc.OnClose(t.close)
+	return t
+}
+
+// send writes a frame, waiting while the channel's send buffer is full
+func (t *forwardTunnel) send(kind byte, streamID uint32, payload []byte) error {
+	frame := make([]byte, forwardHeaderSize+len(payload))
+	frame[0] = kind
+	binary.BigEndian.PutUint32(frame[1:5], streamID)
+	copy(frame[forwardHeaderSize:], payload)
+
+	t.sendMu.Lock()
+	defer t.sendMu.Unlock()
+	for t.dc.BufferedAmount() > forwardBufferHigh {
+		if t.isClosed() {
+			return errors.New("forward tunnel closed")
+		}
+		select {
+		case <-t.drained:
+		case <-time.After(time.Second):
+		}
+	}
+	return t.dc.Send(frame)
+}
+
+// open starts a stream to target on the peer and waits for it to be accepted
+func (t *forwardTunnel) open(target string, write func([]byte) (int, error), onClose func()) (*forwardStream, error) {
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return nil, errors.New("forward tunnel closed")
+	}
+	t.nextID++
+	s := newForwardStream(t, t.nextID, strings.HasPrefix(target, "tcp:"), write, onClose)
+	t.streams[s.id] = s
+	t.mu.Unlock()
+
+	if err := t.send(forwardFrameOpen, s.id, []byte(target)); err != nil {
+		t.remove(s.id)
+		return nil, err
+	}
+
+	select {
+	case err := <-s.ready:
+		if err != nil {
+			t.remove(s.id)
+			return nil, err
+		}
+		return s, nil
+	case <-time.After(forwardOpenTimeout):
+		t.remove(s.id)
+		return nil, errors.New("timed out opening forwarded connection")
+	}
+}
+
+// handleFrame dispatches a frame from the peer
+func (t *forwardTunnel) handleFrame(frame []byte) {
+	if len(frame) < forwardHeaderSize {
+		return
+	}
+	kind := frame[0]
+	id := binary.BigEndian.Uint32(frame[1:5])
+	payload := frame[forwardHeaderSize:]
+
+	if kind == forwardFrameOpen {
+		go t.accept(id, string(payload))
+		return
+	}
+
+	t.mu.Lock()
+	s, ok := t.streams[id]
+	t.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	switch kind {
+	case forwardFrameOpenOK:
+		s.ready <- nil
+	case forwardFrameOpenFail:
+		s.ready <- errors.New(string(payload))
+	case forwardFrameData:
+		if _, err := s.write(payload); err != nil {
+			s.close(true)
+			return
+		}
+		if s.reliable {
+			var credit [4]byte
+			binary.BigEndian.PutUint32(credit[:], uint32(len(payload)))
+			t.send(forwardFrameWindow, id, credit[:])
+		}
+	case forwardFrameWindow:
+		if len(payload) >= 4 {
+			s.addCredit(int(binary.BigEndian.Uint32(payload)))
+		}
+	case forwardFrameClose:
+		s.close(false)
+	}
+}
+
+// accept dials a stream target requested by the peer
+func (t *forwardTunnel) accept(id uint32, target string) {
+	proto, addr, ok := strings.Cut(target, ":")
+	if !ok || (proto != "tcp" && proto != "udp") {
+		t.send(forwardFrameOpenFail, id, []byte("invalid target"))
+		return
+	}
+	if !t.f.allowed(proto, addr) {
+		t.f.logger.Warn("rejected forward to disallowed target", "peer", t.peerID, "target", target)
+		t.send(forwardFrameOpenFail, id, []byte("target not allowed: "+addr))
+		return
+	}
+
+	conn, err := net.DialTimeout(proto, addr, forwardOpenTimeout)
+	if err != nil {
+		t.send(forwardFrameOpenFail, id, []byte(err.Error()))
+		return
+	}
+
+	s := newForwardStream(t, id, proto == "tcp", conn.Write, func() { conn.Close() })
+	t.mu.Lock()
+	t.streams[id] = s
+	t.mu.Unlock()
+
+	if err := t.send(forwardFrameOpenOK, id, nil); err != nil {
+		s.close(false)
+		return
+	}
+	t.f.logger.Info("accepted forwarded connection", "peer", t.peerID, "target", target)
+
+	if proto == "udp" {
+		conn.SetReadDeadline(time.Now().Add(forwardUDPIdle))
+	}
+	s.pump(conn)
+}
+
+// remove forgets a stream
+func (t *forwardTunnel) remove(id uint32) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.streams, id)
+}
+
+func (t *forwardTunnel) isClosed() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.closed
+}
+
+// close tears down the tunnel and all its streams
+func (t *forwardTunnel) close() {
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return
+	}
+	t.closed = true
+	streams := t.streams
+	t.streams = make(map[uint32]*forwardStream)
+	t.mu.Unlock()
+
+	for _, s := range streams {
+		s.close(false)
+	}
+	t.dc.Close()
+}
+
+// forwardStream is one forwarded connection within a tunnel
+type forwardStream struct {
+	id       uint32
+	t        *forwardTunnel
+	reliable bool // TCP streams use credit-based flow control
+	write    func([]byte) (int, error)
+	onClose  func()
+	ready    chan error
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	credit int
+	closed bool
+}
+
+func newForwardStream(t *forwardTunnel, id uint32, reliable bool, write func([]byte) (int, error), onClose func()) *forwardStream {
+	s := &forwardStream{
+		id:       id,
+		t:        t,
+		reliable: reliable,
+		write:    write,
+		onClose:  onClose,
+		ready:    make(chan error, 1),
+		credit:   forwardInitialWindow,
+	}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+// pump copies from a local connection into the tunnel until either side closes
+func (s *forwardStream) pump(conn net.Conn) {
+	buf := make([]byte, forwardChunkSize)
+	for {
+		n, err := conn.Read(buf)
+		if n > 0 {
+			if !s.reliable {
+				conn.SetReadDeadline(time.Now().Add(forwardUDPIdle))
+			}
+			if err := s.sendData(append([]byte(nil), buf[:n]...)); err != nil {
+				break
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	s.close(true)
+}
+
+// sendData sends a chunk, waiting for flow-control credit on reliable streams
+func (s *forwardStream) sendData(data []byte) error {
+	if s.reliable {
+		s.mu.Lock()
+		for s.credit < len(data) && !s.closed {
+			s.cond.Wait()
+		}
+		if s.closed {
+			s.mu.Unlock()
+			return errors.New("stream closed")
+		}
+		s.credit -= len(data)
+		s.mu.Unlock()
+	}
+	return s.t.send(forwardFrameData, s.id, data)
+}
+
+// addCredit returns send credit granted by the peer
+func (s *forwardStream) addCredit(n int) {
+	s.mu.Lock()
+	s.credit += n
+	s.mu.Unlock()
+	s.cond.Broadcast()
+}
+
+// close closes the stream, notifying the peer if notify is set
+func (s *forwardStream) close(notify bool) {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	s.mu.Unlock()
+	s.cond.Broadcast()
+
+	s.t.remove(s.id)
+	if notify {
+		s.t.send(forwardFrameClose, s.id, nil)
+	}
+	s.onClose()
+}
+
+// registerHandlers adds the forwarding browser messages to a bridge
+func (f *Forwarder) registerHandlers(b *Bridge) {
+	b.RegisterHandler(protocol.MessageTypeForward, func(ctx context.Context, msg protocol.BrowserMessage) error {
+		if msg.Forward == nil {
+			return fmt.Errorf("forward requires a forward spec")
+		}
+		// The browser socket accepts any origin, so a page must not be able
+		// to expose a peer's ports beyond this machine; wider listeners are
+		// only opened from the command line
+		if msg.Forward.Listen != "" && !isLoopbackAddr(msg.Forward.Listen) {
+			return fmt.Errorf("forward listen address must be loopback: %s", msg.Forward.Listen)
+		}
+		if _, err := f.Start(*msg.Forward); err != nil {
+			return err
+		}
+		f.sendForwards(b)
+		return nil
+	})
+	b.RegisterHandler(protocol.MessageTypeUnforward, func(ctx context.Context, msg protocol.BrowserMessage) error {
+		if msg.Forward == nil {
+			return fmt.Errorf("unforward requires a forward ID")
+		}
+		if err := f.Stop(msg.Forward.ID); err != nil {
+			return err
+		}
+		f.sendForwards(b)
+		return nil
+	})
+	b.RegisterHandler(protocol.MessageTypeListForwards, func(ctx context.Context, msg protocol.BrowserMessage) error {
+		f.sendForwards(b)
+		return nil
+	})
+}
+
+// sendForwards reports the active forwards to the browser
+func (f *Forwarder) sendForwards(b *Bridge) {
+	b.sendToBrowser(protocol.AgentMessage{
+		Type:     protocol.MessageTypeForwards,
+		Forwards: f.List(),
+	})
+}
+
+// ForwardConfig configures a standalone port forward run from the CLI
+type ForwardConfig struct {
+	SignalingURL  string
+	Topic         string
+	Forward       protocol.Forward
+	TailscaleInfo *TailscaleInfo
+	Identity      *Identity
+	Logger        *slog.Logger
+}
+
+// RunForward joins the topic without a browser, waits for the peer, and
+// forwards the configured port until ctx is cancelled. ready is called with
+// the started forward.
+func RunForward(ctx context.Context, config ForwardConfig, ready func(protocol.Forward)) error {
+	logger := config.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	m, err := NewWebRTCManager(config.TailscaleInfo, logger)
+	if err != nil {
+		return err
+	}
+	defer m.CloseAll()
+
+	dialCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	client, err := dialPeer(dialCtx, m, config.SignalingURL, config.Topic, config.Identity, config.Forward.PeerID, logger)
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect()
+
+	f := NewForwarder(m, nil, nil, logger)
+	defer f.Close()
+
+	spec, err := f.Start(config.Forward)
+	if err != nil {
+		return err
+	}
+	if ready != nil {
+		ready(spec)
+	}
+
+	<-ctx.Done()
+	return nil
+}
@@ -0,0 +1,49 @@
+package agent
+
+import (
+	"time"
+
+	"github.com/jhead/lanscape/lanscape-agent/pkg/protocol"
+)
+
+// heartbeatInterval is how often a browser session is sent the agent's
+// health, so the application can tell an agent that is down from one with
+// no peers without inferring it from silence
+const heartbeatInterval = 10 * time.Second
+
+// startHeartbeat sends the browser a heartbeat now and every
+// heartbeatInterval until the session is disconnected
+func (s *BrowserSession) startHeartbeat() {
+	s.webrtc.supervisor.Go("heartbeat", func() {
+		ticker := time.NewTicker(heartbeatInterval)
+		defer ticker.Stop()
+		for {
+			health := s.health()
+			s.bridge.sendToBrowser(protocol.AgentMessage{
+				Type:   protocol.MessageTypeHeartbeat,
+				Health: &health,
+			})
+			select {
+			case <-ticker.C:
+			case <-s.webrtc.ctx.Done():
+				return
+			}
+		}
+	})
+}
+
+// health reports the session's signaling connection, its connected peers,
+// and whether Tailscale is up
+func (s *BrowserSession) health() protocol.AgentHealth {
+	connected := s.signaling.Connected()
+	if s.sim != nil {
+		// The simulated network stands in for signaling
+		connected = s.simID != ""
+	}
+	return protocol.AgentHealth{
+		SignalingConnected: connected,
+		Peers:              len(s.bridge.GetConnectedPeers()),
+		TailscaleUp:        s.webrtc.tailscaleInfo.Up(),
+		IntervalMs:         heartbeatInterval.Milliseconds(),
+	}
+}
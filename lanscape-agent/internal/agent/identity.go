@@ -0,0 +1,138 @@
+package agent
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+const identityFileName = "identity.pem"
+
+// Identity is the agent's long-lived ed25519 keypair.
+// It is persisted in the data directory so the agent keeps the same
+// public key across restarts and reconnects.
+type Identity struct {
+	PublicKey  ed25519.PublicKey
+	privateKey ed25519.PrivateKey
+}
+
+// LoadOrCreateIdentity loads the identity from dir, generating and persisting a new one if none exists
+func LoadOrCreateIdentity(dir string) (*Identity, error) {
+	path := filepath.Join(dir, identityFileName)
+
+	data, err := os.ReadFile(path)
+	if err == nil {
+		return parseIdentity(data)
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read identity: %w", err)
+	}
+
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate identity: %w", err)
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal identity: %w", err)
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create data directory: %w", err)
+	}
+
+	pemData := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if err := os.WriteFile(path, pemData, 0600); err != nil {
+		return nil, fmt.Errorf("failed to write identity: %w", err)
+	}
+
+	return &Identity{
+		PublicKey:  privateKey.Public().(ed25519.PublicKey),
+		privateKey: privateKey,
+	}, nil
+}
+
+// parseIdentity parses a PEM-encoded PKCS8 ed25519 private key
+func parseIdentity(data []byte) (*Identity, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("failed to decode identity PEM block")
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse identity: %w", err)
+	}
+
+	privateKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("identity is not an ed25519 key")
+	}
+
+	return &Identity{
+		PublicKey:  privateKey.Public().(ed25519.PublicKey),
+		privateKey: privateKey,
+	}, nil
+}
+
+// PublicKeyString returns the base64url-encoded public key
+func (id *Identity) PublicKeyString() string {
+	return base64.RawURLEncoding.EncodeToString(id.PublicKey)
+}
+
+// Fingerprint returns a short, human-comparable fingerprint of the public key
+func (id *Identity) Fingerprint() string {
+	return Fingerprint(id.PublicKey)
+}
+
+// Sign signs data with the identity's private key
+func (id *Identity) Sign(data []byte) []byte {
+	return ed25519.Sign(id.privateKey, data)
+}
+
+// Fingerprint returns the hex-encoded truncated SHA-256 of a public key
+func Fingerprint(publicKey ed25519.PublicKey) string {
+	sum := sha256.Sum256(publicKey)
+	return hex.EncodeToString(sum[:16])
+}
+
+// ParsePublicKey decodes a base64url-encoded ed25519 public key
+func ParsePublicKey(s string) (ed25519.PublicKey, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key encoding: %w", err)
+	}
+	if len(raw) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid public key length: %d", len(raw))
+	}
+	return ed25519.PublicKey(raw), nil
+}
+
+// VerifySignature verifies a base64url-encoded signature over data
+func VerifySignature(publicKey ed25519.PublicKey, data []byte, signature string) error {
+	sig, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil {
+		return fmt.Errorf("invalid signature encoding: %w", err)
+	}
+	if !ed25519.Verify(publicKey, data, sig) {
+		return fmt.Errorf("signature verification failed")
+	}
+	return nil
+}
+
+// DefaultDataDir returns the default directory for persistent agent state
+func DefaultDataDir() string {
+	if dir, err := os.UserConfigDir(); err == nil {
+		return filepath.Join(dir, "lanscape-agent")
+	}
+	return ".lanscape-agent"
+}
@@ -0,0 +1,278 @@
+package agent
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jhead/lanscape/lanscape-agent/pkg/protocol"
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	latencyProbeInterval = 2 * time.Second
+	latencyWindow        = 30 // probe results kept per peer
+)
+
+// LatencyMonitor measures each connected peer's round-trip time and loss by
+// sending a probe every few seconds on an unreliable channel. Peers answer
+// with the benchmark echo, so no extra support is needed on the remote end.
+// Results cover the last minute or so of probes.
+type LatencyMonitor struct {
+	webrtc *WebRTCManager
+	logger *slog.Logger
+
+	mu    sync.Mutex
+	peers map[string]*peerLatency
+}
+
+// peerLatency holds the recent probe results for one peer
+type peerLatency struct {
+	cancel context.CancelFunc
+
+	mu      sync.Mutex
+	results []latencyResult // oldest first, at most latencyWindow
+}
+
+// latencyResult is one probe: its round trip, or lost if no echo arrived
+type latencyResult struct {
+	rtt  time.Duration
+	lost bool
+}
+
+// NewLatencyMonitor creates a monitor for a session's peers
+func NewLatencyMonitor(m *WebRTCManager, logger *slog.Logger) *LatencyMonitor {
+	return &LatencyMonitor{webrtc: m, logger: logger, peers: make(map[string]*peerLatency)}
+}
+
+// start begins probing a peer. It does nothing if l is nil or the peer is
+// already being probed.
+func (l *LatencyMonitor) start(peerID string) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	if _, ok := l.peers[peerID]; ok {
+		l.mu.Unlock()
+		return
+	}
+	ctx, cancel := context.WithCancel(l.webrtc.ctx)
+	p := &peerLatency{cancel: cancel}
+	l.peers[peerID] = p
+	l.mu.Unlock()
+
+	l.webrtc.supervisor.Go("latency-probe", func() {
+		if err := l.probe(ctx, peerID, p); err != nil && ctx.Err() == nil {
+			l.logger.Debug("stopped probing peer latency", "peer", peerID, "error", err)
+		}
+	})
+}
+
+// stop ends probing a peer and forgets its results
+func (l *LatencyMonitor) stop(peerID string) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	p, ok := l.peers[peerID]
+	delete(l.peers, peerID)
+	l.mu.Unlock()
+	if ok {
+		p.cancel()
+	}
+}
+
+// probe sends probes to a peer until ctx is done, recording each as answered
+// or lost once benchResponseWindow passes without an echo
+func (l *LatencyMonitor) probe(ctx context.Context, peerID string, p *peerLatency) error {
+	unordered := false
+	noRetransmits := uint16(0)
+	dc, err := openBenchChannel(ctx, l.webrtc, peerID, benchLossyChannelLabel, &webrtc.DataChannelInit{
+		Ordered:        &unordered,
+		MaxRetransmits: &noRetransmits,
+	})
+	if errors.Is(err, errSimulatedPeer) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer dc.Close()
+
+	var mu sync.Mutex
+	outstanding := make(map[uint32]time.Time) // seq -> sent
+	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		if len(msg.Data) < benchHeaderSize || msg.Data[0] != benchFrameProbe {
+			return
+		}
+		mu.Lock()
+		seq := binary.BigEndian.Uint32(msg.Data[1:5])
+		sent, ok := outstanding[seq]
+		delete(outstanding, seq)
+		mu.Unlock()
+		if ok {
+			p.record(latencyResult{rtt: time.Since(sent)})
+		}
+	})
+
+	ticker := time.NewTicker(latencyProbeInterval)
+	defer ticker.Stop()
+	for seq := uint32(0); ; seq++ {
+		mu.Lock()
+		for s, sent := range outstanding {
+			if time.Since(sent) > benchResponseWindow {
+				delete(outstanding, s)
+				p.record(latencyResult{lost: true})
+			}
+		}
+		outstanding[seq] = time.Now()
+		mu.Unlock()
+
+		if err := dc.Send(benchFrame(benchFrameProbe, seq, benchHeaderSize)); err != nil {
+			return err
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// record adds a probe result, dropping the oldest beyond the window
+func (p *peerLatency) record(r latencyResult) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.results = append(p.results, r)
+	if len(p.results) > latencyWindow {
+		p.results = p.results[len(p.results)-latencyWindow:]
+	}
+}
+
+// summary returns the mean RTT of answered probes, the fraction lost, and
+// the number of results
+func (p *peerLatency) summary() (time.Duration, float64, int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var total time.Duration
+	answered := 0
+	for _, r := range p.results {
+		if !r.lost {
+			total += r.rtt
+			answered++
+		}
+	}
+	if len(p.results) == 0 {
+		return 0, 0, 0
+	}
+	var rtt time.Duration
+	if answered > 0 {
+		rtt = total / time.Duration(answered)
+	}
+	return rtt, 1 - float64(answered)/float64(len(p.results)), len(p.results)
+}
+
+// Ranked returns the given peers best first. Peers are scored by RTT
+// inflated by loss, since a lost message costs at least another round trip;
+// peers with no results yet come last, in ID order.
+func (l *LatencyMonitor) Ranked(peers []string) []protocol.PeerLatency {
+	ranking := make([]protocol.PeerLatency, 0, len(peers))
+	scores := make(map[string]float64, len(peers))
+	for _, peerID := range peers {
+		entry := protocol.PeerLatency{PeerID: peerID}
+		score := math.Inf(1)
+		if l != nil {
+			l.mu.Lock()
+			p, ok := l.peers[peerID]
+			l.mu.Unlock()
+			if ok {
+				rtt, loss, samples := p.summary()
+				entry.RTTMs = float64(rtt) / float64(time.Millisecond)
+				entry.Loss = loss
+				entry.Samples = samples
+				if samples > 0 && loss < 1 {
+					score = entry.RTTMs / (1 - loss)
+				}
+			}
+		}
+		ranking = append(ranking, entry)
+		scores[peerID] = score
+	}
+
+	sort.SliceStable(ranking, func(i, j int) bool {
+		si, sj := scores[ranking[i].PeerID], scores[ranking[j].PeerID]
+		if si != sj {
+			return si < sj
+		}
+		if (ranking[i].Samples == 0) != (ranking[j].Samples == 0) {
+			return ranking[j].Samples == 0
+		}
+		return ranking[i].PeerID < ranking[j].PeerID
+	})
+	return ranking
+}
+
+// registerHandlers adds the best-peer browser message to a bridge. The
+// ranking covers the listed peers, a group, or every connected peer, leaving
+// out peers awaiting verification or blocked.
+func (l *LatencyMonitor) registerHandlers(b *Bridge) {
+	b.RegisterHandler(protocol.MessageTypeBestPeer, func(ctx context.Context, msg protocol.BrowserMessage) error {
+		if msg.Group != "" {
+			b.mu.RLock()
+			_, ok := b.groups[msg.Group]
+			b.mu.RUnlock()
+			if !ok {
+				return fmt.Errorf("unknown group: %s", msg.Group)
+			}
+		}
+		b.sendToBrowser(protocol.AgentMessage{
+			Type:    protocol.MessageTypeBestPeer,
+			Group:   msg.Group,
+			Ranking: l.Ranked(b.bestPeerCandidates(msg.Group, msg.Peers)),
+		})
+		return nil
+	})
+}
+
+// BestPeers ranks the connected, verified peers by measured latency, best
+// first, limited to peers when given
+func (b *Bridge) BestPeers(peers []string) []protocol.PeerLatency {
+	return b.latency.Ranked(b.bestPeerCandidates("", peers))
+}
+
+// bestPeerCandidates returns the connected peers that may exchange data,
+// limited to peers or group members when given
+func (b *Bridge) bestPeerCandidates(group string, peers []string) []string {
+	var allowed map[string]bool
+	if len(peers) > 0 {
+		allowed = make(map[string]bool, len(peers))
+		for _, peerID := range peers {
+			allowed[peerID] = true
+		}
+	}
+
+	var candidates []string
+	for _, peerID := range b.GetConnectedPeers() {
+		if allowed != nil && !allowed[peerID] {
+			continue
+		}
+		if group != "" && !b.inGroup(group, peerID) {
+			continue
+		}
+		if b.isPending(peerID) || b.webrtc.IsBlocked(peerID) {
+			continue
+		}
+		candidates = append(candidates, peerID)
+	}
+	return candidates
+}
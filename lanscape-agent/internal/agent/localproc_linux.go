@@ -0,0 +1,97 @@
+package agent
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// lookupLocalProcess finds the process owning the client end of a loopback
+// TCP connection. SO_PEERCRED only works on Unix sockets, so the socket is
+// found in /proc/net/tcp by its addresses, and its owner by the socket inode
+// among the processes' open files. Processes of other users are only found
+// with root privileges; their UID is reported regardless.
+func lookupLocalProcess(remote netip.AddrPort, local net.Addr) (*LocalProcess, error) {
+	server, err := netip.ParseAddrPort(local.String())
+	if err != nil {
+		return nil, err
+	}
+	if !remote.Addr().Unmap().Is4() || !server.Addr().Unmap().Is4() {
+		return nil, fmt.Errorf("only IPv4 connections are looked up")
+	}
+
+	// The client's socket has the client's address as its local one
+	uid, inode, err := findTCPSocket(procTCPAddr(remote), procTCPAddr(server))
+	if err != nil {
+		return nil, err
+	}
+	proc := &LocalProcess{UID: uid}
+
+	pid, err := findSocketOwner(inode)
+	if err != nil {
+		return proc, nil
+	}
+	proc.PID = pid
+	if comm, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "comm")); err == nil {
+		proc.Name = strings.TrimSpace(string(comm))
+	}
+	proc.Path, _ = os.Readlink(filepath.Join("/proc", strconv.Itoa(pid), "exe"))
+	return proc, nil
+}
+
+// procTCPAddr formats an IPv4 address and port the way /proc/net/tcp does:
+// the address as the hex of its in-memory 32-bit word, then the port
+func procTCPAddr(addr netip.AddrPort) string {
+	ip := addr.Addr().Unmap().As4()
+	return fmt.Sprintf("%08X:%04X", binary.NativeEndian.Uint32(ip[:]), addr.Port())
+}
+
+// findTCPSocket returns the UID and inode of the TCP socket from local to
+// remote
+func findTCPSocket(local, remote string) (int, string, error) {
+	f, err := os.Open("/proc/net/tcp")
+	if err != nil {
+		return -1, "", err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Scan() // header
+	for scanner.Scan() {
+		// sl local_address rem_address st tx_queue:rx_queue tr:tm->when retrnsmt uid timeout inode
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 || fields[1] != local || fields[2] != remote {
+			continue
+		}
+		uid, err := strconv.Atoi(fields[7])
+		if err != nil {
+			return -1, "", fmt.Errorf("invalid uid in /proc/net/tcp: %w", err)
+		}
+		return uid, fields[9], nil
+	}
+	if err := scanner.Err(); err != nil {
+		return -1, "", err
+	}
+	return -1, "", fmt.Errorf("no socket from %s to %s", local, remote)
+}
+
+// findSocketOwner returns the PID of a process holding the socket inode
+func findSocketOwner(inode string) (int, error) {
+	target := "socket:[" + inode + "]"
+	fds, err := filepath.Glob("/proc/[0-9]*/fd/*")
+	if err != nil {
+		return 0, err
+	}
+	for _, fd := range fds {
+		if link, err := os.Readlink(fd); err == nil && link == target {
+			return strconv.Atoi(strings.Split(fd, "/")[2])
+		}
+	}
+	return 0, fmt.Errorf("no process holds socket %s", inode)
+}
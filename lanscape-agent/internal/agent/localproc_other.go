@@ -0,0 +1,16 @@
+//go:build !linux && !windows
+
+package agent
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"runtime"
+)
+
+// lookupLocalProcess reports that finding the process behind a connection
+// is unsupported
+func lookupLocalProcess(netip.AddrPort, net.Addr) (*LocalProcess, error) {
+	return nil, fmt.Errorf("process lookup is not supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,109 @@
+package agent
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"path/filepath"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var procGetExtendedTcpTable = windows.NewLazySystemDLL("iphlpapi.dll").NewProc("GetExtendedTcpTable")
+
+const tcpTableOwnerPIDAll = 5 // TCP_TABLE_OWNER_PID_ALL
+
+// mibTCPRowOwnerPID is a MIB_TCPROW_OWNER_PID. Addresses and ports are in
+// network byte order, ports in the low 16 bits.
+type mibTCPRowOwnerPID struct {
+	State      uint32
+	LocalAddr  uint32
+	LocalPort  uint32
+	RemoteAddr uint32
+	RemotePort uint32
+	OwningPID  uint32
+}
+
+// lookupLocalProcess finds the process owning the client end of a loopback
+// TCP connection in the table GetExtendedTcpTable returns. Windows does not
+// report the owner's user here, so UID is -1.
+func lookupLocalProcess(remote netip.AddrPort, local net.Addr) (*LocalProcess, error) {
+	server, err := netip.ParseAddrPort(local.String())
+	if err != nil {
+		return nil, err
+	}
+	if !remote.Addr().Unmap().Is4() || !server.Addr().Unmap().Is4() {
+		return nil, fmt.Errorf("only IPv4 connections are looked up")
+	}
+
+	rows, err := tcpTable()
+	if err != nil {
+		return nil, err
+	}
+	// The client's socket has the client's address as its local one
+	for _, row := range rows {
+		if rowAddr(row.LocalAddr, row.LocalPort) != remote || rowAddr(row.RemoteAddr, row.RemotePort) != server {
+			continue
+		}
+		proc := &LocalProcess{PID: int(row.OwningPID), UID: -1}
+		if path, err := processPath(row.OwningPID); err == nil {
+			proc.Path = path
+			proc.Name = filepath.Base(path)
+		}
+		return proc, nil
+	}
+	return nil, fmt.Errorf("no socket from %s to %s", remote, server)
+}
+
+// tcpTable returns the IPv4 TCP connections with their owning processes
+func tcpTable() ([]mibTCPRowOwnerPID, error) {
+	var size uint32
+	for {
+		buf := make([]byte, size)
+		var ptr uintptr
+		if size > 0 {
+			ptr = uintptr(unsafe.Pointer(&buf[0]))
+		}
+		ret, _, _ := procGetExtendedTcpTable.Call(ptr, uintptr(unsafe.Pointer(&size)), 0, windows.AF_INET, tcpTableOwnerPIDAll, 0)
+		switch windows.Errno(ret) {
+		case windows.ERROR_INSUFFICIENT_BUFFER:
+			continue
+		case 0:
+		default:
+			return nil, fmt.Errorf("GetExtendedTcpTable: %w", windows.Errno(ret))
+		}
+
+		// MIB_TCPTABLE_OWNER_PID: a count, then the rows
+		n := binary.LittleEndian.Uint32(buf)
+		rowSize := unsafe.Sizeof(mibTCPRowOwnerPID{})
+		if uintptr(len(buf)) < 4+uintptr(n)*rowSize {
+			return nil, fmt.Errorf("GetExtendedTcpTable returned a short table")
+		}
+		return unsafe.Slice((*mibTCPRowOwnerPID)(unsafe.Pointer(&buf[4])), n), nil
+	}
+}
+
+// rowAddr converts an address and port of a table row
+func rowAddr(addr, port uint32) netip.AddrPort {
+	var ip [4]byte
+	binary.LittleEndian.PutUint32(ip[:], addr)
+	return netip.AddrPortFrom(netip.AddrFrom4(ip), uint16(port>>8&0xff|port<<8&0xff00))
+}
+
+// processPath returns the executable of the process pid
+func processPath(pid uint32) (string, error) {
+	h, err := windows.OpenProcess(windows.PROCESS_QUERY_LIMITED_INFORMATION, false, pid)
+	if err != nil {
+		return "", err
+	}
+	defer windows.CloseHandle(h)
+
+	buf := make([]uint16, windows.MAX_LONG_PATH)
+	size := uint32(len(buf))
+	if err := windows.QueryFullProcessImageName(h, 0, &buf[0], &size); err != nil {
+		return "", err
+	}
+	return windows.UTF16ToString(buf[:size]), nil
+}
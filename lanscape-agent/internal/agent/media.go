@@ -0,0 +1,346 @@
+package agent
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jhead/lanscape/lanscape-agent/pkg/protocol"
+	"github.com/oklog/ulid/v2"
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v4"
+)
+
+// keyframeInterval is how often a keyframe is requested from video sources,
+// so viewers that join mid-stream can start decoding
+const keyframeInterval = 3 * time.Second
+
+// MediaRelay relays audio/video tracks between the browser and mesh peers.
+// The browser publishes tracks over WHIP; they are added to the selected
+// peer connections. Tracks received from peers are announced to the browser,
+// which pulls them over WHEP.
+type MediaRelay struct {
+	mu      sync.RWMutex
+	webrtc  *WebRTCManager
+	api     *webrtc.API
+	ingests map[string]*mediaIngest
+	tracks  map[string]*webrtc.TrackLocalStaticRTP // "peerID/trackID" -> relayed remote track
+	egress  map[*webrtc.PeerConnection]bool
+	notify  func(msg protocol.AgentMessage)
+	logger  *slog.Logger
+}
+
+// mediaIngest is a browser-published stream and where it is being forwarded
+type mediaIngest struct {
+	pc      *webrtc.PeerConnection
+	peers   []string // target peers, empty for all
+	senders map[string][]*webrtc.RTPSender
+}
+
+// NewMediaRelay creates a media relay for one browser session
+func NewMediaRelay(m *WebRTCManager, notify func(msg protocol.AgentMessage), logger *slog.Logger) *MediaRelay {
+	r := &MediaRelay{
+		webrtc:  m,
+		api:     webrtc.NewAPI(),
+		ingests: make(map[string]*mediaIngest),
+		tracks:  make(map[string]*webrtc.TrackLocalStaticRTP),
+		egress:  make(map[*webrtc.PeerConnection]bool),
+		notify:  notify,
+		logger:  logger,
+	}
+	m.SetOnTrack(r.handleRemoteTrack)
+	return r
+}
+
+// Publish accepts a browser WHIP offer and forwards its tracks to peers.
+// It returns the ingest ID and the SDP answer.
+func (r *MediaRelay) Publish(offerSDP string, peers []string) (string, string, error) {
+	pc, err := r.api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		return "", "", fmt.Errorf("failed to create ingest connection: %w", err)
+	}
+
+	id := ulid.Make().String()
+	ingest := &mediaIngest{pc: pc, peers: peers, senders: make(map[string][]*webrtc.RTPSender)}
+
+	pc.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		r.logger.Info("browser published track", "ingest", id, "kind", track.Kind().String(), "codec", track.Codec().MimeType)
+
+		local, err := webrtc.NewTrackLocalStaticRTP(track.Codec().RTPCodecCapability, track.ID(), "lanscape-"+id)
+		if err != nil {
+			r.logger.Error("failed to create relay track", "error", err)
+			return
+		}
+		r.forwardToPeers(id, ingest, local)
+
+		if track.Kind() == webrtc.RTPCodecTypeVideo {
+			go requestKeyframes(pc, track)
+		}
+		copyRTP(track, local)
+	})
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if state == webrtc.PeerConnectionStateFailed || state == webrtc.PeerConnectionStateClosed {
+			r.Unpublish(id)
+		}
+	})
+
+	answer, err := answerLocal(pc, offerSDP)
+	if err != nil {
+		pc.Close()
+		return "", "", err
+	}
+
+	r.mu.Lock()
+	r.ingests[id] = ingest
+	r.mu.Unlock()
+
+	return id, answer, nil
+}
+
+// forwardToPeers adds a relay track to each target peer connection
+func (r *MediaRelay) forwardToPeers(id string, ingest *mediaIngest, track *webrtc.TrackLocalStaticRTP) {
+	peers := ingest.peers
+	if len(peers) == 0 {
+		peers = r.webrtc.PeerIDs()
+	}
+
+	for _, peerID := range peers {
+		sender, err := r.webrtc.AddTrack(peerID, track)
+		if err != nil {
+			r.logger.Warn("failed to forward track to peer", "ingest", id, "peer", peerID, "error", err)
+			continue
+		}
+		r.mu.Lock()
+		ingest.senders[peerID] = append(ingest.senders[peerID], sender)
+		r.mu.Unlock()
+	}
+}
+
+// Unpublish stops a browser-published stream and removes its tracks from peers
+func (r *MediaRelay) Unpublish(id string) bool {
+	r.mu.Lock()
+	ingest, ok := r.ingests[id]
+	delete(r.ingests, id)
+	r.mu.Unlock()
+	if !ok {
+		return false
+	}
+
+	for peerID, senders := range ingest.senders {
+		for _, sender := range senders {
+			if err := r.webrtc.RemoveTrack(peerID, sender); err != nil {
+				r.logger.Debug("failed to remove forwarded track", "peer", peerID, "error", err)
+			}
+		}
+	}
+	ingest.pc.Close()
+	r.logger.Info("browser stopped publishing", "ingest", id)
+	return true
+}
+
+// Subscribe accepts a browser WHEP offer for a track received from a peer
+// and returns the SDP answer
+func (r *MediaRelay) Subscribe(trackKey, offerSDP string) (string, error) {
+	r.mu.RLock()
+	track, ok := r.tracks[trackKey]
+	r.mu.RUnlock()
+	if !ok {
+		return "", fmt.Errorf("unknown track: %s", trackKey)
+	}
+
+	pc, err := r.api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		return "", fmt.Errorf("failed to create egress connection: %w", err)
+	}
+	if _, err := pc.AddTrack(track); err != nil {
+		pc.Close()
+		return "", fmt.Errorf("failed to add track: %w", err)
+	}
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if state == webrtc.PeerConnectionStateFailed || state == webrtc.PeerConnectionStateClosed {
+			r.mu.Lock()
+			delete(r.egress, pc)
+			r.mu.Unlock()
+		}
+	})
+
+	answer, err := answerLocal(pc, offerSDP)
+	if err != nil {
+		pc.Close()
+		return "", err
+	}
+
+	r.mu.Lock()
+	r.egress[pc] = true
+	r.mu.Unlock()
+	return answer, nil
+}
+
+// handleRemoteTrack relays a track received from a peer and announces it to the browser
+func (r *MediaRelay) handleRemoteTrack(peerID string, track *webrtc.TrackRemote) {
+	key := peerID + "/" + track.ID()
+	local, err := webrtc.NewTrackLocalStaticRTP(track.Codec().RTPCodecCapability, track.ID(), track.StreamID())
+	if err != nil {
+		r.logger.Error("failed to create relay track", "peer", peerID, "error", err)
+		return
+	}
+
+	r.mu.Lock()
+	r.tracks[key] = local
+	r.mu.Unlock()
+
+	r.logger.Info("received track from peer", "peer", peerID, "track", key, "kind", track.Kind().String())
+	r.notify(protocol.AgentMessage{
+		Type:    protocol.MessageTypeTrackAdded,
+		PeerID:  peerID,
+		TrackID: key,
+		Kind:    track.Kind().String(),
+	})
+
+	if track.Kind() == webrtc.RTPCodecTypeVideo {
+		if peer, err := r.webrtc.GetPeerConnection(peerID); err == nil {
+			go requestKeyframes(peer.PC, track)
+		}
+	}
+	copyRTP(track, local)
+
+	r.mu.Lock()
+	delete(r.tracks, key)
+	r.mu.Unlock()
+	r.notify(protocol.AgentMessage{
+		Type:    protocol.MessageTypeTrackRemoved,
+		PeerID:  peerID,
+		TrackID: key,
+	})
+}
+
+// Close stops all ingest and egress connections
+func (r *MediaRelay) Close() {
+	r.mu.Lock()
+	ids := make([]string, 0, len(r.ingests))
+	for id := range r.ingests {
+		ids = append(ids, id)
+	}
+	egress := r.egress
+	r.egress = make(map[*webrtc.PeerConnection]bool)
+	r.mu.Unlock()
+
+	for _, id := range ids {
+		r.Unpublish(id)
+	}
+	for pc := range egress {
+		pc.Close()
+	}
+}
+
+// answerLocal applies a browser offer and returns the answer once ICE gathering completes
+func answerLocal(pc *webrtc.PeerConnection, offerSDP string) (string, error) {
+	if err := pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: offerSDP}); err != nil {
+		return "", fmt.Errorf("failed to set remote description: %w", err)
+	}
+
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to create answer: %w", err)
+	}
+
+	// WHIP/WHEP have no trickle ICE here, so wait for all candidates
+	gathered := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(answer); err != nil {
+		return "", fmt.Errorf("failed to set local description: %w", err)
+	}
+	<-gathered
+
+	return pc.LocalDescription().SDP, nil
+}
+
+// copyRTP forwards packets from a remote track to a local track until the remote ends
+func copyRTP(src *webrtc.TrackRemote, dst *webrtc.TrackLocalStaticRTP) {
+	for {
+		packet, _, err := src.ReadRTP()
+		if err != nil {
+			return
+		}
+		if err := dst.WriteRTP(packet); err != nil && err != io.ErrClosedPipe {
+			return
+		}
+	}
+}
+
+// requestKeyframes periodically sends a PLI for a video track until the connection closes
+func requestKeyframes(pc *webrtc.PeerConnection, track *webrtc.TrackRemote) {
+	ticker := time.NewTicker(keyframeInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		err := pc.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: uint32(track.SSRC())}})
+		if err != nil || pc.ConnectionState() == webrtc.PeerConnectionStateClosed {
+			return
+		}
+	}
+}
+
+// serveMedia handles WHIP publish (POST /whip, DELETE /whip/{id}) and
+// WHEP subscribe (POST /whep?track=...) requests for a session's relay
+func serveMedia(w http.ResponseWriter, r *http.Request, relay *MediaRelay) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, DELETE, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	w.Header().Set("Access-Control-Expose-Headers", "Location")
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, "/whip/"):
+		if !relay.Unpublish(strings.TrimPrefix(r.URL.Path, "/whip/")) {
+			http.Error(w, "unknown stream", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+
+	case r.Method == http.MethodPost && r.URL.Path == "/whip":
+		offer, err := io.ReadAll(io.LimitReader(r.Body, 64*1024))
+		if err != nil {
+			http.Error(w, "failed to read offer", http.StatusBadRequest)
+			return
+		}
+		var peers []string
+		if p := r.URL.Query().Get("peers"); p != "" {
+			peers = strings.Split(p, ",")
+		}
+
+		id, answer, err := relay.Publish(string(offer), peers)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/sdp")
+		w.Header().Set("Location", "/whip/"+id)
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, answer)
+
+	case r.Method == http.MethodPost && r.URL.Path == "/whep":
+		offer, err := io.ReadAll(io.LimitReader(r.Body, 64*1024))
+		if err != nil {
+			http.Error(w, "failed to read offer", http.StatusBadRequest)
+			return
+		}
+
+		answer, err := relay.Subscribe(r.URL.Query().Get("track"), string(offer))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/sdp")
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, answer)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,280 @@
+package agent
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	// meshRebalanceInterval is how often a capped mesh hands slots to
+	// waiting peers
+	meshRebalanceInterval = 10 * time.Second
+	// meshIdleAfter is how long a connected peer must go without data before
+	// it gives up its slot to a waiting peer
+	meshIdleAfter = time.Minute
+	// meshConnectTimeout is how long a peer connection may take to connect
+	// before its slot goes to a waiting peer; the remote end may be capped
+	// itself and refusing the offer
+	meshConnectTimeout = 30 * time.Second
+)
+
+// meshCap limits how many peers a session connects to in its topic, so
+// small devices in large topics do not exhaust their resources. Peers
+// beyond the cap are degraded: no connection is offered or answered, and
+// the browser is told which peers it cannot reach. There is no relay for
+// them, so their data and broadcasts do not arrive until they get a slot.
+//
+// Slots go to active peers first. While peers wait, a connected peer idle
+// for meshIdleAfter gives up its slot, the slowest by measured latency
+// first, and the peer waiting longest takes it; the idle peer waits in turn.
+type meshCap struct {
+	max    func() int                       // current cap; 0 is unlimited
+	rank   func(peers []string) []string    // peers best first by latency
+	notify func(degraded []string, max int) // called when degraded peers change
+
+	mu       sync.Mutex
+	waiting  map[string]time.Time // degraded peer -> when it started waiting
+	reported string               // last degraded set and cap sent, to skip repeats
+}
+
+// useMeshCap caps the peers c connects to at max, checked whenever a peer
+// connects so config reloads apply, and starts rebalancing slots
+func (c *SignalingClient) useMeshCap(max func() int, rank func(peers []string) []string, notify func(degraded []string, max int)) {
+	c.mesh = &meshCap{max: max, rank: rank, notify: notify, waiting: make(map[string]time.Time)}
+	c.supervisor.Go("mesh-rebalance", c.rebalanceMeshLoop)
+}
+
+// admitPeer reports whether peerID may connect, degrading it if the mesh is
+// full. Peers already connected are always admitted.
+func (c *SignalingClient) admitPeer(peerID string) bool {
+	if c.mesh == nil {
+		return true
+	}
+	if _, err := c.webrtc.GetPeerConnection(peerID); err == nil {
+		return true
+	}
+	max := c.mesh.max()
+	if max <= 0 || len(c.webrtc.PeerIDs()) < max {
+		c.mesh.forget(peerID)
+		return true
+	}
+	if c.mesh.degrade(peerID) {
+		c.logger.Warn("topic peer cap reached, not connecting to peer", "peer", peerID, "max", max)
+		c.mesh.report(max)
+	}
+	return false
+}
+
+// fillMesh connects to waiting peers, longest waiting first, while the mesh
+// has free slots. It offers regardless of perfect negotiation politeness,
+// since a waiting peer's own offer was refused.
+func (c *SignalingClient) fillMesh() {
+	if c.mesh == nil {
+		return
+	}
+	max := c.mesh.max()
+	promoted := false
+	for {
+		if max > 0 && len(c.webrtc.PeerIDs()) >= max {
+			break
+		}
+		peerID, ok := c.mesh.next()
+		if !ok {
+			break
+		}
+		c.logger.Info("connecting to peer that was waiting for a mesh slot", "peer", peerID)
+		c.openPeer(peerID, true)
+		promoted = true
+	}
+	if promoted {
+		c.mesh.report(max)
+	}
+}
+
+// rebalanceMeshLoop rebalances the mesh until the client is closed
+func (c *SignalingClient) rebalanceMeshLoop() {
+	ticker := time.NewTicker(meshRebalanceInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.rebalanceMesh()
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
+
+// rebalanceMesh closes connections beyond a lowered cap, frees the slots of
+// peers that never connected or have gone idle while others wait, and hands
+// free slots to waiting peers
+func (c *SignalingClient) rebalanceMesh() {
+	max := c.mesh.max()
+	if max <= 0 {
+		// The cap was lifted; everyone waiting gets a connection
+		c.fillMesh()
+		return
+	}
+
+	connected := c.webrtc.PeerIDs()
+	excess := len(connected) - max
+	// Swap out at most one idle peer per peer that was waiting, so peers
+	// swapped out this pass do not displace others in turn
+	swaps := c.mesh.waitingCount()
+	for _, peerID := range c.evictionOrder(connected) {
+		stuck := c.peerStuck(peerID)
+		switch {
+		case excess > 0:
+			excess--
+		case stuck:
+		case swaps > 0 && c.peerIdle(peerID):
+			swaps--
+		default:
+			continue
+		}
+		c.logger.Info("freeing mesh slot", "peer", peerID, "stuck", stuck, "max", max)
+		c.webrtc.ClosePeer(peerID)
+		c.mesh.degrade(peerID)
+		// Fill the slot before the next eviction, so it goes to a peer that
+		// was already waiting
+		c.fillMesh()
+	}
+	c.fillMesh()
+	c.mesh.report(max)
+}
+
+// evictionOrder returns the connected peers in the order they give up their
+// slots: idle peers before active ones, then the slowest first
+func (c *SignalingClient) evictionOrder(peers []string) []string {
+	ranked := slices.Clone(peers)
+	if c.mesh.rank != nil {
+		ranked = c.mesh.rank(peers)
+	}
+	position := make(map[string]int, len(ranked))
+	for i, peerID := range ranked {
+		position[peerID] = i
+	}
+	sort.SliceStable(ranked, func(i, j int) bool {
+		idleI, idleJ := c.peerIdle(ranked[i]), c.peerIdle(ranked[j])
+		if idleI != idleJ {
+			return idleI
+		}
+		return position[ranked[i]] > position[ranked[j]]
+	})
+	return ranked
+}
+
+// peerIdle reports whether a connected peer has exchanged no data for
+// meshIdleAfter
+func (c *SignalingClient) peerIdle(peerID string) bool {
+	peer, err := c.webrtc.GetPeerConnection(peerID)
+	if err != nil {
+		return false
+	}
+	return time.Since(time.Unix(0, peer.lastActive.Load())) > meshIdleAfter
+}
+
+// peerStuck reports whether a peer connection has failed to connect within
+// meshConnectTimeout of its last activity
+func (c *SignalingClient) peerStuck(peerID string) bool {
+	peer, err := c.webrtc.GetPeerConnection(peerID)
+	if err != nil || peer.simulated || peer.PC == nil {
+		return false
+	}
+	return peer.PC.ConnectionState() != webrtc.PeerConnectionStateConnected &&
+		time.Since(time.Unix(0, peer.lastActive.Load())) > meshConnectTimeout
+}
+
+// degrade adds peerID to the waiting peers and reports whether it was new
+func (m *meshCap) degrade(peerID string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.waiting[peerID]; ok {
+		return false
+	}
+	m.waiting[peerID] = time.Now()
+	return true
+}
+
+// forget removes peerID from the waiting peers. A nil meshCap does nothing.
+func (m *meshCap) forget(peerID string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	_, ok := m.waiting[peerID]
+	delete(m.waiting, peerID)
+	m.mu.Unlock()
+	if ok {
+		m.report(m.max())
+	}
+}
+
+// prune removes waiting peers that are no longer in the topic. A nil
+// meshCap does nothing.
+func (m *meshCap) prune(listed map[string]bool) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	for peerID := range m.waiting {
+		if !listed[peerID] {
+			delete(m.waiting, peerID)
+		}
+	}
+	m.mu.Unlock()
+}
+
+// next removes and returns the peer waiting longest
+func (m *meshCap) next() (string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var next string
+	var since time.Time
+	for peerID, t := range m.waiting {
+		if next == "" || t.Before(since) || (t.Equal(since) && peerID < next) {
+			next, since = peerID, t
+		}
+	}
+	if next == "" {
+		return "", false
+	}
+	delete(m.waiting, next)
+	return next, true
+}
+
+// waitingCount returns how many peers are waiting for a slot
+func (m *meshCap) waitingCount() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.waiting)
+}
+
+// report tells the browser which peers are degraded, if that or the cap
+// changed since the last report
+func (m *meshCap) report(max int) {
+	if m.notify == nil {
+		return
+	}
+	m.mu.Lock()
+	degraded := make([]string, 0, len(m.waiting))
+	for peerID := range m.waiting {
+		degraded = append(degraded, peerID)
+	}
+	sort.Strings(degraded)
+	key := "" // nothing degraded, as before the first report
+	if len(degraded) > 0 {
+		key = fmt.Sprint(max, degraded)
+	}
+	changed := key != m.reported
+	m.reported = key
+	m.mu.Unlock()
+	if changed {
+		m.notify(degraded, max)
+	}
+}
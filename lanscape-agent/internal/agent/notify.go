@@ -0,0 +1,41 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+)
+
+const notifyTimeout = 5 * time.Second
+
+// Notifier raises desktop notifications for events the user should see even
+// when the browser tab is in the background
+type Notifier interface {
+	Notify(title, body string) error
+}
+
+// commandNotifier shows notifications by running a platform command. The
+// title and body are passed in LANSCAPE_NOTIFY_TITLE and LANSCAPE_NOTIFY_BODY
+// so they never need quoting for a script.
+type commandNotifier struct {
+	name string
+	args []string
+}
+
+// Notify runs the notification command
+func (n commandNotifier) Notify(title, body string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, n.name, n.args...)
+	cmd.Env = append(os.Environ(),
+		"LANSCAPE_NOTIFY_TITLE="+title,
+		"LANSCAPE_NOTIFY_BODY="+body,
+	)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s failed: %w: %s", n.name, err, out)
+	}
+	return nil
+}
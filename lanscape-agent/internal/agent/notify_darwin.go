@@ -0,0 +1,9 @@
+package agent
+
+// NewDesktopNotifier returns a notifier using Notification Center via osascript
+func NewDesktopNotifier() (Notifier, error) {
+	return commandNotifier{
+		name: "osascript",
+		args: []string{"-e", `display notification (system attribute "LANSCAPE_NOTIFY_BODY") with title (system attribute "LANSCAPE_NOTIFY_TITLE")`},
+	}, nil
+}
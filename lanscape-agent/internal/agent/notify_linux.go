@@ -0,0 +1,14 @@
+package agent
+
+import "os/exec"
+
+// NewDesktopNotifier returns a notifier using notify-send (libnotify)
+func NewDesktopNotifier() (Notifier, error) {
+	if _, err := exec.LookPath("notify-send"); err != nil {
+		return nil, err
+	}
+	return commandNotifier{
+		name: "sh",
+		args: []string{"-c", `notify-send --app-name=lanscape "$LANSCAPE_NOTIFY_TITLE" "$LANSCAPE_NOTIFY_BODY"`},
+	}, nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux && !darwin && !windows
+
+package agent
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// NewDesktopNotifier reports that desktop notifications are unsupported
+func NewDesktopNotifier() (Notifier, error) {
+	return nil, fmt.Errorf("desktop notifications are not supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,19 @@
+package agent
+
+// toastScript shows a toast notification through the WinRT API available to PowerShell
+const toastScript = `
+[Windows.UI.Notifications.ToastNotificationManager, Windows.UI.Notifications, ContentType = WindowsRuntime] > $null
+$t = [Windows.UI.Notifications.ToastNotificationManager]::GetTemplateContent([Windows.UI.Notifications.ToastTemplateType]::ToastText02)
+$x = $t.GetElementsByTagName('text')
+$x.Item(0).AppendChild($t.CreateTextNode($env:LANSCAPE_NOTIFY_TITLE)) > $null
+$x.Item(1).AppendChild($t.CreateTextNode($env:LANSCAPE_NOTIFY_BODY)) > $null
+[Windows.UI.Notifications.ToastNotificationManager]::CreateToastNotifier('lanscape-agent').Show([Windows.UI.Notifications.ToastNotification]::new($t))
+`
+
+// NewDesktopNotifier returns a notifier using Windows toast notifications
+func NewDesktopNotifier() (Notifier, error) {
+	return commandNotifier{
+		name: "powershell.exe",
+		args: []string{"-NoProfile", "-NonInteractive", "-Command", toastScript},
+	}, nil
+}
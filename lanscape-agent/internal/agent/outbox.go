@@ -0,0 +1,493 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/jhead/lanscape/lanscape-agent/pkg/protocol"
+	"github.com/oklog/ulid/v2"
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	outboxFileName     = "outbox.json"
+	outboxChannelLabel = "lanscape-outbox"
+
+	defaultOutboxMaxSize = 16 * 1024 * 1024
+	defaultOutboxTTL     = 7 * 24 * time.Hour
+	outboxAckTimeout     = 30 * time.Second
+)
+
+// OutboxConfig configures store-and-forward delivery to offline peers
+type OutboxConfig struct {
+	// Enabled lets the browser queue messages for known peers that are offline
+	Enabled bool
+	// MaxSize bounds the bytes of queued data across all peers (default 16MB)
+	MaxSize int64
+	// TTL is how long a message is kept waiting for its peer (default 7 days)
+	TTL time.Duration
+}
+
+// StoredMessage is a message queued for a peer identified by key fingerprint
+type StoredMessage struct {
+	ID     string    `json:"id"`
+	To     string    `json:"to"`
+	Data   []byte    `json:"data"`
+	Queued time.Time `json:"queued"`
+}
+
+// outboxState is the outbox file: queued messages, and the IDs of messages
+// already received from each peer so redeliveries are dropped
+type outboxState struct {
+	Messages []StoredMessage      `json:"messages"`
+	Seen     map[string]time.Time `json:"seen"` // fingerprint/id -> expiry
+}
+
+// Outbox persists messages for offline peers until they reconnect and
+// acknowledge them. It is shared by every session, like the trust store.
+type Outbox struct {
+	mu     sync.Mutex
+	path   string // empty keeps the outbox in memory
+	config OutboxConfig
+	state  outboxState
+	size   int64
+	logger *slog.Logger
+}
+
+// LoadOutbox loads the outbox from dir, starting empty if none exists. An
+// empty dir keeps the outbox in memory.
+func LoadOutbox(dir string, config OutboxConfig, logger *slog.Logger) (*Outbox, error) {
+	if config.MaxSize <= 0 {
+		config.MaxSize = defaultOutboxMaxSize
+	}
+	if config.TTL <= 0 {
+		config.TTL = defaultOutboxTTL
+	}
+
+	o := &Outbox{config: config, state: outboxState{Seen: make(map[string]time.Time)}, logger: logger}
+	if dir == "" {
+		return o, nil
+	}
+	o.path = filepath.Join(dir, outboxFileName)
+
+	data, err := os.ReadFile(o.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return o, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read outbox: %w", err)
+	}
+	if err := json.Unmarshal(data, &o.state); err != nil {
+		return nil, fmt.Errorf("failed to parse outbox: %w", err)
+	}
+	if o.state.Seen == nil {
+		o.state.Seen = make(map[string]time.Time)
+	}
+	for _, msg := range o.state.Messages {
+		o.size += int64(len(msg.Data))
+	}
+	o.pruneLocked()
+	return o, nil
+}
+
+// Add queues data for the peer with fingerprint to
+func (o *Outbox) Add(to, id string, data []byte) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.pruneLocked()
+	for _, msg := range o.state.Messages {
+		if msg.To == to && msg.ID == id {
+			return nil
+		}
+	}
+	if o.size+int64(len(data)) > o.config.MaxSize {
+		return fmt.Errorf("outbox full: %d of %d bytes queued", o.size, o.config.MaxSize)
+	}
+
+	o.state.Messages = append(o.state.Messages, StoredMessage{ID: id, To: to, Data: data, Queued: time.Now().UTC()})
+	o.size += int64(len(data))
+	return o.saveLocked()
+}
+
+// Pending returns the unexpired messages queued for a peer, oldest first
+func (o *Outbox) Pending(to string) []StoredMessage {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.pruneLocked() > 0 {
+		if err := o.saveLocked(); err != nil {
+			o.logger.Warn("failed to save outbox", "error", err)
+		}
+	}
+	var pending []StoredMessage
+	for _, msg := range o.state.Messages {
+		if msg.To == to {
+			pending = append(pending, msg)
+		}
+	}
+	return pending
+}
+
+// Ack removes a message its peer acknowledged or rejected, reporting whether
+// it was queued
+func (o *Outbox) Ack(to, id string) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	for i, msg := range o.state.Messages {
+		if msg.To == to && msg.ID == id {
+			o.state.Messages = append(o.state.Messages[:i], o.state.Messages[i+1:]...)
+			o.size -= int64(len(msg.Data))
+			if err := o.saveLocked(); err != nil {
+				o.logger.Warn("failed to save outbox", "error", err)
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// seen reports whether a message from a peer was already received
+func (o *Outbox) seen(from, id string) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	expiry, ok := o.state.Seen[from+"/"+id]
+	return ok && time.Now().Before(expiry)
+}
+
+// markSeen records a message received from a peer, reporting false if it
+// was already received
+func (o *Outbox) markSeen(from, id string) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	key := from + "/" + id
+	if expiry, ok := o.state.Seen[key]; ok && time.Now().Before(expiry) {
+		return false
+	}
+	o.state.Seen[key] = time.Now().Add(o.config.TTL).UTC()
+	if err := o.saveLocked(); err != nil {
+		o.logger.Warn("failed to save outbox", "error", err)
+	}
+	return true
+}
+
+// pruneLocked drops expired messages and seen IDs, returning the number of
+// messages dropped. Caller must hold o.mu.
+func (o *Outbox) pruneLocked() int {
+	now := time.Now()
+	kept := o.state.Messages[:0]
+	dropped := 0
+	for _, msg := range o.state.Messages {
+		if now.Sub(msg.Queued) > o.config.TTL {
+			o.logger.Info("dropping expired stored message", "to", msg.To, "id", msg.ID, "queued", msg.Queued)
+			o.size -= int64(len(msg.Data))
+			dropped++
+			continue
+		}
+		kept = append(kept, msg)
+	}
+	o.state.Messages = kept
+
+	for key, expiry := range o.state.Seen {
+		if now.After(expiry) {
+			delete(o.state.Seen, key)
+		}
+	}
+	return dropped
+}
+
+// saveLocked writes the outbox atomically. Caller must hold o.mu.
+func (o *Outbox) saveLocked() error {
+	if o.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(o.state)
+	if err != nil {
+		return fmt.Errorf("failed to marshal outbox: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(o.path), 0700); err != nil {
+		return fmt.Errorf("failed to create data directory: %w", err)
+	}
+	tmp := o.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write outbox: %w", err)
+	}
+	return os.Rename(tmp, o.path)
+}
+
+// outboxEnvelope is one message on the outbox channel. Senders fill ID,
+// Data, and Queued; receivers reply with Ack set to the message ID.
+type outboxEnvelope struct {
+	ID     string    `json:"id,omitempty"`
+	Data   []byte    `json:"data,omitempty"`
+	Queued time.Time `json:"queued,omitempty"`
+	Ack    string    `json:"ack,omitempty"`
+	Nack   string    `json:"nack,omitempty"`
+	Error  string    `json:"error,omitempty"`
+}
+
+// StoreForward delivers a session's share of the outbox: when a verified
+// peer connects, its queued messages are sent over a dedicated data channel
+// and removed once the peer acknowledges them. Receivers drop messages they
+// have already seen, so redelivery after a lost ack is harmless. Messages the
+// receiver refuses are nacked and removed without being delivered.
+type StoreForward struct {
+	outbox      *Outbox
+	webrtc      *WebRTCManager
+	fingerprint func(peerID string) string // verified key fingerprint, empty if none
+	ready       func(peerID string) bool   // peer may exchange data
+	// accept records a received message and reports whether it may reach
+	// the browser, with an error if it is invalid
+	accept      func(peerID string, data []byte) (bool, error)
+	onReceive   func(peerID, fingerprint string, msg StoredMessage)
+	onDelivered func(peerID string, msg StoredMessage)
+	onRejected  func(peerID string, msg StoredMessage, reason string)
+	logger      *slog.Logger
+
+	mu       sync.Mutex
+	flushing map[string]bool // peer IDs with a delivery in progress
+}
+
+// NewStoreForward handles the outbox channel for a session
+func NewStoreForward(outbox *Outbox, m *WebRTCManager, logger *slog.Logger) *StoreForward {
+	s := &StoreForward{
+		outbox:   outbox,
+		webrtc:   m,
+		logger:   logger,
+		flushing: make(map[string]bool),
+	}
+	m.HandleDataChannelLabel(outboxChannelLabel, s.handleChannel)
+	return s
+}
+
+// peerFor returns the connected peer with a fingerprint, if any
+func (s *StoreForward) peerFor(fingerprint string) (string, bool) {
+	for _, peerID := range s.webrtc.PeerIDs() {
+		if s.fingerprint(peerID) == fingerprint && s.ready(peerID) {
+			return peerID, true
+		}
+	}
+	return "", false
+}
+
+// flush delivers a peer's queued messages in the background. It does nothing
+// if s is nil, the peer has no verified identity, or nothing is queued.
+func (s *StoreForward) flush(peerID string) {
+	if s == nil || !s.ready(peerID) {
+		return
+	}
+	fingerprint := s.fingerprint(peerID)
+	if fingerprint == "" || len(s.outbox.Pending(fingerprint)) == 0 {
+		return
+	}
+
+	s.mu.Lock()
+	if s.flushing[peerID] {
+		s.mu.Unlock()
+		return
+	}
+	s.flushing[peerID] = true
+	s.mu.Unlock()
+
+	s.webrtc.supervisor.Go("outbox-flush", func() {
+		sent := make(map[string]bool)
+		err := s.deliver(s.webrtc.ctx, peerID, fingerprint, sent)
+		s.mu.Lock()
+		delete(s.flushing, peerID)
+		s.mu.Unlock()
+		if err != nil {
+			s.logger.Warn("failed to deliver stored messages", "peer", peerID, "error", err)
+			return
+		}
+		// Pick up messages queued while this delivery was running
+		for _, msg := range s.outbox.Pending(fingerprint) {
+			if !sent[msg.ID] {
+				s.flush(peerID)
+				return
+			}
+		}
+	})
+}
+
+// deliver sends every message queued for fingerprint and waits for their
+// acknowledgements. IDs sent are added to sent.
+func (s *StoreForward) deliver(ctx context.Context, peerID, fingerprint string, sent map[string]bool) error {
+	ordered := true
+	dc, err := s.webrtc.CreateDataChannel(peerID, outboxChannelLabel, &webrtc.DataChannelInit{Ordered: &ordered})
+	if err != nil {
+		return err
+	}
+	defer dc.Close()
+
+	ctx, cancel := context.WithTimeout(ctx, outboxAckTimeout)
+	defer cancel()
+
+	opened := make(chan struct{})
+	acks := make(chan outboxEnvelope, 64)
+	dc.OnOpen(func() { close(opened) })
+	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		var env outboxEnvelope
+		if msg.IsString && json.Unmarshal(msg.Data, &env) == nil && (env.Ack != "" || env.Nack != "") {
+			select {
+			case acks <- env:
+			case <-ctx.Done():
+			}
+		}
+	})
+
+	select {
+	case <-opened:
+	case <-ctx.Done():
+		return fmt.Errorf("outbox channel to %s did not open: %w", peerID, ctx.Err())
+	}
+
+	pending := s.outbox.Pending(fingerprint)
+	messages := make(map[string]StoredMessage, len(pending))
+	for _, msg := range pending {
+		body, err := json.Marshal(outboxEnvelope{ID: msg.ID, Data: msg.Data, Queued: msg.Queued})
+		if err != nil {
+			return fmt.Errorf("failed to marshal stored message: %w", err)
+		}
+		if err := dc.SendText(string(body)); err != nil {
+			return err
+		}
+		sent[msg.ID] = true
+		messages[msg.ID] = msg
+	}
+
+	for len(messages) > 0 {
+		select {
+		case env := <-acks:
+			id := env.Ack
+			if id == "" {
+				id = env.Nack
+			}
+			msg, ok := messages[id]
+			if !ok {
+				continue
+			}
+			delete(messages, id)
+			if !s.outbox.Ack(fingerprint, id) {
+				continue
+			}
+			if env.Nack != "" {
+				reason := env.Error
+				if len(reason) > maxRejectSize {
+					reason = reason[:maxRejectSize]
+				}
+				s.logger.Warn("peer rejected stored message", "peer", peerID, "id", id, "reason", reason)
+				if s.onRejected != nil {
+					s.onRejected(peerID, msg, reason)
+				}
+				continue
+			}
+			s.logger.Info("delivered stored message", "peer", peerID, "id", id, "size", len(msg.Data))
+			if s.onDelivered != nil {
+				s.onDelivered(peerID, msg)
+			}
+		case <-ctx.Done():
+			return fmt.Errorf("%d stored messages to %s were not acknowledged: %w", len(messages), peerID, ctx.Err())
+		}
+	}
+	return nil
+}
+
+// handleChannel receives stored messages from a peer, acknowledging each
+// once it has been handed to the browser or recognized as a duplicate, and
+// nacking those that fail validation
+func (s *StoreForward) handleChannel(peerID string, dc *webrtc.DataChannel) {
+	fingerprint := s.fingerprint(peerID)
+	if fingerprint == "" {
+		s.logger.Warn("rejecting stored messages from peer without a verified identity", "peer", peerID)
+		dc.Close()
+		return
+	}
+
+	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		var env outboxEnvelope
+		if !msg.IsString || json.Unmarshal(msg.Data, &env) != nil || env.ID == "" {
+			s.logger.Warn("rejecting invalid stored message", "peer", peerID)
+			dc.Close()
+			return
+		}
+		if !s.ready(peerID) {
+			s.logger.Debug("ignoring stored message from peer that is not ready", "peer", peerID, "id", env.ID)
+			return
+		}
+
+		if s.outbox.seen(fingerprint, env.ID) {
+			s.logger.Debug("dropping duplicate stored message", "peer", peerID, "id", env.ID)
+			ack, _ := json.Marshal(outboxEnvelope{Ack: env.ID})
+			dc.SendText(string(ack))
+			return
+		}
+		if s.accept != nil {
+			ok, err := s.accept(peerID, env.Data)
+			if err != nil {
+				s.logger.Warn("rejecting invalid stored message", "peer", peerID, "id", env.ID, "error", err)
+				nack, _ := json.Marshal(outboxEnvelope{Nack: env.ID, Error: err.Error()})
+				dc.SendText(string(nack))
+				return
+			}
+			if !ok {
+				return
+			}
+		}
+
+		if s.outbox.markSeen(fingerprint, env.ID) {
+			s.logger.Info("received stored message", "peer", peerID, "id", env.ID, "size", len(env.Data))
+			if s.onReceive != nil {
+				s.onReceive(peerID, fingerprint, StoredMessage{ID: env.ID, To: fingerprint, Data: env.Data, Queued: env.Queued})
+			}
+		} else {
+			s.logger.Debug("dropping duplicate stored message", "peer", peerID, "id", env.ID)
+		}
+
+		ack, _ := json.Marshal(outboxEnvelope{Ack: env.ID})
+		dc.SendText(string(ack))
+	})
+}
+
+// registerHandlers adds the store browser message to a bridge. Data is queued
+// for a known peer by fingerprint and sent right away if the peer is online.
+func (s *StoreForward) registerHandlers(b *Bridge, trustStore *TrustStore) {
+	b.RegisterHandler(protocol.MessageTypeStore, func(ctx context.Context, msg protocol.BrowserMessage) error {
+		if msg.Fingerprint == "" {
+			return errors.New("store requires a fingerprint")
+		}
+		if len(msg.Data) == 0 {
+			return errors.New("store requires data")
+		}
+		if trustStore == nil || !trustStore.Knows(msg.Fingerprint) {
+			return fmt.Errorf("unknown peer: %s", msg.Fingerprint)
+		}
+
+		id := msg.MessageID
+		if id == "" {
+			id = ulid.Make().String()
+		}
+		if err := s.outbox.Add(msg.Fingerprint, id, msg.Data); err != nil {
+			return err
+		}
+		b.sendToBrowser(protocol.AgentMessage{
+			Type:        protocol.MessageTypeStored,
+			Fingerprint: msg.Fingerprint,
+			MessageID:   id,
+		})
+
+		if peerID, ok := s.peerFor(msg.Fingerprint); ok {
+			s.flush(peerID)
+		}
+		return nil
+	})
+}
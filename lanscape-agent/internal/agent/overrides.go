@@ -0,0 +1,338 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/jhead/lanscape/lanscape-agent/pkg/protocol"
+)
+
+// Topic reliability modes for the application data channel
+const (
+	ReliabilityReliable   = "reliable"
+	ReliabilityUnreliable = "unreliable"
+)
+
+// Overrides is the operator configuration file: settings for individual
+// topics and peers, consulted at runtime and reloadable without a restart
+type Overrides struct {
+	Topics map[string]TopicOverrides `json:"topics,omitempty"`
+	Peers  map[string]PeerOverrides  `json:"peers,omitempty"`
+}
+
+// TopicOverrides are settings for one signaling topic
+type TopicOverrides struct {
+	// Reliability of the application data channel: "reliable" (ordered,
+	// retransmitted; the default) or "unreliable" (unordered, no retransmits)
+	Reliability string `json:"reliability,omitempty"`
+	// Schema is a JSON Schema application payloads from peers must match.
+	// Invalid messages are dropped and the sender is told why.
+	Schema json.RawMessage `json:"schema,omitempty"`
+	// MaxPeers caps the peers connected in the topic, replacing -max-topic-peers
+	// for it. 0 uses the flag.
+	MaxPeers int `json:"maxPeers,omitempty"`
+}
+
+// PeerOverrides are settings for one peer. Peers are matched by peer ID,
+// identity key fingerprint, or advertised name.
+type PeerOverrides struct {
+	// MaxBandwidth caps application data sent to the peer, in bytes per second
+	MaxBandwidth int64 `json:"maxBandwidth,omitempty"`
+	// Blocked refuses connections and data from the peer
+	Blocked bool `json:"blocked,omitempty"`
+	// Muted drops data to and from the peer but keeps the connection open
+	Muted bool `json:"muted,omitempty"`
+}
+
+// OverrideStore holds the current overrides loaded from a file. A nil store
+// has no overrides.
+type OverrideStore struct {
+	mu        sync.RWMutex
+	path      string
+	current   Overrides
+	schemas   map[string]*Schema // topic -> compiled payload schema
+	listeners map[int]func()
+	nextID    int
+	logger    *slog.Logger
+}
+
+// LoadOverrides loads overrides from path. An empty path yields an empty store
+// that can never be reloaded.
+func LoadOverrides(path string, logger *slog.Logger) (*OverrideStore, error) {
+	s := &OverrideStore{path: path, listeners: make(map[int]func()), logger: logger}
+	if path == "" {
+		return s, nil
+	}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload re-reads the overrides file and notifies listeners. A missing file
+// means no overrides. The previous overrides stay in effect if the file cannot
+// be read or parsed.
+func (s *OverrideStore) Reload() error {
+	if s == nil || s.path == "" {
+		return fmt.Errorf("no config file to reload")
+	}
+
+	var o Overrides
+	data, err := os.ReadFile(s.path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read config: %w", err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &o); err != nil {
+			return fmt.Errorf("failed to parse config: %w", err)
+		}
+	}
+	schemas := make(map[string]*Schema)
+	for name, t := range o.Topics {
+		switch t.Reliability {
+		case "", ReliabilityReliable, ReliabilityUnreliable:
+		default:
+			return fmt.Errorf("invalid reliability for topic %s: %q", name, t.Reliability)
+		}
+		if t.MaxPeers < 0 {
+			return fmt.Errorf("invalid maxPeers for topic %s: %d", name, t.MaxPeers)
+		}
+		if len(t.Schema) > 0 {
+			schema, err := CompileSchema(t.Schema)
+			if err != nil {
+				return fmt.Errorf("invalid schema for topic %s: %w", name, err)
+			}
+			schemas[name] = schema
+		}
+	}
+
+	s.mu.Lock()
+	s.current = o
+	s.schemas = schemas
+	listeners := s.listenersLocked()
+	s.mu.Unlock()
+
+	s.logger.Info("loaded config overrides", "path", s.path, "topics", len(o.Topics), "peers", len(o.Peers))
+	for _, fn := range listeners {
+		fn()
+	}
+	return nil
+}
+
+// BlockPeer blocks the peer configured under key and saves the config file.
+// With close, connections to the peer are refused and closed; otherwise the
+// peer is muted and stays connected.
+func (s *OverrideStore) BlockPeer(key string, close bool) error {
+	return s.updatePeers(func(peers map[string]PeerOverrides) {
+		p := peers[key]
+		p.Blocked = close
+		p.Muted = !close
+		peers[key] = p
+	})
+}
+
+// UnblockPeer clears blocking and muting from every entry matching keys and
+// saves the config file
+func (s *OverrideStore) UnblockPeer(keys ...string) error {
+	return s.updatePeers(func(peers map[string]PeerOverrides) {
+		for _, key := range keys {
+			p, ok := peers[key]
+			if !ok {
+				continue
+			}
+			p.Blocked = false
+			p.Muted = false
+			if p == (PeerOverrides{}) {
+				delete(peers, key)
+			} else {
+				peers[key] = p
+			}
+		}
+	})
+}
+
+// updatePeers applies fn to the peer overrides, saves them, and notifies
+// listeners. Without a config file the change lasts until restart.
+func (s *OverrideStore) updatePeers(fn func(peers map[string]PeerOverrides)) error {
+	if s == nil {
+		return fmt.Errorf("no config overrides")
+	}
+
+	s.mu.Lock()
+	updated := s.current
+	updated.Peers = make(map[string]PeerOverrides, len(s.current.Peers)+1)
+	for key, p := range s.current.Peers {
+		updated.Peers[key] = p
+	}
+	fn(updated.Peers)
+
+	if s.path != "" {
+		if err := saveOverrides(s.path, updated); err != nil {
+			s.mu.Unlock()
+			return err
+		}
+	}
+	s.current = updated
+	listeners := s.listenersLocked()
+	s.mu.Unlock()
+
+	for _, fn := range listeners {
+		fn()
+	}
+	return nil
+}
+
+// saveOverrides atomically replaces the config file with o
+func saveOverrides(path string, o Overrides) error {
+	data, err := json.MarshalIndent(o, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal config: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create config directory: %w", err)
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0600); err != nil {
+		return fmt.Errorf("failed to write config: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to save config: %w", err)
+	}
+	return nil
+}
+
+// listenersLocked snapshots the reload listeners. Caller must hold s.mu.
+func (s *OverrideStore) listenersLocked() []func() {
+	listeners := make([]func(), 0, len(s.listeners))
+	for _, fn := range s.listeners {
+		listeners = append(listeners, fn)
+	}
+	return listeners
+}
+
+// OnReload registers fn to run after each successful reload and returns a
+// function that unregisters it
+func (s *OverrideStore) OnReload(fn func()) func() {
+	if s == nil {
+		return func() {}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := s.nextID
+	s.nextID++
+	s.listeners[id] = fn
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		delete(s.listeners, id)
+	}
+}
+
+// Topic returns the overrides for a topic
+func (s *OverrideStore) Topic(name string) TopicOverrides {
+	if s == nil {
+		return TopicOverrides{}
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.current.Topics[name]
+}
+
+// Schema returns the compiled payload schema for a topic, or nil
+func (s *OverrideStore) Schema(topic string) *Schema {
+	if s == nil {
+		return nil
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.schemas[topic]
+}
+
+// Peer returns the overrides for a peer known by any of keys. When several
+// entries match, a peer is blocked if any entry blocks it and the lowest
+// bandwidth cap applies.
+func (s *OverrideStore) Peer(keys ...string) PeerOverrides {
+	var merged PeerOverrides
+	if s == nil {
+		return merged
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, key := range keys {
+		if key == "" {
+			continue
+		}
+		p, ok := s.current.Peers[key]
+		if !ok {
+			continue
+		}
+		merged.Blocked = merged.Blocked || p.Blocked
+		merged.Muted = merged.Muted || p.Muted
+		if p.MaxBandwidth > 0 && (merged.MaxBandwidth == 0 || p.MaxBandwidth < merged.MaxBandwidth) {
+			merged.MaxBandwidth = p.MaxBandwidth
+		}
+	}
+	return merged
+}
+
+// registerOverrideHandlers adds the reload admin message and peer blocking
+// to a bridge
+func registerOverrideHandlers(b *Bridge, store *OverrideStore, signaling *SignalingClient) {
+	b.RegisterHandler(protocol.MessageTypeReload, func(ctx context.Context, msg protocol.BrowserMessage) error {
+		if err := store.Reload(); err != nil {
+			return err
+		}
+		b.sendToBrowser(protocol.AgentMessage{Type: protocol.MessageTypeReloaded})
+		return nil
+	})
+
+	b.RegisterHandler(protocol.MessageTypeBlockPeer, func(ctx context.Context, msg protocol.BrowserMessage) error {
+		if msg.PeerID == "" {
+			return fmt.Errorf("peerId required")
+		}
+		key := stablePeerKey(signaling, msg.PeerID)
+		if err := store.BlockPeer(key, msg.Close); err != nil {
+			return err
+		}
+		b.logger.Info("blocked peer", "peer", msg.PeerID, "key", key, "closed", msg.Close)
+		b.sendToBrowser(protocol.AgentMessage{Type: protocol.MessageTypePeerBlocked, PeerID: msg.PeerID, Name: key})
+		return nil
+	})
+
+	b.RegisterHandler(protocol.MessageTypeUnblockPeer, func(ctx context.Context, msg protocol.BrowserMessage) error {
+		if msg.PeerID == "" {
+			return fmt.Errorf("peerId required")
+		}
+		keys := append([]string{msg.PeerID}, signaling.peerKeys(msg.PeerID)...)
+		if err := store.UnblockPeer(keys...); err != nil {
+			return err
+		}
+		b.logger.Info("unblocked peer", "peer", msg.PeerID)
+		b.sendToBrowser(protocol.AgentMessage{Type: protocol.MessageTypePeerUnblocked, PeerID: msg.PeerID})
+		return nil
+	})
+}
+
+// stablePeerKey names a peer for blocks and usage reports: the identity key
+// fingerprint if the peer has one, else its advertised name, else its peer
+// ID (which lasts only as long as the peer's signaling connection)
+func stablePeerKey(signaling *SignalingClient, peerID string) string {
+	identity, ok := signaling.PeerIdentity(peerID)
+	if !ok {
+		return peerID
+	}
+	if publicKey, err := ParsePublicKey(identity.PublicKey); err == nil {
+		return Fingerprint(publicKey)
+	}
+	if identity.Name != "" {
+		return identity.Name
+	}
+	return peerID
+}
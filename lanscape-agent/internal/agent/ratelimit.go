@@ -0,0 +1,85 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// maxRateLimitRetries is how many times a rate limited request is retried
+	maxRateLimitRetries = 3
+	// maxRateLimitWait is the longest a request waits to be retried; servers
+	// asking for longer are reported as RateLimitedError straight away
+	maxRateLimitWait = 30 * time.Second
+)
+
+// RateLimitedError is returned when lanscaped or the signaling server
+// refused a request as rate limited, and retrying did not help. Callers
+// should wait RetryAfter before trying again.
+type RateLimitedError struct {
+	URL        string
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitedError) Error() string {
+	return fmt.Sprintf("%s is rate limiting requests; retry after %s", e.URL, e.RetryAfter)
+}
+
+// doWithBackoff sends the request newRequest builds, waiting as long as the
+// server's Retry-After asks and sending it again when it is rate limited.
+// It gives up with a RateLimitedError after maxRateLimitRetries, or as soon
+// as the server asks for a longer wait than maxRateLimitWait or than ctx
+// allows.
+func doWithBackoff(ctx context.Context, client *http.Client, newRequest func() (*http.Request, error)) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		req, err := newRequest()
+		if err != nil {
+			return nil, err
+		}
+		resp, err := client.Do(req)
+		if err != nil || resp.StatusCode != http.StatusTooManyRequests {
+			return resp, err
+		}
+		resp.Body.Close()
+
+		// Servers that do not say how long to wait get exponential backoff
+		wait := retryAfter(resp, time.Second<<attempt)
+		limited := &RateLimitedError{URL: req.URL.Redacted(), RetryAfter: wait}
+		if attempt == maxRateLimitRetries || wait > maxRateLimitWait {
+			return nil, limited
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < wait {
+			return nil, limited
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// retryAfter returns how long a rate limited response asks clients to wait,
+// from Retry-After in seconds or as an HTTP date, or fallback if it has none
+func retryAfter(resp *http.Response, fallback time.Duration) time.Duration {
+	v := resp.Header.Get("Retry-After")
+	if seconds, err := strconv.Atoi(v); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return max(time.Until(t), 0)
+	}
+	return fallback
+}
+
+// dialError explains a failed WebSocket dial to url, as a RateLimitedError
+// if the server refused the handshake as rate limited
+func dialError(url string, resp *http.Response, err error) error {
+	if resp != nil && resp.StatusCode == http.StatusTooManyRequests {
+		err = &RateLimitedError{URL: url, RetryAfter: retryAfter(resp, time.Second)}
+	}
+	return fmt.Errorf("failed to connect to signaling server: %w", err)
+}
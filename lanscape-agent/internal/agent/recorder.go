@@ -0,0 +1,296 @@
+package agent
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jhead/lanscape/lanscape-agent/pkg/protocol"
+)
+
+// Record directions, relative to the agent
+const (
+	RecordBrowserIn  = "browser-in"
+	RecordBrowserOut = "browser-out"
+	RecordPeerIn     = "peer-in"
+	RecordPeerOut    = "peer-out"
+)
+
+// Record is one recorded bridge envelope
+type Record struct {
+	Time      time.Time       `json:"time"`
+	Session   int64           `json:"session"`
+	Direction string          `json:"direction"`
+	Type      string          `json:"type,omitempty"`
+	PeerID    string          `json:"peerId,omitempty"`
+	Size      int             `json:"size"`
+	Hash      string          `json:"hash"`
+	Body      json.RawMessage `json:"body,omitempty"`
+}
+
+// RecorderConfig configures session recording
+type RecorderConfig struct {
+	Path string
+	// IncludeBodies stores full envelopes so the recording can be replayed
+	IncludeBodies bool
+	// MaxSize is the size in bytes at which the file is rotated (0 disables rotation)
+	MaxSize int64
+	// MaxFiles is the number of rotated files to keep alongside the active one
+	MaxFiles int
+}
+
+// Recorder writes bridge traffic to a rotating JSON-lines file.
+// It is shared by all browser sessions; each session gets its own number.
+type Recorder struct {
+	mu       sync.Mutex
+	config   RecorderConfig
+	file     *os.File
+	writer   *bufio.Writer
+	size     int64
+	sessions atomic.Int64
+}
+
+// NewRecorder opens (or appends to) the recording file
+func NewRecorder(config RecorderConfig) (*Recorder, error) {
+	r := &Recorder{config: config}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// NextSession returns a new session number for records
+func (r *Recorder) NextSession() int64 {
+	return r.sessions.Add(1)
+}
+
+// RecordBrowser records a browser envelope in the given direction
+func (r *Recorder) RecordBrowser(session int64, direction string, msgType, peerID string, envelope interface{}, dataSize int) {
+	body, err := json.Marshal(envelope)
+	if err != nil {
+		return
+	}
+	r.write(session, direction, msgType, peerID, body, dataSize)
+}
+
+// RecordPeer records a data channel payload in the given direction
+func (r *Recorder) RecordPeer(session int64, direction string, peerID string, data []byte) {
+	body, err := json.Marshal(data)
+	if err != nil {
+		return
+	}
+	r.write(session, direction, "", peerID, body, len(data))
+}
+
+// write appends a record, rotating the file when it grows past MaxSize
+func (r *Recorder) write(session int64, direction, msgType, peerID string, body []byte, size int) {
+	sum := sha256.Sum256(body)
+	rec := Record{
+		Time:      time.Now().UTC(),
+		Session:   session,
+		Direction: direction,
+		Type:      msgType,
+		PeerID:    peerID,
+		Size:      size,
+		Hash:      hex.EncodeToString(sum[:]),
+	}
+	if r.config.IncludeBodies {
+		rec.Body = body
+	}
+
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.writer == nil {
+		return
+	}
+	if r.config.MaxSize > 0 && r.size+int64(len(line)) > r.config.MaxSize {
+		if err := r.rotate(); err != nil {
+			return
+		}
+	}
+
+	n, _ := r.writer.Write(line)
+	r.size += int64(n)
+	r.writer.Flush()
+}
+
+// open opens the active recording file for appending
+func (r *Recorder) open() error {
+	f, err := os.OpenFile(r.config.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open recording: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to stat recording: %w", err)
+	}
+
+	r.file = f
+	r.writer = bufio.NewWriter(f)
+	r.size = info.Size()
+	return nil
+}
+
+// rotate shifts path -> path.1 -> path.2 ... and reopens. Caller must hold r.mu.
+func (r *Recorder) rotate() error {
+	r.writer.Flush()
+	r.file.Close()
+	r.writer = nil
+
+	if r.config.MaxFiles > 0 {
+		os.Remove(fmt.Sprintf("%s.%d", r.config.Path, r.config.MaxFiles))
+		for i := r.config.MaxFiles - 1; i >= 1; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", r.config.Path, i), fmt.Sprintf("%s.%d", r.config.Path, i+1))
+		}
+		os.Rename(r.config.Path, r.config.Path+".1")
+	} else {
+		os.Remove(r.config.Path)
+	}
+
+	return r.open()
+}
+
+// Close flushes and closes the recording file
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.writer == nil {
+		return nil
+	}
+	r.writer.Flush()
+	r.writer = nil
+	return r.file.Close()
+}
+
+// ReplayResult summarizes a replay run
+type ReplayResult struct {
+	Replayed   int
+	Skipped    int
+	Expected   int
+	Produced   int
+	Mismatches []ReplayMismatch
+}
+
+// ReplayMismatch describes a browser-out envelope that differs from the recording
+type ReplayMismatch struct {
+	Index    int
+	Expected Record
+	Got      protocol.AgentMessage
+}
+
+// Replay feeds the browser-in and peer-in records of one session back
+// through bridge in order, and compares the browser-bound messages it
+// produces against the recorded browser-out envelopes by hash.
+// When realtime is set, the original gaps between records are preserved.
+// Replay stops early with ctx's error if ctx is done.
+func Replay(ctx context.Context, in io.Reader, session int64, bridge *Bridge, realtime bool) (*ReplayResult, error) {
+	var produced []protocol.AgentMessage
+	var mu sync.Mutex
+	bridge.SetBrowserSend(func(msg protocol.AgentMessage) error {
+		mu.Lock()
+		produced = append(produced, msg)
+		mu.Unlock()
+		return nil
+	})
+
+	result := &ReplayResult{}
+	var expected []Record
+	var last time.Time
+
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		var rec Record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("failed to parse record: %w", err)
+		}
+		if rec.Session != session {
+			continue
+		}
+
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if realtime && !last.IsZero() {
+			t := time.NewTimer(rec.Time.Sub(last))
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				t.Stop()
+				return nil, ctx.Err()
+			}
+		}
+		last = rec.Time
+
+		switch rec.Direction {
+		case RecordBrowserOut:
+			expected = append(expected, rec)
+			continue
+		case RecordPeerOut:
+			continue
+		}
+
+		if rec.Body == nil {
+			result.Skipped++
+			continue
+		}
+
+		switch rec.Direction {
+		case RecordBrowserIn:
+			var msg protocol.BrowserMessage
+			if err := json.Unmarshal(rec.Body, &msg); err != nil {
+				return nil, fmt.Errorf("failed to parse browser envelope: %w", err)
+			}
+			_ = bridge.HandleBrowserMessage(ctx, msg)
+		case RecordPeerIn:
+			var data []byte
+			if err := json.Unmarshal(rec.Body, &data); err != nil {
+				return nil, fmt.Errorf("failed to parse peer payload: %w", err)
+			}
+			bridge.handleDataChannelMessage(rec.PeerID, data)
+		}
+		result.Replayed++
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read recording: %w", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	result.Expected = len(expected)
+	result.Produced = len(produced)
+	for i, msg := range produced {
+		body, err := json.Marshal(msg)
+		if err != nil {
+			continue
+		}
+		sum := sha256.Sum256(body)
+		if i >= len(expected) || expected[i].Hash != hex.EncodeToString(sum[:]) {
+			mismatch := ReplayMismatch{Index: i, Got: msg}
+			if i < len(expected) {
+				mismatch.Expected = expected[i]
+			}
+			result.Mismatches = append(result.Mismatches, mismatch)
+		}
+	}
+
+	return result, nil
+}
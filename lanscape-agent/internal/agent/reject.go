@@ -0,0 +1,97 @@
+package agent
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	rejectChannelLabel = "lanscape-reject"
+
+	// rejectInterval rate-limits rejection notices to each peer, so a peer
+	// sending a flood of invalid messages does not cause a flood of channels
+	rejectInterval = time.Second
+	rejectTimeout  = 10 * time.Second
+	maxRejectSize  = 1024
+)
+
+// Rejections tells peers when their application messages fail validation
+// and reports rejections of our own messages. Each notice travels on a
+// short-lived data channel so it never mixes with application traffic.
+type Rejections struct {
+	webrtc     *WebRTCManager
+	onRejected func(peerID, reason string)
+	mu         sync.Mutex
+	lastSent   map[string]time.Time
+	logger     *slog.Logger
+}
+
+// NewRejections creates the rejection subsystem; onRejected is called when a
+// peer rejects a message we sent
+func NewRejections(m *WebRTCManager, onRejected func(peerID, reason string), logger *slog.Logger) *Rejections {
+	r := &Rejections{
+		webrtc:     m,
+		onRejected: onRejected,
+		lastSent:   make(map[string]time.Time),
+		logger:     logger,
+	}
+	m.HandleDataChannelLabel(rejectChannelLabel, r.handleChannel)
+	return r
+}
+
+// Reject notifies a peer that one of its messages was rejected (best-effort)
+func (r *Rejections) Reject(peerID, reason string) {
+	r.mu.Lock()
+	if time.Since(r.lastSent[peerID]) < rejectInterval {
+		r.mu.Unlock()
+		return
+	}
+	r.lastSent[peerID] = time.Now()
+	r.mu.Unlock()
+
+	if len(reason) > maxRejectSize {
+		reason = reason[:maxRejectSize]
+	}
+
+	ordered := true
+	dc, err := r.webrtc.CreateDataChannel(peerID, rejectChannelLabel, &webrtc.DataChannelInit{Ordered: &ordered})
+	if err != nil {
+		r.logger.Debug("failed to open reject channel", "peer", peerID, "error", err)
+		return
+	}
+	dc.OnOpen(func() {
+		if err := dc.SendText(reason); err != nil {
+			r.logger.Debug("failed to send rejection", "peer", peerID, "error", err)
+		}
+	})
+	// The receiver closes the channel once it has read the notice
+	time.AfterFunc(rejectTimeout, func() { dc.Close() })
+}
+
+// handleChannel receives a rejection notice from a peer
+func (r *Rejections) handleChannel(peerID string, dc *webrtc.DataChannel) {
+	var once sync.Once
+	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		once.Do(func() {
+			dc.Close()
+			reason := string(msg.Data)
+			if len(reason) > maxRejectSize {
+				reason = reason[:maxRejectSize]
+			}
+			r.logger.Warn("peer rejected message", "peer", peerID, "reason", reason)
+			if r.onRejected != nil {
+				r.onRejected(peerID, reason)
+			}
+		})
+	})
+}
+
+// forget drops rate-limit state for a peer that has closed
+func (r *Rejections) forget(peerID string) {
+	r.mu.Lock()
+	delete(r.lastSent, peerID)
+	r.mu.Unlock()
+}
@@ -0,0 +1,154 @@
+package agent
+
+import (
+	"encoding/json"
+	"slices"
+	"time"
+
+	"github.com/jhead/lanscape/signaling/pkg/signaling"
+	"github.com/oklog/ulid/v2"
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	// offerAckTimeout is how long an offer waits for the server's ack before
+	// it is resent
+	offerAckTimeout = 3 * time.Second
+	// maxOfferAttempts bounds how many times one offer is sent
+	maxOfferAttempts = 3
+)
+
+// pendingOffer is an offer sent with an ack request, resent until the
+// server acks it
+type pendingOffer struct {
+	msg      signaling.InboundMessage
+	attempts int
+	timer    *time.Timer
+}
+
+// sendOffer relays an offer to peerID. If the server acks relays, it asks
+// for one and resends the offer, with the same message ID, when the relay
+// fails with a retryable error or no ack arrives in time. A newer offer to
+// the same peer replaces a pending one.
+func (c *SignalingClient) sendOffer(peerID string, payload json.RawMessage) {
+	hints := c.Hints()
+	if hints == nil || !slices.Contains(hints.Features, "ack") {
+		c.sendRelay("offer", peerID, payload, "")
+		return
+	}
+
+	msg := signaling.InboundMessage{
+		Type:    "offer",
+		To:      peerID,
+		Payload: payload,
+		MsgID:   ulid.Make().String(),
+		Ack:     true,
+	}
+	pending := &pendingOffer{msg: msg, attempts: 1}
+	c.mu.Lock()
+	if old := c.unackedOffers[peerID]; old != nil {
+		old.timer.Stop()
+	}
+	c.unackedOffers[peerID] = pending
+	pending.timer = time.AfterFunc(offerAckTimeout, func() { c.retryOffer(peerID, msg.MsgID, "ack timeout") })
+	c.mu.Unlock()
+
+	if err := c.send(msg); err != nil {
+		c.logger.Error("failed to send relay message", "error", err)
+	}
+}
+
+// handleAck stops resending the offer the server acked
+func (c *SignalingClient) handleAck(msgID string) {
+	if peerID, attempts, ok := c.forgetOffer(msgID); ok {
+		c.logger.Debug("offer delivered", "peer", peerID, "msgId", msgID, "attempts", attempts)
+	}
+}
+
+// handleRelayError resends a pending offer the server failed to deliver for
+// a reason that may pass, and gives up on it otherwise. Refused app-relays
+// are reported instead.
+func (c *SignalingClient) handleRelayError(code, msgID string) {
+	if msgID == "" || c.appRelay.handleError(code, msgID) {
+		return
+	}
+	if code != "dropped" && code != "rate_limited" {
+		c.forgetOffer(msgID)
+		return
+	}
+	c.mu.RLock()
+	var peerID string
+	for id, pending := range c.unackedOffers {
+		if pending.msg.MsgID == msgID {
+			peerID = id
+		}
+	}
+	c.mu.RUnlock()
+	if peerID != "" {
+		c.retryOffer(peerID, msgID, code)
+	}
+}
+
+// retryOffer resends the pending offer msgID to peerID, unless it has been
+// acked or replaced, the peer has since left the have-local-offer state, or
+// it has been sent maxOfferAttempts times
+func (c *SignalingClient) retryOffer(peerID, msgID, reason string) {
+	peer, err := c.webrtc.GetPeerConnection(peerID)
+	stale := err != nil || peer.PC.SignalingState() != webrtc.SignalingStateHaveLocalOffer
+
+	c.mu.Lock()
+	pending := c.unackedOffers[peerID]
+	if pending == nil || pending.msg.MsgID != msgID {
+		c.mu.Unlock()
+		return
+	}
+	pending.timer.Stop()
+	if stale || pending.attempts >= maxOfferAttempts {
+		delete(c.unackedOffers, peerID)
+		c.mu.Unlock()
+		if !stale {
+			c.logger.Warn("giving up on offer", "peer", peerID, "msgId", msgID, "reason", reason, "attempts", pending.attempts)
+		}
+		return
+	}
+	pending.attempts++
+	attempts := pending.attempts
+	// Back off linearly, so a rate-limited or congested server can recover
+	pending.timer = time.AfterFunc(time.Duration(attempts)*offerAckTimeout, func() { c.retryOffer(peerID, msgID, "ack timeout") })
+	c.mu.Unlock()
+
+	c.logger.Info("resending offer", "peer", peerID, "msgId", msgID, "reason", reason, "attempt", attempts)
+	if err := c.send(pending.msg); err != nil {
+		c.logger.Error("failed to send relay message", "error", err)
+	}
+}
+
+// forgetOffer stops resending the pending offer msgID and returns the peer
+// it was for and how many times it was sent, or false if none is pending
+func (c *SignalingClient) forgetOffer(msgID string) (peerID string, attempts int, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for peerID, pending := range c.unackedOffers {
+		if pending.msg.MsgID == msgID {
+			pending.timer.Stop()
+			delete(c.unackedOffers, peerID)
+			return peerID, pending.attempts, true
+		}
+	}
+	return "", 0, false
+}
+
+// duplicateOffer reports whether an offer from peerID is a resend of the
+// last one handled, which must not be answered twice, and records it
+func (c *SignalingClient) duplicateOffer(peerID, msgID string) bool {
+	if msgID == "" {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.lastOfferIDs[peerID] == msgID {
+		return true
+	}
+	c.lastOfferIDs[peerID] = msgID
+	return false
+}
@@ -0,0 +1,262 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"unicode/utf8"
+)
+
+// Schema is a compiled JSON Schema used to validate application payloads.
+// It supports the commonly used subset of the specification: type, enum,
+// const, properties, required, additionalProperties, items, minItems,
+// maxItems, minLength, maxLength, minimum, and maximum. Other keywords are
+// ignored.
+type Schema struct {
+	Types                []string           `json:"-"`
+	Enum                 []any              `json:"enum,omitempty"`
+	Const                any                `json:"const,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	AdditionalProperties *bool              `json:"additionalProperties,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	MinItems             *int               `json:"minItems,omitempty"`
+	MaxItems             *int               `json:"maxItems,omitempty"`
+	MinLength            *int               `json:"minLength,omitempty"`
+	MaxLength            *int               `json:"maxLength,omitempty"`
+	Minimum              *float64           `json:"minimum,omitempty"`
+	Maximum              *float64           `json:"maximum,omitempty"`
+
+	hasConst bool
+}
+
+// schemaTypes are the type names a schema may use
+var schemaTypes = map[string]bool{
+	"null": true, "boolean": true, "object": true, "array": true,
+	"number": true, "integer": true, "string": true,
+}
+
+// CompileSchema parses a JSON Schema document
+func CompileSchema(data []byte) (*Schema, error) {
+	var s Schema
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("invalid schema: %w", err)
+	}
+	return &s, nil
+}
+
+// UnmarshalJSON parses a schema, accepting "type" as a string or a list
+func (s *Schema) UnmarshalJSON(data []byte) error {
+	type plain Schema
+	var raw struct {
+		plain
+		Type  json.RawMessage `json:"type"`
+		Const json.RawMessage `json:"const"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	*s = Schema(raw.plain)
+
+	if len(raw.Type) > 0 {
+		var one string
+		if err := json.Unmarshal(raw.Type, &one); err == nil {
+			s.Types = []string{one}
+		} else if err := json.Unmarshal(raw.Type, &s.Types); err != nil {
+			return fmt.Errorf("type must be a string or list of strings")
+		}
+		for _, t := range s.Types {
+			if !schemaTypes[t] {
+				return fmt.Errorf("unknown type %q", t)
+			}
+		}
+	}
+	if len(raw.Const) > 0 {
+		s.hasConst = true
+		if err := json.Unmarshal(raw.Const, &s.Const); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ValidateJSON checks that data is a JSON document matching the schema
+func (s *Schema) ValidateJSON(data []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return fmt.Errorf("payload is not JSON: %w", err)
+	}
+	if dec.More() {
+		return fmt.Errorf("payload has trailing data")
+	}
+	return s.validate("$", v)
+}
+
+// validate checks v against the schema; path names v in errors
+func (s *Schema) validate(path string, v any) error {
+	if len(s.Types) > 0 && !s.matchesType(v) {
+		return fmt.Errorf("%s: expected %s", path, joinTypes(s.Types))
+	}
+	if len(s.Enum) > 0 && !containsJSON(s.Enum, v) {
+		return fmt.Errorf("%s: value not in enum", path)
+	}
+	if s.hasConst && !equalJSON(s.Const, v) {
+		return fmt.Errorf("%s: value does not match const", path)
+	}
+
+	switch v := v.(type) {
+	case map[string]any:
+		for _, name := range s.Required {
+			if _, ok := v[name]; !ok {
+				return fmt.Errorf("%s: missing required property %q", path, name)
+			}
+		}
+		// Check properties in a stable order so errors are deterministic
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			prop, ok := s.Properties[name]
+			if !ok {
+				if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+					return fmt.Errorf("%s: unexpected property %q", path, name)
+				}
+				continue
+			}
+			if err := prop.validate(path+"."+name, v[name]); err != nil {
+				return err
+			}
+		}
+
+	case []any:
+		if s.MinItems != nil && len(v) < *s.MinItems {
+			return fmt.Errorf("%s: fewer than %d items", path, *s.MinItems)
+		}
+		if s.MaxItems != nil && len(v) > *s.MaxItems {
+			return fmt.Errorf("%s: more than %d items", path, *s.MaxItems)
+		}
+		if s.Items != nil {
+			for i, item := range v {
+				if err := s.Items.validate(fmt.Sprintf("%s[%d]", path, i), item); err != nil {
+					return err
+				}
+			}
+		}
+
+	case string:
+		n := utf8.RuneCountInString(v)
+		if s.MinLength != nil && n < *s.MinLength {
+			return fmt.Errorf("%s: shorter than %d characters", path, *s.MinLength)
+		}
+		if s.MaxLength != nil && n > *s.MaxLength {
+			return fmt.Errorf("%s: longer than %d characters", path, *s.MaxLength)
+		}
+
+	case json.Number:
+		f, _ := v.Float64()
+		if s.Minimum != nil && f < *s.Minimum {
+			return fmt.Errorf("%s: less than %v", path, *s.Minimum)
+		}
+		if s.Maximum != nil && f > *s.Maximum {
+			return fmt.Errorf("%s: greater than %v", path, *s.Maximum)
+		}
+	}
+	return nil
+}
+
+// matchesType reports whether v is one of the schema's types
+func (s *Schema) matchesType(v any) bool {
+	for _, t := range s.Types {
+		switch v := v.(type) {
+		case nil:
+			if t == "null" {
+				return true
+			}
+		case bool:
+			if t == "boolean" {
+				return true
+			}
+		case map[string]any:
+			if t == "object" {
+				return true
+			}
+		case []any:
+			if t == "array" {
+				return true
+			}
+		case string:
+			if t == "string" {
+				return true
+			}
+		case json.Number:
+			if t == "number" {
+				return true
+			}
+			if t == "integer" {
+				if f, err := v.Float64(); err == nil && f == math.Trunc(f) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// joinTypes formats a type list for errors
+func joinTypes(types []string) string {
+	if len(types) == 1 {
+		return types[0]
+	}
+	return fmt.Sprintf("one of %v", types)
+}
+
+// containsJSON reports whether v equals any value in list
+func containsJSON(list []any, v any) bool {
+	for _, item := range list {
+		if equalJSON(item, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// equalJSON compares a schema value with a decoded payload value. Payload
+// numbers are json.Number while schema numbers are float64.
+func equalJSON(a, b any) bool {
+	if n, ok := b.(json.Number); ok {
+		f, err := n.Float64()
+		return err == nil && a == f
+	}
+	return reflect.DeepEqual(normalizeJSON(a), normalizeJSON(b))
+}
+
+// normalizeJSON converts json.Number values to float64 so decoded payloads
+// compare equal to schema literals
+func normalizeJSON(v any) any {
+	switch v := v.(type) {
+	case json.Number:
+		f, _ := v.Float64()
+		return f
+	case map[string]any:
+		out := make(map[string]any, len(v))
+		for k, item := range v {
+			out[k] = normalizeJSON(item)
+		}
+		return out
+	case []any:
+		out := make([]any, len(v))
+		for i, item := range v {
+			out[i] = normalizeJSON(item)
+		}
+		return out
+	default:
+		return v
+	}
+}
@@ -0,0 +1,83 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// SDP hook directions
+const (
+	SDPDirectionLocal  = "local"
+	SDPDirectionRemote = "remote"
+)
+
+// SDPHook inspects or rewrites session descriptions before they are applied.
+// Local descriptions are hooked before SetLocalDescription (and therefore
+// before they are sent to the peer); remote descriptions before
+// SetRemoteDescription. ctx is the negotiation's: hooks should give up when
+// it is done. Returning an error aborts the negotiation.
+type SDPHook interface {
+	MungeSDP(ctx context.Context, peerID, direction string, desc *webrtc.SessionDescription) error
+}
+
+// SDPHookFunc adapts a function to SDPHook
+type SDPHookFunc func(ctx context.Context, peerID, direction string, desc *webrtc.SessionDescription) error
+
+// MungeSDP calls f
+func (f SDPHookFunc) MungeSDP(ctx context.Context, peerID, direction string, desc *webrtc.SessionDescription) error {
+	return f(ctx, peerID, direction, desc)
+}
+
+// sdpCommandTimeout bounds how long an external SDP hook may run
+const sdpCommandTimeout = 5 * time.Second
+
+// CommandSDPHook runs an external command for each description. The SDP is
+// written to its stdin and, if it prints anything, stdout replaces the SDP.
+// The command receives LANSCAPE_SDP_DIRECTION, LANSCAPE_SDP_TYPE, and
+// LANSCAPE_PEER_ID in its environment. It is killed if it outlives the
+// negotiation or sdpCommandTimeout.
+func CommandSDPHook(path string, args ...string) SDPHook {
+	return SDPHookFunc(func(ctx context.Context, peerID, direction string, desc *webrtc.SessionDescription) error {
+		ctx, cancel := context.WithTimeout(ctx, sdpCommandTimeout)
+		defer cancel()
+
+		cmd := exec.CommandContext(ctx, path, args...)
+		cmd.Env = append(os.Environ(),
+			"LANSCAPE_SDP_DIRECTION="+direction,
+			"LANSCAPE_SDP_TYPE="+desc.Type.String(),
+			"LANSCAPE_PEER_ID="+peerID,
+		)
+		cmd.Stdin = bytes.NewBufferString(desc.SDP)
+		var stdout, stderr bytes.Buffer
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("sdp hook %s failed: %w: %s", path, err, bytes.TrimSpace(stderr.Bytes()))
+		}
+		if stdout.Len() > 0 {
+			desc.SDP = stdout.String()
+		}
+		return nil
+	})
+}
+
+// mungeSDP applies the manager's SDP hooks in order
+func (m *WebRTCManager) mungeSDP(ctx context.Context, peerID, direction string, desc *webrtc.SessionDescription) error {
+	m.mu.RLock()
+	hooks := m.sdpHooks
+	m.mu.RUnlock()
+
+	for _, hook := range hooks {
+		if err := hook.MungeSDP(ctx, peerID, direction, desc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package agent
+
+import (
+	"context"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// shellHook returns a CommandSDPHook running script with sh
+func shellHook(t *testing.T, script string) SDPHook {
+	t.Helper()
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("sh not available")
+	}
+	return CommandSDPHook(sh, "-c", script)
+}
+
+func TestCommandSDPHookRewrites(t *testing.T) {
+	hook := shellHook(t, `cat >/dev/null; printf '%s %s %s' "$LANSCAPE_SDP_DIRECTION" "$LANSCAPE_SDP_TYPE" "$LANSCAPE_PEER_ID"`)
+
+	desc := webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: "v=0\r\n"}
+	if err := hook.MungeSDP(context.Background(), "peer-1", SDPDirectionLocal, &desc); err != nil {
+		t.Fatalf("MungeSDP: %v", err)
+	}
+	if want := "local offer peer-1"; desc.SDP != want {
+		t.Fatalf("SDP = %q, want %q", desc.SDP, want)
+	}
+}
+
+func TestCommandSDPHookFails(t *testing.T) {
+	hook := shellHook(t, `echo refused >&2; exit 1`)
+
+	desc := webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: "v=0\r\n"}
+	if err := hook.MungeSDP(context.Background(), "peer-1", SDPDirectionRemote, &desc); err == nil {
+		t.Fatal("MungeSDP succeeded despite the hook failing")
+	}
+	if desc.SDP != "v=0\r\n" {
+		t.Fatalf("failed hook changed the SDP to %q", desc.SDP)
+	}
+}
+
+func TestCommandSDPHookCancelled(t *testing.T) {
+	hook := shellHook(t, `exec sleep 30`)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	desc := webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: "v=0\r\n"}
+	start := time.Now()
+	if err := hook.MungeSDP(ctx, "peer-1", SDPDirectionLocal, &desc); err == nil {
+		t.Fatal("MungeSDP succeeded after the negotiation was abandoned")
+	}
+	if elapsed := time.Since(start); elapsed >= sdpCommandTimeout {
+		t.Fatalf("hook ran %v after its context was done", elapsed)
+	}
+}
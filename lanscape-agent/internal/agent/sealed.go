@@ -0,0 +1,170 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/jhead/lanscape/lanscape-agent/pkg/protocol"
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	sealedChannelLabel = "lanscape-sealed"
+	sealedOpenTimeout  = 10 * time.Second
+)
+
+// SealedBroadcasts sends application data encrypted with the network's
+// topic key, so only agents of the network's members can read it, on a data
+// channel to each peer that stays open for later messages. A message is
+// sealed once and the same ciphertext goes to every peer.
+type SealedBroadcasts struct {
+	webrtc    *WebRTCManager
+	keys      *TopicKeys
+	onReceive func(peerID string, data []byte)
+	logger    *slog.Logger
+
+	mu       sync.Mutex
+	channels map[string]*sealedChannel // opened by this agent, by peer ID
+}
+
+// sealedChannel is a channel to a peer and whether it has opened
+type sealedChannel struct {
+	dc     *webrtc.DataChannel
+	opened chan struct{}
+}
+
+// NewSealedBroadcasts creates the sealed broadcast subsystem; onReceive is
+// called with the decrypted data of each sealed message from a peer
+func NewSealedBroadcasts(m *WebRTCManager, keys *TopicKeys, onReceive func(peerID string, data []byte), logger *slog.Logger) *SealedBroadcasts {
+	s := &SealedBroadcasts{
+		webrtc:    m,
+		keys:      keys,
+		onReceive: onReceive,
+		logger:    logger,
+		channels:  make(map[string]*sealedChannel),
+	}
+	m.HandleDataChannelLabel(sealedChannelLabel, s.handleChannel)
+	return s
+}
+
+// Send seals data and sends it to each peer, returning the failures
+func (s *SealedBroadcasts) Send(ctx context.Context, peers []string, data []byte) error {
+	sealed, err := s.keys.Seal(data)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, sealedOpenTimeout)
+	defer cancel()
+
+	var errs []error
+	for _, peerID := range peers {
+		if err := s.send(ctx, peerID, sealed); err != nil {
+			errs = append(errs, fmt.Errorf("sealed message to %s: %w", peerID, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// send sends a sealed message to one peer, opening its channel if needed
+func (s *SealedBroadcasts) send(ctx context.Context, peerID string, sealed []byte) error {
+	ch, err := s.channel(peerID)
+	if err != nil {
+		return err
+	}
+	select {
+	case <-ch.opened:
+	case <-ctx.Done():
+		return fmt.Errorf("channel did not open: %w", ctx.Err())
+	}
+	return ch.dc.Send(sealed)
+}
+
+// channel returns the open or opening channel to a peer, creating it if
+// there is none or it closed
+func (s *SealedBroadcasts) channel(peerID string) (*sealedChannel, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if ch, ok := s.channels[peerID]; ok && ch.dc.ReadyState() != webrtc.DataChannelStateClosed {
+		return ch, nil
+	}
+
+	ordered := true
+	dc, err := s.webrtc.CreateDataChannel(peerID, sealedChannelLabel, &webrtc.DataChannelInit{Ordered: &ordered})
+	if err != nil {
+		return nil, err
+	}
+	ch := &sealedChannel{dc: dc, opened: make(chan struct{})}
+	dc.OnOpen(func() { close(ch.opened) })
+	dc.OnClose(func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.channels[peerID] == ch {
+			delete(s.channels, peerID)
+		}
+	})
+	s.channels[peerID] = ch
+	return ch, nil
+}
+
+// handleChannel receives sealed messages from a peer
+func (s *SealedBroadcasts) handleChannel(peerID string, dc *webrtc.DataChannel) {
+	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		data, err := s.keys.Open(s.webrtc.ctx, msg.Data)
+		if err != nil {
+			s.logger.Warn("dropping sealed message", "peer", peerID, "size", len(msg.Data), "error", err)
+			return
+		}
+		if s.onReceive != nil {
+			s.onReceive(peerID, data)
+		}
+	})
+}
+
+// registerHandlers adds the sealed browser message to a bridge. Sealed data
+// goes to the given peer, the members of a group, or every verified peer.
+func (s *SealedBroadcasts) registerHandlers(b *Bridge) {
+	b.RegisterHandler(protocol.MessageTypeSealed, func(ctx context.Context, msg protocol.BrowserMessage) error {
+		if len(msg.Data) == 0 {
+			return errors.New("sealed requires data")
+		}
+
+		var peers []string
+		switch {
+		case msg.PeerID != "":
+			if b.isPending(msg.PeerID) {
+				return fmt.Errorf("peer not verified: %s", msg.PeerID)
+			}
+			peers = []string{msg.PeerID}
+		case msg.Group != "":
+			b.mu.RLock()
+			_, ok := b.groups[msg.Group]
+			b.mu.RUnlock()
+			if !ok {
+				return fmt.Errorf("unknown group: %s", msg.Group)
+			}
+			for _, peerID := range b.GetConnectedPeers() {
+				if b.inGroup(msg.Group, peerID) && !b.isPending(peerID) {
+					peers = append(peers, peerID)
+				}
+			}
+		default:
+			for _, peerID := range b.GetConnectedPeers() {
+				if !b.isPending(peerID) {
+					peers = append(peers, peerID)
+				}
+			}
+		}
+
+		b.logger.Info("sending sealed data", "peer", msg.PeerID, "group", msg.Group, "peers", len(peers), "size", len(msg.Data))
+		if r, session := b.recording(); r != nil {
+			r.RecordPeer(session, RecordPeerOut, msg.PeerID, msg.Data)
+		}
+		return s.Send(ctx, peers, msg.Data)
+	})
+}
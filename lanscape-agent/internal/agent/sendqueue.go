@@ -0,0 +1,115 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// sendQueueSize bounds the number of messages waiting to be sent to one peer.
+// When a queue is full the sequencer blocks, applying backpressure to every
+// peer rather than letting their orders diverge.
+const sendQueueSize = 1024
+
+// errQueueClosed is returned when enqueueing to a closed peer's queue
+var errQueueClosed = errors.New("peer closed")
+
+// sendQueue delivers outbound messages to one peer's application data channel
+// in the order they were enqueued
+type sendQueue struct {
+	peerID string
+	msgs   chan []byte
+	done   chan struct{}
+	ctx    context.Context // the manager's lifetime
+	limit  func() int64    // bytes per second, 0 is unlimited
+	onSent func(n int)     // called after each message is sent, may be nil
+	logger *slog.Logger
+}
+
+// newSendQueue starts the delivery goroutine for a peer, which stops when the
+// queue is closed or ctx is done. limit is consulted before each send so
+// bandwidth caps can change at runtime.
+func newSendQueue(ctx context.Context, peer *PeerConnection, supervisor *Supervisor, limit func() int64, onSent func(n int), logger *slog.Logger) *sendQueue {
+	q := &sendQueue{
+		peerID: peer.ID,
+		msgs:   make(chan []byte, sendQueueSize),
+		done:   make(chan struct{}),
+		ctx:    ctx,
+		limit:  limit,
+		onSent: onSent,
+		logger: logger,
+	}
+	supervisor.Go("send-queue", func() { q.run(peer) })
+	return q
+}
+
+// enqueue queues data for delivery, waiting while the queue is full until
+// ctx is done or the queue is closed
+func (q *sendQueue) enqueue(ctx context.Context, data []byte) error {
+	select {
+	case q.msgs <- data:
+		return nil
+	case <-q.done:
+		return errQueueClosed
+	case <-q.ctx.Done():
+		return errQueueClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// close stops delivery; queued messages are dropped
+func (q *sendQueue) close() {
+	close(q.done)
+}
+
+func (q *sendQueue) run(peer *PeerConnection) {
+	for {
+		select {
+		case data := <-q.msgs:
+			peer.mu.Lock()
+			dc, ok := peer.DataChannel.(DataChannel)
+			peer.mu.Unlock()
+
+			if !ok || dc == nil || dc.ReadyState() != webrtc.DataChannelStateOpen {
+				q.logger.Warn("dropping queued message, data channel not open", "peer", q.peerID, "size", len(data))
+				continue
+			}
+			if err := dc.Send(data); err != nil {
+				q.logger.Warn("failed to send queued message", "peer", q.peerID, "error", err)
+				continue
+			}
+			peer.touch()
+			if q.onSent != nil {
+				q.onSent(len(data))
+			}
+			q.pace(len(data))
+		case <-q.done:
+			return
+		case <-q.ctx.Done():
+			return
+		}
+	}
+}
+
+// pace waits long enough after sending n bytes to stay under the bandwidth cap
+func (q *sendQueue) pace(n int) {
+	if q.limit == nil {
+		return
+	}
+	limit := q.limit()
+	if limit <= 0 {
+		return
+	}
+
+	t := time.NewTimer(time.Duration(n) * time.Second / time.Duration(limit))
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-q.done:
+	case <-q.ctx.Done():
+	}
+}
@@ -0,0 +1,244 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jhead/lanscape/lanscape-agent/pkg/protocol"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	mdnsAddr          = "224.0.0.251:5353"
+	mdnsServicesQuery = "_services._dns-sd._udp.local."
+	mdnsQueryInterval = 5 * time.Minute
+)
+
+// ServiceRegistry holds the local services this agent advertises to peers:
+// services from configuration plus, optionally, services this host announces
+// over mDNS.
+type ServiceRegistry struct {
+	mu         sync.RWMutex
+	static     []protocol.Service
+	discovered map[string]protocol.Service // mDNS instance name -> service
+	logger     *slog.Logger
+}
+
+// NewServiceRegistry creates a registry with the configured services
+func NewServiceRegistry(static []protocol.Service, logger *slog.Logger) *ServiceRegistry {
+	for i := range static {
+		if static[i].Protocol == "" {
+			static[i].Protocol = "tcp"
+		}
+		static[i].Source = "config"
+	}
+	return &ServiceRegistry{
+		static:     static,
+		discovered: make(map[string]protocol.Service),
+		logger:     logger,
+	}
+}
+
+// ParseService parses a service flag of the form name=port[/udp]
+func ParseService(s string) (protocol.Service, error) {
+	name, port, ok := strings.Cut(s, "=")
+	if !ok || name == "" {
+		return protocol.Service{}, fmt.Errorf("invalid service %q, expected name=port[/udp]", s)
+	}
+
+	proto := "tcp"
+	if p, q, ok := strings.Cut(port, "/"); ok {
+		port, proto = p, q
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil || n <= 0 || n > 65535 {
+		return protocol.Service{}, fmt.Errorf("invalid service port %q", port)
+	}
+	if proto != "tcp" && proto != "udp" {
+		return protocol.Service{}, fmt.Errorf("invalid service protocol %q", proto)
+	}
+
+	return protocol.Service{Name: name, Protocol: proto, Port: n}, nil
+}
+
+// List returns all advertised services, sorted by name
+func (r *ServiceRegistry) List() []protocol.Service {
+	if r == nil {
+		return nil
+	}
+
+	r.mu.RLock()
+	services := append([]protocol.Service(nil), r.static...)
+	for _, s := range r.discovered {
+		services = append(services, s)
+	}
+	r.mu.RUnlock()
+
+	sort.Slice(services, func(i, j int) bool { return services[i].Name < services[j].Name })
+	return services
+}
+
+// Offers reports whether a local address is the endpoint of an advertised service
+func (r *ServiceRegistry) Offers(proto, addr string) bool {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || (host != "127.0.0.1" && host != "localhost") {
+		return false
+	}
+	for _, s := range r.List() {
+		if s.Protocol == proto && strconv.Itoa(s.Port) == port {
+			return true
+		}
+	}
+	return false
+}
+
+// SnoopMDNS watches mDNS traffic for services announced by this host until
+// ctx is cancelled. It periodically queries for service types so services
+// that announced before the agent started are found too.
+func (r *ServiceRegistry) SnoopMDNS(ctx context.Context) error {
+	group, err := net.ResolveUDPAddr("udp4", mdnsAddr)
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenMulticastUDP("udp4", nil, group)
+	if err != nil {
+		return fmt.Errorf("failed to join mDNS group: %w", err)
+	}
+
+	hostname, _ := os.Hostname()
+	localTarget := strings.ToLower(strings.TrimSuffix(hostname, ".local")) + ".local."
+
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	go func() {
+		ticker := time.NewTicker(mdnsQueryInterval)
+		defer ticker.Stop()
+		for {
+			r.queryMDNS(conn, group, mdnsServicesQuery)
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	r.logger.Info("snooping mDNS for local services", "host", localTarget)
+
+	buf := make([]byte, 9000)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		r.handleMDNS(conn, group, buf[:n], localTarget)
+	}
+}
+
+// handleMDNS records SRV records that point at this host and follows service type enumerations
+func (r *ServiceRegistry) handleMDNS(conn *net.UDPConn, group *net.UDPAddr, packet []byte, localTarget string) {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(packet); err != nil || !msg.Header.Response {
+		return
+	}
+
+	records := append(append(msg.Answers, msg.Authorities...), msg.Additionals...)
+	for _, rr := range records {
+		switch body := rr.Body.(type) {
+		case *dnsmessage.PTRResource:
+			// A service type from the enumeration query; ask for its instances
+			if strings.EqualFold(rr.Header.Name.String(), mdnsServicesQuery) {
+				r.queryMDNS(conn, group, body.PTR.String())
+			}
+
+		case *dnsmessage.SRVResource:
+			if !strings.EqualFold(body.Target.String(), localTarget) {
+				continue
+			}
+			instance := rr.Header.Name.String()
+			name, serviceType := splitMDNSInstance(instance)
+			proto := "tcp"
+			if strings.HasSuffix(serviceType, "._udp") {
+				proto = "udp"
+			}
+
+			service := protocol.Service{
+				Name:     name,
+				Protocol: proto,
+				Port:     int(body.Port),
+				Type:     serviceType,
+				Source:   "mdns",
+			}
+
+			r.mu.Lock()
+			_, known := r.discovered[instance]
+			if rr.Header.TTL == 0 {
+				delete(r.discovered, instance)
+			} else {
+				r.discovered[instance] = service
+			}
+			r.mu.Unlock()
+
+			if !known && rr.Header.TTL != 0 {
+				r.logger.Info("discovered local mDNS service", "name", name, "type", serviceType, "port", body.Port)
+			}
+		}
+	}
+}
+
+// queryMDNS sends a PTR query to the mDNS group
+func (r *ServiceRegistry) queryMDNS(conn *net.UDPConn, group *net.UDPAddr, name string) {
+	qname, err := dnsmessage.NewName(name)
+	if err != nil {
+		return
+	}
+	msg := dnsmessage.Message{
+		Questions: []dnsmessage.Question{{Name: qname, Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET}},
+	}
+	packet, err := msg.Pack()
+	if err != nil {
+		return
+	}
+	if _, err := conn.WriteToUDP(packet, group); err != nil {
+		r.logger.Debug("failed to send mDNS query", "name", name, "error", err)
+	}
+}
+
+// splitMDNSInstance splits "My Printer._ipp._tcp.local." into "My Printer" and "_ipp._tcp"
+func splitMDNSInstance(instance string) (string, string) {
+	trimmed := strings.TrimSuffix(instance, ".local.")
+	i := strings.LastIndex(trimmed, "._")
+	if i < 0 {
+		return trimmed, ""
+	}
+	j := strings.LastIndex(trimmed[:i], "._")
+	if j < 0 {
+		return trimmed, ""
+	}
+	return strings.ReplaceAll(trimmed[:j], `\ `, " "), trimmed[j+1:]
+}
+
+// registerServiceHandlers adds the service discovery browser messages to a bridge
+func registerServiceHandlers(b *Bridge, signaling *SignalingClient) {
+	b.RegisterHandler(protocol.MessageTypeListServices, func(ctx context.Context, msg protocol.BrowserMessage) error {
+		b.sendToBrowser(protocol.AgentMessage{
+			Type:     protocol.MessageTypeServices,
+			Services: signaling.PeerServices(),
+		})
+		return nil
+	})
+}
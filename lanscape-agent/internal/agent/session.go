@@ -2,7 +2,12 @@ package agent
 
 import (
 	"context"
+	"fmt"
 	"log/slog"
+
+	"github.com/jhead/lanscape/lanscape-agent/pkg/protocol"
+	"github.com/oklog/ulid/v2"
+	"github.com/pion/webrtc/v4"
 )
 
 // BrowserSession represents a single browser connection with its own WebRTC and signaling
@@ -10,23 +15,135 @@ type BrowserSession struct {
 	webrtc    *WebRTCManager
 	signaling *SignalingClient
 	bridge    *Bridge
+	media     *MediaRelay
+	forwarder *Forwarder
 	logger    *slog.Logger
+
+	// sim replaces signaling and WebRTC when set; simID is this session's
+	// peer ID on it
+	sim   *SimNetwork
+	simID string
+
+	// stopOverrides unregisters the session from config reloads
+	stopOverrides func()
+
+	// onSignalingClosed is told when the signaling server ends the connection
+	onSignalingClosed func(reason CloseReason, detail string)
+}
+
+// SessionConfig holds the settings shared by every browser session
+type SessionConfig struct {
+	SignalingURL        string
+	Topic               string
+	Name                string
+	TailscaleInfo       *TailscaleInfo
+	Identity            *Identity
+	Certificate         *webrtc.Certificate
+	TrustStore          *TrustStore
+	RequireVerification bool
+	Recorder            *Recorder
+	Supervisor          *Supervisor
+	SDPHooks            []SDPHook
+
+	// ForwardAllow lists the targets peers may forward to on this machine
+	ForwardAllow []string
+	// Services are advertised to peers and may always be forwarded to
+	Services *ServiceRegistry
+	// Notifier raises desktop notifications when set
+	Notifier Notifier
+	// Overrides holds per-topic and per-peer settings from the config file
+	Overrides *OverrideStore
+	// SignalingMux, when set, carries this session's signaling over a
+	// connection shared with other sessions
+	SignalingMux *SignalingMux
+	// StableID requests a peer ID derived from the identity key
+	StableID bool
+	// MaxTopicPeers caps the peers connected in the topic; 0 is unlimited
+	MaxTopicPeers int
+	// Attestation is advertised to peers; Attestations, when set, rejects
+	// peers without a valid lanscaped membership attestation
+	Attestation  string
+	Attestations *AttestationVerifier
+	// Revocations, when set, rejects peers whose identity key was revoked
+	Revocations *RevocationList
+	// TopicKeys, when set, lets the browser send data sealed with the
+	// network's topic key and opens sealed data from peers
+	TopicKeys *TopicKeys
+	// Usage counts application data per peer for usage reports
+	Usage *UsageMeter
+	// Outbox queues messages for offline peers and remembers the stored
+	// messages already received. Nil keeps received IDs in memory only.
+	Outbox *Outbox
+	// Simulation, when set, connects sessions to each other in memory
+	// instead of through signaling and WebRTC
+	Simulation *SimNetwork
+	// Faults, when set, injects failures into this session's peers
+	Faults *FaultInjector
 }
 
 // NewBrowserSession creates a new browser session with its own WebRTC and signaling
-func NewBrowserSession(signalingURL, topic string, tailscaleInfo *TailscaleInfo, logger *slog.Logger) (*BrowserSession, error) {
+func NewBrowserSession(config SessionConfig, logger *slog.Logger) (*BrowserSession, error) {
 	// Create WebRTC manager for this session
-	webrtc, err := NewWebRTCManager(tailscaleInfo, logger)
+	webrtc, err := NewWebRTCManager(config.TailscaleInfo, logger)
 	if err != nil {
 		return nil, err
 	}
 
+	webrtc.supervise(config.Supervisor)
+	if config.Faults != nil {
+		config.Supervisor.Go("faults", func() { config.Faults.run(webrtc) })
+	}
+	if config.Certificate != nil {
+		webrtc.useCertificate(config.Certificate)
+	}
+	for _, hook := range config.SDPHooks {
+		webrtc.AddSDPHook(hook)
+	}
+
 	// Create signaling client for this session (needed for bridge)
-	signaling := NewSignalingClient(signalingURL, topic, webrtc, logger)
+	signaling := NewSignalingClient(config.SignalingURL, config.Topic, config.Identity, config.Name, webrtc, logger)
+	signaling.supervisor = config.Supervisor
+	if config.SignalingMux != nil {
+		signaling.UseMux(config.SignalingMux)
+	}
+	if config.StableID {
+		signaling.UseStableID()
+	}
+	if config.Attestation != "" || config.Attestations != nil {
+		signaling.UseAttestation(config.Attestation, config.Attestations)
+	}
+	if config.Revocations != nil {
+		signaling.UseRevocations(config.Revocations)
+	}
 
 	// Create bridge
-	bridge := NewBridge(webrtc, logger)
-	
+	bridge := NewBridge(webrtc, config.TrustStore, config.RequireVerification, logger)
+	if config.Recorder != nil {
+		bridge.SetRecorder(config.Recorder)
+	}
+	if config.Notifier != nil {
+		bridge.SetNotifier(config.Notifier)
+	}
+
+	// Report verified peer identities to the bridge for trust evaluation
+	signaling.SetOnPeerIdentity(func(peerID string, identity PeerIdentity) {
+		bridge.handlePeerIdentity(peerID, identity)
+	})
+
+	// Tell the browser why signaling ended so it can decide whether to reconnect
+	session := &BrowserSession{}
+	signaling.SetOnClose(func(reason CloseReason, detail string) {
+		bridge.sendToBrowser(protocol.AgentMessage{
+			Type:      protocol.MessageTypeSignalingClosed,
+			Reason:    string(reason),
+			Retryable: reason.Retryable(),
+			Error:     detail,
+		})
+		if session.onSignalingClosed != nil {
+			session.onSignalingClosed(reason, detail)
+		}
+	})
+
 	// Set up signaling callback to send welcome to browser when received
 	signaling.SetOnWelcome(func(selfID string) {
 		bridge.sendWelcome(selfID)
@@ -39,40 +156,260 @@ func NewBrowserSession(signalingURL, topic string, tailscaleInfo *TailscaleInfo,
 		}
 	})
 
-	session := &BrowserSession{
-		webrtc:    webrtc,
-		signaling: signaling,
-		bridge:    bridge,
-		logger:    logger,
+	// Renegotiate when media tracks are added to or removed from a peer
+	webrtc.SetOnRenegotiate(signaling.renegotiate)
+
+	// Relay browser media to peers and announce peer media to the browser
+	media := NewMediaRelay(webrtc, bridge.sendToBrowser, logger)
+
+	// Tunnel local ports to peers and serve peers' forwarded connections
+	forwarder := NewForwarder(webrtc, config.ForwardAllow, config.Services, logger)
+	forwarder.resolveService = signaling.PeerService
+	forwarder.registerHandlers(bridge)
+
+	// Advertise local services and list peers' services to the browser
+	signaling.SetAdvertisedServices(config.Services.List)
+	registerServiceHandlers(bridge, signaling)
+
+	// Deliver drops from verified peers to the browser
+	drops := NewDrops(webrtc, func(peerID string, drop protocol.Drop) {
+		if bridge.isPending(peerID) {
+			logger.Warn("ignoring drop from unverified peer", "peer", peerID)
+			return
+		}
+		if webrtc.IsBlocked(peerID) {
+			logger.Debug("ignoring drop from blocked peer", "peer", peerID)
+			return
+		}
+		if drop.Kind == DropKindFile {
+			bridge.notify("Incoming file", fmt.Sprintf("%s sent %s (%d bytes)", bridge.peerName(peerID), drop.Name, drop.Size))
+		} else {
+			bridge.notify("Incoming "+drop.Kind, bridge.peerName(peerID)+" sent a "+drop.Kind)
+		}
+		bridge.sendToBrowser(protocol.AgentMessage{
+			Type:   protocol.MessageTypeDropped,
+			PeerID: peerID,
+			Drop:   &drop,
+		})
+	}, logger)
+	drops.registerHandlers(bridge)
+
+	// Tell peers when their messages fail the topic schema, and tell the
+	// browser when peers reject ours
+	bridge.rejections = NewRejections(webrtc, func(peerID, reason string) {
+		bridge.sendToBrowser(protocol.AgentMessage{
+			Type:   protocol.MessageTypeError,
+			PeerID: peerID,
+			Error:  "message rejected by peer: " + reason,
+		})
+	}, logger)
+
+	// Seal group messages with the network's topic key when lanscaped
+	// distributes one
+	if config.TopicKeys != nil {
+		sealed := NewSealedBroadcasts(webrtc, config.TopicKeys, func(peerID string, data []byte) {
+			bridge.handlePeerData(peerID, data, true, false)
+		}, logger)
+		sealed.registerHandlers(bridge)
+	}
+
+	// Exchange small payloads through the signaling server with verified
+	// peers WebRTC could not connect to
+	appRelay := NewAppRelay(signaling, config.TopicKeys, logger)
+	appRelay.ready = func(peerID string) bool {
+		identity, ok := signaling.PeerIdentity(peerID)
+		if !ok || !identity.Verified || webrtc.IsBlocked(peerID) {
+			return false
+		}
+		return !config.RequireVerification || (config.TrustStore != nil && config.TrustStore.Check(identity.Name, identity.PublicKey) == TrustStatusTrusted)
+	}
+	appRelay.onReceive = func(peerID string, data []byte, sealed bool) {
+		bridge.handlePeerData(peerID, data, sealed, true)
+	}
+	appRelay.onFallback = func(peerID string) {
+		bridge.sendToBrowser(protocol.AgentMessage{
+			Type:   protocol.MessageTypePeerRelayed,
+			PeerID: peerID,
+		})
+	}
+	appRelay.onError = func(peerID, code string) {
+		bridge.sendToBrowser(protocol.AgentMessage{
+			Type:   protocol.MessageTypeError,
+			PeerID: peerID,
+			Error:  "app-relay refused by signaling server: " + code,
+		})
+	}
+	bridge.appRelay = appRelay
+
+	// Deliver stored messages to verified peers when they connect, and
+	// queue messages for offline peers when enabled
+	outbox := config.Outbox
+	if outbox == nil {
+		outbox, _ = LoadOutbox("", OutboxConfig{}, logger)
+	}
+	storeForward := NewStoreForward(outbox, webrtc, logger)
+	storeForward.fingerprint = func(peerID string) string {
+		identity, ok := signaling.PeerIdentity(peerID)
+		if !ok || !identity.Verified {
+			return ""
+		}
+		publicKey, err := ParsePublicKey(identity.PublicKey)
+		if err != nil {
+			return ""
+		}
+		return Fingerprint(publicKey)
+	}
+	storeForward.ready = func(peerID string) bool {
+		return !bridge.isPending(peerID) && !webrtc.IsBlocked(peerID)
+	}
+	storeForward.accept = bridge.acceptPeerData
+	storeForward.onReceive = func(peerID, fingerprint string, msg StoredMessage) {
+		bridge.sendToBrowser(protocol.AgentMessage{
+			Type:        protocol.MessageTypeData,
+			PeerID:      peerID,
+			Fingerprint: fingerprint,
+			MessageID:   msg.ID,
+			Data:        msg.Data,
+		})
+	}
+	storeForward.onDelivered = func(peerID string, msg StoredMessage) {
+		bridge.sendToBrowser(protocol.AgentMessage{
+			Type:        protocol.MessageTypeDelivered,
+			PeerID:      peerID,
+			Fingerprint: msg.To,
+			MessageID:   msg.ID,
+		})
+	}
+	storeForward.onRejected = func(peerID string, msg StoredMessage, reason string) {
+		bridge.sendToBrowser(protocol.AgentMessage{
+			Type:        protocol.MessageTypeError,
+			PeerID:      peerID,
+			Fingerprint: msg.To,
+			MessageID:   msg.ID,
+			Error:       "stored message rejected by peer: " + reason,
+		})
+	}
+	bridge.storeForward = storeForward
+	if outbox.config.Enabled {
+		storeForward.registerHandlers(bridge, config.TrustStore)
+	}
+
+	// Rank peers by measured latency for applications that need only one
+	bridge.latency = NewLatencyMonitor(webrtc, logger)
+	bridge.latency.registerHandlers(bridge)
+
+	// Cap the mesh, preferring the fastest peers, and tell the browser which
+	// peers are left out
+	signaling.useMeshCap(func() int {
+		if max := config.Overrides.Topic(config.Topic).MaxPeers; max > 0 {
+			return max
+		}
+		return config.MaxTopicPeers
+	}, func(peers []string) []string {
+		ranked := bridge.latency.Ranked(peers)
+		ids := make([]string, len(ranked))
+		for i, peer := range ranked {
+			ids[i] = peer.PeerID
+		}
+		return ids
+	}, func(degraded []string, max int) {
+		bridge.sendToBrowser(protocol.AgentMessage{
+			Type:     protocol.MessageTypeMeshDegraded,
+			MaxPeers: max,
+			Degraded: degraded,
+		})
+	})
+
+	// Apply config overrides, closing newly blocked peers on reload
+	webrtc.useOverrides(config.Overrides, config.Topic, signaling.peerKeys)
+	registerOverrideHandlers(bridge, config.Overrides, signaling)
+	stopOverrides := config.Overrides.OnReload(webrtc.closeBlockedPeers)
+
+	if config.Usage != nil {
+		webrtc.useUsage(config.Usage, func(peerID string) string {
+			return stablePeerKey(signaling, peerID)
+		})
+	}
+
+	*session = BrowserSession{
+		webrtc:        webrtc,
+		signaling:     signaling,
+		bridge:        bridge,
+		media:         media,
+		forwarder:     forwarder,
+		logger:        logger,
+		stopOverrides: stopOverrides,
+		sim:           config.Simulation,
 	}
 
 	return session, nil
 }
 
-// Connect connects to the signaling server
+// Connect connects to the signaling server, or joins the simulated network,
+// and starts sending the browser heartbeats
 func (s *BrowserSession) Connect() error {
-	return s.signaling.Connect()
+	if s.sim != nil {
+		s.simID = ulid.Make().String()
+		s.bridge.sendWelcome(s.simID)
+		if err := s.sim.Join(s.simID, s.webrtc); err != nil {
+			return err
+		}
+	} else if err := s.signaling.Connect(); err != nil {
+		return err
+	}
+	s.startHeartbeat()
+	return nil
 }
 
 // Disconnect disconnects from signaling and closes all peer connections
 func (s *BrowserSession) Disconnect() {
+	s.stopOverrides()
+	if s.sim != nil {
+		s.sim.Leave(s.simID)
+	}
 	s.signaling.Disconnect()
+	s.media.Close()
+	s.forwarder.Close()
 	s.webrtc.CloseAll()
 }
 
+// SetOnSignalingClosed sets the callback for when the signaling server ends
+// the session's connection. reason is empty if the server gave no known reason.
+func (s *BrowserSession) SetOnSignalingClosed(fn func(reason CloseReason, detail string)) {
+	s.onSignalingClosed = fn
+}
+
 // GetBridge returns the bridge for this session
 func (s *BrowserSession) GetBridge() *Bridge {
 	return s.bridge
 }
 
+// GetMediaRelay returns the media relay for this session
+func (s *BrowserSession) GetMediaRelay() *MediaRelay {
+	return s.media
+}
+
 // GetSelfID returns the self peer ID from signaling
 func (s *BrowserSession) GetSelfID() string {
+	if s.sim != nil {
+		return s.simID
+	}
 	return s.signaling.GetSelfID()
 }
 
-// Stop stops the session
+// Stop stops the session, returning ctx's error if teardown does not finish
+// before ctx is done. Teardown continues in the background in that case.
 func (s *BrowserSession) Stop(ctx context.Context) error {
-	s.Disconnect()
-	return nil
-}
+	done := make(chan struct{})
+	go func() {
+		s.Disconnect()
+		close(done)
+	}()
 
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("session teardown did not complete: %w", ctx.Err())
+	}
+}
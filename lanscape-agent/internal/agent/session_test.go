@@ -0,0 +1,175 @@
+package agent
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// teardownTimeout bounds how long closing a loaded session may take
+const teardownTimeout = 5 * time.Second
+
+func testLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+// joinBlockedPeer joins a manager to sim whose message handler never
+// returns until the test ends, so traffic to it backs up
+func joinBlockedPeer(t *testing.T, sim *SimNetwork, peerID string) *WebRTCManager {
+	t.Helper()
+
+	m, err := NewWebRTCManager(nil, testLogger())
+	if err != nil {
+		t.Fatalf("NewWebRTCManager: %v", err)
+	}
+	release := make(chan struct{})
+	t.Cleanup(func() {
+		close(release)
+		m.CloseAll()
+	})
+	m.SetOnDataChannel(func(_ string, dc interface{}) {
+		dc.(DataChannel).OnMessage(func(webrtc.DataChannelMessage) { <-release })
+	})
+	if err := sim.Join(peerID, m); err != nil {
+		t.Fatalf("Join %s: %v", peerID, err)
+	}
+	return m
+}
+
+// broadcastUntilFull broadcasts from m until its send queue to peerID is
+// full and the broadcaster is blocked on it. The returned channel is closed
+// once the broadcaster gives up after stop is closed.
+func broadcastUntilFull(t *testing.T, m *WebRTCManager, peerID string, stop <-chan struct{}) <-chan struct{} {
+	t.Helper()
+
+	peer, err := m.GetPeerConnection(peerID)
+	if err != nil {
+		t.Fatalf("GetPeerConnection: %v", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			if _, err := m.BroadcastData(context.Background(), []byte("x")); err != nil {
+				return
+			}
+			select {
+			case <-stop:
+				return
+			default:
+			}
+		}
+	}()
+
+	deadline := time.Now().Add(teardownTimeout)
+	for len(peer.queue.msgs) < sendQueueSize {
+		if time.Now().After(deadline) {
+			t.Fatalf("send queue to %s never filled", peerID)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return done
+}
+
+// within fails the test if fn does not return before the teardown timeout
+func within(t *testing.T, what string, fn func()) {
+	t.Helper()
+
+	done := make(chan struct{})
+	go func() {
+		fn()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(teardownTimeout):
+		t.Fatalf("%s did not return within %v", what, teardownTimeout)
+	}
+}
+
+// wait fails the test if done is not closed before the teardown timeout
+func wait(t *testing.T, what string, done <-chan struct{}) {
+	t.Helper()
+	within(t, what, func() { <-done })
+}
+
+func TestClosePeerWhileBroadcastBlocked(t *testing.T) {
+	sim := NewSimNetwork(testLogger())
+	m, err := NewWebRTCManager(nil, testLogger())
+	if err != nil {
+		t.Fatalf("NewWebRTCManager: %v", err)
+	}
+	defer m.CloseAll()
+	if err := sim.Join("sender", m); err != nil {
+		t.Fatalf("Join: %v", err)
+	}
+	joinBlockedPeer(t, sim, "blocked")
+
+	stop := make(chan struct{})
+	done := broadcastUntilFull(t, m, "blocked", stop)
+	close(stop)
+
+	within(t, "ClosePeer", func() { m.ClosePeer("blocked") })
+	wait(t, "blocked broadcast", done)
+	if n := m.PeerCount(); n != 0 {
+		t.Fatalf("PeerCount = %d after ClosePeer, want 0", n)
+	}
+}
+
+func TestCloseAllWhileSendsBlocked(t *testing.T) {
+	sim := NewSimNetwork(testLogger())
+	m, err := NewWebRTCManager(nil, testLogger())
+	if err != nil {
+		t.Fatalf("NewWebRTCManager: %v", err)
+	}
+	if err := sim.Join("sender", m); err != nil {
+		t.Fatalf("Join: %v", err)
+	}
+	joinBlockedPeer(t, sim, "blocked-1")
+	joinBlockedPeer(t, sim, "blocked-2")
+
+	stop := make(chan struct{})
+	broadcast := broadcastUntilFull(t, m, "blocked-1", stop)
+	close(stop)
+
+	// A direct send waits behind the blocked broadcast for the send lock
+	send := make(chan error, 1)
+	go func() { send <- m.SendData(context.Background(), "blocked-2", []byte("x")) }()
+
+	within(t, "CloseAll", m.CloseAll)
+	wait(t, "blocked broadcast", broadcast)
+	within(t, "blocked send", func() { <-send })
+}
+
+func TestBrowserSessionStopUnderLoad(t *testing.T) {
+	sim := NewSimNetwork(testLogger())
+	session, err := NewBrowserSession(SessionConfig{
+		Topic:      "teardown",
+		Supervisor: NewSupervisor(SupervisorLimits{}, testLogger()),
+		Simulation: sim,
+	}, testLogger())
+	if err != nil {
+		t.Fatalf("NewBrowserSession: %v", err)
+	}
+	joinBlockedPeer(t, sim, "blocked-1")
+	joinBlockedPeer(t, sim, "blocked-2")
+	if err := session.Connect(); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+
+	stop := make(chan struct{})
+	broadcast := broadcastUntilFull(t, session.webrtc, "blocked-1", stop)
+	close(stop)
+
+	ctx, cancel := context.WithTimeout(context.Background(), teardownTimeout)
+	defer cancel()
+	if err := session.Stop(ctx); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+	wait(t, "blocked broadcast", broadcast)
+}
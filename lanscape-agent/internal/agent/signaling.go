@@ -2,44 +2,167 @@ package agent
 
 import (
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"log/slog"
+	"net/url"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/jhead/lanscape/lanscape-agent/pkg/protocol"
+	"github.com/jhead/lanscape/signaling/pkg/buildinfo"
 	"github.com/jhead/lanscape/signaling/pkg/signaling"
 	"github.com/pion/webrtc/v4"
 	"nhooyr.io/websocket"
-	"nhooyr.io/websocket/wsjson"
 )
 
+// signalingSubprotocols are the encodings offered to the signaling server,
+// preferring CBOR, which is smaller and cheaper to parse. Servers that
+// predate it select neither, and speak JSON.
+var signalingSubprotocols = []string{signaling.CBORSubprotocol, signaling.Subprotocol}
+
 // SignalingClient handles connection to the signaling server
 type SignalingClient struct {
 	url        string
 	topic      string
 	conn       *websocket.Conn
+	encoding   signaling.Encoding // negotiated with the server, JSON until connected
 	selfID     string
+	identity   *Identity
+	name       string
 	webrtc     *WebRTCManager
 	logger     *slog.Logger
 	ctx        context.Context
 	cancel     context.CancelFunc
 	onPeerList func(peers []signaling.PeerRecord)
 	onWelcome  func(selfID string)
+
+	onPeerIdentity func(peerID string, identity PeerIdentity)
+
+	// onClose is told why the server ended the connection; closing is set
+	// once Disconnect is called, so local disconnects are not reported
+	onClose func(reason CloseReason, detail string)
+	closing atomic.Bool
+	// connected is set by the server's welcome and cleared when the
+	// connection ends
+	connected atomic.Bool
+
+	mu    sync.RWMutex
+	peers map[string]PeerIdentity // peer ID -> advertised/proven identity
+	hints *signaling.ServerHints  // limits from the server's welcome, nil before it
+	// topicSeq is the sequence number of the last membership change applied;
+	// zero if the server does not number them
+	topicSeq uint64
+
+	supervisor *Supervisor
+
+	// renegotiations requested while an offer was outstanding, sent once it is answered
+	pendingOffers map[string]bool
+	// unackedOffers are offers resent until the server acks them, by peer;
+	// lastOfferIDs are the message IDs of the last offers handled, by peer
+	unackedOffers map[string]*pendingOffer
+	lastOfferIDs  map[string]string
+
+	// services returns the local services to advertise; peerServices holds
+	// what each peer advertised
+	services     func() []protocol.Service
+	peerServices map[string]protocol.PeerServices
+
+	// mux shares a multiplexed connection with other sessions when set;
+	// sub is this client's subscription on it
+	mux *SignalingMux
+	sub *muxSubscription
+
+	// stableID asks the server for a peer ID derived from the identity key
+	stableID bool
+
+	// attestation is this agent's lanscaped membership attestation, advertised
+	// in join metadata; attestations, when set, requires one from every peer
+	attestation  string
+	attestations *AttestationVerifier
+
+	// revocations, when set, rejects peers whose identity key lanscaped revoked
+	revocations *RevocationList
+
+	// mesh, when set, caps the peers connected in the topic
+	mesh *meshCap
+
+	// appRelay, when set, exchanges data through the server with peers
+	// WebRTC could not connect to
+	appRelay *AppRelay
+}
+
+// maxAdvertisedServices bounds the services included in join metadata
+const maxAdvertisedServices = 32
+
+// peerMetadata is the metadata the agent advertises when joining a topic
+type peerMetadata struct {
+	PublicKey string             `json:"publicKey,omitempty"`
+	Name      string             `json:"name,omitempty"`
+	Services  []protocol.Service `json:"services,omitempty"`
+	// Attestation is a lanscaped-signed membership attestation for PublicKey
+	Attestation string `json:"attestation,omitempty"`
+	// Version is the agent's build version, for diagnosing mismatched peers
+	Version string `json:"version,omitempty"`
+}
+
+// CloseReason says why the signaling server or agent ended a WebSocket
+type CloseReason = signaling.CloseReason
+
+// RevocationList holds the identity keys lanscaped has revoked
+type RevocationList = signaling.RevocationList
+
+// PeerIdentity is what a remote peer has claimed and proven about itself
+type PeerIdentity struct {
+	PublicKey string // base64url ed25519 key, empty if the peer is unsigned
+	Name      string // advertised name (hostname), unauthenticated
+	Verified  bool   // true once an SDP signature from PublicKey has been checked
+	Member    string // lanscaped username from a verified attestation, empty if none
+
+	attestation string // advertised attestation, checked with the SDP signature
+}
+
+// sdpPayload is the relay payload for offers and answers
+type sdpPayload struct {
+	SDP      string         `json:"sdp"`
+	Type     string         `json:"type"`
+	Identity *identityProof `json:"identity,omitempty"`
+}
+
+// identityProof binds an SDP to the sender's identity key
+type identityProof struct {
+	PublicKey string `json:"publicKey"`
+	Signature string `json:"signature"`
 }
 
 // NewSignalingClient creates a new signaling client
-func NewSignalingClient(url, topic string, webrtc *WebRTCManager, logger *slog.Logger) *SignalingClient {
+func NewSignalingClient(url, topic string, identity *Identity, name string, webrtc *WebRTCManager, logger *slog.Logger) *SignalingClient {
 	ctx, cancel := context.WithCancel(context.Background())
 	return &SignalingClient{
-		url:    url,
-		topic:  topic,
-		webrtc: webrtc,
-		logger: logger,
-		ctx:    ctx,
-		cancel: cancel,
+		url:           url,
+		topic:         topic,
+		identity:      identity,
+		name:          name,
+		webrtc:        webrtc,
+		logger:        logger,
+		ctx:           ctx,
+		cancel:        cancel,
+		peers:         make(map[string]PeerIdentity),
+		pendingOffers: make(map[string]bool),
+		unackedOffers: make(map[string]*pendingOffer),
+		lastOfferIDs:  make(map[string]string),
+		peerServices:  make(map[string]protocol.PeerServices),
 	}
 }
 
+// SetAdvertisedServices sets the source of local services included in the join metadata
+func (c *SignalingClient) SetAdvertisedServices(fn func() []protocol.Service) {
+	c.services = fn
+}
+
 // SetOnPeerList sets the callback for when peer list is received
 func (c *SignalingClient) SetOnPeerList(fn func(peers []signaling.PeerRecord)) {
 	c.onPeerList = fn
@@ -50,23 +173,114 @@ func (c *SignalingClient) SetOnWelcome(fn func(selfID string)) {
 	c.onWelcome = fn
 }
 
+// SetOnClose sets the callback for when the signaling server ends the
+// connection. reason is empty if the server did not give a known reason.
+func (c *SignalingClient) SetOnClose(fn func(reason CloseReason, detail string)) {
+	c.onClose = fn
+}
+
+// SetOnPeerIdentity sets the callback for when a peer's offer/answer identity has been checked
+func (c *SignalingClient) SetOnPeerIdentity(fn func(peerID string, identity PeerIdentity)) {
+	c.onPeerIdentity = fn
+}
+
+// UseStableID makes Connect request a peer ID derived from the identity key,
+// proven by signing the server's join challenge
+func (c *SignalingClient) UseStableID() {
+	c.stableID = true
+}
+
+// UseAttestation advertises token to peers and, if verifier is non-nil,
+// rejects peers whose attestation it cannot verify
+func (c *SignalingClient) UseAttestation(token string, verifier *AttestationVerifier) {
+	c.attestation = token
+	c.attestations = verifier
+}
+
+// UseRevocations rejects peers whose identity key is on list
+func (c *SignalingClient) UseRevocations(list *RevocationList) {
+	c.revocations = list
+}
+
+// UseMux makes Connect subscribe over a shared multiplexed connection
+// instead of dialing its own
+func (c *SignalingClient) UseMux(mux *SignalingMux) {
+	c.mux = mux
+}
+
+// metadata returns the join metadata advertised to other peers, or nil
+func (c *SignalingClient) metadata() (json.RawMessage, error) {
+	if c.identity == nil {
+		return nil, nil
+	}
+	meta := peerMetadata{
+		PublicKey:   c.identity.PublicKeyString(),
+		Name:        c.name,
+		Attestation: c.attestation,
+		Version:     buildinfo.Get().Version,
+	}
+	if c.services != nil {
+		meta.Services = c.services()
+		// Signaling caps metadata size, so advertise a bounded number of services
+		if len(meta.Services) > maxAdvertisedServices {
+			meta.Services = meta.Services[:maxAdvertisedServices]
+		}
+	}
+	metadata, err := json.Marshal(meta)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal peer metadata: %w", err)
+	}
+	return metadata, nil
+}
+
 // Connect connects to the signaling server
 func (c *SignalingClient) Connect() error {
+	metadata, err := c.metadata()
+	if err != nil {
+		return err
+	}
+
+	if c.mux != nil {
+		if c.stableID {
+			c.logger.Warn("stable peer IDs are not supported on multiplexed signaling, using a random ID")
+		}
+		sub, err := c.mux.Subscribe(c.topic, metadata, c.handleMessage, func(reason CloseReason, detail string) {
+			c.handleClosed(reason, detail)
+			c.Disconnect()
+		})
+		if err != nil {
+			return err
+		}
+		c.sub = sub
+		return nil
+	}
+
+	query := url.Values{}
+	if metadata != nil {
+		query.Set("metadata", string(metadata))
+	}
+	if c.stableID && c.identity != nil {
+		query.Set("publicKey", c.identity.PublicKeyString())
+	}
 	wsURL := fmt.Sprintf("%s/ws/%s", c.url, c.topic)
+	if len(query) > 0 {
+		wsURL += "?" + query.Encode()
+	}
 	c.logger.Info("connecting to signaling server", "url", wsURL)
 
 	ctx, cancel := context.WithTimeout(c.ctx, 10*time.Second)
 	defer cancel()
 
-	conn, _, err := websocket.Dial(ctx, wsURL, &websocket.DialOptions{})
+	conn, resp, err := websocket.Dial(ctx, wsURL, &websocket.DialOptions{Subprotocols: signalingSubprotocols})
 	if err != nil {
-		return fmt.Errorf("failed to connect to signaling server: %w", err)
+		return dialError(c.url, resp, err)
 	}
 
 	c.conn = conn
+	c.encoding = signaling.ParseSubprotocol(conn.Subprotocol())
 
 	// Start reader goroutine
-	go c.readLoop()
+	c.supervisor.Go("signaling-read", c.readLoop)
 
 	// Wait for welcome message to get self ID
 	// This will be handled in readLoop
@@ -76,6 +290,11 @@ func (c *SignalingClient) Connect() error {
 
 // Disconnect disconnects from the signaling server
 func (c *SignalingClient) Disconnect() {
+	c.closing.Store(true)
+	c.connected.Store(false)
+	if c.sub != nil {
+		c.sub.Close()
+	}
 	if c.conn != nil {
 		c.conn.Close(websocket.StatusNormalClosure, "")
 		c.conn = nil
@@ -89,8 +308,10 @@ func (c *SignalingClient) readLoop() {
 
 	for {
 		var msg signaling.OutboundMessage
-		if err := wsjson.Read(c.ctx, c.conn, &msg); err != nil {
+		if err := c.encoding.Read(c.ctx, c.conn, &msg); err != nil {
 			c.logger.Debug("signaling read error", "error", err)
+			reason, detail, _ := signaling.ParseClose(err)
+			c.handleClosed(reason, detail)
 			return
 		}
 
@@ -98,14 +319,39 @@ func (c *SignalingClient) readLoop() {
 	}
 }
 
+// handleClosed reports a connection the server ended, unless Disconnect was
+// called first
+func (c *SignalingClient) handleClosed(reason CloseReason, detail string) {
+	c.connected.Store(false)
+	if c.closing.Load() {
+		return
+	}
+	c.logger.Warn("signaling server closed the connection", "reason", reason, "detail", detail, "retryable", reason.Retryable())
+	if c.onClose != nil {
+		c.onClose(reason, detail)
+	}
+}
+
 // handleMessage handles a message from the signaling server
 func (c *SignalingClient) handleMessage(msg signaling.OutboundMessage) {
 	c.logger.Debug("received signaling message", "type", msg.Type)
 
 	switch msg.Type {
+	case "challenge":
+		c.answerChallenge(msg.Nonce)
+
 	case "welcome":
 		c.selfID = msg.SelfID
+		c.connected.Store(true)
 		c.logger.Info("received welcome", "selfId", c.selfID)
+		if msg.Hints != nil {
+			c.applyHints(msg.Hints)
+		}
+		if len(msg.ICEServers) > 0 {
+			// Credentials expire, so each welcome replaces the last ones
+			c.webrtc.SetICEServers(msg.ICEServers)
+			c.logger.Debug("received TURN servers", "count", len(msg.ICEServers))
+		}
 		if c.onWelcome != nil {
 			c.onWelcome(c.selfID)
 		}
@@ -113,26 +359,51 @@ func (c *SignalingClient) handleMessage(msg signaling.OutboundMessage) {
 		// The bridge will handle this via its browserSend callback
 
 	case "peer-list":
-		c.logger.Info("received peer list", "count", len(msg.Peers))
+		c.logger.Info("received peer list", "count", len(msg.Peers), "seq", msg.Seq)
+		c.mu.Lock()
+		c.topicSeq = msg.Seq
+		c.mu.Unlock()
 		if c.onPeerList != nil {
 			c.onPeerList(msg.Peers)
 		}
+		// A resync lists the topic as it is now; drop peers no longer in it
+		listed := make(map[string]bool, len(msg.Peers))
+		for _, peer := range msg.Peers {
+			listed[peer.ID] = true
+		}
+		c.mesh.prune(listed)
+		for _, peerID := range c.webrtc.PeerIDs() {
+			if !listed[peerID] {
+				c.logger.Info("peer no longer in topic", "peerId", peerID)
+				c.removePeer(peerID)
+			}
+		}
 		// Create peer connections for existing peers
 		for _, peer := range msg.Peers {
 			if peer.ID != c.selfID {
+				c.recordAdvertisedKey(peer.ID, peer.Metadata)
+				c.recordAdvertisedServices(peer.ID, peer.Metadata)
 				c.createPeerConnection(peer.ID, true)
 			}
 		}
 
 	case "peer-joined":
-		c.logger.Info("peer joined", "peerId", msg.PeerID)
+		if !c.advanceSeq(msg.Seq) {
+			return
+		}
+		c.logger.Info("peer joined", "peerId", msg.PeerID, "seq", msg.Seq)
 		if msg.PeerID != c.selfID {
+			c.recordAdvertisedKey(msg.PeerID, msg.Metadata)
+			c.recordAdvertisedServices(msg.PeerID, msg.Metadata)
 			c.createPeerConnection(msg.PeerID, true)
 		}
 
 	case "peer-left":
-		c.logger.Info("peer left", "peerId", msg.PeerID)
-		c.webrtc.ClosePeer(msg.PeerID)
+		if !c.advanceSeq(msg.Seq) {
+			return
+		}
+		c.logger.Info("peer left", "peerId", msg.PeerID, "seq", msg.Seq)
+		c.removePeer(msg.PeerID)
 
 	case "offer":
 		c.handleOffer(msg)
@@ -143,9 +414,61 @@ func (c *SignalingClient) handleMessage(msg signaling.OutboundMessage) {
 	case "ice-candidate":
 		c.handleICECandidate(msg)
 
+	case signaling.AppRelayType:
+		c.appRelay.receive(msg.From, msg.Payload)
+
+	case "ack":
+		c.handleAck(msg.MsgID)
+
 	case "error":
-		c.logger.Error("signaling error", "code", msg.Type, "message", "error message")
+		c.logger.Error("signaling error", "code", msg.Code, "message", msg.Message, "msgId", msg.MsgID)
+		c.handleRelayError(msg.Code, msg.MsgID)
+	}
+}
+
+// removePeer forgets a peer that left the topic and closes its connection
+func (c *SignalingClient) removePeer(peerID string) {
+	c.mu.Lock()
+	delete(c.peers, peerID)
+	delete(c.peerServices, peerID)
+	delete(c.lastOfferIDs, peerID)
+	if pending := c.unackedOffers[peerID]; pending != nil {
+		pending.timer.Stop()
+		delete(c.unackedOffers, peerID)
+	}
+	c.mu.Unlock()
+	c.webrtc.ClosePeer(peerID)
+	c.mesh.forget(peerID)
+	c.appRelay.forget(peerID)
+	c.fillMesh()
+}
+
+// advanceSeq records the sequence number of a peer-joined or peer-left and
+// reports whether to apply it. Events already covered by the peer list are
+// skipped; a gap means the server dropped an event, so a fresh peer list is
+// requested to reconcile.
+func (c *SignalingClient) advanceSeq(seq uint64) bool {
+	if seq == 0 {
+		return true
+	}
+	c.mu.Lock()
+	last := c.topicSeq
+	if seq > last {
+		c.topicSeq = seq
+	}
+	c.mu.Unlock()
+
+	if seq <= last {
+		c.logger.Debug("skipping stale membership event", "seq", seq, "last", last)
+		return false
+	}
+	if seq > last+1 {
+		c.logger.Warn("missed membership events, requesting peer list", "seq", seq, "last", last)
+		if err := c.send(signaling.InboundMessage{Type: "sync"}); err != nil {
+			c.logger.Error("failed to request peer list", "error", err)
+		}
 	}
+	return true
 }
 
 // createPeerConnection creates a WebRTC peer connection
@@ -158,12 +481,20 @@ func (c *SignalingClient) createPeerConnection(peerID string, isInitiator bool)
 		return
 	}
 
+	// Peers beyond the topic's peer cap are left out of the mesh
+	if !c.admitPeer(peerID) {
+		return
+	}
+
 	// Use perfect negotiation: only the "polite" peer (lower ID) creates offer
 	// The "impolite" peer (higher ID) waits for an offer
 	isPolite := c.selfID < peerID
-	shouldCreateOffer := isInitiator && isPolite
+	c.openPeer(peerID, isInitiator && isPolite)
+}
 
-	_, err = c.webrtc.CreatePeerConnection(peerID, shouldCreateOffer)
+// openPeer creates a peer connection and sends an offer if shouldCreateOffer
+func (c *SignalingClient) openPeer(peerID string, shouldCreateOffer bool) {
+	_, err := c.webrtc.CreatePeerConnection(peerID, shouldCreateOffer)
 	if err != nil {
 		c.logger.Error("failed to create peer connection", "peer", peerID, "error", err)
 		return
@@ -171,29 +502,59 @@ func (c *SignalingClient) createPeerConnection(peerID string, isInitiator bool)
 
 	if shouldCreateOffer {
 		// Create and send offer
-		offer, err := c.webrtc.CreateOffer(peerID)
+		offer, err := c.webrtc.CreateOffer(c.ctx, peerID)
 		if err != nil {
 			c.logger.Error("failed to create offer", "peer", peerID, "error", err)
 			return
 		}
 
-		payload, _ := json.Marshal(map[string]string{
-			"sdp":  offer.SDP,
-			"type": string(offer.Type),
-		})
+		payload, _ := json.Marshal(c.signSDP("offer", peerID, offer))
+
+		c.sendOffer(peerID, payload)
+	}
+}
+
+// renegotiate sends a new offer on an established peer connection, e.g.
+// after media tracks are added or removed
+func (c *SignalingClient) renegotiate(peerID string) {
+	peer, err := c.webrtc.GetPeerConnection(peerID)
+	if err != nil {
+		return
+	}
+	if peer.PC.SignalingState() != webrtc.SignalingStateStable {
+		c.logger.Debug("deferring renegotiation until current negotiation completes", "peer", peerID)
+		c.mu.Lock()
+		c.pendingOffers[peerID] = true
+		c.mu.Unlock()
+		return
+	}
 
-		c.sendRelay("offer", peerID, payload, "")
+	offer, err := c.webrtc.CreateOffer(c.ctx, peerID)
+	if err != nil {
+		c.logger.Error("failed to create renegotiation offer", "peer", peerID, "error", err)
+		return
 	}
+
+	payload, _ := json.Marshal(c.signSDP("offer", peerID, offer))
+	c.sendOffer(peerID, payload)
 }
 
 // handleOffer handles an SDP offer from a peer
 func (c *SignalingClient) handleOffer(msg signaling.OutboundMessage) {
 	peerID := msg.From
+	if c.duplicateOffer(peerID, msg.MsgID) {
+		c.logger.Debug("ignoring resent offer", "from", peerID, "msgId", msg.MsgID)
+		return
+	}
 	c.logger.Info("received offer", "from", peerID)
 
 	// Get or create peer connection
 	peer, err := c.webrtc.GetPeerConnection(peerID)
 	if err != nil {
+		if !c.admitPeer(peerID) {
+			c.logger.Info("refusing offer, topic peer cap reached", "from", peerID)
+			return
+		}
 		// Create peer connection as responder
 		peer, err = c.webrtc.CreatePeerConnection(peerID, false)
 		if err != nil {
@@ -227,33 +588,36 @@ func (c *SignalingClient) handleOffer(msg signaling.OutboundMessage) {
 	}
 
 	// Parse offer
-	var payload map[string]string
+	var payload sdpPayload
 	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
 		c.logger.Error("failed to parse offer", "error", err)
 		return
 	}
 
+	if err := c.verifySDP("offer", peerID, payload); err != nil {
+		c.logger.Warn("rejecting offer with invalid identity", "peer", peerID, "error", err)
+		c.webrtc.ClosePeer(peerID)
+		return
+	}
+
 	offer := webrtc.SessionDescription{
 		Type: webrtc.SDPTypeOffer,
-		SDP:  payload["sdp"],
+		SDP:  payload.SDP,
 	}
 
-	if err := c.webrtc.SetRemoteDescription(peerID, offer); err != nil {
+	if err := c.webrtc.SetRemoteDescription(c.ctx, peerID, offer); err != nil {
 		c.logger.Error("failed to set remote description", "peer", peerID, "error", err)
 		return
 	}
 
 	// Create and send answer
-	answer, err := c.webrtc.CreateAnswer(peerID)
+	answer, err := c.webrtc.CreateAnswer(c.ctx, peerID)
 	if err != nil {
 		c.logger.Error("failed to create answer", "peer", peerID, "error", err)
 		return
 	}
 
-	answerPayload, _ := json.Marshal(map[string]string{
-		"sdp":  answer.SDP,
-		"type": string(answer.Type),
-	})
+	answerPayload, _ := json.Marshal(c.signSDP("answer", peerID, answer))
 
 	c.sendRelay("answer", peerID, answerPayload, "")
 }
@@ -275,21 +639,35 @@ func (c *SignalingClient) handleAnswer(msg signaling.OutboundMessage) {
 		return
 	}
 
-	var payload map[string]string
+	var payload sdpPayload
 	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
 		c.logger.Error("failed to parse answer", "error", err)
 		return
 	}
 
+	if err := c.verifySDP("answer", peerID, payload); err != nil {
+		c.logger.Warn("rejecting answer with invalid identity", "peer", peerID, "error", err)
+		c.webrtc.ClosePeer(peerID)
+		return
+	}
+
 	answer := webrtc.SessionDescription{
 		Type: webrtc.SDPTypeAnswer,
-		SDP:  payload["sdp"],
+		SDP:  payload.SDP,
 	}
 
-	if err := c.webrtc.SetRemoteDescription(peerID, answer); err != nil {
+	if err := c.webrtc.SetRemoteDescription(c.ctx, peerID, answer); err != nil {
 		c.logger.Error("failed to set remote description", "peer", peerID, "error", err)
 		return
 	}
+
+	c.mu.Lock()
+	pending := c.pendingOffers[peerID]
+	delete(c.pendingOffers, peerID)
+	c.mu.Unlock()
+	if pending {
+		c.renegotiate(peerID)
+	}
 }
 
 // handleICECandidate handles an ICE candidate from a peer
@@ -337,22 +715,47 @@ func (c *SignalingClient) handleICECandidate(msg signaling.OutboundMessage) {
 
 // sendRelay sends a relay message to the signaling server
 func (c *SignalingClient) sendRelay(msgType, to string, payload json.RawMessage, msgID string) {
-	if c.conn == nil {
-		return
-	}
-
 	msg := signaling.InboundMessage{
 		Type:    msgType,
 		To:      to,
 		Payload: payload,
 		MsgID:   msgID,
 	}
+	if err := c.send(msg); err != nil {
+		c.logger.Error("failed to send relay message", "error", err)
+	}
+}
+
+// send writes a message to the signaling server
+func (c *SignalingClient) send(msg signaling.InboundMessage) error {
+	if err := c.checkMessageSize(msg); err != nil {
+		return err
+	}
+	if c.sub != nil {
+		return c.sub.send(msg)
+	}
+	if c.conn == nil {
+		return nil
+	}
 
 	ctx, cancel := context.WithTimeout(c.ctx, 5*time.Second)
 	defer cancel()
+	return c.encoding.Write(ctx, c.conn, msg)
+}
 
-	if err := wsjson.Write(ctx, c.conn, msg); err != nil {
-		c.logger.Error("failed to send relay message", "error", err)
+// answerChallenge proves possession of the identity key so the server
+// assigns the peer ID derived from it
+func (c *SignalingClient) answerChallenge(nonce string) {
+	if c.identity == nil {
+		return
+	}
+	sig := c.identity.Sign(signaling.ChallengeSigningInput(c.topic, nonce))
+	err := c.send(signaling.InboundMessage{
+		Type:      "challenge-response",
+		Signature: base64.RawURLEncoding.EncodeToString(sig),
+	})
+	if err != nil {
+		c.logger.Error("failed to answer join challenge", "error", err)
 	}
 }
 
@@ -380,8 +783,225 @@ func (c *SignalingClient) sendICECandidate(peerID string, candidate interface{})
 	c.sendRelay("ice-candidate", peerID, payloadBytes, "")
 }
 
+// applyHints records the server's limits and raises the read limit to match
+// the largest frame the server will relay. Multiplexed connections apply the
+// read limit themselves.
+func (c *SignalingClient) applyHints(hints *signaling.ServerHints) {
+	c.mu.Lock()
+	c.hints = hints
+	c.mu.Unlock()
+
+	if c.conn != nil && hints.MaxMessageSize > 0 {
+		c.conn.SetReadLimit(int64(hints.MaxMessageSize))
+	}
+	c.logger.Debug("received server hints", "maxMessageSize", hints.MaxMessageSize, "pingIntervalMs", hints.PingIntervalMs, "features", hints.Features, "serverVersion", hints.Version)
+}
+
+// Hints returns the limits and features the server sent with its welcome,
+// or nil before the welcome
+func (c *SignalingClient) Hints() *signaling.ServerHints {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.hints
+}
+
+// checkMessageSize rejects a message larger than the server accepts, which
+// would otherwise make the server close the connection
+func (c *SignalingClient) checkMessageSize(msg signaling.InboundMessage) error {
+	hints := c.Hints()
+	if hints == nil || hints.MaxMessageSize <= 0 {
+		return nil
+	}
+	encoding := c.encoding
+	if c.sub != nil {
+		encoding = c.sub.conn.encoding
+	}
+	data, err := encoding.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if len(data) > hints.MaxMessageSize {
+		return fmt.Errorf("%s message of %d bytes exceeds the signaling server's %d byte limit", msg.Type, len(data), hints.MaxMessageSize)
+	}
+	return nil
+}
+
+// Connected reports whether the server has welcomed the client on a
+// connection that has not ended
+func (c *SignalingClient) Connected() bool {
+	return c.connected.Load()
+}
+
 // GetSelfID returns the self peer ID
 func (c *SignalingClient) GetSelfID() string {
 	return c.selfID
 }
 
+// PeerIdentity returns the identity a peer has advertised or proven, if any
+func (c *SignalingClient) PeerIdentity(peerID string) (PeerIdentity, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	identity, ok := c.peers[peerID]
+	return identity, ok
+}
+
+// peerKeys returns the names a peer can be configured under besides its ID:
+// its advertised name and, if it has a key, the key fingerprint
+func (c *SignalingClient) peerKeys(peerID string) []string {
+	identity, ok := c.PeerIdentity(peerID)
+	if !ok {
+		return nil
+	}
+	keys := []string{identity.Name}
+	if publicKey, err := ParsePublicKey(identity.PublicKey); err == nil {
+		keys = append(keys, Fingerprint(publicKey))
+	}
+	return keys
+}
+
+// recordAdvertisedServices remembers the services a peer advertised in its signaling metadata
+func (c *SignalingClient) recordAdvertisedServices(peerID string, metadata json.RawMessage) {
+	if len(metadata) == 0 {
+		return
+	}
+	var meta peerMetadata
+	if err := json.Unmarshal(metadata, &meta); err != nil || len(meta.Services) == 0 {
+		return
+	}
+	c.mu.Lock()
+	c.peerServices[peerID] = protocol.PeerServices{PeerID: peerID, Name: meta.Name, Services: meta.Services}
+	c.mu.Unlock()
+}
+
+// PeerServices returns the services advertised by every known peer
+func (c *SignalingClient) PeerServices() []protocol.PeerServices {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	list := make([]protocol.PeerServices, 0, len(c.peerServices))
+	for _, ps := range c.peerServices {
+		list = append(list, ps)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].PeerID < list[j].PeerID })
+	return list
+}
+
+// PeerService looks up a service advertised by a peer by name
+func (c *SignalingClient) PeerService(peerID, name string) (protocol.Service, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	for _, s := range c.peerServices[peerID].Services {
+		if s.Name == name {
+			return s, true
+		}
+	}
+	return protocol.Service{}, false
+}
+
+// recordAdvertisedKey remembers the identity a peer advertised in its signaling metadata
+func (c *SignalingClient) recordAdvertisedKey(peerID string, metadata json.RawMessage) {
+	if len(metadata) == 0 {
+		return
+	}
+	var meta peerMetadata
+	if err := json.Unmarshal(metadata, &meta); err != nil || meta.PublicKey == "" {
+		return
+	}
+	c.mu.Lock()
+	c.peers[peerID] = PeerIdentity{PublicKey: meta.PublicKey, Name: meta.Name, attestation: meta.Attestation}
+	c.mu.Unlock()
+}
+
+// sdpSigningInput returns the bytes covered by an SDP identity signature.
+// Binding the sender and recipient IDs prevents a captured offer from being
+// replayed to a different peer.
+func sdpSigningInput(msgType, from, to, sdp string) []byte {
+	return []byte(msgType + "\n" + from + "\n" + to + "\n" + sdp)
+}
+
+// signSDP builds an offer/answer payload signed with the agent identity
+func (c *SignalingClient) signSDP(msgType, peerID string, desc *webrtc.SessionDescription) sdpPayload {
+	payload := sdpPayload{
+		SDP:  desc.SDP,
+		Type: desc.Type.String(),
+	}
+	if c.identity != nil {
+		sig := c.identity.Sign(sdpSigningInput(msgType, c.selfID, peerID, desc.SDP))
+		payload.Identity = &identityProof{
+			PublicKey: c.identity.PublicKeyString(),
+			Signature: base64.RawURLEncoding.EncodeToString(sig),
+		}
+	}
+	return payload
+}
+
+// verifySDP checks the identity proof on an offer/answer.
+// Unsigned payloads are accepted unless the peer advertised a key; a signed
+// payload must match any advertised key and carry a valid signature.
+func (c *SignalingClient) verifySDP(msgType, peerID string, payload sdpPayload) error {
+	c.mu.RLock()
+	advertised, hasAdvertised := c.peers[peerID]
+	c.mu.RUnlock()
+
+	if payload.Identity == nil {
+		if hasAdvertised {
+			return fmt.Errorf("peer advertised an identity but sent an unsigned %s", msgType)
+		}
+		if c.attestations != nil {
+			return fmt.Errorf("peer did not present an attestation")
+		}
+		c.notifyPeerIdentity(peerID, PeerIdentity{})
+		return nil
+	}
+
+	if hasAdvertised && advertised.PublicKey != payload.Identity.PublicKey {
+		return fmt.Errorf("signing key does not match advertised key")
+	}
+
+	if c.revocations.Revoked(payload.Identity.PublicKey) {
+		return fmt.Errorf("peer identity key has been revoked")
+	}
+
+	publicKey, err := ParsePublicKey(payload.Identity.PublicKey)
+	if err != nil {
+		return err
+	}
+	if err := VerifySignature(publicKey, sdpSigningInput(msgType, peerID, c.selfID, payload.SDP), payload.Identity.Signature); err != nil {
+		return err
+	}
+
+	identity := PeerIdentity{
+		PublicKey:   payload.Identity.PublicKey,
+		Name:        advertised.Name,
+		Verified:    true,
+		attestation: advertised.attestation,
+	}
+
+	// Check membership before the description is applied, so no data
+	// channel opens to a peer lanscaped has not vouched for
+	if c.attestations != nil {
+		attestation, err := c.attestations.Verify(advertised.attestation, payload.Identity.PublicKey)
+		if err != nil {
+			return err
+		}
+		identity.Member = attestation.Username
+	}
+	c.mu.Lock()
+	alreadyVerified := c.peers[peerID].Verified
+	c.peers[peerID] = identity
+	c.mu.Unlock()
+
+	// Renegotiation re-verifies the same key; only report the first proof
+	if !alreadyVerified {
+		c.notifyPeerIdentity(peerID, identity)
+	}
+	return nil
+}
+
+// notifyPeerIdentity reports a checked peer identity to the session
+func (c *SignalingClient) notifyPeerIdentity(peerID string, identity PeerIdentity) {
+	if c.onPeerIdentity != nil {
+		c.onPeerIdentity(peerID, identity)
+	}
+}
@@ -0,0 +1,214 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/jhead/lanscape/signaling/pkg/signaling"
+	"nhooyr.io/websocket"
+)
+
+// muxMaxSubscriptions is the per-connection subscription limit assumed until
+// the server's welcome hints give the real one
+const muxMaxSubscriptions = 16
+
+// SignalingMux shares multiplexed signaling connections between topic
+// subscriptions. A connection carries at most one subscription per topic, so
+// a second subscription to the same topic gets another connection.
+type SignalingMux struct {
+	mu     sync.Mutex
+	url    string
+	conns  []*muxConn
+	logger *slog.Logger
+}
+
+// muxConn is one multiplexed WebSocket and the subscriptions it carries
+type muxConn struct {
+	mux      *SignalingMux
+	conn     *websocket.Conn
+	encoding signaling.Encoding
+	writeMu  sync.Mutex
+	subs     map[string]*muxSubscription // topic -> subscription, guarded by mux.mu
+	// maxSubs is the server's subscription limit, guarded by mux.mu
+	maxSubs int
+	ctx     context.Context
+	// reason and detail say why the server closed the connection, set by the reader
+	reason CloseReason
+	detail string
+	cancel context.CancelFunc
+}
+
+// muxSubscription is one topic subscription on a multiplexed connection
+type muxSubscription struct {
+	conn    *muxConn
+	topic   string
+	handle  func(msg signaling.OutboundMessage)
+	onClose func(reason CloseReason, detail string)
+	once    sync.Once
+}
+
+// NewSignalingMux creates a mux for the signaling server at url
+func NewSignalingMux(url string, logger *slog.Logger) *SignalingMux {
+	return &SignalingMux{url: url, logger: logger}
+}
+
+// Subscribe joins topic with metadata. handle receives the topic's messages;
+// onClose is called with the server's close reason if the connection drops.
+func (m *SignalingMux) Subscribe(topic string, metadata json.RawMessage, handle func(msg signaling.OutboundMessage), onClose func(reason CloseReason, detail string)) (*muxSubscription, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var conn *muxConn
+	for _, c := range m.conns {
+		if _, taken := c.subs[topic]; !taken && len(c.subs) < c.maxSubs {
+			conn = c
+			break
+		}
+	}
+	if conn == nil {
+		var err error
+		if conn, err = m.dial(); err != nil {
+			return nil, err
+		}
+	}
+
+	sub := &muxSubscription{conn: conn, topic: topic, handle: handle, onClose: onClose}
+	conn.subs[topic] = sub
+	if err := sub.send(signaling.InboundMessage{Type: "subscribe", Topic: topic, Metadata: metadata}); err != nil {
+		delete(conn.subs, topic)
+		return nil, err
+	}
+
+	m.logger.Info("subscribed to signaling topic", "topic", topic, "connections", len(m.conns))
+	return sub, nil
+}
+
+// dial opens a new multiplexed connection. Caller must hold m.mu.
+func (m *SignalingMux) dial() (*muxConn, error) {
+	wsURL := m.url + "/ws"
+	m.logger.Info("connecting to multiplexed signaling server", "url", wsURL)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	conn, resp, err := websocket.Dial(ctx, wsURL, &websocket.DialOptions{Subprotocols: signalingSubprotocols})
+	if err != nil {
+		return nil, dialError(wsURL, resp, err)
+	}
+
+	c := &muxConn{mux: m, conn: conn, encoding: signaling.ParseSubprotocol(conn.Subprotocol()), subs: make(map[string]*muxSubscription), maxSubs: muxMaxSubscriptions}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	m.conns = append(m.conns, c)
+	go c.readLoop()
+	return c, nil
+}
+
+// readLoop dispatches incoming frames to subscriptions by topic
+func (c *muxConn) readLoop() {
+	defer c.close()
+
+	for {
+		var msg signaling.OutboundMessage
+		if err := c.encoding.Read(c.ctx, c.conn, &msg); err != nil {
+			c.mux.logger.Debug("multiplexed signaling read error", "error", err)
+			c.reason, c.detail, _ = signaling.ParseClose(err)
+			return
+		}
+
+		if msg.Type == "welcome" && msg.Hints != nil {
+			c.applyHints(msg.Hints)
+		}
+
+		c.mux.mu.Lock()
+		sub := c.subs[msg.Topic]
+		c.mux.mu.Unlock()
+		if sub == nil {
+			c.mux.logger.Debug("dropping signaling message for unknown topic", "topic", msg.Topic, "type", msg.Type)
+			continue
+		}
+		sub.handle(msg)
+	}
+}
+
+// applyHints adopts the limits from a welcome. Every subscription's welcome
+// carries the same hints, so applying them repeatedly is harmless.
+func (c *muxConn) applyHints(hints *signaling.ServerHints) {
+	if hints.MaxMessageSize > 0 {
+		c.conn.SetReadLimit(int64(hints.MaxMessageSize))
+	}
+	if hints.MaxTopics > 0 {
+		c.mux.mu.Lock()
+		c.maxSubs = hints.MaxTopics
+		c.mux.mu.Unlock()
+	}
+}
+
+// close tears down the connection and tells its subscriptions
+func (c *muxConn) close() {
+	c.mux.mu.Lock()
+	for i, other := range c.mux.conns {
+		if other == c {
+			c.mux.conns = append(c.mux.conns[:i], c.mux.conns[i+1:]...)
+			break
+		}
+	}
+	subs := c.subs
+	c.subs = make(map[string]*muxSubscription)
+	c.mux.mu.Unlock()
+
+	c.cancel()
+	c.conn.Close(websocket.StatusNormalClosure, "")
+	for _, sub := range subs {
+		// Mark the subscription closed first: onClose may call sub.Close
+		closed := false
+		sub.once.Do(func() { closed = true })
+		if closed && sub.onClose != nil {
+			sub.onClose(c.reason, c.detail)
+		}
+	}
+}
+
+// send writes a frame for this subscription's topic
+func (s *muxSubscription) send(msg signaling.InboundMessage) error {
+	msg.Topic = s.topic
+
+	ctx, cancel := context.WithTimeout(s.conn.ctx, 5*time.Second)
+	defer cancel()
+
+	s.conn.writeMu.Lock()
+	defer s.conn.writeMu.Unlock()
+	return s.conn.encoding.Write(ctx, s.conn.conn, msg)
+}
+
+// Close unsubscribes from the topic, closing the connection if it carries no
+// other subscriptions
+func (s *muxSubscription) Close() {
+	s.once.Do(func() {
+		m := s.conn.mux
+		m.mu.Lock()
+		if s.conn.subs[s.topic] == s {
+			delete(s.conn.subs, s.topic)
+		}
+		idle := len(s.conn.subs) == 0
+		if idle {
+			// Stop handing out the connection before it closes
+			for i, other := range m.conns {
+				if other == s.conn {
+					m.conns = append(m.conns[:i], m.conns[i+1:]...)
+					break
+				}
+			}
+		}
+		m.mu.Unlock()
+
+		if err := s.send(signaling.InboundMessage{Type: "unsubscribe"}); err != nil {
+			m.logger.Debug("failed to unsubscribe", "topic", s.topic, "error", err)
+		}
+		if idle {
+			s.conn.cancel()
+		}
+	})
+}
@@ -0,0 +1,262 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// simQueueSize bounds the messages in flight on one simulated channel before
+// Send blocks, like a congested SCTP stream
+const simQueueSize = 1024
+
+// SimNetwork connects WebRTC managers in memory, without signaling or ICE.
+// Every manager that joins gets an open application data channel to every
+// other member, and messages are delivered in order. It lets tests and the
+// -simulate dev mode run multi-peer scenarios deterministically. Media
+// tracks and additional labeled channels (drops, forwards) are not
+// simulated.
+type SimNetwork struct {
+	mu      sync.Mutex
+	members map[string]*WebRTCManager
+	logger  *slog.Logger
+}
+
+// NewSimNetwork creates an empty simulated network
+func NewSimNetwork(logger *slog.Logger) *SimNetwork {
+	return &SimNetwork{members: make(map[string]*WebRTCManager), logger: logger}
+}
+
+// Join adds a manager to the network under peerID and connects it to every
+// existing member, in peer ID order. Callbacks run without the network lock,
+// so they may join or leave other peers.
+func (n *SimNetwork) Join(peerID string, m *WebRTCManager) error {
+	n.mu.Lock()
+	if _, ok := n.members[peerID]; ok {
+		n.mu.Unlock()
+		return fmt.Errorf("peer already joined: %s", peerID)
+	}
+	ids := make([]string, 0, len(n.members))
+	for id := range n.members {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	others := make([]*WebRTCManager, len(ids))
+	for i, id := range ids {
+		others[i] = n.members[id]
+	}
+	n.members[peerID] = m
+	n.mu.Unlock()
+
+	for i, id := range ids {
+		local, remote := newSimChannelPair(appChannelLabel)
+		if err := m.addSimPeer(id, local); err != nil {
+			local.Close()
+			n.logger.Warn("failed to connect simulated peer", "peer", peerID, "to", id, "error", err)
+			continue
+		}
+		if err := others[i].addSimPeer(peerID, remote); err != nil {
+			m.ClosePeer(id)
+			n.logger.Warn("failed to connect simulated peer", "peer", id, "to", peerID, "error", err)
+			continue
+		}
+		local.open()
+		remote.open()
+	}
+
+	n.logger.Info("joined simulated network", "peer", peerID, "peers", len(ids))
+	return nil
+}
+
+// Leave removes a peer from the network, closing its channels to every member
+func (n *SimNetwork) Leave(peerID string) {
+	n.mu.Lock()
+	m, ok := n.members[peerID]
+	delete(n.members, peerID)
+	others := make([]*WebRTCManager, 0, len(n.members))
+	for _, other := range n.members {
+		others = append(others, other)
+	}
+	n.mu.Unlock()
+
+	if !ok {
+		return
+	}
+	for _, other := range others {
+		other.ClosePeer(peerID)
+	}
+	for _, id := range m.PeerIDs() {
+		m.ClosePeer(id)
+	}
+	n.logger.Info("left simulated network", "peer", peerID)
+}
+
+// addSimPeer tracks a simulated peer whose application channel is dc
+func (m *WebRTCManager) addSimPeer(peerID string, dc *simChannel) error {
+	if m.peerOverrides(peerID).Blocked {
+		return fmt.Errorf("peer is blocked: %s", peerID)
+	}
+
+	m.mu.Lock()
+	if _, ok := m.peers[peerID]; ok {
+		m.mu.Unlock()
+		return fmt.Errorf("peer already connected: %s", peerID)
+	}
+	if m.maxPeers > 0 && len(m.peers) >= m.maxPeers {
+		m.evictIdlePeerLocked()
+	}
+	peer := &PeerConnection{ID: peerID, DataChannel: dc, simulated: true}
+	peer.touch()
+	peer.queue = m.newSendQueue(peer)
+	m.peers[peerID] = peer
+	onDataChannel, onPeerConnected := m.onDataChannel, m.onPeerConnected
+	m.mu.Unlock()
+
+	// The bridge replaces the channel's close handler, so the manager is
+	// told separately when the remote end goes away
+	dc.mu.Lock()
+	dc.onTerminate = func() { m.ClosePeer(peerID) }
+	dc.mu.Unlock()
+
+	if onDataChannel != nil {
+		onDataChannel(peerID, dc)
+	}
+	if onPeerConnected != nil {
+		onPeerConnected(peerID)
+	}
+	return nil
+}
+
+// simChannel is one end of an in-memory data channel
+type simChannel struct {
+	label  string
+	remote *simChannel
+	inbox  chan webrtc.DataChannelMessage
+	done   chan struct{}
+
+	mu          sync.Mutex
+	state       webrtc.DataChannelState
+	onOpen      func()
+	onClose     func()
+	onMessage   func(msg webrtc.DataChannelMessage)
+	onTerminate func()
+	closeOnce   sync.Once
+}
+
+// newSimChannelPair creates two connected channel ends in the connecting state
+func newSimChannelPair(label string) (*simChannel, *simChannel) {
+	a := &simChannel{label: label, inbox: make(chan webrtc.DataChannelMessage, simQueueSize), done: make(chan struct{}), state: webrtc.DataChannelStateConnecting}
+	b := &simChannel{label: label, inbox: make(chan webrtc.DataChannelMessage, simQueueSize), done: make(chan struct{}), state: webrtc.DataChannelStateConnecting}
+	a.remote, b.remote = b, a
+	go a.deliver()
+	go b.deliver()
+	return a, b
+}
+
+// deliver hands received messages to the message handler in order
+func (c *simChannel) deliver() {
+	for {
+		select {
+		case msg := <-c.inbox:
+			c.mu.Lock()
+			fn := c.onMessage
+			c.mu.Unlock()
+			if fn != nil {
+				fn(msg)
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// open moves the channel to the open state and calls its open handler
+func (c *simChannel) open() {
+	c.mu.Lock()
+	if c.state != webrtc.DataChannelStateConnecting {
+		c.mu.Unlock()
+		return
+	}
+	c.state = webrtc.DataChannelStateOpen
+	fn := c.onOpen
+	c.mu.Unlock()
+	if fn != nil {
+		fn()
+	}
+}
+
+func (c *simChannel) Label() string { return c.label }
+
+func (c *simChannel) ReadyState() webrtc.DataChannelState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state
+}
+
+func (c *simChannel) Send(data []byte) error {
+	return c.send(webrtc.DataChannelMessage{Data: append([]byte(nil), data...)})
+}
+
+func (c *simChannel) SendText(s string) error {
+	return c.send(webrtc.DataChannelMessage{IsString: true, Data: []byte(s)})
+}
+
+// send queues a message on the remote end, blocking while its inbox is full
+func (c *simChannel) send(msg webrtc.DataChannelMessage) error {
+	if c.ReadyState() != webrtc.DataChannelStateOpen {
+		return errors.New("simulated data channel is not open")
+	}
+	select {
+	case c.remote.inbox <- msg:
+		return nil
+	case <-c.remote.done:
+		return errors.New("simulated data channel closed")
+	}
+}
+
+func (c *simChannel) OnOpen(fn func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onOpen = fn
+}
+
+func (c *simChannel) OnClose(fn func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onClose = fn
+}
+
+func (c *simChannel) OnMessage(fn func(msg webrtc.DataChannelMessage)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onMessage = fn
+}
+
+// Close closes both ends of the channel
+func (c *simChannel) Close() error {
+	c.close()
+	c.remote.close()
+	return nil
+}
+
+// close closes this end and runs its close handlers
+func (c *simChannel) close() {
+	c.closeOnce.Do(func() {
+		c.mu.Lock()
+		c.state = webrtc.DataChannelStateClosed
+		onClose, onTerminate := c.onClose, c.onTerminate
+		c.mu.Unlock()
+		close(c.done)
+
+		if onClose != nil {
+			go onClose()
+		}
+		if onTerminate != nil {
+			go onTerminate()
+		}
+	})
+}
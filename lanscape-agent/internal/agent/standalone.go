@@ -0,0 +1,41 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+)
+
+// dialPeer joins a topic without a browser session and waits until the
+// given peer's connection is established. Used by CLI tools such as bench
+// and forward; the caller must Disconnect the returned client.
+func dialPeer(ctx context.Context, m *WebRTCManager, signalingURL, topic string, identity *Identity, peerID string, logger *slog.Logger) (*SignalingClient, error) {
+	connected := make(chan struct{})
+	var once sync.Once
+	m.SetOnPeerConnected(func(id string) {
+		if id == peerID {
+			once.Do(func() { close(connected) })
+		}
+	})
+
+	client := NewSignalingClient(signalingURL, topic, identity, "", m, logger)
+	m.SetOnICECandidate(func(id string, candidate interface{}) {
+		if candidate != nil {
+			client.sendICECandidate(id, candidate)
+		}
+	})
+	m.SetOnRenegotiate(client.renegotiate)
+	if err := client.Connect(); err != nil {
+		return nil, err
+	}
+
+	logger.Info("waiting for peer", "peer", peerID)
+	select {
+	case <-connected:
+		return client, nil
+	case <-ctx.Done():
+		client.Disconnect()
+		return nil, fmt.Errorf("peer %s did not connect: %w", peerID, ctx.Err())
+	}
+}
@@ -0,0 +1,143 @@
+package agent
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const localTokenFileName = "local-token"
+
+// localTokenProtocolPrefix prefixes the local token when a browser sends it
+// as a WebSocket subprotocol, alongside one of protocol.Subprotocols
+const localTokenProtocolPrefix = "lanscape.token."
+
+// LocalProcess is the process on this host at the other end of a local
+// connection. PID is 0 and UID -1 when unknown.
+type LocalProcess struct {
+	PID  int
+	UID  int
+	Name string
+	Path string
+}
+
+// LocalTokenPath returns the path of the local token in dir
+func LocalTokenPath(dir string) string {
+	return filepath.Join(dir, localTokenFileName)
+}
+
+// LoadOrCreateLocalToken loads the token local clients must present in
+// strict local mode from dir, generating and persisting a new one if none
+// exists. The file is readable only by its owner, so only processes of the
+// agent's user can read it.
+func LoadOrCreateLocalToken(dir string) (string, error) {
+	path := LocalTokenPath(dir)
+
+	data, err := os.ReadFile(path)
+	if err == nil {
+		if token := strings.TrimSpace(string(data)); token != "" {
+			return token, nil
+		}
+		return "", fmt.Errorf("local token file %s is empty", path)
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return "", fmt.Errorf("failed to read local token: %w", err)
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate local token: %w", err)
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", fmt.Errorf("failed to create data directory: %w", err)
+	}
+	if err := os.WriteFile(path, []byte(token+"\n"), 0600); err != nil {
+		return "", fmt.Errorf("failed to write local token: %w", err)
+	}
+	return token, nil
+}
+
+// strictLocalAddr returns addr bound to 127.0.0.1 explicitly, so a host
+// name that also resolves to other addresses cannot widen the listener. An
+// empty host and localhost become 127.0.0.1; any other host is an error.
+func strictLocalAddr(addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", fmt.Errorf("invalid WebSocket address %q: %w", addr, err)
+	}
+	switch host {
+	case "", "localhost", "127.0.0.1":
+		return net.JoinHostPort("127.0.0.1", port), nil
+	}
+	return "", fmt.Errorf("strict local mode binds to 127.0.0.1, not %q", host)
+}
+
+// localToken returns the token a local client presented in an Authorization
+// bearer header, a lanscape.token.<token> subprotocol, or the token query
+// parameter, in that order
+func localToken(r *http.Request) string {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return token
+	}
+	for _, protocol := range offeredProtocols(r) {
+		if token, ok := strings.CutPrefix(protocol, localTokenProtocolPrefix); ok {
+			return token
+		}
+	}
+	return r.URL.Query().Get("token")
+}
+
+// offeredProtocols returns the subprotocols in Sec-WebSocket-Protocol
+func offeredProtocols(r *http.Request) []string {
+	var protocols []string
+	for _, header := range r.Header.Values("Sec-WebSocket-Protocol") {
+		for _, protocol := range strings.Split(header, ",") {
+			if protocol = strings.TrimSpace(protocol); protocol != "" {
+				protocols = append(protocols, protocol)
+			}
+		}
+	}
+	return protocols
+}
+
+// strictLocal wraps next to refuse clients that are not on the loopback
+// interface or do not present token, and to log every client with the
+// process it connected from, where the platform can tell
+func (s *WebSocketServer) strictLocal(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		remote, err := netip.ParseAddrPort(r.RemoteAddr)
+		if err != nil || !remote.Addr().Unmap().IsLoopback() {
+			s.logger.Warn("refused non-loopback client", "remote", r.RemoteAddr, "path", r.URL.Path)
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+
+		attrs := []any{"remote", r.RemoteAddr, "path", r.URL.Path, "origin", r.Header.Get("Origin")}
+		if local, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+			proc, err := lookupLocalProcess(remote, local)
+			if err != nil {
+				attrs = append(attrs, "processError", err)
+			} else {
+				attrs = append(attrs, "pid", proc.PID, "uid", proc.UID, "process", proc.Name, "exe", proc.Path)
+			}
+		}
+
+		if subtle.ConstantTimeCompare([]byte(localToken(r)), []byte(token)) != 1 {
+			s.logger.Warn("refused local client without the local token", attrs...)
+			http.Error(w, "missing or invalid local token", http.StatusUnauthorized)
+			return
+		}
+		s.logger.Info("local client connected", attrs...)
+		next.ServeHTTP(w, r)
+	})
+}
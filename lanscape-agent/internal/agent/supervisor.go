@@ -0,0 +1,179 @@
+package agent
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// SupervisorLimits caps long-lived resources. Zero means unlimited.
+type SupervisorLimits struct {
+	MaxSessions        int `json:"maxSessions"`
+	MaxPeersPerSession int `json:"maxPeersPerSession"`
+}
+
+// Supervisor tracks the lifecycle of browser sessions, peer connections, and
+// agent goroutines. It enforces limits by closing the least recently active
+// resource, so a long-lived agent cannot slowly accumulate leaked state.
+type Supervisor struct {
+	mu         sync.Mutex
+	limits     SupervisorLimits
+	sessions   map[*BrowserSession]*supervisedSession
+	goroutines map[string]int
+	crash      *CrashReporter
+	logger     *slog.Logger
+}
+
+// supervisedSession is the supervisor's record of a browser session
+type supervisedSession struct {
+	created    time.Time
+	lastActive time.Time
+	close      func()
+}
+
+// SupervisorStats is a snapshot of tracked resources
+type SupervisorStats struct {
+	Sessions          int              `json:"sessions"`
+	Peers             int              `json:"peers"`
+	Goroutines        map[string]int   `json:"goroutines"`
+	RuntimeGoroutines int              `json:"runtimeGoroutines"`
+	Limits            SupervisorLimits `json:"limits"`
+}
+
+// NewSupervisor creates a supervisor with the given limits
+func NewSupervisor(limits SupervisorLimits, logger *slog.Logger) *Supervisor {
+	return &Supervisor{
+		limits:     limits,
+		sessions:   make(map[*BrowserSession]*supervisedSession),
+		goroutines: make(map[string]int),
+		logger:     logger,
+	}
+}
+
+// SetCrashReporter recovers and records panics in supervised goroutines
+func (s *Supervisor) SetCrashReporter(crash *CrashReporter) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.crash = crash
+}
+
+// Go runs fn in a goroutine counted under name, recovering panics when a
+// crash reporter is set. A nil supervisor just runs it.
+func (s *Supervisor) Go(name string, fn func()) {
+	if s == nil {
+		go fn()
+		return
+	}
+
+	s.mu.Lock()
+	s.goroutines[name]++
+	crash := s.crash
+	s.mu.Unlock()
+
+	go func() {
+		defer func() {
+			s.mu.Lock()
+			s.goroutines[name]--
+			if s.goroutines[name] == 0 {
+				delete(s.goroutines, name)
+			}
+			s.mu.Unlock()
+		}()
+		defer crash.Recover(name)
+		fn()
+	}()
+}
+
+// AddSession registers a session and the function that closes it. If the
+// session limit is exceeded, the least recently active session is closed.
+func (s *Supervisor) AddSession(session *BrowserSession, close func()) {
+	if s == nil {
+		return
+	}
+
+	now := time.Now()
+	s.mu.Lock()
+	s.sessions[session] = &supervisedSession{created: now, lastActive: now, close: close}
+
+	var evict *supervisedSession
+	if s.limits.MaxSessions > 0 && len(s.sessions) > s.limits.MaxSessions {
+		var oldest *BrowserSession
+		for sess, entry := range s.sessions {
+			if sess == session {
+				continue
+			}
+			if oldest == nil || entry.lastActive.Before(s.sessions[oldest].lastActive) {
+				oldest = sess
+			}
+		}
+		if oldest != nil {
+			evict = s.sessions[oldest]
+			delete(s.sessions, oldest)
+		}
+	}
+	s.mu.Unlock()
+
+	if evict != nil {
+		s.logger.Warn("session limit reached, closing least recently active session",
+			"limit", s.limits.MaxSessions, "idle", time.Since(evict.lastActive).Round(time.Second))
+		evict.close()
+	}
+}
+
+// Touch marks a session as active
+func (s *Supervisor) Touch(session *BrowserSession) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if entry, ok := s.sessions[session]; ok {
+		entry.lastActive = time.Now()
+	}
+}
+
+// RemoveSession stops tracking a session
+func (s *Supervisor) RemoveSession(session *BrowserSession) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, session)
+}
+
+// Stats returns a snapshot of tracked resources
+func (s *Supervisor) Stats() SupervisorStats {
+	s.mu.Lock()
+	sessions := make([]*BrowserSession, 0, len(s.sessions))
+	for sess := range s.sessions {
+		sessions = append(sessions, sess)
+	}
+	goroutines := make(map[string]int, len(s.goroutines))
+	for name, n := range s.goroutines {
+		goroutines[name] = n
+	}
+	s.mu.Unlock()
+
+	stats := SupervisorStats{
+		Sessions:          len(sessions),
+		Goroutines:        goroutines,
+		RuntimeGoroutines: runtime.NumGoroutine(),
+		Limits:            s.limits,
+	}
+	for _, sess := range sessions {
+		stats.Peers += sess.webrtc.PeerCount()
+	}
+	return stats
+}
+
+// ServeHTTP serves the stats snapshot as JSON
+func (s *Supervisor) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.Stats())
+}
@@ -166,6 +166,29 @@ func GetTailscaleNetworks() ([]net.IPNet, error) {
 	return networks, nil
 }
 
+// Up reports whether the Tailscale interface still holds the Tailscale IP,
+// which it loses when Tailscale is stopped or logged out. It is false if
+// the agent runs without Tailscale.
+func (t *TailscaleInfo) Up() bool {
+	if t == nil {
+		return false
+	}
+	iface, err := net.InterfaceByName(t.Interface)
+	if err != nil || iface.Flags&net.FlagUp == 0 {
+		return false
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.String() == t.IP {
+			return true
+		}
+	}
+	return false
+}
+
 // GetTailscaleInfo gets all Tailscale information
 func GetTailscaleInfo() (*TailscaleInfo, error) {
 	ip, err := GetTailscaleIP()
@@ -0,0 +1,268 @@
+package agent
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	// topicKeyWrapLabel matches the label lanscaped derives wrapping keys
+	// with
+	topicKeyWrapLabel = "lanscape topic key v1"
+
+	// topicKeyRefreshInterval is how often topic keys are fetched, bounding
+	// how long a member removed from the network can read new messages
+	topicKeyRefreshInterval = 5 * time.Minute
+
+	// topicKeyCatchUpInterval rate-limits fetches prompted by messages
+	// sealed with a key this agent has not fetched yet
+	topicKeyCatchUpInterval = 30 * time.Second
+
+	// sealedVersion is the first byte of a sealed message, followed by the
+	// key generation (4 bytes, big endian), the nonce, and the ciphertext
+	sealedVersion    = 1
+	sealedHeaderSize = 5
+)
+
+var errNoTopicKey = errors.New("no topic key from lanscaped yet")
+
+// TopicKeys holds the symmetric keys lanscaped distributes to a network's
+// members for group encryption, unwrapped with the agent identity. The
+// current generation seals outgoing messages; earlier ones lanscaped still
+// returns open messages from members that have not fetched the rotated key.
+type TopicKeys struct {
+	enrollment *Enrollment
+	identity   *Identity
+	network    string
+	client     *http.Client
+	logger     *slog.Logger
+
+	// fetchMu serializes fetches
+	fetchMu   sync.Mutex
+	lastFetch time.Time
+	networkID int64
+
+	mu      sync.RWMutex
+	current int64
+	keys    map[int64]cipher.AEAD
+}
+
+// topicKeysResponse is lanscaped's list of topic keys wrapped to this agent
+type topicKeysResponse struct {
+	Generation int64 `json:"generation"`
+	Keys       []struct {
+		Generation int64  `json:"generation"`
+		WrappedKey string `json:"wrapped_key"`
+	} `json:"keys"`
+}
+
+// NewTopicKeys returns the topic keys of the named network, fetched from the
+// lanscaped server identity is enrolled with. Fetch them with Run.
+func NewTopicKeys(e *Enrollment, identity *Identity, network string, logger *slog.Logger) *TopicKeys {
+	return &TopicKeys{
+		enrollment: e,
+		identity:   identity,
+		network:    network,
+		client:     &http.Client{Timeout: 10 * time.Second},
+		logger:     logger,
+		keys:       make(map[int64]cipher.AEAD),
+	}
+}
+
+// Run fetches the keys now and then every interval until ctx is done
+func (k *TopicKeys) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := k.Refresh(ctx); err != nil && ctx.Err() == nil {
+			k.logger.Warn("failed to fetch topic keys, group encryption uses the last ones", "network", k.network, "error", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Refresh fetches the network's topic keys, replacing those held
+func (k *TopicKeys) Refresh(ctx context.Context) error {
+	k.fetchMu.Lock()
+	defer k.fetchMu.Unlock()
+	k.lastFetch = time.Now()
+
+	if k.enrollment.Token == "" {
+		return errors.New("device token has expired; run lanscape-agent login again")
+	}
+	if k.networkID == 0 {
+		id, err := lookupNetwork(ctx, k.client, k.enrollment, k.network)
+		if err != nil {
+			return err
+		}
+		k.networkID = id
+	}
+
+	var resp topicKeysResponse
+	keysURL := fmt.Sprintf("%s/v1/networks/%d/keys?public_key=%s", k.enrollment.Server, k.networkID, url.QueryEscape(k.identity.PublicKeyString()))
+	if err := requestJSON(ctx, k.client, http.MethodGet, keysURL, k.enrollment.Token, nil, &resp); err != nil {
+		return fmt.Errorf("failed to get topic keys: %w", err)
+	}
+
+	keys := make(map[int64]cipher.AEAD, len(resp.Keys))
+	for _, wrapped := range resp.Keys {
+		key, err := k.unwrap(wrapped.WrappedKey, wrapped.Generation)
+		if err != nil {
+			return fmt.Errorf("failed to unwrap topic key %d: %w", wrapped.Generation, err)
+		}
+		if keys[wrapped.Generation], err = newAEAD(key); err != nil {
+			return err
+		}
+	}
+	if keys[resp.Generation] == nil {
+		return fmt.Errorf("lanscaped did not return the current topic key %d", resp.Generation)
+	}
+
+	k.mu.Lock()
+	previous := k.current
+	k.current, k.keys = resp.Generation, keys
+	k.mu.Unlock()
+	if previous != resp.Generation {
+		k.logger.Info("fetched topic key", "network", k.network, "generation", resp.Generation)
+	}
+	return nil
+}
+
+// unwrap decrypts a topic key lanscaped wrapped to the identity key: an
+// ephemeral X25519 public key, then the AES-256-GCM sealed key
+func (k *TopicKeys) unwrap(wrapped string, generation int64) ([]byte, error) {
+	data, err := base64.RawURLEncoding.DecodeString(wrapped)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 32 {
+		return nil, errors.New("wrapped key is too short")
+	}
+
+	// The X25519 secret of an ed25519 key is the clamped first half of the
+	// hashed seed; X25519 does the clamping
+	h := sha512.Sum512(k.identity.privateKey.Seed())
+	private, err := ecdh.X25519().NewPrivateKey(h[:32])
+	if err != nil {
+		return nil, err
+	}
+	ephemeral, err := ecdh.X25519().NewPublicKey(data[:32])
+	if err != nil {
+		return nil, err
+	}
+	shared, err := private.ECDH(ephemeral)
+	if err != nil {
+		return nil, err
+	}
+
+	kek := make([]byte, 32)
+	salt := slices.Concat(data[:32], private.PublicKey().Bytes())
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, salt, []byte(topicKeyWrapLabel)), kek); err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(kek)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	aad := fmt.Appendf(nil, "%d:%d", k.networkID, generation)
+	return aead.Open(nil, nonce, data[32:], aad)
+}
+
+// Seal encrypts data with the current topic key
+func (k *TopicKeys) Seal(data []byte) ([]byte, error) {
+	k.mu.RLock()
+	generation, aead := k.current, k.keys[k.current]
+	k.mu.RUnlock()
+	if aead == nil {
+		return nil, errNoTopicKey
+	}
+
+	header := make([]byte, sealedHeaderSize, sealedHeaderSize+aead.NonceSize()+len(data)+aead.Overhead())
+	header[0] = sealedVersion
+	binary.BigEndian.PutUint32(header[1:], uint32(generation))
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(append(header, nonce...), nonce, data, header), nil
+}
+
+// Open decrypts a message sealed with any topic key held. A message sealed
+// with a newer key than the current one prompts a fetch, at most every
+// topicKeyCatchUpInterval.
+func (k *TopicKeys) Open(ctx context.Context, sealed []byte) ([]byte, error) {
+	if len(sealed) < sealedHeaderSize || sealed[0] != sealedVersion {
+		return nil, errors.New("not a sealed message")
+	}
+	header := sealed[:sealedHeaderSize]
+	generation := int64(binary.BigEndian.Uint32(header[1:]))
+
+	aead, current := k.key(generation)
+	if aead == nil && generation > current && k.catchUp(ctx) {
+		aead, _ = k.key(generation)
+	}
+	if aead == nil {
+		return nil, fmt.Errorf("sealed with unknown topic key %d", generation)
+	}
+
+	body := sealed[sealedHeaderSize:]
+	if len(body) < aead.NonceSize() {
+		return nil, errors.New("sealed message is too short")
+	}
+	return aead.Open(nil, body[:aead.NonceSize()], body[aead.NonceSize():], header)
+}
+
+// key returns the key of a generation, if held, and the current generation
+func (k *TopicKeys) key(generation int64) (cipher.AEAD, int64) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.keys[generation], k.current
+}
+
+// catchUp fetches the keys unless they were fetched recently, reporting
+// whether it did
+func (k *TopicKeys) catchUp(ctx context.Context) bool {
+	k.fetchMu.Lock()
+	recent := time.Since(k.lastFetch) < topicKeyCatchUpInterval
+	k.fetchMu.Unlock()
+	if recent {
+		return false
+	}
+	if err := k.Refresh(ctx); err != nil {
+		k.logger.Warn("failed to fetch rotated topic key", "network", k.network, "error", err)
+		return false
+	}
+	return true
+}
+
+// newAEAD returns AES-256-GCM with key
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
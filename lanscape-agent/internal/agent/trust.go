@@ -0,0 +1,205 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const trustStoreFileName = "known_peers.json"
+
+// TrustStatus describes how a peer's identity key relates to the trust store
+type TrustStatus string
+
+const (
+	// TrustStatusTrusted means the key is pinned for the peer's name
+	TrustStatusTrusted TrustStatus = "trusted"
+	// TrustStatusNew means no key has been pinned for the peer's name yet
+	TrustStatusNew TrustStatus = "new"
+	// TrustStatusChanged means a different key is pinned for the peer's name
+	TrustStatusChanged TrustStatus = "changed"
+	// TrustStatusUnsigned means the peer did not prove any identity
+	TrustStatusUnsigned TrustStatus = "unsigned"
+	// TrustStatusCertificateChanged means the peer's key is trusted but it
+	// presented a different DTLS certificate than the one pinned for it
+	TrustStatusCertificateChanged TrustStatus = "certificate-changed"
+)
+
+// KnownPeer is a pinned peer identity
+type KnownPeer struct {
+	Name      string `json:"name,omitempty"`
+	PublicKey string `json:"publicKey"`
+	// Certificate is the fingerprint of the DTLS certificate the peer presents
+	Certificate string    `json:"certificate,omitempty"`
+	FirstSeen   time.Time `json:"firstSeen"`
+	LastSeen    time.Time `json:"lastSeen"`
+}
+
+// TrustStore persists known peer identity keys (trust on first use).
+// Keys are pinned under the name the peer advertises, similar to SSH
+// known_hosts; peers without a name are pinned by key alone.
+type TrustStore struct {
+	mu    sync.Mutex
+	path  string
+	peers []KnownPeer
+}
+
+// LoadTrustStore loads the trust store from dir, starting empty if none exists
+func LoadTrustStore(dir string) (*TrustStore, error) {
+	ts := &TrustStore{path: filepath.Join(dir, trustStoreFileName)}
+
+	data, err := os.ReadFile(ts.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return ts, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read trust store: %w", err)
+	}
+
+	if err := json.Unmarshal(data, &ts.peers); err != nil {
+		return nil, fmt.Errorf("failed to parse trust store: %w", err)
+	}
+	return ts, nil
+}
+
+// Check returns the trust status of a key presented under a name
+func (ts *TrustStore) Check(name, publicKey string) TrustStatus {
+	if publicKey == "" {
+		return TrustStatusUnsigned
+	}
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if name == "" {
+		if ts.findByKey(publicKey) >= 0 {
+			return TrustStatusTrusted
+		}
+		return TrustStatusNew
+	}
+
+	i := ts.findByName(name)
+	if i < 0 {
+		return TrustStatusNew
+	}
+	if ts.peers[i].PublicKey != publicKey {
+		return TrustStatusChanged
+	}
+	return TrustStatusTrusted
+}
+
+// Pin records publicKey as the trusted key for name, replacing any previous key
+func (ts *TrustStore) Pin(name, publicKey string) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	now := time.Now().UTC()
+	i := ts.findByKey(publicKey)
+	if name != "" {
+		i = ts.findByName(name)
+	}
+
+	if i >= 0 {
+		if ts.peers[i].PublicKey != publicKey {
+			ts.peers[i].PublicKey = publicKey
+			ts.peers[i].Certificate = ""
+			ts.peers[i].FirstSeen = now
+		}
+		ts.peers[i].LastSeen = now
+	} else {
+		ts.peers = append(ts.peers, KnownPeer{
+			Name:      name,
+			PublicKey: publicKey,
+			FirstSeen: now,
+			LastSeen:  now,
+		})
+	}
+
+	return ts.save()
+}
+
+// CheckCertificate returns the trust status of a DTLS certificate presented
+// by the peer with publicKey. It is new until a certificate is pinned.
+func (ts *TrustStore) CheckCertificate(publicKey, fingerprint string) TrustStatus {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	i := ts.findByKey(publicKey)
+	if i < 0 || ts.peers[i].Certificate == "" {
+		return TrustStatusNew
+	}
+	if ts.peers[i].Certificate != fingerprint {
+		return TrustStatusCertificateChanged
+	}
+	return TrustStatusTrusted
+}
+
+// PinCertificate records fingerprint as the DTLS certificate of the known
+// peer with publicKey, replacing any previous certificate
+func (ts *TrustStore) PinCertificate(publicKey, fingerprint string) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	i := ts.findByKey(publicKey)
+	if i < 0 {
+		return errors.New("peer key is not pinned")
+	}
+	ts.peers[i].Certificate = fingerprint
+	ts.peers[i].LastSeen = time.Now().UTC()
+	return ts.save()
+}
+
+// Knows reports whether a key with fingerprint is pinned
+func (ts *TrustStore) Knows(fingerprint string) bool {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	for _, p := range ts.peers {
+		if publicKey, err := ParsePublicKey(p.PublicKey); err == nil && Fingerprint(publicKey) == fingerprint {
+			return true
+		}
+	}
+	return false
+}
+
+// findByName returns the index of the entry pinned under name, or -1
+func (ts *TrustStore) findByName(name string) int {
+	for i, p := range ts.peers {
+		if p.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// findByKey returns the index of the entry with publicKey, or -1
+func (ts *TrustStore) findByKey(publicKey string) int {
+	for i, p := range ts.peers {
+		if p.PublicKey == publicKey {
+			return i
+		}
+	}
+	return -1
+}
+
+// save writes the trust store atomically. Caller must hold ts.mu.
+func (ts *TrustStore) save() error {
+	data, err := json.MarshalIndent(ts.peers, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal trust store: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(ts.path), 0700); err != nil {
+		return fmt.Errorf("failed to create data directory: %w", err)
+	}
+
+	tmp := ts.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write trust store: %w", err)
+	}
+	return os.Rename(tmp, ts.path)
+}
@@ -0,0 +1,230 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultUsageInterval is how often usage is reported when no interval is set
+const defaultUsageInterval = 5 * time.Minute
+
+// UsageConfig configures periodic usage reports to lanscaped
+type UsageConfig struct {
+	// ReportURL is the lanscaped ingestion endpoint,
+	// e.g. https://lanscaped.example.com/v1/networks/1/usage
+	ReportURL string
+	// TokenPath is a file holding the lanscaped access token. It is re-read
+	// before every report so it can be refreshed while the agent runs.
+	TokenPath string
+	// Interval between reports (default 5 minutes)
+	Interval time.Duration
+}
+
+// PeerUsage is application data exchanged with one peer on one topic
+type PeerUsage struct {
+	Topic            string `json:"topic"`
+	Peer             string `json:"peer"` // fingerprint, name, or peer ID
+	BytesSent        int64  `json:"bytes_sent"`
+	BytesReceived    int64  `json:"bytes_received"`
+	MessagesSent     int64  `json:"messages_sent"`
+	MessagesReceived int64  `json:"messages_received"`
+}
+
+// UsageReport is the usage accumulated over one reporting period
+type UsageReport struct {
+	PeriodStart time.Time   `json:"period_start"`
+	PeriodEnd   time.Time   `json:"period_end"`
+	Peers       []PeerUsage `json:"peers"`
+}
+
+// usageKey identifies a usage counter
+type usageKey struct {
+	topic string
+	peer  string
+}
+
+// UsageMeter counts application data per peer and topic. A nil meter
+// counts nothing.
+type UsageMeter struct {
+	mu     sync.Mutex
+	start  time.Time
+	counts map[usageKey]*PeerUsage
+}
+
+// NewUsageMeter creates an empty meter
+func NewUsageMeter() *UsageMeter {
+	return &UsageMeter{start: time.Now(), counts: make(map[usageKey]*PeerUsage)}
+}
+
+// AddSent counts a message of n bytes sent to peer
+func (m *UsageMeter) AddSent(topic, peer string, n int) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u := m.counter(topic, peer)
+	u.BytesSent += int64(n)
+	u.MessagesSent++
+}
+
+// AddReceived counts a message of n bytes received from peer
+func (m *UsageMeter) AddReceived(topic, peer string, n int) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u := m.counter(topic, peer)
+	u.BytesReceived += int64(n)
+	u.MessagesReceived++
+}
+
+// counter returns the counter for a peer, creating it. Caller must hold m.mu.
+func (m *UsageMeter) counter(topic, peer string) *PeerUsage {
+	key := usageKey{topic, peer}
+	u, ok := m.counts[key]
+	if !ok {
+		u = &PeerUsage{Topic: topic, Peer: peer}
+		m.counts[key] = u
+	}
+	return u
+}
+
+// Snapshot returns the usage since the last snapshot and resets the counters
+func (m *UsageMeter) Snapshot() UsageReport {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	report := UsageReport{PeriodStart: m.start.UTC(), PeriodEnd: now.UTC(), Peers: make([]PeerUsage, 0, len(m.counts))}
+	for _, u := range m.counts {
+		report.Peers = append(report.Peers, *u)
+	}
+	sort.Slice(report.Peers, func(i, j int) bool {
+		if report.Peers[i].Topic != report.Peers[j].Topic {
+			return report.Peers[i].Topic < report.Peers[j].Topic
+		}
+		return report.Peers[i].Peer < report.Peers[j].Peer
+	})
+
+	m.start = now
+	m.counts = make(map[usageKey]*PeerUsage)
+	return report
+}
+
+// restore adds back a report that could not be delivered, so its usage is
+// included in the next one
+func (m *UsageMeter) restore(report UsageReport) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if report.PeriodStart.Before(m.start) {
+		m.start = report.PeriodStart
+	}
+	for _, p := range report.Peers {
+		u := m.counter(p.Topic, p.Peer)
+		u.BytesSent += p.BytesSent
+		u.BytesReceived += p.BytesReceived
+		u.MessagesSent += p.MessagesSent
+		u.MessagesReceived += p.MessagesReceived
+	}
+}
+
+// UsageReporter periodically posts a meter's usage to lanscaped
+type UsageReporter struct {
+	meter  *UsageMeter
+	config UsageConfig
+	client *http.Client
+	logger *slog.Logger
+}
+
+// NewUsageReporter creates a reporter for meter
+func NewUsageReporter(meter *UsageMeter, config UsageConfig, logger *slog.Logger) *UsageReporter {
+	if config.Interval <= 0 {
+		config.Interval = defaultUsageInterval
+	}
+	return &UsageReporter{
+		meter:  meter,
+		config: config,
+		client: &http.Client{Timeout: 30 * time.Second},
+		logger: logger,
+	}
+}
+
+// Run reports usage every interval until ctx is done, then reports once more
+func (r *UsageReporter) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			r.report(ctx)
+		case <-ctx.Done():
+			flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			r.report(flushCtx)
+			cancel()
+			return
+		}
+	}
+}
+
+// report posts the usage since the last report. Undelivered usage is kept
+// for the next attempt.
+func (r *UsageReporter) report(ctx context.Context) {
+	report := r.meter.Snapshot()
+	if len(report.Peers) == 0 {
+		return
+	}
+	if err := r.post(ctx, report); err != nil {
+		r.logger.Warn("failed to report usage", "error", err)
+		r.meter.restore(report)
+		return
+	}
+	r.logger.Debug("reported usage", "peers", len(report.Peers))
+}
+
+// post sends one report to the ingestion endpoint, backing off if rate
+// limited
+func (r *UsageReporter) post(ctx context.Context, report UsageReport) error {
+	body, err := json.Marshal(report)
+	if err != nil {
+		return fmt.Errorf("failed to marshal usage report: %w", err)
+	}
+	var token []byte
+	if r.config.TokenPath != "" {
+		if token, err = os.ReadFile(r.config.TokenPath); err != nil {
+			return fmt.Errorf("failed to read usage token: %w", err)
+		}
+	}
+
+	resp, err := doWithBackoff(ctx, r.client, func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.config.ReportURL, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if token != nil {
+			req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+		}
+		return req, nil
+	})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("usage endpoint returned status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -2,10 +2,15 @@ package agent
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
+	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/jhead/lanscape/signaling/pkg/signaling"
 	"github.com/pion/webrtc/v4"
 )
 
@@ -15,25 +20,107 @@ type WebRTCManager struct {
 	peers           map[string]*PeerConnection
 	settingEngine   *webrtc.SettingEngine
 	api             *webrtc.API
-	tailscaleInfo      *TailscaleInfo
-	logger             *slog.Logger
-	onDataChannel      func(peerID string, dc interface{})
-	onPeerConnected    func(peerID string)
-	onPeerClosed       func(peerID string)
-	onICECandidate     func(peerID string, candidate interface{})
+	tailscaleInfo   *TailscaleInfo
+	logger          *slog.Logger
+	onDataChannel   func(peerID string, dc interface{})
+	onPeerConnected func(peerID string)
+	onPeerClosed    func(peerID string)
+	onPeerFailed    func(peerID string)
+	onICECandidate  func(peerID string, candidate interface{})
+	onTrack         func(peerID string, track *webrtc.TrackRemote)
+	onRenegotiate   func(peerID string)
+
+	// labelHandlers receive remotely-opened data channels by label instead of
+	// treating them as the application channel
+	labelHandlers map[string]func(peerID string, dc *webrtc.DataChannel)
+
+	// sendLock serializes enqueueing so every peer's queue sees sends in the
+	// same order; it is a channel so waiting for it honors contexts.
+	// broadcastSeq numbers each broadcast.
+	sendLock     chan struct{}
+	broadcastSeq uint64
+
+	// supervisor tracks goroutines; maxPeers closes the least recently
+	// active peer when exceeded (0 is unlimited)
+	supervisor *Supervisor
+	maxPeers   int
+
+	// sdpHooks may rewrite descriptions before they are applied
+	sdpHooks []SDPHook
+
+	// certificate is presented to every peer so they can pin it; nil
+	// generates one per connection
+	certificate *webrtc.Certificate
+
+	// iceServers are the TURN servers the signaling server vended, for
+	// peers that cannot connect directly
+	iceServers []webrtc.ICEServer
+
+	// overrides holds per-topic and per-peer settings; peerKeys returns the
+	// other names a peer may be configured under
+	overrides *OverrideStore
+	topic     string
+	peerKeys  func(peerID string) []string
+
+	// usage counts application data per peer, reported under usageKey
+	usage    *UsageMeter
+	usageKey func(peerID string) string
+
+	// ctx is cancelled by CloseAll, unblocking sends waiting on full queues
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
+// errManagerClosed is returned by operations interrupted by CloseAll
+var errManagerClosed = errors.New("peer connections closed")
+
+// errSimulatedPeer is returned for operations that need a real peer connection
+var errSimulatedPeer = errors.New("not supported for simulated peers")
+
+// DataChannel is the data channel API the manager and bridge use for
+// application traffic. *webrtc.DataChannel implements it, as do the
+// in-memory channels of a SimNetwork.
+type DataChannel interface {
+	Label() string
+	ReadyState() webrtc.DataChannelState
+	Send(data []byte) error
+	SendText(s string) error
+	OnOpen(fn func())
+	OnClose(fn func())
+	OnMessage(fn func(msg webrtc.DataChannelMessage))
+	Close() error
+}
+
+// appChannelLabel is the label of the application data channel bridged to the browser
+const appChannelLabel = "yjs-sync"
+
 // PeerConnection wraps a WebRTC peer connection
 type PeerConnection struct {
 	ID          string
 	PC          *webrtc.PeerConnection
-	DataChannel interface{} // *webrtc.DataChannel (not exported)
+	DataChannel interface{} // DataChannel: *webrtc.DataChannel, or a simulated channel
+	simulated   bool        // connected through a SimNetwork, PC is nil
 	mu          sync.Mutex
+	queue       *sendQueue
+	lastActive  atomic.Int64 // unix nanoseconds of the last data sent or received
+}
+
+// touch marks the peer as active
+func (p *PeerConnection) touch() {
+	p.lastActive.Store(time.Now().UnixNano())
 }
 
 // NewWebRTCManager creates a new WebRTC manager
 func NewWebRTCManager(tailscaleInfo *TailscaleInfo, logger *slog.Logger) (*WebRTCManager, error) {
+	return newWebRTCManager(tailscaleInfo, nil, logger)
+}
+
+// newWebRTCManager creates a WebRTC manager, optionally restricting ICE candidates with ipFilter
+func newWebRTCManager(tailscaleInfo *TailscaleInfo, ipFilter func(net.IP) bool, logger *slog.Logger) (*WebRTCManager, error) {
 	se := webrtc.SettingEngine{}
+	if ipFilter != nil {
+		se.SetIPFilter(ipFilter)
+	}
 
 	// Configure NAT 1:1 IP mapping with Tailscale IP
 	if tailscaleInfo != nil && tailscaleInfo.IP != "" {
@@ -48,13 +135,226 @@ func NewWebRTCManager(tailscaleInfo *TailscaleInfo, logger *slog.Logger) (*WebRT
 	// Create API with settings
 	api := webrtc.NewAPI(webrtc.WithSettingEngine(se))
 
-	return &WebRTCManager{
+	ctx, cancel := context.WithCancel(context.Background())
+	m := &WebRTCManager{
+		ctx:           ctx,
+		cancel:        cancel,
 		peers:         make(map[string]*PeerConnection),
+		sendLock:      make(chan struct{}, 1),
 		settingEngine: &se,
 		api:           api,
 		tailscaleInfo: tailscaleInfo,
 		logger:        logger,
-	}, nil
+		labelHandlers: make(map[string]func(peerID string, dc *webrtc.DataChannel)),
+	}
+
+	// Every agent answers benchmark traffic so peers can measure the path
+	m.labelHandlers[benchChannelLabel] = m.handleBenchChannel
+	m.labelHandlers[benchLossyChannelLabel] = m.handleBenchChannel
+
+	return m, nil
+}
+
+// HandleDataChannelLabel registers a handler for remotely-opened data channels with the given label
+func (m *WebRTCManager) HandleDataChannelLabel(label string, fn func(peerID string, dc *webrtc.DataChannel)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.labelHandlers[label] = fn
+}
+
+// CreateDataChannel opens an additional labeled data channel to a connected peer
+func (m *WebRTCManager) CreateDataChannel(peerID, label string, init *webrtc.DataChannelInit) (*webrtc.DataChannel, error) {
+	peer, err := m.GetPeerConnection(peerID)
+	if err != nil {
+		return nil, err
+	}
+	if peer.simulated {
+		return nil, errSimulatedPeer
+	}
+
+	dc, err := peer.PC.CreateDataChannel(label, init)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create data channel %q: %w", label, err)
+	}
+	return dc, nil
+}
+
+// supervise registers the manager's goroutines with a supervisor and applies its peer limit
+func (m *WebRTCManager) supervise(supervisor *Supervisor) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.supervisor = supervisor
+	if supervisor != nil {
+		m.maxPeers = supervisor.limits.MaxPeersPerSession
+	}
+}
+
+// useOverrides applies per-topic and per-peer overrides to this manager's
+// connections. It must be called before any peer connects.
+func (m *WebRTCManager) useOverrides(store *OverrideStore, topic string, peerKeys func(peerID string) []string) {
+	m.overrides = store
+	m.topic = topic
+	m.peerKeys = peerKeys
+}
+
+// useUsage counts application data exchanged with peers in meter, naming
+// each peer with key. It must be called before any peer connects.
+func (m *WebRTCManager) useUsage(meter *UsageMeter, key func(peerID string) string) {
+	m.usage = meter
+	m.usageKey = key
+}
+
+// checkSchema validates an application payload against the topic's schema,
+// if one is configured
+func (m *WebRTCManager) checkSchema(data []byte) error {
+	schema := m.overrides.Schema(m.topic)
+	if schema == nil {
+		return nil
+	}
+	return schema.ValidateJSON(data)
+}
+
+// recordReceived counts application data received from a peer
+func (m *WebRTCManager) recordReceived(peerID string, n int) {
+	if m.usage != nil {
+		m.usage.AddReceived(m.topic, m.usageKey(peerID), n)
+	}
+}
+
+// peerOverrides returns the current overrides for a peer. It does not take
+// m.mu, since send queues consult it while a broadcast holds the lock.
+func (m *WebRTCManager) peerOverrides(peerID string) PeerOverrides {
+	if m.overrides == nil {
+		return PeerOverrides{}
+	}
+
+	keys := []string{peerID}
+	if m.peerKeys != nil {
+		keys = append(keys, m.peerKeys(peerID)...)
+	}
+	return m.overrides.Peer(keys...)
+}
+
+// IsBlocked reports whether data exchange with a peer is blocked or muted by
+// configuration
+func (m *WebRTCManager) IsBlocked(peerID string) bool {
+	o := m.peerOverrides(peerID)
+	return o.Blocked || o.Muted
+}
+
+// closeBlockedPeers closes connections to peers that are now blocked
+func (m *WebRTCManager) closeBlockedPeers() {
+	for _, peerID := range m.PeerIDs() {
+		if m.peerOverrides(peerID).Blocked {
+			m.logger.Info("closing blocked peer", "peer", peerID)
+			m.ClosePeer(peerID)
+		}
+	}
+}
+
+// AddSDPHook appends a hook that can inspect or modify SDP before it is applied
+func (m *WebRTCManager) AddSDPHook(hook SDPHook) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sdpHooks = append(m.sdpHooks, hook)
+}
+
+// SetOnTrack sets the callback for media tracks received from peers
+func (m *WebRTCManager) SetOnTrack(fn func(peerID string, track *webrtc.TrackRemote)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.onTrack = fn
+}
+
+// SetOnRenegotiate sets the callback for when a peer connection needs a new offer
+func (m *WebRTCManager) SetOnRenegotiate(fn func(peerID string)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.onRenegotiate = fn
+}
+
+// AddTrack adds a local media track to a peer connection and renegotiates
+func (m *WebRTCManager) AddTrack(peerID string, track webrtc.TrackLocal) (*webrtc.RTPSender, error) {
+	peer, err := m.GetPeerConnection(peerID)
+	if err != nil {
+		return nil, err
+	}
+	if peer.simulated {
+		return nil, errSimulatedPeer
+	}
+
+	sender, err := peer.PC.AddTrack(track)
+	if err != nil {
+		return nil, fmt.Errorf("failed to add track: %w", err)
+	}
+
+	// Drain RTCP so interceptors keep working
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			if _, _, err := sender.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	m.renegotiate(peerID)
+	return sender, nil
+}
+
+// RemoveTrack removes a media track from a peer connection and renegotiates
+func (m *WebRTCManager) RemoveTrack(peerID string, sender *webrtc.RTPSender) error {
+	peer, err := m.GetPeerConnection(peerID)
+	if err != nil {
+		return err
+	}
+	if peer.simulated {
+		return errSimulatedPeer
+	}
+
+	if err := peer.PC.RemoveTrack(sender); err != nil {
+		return fmt.Errorf("failed to remove track: %w", err)
+	}
+
+	m.renegotiate(peerID)
+	return nil
+}
+
+// renegotiate asks signaling to send a new offer for a peer
+func (m *WebRTCManager) renegotiate(peerID string) {
+	m.mu.RLock()
+	fn := m.onRenegotiate
+	m.mu.RUnlock()
+
+	if fn != nil {
+		fn(peerID)
+	}
+}
+
+// PeerIDs returns the IDs of all tracked peer connections
+func (m *WebRTCManager) PeerIDs() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	ids := make([]string, 0, len(m.peers))
+	for peerID := range m.peers {
+		ids = append(ids, peerID)
+	}
+	return ids
+}
+
+// PeerCount returns the number of tracked peer connections
+func (m *WebRTCManager) PeerCount() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.peers)
+}
+
+// TouchPeer marks a peer as active
+func (m *WebRTCManager) TouchPeer(peerID string) {
+	if peer, err := m.GetPeerConnection(peerID); err == nil {
+		peer.touch()
+	}
 }
 
 // SetOnDataChannel sets the callback for when a data channel is opened
@@ -78,6 +378,14 @@ func (m *WebRTCManager) SetOnPeerClosed(fn func(peerID string)) {
 	m.onPeerClosed = fn
 }
 
+// SetOnPeerFailed sets the callback for when a peer connection fails
+// without ever having connected, after the peer is closed
+func (m *WebRTCManager) SetOnPeerFailed(fn func(peerID string)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.onPeerFailed = fn
+}
+
 // SetOnICECandidate sets the callback for when an ICE candidate is generated
 func (m *WebRTCManager) SetOnICECandidate(fn func(peerID string, candidate interface{})) {
 	m.mu.Lock()
@@ -85,8 +393,31 @@ func (m *WebRTCManager) SetOnICECandidate(fn func(peerID string, candidate inter
 	m.onICECandidate = fn
 }
 
+// SetICEServers sets the STUN and TURN servers new peer connections gather
+// candidates from; existing connections keep theirs
+func (m *WebRTCManager) SetICEServers(servers []signaling.ICEServer) {
+	iceServers := make([]webrtc.ICEServer, 0, len(servers))
+	for _, server := range servers {
+		iceServer := webrtc.ICEServer{URLs: server.URLs}
+		if server.Username != "" {
+			iceServer.Username = server.Username
+			iceServer.Credential = server.Credential
+			iceServer.CredentialType = webrtc.ICECredentialTypePassword
+		}
+		iceServers = append(iceServers, iceServer)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.iceServers = iceServers
+}
+
 // CreatePeerConnection creates a new peer connection
 func (m *WebRTCManager) CreatePeerConnection(peerID string, isInitiator bool) (*PeerConnection, error) {
+	if m.peerOverrides(peerID).Blocked {
+		return nil, fmt.Errorf("peer is blocked: %s", peerID)
+	}
+
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
@@ -95,9 +426,16 @@ func (m *WebRTCManager) CreatePeerConnection(peerID string, isInitiator bool) (*
 		return existing, nil
 	}
 
+	if m.maxPeers > 0 && len(m.peers) >= m.maxPeers {
+		m.evictIdlePeerLocked()
+	}
+
 	// Create peer connection configuration
 	config := webrtc.Configuration{
-		ICEServers: []webrtc.ICEServer{},
+		ICEServers: m.iceServers,
+	}
+	if m.certificate != nil {
+		config.Certificates = []webrtc.Certificate{*m.certificate}
 	}
 
 	// Create peer connection
@@ -108,17 +446,25 @@ func (m *WebRTCManager) CreatePeerConnection(peerID string, isInitiator bool) (*
 
 	peerConn := &PeerConnection{
 		ID: peerID,
-		PC:  pc,
+		PC: pc,
 	}
+	peerConn.touch()
+	peerConn.queue = m.newSendQueue(peerConn)
 
 	// Create data channel if we're the initiator
 	if isInitiator {
+		init := &webrtc.DataChannelInit{}
 		ordered := true
-		dc, err := pc.CreateDataChannel("yjs-sync", &webrtc.DataChannelInit{
-			Ordered: &ordered,
-		})
+		if m.overrides.Topic(m.topic).Reliability == ReliabilityUnreliable {
+			var maxRetransmits uint16
+			ordered = false
+			init.MaxRetransmits = &maxRetransmits
+		}
+		init.Ordered = &ordered
+		dc, err := pc.CreateDataChannel(appChannelLabel, init)
 		if err != nil {
 			pc.Close()
+			peerConn.queue.close()
 			return nil, fmt.Errorf("failed to create data channel: %w", err)
 		}
 		peerConn.DataChannel = dc
@@ -131,7 +477,16 @@ func (m *WebRTCManager) CreatePeerConnection(peerID string, isInitiator bool) (*
 
 	// Handle incoming data channels
 	pc.OnDataChannel(func(dc *webrtc.DataChannel) {
-		m.logger.Info("received data channel", "peer", peerID)
+		m.logger.Info("received data channel", "peer", peerID, "label", dc.Label())
+
+		m.mu.RLock()
+		handler, ok := m.labelHandlers[dc.Label()]
+		m.mu.RUnlock()
+		if ok {
+			handler(peerID, dc)
+			return
+		}
+
 		peerConn.mu.Lock()
 		peerConn.DataChannel = dc
 		peerConn.mu.Unlock()
@@ -142,15 +497,35 @@ func (m *WebRTCManager) CreatePeerConnection(peerID string, isInitiator bool) (*
 		}
 	})
 
+	// Surface incoming media tracks
+	pc.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		m.logger.Info("received track", "peer", peerID, "kind", track.Kind().String(), "codec", track.Codec().MimeType)
+
+		m.mu.RLock()
+		fn := m.onTrack
+		m.mu.RUnlock()
+		if fn != nil {
+			fn(peerID, track)
+		}
+	})
+
 	// Handle connection state changes
+	var everConnected atomic.Bool
 	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
 		m.logger.Info("peer connection state changed", "peer", peerID, "state", state.String())
 		if state == webrtc.PeerConnectionStateConnected {
+			everConnected.Store(true)
 			if m.onPeerConnected != nil {
 				m.onPeerConnected(peerID)
 			}
 		} else if state == webrtc.PeerConnectionStateClosed || state == webrtc.PeerConnectionStateFailed {
+			m.mu.RLock()
+			onFailed := m.onPeerFailed
+			m.mu.RUnlock()
 			m.ClosePeer(peerID)
+			if state == webrtc.PeerConnectionStateFailed && !everConnected.Load() && onFailed != nil {
+				onFailed(peerID)
+			}
 		}
 	})
 
@@ -173,6 +548,19 @@ func (m *WebRTCManager) CreatePeerConnection(peerID string, isInitiator bool) (*
 	return peerConn, nil
 }
 
+// newSendQueue starts the send queue for a new peer, applying its bandwidth
+// cap and counting usage
+func (m *WebRTCManager) newSendQueue(peer *PeerConnection) *sendQueue {
+	peerID := peer.ID
+	return newSendQueue(m.ctx, peer, m.supervisor, func() int64 {
+		return m.peerOverrides(peerID).MaxBandwidth
+	}, func(n int) {
+		if m.usage != nil {
+			m.usage.AddSent(m.topic, m.usageKey(peerID), n)
+		}
+	}, m.logger)
+}
+
 // setupDataChannel sets up event handlers for a data channel
 func (m *WebRTCManager) setupDataChannel(peerID string, dc *webrtc.DataChannel) {
 	dc.OnOpen(func() {
@@ -204,24 +592,46 @@ func (m *WebRTCManager) GetPeerConnection(peerID string) (*PeerConnection, error
 	return peer, nil
 }
 
+// evictIdlePeerLocked closes the least recently active peer. Caller must hold m.mu.
+func (m *WebRTCManager) evictIdlePeerLocked() {
+	var oldest *PeerConnection
+	for _, peer := range m.peers {
+		if oldest == nil || peer.lastActive.Load() < oldest.lastActive.Load() {
+			oldest = peer
+		}
+	}
+	if oldest == nil {
+		return
+	}
+
+	m.logger.Warn("peer limit reached, closing least recently active peer",
+		"limit", m.maxPeers, "peer", oldest.ID, "idle", time.Since(time.Unix(0, oldest.lastActive.Load())).Round(time.Second))
+	m.closePeerLocked(oldest.ID)
+}
+
 // ClosePeer closes a peer connection
 func (m *WebRTCManager) ClosePeer(peerID string) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
+	m.closePeerLocked(peerID)
+}
 
+// closePeerLocked closes a peer connection. Caller must hold m.mu.
+func (m *WebRTCManager) closePeerLocked(peerID string) {
 	peer, ok := m.peers[peerID]
 	if !ok {
 		return
 	}
 
 	if peer.DataChannel != nil {
-		if dc, ok := peer.DataChannel.(*webrtc.DataChannel); ok {
+		if dc, ok := peer.DataChannel.(DataChannel); ok {
 			dc.Close()
 		}
 	}
 	if peer.PC != nil {
 		peer.PC.Close()
 	}
+	peer.queue.close()
 
 	delete(m.peers, peerID)
 
@@ -232,26 +642,33 @@ func (m *WebRTCManager) ClosePeer(peerID string) {
 	m.logger.Info("closed peer connection", "peer", peerID)
 }
 
-// CloseAll closes all peer connections
+// CloseAll closes all peer connections. Sends blocked on full queues are
+// cancelled first so they release the manager lock.
 func (m *WebRTCManager) CloseAll() {
+	m.cancel()
+
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
 	for peerID, peer := range m.peers {
 		if peer.DataChannel != nil {
-			if dc, ok := peer.DataChannel.(*webrtc.DataChannel); ok {
+			if dc, ok := peer.DataChannel.(DataChannel); ok {
 				dc.Close()
 			}
 		}
 		if peer.PC != nil {
 			peer.PC.Close()
 		}
+		peer.queue.close()
 		delete(m.peers, peerID)
 	}
 }
 
 // CreateOffer creates an SDP offer for a peer
-func (m *WebRTCManager) CreateOffer(peerID string) (*webrtc.SessionDescription, error) {
+func (m *WebRTCManager) CreateOffer(ctx context.Context, peerID string) (*webrtc.SessionDescription, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	peer, err := m.GetPeerConnection(peerID)
 	if err != nil {
 		return nil, err
@@ -262,6 +679,10 @@ func (m *WebRTCManager) CreateOffer(peerID string) (*webrtc.SessionDescription,
 		return nil, fmt.Errorf("failed to create offer: %w", err)
 	}
 
+	if err := m.mungeSDP(ctx, peerID, SDPDirectionLocal, &offer); err != nil {
+		return nil, err
+	}
+
 	if err := peer.PC.SetLocalDescription(offer); err != nil {
 		return nil, fmt.Errorf("failed to set local description: %w", err)
 	}
@@ -270,17 +691,27 @@ func (m *WebRTCManager) CreateOffer(peerID string) (*webrtc.SessionDescription,
 }
 
 // SetRemoteDescription sets the remote SDP description
-func (m *WebRTCManager) SetRemoteDescription(peerID string, desc webrtc.SessionDescription) error {
+func (m *WebRTCManager) SetRemoteDescription(ctx context.Context, peerID string, desc webrtc.SessionDescription) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	peer, err := m.GetPeerConnection(peerID)
 	if err != nil {
 		return err
 	}
 
+	if err := m.mungeSDP(ctx, peerID, SDPDirectionRemote, &desc); err != nil {
+		return err
+	}
+
 	return peer.PC.SetRemoteDescription(desc)
 }
 
 // CreateAnswer creates an SDP answer for a peer
-func (m *WebRTCManager) CreateAnswer(peerID string) (*webrtc.SessionDescription, error) {
+func (m *WebRTCManager) CreateAnswer(ctx context.Context, peerID string) (*webrtc.SessionDescription, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	peer, err := m.GetPeerConnection(peerID)
 	if err != nil {
 		return nil, err
@@ -291,6 +722,10 @@ func (m *WebRTCManager) CreateAnswer(peerID string) (*webrtc.SessionDescription,
 		return nil, fmt.Errorf("failed to create answer: %w", err)
 	}
 
+	if err := m.mungeSDP(ctx, peerID, SDPDirectionLocal, &answer); err != nil {
+		return nil, err
+	}
+
 	if err := peer.PC.SetLocalDescription(answer); err != nil {
 		return nil, fmt.Errorf("failed to set local description: %w", err)
 	}
@@ -308,8 +743,9 @@ func (m *WebRTCManager) AddICECandidate(peerID string, candidate webrtc.ICECandi
 	return peer.PC.AddICECandidate(candidate)
 }
 
-// SendData sends data to a peer via data channel
-func (m *WebRTCManager) SendData(peerID string, data []byte) error {
+// SendData queues data for a peer's data channel, waiting while the queue is
+// full until ctx is done
+func (m *WebRTCManager) SendData(ctx context.Context, peerID string, data []byte) error {
 	peer, err := m.GetPeerConnection(peerID)
 	if err != nil {
 		return err
@@ -319,31 +755,94 @@ func (m *WebRTCManager) SendData(peerID string, data []byte) error {
 	dcInterface := peer.DataChannel
 	peer.mu.Unlock()
 
-	dc, ok := dcInterface.(*webrtc.DataChannel)
+	dc, ok := dcInterface.(DataChannel)
 	if !ok || dc == nil || dc.ReadyState() != webrtc.DataChannelStateOpen {
 		return fmt.Errorf("data channel not open for peer: %s", peerID)
 	}
+	if m.IsBlocked(peerID) {
+		return fmt.Errorf("peer is blocked: %s", peerID)
+	}
 
-	return dc.Send(data)
+	if err := m.lockSend(ctx); err != nil {
+		return err
+	}
+	defer m.unlockSend()
+	if err := peer.queue.enqueue(ctx, data); err != nil {
+		return fmt.Errorf("failed to send to peer %s: %w", peerID, err)
+	}
+	return nil
+}
+
+// lockSend waits for the send lock until ctx is done or the manager closes
+func (m *WebRTCManager) lockSend(ctx context.Context) error {
+	select {
+	case m.sendLock <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-m.ctx.Done():
+		return errManagerClosed
+	}
+}
+
+// unlockSend releases the send lock
+func (m *WebRTCManager) unlockSend() {
+	<-m.sendLock
 }
 
 // BroadcastData sends data to all connected peers
-func (m *WebRTCManager) BroadcastData(data []byte) {
+func (m *WebRTCManager) BroadcastData(ctx context.Context, data []byte) (uint64, error) {
+	return m.BroadcastDataTo(ctx, data, nil)
+}
+
+// BroadcastDataTo sends data to all connected peers accepted by include (nil includes all).
+// Broadcasts are sequenced: every peer receives them in the same order, and
+// the returned sequence number identifies this broadcast. If ctx is done
+// while waiting on a full queue, peers not yet reached miss the broadcast.
+func (m *WebRTCManager) BroadcastDataTo(ctx context.Context, data []byte, include func(peerID string) bool) (uint64, error) {
+	if err := m.lockSend(ctx); err != nil {
+		return 0, err
+	}
+	defer m.unlockSend()
+
+	// Enqueueing can block on a full queue, so only the send lock is held
+	// while it does; holding m.mu would stall ClosePeer and CloseAll, which
+	// are what unblock it.
+	queues := m.broadcastQueues(include)
+	m.broadcastSeq++
+	for _, q := range queues {
+		if err := q.enqueue(ctx, data); err != nil && err != errQueueClosed {
+			return m.broadcastSeq, err
+		}
+	}
+	return m.broadcastSeq, nil
+}
+
+// broadcastQueues snapshots the send queues of the unblocked peers accepted
+// by include whose data channel is open
+func (m *WebRTCManager) broadcastQueues(include func(peerID string) bool) []*sendQueue {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 
+	queues := make([]*sendQueue, 0, len(m.peers))
 	for peerID, peer := range m.peers {
+		if include != nil && !include(peerID) {
+			continue
+		}
+		if m.IsBlocked(peerID) {
+			continue
+		}
 		peer.mu.Lock()
 		dcInterface := peer.DataChannel
 		peer.mu.Unlock()
 
-		dc, ok := dcInterface.(*webrtc.DataChannel)
-		if ok && dc != nil && dc.ReadyState() == webrtc.DataChannelStateOpen {
-			if err := dc.Send(data); err != nil {
-				m.logger.Warn("failed to broadcast to peer", "peer", peerID, "error", err)
-			}
+		dc, ok := dcInterface.(DataChannel)
+		if !ok || dc == nil || dc.ReadyState() != webrtc.DataChannelStateOpen {
+			continue
 		}
+		queues = append(queues, peer.queue)
 	}
+	return queues
 }
 
 // SetDataChannelHandler sets a handler for incoming data channel messages
@@ -357,7 +856,7 @@ func (m *WebRTCManager) SetDataChannelHandler(peerID string, handler func([]byte
 	dcInterface := peer.DataChannel
 	peer.mu.Unlock()
 
-	dc, ok := dcInterface.(*webrtc.DataChannel)
+	dc, ok := dcInterface.(DataChannel)
 	if !ok || dc == nil {
 		return fmt.Errorf("data channel not available for peer: %s", peerID)
 	}
@@ -376,23 +875,26 @@ func (m *WebRTCManager) WaitForDataChannel(ctx context.Context, peerID string) e
 		return err
 	}
 
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+
 	// Wait for data channel to be set
 	for {
 		peer.mu.Lock()
 		dcInterface := peer.DataChannel
 		peer.mu.Unlock()
 
-		dc, ok := dcInterface.(*webrtc.DataChannel)
+		dc, ok := dcInterface.(DataChannel)
 		if ok && dc != nil && dc.ReadyState() == webrtc.DataChannelStateOpen {
 			return nil
 		}
 
 		select {
+		case <-ticker.C:
 		case <-ctx.Done():
 			return ctx.Err()
-		default:
-			// Continue waiting
+		case <-m.ctx.Done():
+			return errManagerClosed
 		}
 	}
 }
-
@@ -2,35 +2,38 @@ package agent
 
 import (
 	"context"
+	"errors"
 	"log/slog"
 	"net/http"
+	"slices"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/jhead/lanscape/lanscape-agent/pkg/protocol"
+	"github.com/jhead/lanscape/signaling/pkg/buildinfo"
+	"github.com/jhead/lanscape/signaling/pkg/signaling"
 	"nhooyr.io/websocket"
-	"nhooyr.io/websocket/wsjson"
 )
 
 // WebSocketServer handles browser WebSocket connections
 type WebSocketServer struct {
-	addr            string
-	signalingURL    string
-	topic           string
-	tailscaleInfo   *TailscaleInfo
-	logger          *slog.Logger
-	server          *http.Server
-	sessions        map[*websocket.Conn]*BrowserSession
-	mu              sync.RWMutex
+	addr          string
+	sessionConfig SessionConfig
+	logger        *slog.Logger
+	server        *http.Server
+	// localToken is required of every client, which must also be on the
+	// loopback interface, in strict local mode
+	localToken string
+	sessions   map[*websocket.Conn]*BrowserSession
+	mu         sync.RWMutex
 }
 
 // NewWebSocketServer creates a new WebSocket server
-func NewWebSocketServer(addr, signalingURL, topic string, tailscaleInfo *TailscaleInfo, logger *slog.Logger) *WebSocketServer {
+func NewWebSocketServer(addr string, sessionConfig SessionConfig, logger *slog.Logger) *WebSocketServer {
 	return &WebSocketServer{
 		addr:          addr,
-		signalingURL:  signalingURL,
-		topic:         topic,
-		tailscaleInfo: tailscaleInfo,
+		sessionConfig: sessionConfig,
 		logger:        logger,
 		sessions:      make(map[*websocket.Conn]*BrowserSession),
 	}
@@ -40,13 +43,24 @@ func NewWebSocketServer(addr, signalingURL, topic string, tailscaleInfo *Tailsca
 func (s *WebSocketServer) Start() error {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", s.handleWebSocket)
+	mux.HandleFunc("/whip", s.handleMedia)
+	mux.HandleFunc("/whip/", s.handleMedia)
+	mux.HandleFunc("/whep", s.handleMedia)
+	mux.Handle("GET /version", buildinfo.Handler())
+	if s.sessionConfig.Supervisor != nil {
+		mux.Handle("/debug/lifecycle", s.sessionConfig.Supervisor)
+	}
 
+	var handler http.Handler = mux
+	if s.localToken != "" {
+		handler = s.strictLocal(s.localToken, mux)
+	}
 	s.server = &http.Server{
 		Addr:    s.addr,
-		Handler: mux,
+		Handler: handler,
 	}
 
-	s.logger.Info("starting WebSocket server", "addr", s.addr)
+	s.logger.Info("starting WebSocket server", "addr", s.addr, "strictLocal", s.localToken != "")
 	return s.server.ListenAndServe()
 }
 
@@ -54,8 +68,10 @@ func (s *WebSocketServer) Start() error {
 func (s *WebSocketServer) Stop(ctx context.Context) error {
 	s.mu.Lock()
 	for conn, session := range s.sessions {
-		session.Disconnect()
-		conn.Close(websocket.StatusNormalClosure, "server shutting down")
+		if err := session.Stop(ctx); err != nil {
+			s.logger.Warn("failed to stop browser session", "error", err)
+		}
+		signaling.Close(conn, signaling.CloseDraining, "agent shutting down")
 	}
 	s.mu.Unlock()
 
@@ -67,31 +83,63 @@ func (s *WebSocketServer) Stop(ctx context.Context) error {
 
 // handleWebSocket handles a WebSocket connection
 func (s *WebSocketServer) handleWebSocket(w http.ResponseWriter, r *http.Request) {
-	conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
-		OriginPatterns: []string{"*"}, // Allow all origins for localhost
-	})
+	casing, err := protocol.ParseCasing(r.URL.Query().Get("casing"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	conn, err := websocket.Accept(w, r, acceptOptions(r))
 	if err != nil {
 		s.logger.Error("failed to accept WebSocket", "error", err)
 		return
 	}
 
+	// Browsers that request no subprotocol, or only their local token, speak v1
+	negotiated := conn.Subprotocol()
+	if strings.HasPrefix(negotiated, localTokenProtocolPrefix) {
+		negotiated = ""
+	}
+	version, err := protocol.ParseSubprotocol(negotiated)
+	if err != nil {
+		signaling.Close(conn, signaling.CloseProtocolError, err.Error())
+		return
+	}
+	codec, _ := protocol.NewCodec(version, casing)
+
 	// Create a new browser session for this connection
-	session, err := NewBrowserSession(s.signalingURL, s.topic, s.tailscaleInfo, s.logger)
+	session, err := NewBrowserSession(s.sessionConfig, s.logger)
 	if err != nil {
 		s.logger.Error("failed to create browser session", "error", err)
 		conn.Close(websocket.StatusInternalError, "failed to create session")
 		return
 	}
 
+	// The session is unusable once signaling ends, so pass the server's
+	// reason on to the browser
+	session.SetOnSignalingClosed(func(reason CloseReason, detail string) {
+		if reason == "" {
+			conn.Close(websocket.StatusGoingAway, "signaling connection lost")
+			return
+		}
+		signaling.Close(conn, reason, detail)
+	})
+
 	// Set up bridge to send messages to this browser (before connecting)
 	bridge := session.GetBridge()
 	bridge.SetBrowserSend(func(msg protocol.AgentMessage) error {
-		return s.sendToBrowser(conn, msg)
+		return s.sendToBrowser(conn, codec, protocol.UpgradeAgent(msg))
 	})
 
 	// Connect to signaling server
 	if err := session.Connect(); err != nil {
 		s.logger.Error("failed to connect to signaling", "error", err)
+		var limited *RateLimitedError
+		if errors.As(err, &limited) {
+			// Retryable, once the browser has waited as long as the server asked
+			signaling.Close(conn, signaling.CloseRateLimited, "retry after "+limited.RetryAfter.String())
+			return
+		}
 		conn.Close(websocket.StatusInternalError, "failed to connect to signaling")
 		return
 	}
@@ -100,26 +148,47 @@ func (s *WebSocketServer) handleWebSocket(w http.ResponseWriter, r *http.Request
 	s.sessions[conn] = session
 	s.mu.Unlock()
 
+	s.sessionConfig.Supervisor.AddSession(session, func() {
+		signaling.Close(conn, signaling.CloseSuperseded, "session limit reached")
+	})
+
 	// Wait a bit for welcome message from signaling
 	// The signaling client will receive welcome and set selfID
 	// We'll send welcome to browser when we receive it from signaling
 	// For now, just log
-	s.logger.Info("browser connected, waiting for signaling welcome")
+	s.logger.Info("browser connected, waiting for signaling welcome", "protocol", version, "casing", casing)
 
 	// Handle messages from browser
 	ctx := r.Context()
 	for {
-		var msg protocol.BrowserMessage
-		if err := wsjson.Read(ctx, conn, &msg); err != nil {
+		typ, data, err := conn.Read(ctx)
+		if err != nil {
 			s.logger.Debug("browser disconnected", "error", err)
 			break
 		}
+		envelope, err := codec.DecodeBrowser(protocol.Frame{Binary: typ == websocket.MessageBinary, Data: data})
+		if err != nil {
+			s.logger.Warn("closing browser connection after invalid message", "error", err)
+			signaling.Close(conn, signaling.CloseProtocolError, "invalid message")
+			break
+		}
 
-		s.logger.Info("received browser message", "type", msg.Type, "peerId", msg.PeerID, "dataSize", len(msg.Data))
+		s.sessionConfig.Supervisor.Touch(session)
 
-		if err := bridge.HandleBrowserMessage(msg); err != nil {
+		msg, err := envelope.Downgrade()
+		if err == nil {
+			s.logger.Info("received browser message", "type", msg.Type, "peerId", msg.PeerID, "dataSize", len(msg.Data))
+			err = bridge.HandleBrowserMessage(ctx, msg)
+		}
+		if err != nil {
 			s.logger.Warn("failed to handle browser message", "error", err)
-			s.sendError(conn, err.Error())
+		}
+
+		// v2 messages with an ID are acknowledged whether or not they succeeded
+		if envelope.ID != "" {
+			s.sendToBrowser(conn, codec, protocol.Ack(envelope.ID, err))
+		} else if err != nil {
+			s.sendError(conn, codec, err.Error())
 		}
 	}
 
@@ -127,25 +196,94 @@ func (s *WebSocketServer) handleWebSocket(w http.ResponseWriter, r *http.Request
 	session.Disconnect()
 	delete(s.sessions, conn)
 	s.mu.Unlock()
+	s.sessionConfig.Supervisor.RemoveSession(session)
 
 	conn.Close(websocket.StatusNormalClosure, "")
 	s.logger.Info("browser disconnected")
 }
 
-// sendToBrowser sends a message to the browser
-func (s *WebSocketServer) sendToBrowser(conn *websocket.Conn, msg protocol.AgentMessage) error {
+// acceptOptions returns the options to accept a browser WebSocket with. The
+// newest protocol version offered is selected. A browser fails the
+// handshake if it offered subprotocols and the agent selects none, so a
+// local token offered on its own is selected as a last resort.
+func acceptOptions(r *http.Request) *websocket.AcceptOptions {
+	opts := &websocket.AcceptOptions{
+		OriginPatterns: []string{"*"}, // Allow all origins for localhost
+		Subprotocols:   slices.Clone(protocol.Subprotocols),
+	}
+	for _, offered := range offeredProtocols(r) {
+		if strings.HasPrefix(offered, localTokenProtocolPrefix) {
+			opts.Subprotocols = append(opts.Subprotocols, offered)
+		}
+	}
+	return opts
+}
+
+// handleMedia routes WHIP/WHEP requests to the media relay of a browser
+// session, selected by ?session=<selfId> (optional with a single session)
+func (s *WebSocketServer) handleMedia(w http.ResponseWriter, r *http.Request) {
+	s.mu.RLock()
+	var relays []*MediaRelay
+	var match *MediaRelay
+	selfID := r.URL.Query().Get("session")
+	for _, session := range s.sessions {
+		relays = append(relays, session.GetMediaRelay())
+		if selfID != "" && session.GetSelfID() == selfID {
+			match = session.GetMediaRelay()
+		}
+	}
+	s.mu.RUnlock()
+
+	// Resource URLs from WHIP Location headers don't carry the session
+	if r.Method == http.MethodDelete {
+		for _, relay := range relays {
+			if relay.Unpublish(strings.TrimPrefix(r.URL.Path, "/whip/")) {
+				w.Header().Set("Access-Control-Allow-Origin", "*")
+				w.WriteHeader(http.StatusOK)
+				return
+			}
+		}
+	}
+
+	if match == nil && selfID == "" && len(relays) == 1 {
+		match = relays[0]
+	}
+	if match == nil {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		http.Error(w, "unknown session", http.StatusNotFound)
+		return
+	}
+
+	serveMedia(w, r, match)
+}
+
+// sendToBrowser encodes a message in the browser's protocol version and
+// sends it
+func (s *WebSocketServer) sendToBrowser(conn *websocket.Conn, codec *protocol.Codec, msg protocol.AgentMessageV2) error {
+	frame, ok, err := codec.EncodeAgent(msg)
+	if err != nil || !ok {
+		return err
+	}
+
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	// Always send as JSON (data will be encoded as array)
-	return wsjson.Write(ctx, conn, msg)
+	typ := websocket.MessageText
+	if frame.Binary {
+		typ = websocket.MessageBinary
+	}
+	return conn.Write(ctx, typ, frame.Data)
 }
 
 // sendError sends an error message to the browser
-func (s *WebSocketServer) sendError(conn *websocket.Conn, errorMsg string) {
+func (s *WebSocketServer) sendError(conn *websocket.Conn, codec *protocol.Codec, errorMsg string) {
 	msg := protocol.AgentMessage{
 		Type:  protocol.MessageTypeError,
 		Error: errorMsg,
 	}
-	s.sendToBrowser(conn, msg)
+	s.sendToBrowser(conn, codec, protocol.UpgradeAgent(msg))
 }
@@ -0,0 +1,73 @@
+package agent
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jhead/lanscape/lanscape-agent/pkg/protocol"
+	"nhooyr.io/websocket"
+)
+
+func TestAcceptOptionsSubprotocols(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, acceptOptions(r))
+		if err != nil {
+			return
+		}
+		conn.Close(websocket.StatusNormalClosure, "")
+	}))
+	defer srv.Close()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	token := localTokenProtocolPrefix + "secret"
+	tests := []struct {
+		name    string
+		offered []string
+		want    string
+	}{
+		{"none", nil, ""},
+		{"v1", []string{protocol.Version1.Subprotocol()}, protocol.Version1.Subprotocol()},
+		{"both versions", []string{protocol.Version1.Subprotocol(), protocol.Version2.Subprotocol()}, protocol.Version2.Subprotocol()},
+		{"version and token", []string{token, protocol.Version2.Subprotocol()}, protocol.Version2.Subprotocol()},
+		{"token only", []string{token}, token},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, _, err := websocket.Dial(context.Background(), url, &websocket.DialOptions{Subprotocols: tt.offered})
+			if err != nil {
+				t.Fatalf("Dial: %v", err)
+			}
+			defer conn.CloseNow()
+			if got := conn.Subprotocol(); got != tt.want {
+				t.Fatalf("negotiated %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLocalToken(t *testing.T) {
+	tests := []struct {
+		name   string
+		header http.Header
+		query  string
+		want   string
+	}{
+		{"bearer", http.Header{"Authorization": {"Bearer abc"}}, "", "abc"},
+		{"subprotocol", http.Header{"Sec-Websocket-Protocol": {"lanscape.v2, lanscape.token.def"}}, "", "def"},
+		{"query", nil, "token=ghi", "ghi"},
+		{"bearer first", http.Header{"Authorization": {"Bearer abc"}, "Sec-Websocket-Protocol": {"lanscape.token.def"}}, "token=ghi", "abc"},
+		{"none", http.Header{"Sec-Websocket-Protocol": {"lanscape.v2"}}, "", ""},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/?"+tt.query, nil)
+		for k, v := range tt.header {
+			r.Header[k] = v
+		}
+		if got := localToken(r); got != tt.want {
+			t.Errorf("%s: localToken = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,365 @@
+// Package agent embeds lanscape peer connectivity in Go applications. A
+// Client joins a signaling topic, connects to every peer in it over WebRTC,
+// and delivers application messages through callbacks, without running the
+// local WebSocket server a browser would use.
+//
+//	client, err := agent.New("ws://localhost:8081", "my-topic",
+//		agent.WithMessageHandler(func(peerID string, data []byte) {
+//			fmt.Printf("%s: %s\n", peerID, data)
+//		}),
+//	)
+//	if err != nil {
+//		return err
+//	}
+//	defer client.Close()
+//	if err := client.Connect(ctx); err != nil {
+//		return err
+//	}
+//	client.Broadcast(ctx, []byte("hello"))
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+
+	internal "github.com/jhead/lanscape/lanscape-agent/internal/agent"
+	"github.com/jhead/lanscape/lanscape-agent/pkg/protocol"
+	"github.com/jhead/lanscape/signaling/pkg/signaling"
+)
+
+// PeerVerification reports the outcome of checking a peer's identity key
+type PeerVerification struct {
+	PeerID      string
+	Name        string // advertised name, unauthenticated
+	Fingerprint string // identity key fingerprint, empty if the peer is unsigned
+	Status      string // "trusted", "new", "changed", "unsigned", or "certificate-changed"
+	Certificate string // DTLS certificate fingerprint, set when it changed
+}
+
+// Option configures a Client
+type Option func(*options)
+
+type options struct {
+	logger              *slog.Logger
+	dataDir             string
+	name                string
+	tailscale           bool
+	requireVerification bool
+	stableID            bool
+	configPath          string
+	simulation          *SimNetwork
+
+	onMessage          func(peerID string, data []byte)
+	onPeerConnected    func(peerID string)
+	onPeerDisconnected func(peerID string)
+	onPeerVerification func(v PeerVerification)
+	onError            func(peerID string, err error)
+	onSignalingClosed  func(reason CloseReason, detail string)
+}
+
+// WithLogger sets the logger (default: slog.Default())
+func WithLogger(logger *slog.Logger) Option {
+	return func(o *options) { o.logger = logger }
+}
+
+// WithDataDir sets the directory holding the identity key and known peers
+// (default: the same directory as the lanscape-agent daemon)
+func WithDataDir(dir string) Option {
+	return func(o *options) { o.dataDir = dir }
+}
+
+// WithName sets the name advertised to peers (default: hostname)
+func WithName(name string) Option {
+	return func(o *options) { o.name = name }
+}
+
+// WithTailscale binds peer connections to the Tailscale interface if one is found
+func WithTailscale() Option {
+	return func(o *options) { o.tailscale = true }
+}
+
+// WithRequireVerification blocks data with new or changed peer identities
+// until VerifyPeer accepts them
+func WithRequireVerification() Option {
+	return func(o *options) { o.requireVerification = true }
+}
+
+// WithStableID requests a peer ID derived from the identity key. It is
+// implied once the identity has been enrolled with `lanscape-agent login`.
+func WithStableID() Option {
+	return func(o *options) { o.stableID = true }
+}
+
+// WithConfigFile loads per-topic and per-peer overrides from path
+func WithConfigFile(path string) Option {
+	return func(o *options) { o.configPath = path }
+}
+
+// SimNetwork connects clients in memory, without signaling or WebRTC. Clients
+// created with the same network see each other as peers, which lets tests run
+// multi-peer scenarios deterministically in one process.
+type SimNetwork = internal.SimNetwork
+
+// NewSimNetwork creates an empty simulated network
+func NewSimNetwork() *SimNetwork {
+	return internal.NewSimNetwork(slog.Default())
+}
+
+// WithSimulation connects the client to a simulated network instead of the
+// signaling server. Only application messages are simulated.
+func WithSimulation(n *SimNetwork) Option {
+	return func(o *options) { o.simulation = n }
+}
+
+// WithMessageHandler sets the callback for application messages from peers
+func WithMessageHandler(fn func(peerID string, data []byte)) Option {
+	return func(o *options) { o.onMessage = fn }
+}
+
+// WithPeerConnected sets the callback for when a peer's data channel opens
+func WithPeerConnected(fn func(peerID string)) Option {
+	return func(o *options) { o.onPeerConnected = fn }
+}
+
+// WithPeerDisconnected sets the callback for when a peer disconnects
+func WithPeerDisconnected(fn func(peerID string)) Option {
+	return func(o *options) { o.onPeerDisconnected = fn }
+}
+
+// WithPeerVerification sets the callback for peer identity checks
+func WithPeerVerification(fn func(v PeerVerification)) Option {
+	return func(o *options) { o.onPeerVerification = fn }
+}
+
+// WithErrorHandler sets the callback for asynchronous errors, such as a
+// peer rejecting a message. peerID is empty for errors not tied to a peer.
+func WithErrorHandler(fn func(peerID string, err error)) Option {
+	return func(o *options) { o.onError = fn }
+}
+
+// CloseReason says why the signaling server ended the connection
+type CloseReason = signaling.CloseReason
+
+// RateLimitedError is returned by Connect when the signaling server refused
+// the connection as rate limited; wait RetryAfter before connecting again
+type RateLimitedError = internal.RateLimitedError
+
+// Close reasons reported to WithSignalingClosed. CloseReason.Retryable
+// reports whether reconnecting makes sense.
+const (
+	CloseAuthFailed    = signaling.CloseAuthFailed
+	CloseDraining      = signaling.CloseDraining
+	CloseRateLimited   = signaling.CloseRateLimited
+	CloseProtocolError = signaling.CloseProtocolError
+	CloseSuperseded    = signaling.CloseSuperseded
+
+	CloseMembershipRevoked = signaling.CloseMembershipRevoked
+	CloseDisconnected      = signaling.CloseDisconnected
+)
+
+// WithSignalingClosed sets the callback for when the signaling server ends
+// the connection. The client cannot be used afterwards; reason, empty if the
+// server gave none, says whether to create a new one.
+func WithSignalingClosed(fn func(reason CloseReason, detail string)) Option {
+	return func(o *options) { o.onSignalingClosed = fn }
+}
+
+// Client is an embedded lanscape agent connected to one signaling topic.
+// Callbacks run on connection goroutines and must not block.
+type Client struct {
+	session *internal.BrowserSession
+	bridge  *internal.Bridge
+	opts    options
+
+	welcome chan struct{}
+	once    sync.Once
+	// closed receives the reason if signaling ends before the welcome
+	closed    chan CloseReason
+	closeOnce sync.Once
+}
+
+// New creates a client for topic on the signaling server at signalingURL.
+// Call Connect to join the topic.
+func New(signalingURL, topic string, opts ...Option) (*Client, error) {
+	o := options{logger: slog.Default(), dataDir: internal.DefaultDataDir()}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.name == "" {
+		o.name, _ = os.Hostname()
+	}
+
+	identity, err := internal.LoadOrCreateIdentity(o.dataDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load identity: %w", err)
+	}
+	certificate, err := internal.LoadOrCreateCertificate(o.dataDir)
+	if err != nil {
+		return nil, err
+	}
+	credentials, err := internal.LoadCredentialCache(o.dataDir, identity)
+	if err != nil {
+		return nil, err
+	}
+	enrollment, err := internal.LoadEnrollment(o.dataDir, credentials)
+	if err != nil {
+		return nil, err
+	}
+	if enrollment != nil {
+		o.stableID = true
+	}
+	trustStore, err := internal.LoadTrustStore(o.dataDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load trust store: %w", err)
+	}
+	overrides, err := internal.LoadOverrides(o.configPath, o.logger)
+	if err != nil {
+		return nil, err
+	}
+
+	var tailscaleInfo *internal.TailscaleInfo
+	if o.tailscale {
+		if tailscaleInfo, err = internal.GetTailscaleInfo(); err != nil {
+			o.logger.Warn("failed to get Tailscale info, continuing without interface binding", "error", err)
+		}
+	}
+
+	session, err := internal.NewBrowserSession(internal.SessionConfig{
+		SignalingURL:        signalingURL,
+		Topic:               topic,
+		Name:                o.name,
+		TailscaleInfo:       tailscaleInfo,
+		Identity:            identity,
+		Certificate:         certificate,
+		TrustStore:          trustStore,
+		RequireVerification: o.requireVerification,
+		Supervisor:          internal.NewSupervisor(internal.SupervisorLimits{}, o.logger),
+		Services:            internal.NewServiceRegistry(nil, o.logger),
+		Overrides:           overrides,
+		StableID:            o.stableID,
+		Simulation:          o.simulation,
+	}, o.logger)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Client{
+		session: session,
+		bridge:  session.GetBridge(),
+		opts:    o,
+		welcome: make(chan struct{}),
+		closed:  make(chan CloseReason, 1),
+	}
+	c.bridge.SetBrowserSend(c.deliver)
+	return c, nil
+}
+
+// Connect joins the topic and waits until the signaling server has assigned
+// this client a peer ID. Peers connect in the background afterwards. If the
+// server is rate limiting connections, the error is a *RateLimitedError.
+func (c *Client) Connect(ctx context.Context) error {
+	if err := c.session.Connect(); err != nil {
+		return err
+	}
+	select {
+	case <-c.welcome:
+		return nil
+	case reason := <-c.closed:
+		return fmt.Errorf("signaling server closed the connection: %s", reason)
+	case <-ctx.Done():
+		c.session.Disconnect()
+		return fmt.Errorf("signaling server did not welcome client: %w", ctx.Err())
+	}
+}
+
+// SelfID returns this client's peer ID, empty before Connect returns
+func (c *Client) SelfID() string {
+	return c.session.GetSelfID()
+}
+
+// Peers returns the peers with an open data channel
+func (c *Client) Peers() []string {
+	return c.bridge.GetConnectedPeers()
+}
+
+// BestPeers returns the connected peers ranked by recent round-trip time
+// and loss, best first, limited to peers when given. Peers connected for
+// less than a few seconds have no measurements yet and come last.
+func (c *Client) BestPeers(peers ...string) []protocol.PeerLatency {
+	return c.bridge.BestPeers(peers)
+}
+
+// Send sends an application message to one peer, waiting while the peer's
+// send queue is full until ctx is done
+func (c *Client) Send(ctx context.Context, peerID string, data []byte) error {
+	if peerID == "" {
+		return errors.New("peer ID required")
+	}
+	return c.bridge.HandleBrowserMessage(ctx, protocol.BrowserMessage{Type: protocol.MessageTypeData, PeerID: peerID, Data: data})
+}
+
+// Broadcast sends an application message to every verified peer. Every peer
+// receives broadcasts in the same order. If ctx is done while waiting on a
+// full send queue, peers not yet reached miss the message.
+func (c *Client) Broadcast(ctx context.Context, data []byte) error {
+	return c.bridge.HandleBrowserMessage(ctx, protocol.BrowserMessage{Type: protocol.MessageTypeData, Data: data})
+}
+
+// VerifyPeer answers a pending verification: accept pins the peer's key and
+// unblocks it, reject closes the connection
+func (c *Client) VerifyPeer(peerID string, accept bool) error {
+	return c.bridge.HandleBrowserMessage(context.Background(), protocol.BrowserMessage{Type: protocol.MessageTypeVerifyPeer, PeerID: peerID, Accept: accept})
+}
+
+// Close leaves the topic and closes every peer connection
+func (c *Client) Close() error {
+	c.closeOnce.Do(c.session.Disconnect)
+	return nil
+}
+
+// deliver turns the messages the bridge would send a browser into callbacks
+func (c *Client) deliver(msg protocol.AgentMessage) error {
+	switch msg.Type {
+	case protocol.MessageTypeWelcome:
+		c.once.Do(func() { close(c.welcome) })
+	case protocol.MessageTypeData:
+		if c.opts.onMessage != nil {
+			c.opts.onMessage(msg.PeerID, msg.Data)
+		}
+	case protocol.MessageTypePeerConnected:
+		if c.opts.onPeerConnected != nil {
+			c.opts.onPeerConnected(msg.PeerID)
+		}
+	case protocol.MessageTypePeerDisconnected:
+		if c.opts.onPeerDisconnected != nil {
+			c.opts.onPeerDisconnected(msg.PeerID)
+		}
+	case protocol.MessageTypePeerVerification:
+		if c.opts.onPeerVerification != nil {
+			c.opts.onPeerVerification(PeerVerification{
+				PeerID:      msg.PeerID,
+				Name:        msg.Name,
+				Fingerprint: msg.Fingerprint,
+				Status:      msg.Status,
+				Certificate: msg.Certificate,
+			})
+		}
+	case protocol.MessageTypeError:
+		if c.opts.onError != nil {
+			c.opts.onError(msg.PeerID, errors.New(msg.Error))
+		}
+	case protocol.MessageTypeSignalingClosed:
+		select {
+		case c.closed <- CloseReason(msg.Reason):
+		default:
+		}
+		if c.opts.onSignalingClosed != nil {
+			c.opts.onSignalingClosed(CloseReason(msg.Reason), msg.Error)
+		}
+	}
+	return nil
+}
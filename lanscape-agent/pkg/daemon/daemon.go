@@ -0,0 +1,35 @@
+// Package daemon runs the lanscape-agent daemon, the local WebSocket server
+// browsers connect through, inside another Go program. It is what the
+// lanscape-agent command runs; applications that want peer connectivity
+// without a browser should use pkg/agent instead.
+package daemon
+
+import (
+	internal "github.com/jhead/lanscape/lanscape-agent/internal/agent"
+)
+
+// Config holds the daemon's configuration, as set by the lanscape-agent flags
+type Config = internal.Config
+
+// Agent is a running daemon. Start it, then Stop it to disconnect every
+// browser session.
+type Agent = internal.Agent
+
+// TailscaleInfo describes the Tailscale interface peer connections bind to
+type TailscaleInfo = internal.TailscaleInfo
+
+// New creates a daemon with the given configuration
+func New(config Config) (*Agent, error) {
+	return internal.NewAgent(config)
+}
+
+// DefaultDataDir returns the directory lanscape-agent keeps its identity and
+// state in by default
+func DefaultDataDir() string {
+	return internal.DefaultDataDir()
+}
+
+// GetTailscaleInfo finds the local Tailscale interface
+func GetTailscaleInfo() (*TailscaleInfo, error) {
+	return internal.GetTailscaleInfo()
+}
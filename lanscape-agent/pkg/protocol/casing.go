@@ -0,0 +1,90 @@
+package protocol
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// Casing is the style of JSON field names on the wire. Messages are defined
+// in camelCase; clients in languages that prefer snake_case can ask for it
+// instead of mapping every field themselves.
+type Casing int
+
+const (
+	CasingCamel Casing = iota // peerId (default)
+	CasingSnake               // peer_id
+)
+
+// ParseCasing parses "camel" or "snake"; empty selects CasingCamel
+func ParseCasing(s string) (Casing, error) {
+	switch s {
+	case "", "camel":
+		return CasingCamel, nil
+	case "snake":
+		return CasingSnake, nil
+	}
+	return 0, fmt.Errorf("unknown casing: %s (must be camel or snake)", s)
+}
+
+// String returns the casing's name as ParseCasing accepts it
+func (c Casing) String() string {
+	if c == CasingSnake {
+		return "snake"
+	}
+	return "camel"
+}
+
+// recase renames the keys of every JSON object in data, at any depth
+func recase(data []byte, rename func(string) string) ([]byte, error) {
+	var v any
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+	return json.Marshal(recaseValue(v, rename))
+}
+
+// recaseValue renames the keys of the objects in a decoded JSON value
+func recaseValue(v any, rename func(string) string) any {
+	switch v := v.(type) {
+	case map[string]any:
+		out := make(map[string]any, len(v))
+		for key, value := range v {
+			out[rename(key)] = recaseValue(value, rename)
+		}
+		return out
+	case []any:
+		for i, value := range v {
+			v[i] = recaseValue(value, rename)
+		}
+		return v
+	}
+	return v
+}
+
+// snakeCase converts a camelCase field name to snake_case
+func snakeCase(s string) string {
+	var b strings.Builder
+	for i, r := range s {
+		if unicode.IsUpper(r) {
+			if i > 0 {
+				b.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// camelCase converts a snake_case field name to camelCase
+func camelCase(s string) string {
+	parts := strings.Split(s, "_")
+	for i := 1; i < len(parts); i++ {
+		if parts[i] != "" {
+			parts[i] = strings.ToUpper(parts[i][:1]) + parts[i][1:]
+		}
+	}
+	return strings.Join(parts, "")
+}
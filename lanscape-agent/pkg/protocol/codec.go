@@ -0,0 +1,147 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// binaryHeaderSize is the size of a v2 binary frame's fixed header: the
+// version byte and the length of the JSON header that follows
+const binaryHeaderSize = 5
+
+// Frame is one WebSocket message. Text frames carry JSON. v2 also uses
+// binary frames for messages with data:
+//
+//	byte 0      protocol version (2)
+//	bytes 1-4   length n of the JSON header, big endian
+//	bytes 5-    JSON header: the message without its data (n bytes)
+//	            the data, unencoded
+type Frame struct {
+	Binary bool
+	Data   []byte
+}
+
+// Codec translates between frames and messages for one protocol version and
+// casing. Messages are handled as v2 on both sides: a v1 codec upgrades what
+// it decodes and downgrades what it encodes.
+type Codec struct {
+	version Version
+	casing  Casing
+}
+
+// NewCodec creates a codec for version with the given field casing
+func NewCodec(version Version, casing Casing) (*Codec, error) {
+	if version != Version1 && version != Version2 {
+		return nil, fmt.Errorf("unsupported protocol version: %d", version)
+	}
+	return &Codec{version: version, casing: casing}, nil
+}
+
+// Version returns the protocol version the codec speaks
+func (c *Codec) Version() Version {
+	return c.version
+}
+
+// DecodeBrowser decodes a frame from the browser
+func (c *Codec) DecodeBrowser(f Frame) (BrowserMessageV2, error) {
+	if c.version == Version1 {
+		if f.Binary {
+			return BrowserMessageV2{}, errors.New("binary frames require protocol version 2")
+		}
+		var msg BrowserMessage
+		if err := c.unmarshal(f.Data, &msg); err != nil {
+			return BrowserMessageV2{}, err
+		}
+		return UpgradeBrowser(msg), nil
+	}
+
+	var msg BrowserMessageV2
+	if !f.Binary {
+		if err := c.unmarshal(f.Data, &msg); err != nil {
+			return BrowserMessageV2{}, err
+		}
+		return msg, nil
+	}
+
+	header, data, err := splitBinary(f.Data)
+	if err != nil {
+		return BrowserMessageV2{}, err
+	}
+	if err := c.unmarshal(header, &msg); err != nil {
+		return BrowserMessageV2{}, err
+	}
+	msg.Data = data
+	return msg, nil
+}
+
+// EncodeAgent encodes a message for the browser. ok is false if the message
+// has no v1 equivalent and nothing should be sent.
+func (c *Codec) EncodeAgent(msg AgentMessageV2) (f Frame, ok bool, err error) {
+	if c.version == Version1 {
+		v1, ok := msg.Downgrade()
+		if !ok {
+			return Frame{}, false, nil
+		}
+		data, err := c.marshal(v1)
+		return Frame{Data: data}, err == nil, err
+	}
+
+	msg.V = Version2
+	if msg.Channel == "" {
+		msg.Channel = ChannelOf(msg.Type)
+	}
+	if len(msg.Data) == 0 {
+		data, err := c.marshal(msg)
+		return Frame{Data: data}, err == nil, err
+	}
+
+	payload := msg.Data
+	msg.Data = nil
+	header, err := c.marshal(msg)
+	if err != nil {
+		return Frame{}, false, err
+	}
+	frame := make([]byte, binaryHeaderSize, binaryHeaderSize+len(header)+len(payload))
+	frame[0] = byte(Version2)
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(header)))
+	frame = append(append(frame, header...), payload...)
+	return Frame{Binary: true, Data: frame}, true, nil
+}
+
+// splitBinary returns the JSON header and data of a v2 binary frame
+func splitBinary(frame []byte) (header, data []byte, err error) {
+	if len(frame) < binaryHeaderSize {
+		return nil, nil, errors.New("binary frame too short")
+	}
+	if Version(frame[0]) != Version2 {
+		return nil, nil, fmt.Errorf("unsupported binary frame version: %d", frame[0])
+	}
+	n := binary.BigEndian.Uint32(frame[1:binaryHeaderSize])
+	if uint64(n) > uint64(len(frame)-binaryHeaderSize) {
+		return nil, nil, errors.New("binary frame header exceeds frame")
+	}
+	end := binaryHeaderSize + int(n)
+	return frame[binaryHeaderSize:end], frame[end:], nil
+}
+
+// marshal encodes v as JSON in the codec's casing
+func (c *Codec) marshal(v any) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil || c.casing == CasingCamel {
+		return data, err
+	}
+	return recase(data, snakeCase)
+}
+
+// unmarshal decodes JSON in the codec's casing into v
+func (c *Codec) unmarshal(data []byte, v any) error {
+	if c.casing == CasingSnake {
+		var err error
+		if data, err = recase(data, camelCase); err != nil {
+			return err
+		}
+	}
+	return json.Unmarshal(data, v)
+}
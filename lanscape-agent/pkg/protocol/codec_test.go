@@ -0,0 +1,276 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden frames in testdata")
+
+// codecs are every version and casing a browser can negotiate, named like
+// their directory under testdata/golden
+var codecs = []struct {
+	name    string
+	version Version
+	casing  Casing
+}{
+	{"v1-camel", Version1, CasingCamel},
+	{"v1-snake", Version1, CasingSnake},
+	{"v2-camel", Version2, CasingCamel},
+	{"v2-snake", Version2, CasingSnake},
+}
+
+var agentMessages = []struct {
+	name string
+	msg  AgentMessageV2
+}{
+	{"data", UpgradeAgent(AgentMessage{Type: MessageTypeData, PeerID: "peer-1", Data: []byte("hello"), MessageID: "msg-1"})},
+	{"forwards", UpgradeAgent(AgentMessage{Type: MessageTypeForwards, Forwards: []Forward{
+		{ID: "fwd-1", PeerID: "peer-1", Protocol: "tcp", Listen: "127.0.0.1:8080", Target: "127.0.0.1:3000"},
+	}})},
+	{"ack", Ack("req-1", nil)},
+	{"ack-error", Ack("req-2", errors.New("peer not found: peer-2"))},
+}
+
+var browserMessages = []struct {
+	name string
+	msg  BrowserMessageV2
+}{
+	{"data", BrowserMessageV2{V: Version2, ID: "req-1", BrowserMessage: BrowserMessage{Type: MessageTypeData, PeerID: "peer-1", Data: []byte("hello")}}},
+	{"forward", BrowserMessageV2{V: Version2, ID: "req-2", Channel: ChannelForward, BrowserMessage: BrowserMessage{Type: MessageTypeForward, Forward: &Forward{
+		PeerID: "peer-1", Protocol: "udp", Listen: "127.0.0.1:5353", Target: "53",
+	}}}},
+	{"store", BrowserMessageV2{V: Version2, BrowserMessage: BrowserMessage{Type: MessageTypeStore, Fingerprint: "SHA256:abc", MessageID: "msg-1", Data: []byte{0, 1, 2}}}},
+}
+
+// golden compares frame with the golden file at path, or rewrites the file
+// with -update. A frame that should not be sent has no golden file.
+func golden(t *testing.T, path string, f Frame, ok bool) {
+	t.Helper()
+
+	text, bin := path+".json", path+".bin"
+	if *update {
+		os.Remove(text)
+		os.Remove(bin)
+		if !ok {
+			return
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		name := text
+		if f.Binary {
+			name = bin
+		}
+		if err := os.WriteFile(name, f.Data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	want, textErr := os.ReadFile(text)
+	wantBin, binErr := os.ReadFile(bin)
+	switch {
+	case !ok:
+		if textErr == nil || binErr == nil {
+			t.Fatalf("%s: frame not sent, but a golden file exists", path)
+		}
+	case f.Binary:
+		if binErr != nil {
+			t.Fatalf("%s: got a binary frame: %v", path, binErr)
+		}
+		if !bytes.Equal(f.Data, wantBin) {
+			t.Fatalf("%s: got frame\n%q\nwant\n%q", bin, f.Data, wantBin)
+		}
+	default:
+		if textErr != nil {
+			t.Fatalf("%s: got a text frame: %v", path, textErr)
+		}
+		if !bytes.Equal(f.Data, want) {
+			t.Fatalf("%s: got frame\n%s\nwant\n%s", text, f.Data, want)
+		}
+	}
+}
+
+// readGolden reads the golden frame at path, text or binary
+func readGolden(t *testing.T, path string) Frame {
+	t.Helper()
+	if data, err := os.ReadFile(path + ".json"); err == nil {
+		return Frame{Data: data}
+	}
+	data, err := os.ReadFile(path + ".bin")
+	if err != nil {
+		t.Fatalf("no golden frame for %s: %v", path, err)
+	}
+	return Frame{Binary: true, Data: data}
+}
+
+// encodeBrowser encodes a message the way a browser speaking c's version
+// and casing would
+func encodeBrowser(c *Codec, msg BrowserMessageV2) (Frame, error) {
+	if c.version == Version1 {
+		data, err := c.marshal(msg.BrowserMessage)
+		return Frame{Data: data}, err
+	}
+	if len(msg.Data) == 0 {
+		data, err := c.marshal(msg)
+		return Frame{Data: data}, err
+	}
+
+	payload := msg.Data
+	msg.Data = nil
+	header, err := c.marshal(msg)
+	if err != nil {
+		return Frame{}, err
+	}
+	frame := make([]byte, binaryHeaderSize)
+	frame[0] = byte(Version2)
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(header)))
+	return Frame{Binary: true, Data: append(append(frame, header...), payload...)}, nil
+}
+
+// decodeAgent decodes an agent frame the way a browser speaking c's
+// version and casing would
+func decodeAgent(c *Codec, f Frame) (AgentMessageV2, error) {
+	if c.version == Version1 {
+		var msg AgentMessage
+		err := c.unmarshal(f.Data, &msg)
+		return UpgradeAgent(msg), err
+	}
+
+	var msg AgentMessageV2
+	if !f.Binary {
+		err := c.unmarshal(f.Data, &msg)
+		return msg, err
+	}
+	header, data, err := splitBinary(f.Data)
+	if err != nil {
+		return msg, err
+	}
+	err = c.unmarshal(header, &msg)
+	msg.Data = data
+	return msg, err
+}
+
+func TestAgentFrames(t *testing.T) {
+	for _, cc := range codecs {
+		c, err := NewCodec(cc.version, cc.casing)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, tc := range agentMessages {
+			t.Run(cc.name+"/"+tc.name, func(t *testing.T) {
+				f, ok, err := c.EncodeAgent(tc.msg)
+				if err != nil {
+					t.Fatalf("EncodeAgent: %v", err)
+				}
+				golden(t, filepath.Join("testdata", "golden", cc.name, "agent-"+tc.name), f, ok)
+				if !ok {
+					return
+				}
+
+				want := tc.msg
+				if cc.version == Version1 {
+					v1, _ := tc.msg.Downgrade()
+					want = UpgradeAgent(v1)
+				}
+				got, err := decodeAgent(c, f)
+				if err != nil {
+					t.Fatalf("decoding frame: %v", err)
+				}
+				if !reflect.DeepEqual(got, want) {
+					t.Fatalf("round trip got %+v, want %+v", got, want)
+				}
+			})
+		}
+	}
+}
+
+func TestBrowserFrames(t *testing.T) {
+	for _, cc := range codecs {
+		c, err := NewCodec(cc.version, cc.casing)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, tc := range browserMessages {
+			t.Run(cc.name+"/"+tc.name, func(t *testing.T) {
+				path := filepath.Join("testdata", "golden", cc.name, "browser-"+tc.name)
+				f, err := encodeBrowser(c, tc.msg)
+				if err != nil {
+					t.Fatalf("encoding frame: %v", err)
+				}
+				golden(t, path, f, true)
+
+				want := tc.msg
+				if cc.version == Version1 {
+					want = UpgradeBrowser(tc.msg.BrowserMessage)
+				}
+				got, err := c.DecodeBrowser(readGolden(t, path))
+				if err != nil {
+					t.Fatalf("DecodeBrowser: %v", err)
+				}
+				if !reflect.DeepEqual(got, want) {
+					t.Fatalf("decoded %+v, want %+v", got, want)
+				}
+				if _, err := got.Downgrade(); err != nil {
+					t.Fatalf("Downgrade: %v", err)
+				}
+			})
+		}
+	}
+}
+
+func TestDecodeBrowserRejectsBadFrames(t *testing.T) {
+	v1, _ := NewCodec(Version1, CasingCamel)
+	v2, _ := NewCodec(Version2, CasingCamel)
+
+	tests := []struct {
+		name  string
+		codec *Codec
+		frame Frame
+	}{
+		{"v1 binary", v1, Frame{Binary: true, Data: []byte{2, 0, 0, 0, 2, '{', '}'}}},
+		{"short", v2, Frame{Binary: true, Data: []byte{2, 0, 0}}},
+		{"wrong version", v2, Frame{Binary: true, Data: []byte{1, 0, 0, 0, 2, '{', '}'}}},
+		{"header past end", v2, Frame{Binary: true, Data: []byte{2, 0, 0, 0, 9, '{', '}'}}},
+		{"bad json", v2, Frame{Data: []byte(`{"type":`)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if msg, err := tt.codec.DecodeBrowser(tt.frame); err == nil {
+				t.Fatalf("decoded %+v, want an error", msg)
+			}
+		})
+	}
+}
+
+func TestNewCodecRejectsUnknownVersion(t *testing.T) {
+	for _, v := range []Version{0, 3} {
+		if _, err := NewCodec(v, CasingCamel); err == nil {
+			t.Errorf("NewCodec(%d) succeeded", v)
+		}
+	}
+}
+
+func TestCasing(t *testing.T) {
+	tests := []struct{ camel, snake string }{
+		{"type", "type"},
+		{"peerId", "peer_id"},
+		{"messageId", "message_id"},
+		{"maxPeers", "max_peers"},
+	}
+	for _, tt := range tests {
+		if got := snakeCase(tt.camel); got != tt.snake {
+			t.Errorf("snakeCase(%q) = %q, want %q", tt.camel, got, tt.snake)
+		}
+		if got := camelCase(tt.snake); got != tt.camel {
+			t.Errorf("camelCase(%q) = %q, want %q", tt.snake, got, tt.camel)
+		}
+	}
+}
@@ -7,13 +7,104 @@ const (
 	MessageTypePeerDisconnected = "peer-disconnected"
 	MessageTypeError            = "error"
 	MessageTypeWelcome          = "welcome"
+	MessageTypePeerVerification = "peer-verification"
+	MessageTypeVerifyPeer       = "verify-peer"
+	MessageTypeCapabilities     = "capabilities"
+	MessageTypeSetGroup         = "set-group"
+	MessageTypeSent             = "sent"
+	MessageTypeTrackAdded       = "track-added"
+	MessageTypeTrackRemoved     = "track-removed"
+	MessageTypeForward          = "forward"
+	MessageTypeUnforward        = "unforward"
+	MessageTypeListForwards     = "list-forwards"
+	MessageTypeForwards         = "forwards"
+	MessageTypeListServices     = "list-services"
+	MessageTypeServices         = "services"
+	MessageTypeDrop             = "drop"
+	MessageTypeDropped          = "dropped"
+	MessageTypeDropStatus       = "drop-status"
+	MessageTypeReload           = "reload"
+	MessageTypeReloaded         = "reloaded"
+	MessageTypeBlockPeer        = "block-peer"
+	MessageTypeUnblockPeer      = "unblock-peer"
+	MessageTypePeerBlocked      = "peer-blocked"
+	MessageTypePeerUnblocked    = "peer-unblocked"
+	MessageTypeStore            = "store"
+	MessageTypeStored           = "stored"
+	MessageTypeDelivered        = "delivered"
+	MessageTypeBestPeer         = "best-peer"
+	MessageTypeSignalingClosed  = "signaling-closed"
+	MessageTypeMeshDegraded     = "mesh-degraded"
+	MessageTypeHeartbeat        = "heartbeat"
+	MessageTypeSealed           = "sealed"
+	MessageTypePeerRelayed      = "peer-relayed"
+)
+
+// Drop delivery statuses reported in drop-status messages
+const (
+	DropStatusDelivered = "delivered"
+	DropStatusFailed    = "failed"
 )
 
 // BrowserMessage represents a message from browser to agent
 type BrowserMessage struct {
 	Type   string `json:"type"`
 	PeerID string `json:"peerId,omitempty"`
-	Data   []byte `json:"data,omitempty"` // Base64-encoded in JSON, decoded in client
+	Data   []byte `json:"data,omitempty"`   // Base64-encoded in JSON, decoded in client
+	Accept bool   `json:"accept,omitempty"` // verify-peer: true pins the key, false rejects the peer
+	Close  bool   `json:"close,omitempty"`  // block-peer: also close the connection and refuse new ones
+
+	// Group names a peer group: the target of data, the group defined by
+	// set-group, or the candidates for best-peer
+	Group string   `json:"group,omitempty"`
+	Peers []string `json:"peers,omitempty"` // set-group: members, empty deletes the group; best-peer: candidates
+
+	// Forward describes a port forward to start; unforward uses only its ID
+	Forward *Forward `json:"forward,omitempty"`
+
+	// Drop is a small payload to deliver to peerId, peers, or every peer
+	Drop *Drop `json:"drop,omitempty"`
+
+	// store: the key fingerprint of the known peer to queue data for, and an
+	// optional message ID (generated if empty) used to drop redeliveries
+	Fingerprint string `json:"fingerprint,omitempty"`
+	MessageID   string `json:"messageId,omitempty"`
+}
+
+// Drop is a small payload (clipboard text, link, or file) sent between agents
+type Drop struct {
+	ID   string `json:"id,omitempty"`
+	Kind string `json:"kind"` // "text", "link", or "file"
+	Name string `json:"name,omitempty"`
+	MIME string `json:"mime,omitempty"`
+	Size int    `json:"size,omitempty"`
+	Data []byte `json:"data,omitempty"` // Base64-encoded in JSON, at most 1MB
+}
+
+// Forward is a local port forwarded to a target on a peer
+type Forward struct {
+	ID       string `json:"id,omitempty"`
+	PeerID   string `json:"peerId"`
+	Protocol string `json:"protocol,omitempty"` // "tcp" (default) or "udp"
+	Listen   string `json:"listen,omitempty"`   // local address, default 127.0.0.1 on a free port
+	Target   string `json:"target,omitempty"`   // "port" or "host:port" as seen by the peer
+	Service  string `json:"service,omitempty"`  // name of a service the peer advertises, instead of target
+}
+
+// Service is a named local service an agent advertises to peers
+type Service struct {
+	Name     string `json:"name"`
+	Protocol string `json:"protocol"`       // "tcp" or "udp"
+	Port     int    `json:"port"`           // port on the advertising agent's localhost
+	Type     string `json:"type,omitempty"` // DNS-SD type such as "_http._tcp", if known
+	Source   string `json:"source,omitempty"`
+}
+
+// PeerServices lists the services advertised by one peer
+type PeerServices struct {
+	PeerID   string    `json:"peerId"`
+	Name     string    `json:"name,omitempty"`
+	Services []Service `json:"services"`
 }
 
 // AgentMessage represents a message from agent to browser
@@ -23,4 +114,73 @@ type AgentMessage struct {
 	SelfID string `json:"selfId,omitempty"`
 	Data   []byte `json:"data,omitempty"` // Base64-encoded in JSON, decoded in client
 	Error  string `json:"error,omitempty"`
+
+	// peer-verification fields
+	Fingerprint string `json:"fingerprint,omitempty"`
+	Name        string `json:"name,omitempty"`
+	Status      string `json:"status,omitempty"`
+	Certificate string `json:"certificate,omitempty"` // DTLS certificate fingerprint, when it changed
+
+	// stored/delivered, and data delivered from a peer's outbox: the stored message ID
+	MessageID string `json:"messageId,omitempty"`
+
+	// sent fields: the broadcast sequence number and target group, if any
+	Seq   uint64 `json:"seq,omitempty"`
+	Group string `json:"group,omitempty"`
+
+	// track-added/track-removed fields
+	TrackID string `json:"trackId,omitempty"`
+	Kind    string `json:"kind,omitempty"`
+
+	// forwards: the active local port forwards
+	Forwards []Forward `json:"forwards,omitempty"`
+
+	// dropped/drop-status: the drop received or sent (without data for drop-status)
+	Drop *Drop `json:"drop,omitempty"`
+
+	// services: the services advertised by each peer
+	Services []PeerServices `json:"services,omitempty"`
+
+	// signaling-closed: why the signaling server ended the connection (a
+	// close reason such as "draining", empty if unknown), whether to
+	// reconnect, and any detail in Error
+	Reason    string `json:"reason,omitempty"`
+	Retryable bool   `json:"retryable,omitempty"`
+
+	// capabilities and unsupported-type error fields
+	Capabilities []string `json:"capabilities,omitempty"`
+
+	// best-peer: candidate peers ranked by measured latency, best first
+	Ranking []PeerLatency `json:"ranking,omitempty"`
+
+	// mesh-degraded: the topic peer cap and the peers left unconnected
+	// because of it, omitted once every peer has a connection
+	MaxPeers int      `json:"maxPeers,omitempty"`
+	Degraded []string `json:"degraded,omitempty"`
+
+	// heartbeat: the agent's health, sent periodically
+	Health *AgentHealth `json:"health,omitempty"`
+
+	// data: the peer sent it encrypted with the network's topic key, or
+	// through the signaling server because WebRTC could not connect
+	Sealed  bool `json:"sealed,omitempty"`
+	Relayed bool `json:"relayed,omitempty"`
+}
+
+// AgentHealth is the agent's state reported in heartbeats. A browser that
+// misses heartbeats for a few intervals can treat the agent as down, and one
+// reporting no peers as up but alone.
+type AgentHealth struct {
+	SignalingConnected bool  `json:"signalingConnected"`
+	Peers              int   `json:"peers"` // peers with an open data channel
+	TailscaleUp        bool  `json:"tailscaleUp"`
+	IntervalMs         int64 `json:"intervalMs"` // until the next heartbeat
+}
+
+// PeerLatency is a peer's recent round-trip time and probe loss
+type PeerLatency struct {
+	PeerID  string  `json:"peerId"`
+	RTTMs   float64 `json:"rttMs"`
+	Loss    float64 `json:"loss"`    // fraction of recent probes lost, 0 to 1
+	Samples int     `json:"samples"` // probes measured; 0 means not measured yet
 }
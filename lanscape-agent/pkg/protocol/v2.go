@@ -0,0 +1,117 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+)
+
+// MessageTypeAck acknowledges a v2 browser message that carried an ID
+const MessageTypeAck = "ack"
+
+// Channels label v2 messages with the subsystem they belong to, so clients
+// can route frames without knowing every message type
+const (
+	ChannelControl = "control"
+	ChannelData    = "data"
+	ChannelMedia   = "media"
+	ChannelForward = "forward"
+	ChannelDrop    = "drop"
+)
+
+// channels maps message types to their channel; unlisted types are control
+var channels = map[string]string{
+	MessageTypeData:         ChannelData,
+	MessageTypeSent:         ChannelData,
+	MessageTypeStore:        ChannelData,
+	MessageTypeStored:       ChannelData,
+	MessageTypeDelivered:    ChannelData,
+	MessageTypeTrackAdded:   ChannelMedia,
+	MessageTypeTrackRemoved: ChannelMedia,
+	MessageTypeForward:      ChannelForward,
+	MessageTypeUnforward:    ChannelForward,
+	MessageTypeListForwards: ChannelForward,
+	MessageTypeForwards:     ChannelForward,
+	MessageTypeListServices: ChannelForward,
+	MessageTypeServices:     ChannelForward,
+	MessageTypeDrop:         ChannelDrop,
+	MessageTypeDropped:      ChannelDrop,
+	MessageTypeDropStatus:   ChannelDrop,
+}
+
+// ChannelOf returns the channel a message type belongs to
+func ChannelOf(msgType string) string {
+	if channel, ok := channels[msgType]; ok {
+		return channel
+	}
+	return ChannelControl
+}
+
+// BrowserMessageV2 is a v2 message from browser to agent: the v1 fields plus
+// an optional ID, which the agent answers with an ack once the message is
+// handled, and the message's channel
+type BrowserMessageV2 struct {
+	V       Version `json:"v"`
+	ID      string  `json:"id,omitempty"`
+	Channel string  `json:"channel,omitempty"` // optional; checked against the type if set
+	BrowserMessage
+}
+
+// AgentMessageV2 is a v2 message from agent to browser: the v1 fields plus
+// the message's channel and, on an ack, the ID of the acknowledged message.
+// An ack that reports a failure sets Error.
+type AgentMessageV2 struct {
+	V       Version `json:"v"`
+	ID      string  `json:"id,omitempty"`
+	Channel string  `json:"channel"`
+	AgentMessage
+}
+
+// UpgradeBrowser converts a v1 browser message to v2. It has no ID, so it is
+// not acknowledged.
+func UpgradeBrowser(msg BrowserMessage) BrowserMessageV2 {
+	return BrowserMessageV2{V: Version2, Channel: ChannelOf(msg.Type), BrowserMessage: msg}
+}
+
+// Downgrade converts a v2 browser message to the v1 message the agent
+// handles. It fails if the version or channel does not match the message.
+func (m BrowserMessageV2) Downgrade() (BrowserMessage, error) {
+	if m.V != Version2 {
+		return BrowserMessage{}, fmt.Errorf("expected protocol version %d, got %d", Version2, m.V)
+	}
+	if m.Type == "" {
+		return BrowserMessage{}, errors.New("message type required")
+	}
+	if m.Channel != "" && m.Channel != ChannelOf(m.Type) {
+		return BrowserMessage{}, fmt.Errorf("%s messages belong to the %s channel, not %s", m.Type, ChannelOf(m.Type), m.Channel)
+	}
+	return m.BrowserMessage, nil
+}
+
+// UpgradeAgent converts a v1 agent message to v2
+func UpgradeAgent(msg AgentMessage) AgentMessageV2 {
+	return AgentMessageV2{V: Version2, Channel: ChannelOf(msg.Type), AgentMessage: msg}
+}
+
+// Downgrade converts a v2 agent message for a v1 browser. v1 has no acks: a
+// failed ack becomes an error message and a successful one is dropped, in
+// which case ok is false.
+func (m AgentMessageV2) Downgrade() (msg AgentMessage, ok bool) {
+	if m.Type != MessageTypeAck {
+		return m.AgentMessage, true
+	}
+	if m.Error == "" {
+		return AgentMessage{}, false
+	}
+	return AgentMessage{Type: MessageTypeError, Error: m.Error}, true
+}
+
+// Ack acknowledges the v2 browser message with the given ID, reporting err
+// if handling it failed
+func Ack(id string, err error) AgentMessageV2 {
+	ack := UpgradeAgent(AgentMessage{Type: MessageTypeAck})
+	ack.ID = id
+	if err != nil {
+		ack.Error = err.Error()
+	}
+	return ack
+}
@@ -0,0 +1,100 @@
+package protocol
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestParseSubprotocol(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    Version
+		wantErr bool
+	}{
+		{"", Version1, false},
+		{"lanscape.v1", Version1, false},
+		{"lanscape.v2", Version2, false},
+		{"lanscape.v3", 0, true},
+		{"lanscape.token.abc", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseSubprotocol(tt.name)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParseSubprotocol(%q) = %d, %v; want %d, error %v", tt.name, got, err, tt.want, tt.wantErr)
+		}
+	}
+
+	// Every advertised subprotocol parses back to its version, newest first
+	for i, name := range Subprotocols {
+		v, err := ParseSubprotocol(name)
+		if err != nil || v.Subprotocol() != name {
+			t.Errorf("Subprotocols[%d] = %q parses to %d, %v", i, name, v, err)
+		}
+		if i > 0 {
+			if prev, _ := ParseSubprotocol(Subprotocols[i-1]); prev <= v {
+				t.Errorf("Subprotocols not newest first: %v", Subprotocols)
+			}
+		}
+	}
+}
+
+func TestUpgradeAgent(t *testing.T) {
+	tests := []struct {
+		msg     AgentMessage
+		channel string
+	}{
+		{AgentMessage{Type: MessageTypeData, PeerID: "peer-1", Data: []byte("hi")}, ChannelData},
+		{AgentMessage{Type: MessageTypeTrackAdded, TrackID: "track-1"}, ChannelMedia},
+		{AgentMessage{Type: MessageTypeForwards}, ChannelForward},
+		{AgentMessage{Type: MessageTypeDropped}, ChannelDrop},
+		{AgentMessage{Type: MessageTypeError, Error: "boom"}, ChannelControl},
+	}
+	for _, tt := range tests {
+		v2 := UpgradeAgent(tt.msg)
+		if v2.V != Version2 || v2.Channel != tt.channel {
+			t.Errorf("UpgradeAgent(%s) = v%d on %q, want v2 on %q", tt.msg.Type, v2.V, v2.Channel, tt.channel)
+		}
+		v1, ok := v2.Downgrade()
+		if !ok || !reflect.DeepEqual(v1, tt.msg) {
+			t.Errorf("Downgrade(UpgradeAgent(%s)) = %+v, %v; want the original", tt.msg.Type, v1, ok)
+		}
+	}
+}
+
+func TestAckDowngrade(t *testing.T) {
+	if msg, ok := Ack("req-1", nil).Downgrade(); ok {
+		t.Errorf("successful ack downgraded to %+v, want nothing sent", msg)
+	}
+
+	msg, ok := Ack("req-2", errors.New("boom")).Downgrade()
+	want := AgentMessage{Type: MessageTypeError, Error: "boom"}
+	if !ok || !reflect.DeepEqual(msg, want) {
+		t.Errorf("failed ack downgraded to %+v, %v; want %+v", msg, ok, want)
+	}
+}
+
+func TestBrowserDowngrade(t *testing.T) {
+	data := BrowserMessage{Type: MessageTypeData, PeerID: "peer-1"}
+	tests := []struct {
+		name    string
+		msg     BrowserMessageV2
+		wantErr bool
+	}{
+		{"upgraded", UpgradeBrowser(data), false},
+		{"no channel", BrowserMessageV2{V: Version2, BrowserMessage: data}, false},
+		{"wrong version", BrowserMessageV2{V: Version1, BrowserMessage: data}, true},
+		{"no type", BrowserMessageV2{V: Version2}, true},
+		{"wrong channel", BrowserMessageV2{V: Version2, Channel: ChannelMedia, BrowserMessage: data}, true},
+	}
+	for _, tt := range tests {
+		got, err := tt.msg.Downgrade()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: Downgrade error %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if err == nil && !reflect.DeepEqual(got, data) {
+			t.Errorf("%s: Downgrade = %+v, want %+v", tt.name, got, data)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package protocol
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Version is a browser protocol schema version. A browser picks one with the
+// WebSocket subprotocol it requests; connections without a subprotocol speak
+// Version1, so existing clients keep working while they migrate.
+type Version int
+
+const (
+	// Version1 is the original schema: BrowserMessage and AgentMessage as
+	// JSON text frames, with data base64-encoded
+	Version1 Version = 1
+	// Version2 wraps the v1 fields with a message ID the agent acknowledges
+	// and a channel label, and carries data in binary frames
+	Version2 Version = 2
+)
+
+// subprotocolPrefix starts every protocol version's subprotocol name
+const subprotocolPrefix = "lanscape.v"
+
+// Subprotocols lists the WebSocket subprotocols the agent accepts, newest
+// first
+var Subprotocols = []string{Version2.Subprotocol(), Version1.Subprotocol()}
+
+// Subprotocol returns the WebSocket subprotocol that selects v
+func (v Version) Subprotocol() string {
+	return fmt.Sprintf("%s%d", subprotocolPrefix, v)
+}
+
+// ParseSubprotocol returns the version a negotiated subprotocol selects. An
+// empty name selects Version1.
+func ParseSubprotocol(name string) (Version, error) {
+	switch name {
+	case "", Version1.Subprotocol():
+		return Version1, nil
+	case Version2.Subprotocol():
+		return Version2, nil
+	}
+	if strings.HasPrefix(name, subprotocolPrefix) {
+		return 0, fmt.Errorf("unsupported protocol version: %s", name)
+	}
+	return 0, fmt.Errorf("unknown subprotocol: %s", name)
+}
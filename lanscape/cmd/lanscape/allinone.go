@@ -0,0 +1,381 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/jhead/lanscape/lanscape-agent/pkg/daemon"
+	"github.com/jhead/lanscape/lanscaped/pkg/lanscaped"
+	"github.com/jhead/lanscape/signaling/pkg/service"
+	"github.com/jhead/lanscape/signaling/pkg/signaling"
+	"github.com/jhead/lanscape/signaling/pkg/turnrelay"
+)
+
+// runAllInOne implements `lanscape all-in-one`: lanscaped, the signaling
+// server, and optionally a local agent, wired to each other
+func runAllInOne(args []string) {
+	fs := flag.NewFlagSet("all-in-one", flag.ExitOnError)
+	apiPort := fs.Int("api-port", 8080, "lanscaped API port")
+	signalingPort := fs.Int("signaling-port", 8081, "Signaling server port")
+	revocationRefresh := fs.Duration("revocation-refresh", time.Minute, "How often signaling re-reads lanscaped's revoked agent keys")
+	presenceGrace := fs.Duration("presence-grace", 15*time.Second, "How long an agent must stay disconnected before lanscaped shows it offline")
+	relayRate := fs.Float64("relay-rate", 20, "Relays per second each signaling peer may send on average (0 disables the limit)")
+	relayBurst := fs.Int("relay-burst", 100, "Relays each signaling peer may send in a burst")
+	relayIPRate := fs.Float64("relay-ip-rate", 100, "Relays per second all signaling peers from one client IP may send on average (0 disables the limit)")
+	relayIPBurst := fs.Int("relay-ip-burst", 500, "Relays all signaling peers from one client IP may send in a burst")
+	httpRate := fs.Float64("http-rate", 10, "HTTP requests per second, WebSocket handshakes included, each client IP may make to signaling on average (0 disables the limit)")
+	httpBurst := fs.Int("http-burst", 50, "HTTP requests each client IP may make to signaling in a burst")
+	allowedOrigins := fs.String("allowed-origins", "", "Comma-separated browser origins allowed to connect to signaling, e.g. chat.example.com (default: any)")
+	turnURLs := fs.String("turn-urls", "", "Comma-separated TURN server URLs to vend credentials for, e.g. turn:turn.example.com:3478")
+	turnSecret := fs.String("turn-secret", "", "Secret shared with the TURN servers (coturn's static-auth-secret; default: random when only -turn-listen is set)")
+	turnSecretFile := fs.String("turn-secret-file", "", "File holding the TURN secret, instead of -turn-secret, keeping it out of process listings")
+	turnListen := fs.String("turn-listen", "", "Address to run an embedded TURN server on, e.g. :3478 (default: none)")
+	turnPublicIP := fs.String("turn-public-ip", "", "Public IP clients reach the embedded TURN server at; required with -turn-listen")
+	turnRelayPorts := fs.String("turn-relay-ports", "", "Port range the embedded TURN server relays on, e.g. 49152-65535 (default: any)")
+	turnRelayPrivate := fs.Bool("turn-relay-private", false, "Let the embedded TURN server relay to private addresses")
+	turnTTL := fs.Duration("turn-ttl", signaling.DefaultTURNTTL, "How long vended TURN credentials are valid")
+	webhookURLs := fs.String("webhook-urls", "", "Comma-separated URLs signaling posts topic-created, topic-empty, peer-joined, and peer-left events to (default: none)")
+	webhookSecretFile := fs.String("webhook-secret-file", "", "File holding the secret webhook deliveries are signed with; required with -webhook-urls")
+	relayHold := fs.Duration("relay-hold", 0, "How long signaling relays to a peer that just disconnected are held for it to reconnect (0 disables holding)")
+	drainGrace := fs.Duration("drain-grace", 0, "How long signaling peers get to move to another server on shutdown before their connections are closed (0 closes them right away)")
+	resumeGrace := fs.Duration("resume-grace", signaling.DefaultResumeGrace, "How long a signaling peer whose connection dropped can resume its peer ID (0 disables resumption)")
+	runAgent := fs.Bool("agent", false, "Also run a local agent connected to the embedded signaling server")
+	wsAddr := fs.String("ws-addr", "localhost:8082", "Agent WebSocket server address")
+	topic := fs.String("topic", "", "Agent signaling topic (default: the -attestation-network topic, or lanscape-chat)")
+	dataDir := fs.String("data-dir", daemon.DefaultDataDir(), "Directory for persistent agent state (identity key)")
+	name := fs.String("name", "", "Name the agent advertises to peers (default: hostname)")
+	network := fs.String("attestation-network", "", "lanscaped network the agent's peers must be members of, checked against this lanscaped's keys")
+	shutdownTimeout := fs.Duration("shutdown-timeout", 10*time.Second, "Time allowed for graceful shutdown of all components")
+	logLevel := fs.String("log-level", "info", "Log level (debug, info, warn, error)")
+	fs.Parse(args)
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(*logLevel)); err != nil {
+		level = slog.LevelInfo
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+		Level: level,
+	}))
+	// lanscaped logs through the standard log package, which writes to the
+	// default slog logger once it is set
+	slog.SetDefault(logger.With("component", "lanscaped"))
+
+	// Bind both ports before starting anything, so a port in use fails fast
+	apiListener, err := net.Listen("tcp", fmt.Sprintf(":%d", *apiPort))
+	if err != nil {
+		logger.Error("failed to listen for lanscaped", "error", err)
+		os.Exit(1)
+	}
+	signalingListener, err := net.Listen("tcp", fmt.Sprintf(":%d", *signalingPort))
+	if err != nil {
+		logger.Error("failed to listen for signaling", "error", err)
+		os.Exit(1)
+	}
+	apiURL := fmt.Sprintf("http://localhost:%d", apiListener.Addr().(*net.TCPAddr).Port)
+	signalingURL := fmt.Sprintf("ws://localhost:%d", signalingListener.Addr().(*net.TCPAddr).Port)
+	revocationURL := apiURL + "/v1/agents/revoked"
+
+	api, err := lanscaped.NewServer(*apiPort)
+	if err != nil {
+		logger.Error("failed to create lanscaped server", "error", err)
+		os.Exit(1)
+	}
+
+	signalingLogger := logger.With("component", "signaling")
+	signalingServer := signaling.NewServer(signalingLogger)
+	revocations := signaling.NewRevocationList(revocationURL, signalingLogger)
+	signalingServer.SetRevocations(revocations)
+	acls := signaling.NewACLTable()
+	acls.SetAuthorizer(signaling.AuthorizerMembers, signaling.NewMemberAuthorizer(apiURL+"/.well-known/lanscape.jwks.json", signalingLogger))
+	signalingServer.SetACLs(acls)
+	api.SetSignalingAdmin(embeddedSignaling{signalingServer, acls})
+	// Signaling reports presence to lanscaped over HTTP, with a token only
+	// this process knows
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		logger.Error("failed to generate presence token", "error", err)
+		os.Exit(1)
+	}
+	presenceToken := hex.EncodeToString(secret)
+	api.SetPresenceToken(presenceToken)
+	presence := signaling.NewPresenceReporter(apiURL+"/v1/presence", presenceToken, *presenceGrace, signalingLogger)
+	signalingServer.SetPresence(presence)
+	signalingServer.SetResumeGrace(*resumeGrace)
+	signalingServer.SetRelayHold(*relayHold)
+	signalingServer.SetDrainGrace(*drainGrace)
+	urls, err := signaling.ParseWebhookURLs(*webhookURLs)
+	if err != nil {
+		logger.Error("invalid -webhook-urls", "error", err)
+		os.Exit(1)
+	}
+	var webhooks *signaling.Webhooks
+	if len(urls) > 0 {
+		if *webhookSecretFile == "" {
+			logger.Error("-webhook-secret-file is required with -webhook-urls")
+			os.Exit(1)
+		}
+		secret, err := os.ReadFile(*webhookSecretFile)
+		if err != nil {
+			logger.Error("failed to read -webhook-secret-file", "error", err)
+			os.Exit(1)
+		}
+		webhooks = signaling.NewWebhooks(urls, strings.TrimRight(string(secret), "\r\n"), signalingLogger)
+		signalingServer.SetWebhooks(webhooks)
+	}
+	if *relayRate > 0 || *relayIPRate > 0 {
+		signalingServer.SetRateLimiter(signaling.NewRateLimiter(
+			signaling.RateLimit{Rate: *relayRate, Burst: *relayBurst},
+			signaling.RateLimit{Rate: *relayIPRate, Burst: *relayIPBurst},
+		))
+	}
+	turnServers, err := signaling.ParseTURNURLs(*turnURLs)
+	if err != nil {
+		logger.Error("invalid -turn-urls", "error", err)
+		os.Exit(1)
+	}
+	var relayConfig turnrelay.Config
+	if *turnListen != "" {
+		relayConfig = turnrelay.Config{
+			Listen:       *turnListen,
+			PublicIP:     net.ParseIP(*turnPublicIP),
+			AllowPrivate: *turnRelayPrivate,
+		}
+		if *turnRelayPorts != "" {
+			if relayConfig.MinPort, relayConfig.MaxPort, err = turnrelay.ParsePortRange(*turnRelayPorts); err != nil {
+				logger.Error("invalid -turn-relay-ports", "error", err)
+				os.Exit(1)
+			}
+		}
+		relayURLs, err := relayConfig.URLs()
+		if err != nil {
+			logger.Error("invalid embedded TURN server config", "error", err)
+			os.Exit(1)
+		}
+		turnServers = append(turnServers, relayURLs...)
+	}
+	var relay *turnrelay.Server
+	if len(turnServers) > 0 {
+		if *turnSecretFile != "" {
+			if *turnSecret != "" {
+				logger.Error("set only one of -turn-secret and -turn-secret-file")
+				os.Exit(1)
+			}
+			secret, err := os.ReadFile(*turnSecretFile)
+			if err != nil {
+				logger.Error("failed to read -turn-secret-file", "error", err)
+				os.Exit(1)
+			}
+			*turnSecret = strings.TrimRight(string(secret), "\r\n")
+		}
+		if *turnSecret == "" {
+			if *turnURLs != "" {
+				logger.Error("-turn-secret is required with -turn-urls")
+				os.Exit(1)
+			}
+			// Only the embedded TURN server checks credentials
+			key := make([]byte, 32)
+			if _, err := rand.Read(key); err != nil {
+				logger.Error("failed to generate TURN secret", "error", err)
+				os.Exit(1)
+			}
+			*turnSecret = hex.EncodeToString(key)
+		}
+		turn := signaling.NewTURNCredentials(turnServers, *turnSecret, *turnTTL)
+		signalingServer.SetTURN(turn)
+		if *turnListen != "" {
+			if relay, err = turnrelay.Start(relayConfig, turn, signalingLogger); err != nil {
+				logger.Error("failed to start embedded TURN server", "error", err)
+				os.Exit(1)
+			}
+		}
+	}
+	// lanscaped reads TRUSTED_PROXIES itself; signaling sits behind the
+	// same proxies
+	trustedProxies, err := service.ParseTrustedProxies(os.Getenv("TRUSTED_PROXIES"))
+	if err != nil {
+		logger.Error("invalid TRUSTED_PROXIES", "error", err)
+		os.Exit(1)
+	}
+	origins, err := service.ParseAllowedOrigins(*allowedOrigins)
+	if err != nil {
+		logger.Error("invalid -allowed-origins", "error", err)
+		os.Exit(1)
+	}
+	var httpLimiter *signaling.IPRateLimiter
+	if *httpRate > 0 {
+		httpLimiter = signaling.NewIPRateLimiter(signaling.RateLimit{Rate: *httpRate, Burst: *httpBurst})
+	}
+	signalingHTTP := &http.Server{
+		Handler: service.NewHandler(signalingServer, service.Config{
+			AllowedOrigins:  origins,
+			TrustedProxies:  trustedProxies,
+			HTTPRateLimiter: httpLimiter,
+		}, signalingLogger),
+		ReadTimeout:  15 * time.Second,
+		WriteTimeout: 15 * time.Second,
+		IdleTimeout:  60 * time.Second,
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// serveErr receives the first error from a server that stopped on its own
+	serveErr := make(chan error, 2)
+	go func() {
+		if err := api.Serve(apiListener); err != http.ErrServerClosed {
+			serveErr <- fmt.Errorf("lanscaped: %w", err)
+		}
+	}()
+	go func() {
+		if err := signalingHTTP.Serve(signalingListener); err != http.ErrServerClosed {
+			serveErr <- fmt.Errorf("signaling: %w", err)
+		}
+	}()
+
+	pollCtx, cancelPolling := context.WithCancel(context.Background())
+	go revocations.Run(pollCtx, *revocationRefresh)
+	go presence.Run(pollCtx, 5*time.Minute)
+	if webhooks != nil {
+		go webhooks.Run(pollCtx)
+	}
+	logger.Info("started lanscaped and signaling", "api", apiURL, "signaling", signalingURL)
+
+	var agent *daemon.Agent
+	if *runAgent {
+		agentLogger := logger.With("component", "agent")
+		tailscaleInfo, err := daemon.GetTailscaleInfo()
+		if err != nil {
+			agentLogger.Warn("failed to get Tailscale info, continuing without interface binding", "error", err)
+			tailscaleInfo = nil
+		}
+		if *topic == "" {
+			*topic = "lanscape-chat"
+			if *network != "" {
+				*topic = *network
+			}
+		}
+		cfg := daemon.Config{
+			WebSocketAddr: *wsAddr,
+			SignalingURL:  signalingURL,
+			Topic:         *topic,
+			DataDir:       *dataDir,
+			Name:          *name,
+			TailscaleInfo: tailscaleInfo,
+			Logger:        agentLogger,
+			RevocationURL: revocationURL,
+		}
+		if *network != "" {
+			cfg.Attestation.Network = *network
+			cfg.Attestation.JWKSURL = apiURL + "/.well-known/lanscape.jwks.json"
+		}
+		if agent, err = daemon.New(cfg); err == nil {
+			err = agent.Start()
+		}
+		if err != nil {
+			serveErr <- fmt.Errorf("agent: %w", err)
+			agent = nil
+		}
+	}
+
+	var failed error
+	select {
+	case <-ctx.Done():
+		logger.Info("received interrupt signal, shutting down")
+	case failed = <-serveErr:
+		logger.Error("component failed, shutting down", "error", failed)
+	}
+	stop()
+
+	// Shut down in dependency order: the agent leaves signaling, signaling
+	// closes its remaining peers and reports them offline, and lanscaped,
+	// which signaling reads revocations from, stops last. Signaling's drain
+	// grace comes on top of the shutdown timeout.
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), *drainGrace+*shutdownTimeout)
+	defer cancel()
+
+	if agent != nil {
+		if err := agent.Stop(shutdownCtx); err != nil {
+			logger.Warn("error stopping agent", "error", err)
+		}
+	}
+	if err := signalingServer.Drain(shutdownCtx); err != nil {
+		logger.Warn("signaling connections still open after drain", "error", err)
+	}
+	presence.Flush(shutdownCtx)
+	webhooks.Flush(shutdownCtx)
+	if err := signalingHTTP.Shutdown(shutdownCtx); err != nil {
+		logger.Warn("error stopping signaling", "error", err)
+	}
+	if relay != nil {
+		if err := relay.Close(); err != nil {
+			logger.Warn("error stopping embedded TURN server", "error", err)
+		}
+	}
+	cancelPolling()
+	if err := api.Stop(shutdownCtx); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logger.Warn("error stopping lanscaped", "error", err)
+	}
+
+	if failed != nil {
+		os.Exit(1)
+	}
+	logger.Info("stopped")
+}
+
+// embeddedSignaling applies lanscaped's network topic changes directly to the
+// embedded signaling server
+type embeddedSignaling struct {
+	server *signaling.Server
+	acls   *signaling.ACLTable
+}
+
+func (e embeddedSignaling) SetACL(ctx context.Context, topic string, acl lanscaped.TopicACL) error {
+	return e.acls.Set(topic, signaling.TopicACL{
+		RequireAuth: acl.RequireAuth,
+		Authorizer:  acl.Authorizer,
+		Network:     acl.Network,
+		AppRelay:    acl.AppRelay,
+	})
+}
+
+func (e embeddedSignaling) Kick(ctx context.Context, topic string, publicKeys []string, all bool, banUntil time.Time) error {
+	if err := e.acls.Ban(topic, publicKeys, banUntil); err != nil {
+		return err
+	}
+	e.server.Kick(topic, publicKeys, all, "no longer a network member")
+	return nil
+}
+
+func (e embeddedSignaling) Unban(ctx context.Context, topic string, publicKeys []string) error {
+	return e.acls.Unban(topic, publicKeys)
+}
+
+func (e embeddedSignaling) Stats(ctx context.Context, window time.Duration) (*lanscaped.SignalingStats, error) {
+	stats := e.server.Stats(window)
+	out := &lanscaped.SignalingStats{
+		WindowSeconds: stats.WindowSeconds,
+		Topics:        make([]lanscaped.SignalingTopicStats, len(stats.Topics)),
+	}
+	for i, t := range stats.Topics {
+		out.Topics[i] = lanscaped.SignalingTopicStats{
+			Topic:      t.Topic,
+			Peers:      t.Peers,
+			Observers:  t.Observers,
+			PublicKeys: t.PublicKeys,
+			Relays:     t.Relays,
+		}
+	}
+	return out, nil
+}
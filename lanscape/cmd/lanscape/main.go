@@ -0,0 +1,23 @@
+// Command lanscape runs lanscape's server components together in one process.
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/jhead/lanscape/signaling/pkg/buildinfo"
+)
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "all-in-one" {
+		runAllInOne(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && (os.Args[1] == "-version" || os.Args[1] == "--version") {
+		fmt.Println("lanscape", buildinfo.Get())
+		return
+	}
+
+	fmt.Fprintln(os.Stderr, "usage: lanscape all-in-one [flags] | lanscape --version")
+	os.Exit(2)
+}
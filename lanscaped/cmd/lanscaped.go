@@ -1,9 +1,25 @@
 package main
 
 import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/jhead/lanscape/lanscaped/internal/buildinfo"
 	"github.com/jhead/lanscape/lanscaped/internal/daemon"
 )
 
 func main() {
+	if len(os.Args) > 1 && (os.Args[1] == "-version" || os.Args[1] == "--version") {
+		fmt.Println("lanscaped", buildinfo.Get())
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "migrate-db" {
+		if err := daemon.MigrateDB(os.Args[2:]); err != nil {
+			log.Fatalf("migrate-db: %v", err)
+		}
+		return
+	}
+
 	daemon.Run(daemon.LoadServerConfig())
 }
@@ -2,6 +2,7 @@ package middleware
 
 import (
 	"context"
+	"errors"
 	"log"
 	"net/http"
 	"strings"
@@ -40,6 +41,11 @@ func JWTAuthMiddleware(jwtService *auth.JWTService) func(http.Handler) http.Hand
 
 			// Validate token
 			claims, err := jwtService.ValidateToken(tokenString)
+			if errors.Is(err, auth.ErrAlgorithmMismatch) {
+				log.Printf("Rejected JWT token from %s signed with an unexpected algorithm: %v", r.RemoteAddr, err)
+				http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
+				return
+			}
 			if err != nil {
 				log.Printf("Invalid JWT token: %v", err)
 				http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
@@ -0,0 +1,158 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+// forwardedHTTPSKey marks requests a trusted proxy received over HTTPS
+type forwardedHTTPSKey struct{}
+
+// TrustedProxies makes requests forwarded by reverse proxies such as nginx or
+// Caddy look like they came from the client: RemoteAddr becomes the address
+// in X-Forwarded-For (or X-Real-IP), and IsHTTPS follows X-Forwarded-Proto.
+// The headers are only believed from the proxies' own addresses, since any
+// client can send them.
+type TrustedProxies struct {
+	prefixes []netip.Prefix
+}
+
+// TrustedProxiesFromEnv creates TrustedProxies from TRUSTED_PROXIES, a
+// comma-separated list of addresses and CIDR ranges. When it is unset no
+// proxy is trusted and requests are left as they are.
+func TrustedProxiesFromEnv() (*TrustedProxies, error) {
+	prefixes, err := ParseTrustedProxies(os.Getenv("TRUSTED_PROXIES"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid TRUSTED_PROXIES: %w", err)
+	}
+	return &TrustedProxies{prefixes: prefixes}, nil
+}
+
+// ParseTrustedProxies parses a comma-separated list of addresses and CIDR
+// ranges, such as "127.0.0.1, 10.0.0.0/8"
+func ParseTrustedProxies(s string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		if strings.Contains(field, "/") {
+			prefix, err := netip.ParsePrefix(field)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(field)
+		if err != nil {
+			return nil, err
+		}
+		addr = addr.Unmap()
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, nil
+}
+
+// trusted reports whether addr is a trusted proxy
+func (t *TrustedProxies) trusted(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range t.prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Handler rewrites requests from trusted proxies before calling next. It
+// must run before anything that reads RemoteAddr or IsHTTPS.
+func (t *TrustedProxies) Handler(next http.Handler) http.Handler {
+	if len(t.prefixes) == 0 {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		peer, ok := remoteIP(r.RemoteAddr)
+		if !ok || !t.trusted(peer) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if client, ok := t.forwardedFor(r); ok {
+			r.RemoteAddr = client.String()
+		}
+		// A chain of proxies passes the first one's scheme along
+		proto, _, _ := strings.Cut(r.Header.Get("X-Forwarded-Proto"), ",")
+		if strings.EqualFold(strings.TrimSpace(proto), "https") {
+			r = r.WithContext(context.WithValue(r.Context(), forwardedHTTPSKey{}, true))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// forwardedFor returns the client address a trusted proxy forwarded. Each
+// proxy appends the address it received from, so the client is the last
+// address that is not itself a trusted proxy; anything before it could have
+// been sent by the client.
+func (t *TrustedProxies) forwardedFor(r *http.Request) (netip.Addr, bool) {
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	if len(hops) == 0 {
+		if realIP := r.Header.Get("X-Real-IP"); realIP != "" {
+			hops = []string{realIP}
+		}
+	}
+
+	var client netip.Addr
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		client = addr.Unmap()
+		if !t.trusted(client) {
+			break
+		}
+	}
+	return client, client.IsValid()
+}
+
+// IsHTTPS reports whether the client made the request over HTTPS, either to
+// lanscaped or to a trusted proxy in front of it
+func IsHTTPS(r *http.Request) bool {
+	if r.TLS != nil {
+		return true
+	}
+	https, _ := r.Context().Value(forwardedHTTPSKey{}).(bool)
+	return https
+}
+
+// ClientIP returns the client's address without a port, e.g. for audit logs
+func ClientIP(r *http.Request) string {
+	if addr, ok := remoteIP(r.RemoteAddr); ok {
+		return addr.String()
+	}
+	return r.RemoteAddr
+}
+
+// remoteIP parses a RemoteAddr, with or without a port
+func remoteIP(remoteAddr string) (netip.Addr, bool) {
+	host := remoteAddr
+	if h, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		host = h
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
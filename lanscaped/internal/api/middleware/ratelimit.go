@@ -0,0 +1,156 @@
+package middleware
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/netip"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Defaults for RateLimiter: enough for the web UI to load its assets and
+// the agents behind one address to poll, but not to hammer the API
+const (
+	DefaultHTTPRate  = 20
+	DefaultHTTPBurst = 100
+)
+
+// rateLimitSweepInterval is how often idle buckets are forgotten
+const rateLimitSweepInterval = time.Minute
+
+// RateLimitHeaders are the headers RateLimiter sets, which browsers may only
+// read cross-origin if they are exposed
+const RateLimitHeaders = "Retry-After, X-RateLimit-Limit, X-RateLimit-Remaining, X-RateLimit-Reset"
+
+// RateLimiter limits requests per client IP with a token bucket, so one
+// client cannot starve the others. Every response says how to pace further
+// requests: X-RateLimit-Limit is the burst, X-RateLimit-Remaining the
+// requests left in it, and X-RateLimit-Reset the seconds until it is full
+// again. Refused requests get a 429 with Retry-After.
+type RateLimiter struct {
+	// Rate is how many requests per second a client may make on average
+	Rate float64
+	// Burst is how many requests a client may make at once
+	Burst int
+
+	mu        sync.Mutex
+	buckets   map[netip.Addr]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimiterFromEnv creates a RateLimiter from HTTP_RATE and HTTP_BURST,
+// using the defaults for those unset. It returns nil if HTTP_RATE is 0.
+func RateLimiterFromEnv() (*RateLimiter, error) {
+	l := &RateLimiter{Rate: DefaultHTTPRate, Burst: DefaultHTTPBurst}
+	if v, ok := os.LookupEnv("HTTP_RATE"); ok {
+		rate, err := strconv.ParseFloat(v, 64)
+		if err != nil || rate < 0 {
+			return nil, fmt.Errorf("invalid HTTP_RATE %q: must be a number of at least 0", v)
+		}
+		l.Rate = rate
+	}
+	if v, ok := os.LookupEnv("HTTP_BURST"); ok {
+		burst, err := strconv.Atoi(v)
+		if err != nil || burst < 1 {
+			return nil, fmt.Errorf("invalid HTTP_BURST %q: must be at least 1", v)
+		}
+		l.Burst = burst
+	}
+	if l.Rate == 0 {
+		return nil, nil
+	}
+	return l, nil
+}
+
+// Handler limits requests before calling next. It must run after
+// TrustedProxies, so clients behind a proxy are told apart. Health checks
+// are not limited.
+func (l *RateLimiter) Handler(next http.Handler) http.Handler {
+	if l == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client, ok := remoteIP(r.RemoteAddr)
+		if !ok || r.URL.Path == "/healthz" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		remaining, reset, retryAfter := l.take(client, time.Now())
+		h := w.Header()
+		h.Set("X-RateLimit-Limit", strconv.Itoa(l.Burst))
+		h.Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+		h.Set("X-RateLimit-Reset", ceilSeconds(reset))
+		if retryAfter > 0 {
+			log.Printf("Rate limited %s %s from %s", r.Method, r.URL.Path, client)
+			h.Set("Retry-After", ceilSeconds(retryAfter))
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// take takes a token from client's bucket if it has one. It returns the
+// whole tokens left, how long until the bucket is full, and how long until
+// the next token if there was none to take.
+func (l *RateLimiter) take(client netip.Addr, now time.Time) (remaining int, reset, retryAfter time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.buckets == nil {
+		l.buckets = make(map[netip.Addr]*tokenBucket)
+		l.lastSweep = now
+	}
+	if now.Sub(l.lastSweep) >= rateLimitSweepInterval {
+		l.sweep(now)
+	}
+
+	b, ok := l.buckets[client]
+	if !ok {
+		b = &tokenBucket{tokens: float64(l.Burst), last: now}
+		l.buckets[client] = b
+	}
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = min(b.tokens+elapsed.Seconds()*l.Rate, float64(l.Burst))
+		b.last = now
+	}
+
+	if b.tokens < 1 {
+		retryAfter = l.refillTime(1 - b.tokens)
+	} else {
+		b.tokens--
+	}
+	return int(b.tokens), l.refillTime(float64(l.Burst) - b.tokens), retryAfter
+}
+
+// sweep forgets buckets that have refilled, since a new bucket starts full
+func (l *RateLimiter) sweep(now time.Time) {
+	l.lastSweep = now
+	for client, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.Rate >= float64(l.Burst) {
+			delete(l.buckets, client)
+		}
+	}
+}
+
+// refillTime returns how long a bucket takes to earn tokens
+func (l *RateLimiter) refillTime(tokens float64) time.Duration {
+	return time.Duration(tokens / l.Rate * float64(time.Second))
+}
+
+// ceilSeconds formats d as whole seconds, rounded up so clients waiting that
+// long are not refused again
+func ceilSeconds(d time.Duration) string {
+	return strconv.FormatInt(int64(math.Ceil(d.Seconds())), 10)
+}
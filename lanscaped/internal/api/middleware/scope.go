@@ -0,0 +1,66 @@
+package middleware
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/jhead/lanscape/lanscaped/internal/auth"
+	"github.com/jhead/lanscape/lanscaped/internal/store"
+)
+
+// APITokens looks up personal API tokens and their owners
+type APITokens interface {
+	GetAPITokenByHash(hash string) (*store.APIToken, error)
+	TouchAPIToken(id int64) error
+	GetUserByID(id int64) (*store.User, error)
+}
+
+// ScopedAuthMiddleware returns middleware for routes personal API tokens may
+// call if they were granted a scope. Other tokens are validated as by
+// JWTAuthMiddleware. Routes that only take JWTAuthMiddleware refuse personal
+// API tokens, so a token cannot, for example, create more tokens.
+func ScopedAuthMiddleware(jwtService *auth.JWTService, tokens APITokens) func(scope auth.Scope) func(http.Handler) http.Handler {
+	jwtMiddleware := JWTAuthMiddleware(jwtService)
+	return func(scope auth.Scope) func(http.Handler) http.Handler {
+		return func(next http.Handler) http.Handler {
+			withJWT := jwtMiddleware(next)
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				tokenString, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+				if !ok || !strings.HasPrefix(tokenString, auth.APITokenPrefix) {
+					withJWT.ServeHTTP(w, r)
+					return
+				}
+
+				token, err := tokens.GetAPITokenByHash(auth.HashAPIToken(tokenString))
+				if err != nil {
+					log.Printf("Invalid API token: %v", err)
+					http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
+					return
+				}
+				if !auth.Grants(token.Scopes, scope) {
+					log.Printf("API token %d lacks scope %s for %s %s", token.ID, scope, r.Method, r.URL.Path)
+					http.Error(w, "Token lacks the "+string(scope)+" scope", http.StatusForbidden)
+					return
+				}
+				user, err := tokens.GetUserByID(token.UserID)
+				if err != nil {
+					log.Printf("Error looking up owner of API token %d: %v", token.ID, err)
+					http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
+					return
+				}
+				if err := tokens.TouchAPIToken(token.ID); err != nil {
+					// Last use is informational; serve the request anyway
+					log.Printf("Error recording use of API token %d: %v", token.ID, err)
+				}
+
+				log.Printf("API token %d validated for user: %s (ID: %d)", token.ID, user.Username, user.ID)
+
+				claims := &auth.Claims{UserID: user.ID, Username: user.Username}
+				ctx := context.WithValue(r.Context(), "jwt_claims", claims)
+				next.ServeHTTP(w, r.WithContext(ctx))
+			})
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Defaults for SecurityHeaders. The API serves only JSON and images, so by
+// default nothing it returns may load or embed anything.
+const (
+	DefaultCSP            = "default-src 'none'; frame-ancestors 'none'; base-uri 'none'; form-action 'none'"
+	DefaultReferrerPolicy = "no-referrer"
+	DefaultHSTSMaxAge     = 365 * 24 * time.Hour
+)
+
+// SecurityHeaders sets HSTS, X-Content-Type-Options, Referrer-Policy, and
+// Content-Security-Policy on every response
+type SecurityHeaders struct {
+	// HSTSMaxAge is sent in Strict-Transport-Security on requests made over
+	// HTTPS; 0 disables HSTS
+	HSTSMaxAge time.Duration
+	// ReferrerPolicy is sent in Referrer-Policy; empty omits the header
+	ReferrerPolicy string
+	// CSP is the Content-Security-Policy of routes without an override;
+	// empty omits the header
+	CSP string
+
+	overrides []cspOverride // longest prefix first
+}
+
+// cspOverride is the CSP of the routes under a path prefix
+type cspOverride struct {
+	prefix string
+	csp    string
+}
+
+// SecurityHeadersFromEnv creates SecurityHeaders from HSTS_MAX_AGE,
+// REFERRER_POLICY, and CONTENT_SECURITY_POLICY, using the defaults for those
+// unset
+func SecurityHeadersFromEnv() (*SecurityHeaders, error) {
+	s := &SecurityHeaders{
+		HSTSMaxAge:     DefaultHSTSMaxAge,
+		ReferrerPolicy: DefaultReferrerPolicy,
+		CSP:            DefaultCSP,
+	}
+	if v, ok := os.LookupEnv("HSTS_MAX_AGE"); ok {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("invalid HSTS_MAX_AGE %q: must be a duration of at least 0", v)
+		}
+		s.HSTSMaxAge = d
+	}
+	if v, ok := os.LookupEnv("REFERRER_POLICY"); ok {
+		s.ReferrerPolicy = v
+	}
+	if v, ok := os.LookupEnv("CONTENT_SECURITY_POLICY"); ok {
+		s.CSP = v
+	}
+	return s, nil
+}
+
+// Override sets the CSP of the routes under a path prefix, such as pages that
+// need scripts and styles. The longest matching prefix wins; an empty csp
+// omits the header for those routes. It must be called before Handler.
+func (s *SecurityHeaders) Override(prefix, csp string) {
+	s.overrides = append(s.overrides, cspOverride{prefix: prefix, csp: csp})
+	sort.SliceStable(s.overrides, func(i, j int) bool {
+		return len(s.overrides[i].prefix) > len(s.overrides[j].prefix)
+	})
+}
+
+// Handler sets the headers before calling next, so handlers can still
+// replace them
+func (s *SecurityHeaders) Handler(next http.Handler) http.Handler {
+	hsts := ""
+	if s.HSTSMaxAge > 0 {
+		hsts = "max-age=" + strconv.FormatInt(int64(s.HSTSMaxAge/time.Second), 10) + "; includeSubDomains"
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		h.Set("X-Content-Type-Options", "nosniff")
+		if s.ReferrerPolicy != "" {
+			h.Set("Referrer-Policy", s.ReferrerPolicy)
+		}
+		if csp := s.cspFor(r.URL.Path); csp != "" {
+			h.Set("Content-Security-Policy", csp)
+		}
+		// Browsers ignore HSTS over plain HTTP, so it is only sent over HTTPS,
+		// including HTTPS terminated by a trusted proxy in front of lanscaped
+		if hsts != "" && IsHTTPS(r) {
+			h.Set("Strict-Transport-Security", hsts)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// cspFor returns the CSP of a path
+func (s *SecurityHeaders) cspFor(path string) string {
+	for _, o := range s.overrides {
+		if strings.HasPrefix(path, o.prefix) {
+			return o.csp
+		}
+	}
+	return s.CSP
+}
+
+// Chain wraps h in middlewares, the first outermost
+func Chain(h http.Handler, middlewares ...func(http.Handler) http.Handler) http.Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		h = middlewares[i](h)
+	}
+	return h
+}
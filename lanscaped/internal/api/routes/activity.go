@@ -0,0 +1,162 @@
+package routes
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jhead/lanscape/lanscaped/internal/api/middleware"
+	"github.com/jhead/lanscape/lanscaped/internal/store"
+)
+
+// defaultActivityLimit and maxActivityLimit bound one page of the timeline
+const (
+	defaultActivityLimit = 50
+	maxActivityLimit     = 200
+)
+
+// Audit actions recorded for a user's account
+const (
+	auditAccountRegistered      = "account.registered"
+	auditAccountLogin           = "account.login"
+	auditDeviceApproved         = "device_signin.approved"
+	auditDeviceSignedIn         = "device_signin.completed"
+	auditNetworkCreated         = "network.created"
+	auditNetworkJoined          = "network.joined"
+	auditNetworkJoinRequested   = "network.join_requested"
+	auditNetworkInvited         = "network.invited"
+	auditInvitationDeclined     = "network.invitation_declined"
+	auditNetworkLeft            = "network.left"
+	auditNetworkDeleted         = "network.deleted"
+	auditNetworkSettingsChanged = "network.settings_changed"
+	auditNetworkUpdated         = "network.updated"
+	auditNetworkImported        = "network.imported"
+	auditDeviceAdopted          = "device.adopted"
+	auditAgentRenamed           = "agent.renamed"
+	auditAPITokenCreated        = "api_token.created"
+	auditAPITokenRevoked        = "api_token.revoked"
+)
+
+// ActivityResponse represents one page of the caller's account timeline
+type ActivityResponse struct {
+	Events []ActivityEventResponse `json:"events"`
+	// NextCursor fetches the next, older page; empty on the last page
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// ActivityEventResponse represents one event in the timeline
+type ActivityEventResponse struct {
+	Type   string         `json:"type"`
+	At     string         `json:"at"`
+	Detail map[string]any `json:"detail"`
+}
+
+// HandleListActivity handles GET /v1/me/activity
+// Returns the caller's account timeline, newest first: audit events such as
+// sign-ins, network changes, and device adoptions, agent enrollments and
+// revocations, and agents coming online and going offline. Pages with the
+// limit and cursor query parameters.
+func HandleListActivity(w http.ResponseWriter, r *http.Request, dbStore *store.Store) {
+	log.Printf("List activity request from %s", r.RemoteAddr)
+
+	claims, ok := middleware.GetClaimsFromContext(r)
+	if !ok {
+		log.Printf("Failed to extract JWT claims from context")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	limit := defaultActivityLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxActivityLimit {
+			http.Error(w, "limit must be between 1 and 200", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	var before *store.ActivityCursor
+	if v := r.URL.Query().Get("cursor"); v != "" {
+		cursor, ok := decodeActivityCursor(v)
+		if !ok {
+			http.Error(w, "Invalid cursor", http.StatusBadRequest)
+			return
+		}
+		before = cursor
+	}
+
+	entries, err := dbStore.ListActivity(claims.UserID, before, limit)
+	if err != nil {
+		log.Printf("Error listing activity: %v", err)
+		http.Error(w, "Failed to list activity", http.StatusInternalServerError)
+		return
+	}
+
+	response := ActivityResponse{Events: make([]ActivityEventResponse, 0, len(entries))}
+	for _, entry := range entries {
+		response.Events = append(response.Events, ActivityEventResponse{
+			Type:   entry.Type,
+			At:     entry.At.UTC().Format("2006-01-02T15:04:05Z"),
+			Detail: entry.Detail,
+		})
+	}
+	if len(entries) == limit {
+		response.NextCursor = encodeActivityCursor(entries[len(entries)-1].ActivityCursor)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("Error encoding response: %v", err)
+	}
+}
+
+// encodeActivityCursor makes an opaque cursor from a timeline position
+func encodeActivityCursor(c store.ActivityCursor) string {
+	raw := strconv.FormatInt(c.At.Unix(), 10) + "|" + c.Source + "|" + strconv.FormatInt(c.ID, 10)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// decodeActivityCursor parses a cursor made by encodeActivityCursor
+func decodeActivityCursor(s string) (*store.ActivityCursor, bool) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, false
+	}
+	parts := strings.Split(string(raw), "|")
+	if len(parts) != 3 {
+		return nil, false
+	}
+	at, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return nil, false
+	}
+	id, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return nil, false
+	}
+	return &store.ActivityCursor{At: time.Unix(at, 0), Source: parts[1], ID: id}, true
+}
+
+// recordAudit adds an action to a user's audit log. The action already
+// happened, so failures are only logged.
+func recordAudit(dbStore *store.Store, r *http.Request, userID int64, action string, detail map[string]any) {
+	if detail == nil {
+		detail = map[string]any{}
+	}
+	detail["remote_addr"] = middleware.ClientIP(r)
+	if err := dbStore.RecordAuditEvent(userID, action, detail); err != nil {
+		log.Printf("Error recording audit event %s for user %d: %v", action, userID, err)
+	}
+}
+
+// networkDetail identifies a network in audit events
+func networkDetail(network *store.Network) map[string]any {
+	return map[string]any{"network_id": network.ID, "network": network.Name}
+}
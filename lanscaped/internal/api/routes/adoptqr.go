@@ -0,0 +1,152 @@
+package routes
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jhead/lanscape/lanscaped/internal/api/middleware"
+	"github.com/jhead/lanscape/lanscaped/internal/authz"
+	"github.com/jhead/lanscape/lanscaped/internal/store"
+	"github.com/jhead/lanscape/lanscaped/internal/tailnet"
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// adoptQRTTL is how long the preauth key in an adoption QR code is valid, or
+// the network's default key expiry if shorter. The code is meant to be
+// scanned right away, and anyone who sees it can use it.
+const adoptQRTTL = 15 * time.Minute
+
+// qrPNGSize is the width and height of PNG QR codes, in pixels
+const qrPNGSize = 512
+
+// AdoptQRResponse represents an adoption deep link, for format=json
+type AdoptQRResponse struct {
+	DeepLink  string `json:"deep_link"`
+	ExpiresAt string `json:"expires_at"`
+}
+
+// HandleAdoptQR handles GET /v1/networks/{id}/devices/adopt/qr
+// Mints a short-lived preauth key and returns a lanscape://adopt deep link
+// carrying it and the network's Headscale endpoint, as a QR code to scan
+// from a phone or tablet. format is svg (default), png, or json; images carry
+// the link in the Lanscape-Deep-Link header. name optionally names the
+// device.
+func HandleAdoptQR(w http.ResponseWriter, r *http.Request, dbStore *store.Store, authorizer *authz.Authorizer) {
+	log.Printf("Adoption QR request from %s", r.RemoteAddr)
+
+	claims, ok := middleware.GetClaimsFromContext(r)
+	if !ok {
+		log.Printf("Failed to extract JWT claims from context")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	switch format {
+	case "":
+		format = "svg"
+	case "svg", "png", "json":
+	default:
+		http.Error(w, "format must be svg, png, or json", http.StatusBadRequest)
+		return
+	}
+
+	networkID, ok := authorizedNetworkID(w, r, authorizer, claims.UserID, authz.AdoptDevice)
+	if !ok {
+		return
+	}
+
+	network, err := dbStore.GetNetworkByID(networkID)
+	if err != nil {
+		log.Printf("Error fetching network: %v", err)
+		http.Error(w, "Network not found", http.StatusNotFound)
+		return
+	}
+
+	settings, ok := networkSettings(w, dbStore, networkID)
+	if !ok {
+		return
+	}
+
+	ttl := min(adoptQRTTL, settings.DefaultKeyExpiry)
+	expiration := time.Now().Add(ttl)
+	preauthKey, ok := createPreauthKey(r.Context(), w, network, claims.Username, expiration)
+	if !ok {
+		return
+	}
+
+	name := r.URL.Query().Get("name")
+	detail := networkDetail(network)
+	detail["name"] = name
+	detail["via"] = "qr"
+	recordAudit(dbStore, r, claims.UserID, auditDeviceAdopted, detail)
+
+	deepLink := tailnet.Enrollment{
+		LoginServer: network.HeadscaleEndpoint,
+		AuthKey:     preauthKey,
+		Expires:     expiration,
+		Hostname:    name,
+	}.DeepLink()
+	expiresAt := expiration.UTC().Format("2006-01-02T15:04:05Z")
+
+	// The response holds a usable key
+	w.Header().Set("Cache-Control", "no-store")
+
+	if format == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		if err := json.NewEncoder(w).Encode(AdoptQRResponse{DeepLink: deepLink, ExpiresAt: expiresAt}); err != nil {
+			log.Printf("Error encoding response: %v", err)
+		}
+		return
+	}
+
+	qr, err := qrcode.New(deepLink, qrcode.Medium)
+	if err != nil {
+		log.Printf("Error encoding QR code: %v", err)
+		http.Error(w, "Failed to create QR code", http.StatusInternalServerError)
+		return
+	}
+
+	var body []byte
+	if format == "png" {
+		if body, err = qr.PNG(qrPNGSize); err != nil {
+			log.Printf("Error rendering QR code: %v", err)
+			http.Error(w, "Failed to create QR code", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+	} else {
+		body = []byte(qrSVG(qr.Bitmap()))
+		w.Header().Set("Content-Type", "image/svg+xml")
+	}
+
+	w.Header().Set("Lanscape-Deep-Link", deepLink)
+	w.Header().Set("Lanscape-Expires-At", expiresAt)
+	w.WriteHeader(http.StatusCreated)
+	if _, err := w.Write(body); err != nil {
+		log.Printf("Error writing QR code: %v", err)
+	}
+}
+
+// qrSVG renders a QR code bitmap, quiet zone included, as an SVG with one
+// unit per module
+func qrSVG(bitmap [][]bool) string {
+	size := len(bitmap)
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" shape-rendering="crispEdges">`, size, size)
+	fmt.Fprintf(&b, `<rect width="%d" height="%d" fill="#fff"/><path fill="#000" d="`, size, size)
+	for y, row := range bitmap {
+		for x, dark := range row {
+			if dark {
+				fmt.Fprintf(&b, "M%d %dh1v1h-1z", x, y)
+			}
+		}
+	}
+	b.WriteString(`"/></svg>`)
+	return b.String()
+}
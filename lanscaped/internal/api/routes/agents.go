@@ -0,0 +1,277 @@
+package routes
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/jhead/lanscape/lanscaped/internal/api/middleware"
+	"github.com/jhead/lanscape/lanscaped/internal/store"
+)
+
+// maxAgentNameLength bounds the name a user gives an enrolled agent
+const maxAgentNameLength = 64
+
+// maxAgentVersionLength bounds the build version an agent reports
+const maxAgentVersionLength = 64
+
+// RegisterAgentRequest represents the request to enroll an agent identity key
+type RegisterAgentRequest struct {
+	PublicKey string `json:"public_key"` // agent ed25519 identity key, base64url
+	Name      string `json:"name,omitempty"`
+	Version   string `json:"version,omitempty"` // agent build version
+}
+
+// AgentResponse represents an enrolled agent
+type AgentResponse struct {
+	ID        int64  `json:"id"`
+	PublicKey string `json:"public_key"`
+	Name      string `json:"name"`
+	Version   string `json:"version,omitempty"`
+	CreatedAt string `json:"created_at"`
+	RevokedAt string `json:"revoked_at,omitempty"`
+	// Online is set in listings when the agent is connected to signaling
+	Online       bool     `json:"online"`
+	OnlineTopics []string `json:"online_topics,omitempty"`
+	LastSeen     string   `json:"last_seen,omitempty"`
+}
+
+// ListAgentsResponse represents the response from listing enrolled agents
+type ListAgentsResponse struct {
+	Agents []AgentResponse `json:"agents"`
+}
+
+// RenameAgentRequest represents the request to rename an enrolled agent
+type RenameAgentRequest struct {
+	Name string `json:"name"`
+}
+
+// RevokedAgentsResponse lists the identity keys signaling servers and agents
+// must reject
+type RevokedAgentsResponse struct {
+	Revoked []string `json:"revoked"`
+}
+
+// HandleRegisterAgent handles POST /v1/me/agents
+// Enrolls an agent identity key with the caller's account, tying the peer
+// the agent joins signaling as back to the user
+func HandleRegisterAgent(w http.ResponseWriter, r *http.Request, dbStore *store.Store) {
+	log.Printf("Register agent request from %s", r.RemoteAddr)
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	claims, ok := middleware.GetClaimsFromContext(r)
+	if !ok {
+		log.Printf("Failed to extract JWT claims from context")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req RegisterAgentRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		log.Printf("Error decoding request: %v", err)
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	key, err := base64.RawURLEncoding.DecodeString(req.PublicKey)
+	if err != nil || len(key) != ed25519PublicKeySize {
+		http.Error(w, "Invalid public key", http.StatusBadRequest)
+		return
+	}
+
+	name := strings.TrimSpace(req.Name)
+	if len(name) > maxAgentNameLength {
+		http.Error(w, "Name is too long", http.StatusBadRequest)
+		return
+	}
+
+	version := strings.TrimSpace(req.Version)
+	if len(version) > maxAgentVersionLength {
+		http.Error(w, "Version is too long", http.StatusBadRequest)
+		return
+	}
+
+	agent, err := dbStore.RegisterAgent(claims.UserID, req.PublicKey, name, version)
+	if err != nil {
+		log.Printf("Error registering agent: %v", err)
+		if strings.Contains(err.Error(), "another user") {
+			http.Error(w, "Agent key is registered to another account", http.StatusConflict)
+			return
+		}
+		if strings.Contains(err.Error(), "revoked") {
+			http.Error(w, "Agent key has been revoked", http.StatusForbidden)
+			return
+		}
+		http.Error(w, "Failed to register agent", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Registered agent %d (%s, version %q) for user %s (ID: %d)", agent.ID, agent.Name, agent.Version, claims.Username, claims.UserID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+
+	response := newAgentResponse(agent)
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("Error encoding response: %v", err)
+	}
+}
+
+// HandleListAgents handles GET /v1/me/agents
+// Lists the agents enrolled with the caller's account, including revoked
+// ones, with the topics they are online in as reported by the signaling
+// server
+func HandleListAgents(w http.ResponseWriter, r *http.Request, dbStore *store.Store) {
+	log.Printf("List agents request from %s", r.RemoteAddr)
+
+	claims, ok := middleware.GetClaimsFromContext(r)
+	if !ok {
+		log.Printf("Failed to extract JWT claims from context")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	agents, err := dbStore.ListAgents(claims.UserID)
+	if err != nil {
+		log.Printf("Error listing agents: %v", err)
+		http.Error(w, "Failed to list agents", http.StatusInternalServerError)
+		return
+	}
+
+	presence, err := dbStore.GetAgentPresence(claims.UserID)
+	if err != nil {
+		// Presence is advisory; list the agents without it
+		log.Printf("Error getting agent presence: %v", err)
+	}
+
+	response := ListAgentsResponse{Agents: make([]AgentResponse, 0, len(agents))}
+	for _, agent := range agents {
+		a := newAgentResponse(agent)
+		if p, ok := presence[agent.PublicKey]; ok {
+			a.Online = len(p.Topics) > 0
+			a.OnlineTopics = p.Topics
+			a.LastSeen = p.LastSeen.UTC().Format("2006-01-02T15:04:05Z")
+		}
+		response.Agents = append(response.Agents, a)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("Error encoding response: %v", err)
+	}
+}
+
+// HandleRenameAgent handles PATCH /v1/me/agents/{id}
+func HandleRenameAgent(w http.ResponseWriter, r *http.Request, dbStore *store.Store) {
+	log.Printf("Rename agent request from %s", r.RemoteAddr)
+
+	claims, ok := middleware.GetClaimsFromContext(r)
+	if !ok {
+		log.Printf("Failed to extract JWT claims from context")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	agentID, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid agent ID", http.StatusBadRequest)
+		return
+	}
+
+	var req RenameAgentRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		log.Printf("Error decoding request: %v", err)
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	name := strings.TrimSpace(req.Name)
+	if len(name) > maxAgentNameLength {
+		http.Error(w, "Name is too long", http.StatusBadRequest)
+		return
+	}
+
+	if err := dbStore.RenameAgent(claims.UserID, agentID, name); err != nil {
+		log.Printf("Error renaming agent: %v", err)
+		http.Error(w, "Agent not found", http.StatusNotFound)
+		return
+	}
+
+	log.Printf("User %s (ID: %d) renamed agent %d to %q", claims.Username, claims.UserID, agentID, name)
+	recordAudit(dbStore, r, claims.UserID, auditAgentRenamed, map[string]any{"agent_id": agentID, "name": name})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleRevokeAgent handles DELETE /v1/me/agents/{id}
+// Revokes an agent identity key, for example when a device is lost. Signaling
+// servers and peers refuse the key once they refresh the revocation list.
+func HandleRevokeAgent(w http.ResponseWriter, r *http.Request, dbStore *store.Store) {
+	log.Printf("Revoke agent request from %s", r.RemoteAddr)
+
+	claims, ok := middleware.GetClaimsFromContext(r)
+	if !ok {
+		log.Printf("Failed to extract JWT claims from context")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	agentID, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid agent ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := dbStore.RevokeAgent(claims.UserID, agentID); err != nil {
+		log.Printf("Error revoking agent: %v", err)
+		http.Error(w, "Agent not found", http.StatusNotFound)
+		return
+	}
+
+	log.Printf("User %s (ID: %d) revoked agent %d", claims.Username, claims.UserID, agentID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleListRevokedAgents handles GET /v1/agents/revoked
+// Public: revoked keys are public keys, and signaling servers and agents
+// fetch the list without an account
+func HandleListRevokedAgents(w http.ResponseWriter, r *http.Request, dbStore *store.Store) {
+	keys, err := dbStore.ListRevokedAgentKeys()
+	if err != nil {
+		log.Printf("Error listing revoked agents: %v", err)
+		http.Error(w, "Failed to list revoked agents", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=60")
+	w.WriteHeader(http.StatusOK)
+
+	if err := json.NewEncoder(w).Encode(RevokedAgentsResponse{Revoked: keys}); err != nil {
+		log.Printf("Error encoding response: %v", err)
+	}
+}
+
+// newAgentResponse converts a stored agent to its API representation
+func newAgentResponse(agent *store.Agent) AgentResponse {
+	response := AgentResponse{
+		ID:        agent.ID,
+		PublicKey: agent.PublicKey,
+		Name:      agent.Name,
+		Version:   agent.Version,
+		CreatedAt: agent.CreatedAt.UTC().Format("2006-01-02T15:04:05Z"),
+	}
+	if agent.RevokedAt != nil {
+		response.RevokedAt = agent.RevokedAt.UTC().Format("2006-01-02T15:04:05Z")
+	}
+	return response
+}
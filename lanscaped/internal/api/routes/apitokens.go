@@ -0,0 +1,179 @@
+package routes
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/jhead/lanscape/lanscaped/internal/api/middleware"
+	"github.com/jhead/lanscape/lanscaped/internal/auth"
+	"github.com/jhead/lanscape/lanscaped/internal/store"
+)
+
+// maxAPITokenNameLength bounds the name a user gives a personal API token
+const maxAPITokenNameLength = 64
+
+// CreateAPITokenRequest represents the request to create a personal API
+// token
+type CreateAPITokenRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+}
+
+// APITokenResponse represents a personal API token
+type APITokenResponse struct {
+	ID         int64    `json:"id"`
+	Name       string   `json:"name"`
+	Scopes     []string `json:"scopes"`
+	CreatedAt  string   `json:"created_at"`
+	LastUsedAt string   `json:"last_used_at,omitempty"`
+	// Token is only set when the token is created; it cannot be shown again
+	Token string `json:"token,omitempty"`
+}
+
+// ListAPITokensResponse represents the response from listing personal API
+// tokens
+type ListAPITokensResponse struct {
+	Tokens []APITokenResponse `json:"tokens"`
+}
+
+// HandleCreateAPIToken handles POST /v1/me/tokens
+// Creates a personal API token for automation, limited to the given scopes
+func HandleCreateAPIToken(w http.ResponseWriter, r *http.Request, dbStore *store.Store) {
+	log.Printf("Create API token request from %s", r.RemoteAddr)
+
+	claims, ok := middleware.GetClaimsFromContext(r)
+	if !ok {
+		log.Printf("Failed to extract JWT claims from context")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req CreateAPITokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		log.Printf("Error decoding request: %v", err)
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	name := strings.TrimSpace(req.Name)
+	if name == "" {
+		http.Error(w, "Name is required", http.StatusBadRequest)
+		return
+	}
+	if len(name) > maxAPITokenNameLength {
+		http.Error(w, "Name is too long", http.StatusBadRequest)
+		return
+	}
+
+	scopes, err := auth.ParseScopes(req.Scopes)
+	if err != nil {
+		http.Error(w, "Invalid scopes: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	secret, hash, err := auth.GenerateAPIToken()
+	if err != nil {
+		log.Printf("Error generating API token: %v", err)
+		http.Error(w, "Failed to create token", http.StatusInternalServerError)
+		return
+	}
+
+	token, err := dbStore.CreateAPIToken(claims.UserID, name, hash, scopes)
+	if err != nil {
+		log.Printf("Error creating API token: %v", err)
+		http.Error(w, "Failed to create token", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("User %s (ID: %d) created API token %d (%s) with scopes %s", claims.Username, claims.UserID, token.ID, token.Name, strings.Join(token.Scopes, " "))
+	recordAudit(dbStore, r, claims.UserID, auditAPITokenCreated, map[string]any{"token_id": token.ID, "name": token.Name, "scopes": token.Scopes})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+
+	response := newAPITokenResponse(token)
+	response.Token = secret
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("Error encoding response: %v", err)
+	}
+}
+
+// HandleListAPITokens handles GET /v1/me/tokens
+// Lists the caller's personal API tokens with their scopes and when they
+// were last used
+func HandleListAPITokens(w http.ResponseWriter, r *http.Request, dbStore *store.Store) {
+	log.Printf("List API tokens request from %s", r.RemoteAddr)
+
+	claims, ok := middleware.GetClaimsFromContext(r)
+	if !ok {
+		log.Printf("Failed to extract JWT claims from context")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	tokens, err := dbStore.ListAPITokens(claims.UserID)
+	if err != nil {
+		log.Printf("Error listing API tokens: %v", err)
+		http.Error(w, "Failed to list tokens", http.StatusInternalServerError)
+		return
+	}
+
+	response := ListAPITokensResponse{Tokens: make([]APITokenResponse, 0, len(tokens))}
+	for _, token := range tokens {
+		response.Tokens = append(response.Tokens, newAPITokenResponse(token))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("Error encoding response: %v", err)
+	}
+}
+
+// HandleDeleteAPIToken handles DELETE /v1/me/tokens/{id}
+// Revokes one of the caller's personal API tokens
+func HandleDeleteAPIToken(w http.ResponseWriter, r *http.Request, dbStore *store.Store) {
+	log.Printf("Delete API token request from %s", r.RemoteAddr)
+
+	claims, ok := middleware.GetClaimsFromContext(r)
+	if !ok {
+		log.Printf("Failed to extract JWT claims from context")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	tokenID, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid token ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := dbStore.DeleteAPIToken(claims.UserID, tokenID); err != nil {
+		log.Printf("Error deleting API token: %v", err)
+		http.Error(w, "Token not found", http.StatusNotFound)
+		return
+	}
+
+	log.Printf("User %s (ID: %d) revoked API token %d", claims.Username, claims.UserID, tokenID)
+	recordAudit(dbStore, r, claims.UserID, auditAPITokenRevoked, map[string]any{"token_id": tokenID})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// newAPITokenResponse converts a stored token to its API representation
+func newAPITokenResponse(token *store.APIToken) APITokenResponse {
+	response := APITokenResponse{
+		ID:        token.ID,
+		Name:      token.Name,
+		Scopes:    token.Scopes,
+		CreatedAt: token.CreatedAt.UTC().Format("2006-01-02T15:04:05Z"),
+	}
+	if token.LastUsedAt != nil {
+		response.LastUsedAt = token.LastUsedAt.UTC().Format("2006-01-02T15:04:05Z")
+	}
+	return response
+}
@@ -0,0 +1,109 @@
+package routes
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/jhead/lanscape/lanscaped/internal/api/middleware"
+	"github.com/jhead/lanscape/lanscaped/internal/auth"
+	"github.com/jhead/lanscape/lanscaped/internal/authz"
+	"github.com/jhead/lanscape/lanscaped/internal/store"
+)
+
+// ed25519PublicKeySize is the length of an agent identity key
+const ed25519PublicKeySize = 32
+
+// IssueAttestationRequest represents the request to issue a membership attestation
+type IssueAttestationRequest struct {
+	NetworkID int64  `json:"network_id"`
+	PublicKey string `json:"public_key"` // agent ed25519 identity key, base64url
+}
+
+// IssueAttestationResponse represents the response from issuing an attestation
+type IssueAttestationResponse struct {
+	Attestation string `json:"attestation"`
+	ExpiresAt   string `json:"expires_at"`
+	// SignalingTopology hints how the agent should connect to the network's
+	// peers: auto, mesh, or relay
+	SignalingTopology string `json:"signaling_topology"`
+}
+
+// HandleIssueAttestation handles POST /v1/attestations
+// Signs an attestation that the caller's agent key belongs to a member of the
+// network. Agents exchange attestations in signaling metadata and verify them
+// against the JWKS before opening data channels.
+func HandleIssueAttestation(w http.ResponseWriter, r *http.Request, jwtService *auth.JWTService, dbStore *store.Store, authorizer *authz.Authorizer) {
+	log.Printf("Issue attestation request from %s", r.RemoteAddr)
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Extract JWT claims from context
+	claims, ok := middleware.GetClaimsFromContext(r)
+	if !ok {
+		log.Printf("Failed to extract JWT claims from context")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req IssueAttestationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		log.Printf("Error decoding request: %v", err)
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	key, err := base64.RawURLEncoding.DecodeString(req.PublicKey)
+	if err != nil || len(key) != ed25519PublicKeySize {
+		http.Error(w, "Invalid public key", http.StatusBadRequest)
+		return
+	}
+
+	// A revoked key must not regain access through a fresh attestation
+	if agent, err := dbStore.GetAgentByPublicKey(req.PublicKey); err == nil && agent.RevokedAt != nil {
+		http.Error(w, "Agent key has been revoked", http.StatusForbidden)
+		return
+	}
+
+	if !authorize(w, authorizer, claims.UserID, authz.Connect, authz.Network(req.NetworkID)) {
+		return
+	}
+
+	network, err := dbStore.GetNetworkByID(req.NetworkID)
+	if err != nil {
+		log.Printf("Error fetching network: %v", err)
+		http.Error(w, "Network not found", http.StatusNotFound)
+		return
+	}
+
+	settings, ok := networkSettings(w, dbStore, req.NetworkID)
+	if !ok {
+		return
+	}
+
+	attestation, expiresAt, err := jwtService.GenerateAttestation(claims.UserID, claims.Username, network.Name, req.PublicKey)
+	if err != nil {
+		log.Printf("Error generating attestation: %v", err)
+		http.Error(w, "Failed to generate attestation", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Issued attestation for user %s (ID: %d) in network %s", claims.Username, claims.UserID, network.Name)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+
+	response := IssueAttestationResponse{
+		Attestation:       attestation,
+		ExpiresAt:         expiresAt.UTC().Format("2006-01-02T15:04:05Z"),
+		SignalingTopology: string(settings.SignalingTopology),
+	}
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("Error encoding response: %v", err)
+	}
+}
@@ -9,6 +9,7 @@ import (
 
 	"github.com/jhead/lanscape/lanscaped/internal/api/middleware"
 	"github.com/jhead/lanscape/lanscaped/internal/auth"
+	"github.com/jhead/lanscape/lanscaped/internal/authz"
 	"github.com/jhead/lanscape/lanscaped/internal/store"
 )
 
@@ -18,8 +19,9 @@ type TokenResponse struct {
 }
 
 // HandleGetToken handles the token endpoint (protected by JWT middleware)
-// Mints a new JWT token with network-specific JID for XMPP authentication
-func HandleGetToken(w http.ResponseWriter, r *http.Request, jwtService *auth.JWTService, dbStore *store.Store) {
+// Mints a new JWT token with network-specific JID for XMPP authentication,
+// unless the network has chat disabled
+func HandleGetToken(w http.ResponseWriter, r *http.Request, jwtService *auth.JWTService, dbStore *store.Store, authorizer *authz.Authorizer) {
 	log.Printf("Get token request from %s", r.RemoteAddr)
 
 	if r.Method != http.MethodGet {
@@ -48,16 +50,7 @@ func HandleGetToken(w http.ResponseWriter, r *http.Request, jwtService *auth.JWT
 		return
 	}
 
-	// Verify user is a member of the network
-	isMember, err := dbStore.IsUserInNetwork(claims.UserID, networkID)
-	if err != nil {
-		log.Printf("Error checking network membership: %v", err)
-		http.Error(w, "Failed to verify network membership", http.StatusInternalServerError)
-		return
-	}
-
-	if !isMember {
-		http.Error(w, "User is not a member of this network", http.StatusForbidden)
+	if !authorize(w, authorizer, claims.UserID, authz.Connect, authz.Network(networkID)) {
 		return
 	}
 
@@ -69,6 +62,15 @@ func HandleGetToken(w http.ResponseWriter, r *http.Request, jwtService *auth.JWT
 		return
 	}
 
+	settings, ok := networkSettings(w, dbStore, networkID)
+	if !ok {
+		return
+	}
+	if !settings.ChatEnabled {
+		http.Error(w, "Chat is disabled for this network", http.StatusForbidden)
+		return
+	}
+
 	// Build JID based on network: username@chat.<network>.tsnet.jxh.io
 	jid := fmt.Sprintf("%s@chat.%s.tsnet.jxh.io", claims.Username, network.Name)
 
@@ -145,7 +147,7 @@ func HandleLogout(w http.ResponseWriter, r *http.Request) {
 		MaxAge:   -1,
 		HttpOnly: true,
 		SameSite: http.SameSiteLaxMode,
-		Secure:   false,
+		Secure:   middleware.IsHTTPS(r),
 	})
 
 	w.Header().Set("Content-Type", "application/json")
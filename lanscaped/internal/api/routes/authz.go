@@ -0,0 +1,45 @@
+package routes
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/jhead/lanscape/lanscaped/internal/authz"
+)
+
+// authorize checks that a user may take an action on a resource, writing an
+// error response if not
+func authorize(w http.ResponseWriter, authorizer *authz.Authorizer, userID int64, action authz.Action, resource authz.Resource) bool {
+	decision, err := authorizer.Can(userID, action, resource)
+	if err != nil {
+		log.Printf("Error authorizing %s for user %d: %v", action, userID, err)
+		http.Error(w, "Failed to check permissions", http.StatusInternalServerError)
+		return false
+	}
+	if !decision.Allowed {
+		log.Printf("Denied %s on network %d to user %d", action, resource.NetworkID, userID)
+		if decision.Hidden {
+			http.Error(w, "Network not found", http.StatusNotFound)
+			return false
+		}
+		http.Error(w, decision.Reason(), http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// authorizedNetworkID parses the network ID path variable and checks that the
+// user may take an action on the network, writing an error response if not
+func authorizedNetworkID(w http.ResponseWriter, r *http.Request, authorizer *authz.Authorizer, userID int64, action authz.Action) (int64, bool) {
+	networkID, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid network ID", http.StatusBadRequest)
+		return 0, false
+	}
+
+	if !authorize(w, authorizer, userID, action, authz.Network(networkID)) {
+		return 0, false
+	}
+	return networkID, true
+}
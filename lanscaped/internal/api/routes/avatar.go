@@ -0,0 +1,256 @@
+package routes
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jhead/lanscape/lanscaped/internal/api/middleware"
+	"github.com/jhead/lanscape/lanscaped/internal/authz"
+	"github.com/jhead/lanscape/lanscaped/internal/blob"
+	"github.com/jhead/lanscape/lanscaped/internal/store"
+)
+
+// MaxAvatarSize bounds an uploaded avatar image, in bytes
+const MaxAvatarSize = 512 << 10
+
+// avatarExtensions are the image types accepted as avatars, by the content
+// type sniffed from the upload, with the extension they are stored under
+var avatarExtensions = map[string]string{
+	"image/png":  ".png",
+	"image/jpeg": ".jpg",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+// avatarURL returns the path a network's avatar is served at, or empty if it
+// has none. The path changes with the image, so it can be cached for long.
+func avatarURL(network *store.Network) string {
+	if network.Avatar == "" {
+		return ""
+	}
+	version := strings.TrimSuffix(path.Base(network.Avatar), path.Ext(network.Avatar))
+	return fmt.Sprintf("/v1/networks/%d/avatar?v=%s", network.ID, version)
+}
+
+// networkMetadata returns a network's metadata for responses, never nil so
+// it encodes as an object
+func networkMetadata(network *store.Network) map[string]string {
+	if network.Metadata == nil {
+		return map[string]string{}
+	}
+	return network.Metadata
+}
+
+// deleteAvatar deletes a replaced avatar image. A failure only leaves an
+// unreferenced blob behind, so it is logged rather than failing the request.
+func deleteAvatar(avatars blob.Store, key string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := avatars.Delete(ctx, key); err != nil {
+		log.Printf("Error deleting avatar %s: %v", key, err)
+	}
+}
+
+// HandleUploadNetworkAvatar handles PUT /v1/networks/{id}/avatar
+// Replaces a network's avatar with the PNG, JPEG, GIF, or WebP image in the
+// request body, which takes the same permission as its settings, and
+// returns the network.
+func HandleUploadNetworkAvatar(w http.ResponseWriter, r *http.Request, dbStore *store.Store, authorizer *authz.Authorizer, avatars blob.Store) {
+	log.Printf("Upload network avatar request from %s", r.RemoteAddr)
+
+	claims, ok := middleware.GetClaimsFromContext(r)
+	if !ok {
+		log.Printf("Failed to extract JWT claims from context")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	networkID, ok := authorizedNetworkID(w, r, authorizer, claims.UserID, authz.ManageSettings)
+	if !ok {
+		return
+	}
+
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, MaxAvatarSize))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, fmt.Sprintf("Avatar must be at most %d KiB", MaxAvatarSize>>10), http.StatusRequestEntityTooLarge)
+			return
+		}
+		log.Printf("Error reading avatar: %v", err)
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if len(data) == 0 {
+		http.Error(w, "Avatar image is required", http.StatusBadRequest)
+		return
+	}
+
+	// The declared Content-Type is not trusted; the image is served as the
+	// type it actually is
+	contentType := http.DetectContentType(data)
+	ext, ok := avatarExtensions[contentType]
+	if !ok {
+		http.Error(w, "Avatar must be a PNG, JPEG, GIF, or WebP image", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	network, err := dbStore.GetNetworkByID(networkID)
+	if err != nil {
+		log.Printf("Error fetching network: %v", err)
+		http.Error(w, "Network not found", http.StatusNotFound)
+		return
+	}
+
+	sum := sha256.Sum256(data)
+	key := fmt.Sprintf("networks/%d/%s%s", networkID, hex.EncodeToString(sum[:8]), ext)
+	if err := avatars.Put(r.Context(), key, data, contentType); err != nil {
+		log.Printf("Error storing avatar of network %d: %v", networkID, err)
+		http.Error(w, "Failed to store avatar", http.StatusInternalServerError)
+		return
+	}
+
+	previous, err := dbStore.SetNetworkAvatar(networkID, key)
+	if err != nil {
+		log.Printf("Error updating avatar of network %d: %v", networkID, err)
+		http.Error(w, "Failed to update network", http.StatusInternalServerError)
+		return
+	}
+	if previous != "" && previous != key {
+		deleteAvatar(avatars, previous)
+	}
+	network.Avatar = key
+
+	log.Printf("User %s (ID: %d) changed the avatar of network %s", claims.Username, claims.UserID, network.Name)
+	detail := networkDetail(network)
+	detail["fields"] = []string{"avatar"}
+	recordAudit(dbStore, r, claims.UserID, auditNetworkUpdated, detail)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	if err := json.NewEncoder(w).Encode(networkResponse(network)); err != nil {
+		log.Printf("Error encoding response: %v", err)
+	}
+}
+
+// HandleDeleteNetworkAvatar handles DELETE /v1/networks/{id}/avatar
+// Removes a network's avatar and returns the network.
+func HandleDeleteNetworkAvatar(w http.ResponseWriter, r *http.Request, dbStore *store.Store, authorizer *authz.Authorizer, avatars blob.Store) {
+	log.Printf("Delete network avatar request from %s", r.RemoteAddr)
+
+	claims, ok := middleware.GetClaimsFromContext(r)
+	if !ok {
+		log.Printf("Failed to extract JWT claims from context")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	networkID, ok := authorizedNetworkID(w, r, authorizer, claims.UserID, authz.ManageSettings)
+	if !ok {
+		return
+	}
+
+	network, err := dbStore.GetNetworkByID(networkID)
+	if err != nil {
+		log.Printf("Error fetching network: %v", err)
+		http.Error(w, "Network not found", http.StatusNotFound)
+		return
+	}
+
+	previous, err := dbStore.SetNetworkAvatar(networkID, "")
+	if err != nil {
+		log.Printf("Error removing avatar of network %d: %v", networkID, err)
+		http.Error(w, "Failed to update network", http.StatusInternalServerError)
+		return
+	}
+	if previous != "" {
+		deleteAvatar(avatars, previous)
+
+		log.Printf("User %s (ID: %d) removed the avatar of network %s", claims.Username, claims.UserID, network.Name)
+		detail := networkDetail(network)
+		detail["fields"] = []string{"avatar"}
+		recordAudit(dbStore, r, claims.UserID, auditNetworkUpdated, detail)
+	}
+	network.Avatar = ""
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	if err := json.NewEncoder(w).Encode(networkResponse(network)); err != nil {
+		log.Printf("Error encoding response: %v", err)
+	}
+}
+
+// HandleGetNetworkAvatar handles GET /v1/networks/{id}/avatar
+// Serves a network's avatar to anyone who can see the network. The JWT
+// cookie authenticates image requests from the web UI.
+func HandleGetNetworkAvatar(w http.ResponseWriter, r *http.Request, dbStore *store.Store, authorizer *authz.Authorizer, avatars blob.Store) {
+	claims, ok := middleware.GetClaimsFromContext(r)
+	if !ok {
+		log.Printf("Failed to extract JWT claims from context")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	networkID, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid network ID", http.StatusBadRequest)
+		return
+	}
+
+	network, err := dbStore.GetNetworkByID(networkID)
+	if err != nil {
+		http.Error(w, "Network not found", http.StatusNotFound)
+		return
+	}
+	if !authorize(w, authorizer, claims.UserID, authz.ViewNetwork, authz.Network(network.ID)) {
+		return
+	}
+	if network.Avatar == "" {
+		http.Error(w, "Network has no avatar", http.StatusNotFound)
+		return
+	}
+
+	etag := `"` + strings.TrimSuffix(path.Base(network.Avatar), path.Ext(network.Avatar)) + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	data, contentType, err := avatars.Get(r.Context(), network.Avatar)
+	if err != nil {
+		log.Printf("Error reading avatar of network %d: %v", networkID, err)
+		if errors.Is(err, blob.ErrNotFound) {
+			http.Error(w, "Network has no avatar", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Failed to get avatar", http.StatusInternalServerError)
+		return
+	}
+	if _, ok := avatarExtensions[contentType]; !ok {
+		// Only ever serve the image types accepted on upload
+		contentType = http.DetectContentType(data)
+		if _, ok := avatarExtensions[contentType]; !ok {
+			contentType = "application/octet-stream"
+		}
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
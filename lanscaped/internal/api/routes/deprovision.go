@@ -0,0 +1,265 @@
+package routes
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/jhead/lanscape/lanscaped/internal/authz"
+	"github.com/jhead/lanscape/lanscaped/internal/store"
+	"github.com/jhead/lanscape/lanscaped/internal/tailnet"
+)
+
+// PlanResponse represents what a destructive operation would do, returned
+// instead of doing it when the request has ?dry_run=true
+type PlanResponse struct {
+	DryRun    bool   `json:"dry_run"`
+	Action    string `json:"action"`
+	NetworkID int64  `json:"network_id"`
+	Network   string `json:"network"`
+	// Memberships are removed, and Devices are forgotten
+	Memberships []PlannedMembershipResponse `json:"memberships"`
+	Devices     []DeviceResponse            `json:"devices"`
+	// AgentKeys are disconnected from the network's signaling topic
+	AgentKeys []string `json:"agent_keys"`
+	// Avatar is deleted from the avatar store
+	Avatar bool `json:"avatar,omitempty"`
+	// Deprovision is what happens to each member's Headscale account
+	Deprovision []DeprovisionPlanResponse `json:"deprovision"`
+}
+
+// PlannedMembershipResponse represents a membership an operation removes
+type PlannedMembershipResponse struct {
+	UserID   int64  `json:"user_id"`
+	Username string `json:"username"`
+}
+
+// DeprovisionPlanResponse represents what the network's tailnet_deprovision
+// setting does to one former member's Headscale account
+type DeprovisionPlanResponse struct {
+	UserID   int64  `json:"user_id"`
+	Username string `json:"username"`
+	Mode     string `json:"mode"`
+	// KeptFor names another network on the same Headscale the user is still
+	// a member of, which keeps the account as it is
+	KeptFor         string                `json:"kept_for,omitempty"`
+	HeadscaleUserID string                `json:"headscale_user_id,omitempty"`
+	Nodes           []PlannedNodeResponse `json:"nodes,omitempty"`
+	// ExpirePreauthKeys are the IDs of the preauth keys expired
+	ExpirePreauthKeys []string `json:"expire_preauth_keys,omitempty"`
+	DeleteUser        bool     `json:"delete_user,omitempty"`
+	// Error is set when Headscale could not be read; nothing more is done
+	Error string `json:"error,omitempty"`
+
+	preauthKeys []string // the keys of ExpirePreauthKeys
+}
+
+// PlannedNodeResponse represents a Headscale node deprovisioning deletes or
+// expires
+type PlannedNodeResponse struct {
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	Action string `json:"action"`
+}
+
+// dryRun reports whether the request asks for a plan with ?dry_run=true,
+// writing an error response if the parameter is invalid
+func dryRun(w http.ResponseWriter, r *http.Request) (dryRun, ok bool) {
+	v := r.URL.Query().Get("dry_run")
+	if v == "" {
+		return false, true
+	}
+	dryRun, err := strconv.ParseBool(v)
+	if err != nil {
+		http.Error(w, "dry_run must be true or false", http.StatusBadRequest)
+		return false, false
+	}
+	return dryRun, true
+}
+
+// writePlan writes a plan as the response of a dry run
+func writePlan(w http.ResponseWriter, plan PlanResponse) {
+	plan.DryRun = true
+	if plan.Memberships == nil {
+		plan.Memberships = []PlannedMembershipResponse{}
+	}
+	if plan.Devices == nil {
+		plan.Devices = []DeviceResponse{}
+	}
+	if plan.AgentKeys == nil {
+		plan.AgentKeys = []string{}
+	}
+	if plan.Deprovision == nil {
+		plan.Deprovision = []DeprovisionPlanResponse{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	if err := json.NewEncoder(w).Encode(plan); err != nil {
+		log.Printf("Error encoding plan: %v", err)
+	}
+}
+
+// planDevices returns the devices a user, or every member if userID is 0,
+// has in a network
+func planDevices(dbStore *store.Store, networkID, userID int64) ([]DeviceResponse, error) {
+	devices, err := dbStore.ListNetworkDevices(networkID)
+	if err != nil {
+		return nil, err
+	}
+	var planned []DeviceResponse
+	for _, device := range devices {
+		if userID == 0 || device.UserID == userID {
+			planned = append(planned, deviceResponse(device))
+		}
+	}
+	return planned, nil
+}
+
+// planLeave writes the plan of a user leaving a network
+func planLeave(w http.ResponseWriter, r *http.Request, dbStore *store.Store, userID int64, username string, network *store.Network, mode store.Deprovision) {
+	isMember, err := dbStore.IsUserInNetwork(userID, network.ID)
+	if err != nil {
+		log.Printf("Error checking membership: %v", err)
+		http.Error(w, "Failed to plan leaving the network", http.StatusInternalServerError)
+		return
+	}
+	if !isMember {
+		http.Error(w, "User is not a member of this network", http.StatusNotFound)
+		return
+	}
+
+	plan := PlanResponse{
+		Action:      string(authz.LeaveNetwork),
+		NetworkID:   network.ID,
+		Network:     network.Name,
+		Memberships: []PlannedMembershipResponse{{UserID: userID, Username: username}},
+		Deprovision: []DeprovisionPlanResponse{planDeprovision(r.Context(), dbStore, userID, username, network, mode)},
+	}
+	if plan.Devices, err = planDevices(dbStore, network.ID, userID); err == nil {
+		plan.AgentKeys, err = dbStore.ListAgentKeys(userID)
+	}
+	if err != nil {
+		log.Printf("Error planning user %d leaving network %d: %v", userID, network.ID, err)
+		http.Error(w, "Failed to plan leaving the network", http.StatusInternalServerError)
+		return
+	}
+	writePlan(w, plan)
+}
+
+// planDeprovision works out what a network's tailnet_deprovision setting
+// does to the Headscale account of a user who is leaving it. An account the
+// user still needs for another network on the same Headscale is kept.
+func planDeprovision(ctx context.Context, dbStore *store.Store, userID int64, username string, network *store.Network, mode store.Deprovision) DeprovisionPlanResponse {
+	plan := DeprovisionPlanResponse{UserID: userID, Username: username, Mode: string(mode)}
+	if mode == store.DeprovisionNone {
+		return plan
+	}
+
+	networks, err := dbStore.GetUserNetworks(userID)
+	if err != nil {
+		plan.Error = "failed to list the user's networks: " + err.Error()
+		return plan
+	}
+	for _, other := range networks {
+		if other.ID != network.ID && other.HeadscaleEndpoint == network.HeadscaleEndpoint {
+			plan.KeptFor = other.Name
+			return plan
+		}
+	}
+
+	headscaleClient := tailnet.NewClientWithEndpoint(network.HeadscaleEndpoint, network.APIKey).WithContext(ctx)
+	user, err := headscaleClient.GetUser(username)
+	if err != nil {
+		plan.Error = "failed to fetch the Headscale user: " + err.Error()
+		return plan
+	}
+	plan.HeadscaleUserID = user.ID
+	nodes, err := headscaleClient.ListNodes(username)
+	if err != nil {
+		plan.Error = "failed to list the Headscale nodes: " + err.Error()
+		return plan
+	}
+	for _, node := range nodes {
+		action := "expire"
+		if mode == store.DeprovisionDelete {
+			action = "delete"
+		}
+		plan.Nodes = append(plan.Nodes, PlannedNodeResponse{ID: node.ID, Name: node.Name, Action: action})
+	}
+
+	if mode == store.DeprovisionDelete {
+		// Deleting the user also deletes its preauth keys
+		plan.DeleteUser = true
+		return plan
+	}
+
+	headscaleUserID, err := strconv.ParseUint(user.ID, 10, 64)
+	if err != nil {
+		plan.Error = "invalid Headscale user ID " + strconv.Quote(user.ID)
+		return plan
+	}
+	keys, err := headscaleClient.ListPreauthKeys(headscaleUserID)
+	if err != nil {
+		plan.Error = "failed to list the Headscale preauth keys: " + err.Error()
+		return plan
+	}
+	for _, key := range keys {
+		if key.Used && !key.Reusable {
+			continue
+		}
+		plan.ExpirePreauthKeys = append(plan.ExpirePreauthKeys, key.ID)
+		plan.preauthKeys = append(plan.preauthKeys, key.Key)
+	}
+	return plan
+}
+
+// deprovisionMember applies a network's tailnet_deprovision setting to the
+// Headscale account of a user who is no longer a member, as planDeprovision
+// plans it. The membership change is already stored, so failures are only
+// logged, and it runs to the end even if ctx is canceled.
+func deprovisionMember(ctx context.Context, dbStore *store.Store, userID int64, username string, network *store.Network, mode store.Deprovision) {
+	ctx = context.WithoutCancel(ctx)
+	plan := planDeprovision(ctx, dbStore, userID, username, network, mode)
+	switch {
+	case mode == store.DeprovisionNone:
+		return
+	case plan.Error != "":
+		log.Printf("Error deprovisioning Headscale user %s: %s", username, plan.Error)
+		return
+	case plan.KeptFor != "":
+		log.Printf("Keeping Headscale user %s: still a member of network %s on the same Headscale", username, plan.KeptFor)
+		return
+	}
+
+	headscaleClient := tailnet.NewClientWithEndpoint(network.HeadscaleEndpoint, network.APIKey).WithContext(ctx)
+	log.Printf("Deprovisioning user %s (%s) in Headscale endpoint: %s", username, mode, network.HeadscaleEndpoint)
+	for _, node := range plan.Nodes {
+		var err error
+		if node.Action == "delete" {
+			err = headscaleClient.DeleteNode(node.ID)
+		} else {
+			err = headscaleClient.ExpireNode(node.ID)
+		}
+		if err != nil {
+			log.Printf("Error deprovisioning Headscale node %s of %s: %v", node.ID, username, err)
+		}
+	}
+
+	if plan.DeleteUser {
+		if err := headscaleClient.DeleteUser(plan.HeadscaleUserID); err != nil {
+			log.Printf("Error deleting Headscale user %s: %v", username, err)
+		}
+		return
+	}
+
+	headscaleUserID, _ := strconv.ParseUint(plan.HeadscaleUserID, 10, 64)
+	for i, key := range plan.preauthKeys {
+		if err := headscaleClient.ExpirePreauthKey(headscaleUserID, key); err != nil {
+			log.Printf("Error expiring Headscale preauth key %s of %s: %v", plan.ExpirePreauthKeys[i], username, err)
+		}
+	}
+}
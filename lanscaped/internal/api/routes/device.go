@@ -0,0 +1,222 @@
+package routes
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jhead/lanscape/lanscaped/internal/api/middleware"
+	"github.com/jhead/lanscape/lanscaped/internal/auth"
+	"github.com/jhead/lanscape/lanscaped/internal/store"
+)
+
+const (
+	// deviceCodeTTL is how long a user has to approve a device sign-in
+	deviceCodeTTL = 10 * time.Minute
+	// devicePollInterval is how often a device should poll for its token
+	devicePollInterval = 5 * time.Second
+	// userCodeAlphabet avoids vowels and look-alike characters so codes are
+	// easy to type and never spell words
+	userCodeAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+)
+
+// DeviceCodeResponse represents the response from starting a device sign-in
+type DeviceCodeResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int    `json:"expires_in"` // seconds
+	Interval                int    `json:"interval"`   // seconds between polls
+}
+
+// ApproveDeviceRequest represents a signed-in user's approval of a user code
+type ApproveDeviceRequest struct {
+	UserCode string `json:"user_code"`
+}
+
+// DeviceTokenRequest represents a device polling for its token
+type DeviceTokenRequest struct {
+	DeviceCode string `json:"device_code"`
+}
+
+// DeviceTokenResponse represents the token issued to an approved device
+type DeviceTokenResponse struct {
+	Token     string `json:"token"`
+	Username  string `json:"username"`
+	ExpiresAt string `json:"expires_at"`
+}
+
+// DeviceTokenError is returned while a device sign-in cannot complete:
+// "authorization_pending" until the user approves, "expired_token" once the
+// device code has expired or was already used
+type DeviceTokenError struct {
+	Error string `json:"error"`
+}
+
+// HandleRequestDeviceCode handles POST /v1/device/code
+// Starts a device sign-in for a device without a browser, such as an agent.
+// The device shows the user code and polls /v1/device/token until a
+// signed-in user approves the code at the verification URI.
+func HandleRequestDeviceCode(w http.ResponseWriter, r *http.Request, dbStore *store.Store, verificationURI string) {
+	log.Printf("Device code request from %s", r.RemoteAddr)
+
+	deviceCode, err := randomDeviceCode()
+	if err != nil {
+		log.Printf("Error generating device code: %v", err)
+		http.Error(w, "Failed to generate device code", http.StatusInternalServerError)
+		return
+	}
+	userCode, err := randomUserCode()
+	if err != nil {
+		log.Printf("Error generating user code: %v", err)
+		http.Error(w, "Failed to generate device code", http.StatusInternalServerError)
+		return
+	}
+
+	if err := dbStore.CreateDeviceCode(deviceCode, userCode, time.Now().Add(deviceCodeTTL)); err != nil {
+		log.Printf("Error storing device code: %v", err)
+		http.Error(w, "Failed to create device code", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+
+	response := DeviceCodeResponse{
+		DeviceCode:              deviceCode,
+		UserCode:                userCode,
+		VerificationURI:         verificationURI,
+		VerificationURIComplete: verificationURI + "?code=" + userCode,
+		ExpiresIn:               int(deviceCodeTTL.Seconds()),
+		Interval:                int(devicePollInterval.Seconds()),
+	}
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("Error encoding device code response: %v", err)
+	}
+}
+
+// HandleApproveDevice handles POST /v1/device/approve
+// Grants a pending device sign-in to the signed-in user
+func HandleApproveDevice(w http.ResponseWriter, r *http.Request, dbStore *store.Store) {
+	log.Printf("Approve device request from %s", r.RemoteAddr)
+
+	claims, ok := middleware.GetClaimsFromContext(r)
+	if !ok {
+		log.Printf("Failed to extract JWT claims from context")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req ApproveDeviceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		log.Printf("Error decoding request: %v", err)
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	userCode := strings.ToUpper(strings.TrimSpace(req.UserCode))
+	if err := dbStore.ApproveDeviceCode(userCode, claims.UserID); err != nil {
+		log.Printf("Error approving device code: %v", err)
+		http.Error(w, "Code not found or expired", http.StatusNotFound)
+		return
+	}
+
+	log.Printf("User %s (ID: %d) approved a device sign-in", claims.Username, claims.UserID)
+	recordAudit(dbStore, r, claims.UserID, auditDeviceApproved, map[string]any{"user_code": userCode})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleDeviceToken handles POST /v1/device/token
+// Issues a device token once the device code has been approved. The device
+// code is single-use.
+func HandleDeviceToken(w http.ResponseWriter, r *http.Request, jwtService *auth.JWTService, dbStore *store.Store) {
+	var req DeviceTokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		log.Printf("Error decoding request: %v", err)
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	code, err := dbStore.GetDeviceCode(req.DeviceCode)
+	if err != nil {
+		writeDeviceTokenError(w, "expired_token")
+		return
+	}
+	if code.UserID == 0 {
+		writeDeviceTokenError(w, "authorization_pending")
+		return
+	}
+
+	user, err := dbStore.GetUserByID(code.UserID)
+	if err != nil {
+		log.Printf("Error fetching user: %v", err)
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	token, expiresAt, err := jwtService.GenerateDeviceToken(user.ID, user.Username)
+	if err != nil {
+		log.Printf("Error generating device token: %v", err)
+		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+		return
+	}
+	if err := dbStore.DeleteDeviceCode(code.DeviceCode); err != nil {
+		log.Printf("Error deleting device code: %v", err)
+	}
+
+	log.Printf("Issued device token for user %s (ID: %d)", user.Username, user.ID)
+	recordAudit(dbStore, r, user.ID, auditDeviceSignedIn, nil)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	response := DeviceTokenResponse{
+		Token:     token,
+		Username:  user.Username,
+		ExpiresAt: expiresAt.UTC().Format("2006-01-02T15:04:05Z"),
+	}
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("Error encoding device token response: %v", err)
+	}
+}
+
+// writeDeviceTokenError tells a polling device why it has no token yet
+func writeDeviceTokenError(w http.ResponseWriter, code string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	if err := json.NewEncoder(w).Encode(DeviceTokenError{Error: code}); err != nil {
+		log.Printf("Error encoding device token error: %v", err)
+	}
+}
+
+// randomDeviceCode returns an unguessable code the device polls with
+func randomDeviceCode() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// randomUserCode returns a short code such as "BDFG-HJKL" for the user to type
+func randomUserCode() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	code := make([]byte, 0, 9)
+	for i, v := range b {
+		if i == 4 {
+			code = append(code, '-')
+		}
+		code = append(code, userCodeAlphabet[int(v)%len(userCodeAlphabet)])
+	}
+	return string(code), nil
+}
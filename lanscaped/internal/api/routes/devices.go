@@ -1,6 +1,7 @@
 package routes
 
 import (
+	"context"
 	"encoding/json"
 	"log"
 	"net/http"
@@ -8,6 +9,7 @@ import (
 	"time"
 
 	"github.com/jhead/lanscape/lanscaped/internal/api/middleware"
+	"github.com/jhead/lanscape/lanscaped/internal/authz"
 	"github.com/jhead/lanscape/lanscaped/internal/store"
 	"github.com/jhead/lanscape/lanscaped/internal/tailnet"
 )
@@ -23,10 +25,26 @@ type AdoptDeviceRequest struct {
 type AdoptDeviceResponse struct {
 	PreauthKey        string `json:"preauth_key"`
 	HeadscaleEndpoint string `json:"headscale_endpoint"`
+	ExpiresAt         string `json:"expires_at"`
+	// Instructions covers the requested platform, or every platform if none
+	// or an unknown one was requested
+	Instructions []OnboardingInstructionsResponse `json:"instructions"`
+	// QRPayload is a lanscape://adopt deep link to render as a QR code for
+	// mobile devices
+	QRPayload string `json:"qr_payload"`
+}
+
+// OnboardingInstructionsResponse represents how to onboard a device on one
+// platform
+type OnboardingInstructionsResponse struct {
+	Platform string   `json:"platform"`
+	Steps    []string `json:"steps"`
+	Commands []string `json:"commands,omitempty"`
+	DeepLink string   `json:"deep_link,omitempty"`
 }
 
 // HandleAdoptDevice handles device adoption
-func HandleAdoptDevice(w http.ResponseWriter, r *http.Request, store *store.Store) {
+func HandleAdoptDevice(w http.ResponseWriter, r *http.Request, store *store.Store, authorizer *authz.Authorizer) {
 	log.Printf("Device adoption request from %s", r.RemoteAddr)
 
 	if r.Method != http.MethodPost {
@@ -67,38 +85,85 @@ func HandleAdoptDevice(w http.ResponseWriter, r *http.Request, store *store.Stor
 		return
 	}
 
-	// Check if user is a member of the network
-	isMember, err := store.IsUserInNetwork(userID, req.NetworkID)
-	if err != nil {
-		log.Printf("Error checking network membership: %v", err)
-		http.Error(w, "Failed to verify network membership", http.StatusInternalServerError)
+	if !authorize(w, authorizer, userID, authz.AdoptDevice, authz.Network(req.NetworkID)) {
+		return
+	}
+
+	settings, ok := networkSettings(w, store, req.NetworkID)
+	if !ok {
 		return
 	}
 
-	if !isMember {
-		log.Printf("User %s (ID: %d) is not a member of network %s (ID: %d)", username, userID, network.Name, req.NetworkID)
-		http.Error(w, "You must be a member of this network to add devices", http.StatusForbidden)
+	expiration := time.Now().Add(settings.DefaultKeyExpiry)
+	preauthKey, ok := createPreauthKey(r.Context(), w, network, username, expiration)
+	if !ok {
 		return
 	}
 
+	log.Printf("Successfully created preauth key for user %s in network %s", username, network.Name)
+	detail := networkDetail(network)
+	detail["name"] = req.Name
+	detail["platform"] = req.Platform
+	recordAudit(store, r, userID, auditDeviceAdopted, detail)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+
+	enrollment := tailnet.Enrollment{
+		LoginServer: network.HeadscaleEndpoint,
+		AuthKey:     preauthKey,
+		Expires:     expiration,
+		Hostname:    req.Name,
+	}
+
+	response := AdoptDeviceResponse{
+		PreauthKey:        preauthKey,
+		HeadscaleEndpoint: network.HeadscaleEndpoint,
+		ExpiresAt:         expiration.UTC().Format("2006-01-02T15:04:05Z"),
+		Instructions:      onboardingInstructions(enrollment, tailnet.Platform(req.Platform)),
+		QRPayload:         enrollment.DeepLink(),
+	}
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("Error encoding device adoption response: %v", err)
+	}
+}
+
+// onboardingInstructions returns the instructions for platform, or for every
+// platform if it has none
+func onboardingInstructions(enrollment tailnet.Enrollment, platform tailnet.Platform) []OnboardingInstructionsResponse {
+	platforms := tailnet.Platforms
+	if _, ok := enrollment.Instructions(platform); ok {
+		platforms = []tailnet.Platform{platform}
+	}
+
+	response := make([]OnboardingInstructionsResponse, 0, len(platforms))
+	for _, p := range platforms {
+		instructions, _ := enrollment.Instructions(p)
+		response = append(response, OnboardingInstructionsResponse{
+			Platform: string(instructions.Platform),
+			Steps:    instructions.Steps,
+			Commands: instructions.Commands,
+			DeepLink: instructions.DeepLink,
+		})
+	}
+	return response
+}
+
+// createPreauthKey ensures the user exists in a network's Headscale and
+// creates a single-use preauth key for them, writing an error response on
+// failure
+func createPreauthKey(ctx context.Context, w http.ResponseWriter, network *store.Network, username string, expiration time.Time) (string, bool) {
 	// Create Headscale client for this network
-	headscaleClient := tailnet.NewClientWithEndpoint(network.HeadscaleEndpoint, network.APIKey)
+	headscaleClient := tailnet.NewClientWithEndpoint(network.HeadscaleEndpoint, network.APIKey).WithContext(ctx)
 
 	// Ensure user exists in Headscale (create if not exists)
 	log.Printf("Ensuring user %s exists in Headscale endpoint: %s", username, network.HeadscaleEndpoint)
-	_, err = headscaleClient.CreateUser(username)
+	userResp, err := headscaleClient.EnsureUser(username)
 	if err != nil {
 		log.Printf("Error ensuring user exists in Headscale: %v", err)
-		// Continue anyway - user might already exist
-	}
-
-	// Get user from Headscale to retrieve the user ID
-	log.Printf("Retrieving user %s from Headscale to get user ID", username)
-	userResp, err := headscaleClient.GetUser(username)
-	if err != nil {
-		log.Printf("Error retrieving user from Headscale: %v", err)
-		http.Error(w, "Failed to retrieve user from Headscale: "+err.Error(), http.StatusInternalServerError)
-		return
+		http.Error(w, "Failed to provision user in Headscale: "+err.Error(), http.StatusInternalServerError)
+		return "", false
 	}
 
 	// Convert user ID string to uint64
@@ -106,32 +171,18 @@ func HandleAdoptDevice(w http.ResponseWriter, r *http.Request, store *store.Stor
 	if err != nil {
 		log.Printf("Error parsing user ID: %v", err)
 		http.Error(w, "Failed to parse user ID: "+err.Error(), http.StatusInternalServerError)
-		return
+		return "", false
 	}
 
 	log.Printf("Retrieved user ID %d for user %s", headscaleUserID, username)
 
 	// Create preauth key in Headscale
-	// Set expiration to 24 hours from now
-	expiration := time.Now().Add(24 * time.Hour)
 	preauthResp, err := headscaleClient.CreatePreauthKey(headscaleUserID, false, false, &expiration)
 	if err != nil {
 		log.Printf("Error creating preauth key in Headscale: %v", err)
 		http.Error(w, "Failed to create preauth key: "+err.Error(), http.StatusInternalServerError)
-		return
+		return "", false
 	}
 
-	log.Printf("Successfully created preauth key for user %s in network %s", username, network.Name)
-
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
-
-	response := AdoptDeviceResponse{
-		PreauthKey:        preauthResp.PreAuthKey.Key,
-		HeadscaleEndpoint: network.HeadscaleEndpoint,
-	}
-
-	if err := json.NewEncoder(w).Encode(response); err != nil {
-		log.Printf("Error encoding device adoption response: %v", err)
-	}
+	return preauthResp.PreAuthKey.Key, true
 }
@@ -0,0 +1,247 @@
+package routes
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/jhead/lanscape/lanscaped/internal/api/middleware"
+	"github.com/jhead/lanscape/lanscaped/internal/authz"
+	"github.com/jhead/lanscape/lanscaped/internal/store"
+)
+
+// defaultDirectoryLimit and maxDirectoryLimit bound one directory search
+const (
+	defaultDirectoryLimit = 50
+	maxDirectoryLimit     = 200
+)
+
+// NetworkDirectoryResponse represents the public networks matching a search
+type NetworkDirectoryResponse struct {
+	Networks []DirectoryEntryResponse `json:"networks"`
+}
+
+// DirectoryEntryResponse represents a public network in the directory. It
+// leaves out the Headscale endpoint, which only members need.
+type DirectoryEntryResponse struct {
+	ID          int64             `json:"id"`
+	Name        string            `json:"name"`
+	Description string            `json:"description"`
+	Metadata    map[string]string `json:"metadata"`
+	AvatarURL   string            `json:"avatar_url,omitempty"`
+	MemberCount int64             `json:"member_count"`
+	CreatedAt   string            `json:"created_at"`
+}
+
+// UpdateNetworkRequest represents a change to how a network is listed.
+// Omitted fields are left as they are; metadata replaces all labels.
+type UpdateNetworkRequest struct {
+	Description *string            `json:"description"`
+	Visibility  *string            `json:"visibility"`
+	Metadata    *map[string]string `json:"metadata"`
+}
+
+// newNetworkListing returns the listing requested for a new network,
+// unlisted if no visibility was requested, after checking it
+func newNetworkListing(req CreateNetworkRequest) (store.Listing, error) {
+	listing := store.Listing{
+		Description: req.Description,
+		Visibility:  store.VisibilityUnlisted,
+		Metadata:    req.Metadata,
+	}
+	if req.Visibility != "" {
+		listing.Visibility = store.Visibility(req.Visibility)
+	}
+	if err := listing.Validate(); err != nil {
+		return store.Listing{}, err
+	}
+	return listing, nil
+}
+
+// joinNeedsApproval reports whether joining a network takes a request that
+// a member approves. Private networks always do, since outsiders should only
+// get in by invitation.
+func joinNeedsApproval(settings *store.NetworkSettings, network *store.Network) bool {
+	return settings.JoinApprovalRequired || network.Visibility == store.VisibilityPrivate
+}
+
+// HandleNetworkDirectory handles GET /v1/networks/directory
+// Searches the public networks by name and description. Every word of the
+// q query parameter must match; without q every public network is listed.
+func HandleNetworkDirectory(w http.ResponseWriter, r *http.Request, dbStore *store.Store) {
+	log.Printf("Network directory request from %s", r.RemoteAddr)
+
+	if _, ok := middleware.GetClaimsFromContext(r); !ok {
+		log.Printf("Failed to extract JWT claims from context")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	limit := defaultDirectoryLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxDirectoryLimit {
+			http.Error(w, "limit must be between 1 and "+strconv.Itoa(maxDirectoryLimit), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	networks, err := dbStore.SearchNetworks(r.URL.Query().Get("q"), limit)
+	if err != nil {
+		log.Printf("Error searching networks: %v", err)
+		http.Error(w, "Failed to search networks", http.StatusInternalServerError)
+		return
+	}
+
+	counts, err := dbStore.CountNetworkMembers()
+	if err != nil {
+		log.Printf("Error counting network members: %v", err)
+		http.Error(w, "Failed to search networks", http.StatusInternalServerError)
+		return
+	}
+
+	response := NetworkDirectoryResponse{Networks: make([]DirectoryEntryResponse, 0, len(networks))}
+	for _, network := range networks {
+		response.Networks = append(response.Networks, DirectoryEntryResponse{
+			ID:          network.ID,
+			Name:        network.Name,
+			Description: network.Description,
+			Metadata:    networkMetadata(network),
+			AvatarURL:   avatarURL(network),
+			MemberCount: counts[network.ID],
+			CreatedAt:   network.CreatedAt.Format("2006-01-02T15:04:05Z"),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("Error encoding response: %v", err)
+	}
+}
+
+// HandleUpdateNetwork handles PATCH /v1/networks/{id}
+// Changes a network's description, visibility, and metadata, which take the
+// same permission as its settings, and returns the network.
+func HandleUpdateNetwork(w http.ResponseWriter, r *http.Request, dbStore *store.Store, authorizer *authz.Authorizer) {
+	log.Printf("Update network request from %s", r.RemoteAddr)
+
+	claims, ok := middleware.GetClaimsFromContext(r)
+	if !ok {
+		log.Printf("Failed to extract JWT claims from context")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	networkID, ok := authorizedNetworkID(w, r, authorizer, claims.UserID, authz.ManageSettings)
+	if !ok {
+		return
+	}
+
+	var req UpdateNetworkRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		log.Printf("Error decoding request: %v", err)
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	network, err := dbStore.GetNetworkByID(networkID)
+	if err != nil {
+		log.Printf("Error fetching network: %v", err)
+		http.Error(w, "Network not found", http.StatusNotFound)
+		return
+	}
+
+	changed := []string{}
+	if req.Description != nil {
+		network.Description = *req.Description
+		changed = append(changed, "description")
+	}
+	if req.Visibility != nil {
+		network.Visibility = store.Visibility(*req.Visibility)
+		changed = append(changed, "visibility")
+	}
+	if req.Metadata != nil {
+		network.Metadata = *req.Metadata
+		changed = append(changed, "metadata")
+	}
+
+	if err := network.Listing.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := dbStore.UpdateNetworkListing(networkID, network.Listing); err != nil {
+		log.Printf("Error updating network %d: %v", networkID, err)
+		http.Error(w, "Failed to update network", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("User %s (ID: %d) changed %v of network %s", claims.Username, claims.UserID, changed, network.Name)
+	detail := networkDetail(network)
+	detail["fields"] = changed
+	detail["visibility"] = string(network.Visibility)
+	recordAudit(dbStore, r, claims.UserID, auditNetworkUpdated, detail)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	if err := json.NewEncoder(w).Encode(networkResponse(network)); err != nil {
+		log.Printf("Error encoding response: %v", err)
+	}
+}
+
+// NetworkDetailResponse represents one network with its member count
+type NetworkDetailResponse struct {
+	NetworkResponse
+	MemberCount int64 `json:"member_count"`
+}
+
+// HandleGetNetwork handles GET /v1/networks/{id}
+// Returns a network the user can see, with its member count. Private
+// networks are only found by their members and the users invited to them.
+func HandleGetNetwork(w http.ResponseWriter, r *http.Request, dbStore *store.Store, authorizer *authz.Authorizer) {
+	log.Printf("Get network request from %s", r.RemoteAddr)
+
+	claims, ok := middleware.GetClaimsFromContext(r)
+	if !ok {
+		log.Printf("Failed to extract JWT claims from context")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	networkID, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid network ID", http.StatusBadRequest)
+		return
+	}
+
+	network, err := dbStore.GetNetworkByID(networkID)
+	if err != nil {
+		http.Error(w, "Network not found", http.StatusNotFound)
+		return
+	}
+	if !authorize(w, authorizer, claims.UserID, authz.ViewNetwork, authz.Network(network.ID)) {
+		return
+	}
+
+	counts, err := dbStore.CountNetworkMembers()
+	if err != nil {
+		log.Printf("Error counting network members: %v", err)
+		http.Error(w, "Failed to get network", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	response := NetworkDetailResponse{NetworkResponse: networkResponse(network), MemberCount: counts[network.ID]}
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("Error encoding response: %v", err)
+	}
+}
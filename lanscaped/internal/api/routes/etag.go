@@ -0,0 +1,62 @@
+package routes
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// listETag computes a weak ETag for a list response from each row's ID and
+// update time, so polling an unchanged list is answered with a 304 without
+// encoding it. Rows added, removed, changed, or reordered change the ETag.
+type listETag struct {
+	hash   hash.Hash
+	newest time.Time
+}
+
+// newListETag starts an ETag for a list
+func newListETag() *listETag {
+	return &listETag{hash: sha256.New()}
+}
+
+// add adds a row, identified by fields, that last changed at updatedAt
+func (e *listETag) add(updatedAt time.Time, fields ...any) {
+	fmt.Fprintln(e.hash, append(fields, updatedAt.Unix())...)
+	if updatedAt.After(e.newest) {
+		e.newest = updatedAt
+	}
+}
+
+// String returns the ETag, or "" if a row changed within the last second:
+// update times are stored to the second, so the row could change again
+// without its update time moving
+func (e *listETag) String() string {
+	if !e.newest.Before(time.Now().Add(-time.Second)) {
+		return ""
+	}
+	return `W/"` + hex.EncodeToString(e.hash.Sum(nil)[:16]) + `"`
+}
+
+// notModified sets a list response's ETag and caching headers, and answers
+// 304 and returns true if the request's If-None-Match has the ETag. Lists
+// are per user and change at any time, so caches keep them private and
+// revalidate them every time. An empty etag is never matched.
+func notModified(w http.ResponseWriter, r *http.Request, etag string) bool {
+	w.Header().Set("Cache-Control", "private, no-cache")
+	if etag == "" {
+		return false
+	}
+	w.Header().Set("ETag", etag)
+	for _, candidate := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		// If-None-Match compares weakly
+		if strings.TrimPrefix(strings.TrimSpace(candidate), "W/") == strings.TrimPrefix(etag, "W/") {
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	}
+	return false
+}
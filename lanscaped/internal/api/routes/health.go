@@ -4,17 +4,84 @@ import (
 	"encoding/json"
 	"log"
 	"net/http"
+
+	"github.com/jhead/lanscape/lanscaped/internal/store"
 )
 
+// HealthResponse represents the health check response
+type HealthResponse struct {
+	Status   string                  `json:"status"`
+	Cache    CacheStatsResponse      `json:"cache"`
+	Database *DatabaseHealthResponse `json:"database,omitempty"`
+	Sessions *SessionStatsResponse   `json:"sessions,omitempty"`
+}
+
+// DatabaseHealthResponse represents the size of the database file and the
+// outcome of the latest maintenance run, if any ran since startup
+type DatabaseHealthResponse struct {
+	DatabaseStatsResponse
+	LastMaintenance string `json:"last_maintenance,omitempty"`
+	Intact          *bool  `json:"intact,omitempty"`
+}
+
+// CacheStatsResponse represents how well the store's lookup cache is doing
+type CacheStatsResponse struct {
+	Hits    uint64  `json:"hits"`
+	Misses  uint64  `json:"misses"`
+	HitRate float64 `json:"hit_rate"`
+}
+
+// SessionStatsResponse represents the size of the WebAuthn session table and
+// how it changed since startup
+type SessionStatsResponse struct {
+	Count           int64  `json:"count"`
+	PerUserLimit    int    `json:"per_user_limit"`
+	Limit           int    `json:"limit"`
+	Created         uint64 `json:"created"`
+	EvictedPerUser  uint64 `json:"evicted_per_user"`
+	EvictedOverflow uint64 `json:"evicted_overflow"`
+	Expired         uint64 `json:"expired"`
+}
+
 // handleHealthz handles the health check endpoint
-func HandleHealthz(w http.ResponseWriter, r *http.Request) {
+func HandleHealthz(w http.ResponseWriter, r *http.Request, dbStore *store.Store) {
 	log.Printf("Health check requested from %s", r.RemoteAddr)
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 
-	response := map[string]string{
-		"status": "ok",
+	stats := dbStore.CacheStats()
+	response := HealthResponse{
+		Status: "ok",
+		Cache: CacheStatsResponse{
+			Hits:    stats.Hits,
+			Misses:  stats.Misses,
+			HitRate: stats.HitRate(),
+		},
+	}
+	if dbStats, err := dbStore.DatabaseStats(r.Context()); err != nil {
+		log.Printf("Error reading database stats: %v", err)
+	} else {
+		response.Database = &DatabaseHealthResponse{DatabaseStatsResponse: databaseStats(dbStats)}
+		if last := dbStore.LastMaintenance(); last != nil {
+			intact := last.Healthy()
+			response.Database.LastMaintenance = last.StartedAt.UTC().Format("2006-01-02T15:04:05Z")
+			response.Database.Intact = &intact
+		}
+	}
+
+	if sessions, err := dbStore.SessionStats(r.Context()); err != nil {
+		log.Printf("Error reading session stats: %v", err)
+	} else {
+		response.Sessions = &SessionStatsResponse{
+			Count:           sessions.Count,
+			PerUserLimit:    sessions.PerUserLimit,
+			Limit:           sessions.Limit,
+			Created:         sessions.Created,
+			EvictedPerUser:  sessions.EvictedPerUser,
+			EvictedOverflow: sessions.EvictedOverflow,
+			Expired:         sessions.Expired,
+		}
 	}
 
 	if err := json.NewEncoder(w).Encode(response); err != nil {
@@ -0,0 +1,170 @@
+package routes
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/jhead/lanscape/lanscaped/internal/api/middleware"
+	"github.com/jhead/lanscape/lanscaped/internal/store"
+	"github.com/jhead/lanscape/lanscaped/internal/topics"
+)
+
+// ListInvitationsResponse represents the invitations waiting on the caller
+type ListInvitationsResponse struct {
+	Invitations []InvitationResponse `json:"invitations"`
+}
+
+// InvitationResponse represents an invitation to join a network
+type InvitationResponse struct {
+	NetworkID   int64  `json:"network_id"`
+	NetworkName string `json:"network_name"`
+	InvitedBy   string `json:"invited_by"`
+	InvitedAt   string `json:"invited_at"`
+}
+
+// HandleListInvitations handles GET /v1/invitations
+// Lists the caller's invitations to join networks, oldest first
+func HandleListInvitations(w http.ResponseWriter, r *http.Request, dbStore *store.Store) {
+	log.Printf("List invitations request from %s", r.RemoteAddr)
+
+	claims, ok := middleware.GetClaimsFromContext(r)
+	if !ok {
+		log.Printf("Failed to extract JWT claims from context")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	invitations, err := dbStore.ListInvitations(claims.UserID)
+	if err != nil {
+		log.Printf("Error listing invitations: %v", err)
+		http.Error(w, "Failed to list invitations", http.StatusInternalServerError)
+		return
+	}
+
+	response := ListInvitationsResponse{Invitations: make([]InvitationResponse, 0, len(invitations))}
+	for _, inv := range invitations {
+		response.Invitations = append(response.Invitations, InvitationResponse{
+			NetworkID:   inv.NetworkID,
+			NetworkName: inv.NetworkName,
+			InvitedBy:   inv.InvitedBy,
+			InvitedAt:   inv.CreatedAt.UTC().Format("2006-01-02T15:04:05Z"),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("Error encoding response: %v", err)
+	}
+}
+
+// HandleAcceptInvitation handles PUT /v1/invitations/{id}
+// Makes the caller a member of the network they were invited to and
+// provisions them as if they had joined themselves
+func HandleAcceptInvitation(w http.ResponseWriter, r *http.Request, dbStore *store.Store, signaling topics.Admin) {
+	log.Printf("Accept invitation request from %s", r.RemoteAddr)
+
+	claims, ok := middleware.GetClaimsFromContext(r)
+	if !ok {
+		log.Printf("Failed to extract JWT claims from context")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	network, ok := invitationNetwork(w, r, dbStore)
+	if !ok {
+		return
+	}
+
+	if err := dbStore.AcceptInvitation(claims.UserID, network.ID); err != nil {
+		log.Printf("Error accepting invitation: %v", err)
+		if strings.Contains(err.Error(), "not found") {
+			http.Error(w, "Invitation not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Failed to accept invitation", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("User %s (ID: %d) accepted an invitation to network %s", claims.Username, claims.UserID, network.Name)
+	recordAudit(dbStore, r, claims.UserID, auditNetworkJoined, networkDetail(network))
+
+	provisionMember(r.Context(), dbStore, signaling, claims.UserID, claims.Username, network)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	response := map[string]interface{}{
+		"success":    true,
+		"message":    "Invitation accepted",
+		"network_id": network.ID,
+	}
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("Error encoding response: %v", err)
+	}
+}
+
+// HandleDeclineInvitation handles DELETE /v1/invitations/{id}
+func HandleDeclineInvitation(w http.ResponseWriter, r *http.Request, dbStore *store.Store) {
+	log.Printf("Decline invitation request from %s", r.RemoteAddr)
+
+	claims, ok := middleware.GetClaimsFromContext(r)
+	if !ok {
+		log.Printf("Failed to extract JWT claims from context")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	network, ok := invitationNetwork(w, r, dbStore)
+	if !ok {
+		return
+	}
+
+	if err := dbStore.DeleteInvitation(claims.UserID, network.ID); err != nil {
+		log.Printf("Error declining invitation: %v", err)
+		if strings.Contains(err.Error(), "not found") {
+			http.Error(w, "Invitation not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Failed to decline invitation", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("User %s (ID: %d) declined an invitation to network %s", claims.Username, claims.UserID, network.Name)
+	recordAudit(dbStore, r, claims.UserID, auditInvitationDeclined, networkDetail(network))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	response := map[string]interface{}{
+		"success":    true,
+		"message":    "Invitation declined",
+		"network_id": network.ID,
+	}
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("Error encoding response: %v", err)
+	}
+}
+
+// invitationNetwork resolves the network of an invitation route
+func invitationNetwork(w http.ResponseWriter, r *http.Request, dbStore *store.Store) (*store.Network, bool) {
+	networkID, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid network ID", http.StatusBadRequest)
+		return nil, false
+	}
+
+	network, err := dbStore.GetNetworkByID(networkID)
+	if err != nil {
+		log.Printf("Error fetching network: %v", err)
+		http.Error(w, "Invitation not found", http.StatusNotFound)
+		return nil, false
+	}
+	return network, true
+}
@@ -0,0 +1,227 @@
+package routes
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/jhead/lanscape/lanscaped/internal/api/middleware"
+	"github.com/jhead/lanscape/lanscaped/internal/authz"
+	"github.com/jhead/lanscape/lanscaped/internal/store"
+	"github.com/jhead/lanscape/lanscaped/internal/topics"
+)
+
+// ListJoinRequestsResponse represents the pending requests to join a network
+type ListJoinRequestsResponse struct {
+	Requests []JoinRequestResponse `json:"requests"`
+}
+
+// JoinRequestResponse represents a user waiting to join a network
+type JoinRequestResponse struct {
+	UserID      int64  `json:"user_id"`
+	Username    string `json:"username"`
+	RequestedAt string `json:"requested_at"`
+}
+
+// requestToJoin records a request to join a network that requires approval
+func requestToJoin(w http.ResponseWriter, r *http.Request, dbStore *store.Store, userID int64, network *store.Network) {
+	isMember, err := dbStore.IsUserInNetwork(userID, network.ID)
+	if err != nil {
+		log.Printf("Error checking membership: %v", err)
+		http.Error(w, "Failed to join network", http.StatusInternalServerError)
+		return
+	}
+	if isMember {
+		http.Error(w, "User is already a member of this network", http.StatusConflict)
+		return
+	}
+
+	if err := dbStore.RequestToJoin(userID, network.ID); err != nil {
+		log.Printf("Error requesting to join network: %v", err)
+		http.Error(w, "Failed to join network", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("User ID %d requested to join network %s (ID: %d)", userID, network.Name, network.ID)
+	recordAudit(dbStore, r, userID, auditNetworkJoinRequested, networkDetail(network))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+
+	response := map[string]interface{}{
+		"success":    true,
+		"pending":    true,
+		"message":    "Join request sent; a member of the network must approve it",
+		"network_id": network.ID,
+	}
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("Error encoding response: %v", err)
+	}
+}
+
+// HandleListJoinRequests handles GET /v1/networks/{id}/join-requests
+func HandleListJoinRequests(w http.ResponseWriter, r *http.Request, dbStore *store.Store, authorizer *authz.Authorizer) {
+	log.Printf("List join requests request from %s", r.RemoteAddr)
+
+	claims, ok := middleware.GetClaimsFromContext(r)
+	if !ok {
+		log.Printf("Failed to extract JWT claims from context")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	networkID, ok := authorizedNetworkID(w, r, authorizer, claims.UserID, authz.ApproveJoin)
+	if !ok {
+		return
+	}
+
+	requests, err := dbStore.ListJoinRequests(networkID)
+	if err != nil {
+		log.Printf("Error listing join requests: %v", err)
+		http.Error(w, "Failed to list join requests", http.StatusInternalServerError)
+		return
+	}
+
+	response := ListJoinRequestsResponse{Requests: make([]JoinRequestResponse, 0, len(requests))}
+	for _, req := range requests {
+		response.Requests = append(response.Requests, JoinRequestResponse{
+			UserID:      req.UserID,
+			Username:    req.Username,
+			RequestedAt: req.CreatedAt.UTC().Format("2006-01-02T15:04:05Z"),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("Error encoding response: %v", err)
+	}
+}
+
+// HandleApproveJoinRequest handles PUT /v1/networks/{id}/join-requests/{user_id}
+// Makes the requesting user a member and provisions them as if they had
+// joined themselves.
+func HandleApproveJoinRequest(w http.ResponseWriter, r *http.Request, dbStore *store.Store, authorizer *authz.Authorizer, signaling topics.Admin) {
+	log.Printf("Approve join request request from %s", r.RemoteAddr)
+
+	claims, ok := middleware.GetClaimsFromContext(r)
+	if !ok {
+		log.Printf("Failed to extract JWT claims from context")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	network, user, ok := joinRequestTarget(w, r, dbStore, authorizer, claims.UserID)
+	if !ok {
+		return
+	}
+
+	if err := dbStore.ApproveJoinRequest(user.ID, network.ID); err != nil {
+		log.Printf("Error approving join request: %v", err)
+		if strings.Contains(err.Error(), "not found") {
+			http.Error(w, "Join request not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Failed to approve join request", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("User %s (ID: %d) approved %s (ID: %d) joining network %s", claims.Username, claims.UserID, user.Username, user.ID, network.Name)
+	detail := networkDetail(network)
+	detail["approved_by"] = claims.Username
+	recordAudit(dbStore, r, user.ID, auditNetworkJoined, detail)
+
+	provisionMember(r.Context(), dbStore, signaling, user.ID, user.Username, network)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	response := map[string]interface{}{
+		"success":    true,
+		"message":    "Join request approved",
+		"network_id": network.ID,
+		"user_id":    user.ID,
+	}
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("Error encoding response: %v", err)
+	}
+}
+
+// HandleRejectJoinRequest handles DELETE /v1/networks/{id}/join-requests/{user_id}
+func HandleRejectJoinRequest(w http.ResponseWriter, r *http.Request, dbStore *store.Store, authorizer *authz.Authorizer) {
+	log.Printf("Reject join request request from %s", r.RemoteAddr)
+
+	claims, ok := middleware.GetClaimsFromContext(r)
+	if !ok {
+		log.Printf("Failed to extract JWT claims from context")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	network, user, ok := joinRequestTarget(w, r, dbStore, authorizer, claims.UserID)
+	if !ok {
+		return
+	}
+
+	if err := dbStore.DeleteJoinRequest(user.ID, network.ID); err != nil {
+		log.Printf("Error rejecting join request: %v", err)
+		if strings.Contains(err.Error(), "not found") {
+			http.Error(w, "Join request not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Failed to reject join request", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("User %s (ID: %d) rejected %s (ID: %d) joining network %s", claims.Username, claims.UserID, user.Username, user.ID, network.Name)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	response := map[string]interface{}{
+		"success":    true,
+		"message":    "Join request rejected",
+		"network_id": network.ID,
+		"user_id":    user.ID,
+	}
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("Error encoding response: %v", err)
+	}
+}
+
+// joinRequestTarget resolves the network and requesting user of a join
+// request route, checking that the caller may decide on its requests
+func joinRequestTarget(w http.ResponseWriter, r *http.Request, dbStore *store.Store, authorizer *authz.Authorizer, callerID int64) (*store.Network, *store.User, bool) {
+	networkID, ok := authorizedNetworkID(w, r, authorizer, callerID, authz.ApproveJoin)
+	if !ok {
+		return nil, nil, false
+	}
+
+	userID, err := strconv.ParseInt(r.PathValue("user_id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return nil, nil, false
+	}
+
+	network, err := dbStore.GetNetworkByID(networkID)
+	if err != nil {
+		log.Printf("Error fetching network: %v", err)
+		http.Error(w, "Network not found", http.StatusNotFound)
+		return nil, nil, false
+	}
+
+	user, err := dbStore.GetUserByID(userID)
+	if err != nil {
+		log.Printf("Error fetching user: %v", err)
+		http.Error(w, "Join request not found", http.StatusNotFound)
+		return nil, nil, false
+	}
+
+	return network, user, true
+}
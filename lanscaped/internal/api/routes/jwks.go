@@ -49,7 +49,7 @@ func HandleJWKS(w http.ResponseWriter, r *http.Request, jwtService *auth.JWTServ
 	jwk := JWK{
 		Kty: "RSA",
 		Use: "sig",
-		Kid: "lanscape-key-1",
+		Kid: auth.SigningKeyID,
 		N:   base64.RawURLEncoding.EncodeToString(nBytes),
 		E:   base64.RawURLEncoding.EncodeToString(eBytes),
 		Alg: "RS256",
@@ -66,3 +66,39 @@ func HandleJWKS(w http.ResponseWriter, r *http.Request, jwtService *auth.JWTServ
 		log.Printf("Error encoding JWKS response: %v", err)
 	}
 }
+
+// TokenKeyMetadata names the algorithm and key a kind of token is signed with
+type TokenKeyMetadata struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	// JWKSURI is where the key is published, unset for shared secrets
+	JWKSURI string `json:"jwks_uri,omitempty"`
+}
+
+// TokenMetadata describes how lanscaped signs its tokens
+type TokenMetadata struct {
+	AccessTokens TokenKeyMetadata `json:"access_tokens"`
+	Attestations TokenKeyMetadata `json:"attestations"`
+}
+
+// HandleTokenMetadata handles GET /.well-known/lanscape.jwt.json
+// Advertises the algorithm and key ID of access tokens and attestations, so
+// clients can tell which key to expect when HS256 signs access tokens and
+// the JWKS holds only the attestation key. Secrets are never included.
+func HandleTokenMetadata(w http.ResponseWriter, r *http.Request, jwtService *auth.JWTService) {
+	alg, kid := jwtService.AccessTokenKey()
+	metadata := TokenMetadata{
+		AccessTokens: TokenKeyMetadata{Alg: alg, Kid: kid},
+		Attestations: TokenKeyMetadata{Alg: "RS256", Kid: auth.SigningKeyID, JWKSURI: "/.well-known/lanscape.jwks.json"},
+	}
+	if alg == auth.AlgRS256 {
+		metadata.AccessTokens.JWKSURI = metadata.Attestations.JWKSURI
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	if err := json.NewEncoder(w).Encode(metadata); err != nil {
+		log.Printf("Error encoding token metadata response: %v", err)
+	}
+}
@@ -0,0 +1,193 @@
+package routes
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/jhead/lanscape/lanscaped/internal/api/middleware"
+	"github.com/jhead/lanscape/lanscaped/internal/authz"
+	"github.com/jhead/lanscape/lanscaped/internal/store"
+	"github.com/jhead/lanscape/lanscaped/internal/topics"
+)
+
+// defaultLiveWindow is the window relay error rates cover by default
+const defaultLiveWindow = 5 * time.Minute
+
+// LiveResponse represents the live state of lanscaped and its signaling
+// server
+type LiveResponse struct {
+	GeneratedAt string                `json:"generated_at"`
+	Signaling   LiveSignalingResponse `json:"signaling"`
+	Networks    []LiveNetworkResponse `json:"networks"`
+	// Topics are the signaling server's topics, including any no network
+	// owns; empty when signaling stats are unavailable
+	Topics []LiveTopicResponse `json:"topics"`
+}
+
+// LiveSignalingResponse represents whether signaling stats could be fetched,
+// and relay totals across topics
+type LiveSignalingResponse struct {
+	Available     bool                `json:"available"`
+	Error         string              `json:"error,omitempty"`
+	WindowSeconds int64               `json:"window_seconds,omitempty"`
+	Relays        *RelayStatsResponse `json:"relays,omitempty"`
+}
+
+// LiveNetworkResponse represents a network's members and connected agents.
+// ConnectedAgents comes from presence reports, so it counts enrolled agents
+// only.
+type LiveNetworkResponse struct {
+	ID              int64  `json:"id"`
+	Name            string `json:"name"`
+	Topic           string `json:"topic"`
+	Members         int64  `json:"members"`
+	ConnectedAgents int64  `json:"connected_agents"`
+}
+
+// LiveTopicResponse represents a signaling topic
+type LiveTopicResponse struct {
+	Topic     string             `json:"topic"`
+	NetworkID int64              `json:"network_id,omitempty"`
+	Peers     int                `json:"peers"`
+	Observers int                `json:"observers"`
+	Relays    RelayStatsResponse `json:"relays"`
+}
+
+// RelayStatsResponse represents relay attempts within the window. Every
+// result other than delivered, or held for a reconnecting peer, counts as an
+// error.
+type RelayStatsResponse struct {
+	Attempts  int64            `json:"attempts"`
+	Errors    int64            `json:"errors"`
+	ErrorRate float64          `json:"error_rate"`
+	ByResult  map[string]int64 `json:"by_result"`
+}
+
+// HandleAdminLive handles GET /v1/admin/live
+// Summarizes every network's members and connected agents, the signaling
+// server's topics, and relay error rates over the last window (a duration,
+// 5m by default) from the signaling stats API. Only administrators may view
+// it. Signaling being unreachable is reported in the response rather than
+// failing it.
+func HandleAdminLive(w http.ResponseWriter, r *http.Request, dbStore *store.Store, authorizer *authz.Authorizer, signaling topics.Admin) {
+	log.Printf("Admin live request from %s", r.RemoteAddr)
+
+	claims, ok := middleware.GetClaimsFromContext(r)
+	if !ok {
+		log.Printf("Failed to extract JWT claims from context")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if !authorize(w, authorizer, claims.UserID, authz.ViewLive, authz.System) {
+		return
+	}
+
+	window := defaultLiveWindow
+	if v := r.URL.Query().Get("window"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			http.Error(w, "Invalid window", http.StatusBadRequest)
+			return
+		}
+		window = d
+	}
+
+	networks, err := dbStore.ListNetworks()
+	if err != nil {
+		log.Printf("Error listing networks: %v", err)
+		http.Error(w, "Failed to list networks", http.StatusInternalServerError)
+		return
+	}
+	members, err := dbStore.CountNetworkMembers()
+	if err != nil {
+		log.Printf("Error counting network members: %v", err)
+		http.Error(w, "Failed to count network members", http.StatusInternalServerError)
+		return
+	}
+	online, err := dbStore.CountOnlineAgents()
+	if err != nil {
+		log.Printf("Error counting online agents: %v", err)
+		http.Error(w, "Failed to count online agents", http.StatusInternalServerError)
+		return
+	}
+
+	response := LiveResponse{
+		GeneratedAt: time.Now().UTC().Format("2006-01-02T15:04:05Z"),
+		Networks:    make([]LiveNetworkResponse, 0, len(networks)),
+		Topics:      []LiveTopicResponse{},
+	}
+
+	networkByTopic := make(map[string]int64, len(networks))
+	for _, network := range networks {
+		topic := topics.TopicForNetwork(network.Name)
+		networkByTopic[topic] = network.ID
+		response.Networks = append(response.Networks, LiveNetworkResponse{
+			ID:              network.ID,
+			Name:            network.Name,
+			Topic:           topic,
+			Members:         members[network.ID],
+			ConnectedAgents: online[topic],
+		})
+	}
+	sort.Slice(response.Networks, func(i, j int) bool { return response.Networks[i].Name < response.Networks[j].Name })
+
+	if signaling == nil {
+		response.Signaling.Error = "no signaling admin API configured"
+	} else {
+		ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+		stats, err := signaling.Stats(ctx, window)
+		cancel()
+		if err != nil {
+			log.Printf("Error fetching signaling stats: %v", err)
+			response.Signaling.Error = err.Error()
+		} else {
+			response.Signaling.Available = true
+			response.Signaling.WindowSeconds = stats.WindowSeconds
+			total := map[string]int64{}
+			for _, t := range stats.Topics {
+				for result, n := range t.Relays {
+					total[result] += n
+				}
+				response.Topics = append(response.Topics, LiveTopicResponse{
+					Topic:     t.Topic,
+					NetworkID: networkByTopic[t.Topic],
+					Peers:     t.Peers,
+					Observers: t.Observers,
+					Relays:    relayStats(t.Relays),
+				})
+			}
+			relays := relayStats(total)
+			response.Signaling.Relays = &relays
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("Error encoding response: %v", err)
+	}
+}
+
+// relayStats summarizes relay counts by result
+func relayStats(byResult map[string]int64) RelayStatsResponse {
+	stats := RelayStatsResponse{ByResult: byResult}
+	if stats.ByResult == nil {
+		stats.ByResult = map[string]int64{}
+	}
+	for result, n := range stats.ByResult {
+		stats.Attempts += n
+		if result != "delivered" && result != "held" {
+			stats.Errors += n
+		}
+	}
+	if stats.Attempts > 0 {
+		stats.ErrorRate = float64(stats.Errors) / float64(stats.Attempts)
+	}
+	return stats
+}
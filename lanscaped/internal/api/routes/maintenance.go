@@ -0,0 +1,126 @@
+package routes
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/jhead/lanscape/lanscaped/internal/api/middleware"
+	"github.com/jhead/lanscape/lanscaped/internal/authz"
+	"github.com/jhead/lanscape/lanscaped/internal/store"
+)
+
+// MaintenanceResponse represents the database's current size and the latest
+// maintenance run
+type MaintenanceResponse struct {
+	Database DatabaseStatsResponse      `json:"database"`
+	Last     *MaintenanceReportResponse `json:"last_maintenance"`
+}
+
+// DatabaseStatsResponse represents the size of the database file
+type DatabaseStatsResponse struct {
+	SizeBytes     int64 `json:"size_bytes"`
+	FreeBytes     int64 `json:"free_bytes"`
+	PageSize      int64 `json:"page_size"`
+	PageCount     int64 `json:"page_count"`
+	FreelistCount int64 `json:"freelist_count"`
+}
+
+// MaintenanceReportResponse represents one maintenance run
+type MaintenanceReportResponse struct {
+	StartedAt  string                `json:"started_at"`
+	DurationMs int64                 `json:"duration_ms"`
+	Healthy    bool                  `json:"healthy"`
+	Integrity  []string              `json:"integrity,omitempty"`
+	Converted  bool                  `json:"converted,omitempty"`
+	FreedPages int64                 `json:"freed_pages"`
+	Before     DatabaseStatsResponse `json:"before"`
+	After      DatabaseStatsResponse `json:"after"`
+}
+
+// HandleGetMaintenance handles GET /v1/admin/maintenance
+// Returns the database's current size and the report of the latest
+// maintenance run, null if none ran since startup. Only administrators may
+// view it.
+func HandleGetMaintenance(w http.ResponseWriter, r *http.Request, dbStore *store.Store, authorizer *authz.Authorizer) {
+	if !authorizeMaintenance(w, r, authorizer) {
+		return
+	}
+
+	stats, err := dbStore.DatabaseStats(r.Context())
+	if err != nil {
+		log.Printf("Error reading database stats: %v", err)
+		http.Error(w, "Failed to read database stats", http.StatusInternalServerError)
+		return
+	}
+	writeMaintenance(w, stats, dbStore.LastMaintenance())
+}
+
+// HandleRunMaintenance handles POST /v1/admin/maintenance
+// Runs database maintenance now and returns its report: an integrity check,
+// then an incremental vacuum if the database is intact. Only administrators
+// may run it; a run already in progress is 409 Conflict.
+func HandleRunMaintenance(w http.ResponseWriter, r *http.Request, dbStore *store.Store, authorizer *authz.Authorizer) {
+	if !authorizeMaintenance(w, r, authorizer) {
+		return
+	}
+
+	report, err := dbStore.Maintain(r.Context())
+	if errors.Is(err, store.ErrMaintenanceRunning) {
+		http.Error(w, "Maintenance is already running", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("Error running database maintenance: %v", err)
+		http.Error(w, "Failed to run maintenance", http.StatusInternalServerError)
+		return
+	}
+	writeMaintenance(w, report.After, report)
+}
+
+// authorizeMaintenance checks that the caller is an administrator
+func authorizeMaintenance(w http.ResponseWriter, r *http.Request, authorizer *authz.Authorizer) bool {
+	claims, ok := middleware.GetClaimsFromContext(r)
+	if !ok {
+		log.Printf("Failed to extract JWT claims from context")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return authorize(w, authorizer, claims.UserID, authz.MaintainDatabase, authz.System)
+}
+
+// writeMaintenance writes the database's size and a maintenance report
+func writeMaintenance(w http.ResponseWriter, stats store.DatabaseStats, report *store.MaintenanceReport) {
+	response := MaintenanceResponse{Database: databaseStats(stats)}
+	if report != nil {
+		response.Last = &MaintenanceReportResponse{
+			StartedAt:  report.StartedAt.UTC().Format("2006-01-02T15:04:05Z"),
+			DurationMs: report.Duration.Milliseconds(),
+			Healthy:    report.Healthy(),
+			Integrity:  report.Integrity,
+			Converted:  report.Converted,
+			FreedPages: report.FreedPages,
+			Before:     databaseStats(report.Before),
+			After:      databaseStats(report.After),
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("Error encoding response: %v", err)
+	}
+}
+
+// databaseStats converts database stats for a response
+func databaseStats(stats store.DatabaseStats) DatabaseStatsResponse {
+	return DatabaseStatsResponse{
+		SizeBytes:     stats.SizeBytes(),
+		FreeBytes:     stats.FreeBytes(),
+		PageSize:      stats.PageSize,
+		PageCount:     stats.PageCount,
+		FreelistCount: stats.FreelistCount,
+	}
+}
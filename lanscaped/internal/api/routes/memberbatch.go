@@ -0,0 +1,239 @@
+package routes
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/jhead/lanscape/lanscaped/internal/api/middleware"
+	"github.com/jhead/lanscape/lanscaped/internal/authz"
+	"github.com/jhead/lanscape/lanscaped/internal/store"
+	"github.com/jhead/lanscape/lanscaped/internal/topics"
+)
+
+// maxMemberBatch bounds the usernames in one membership batch, so a batch
+// fits in one transaction without holding the database for long
+const maxMemberBatch = 500
+
+// maxMemberBatchBody bounds the size of a membership batch request
+const maxMemberBatchBody = 256 << 10
+
+// Statuses of a user in a membership batch
+const (
+	batchInvited        = "invited"         // the user was invited, and joins by accepting
+	batchAlreadyInvited = "already_invited" // nothing to do
+	batchAlreadyMember  = "already_member"  // nothing to do
+	batchRemoved        = "removed"         // the user is no longer a member
+	batchNotMember      = "not_member"      // nothing to do
+	batchNotFound       = "not_found"       // no account of that name
+	batchInvalid        = "invalid"         // the item was rejected; see its error
+)
+
+// MemberBatchRequest represents users to add to and remove from a network.
+// Items are lanscaped usernames; an email address is taken as the username
+// of the same name, as Headscale users often are.
+type MemberBatchRequest struct {
+	Invite []string `json:"invite"`
+	Remove []string `json:"remove"`
+}
+
+// MemberBatchResponse represents the outcome of a membership batch, one
+// result per requested item in request order, invitations first
+type MemberBatchResponse struct {
+	Results []MemberBatchResultResponse `json:"results"`
+	Invited int                         `json:"invited"`
+	Removed int                         `json:"removed"`
+}
+
+// MemberBatchResultResponse represents what a membership batch did for one
+// item
+type MemberBatchResultResponse struct {
+	Username string `json:"username"`
+	Action   string `json:"action"`
+	Status   string `json:"status"`
+	UserID   int64  `json:"user_id,omitempty"`
+	// Queued is set when signaling and Headscale deprovisioning for a
+	// removed user was queued, to run after the response
+	Queued bool   `json:"queued,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// HandleMemberBatch handles POST /v1/networks/{id}/members:batch
+// Invites and removes many users in one call, for administrators moving
+// existing groups into a network. Invited users must already have an
+// account, and become members only when they accept the invitation (see
+// HandleAcceptInvitation); no accounts are created. Removed users leave as
+// if they had left themselves. The changes are stored in one transaction
+// per action; signaling and Headscale are updated in the background
+// afterwards, in request order.
+func HandleMemberBatch(w http.ResponseWriter, r *http.Request, dbStore *store.Store, authorizer *authz.Authorizer, signaling topics.Admin) {
+	log.Printf("Member batch request from %s", r.RemoteAddr)
+
+	claims, ok := middleware.GetClaimsFromContext(r)
+	if !ok {
+		log.Printf("Failed to extract JWT claims from context")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	networkID, ok := authorizedNetworkID(w, r, authorizer, claims.UserID, authz.ManageMembers)
+	if !ok {
+		return
+	}
+
+	var req MemberBatchRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxMemberBatchBody)).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if len(req.Invite)+len(req.Remove) == 0 {
+		http.Error(w, "Nothing to invite or remove", http.StatusBadRequest)
+		return
+	}
+	if len(req.Invite)+len(req.Remove) > maxMemberBatch {
+		http.Error(w, "Too many users in one batch", http.StatusBadRequest)
+		return
+	}
+
+	network, err := dbStore.GetNetworkByID(networkID)
+	if err != nil {
+		log.Printf("Error fetching network: %v", err)
+		http.Error(w, "Network not found", http.StatusNotFound)
+		return
+	}
+	settings, ok := networkSettings(w, dbStore, networkID)
+	if !ok {
+		return
+	}
+
+	invites, inviteResults := batchItems(req.Invite, "invite", nil)
+	removals, removeResults := batchItems(req.Remove, "remove", invites)
+
+	invited, err := dbStore.InviteMembers(networkID, claims.UserID, invites)
+	if err != nil {
+		log.Printf("Error inviting members to network %d: %v", networkID, err)
+		http.Error(w, "Failed to invite members", http.StatusInternalServerError)
+		return
+	}
+	removed, err := dbStore.RemoveMembers(networkID, removals)
+	if err != nil {
+		log.Printf("Error removing members from network %d: %v", networkID, err)
+		http.Error(w, "Failed to remove members", http.StatusInternalServerError)
+		return
+	}
+
+	response := MemberBatchResponse{Results: make([]MemberBatchResultResponse, 0, len(req.Invite)+len(req.Remove))}
+	var deprovision []*store.User
+	for _, result := range invited {
+		item := MemberBatchResultResponse{Username: result.Username, Action: "invite", Status: batchNotFound}
+		switch {
+		case result.User == nil:
+		case result.Member:
+			item.UserID = result.User.ID
+			item.Status = batchAlreadyMember
+		case result.Changed:
+			item.UserID = result.User.ID
+			item.Status = batchInvited
+			response.Invited++
+
+			detail := networkDetail(network)
+			detail["invited_by"] = claims.Username
+			recordAudit(dbStore, r, result.User.ID, auditNetworkInvited, detail)
+		default:
+			item.UserID = result.User.ID
+			item.Status = batchAlreadyInvited
+		}
+		inviteResults[result.Username] = item
+	}
+	for _, result := range removed {
+		item := MemberBatchResultResponse{Username: result.Username, Action: "remove", Status: batchNotFound}
+		if result.User != nil {
+			item.UserID = result.User.ID
+			item.Status = batchNotMember
+		}
+		if result.Changed {
+			item.Status = batchRemoved
+			item.Queued = true
+			deprovision = append(deprovision, result.User)
+			response.Removed++
+
+			detail := networkDetail(network)
+			detail["removed_by"] = claims.Username
+			recordAudit(dbStore, r, result.User.ID, auditNetworkLeft, detail)
+		}
+		removeResults[result.Username] = item
+	}
+	response.Results = append(response.Results, batchResults(req.Invite, inviteResults)...)
+	response.Results = append(response.Results, batchResults(req.Remove, removeResults)...)
+
+	log.Printf("User %s (ID: %d) invited %d and removed %d members of network %s in a batch",
+		claims.Username, claims.UserID, response.Invited, response.Removed, network.Name)
+
+	if len(deprovision) > 0 {
+		go func() {
+			ctx := context.WithoutCancel(r.Context())
+			dbStore := dbStore.WithContext(ctx)
+			for _, user := range deprovision {
+				if signaling != nil {
+					syncMembership(ctx, dbStore, signaling, user.ID, network.Name, topics.RemoveMember)
+				}
+				deprovisionMember(ctx, dbStore, user.ID, user.Username, network, settings.TailnetDeprovision)
+			}
+			log.Printf("Deprovisioned %d members of network %s", len(deprovision), network.Name)
+		}()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("Error encoding response: %v", err)
+	}
+}
+
+// batchItems returns the valid, distinct usernames among items, and the
+// results of the items rejected, keyed by item. Items also in exclude, the
+// usernames of the other action, are rejected as conflicting.
+func batchItems(items []string, action string, exclude []string) ([]string, map[string]MemberBatchResultResponse) {
+	results := make(map[string]MemberBatchResultResponse, len(items))
+	reject := func(item, reason string) {
+		results[item] = MemberBatchResultResponse{Username: item, Action: action, Status: batchInvalid, Error: reason}
+	}
+
+	conflicts := make(map[string]bool, len(exclude))
+	for _, username := range exclude {
+		conflicts[username] = true
+	}
+	var usernames []string
+	seen := make(map[string]bool, len(items))
+	for _, item := range items {
+		switch {
+		case seen[item]:
+			// Reported once, with the first occurrence's result
+		case strings.TrimSpace(item) != item || item == "":
+			reject(item, "username is empty or has surrounding spaces")
+		case conflicts[item]:
+			reject(item, "username is both invited and removed")
+		default:
+			usernames = append(usernames, item)
+		}
+		seen[item] = true
+	}
+	return usernames, results
+}
+
+// batchResults returns the result of each distinct item, in request order
+func batchResults(items []string, results map[string]MemberBatchResultResponse) []MemberBatchResultResponse {
+	ordered := make([]MemberBatchResultResponse, 0, len(results))
+	seen := make(map[string]bool, len(items))
+	for _, item := range items {
+		if seen[item] {
+			continue
+		}
+		seen[item] = true
+		ordered = append(ordered, results[item])
+	}
+	return ordered
+}
@@ -1,32 +1,34 @@
 package routes
 
 import (
+	"context"
 	"encoding/json"
 	"log"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/jhead/lanscape/lanscaped/internal/api/middleware"
+	"github.com/jhead/lanscape/lanscaped/internal/authz"
+	"github.com/jhead/lanscape/lanscaped/internal/blob"
 	"github.com/jhead/lanscape/lanscaped/internal/store"
 	"github.com/jhead/lanscape/lanscaped/internal/tailnet"
+	"github.com/jhead/lanscape/lanscaped/internal/topics"
 )
 
 // CreateNetworkRequest represents the request to create a network
 type CreateNetworkRequest struct {
-	Name              string `json:"name"`
-	HeadscaleEndpoint string `json:"headscale_endpoint"`
-	APIKey            string `json:"api_key"`
+	Name              string            `json:"name"`
+	HeadscaleEndpoint string            `json:"headscale_endpoint"`
+	APIKey            string            `json:"api_key"`
+	Description       string            `json:"description"`
+	Visibility        string            `json:"visibility"` // public, unlisted (default), or private
+	Metadata          map[string]string `json:"metadata"`
 }
 
 // CreateNetworkResponse represents the response from creating a network
-type CreateNetworkResponse struct {
-	ID                int64  `json:"id"`
-	Name              string `json:"name"`
-	HeadscaleEndpoint string `json:"headscale_endpoint"`
-	CreatedAt         string `json:"created_at"`
-	// Note: API key is not returned in response for security
-}
+type CreateNetworkResponse = NetworkResponse
 
 // ListNetworksResponse represents the response from listing networks
 type ListNetworksResponse struct {
@@ -35,14 +37,51 @@ type ListNetworksResponse struct {
 
 // NetworkResponse represents a network in API responses
 type NetworkResponse struct {
-	ID                int64  `json:"id"`
-	Name              string `json:"name"`
-	HeadscaleEndpoint string `json:"headscale_endpoint"`
-	CreatedAt         string `json:"created_at"`
+	ID                int64             `json:"id"`
+	Name              string            `json:"name"`
+	HeadscaleEndpoint string            `json:"headscale_endpoint"`
+	Description       string            `json:"description"`
+	Visibility        string            `json:"visibility"`
+	Metadata          map[string]string `json:"metadata"`
+	AvatarURL         string            `json:"avatar_url,omitempty"`
+	CreatedAt         string            `json:"created_at"`
+	// Note: API key is not returned in response for security
 }
 
-// HandleCreateNetwork handles POST /v1/networks
-func HandleCreateNetwork(w http.ResponseWriter, r *http.Request, store *store.Store) {
+// networkResponse converts a network for API responses
+func networkResponse(network *store.Network) NetworkResponse {
+	return NetworkResponse{
+		ID:                network.ID,
+		Name:              network.Name,
+		HeadscaleEndpoint: network.HeadscaleEndpoint,
+		Description:       network.Description,
+		Visibility:        string(network.Visibility),
+		Metadata:          networkMetadata(network),
+		AvatarURL:         avatarURL(network),
+		CreatedAt:         network.CreatedAt.Format("2006-01-02T15:04:05Z"),
+	}
+}
+
+// ListMembersResponse represents the response from listing network members
+type ListMembersResponse struct {
+	Members []MemberResponse `json:"members"`
+}
+
+// MemberResponse represents a network member and whether any of their
+// agents is connected to the network's signaling topic
+type MemberResponse struct {
+	UserID   int64  `json:"user_id"`
+	Username string `json:"username"`
+	JoinedAt string `json:"joined_at"`
+	Online   bool   `json:"online"`
+	LastSeen string `json:"last_seen,omitempty"`
+}
+
+// HandleCreateNetwork handles POST /v1/networks. When a signaling admin is
+// configured the network's signaling topic is restricted to its members
+// before the network is returned; if that fails the network is removed
+// rather than left with an open topic.
+func HandleCreateNetwork(w http.ResponseWriter, r *http.Request, store *store.Store, signaling topics.Admin) {
 	log.Printf("Create network request from %s", r.RemoteAddr)
 
 	if r.Method != http.MethodPost {
@@ -79,9 +118,14 @@ func HandleCreateNetwork(w http.ResponseWriter, r *http.Request, store *store.St
 		http.Error(w, "Headscale endpoint is required", http.StatusBadRequest)
 		return
 	}
+	listing, err := newNetworkListing(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
 	// Create network
-	network, err := store.CreateNetwork(req.Name, req.HeadscaleEndpoint, req.APIKey)
+	network, err := store.CreateNetwork(req.Name, req.HeadscaleEndpoint, req.APIKey, listing)
 	if err != nil {
 		log.Printf("Error creating network: %v", err)
 		if strings.Contains(err.Error(), "UNIQUE constraint") {
@@ -94,19 +138,39 @@ func HandleCreateNetwork(w http.ResponseWriter, r *http.Request, store *store.St
 
 	log.Printf("Network created: %s (ID: %d)", network.Name, network.ID)
 
+	if signaling != nil {
+		ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+		err := topics.RegisterNetwork(ctx, signaling, network.Name)
+		cancel()
+		if err != nil {
+			log.Printf("Error registering signaling topic for network %s: %v", network.Name, err)
+			if err := store.DeleteNetwork(network.ID); err != nil {
+				log.Printf("Error removing network %s after failed topic registration: %v", network.Name, err)
+			}
+			http.Error(w, "Failed to register network topic with signaling", http.StatusBadGateway)
+			return
+		}
+		log.Printf("Registered signaling topic for network %s", network.Name)
+	}
+
+	recordAudit(store, r, userID, auditNetworkCreated, networkDetail(network))
+
 	// Auto-join the creator to the network
 	if err := store.JoinNetwork(userID, network.ID); err != nil {
 		log.Printf("Error joining user to network: %v", err)
 		// Network was created but user couldn't join - this is a partial failure
 		// We'll still return success but log the error
 		log.Printf("Warning: Network created but user %s (ID: %d) could not be auto-joined", username, userID)
+	} else if signaling != nil {
+		// A deleted network of the same name may have left bans behind
+		syncMembership(r.Context(), store, signaling, userID, network.Name, topics.AddMember)
 	}
 
 	// Auto-provision user in the network's headscale
 	// Use the network-specific API key
-	headscaleClient := tailnet.NewClientWithEndpoint(network.HeadscaleEndpoint, network.APIKey)
+	headscaleClient := tailnet.NewClientWithEndpoint(network.HeadscaleEndpoint, network.APIKey).WithContext(context.WithoutCancel(r.Context()))
 	log.Printf("Auto-provisioning user %s in Headscale endpoint: %s", username, network.HeadscaleEndpoint)
-	_, err = headscaleClient.CreateUser(username)
+	_, err = headscaleClient.EnsureUser(username)
 	if err != nil {
 		log.Printf("Error auto-provisioning user in Headscale: %v", err)
 		// Log but don't fail - user can be provisioned later
@@ -116,14 +180,7 @@ func HandleCreateNetwork(w http.ResponseWriter, r *http.Request, store *store.St
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
 
-	response := CreateNetworkResponse{
-		ID:                network.ID,
-		Name:              network.Name,
-		HeadscaleEndpoint: network.HeadscaleEndpoint,
-		CreatedAt:         network.CreatedAt.Format("2006-01-02T15:04:05Z"),
-	}
-
-	if err := json.NewEncoder(w).Encode(response); err != nil {
+	if err := json.NewEncoder(w).Encode(networkResponse(network)); err != nil {
 		log.Printf("Error encoding response: %v", err)
 	}
 }
@@ -138,32 +195,35 @@ func HandleListNetworks(w http.ResponseWriter, r *http.Request, store *store.Sto
 	}
 
 	// Extract JWT claims from context
-	_, ok := middleware.GetClaimsFromContext(r)
+	claims, ok := middleware.GetClaimsFromContext(r)
 	if !ok {
 		log.Printf("Failed to extract JWT claims from context")
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
 
-	// List all networks
-	networks, err := store.ListNetworks()
+	// List the networks the caller can see
+	networks, err := store.ListNetworksVisibleTo(claims.UserID)
 	if err != nil {
 		log.Printf("Error listing networks: %v", err)
 		http.Error(w, "Failed to list networks", http.StatusInternalServerError)
 		return
 	}
 
+	etag := newListETag()
+	for _, network := range networks {
+		etag.add(network.UpdatedAt, network.ID)
+	}
+	if notModified(w, r, etag.String()) {
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 
 	networkResponses := make([]NetworkResponse, len(networks))
 	for i, network := range networks {
-		networkResponses[i] = NetworkResponse{
-			ID:                network.ID,
-			Name:              network.Name,
-			HeadscaleEndpoint: network.HeadscaleEndpoint,
-			CreatedAt:         network.CreatedAt.Format("2006-01-02T15:04:05Z"),
-		}
+		networkResponses[i] = networkResponse(network)
 	}
 
 	response := ListNetworksResponse{
@@ -175,8 +235,77 @@ func HandleListNetworks(w http.ResponseWriter, r *http.Request, store *store.Sto
 	}
 }
 
-// HandleJoinNetwork handles PUT /v1/networks/:id/join
-func HandleJoinNetwork(w http.ResponseWriter, r *http.Request, store *store.Store) {
+// HandleListMembers handles GET /v1/networks/:id/members
+// Lists a network's members with their online status, as reported by the
+// signaling server. Only members may list them.
+func HandleListMembers(w http.ResponseWriter, r *http.Request, store *store.Store, authorizer *authz.Authorizer) {
+	log.Printf("List members request from %s", r.RemoteAddr)
+
+	claims, ok := middleware.GetClaimsFromContext(r)
+	if !ok {
+		log.Printf("Failed to extract JWT claims from context")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	networkID, ok := authorizedNetworkID(w, r, authorizer, claims.UserID, authz.ViewMembers)
+	if !ok {
+		return
+	}
+
+	network, err := store.GetNetworkByID(networkID)
+	if err != nil {
+		log.Printf("Error fetching network: %v", err)
+		http.Error(w, "Network not found", http.StatusNotFound)
+		return
+	}
+
+	members, err := store.ListNetworkMembers(networkID, topics.TopicForNetwork(network.Name))
+	if err != nil {
+		log.Printf("Error listing members: %v", err)
+		http.Error(w, "Failed to list members", http.StatusInternalServerError)
+		return
+	}
+
+	// A member changes when they join and when their presence does
+	etag := newListETag()
+	for _, member := range members {
+		updatedAt := member.JoinedAt
+		if member.LastSeen != nil && member.LastSeen.After(updatedAt) {
+			updatedAt = *member.LastSeen
+		}
+		etag.add(updatedAt, member.UserID, member.Username, member.JoinedAt.Unix(), member.Online)
+	}
+	if notModified(w, r, etag.String()) {
+		return
+	}
+
+	response := ListMembersResponse{Members: make([]MemberResponse, 0, len(members))}
+	for _, member := range members {
+		m := MemberResponse{
+			UserID:   member.UserID,
+			Username: member.Username,
+			JoinedAt: member.JoinedAt.UTC().Format("2006-01-02T15:04:05Z"),
+			Online:   member.Online,
+		}
+		if member.LastSeen != nil {
+			m.LastSeen = member.LastSeen.UTC().Format("2006-01-02T15:04:05Z")
+		}
+		response.Members = append(response.Members, m)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("Error encoding response: %v", err)
+	}
+}
+
+// HandleJoinNetwork handles PUT /v1/networks/:id/join. Bans left in the
+// network's signaling topic from an earlier leave are lifted. On networks
+// that require approval, a join request is left for a member to approve.
+func HandleJoinNetwork(w http.ResponseWriter, r *http.Request, store *store.Store, authorizer *authz.Authorizer, signaling topics.Admin) {
 	log.Printf("Join network request from %s", r.RemoteAddr)
 
 	if r.Method != http.MethodPut {
@@ -210,6 +339,10 @@ func HandleJoinNetwork(w http.ResponseWriter, r *http.Request, store *store.Stor
 
 	log.Printf("Processing network join for user: %s (ID: %d) to network ID: %d", username, userID, networkID)
 
+	if !authorize(w, authorizer, userID, authz.JoinNetwork, authz.Network(networkID)) {
+		return
+	}
+
 	// Check if network exists
 	network, err := store.GetNetworkByID(networkID)
 	if err != nil {
@@ -217,6 +350,19 @@ func HandleJoinNetwork(w http.ResponseWriter, r *http.Request, store *store.Stor
 		http.Error(w, "Network not found", http.StatusNotFound)
 		return
 	}
+	// Strangers can neither find a private network nor queue requests for it
+	if !authorize(w, authorizer, userID, authz.ViewNetwork, authz.Network(networkID)) {
+		return
+	}
+
+	settings, ok := networkSettings(w, store, networkID)
+	if !ok {
+		return
+	}
+	if joinNeedsApproval(settings, network) {
+		requestToJoin(w, r, store, userID, network)
+		return
+	}
 
 	// Join network
 	if err := store.JoinNetwork(userID, networkID); err != nil {
@@ -230,24 +376,120 @@ func HandleJoinNetwork(w http.ResponseWriter, r *http.Request, store *store.Stor
 	}
 
 	log.Printf("User %s (ID: %d) joined network %s (ID: %d)", username, userID, network.Name, networkID)
+	recordAudit(store, r, userID, auditNetworkJoined, networkDetail(network))
+
+	provisionMember(r.Context(), store, signaling, userID, username, network)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	response := map[string]interface{}{
+		"success":    true,
+		"message":    "Successfully joined network",
+		"network_id": networkID,
+	}
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("Error encoding response: %v", err)
+	}
+}
+
+// provisionMember gives a new member of a network access to it: bans left
+// in the network's signaling topic from an earlier leave are lifted, and the
+// user is created in the network's Headscale. The membership is already
+// stored, so failures are only logged.
+func provisionMember(ctx context.Context, store *store.Store, signaling topics.Admin, userID int64, username string, network *store.Network) {
+	if signaling != nil {
+		syncMembership(ctx, store, signaling, userID, network.Name, topics.AddMember)
+	}
 
 	// Auto-provision user in the network's headscale
 	// Use the network-specific API key
-	headscaleClient := tailnet.NewClientWithEndpoint(network.HeadscaleEndpoint, network.APIKey)
+	headscaleClient := tailnet.NewClientWithEndpoint(network.HeadscaleEndpoint, network.APIKey).WithContext(context.WithoutCancel(ctx))
 	log.Printf("Auto-provisioning user %s in Headscale endpoint: %s", username, network.HeadscaleEndpoint)
-	_, err = headscaleClient.CreateUser(username)
-	if err != nil {
+	if _, err := headscaleClient.EnsureUser(username); err != nil {
 		log.Printf("Error auto-provisioning user in Headscale: %v", err)
 		// Log but don't fail - user can be provisioned later
 		log.Printf("Warning: User %s could not be auto-provisioned in Headscale for network %s", username, network.Name)
 	}
+}
+
+// HandleLeaveNetwork handles DELETE /v1/networks/:id/join. The user's
+// agents are disconnected from the network's signaling topic right away
+// instead of staying connected until they next reconnect, and their
+// Headscale account is deprovisioned as the network's settings say.
+func HandleLeaveNetwork(w http.ResponseWriter, r *http.Request, store *store.Store, authorizer *authz.Authorizer, signaling topics.Admin) {
+	log.Printf("Leave network request from %s", r.RemoteAddr)
+
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Extract JWT claims from context
+	claims, ok := middleware.GetClaimsFromContext(r)
+	if !ok {
+		log.Printf("Failed to extract JWT claims from context")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	userID := claims.UserID
+	username := claims.Username
+
+	networkID, ok := authorizedNetworkID(w, r, authorizer, userID, authz.LeaveNetwork)
+	if !ok {
+		return
+	}
+	dryRun, ok := dryRun(w, r)
+	if !ok {
+		return
+	}
+
+	network, err := store.GetNetworkByID(networkID)
+	if err != nil {
+		log.Printf("Error fetching network: %v", err)
+		http.Error(w, "Network not found", http.StatusNotFound)
+		return
+	}
+
+	settings, ok := networkSettings(w, store, networkID)
+	if !ok {
+		return
+	}
+
+	if dryRun {
+		planLeave(w, r, store, userID, username, network, settings.TailnetDeprovision)
+		return
+	}
+
+	if err := store.LeaveNetwork(userID, networkID); err != nil {
+		log.Printf("Error leaving network: %v", err)
+		if strings.Contains(err.Error(), "not a member") {
+			http.Error(w, "User is not a member of this network", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Failed to leave network", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("User %s (ID: %d) left network %s (ID: %d)", username, userID, network.Name, networkID)
+	recordAudit(store, r, userID, auditNetworkLeft, networkDetail(network))
+
+	if signaling != nil {
+		syncMembership(r.Context(), store, signaling, userID, network.Name, topics.RemoveMember)
+	}
+	deprovisionMember(r.Context(), store, userID, username, network, settings.TailnetDeprovision)
+	if err := store.DeleteUserDevices(userID, networkID); err != nil {
+		log.Printf("Error forgetting devices of user %d: %v", userID, err)
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 
 	response := map[string]interface{}{
 		"success":    true,
-		"message":    "Successfully joined network",
+		"message":    "Successfully left network",
 		"network_id": networkID,
 	}
 
@@ -256,8 +498,29 @@ func HandleJoinNetwork(w http.ResponseWriter, r *http.Request, store *store.Stor
 	}
 }
 
-// HandleDeleteNetwork handles DELETE /v1/networks/:id
-func HandleDeleteNetwork(w http.ResponseWriter, r *http.Request, store *store.Store) {
+// syncMembership applies a membership change for all of a user's agents to
+// a network's signaling topic. The change is already stored, so failures
+// are only logged; the topic ACL still refuses the user once their
+// attestations expire.
+func syncMembership(ctx context.Context, store *store.Store, signaling topics.Admin, userID int64, network string,
+	apply func(context.Context, topics.Admin, string, []string) error) {
+	keys, err := store.ListAgentKeys(userID)
+	if err != nil {
+		log.Printf("Error listing agents of user %d: %v", userID, err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	if err := apply(ctx, signaling, network, keys); err != nil {
+		log.Printf("Error updating signaling topic for network %s: %v", network, err)
+	}
+}
+
+// HandleDeleteNetwork handles DELETE /v1/networks/:id. Every peer is
+// disconnected from the network's signaling topic, and members' Headscale
+// accounts are deprovisioned in the background as the network's settings
+// say.
+func HandleDeleteNetwork(w http.ResponseWriter, r *http.Request, store *store.Store, authorizer *authz.Authorizer, signaling topics.Admin, avatars blob.Store) {
 	log.Printf("Delete network request from %s", r.RemoteAddr)
 
 	if r.Method != http.MethodDelete {
@@ -266,7 +529,7 @@ func HandleDeleteNetwork(w http.ResponseWriter, r *http.Request, store *store.St
 	}
 
 	// Extract JWT claims from context
-	_, ok := middleware.GetClaimsFromContext(r)
+	claims, ok := middleware.GetClaimsFromContext(r)
 	if !ok {
 		log.Printf("Failed to extract JWT claims from context")
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
@@ -288,6 +551,57 @@ func HandleDeleteNetwork(w http.ResponseWriter, r *http.Request, store *store.St
 
 	log.Printf("Processing network deletion for network ID: %d", networkID)
 
+	if !authorize(w, authorizer, claims.UserID, authz.DeleteNetwork, authz.Network(networkID)) {
+		return
+	}
+
+	dryRun, ok := dryRun(w, r)
+	if !ok {
+		return
+	}
+
+	// Look up the network and its members' agents before the memberships
+	// are deleted with it
+	network, err := store.GetNetworkByID(networkID)
+	if err != nil {
+		log.Printf("Error fetching network: %v", err)
+		http.Error(w, "Network not found", http.StatusNotFound)
+		return
+	}
+	keys, err := store.ListNetworkAgentKeys(networkID)
+	if err != nil {
+		log.Printf("Error listing agents of network %d: %v", networkID, err)
+	}
+	settings, ok := networkSettings(w, store, networkID)
+	if !ok {
+		return
+	}
+	members, err := store.ListNetworkMembers(networkID, topics.TopicForNetwork(network.Name))
+	if err != nil {
+		log.Printf("Error listing members of network %d: %v", networkID, err)
+	}
+
+	if dryRun {
+		plan := PlanResponse{
+			Action:    string(authz.DeleteNetwork),
+			NetworkID: networkID,
+			Network:   network.Name,
+			AgentKeys: keys,
+			Avatar:    network.Avatar != "",
+		}
+		for _, member := range members {
+			plan.Memberships = append(plan.Memberships, PlannedMembershipResponse{UserID: member.UserID, Username: member.Username})
+			plan.Deprovision = append(plan.Deprovision, planDeprovision(r.Context(), store, member.UserID, member.Username, network, settings.TailnetDeprovision))
+		}
+		if plan.Devices, err = planDevices(store, networkID, 0); err != nil {
+			log.Printf("Error listing devices of network %d: %v", networkID, err)
+			http.Error(w, "Failed to plan network deletion", http.StatusInternalServerError)
+			return
+		}
+		writePlan(w, plan)
+		return
+	}
+
 	// Delete network
 	if err := store.DeleteNetwork(networkID); err != nil {
 		log.Printf("Error deleting network: %v", err)
@@ -300,6 +614,26 @@ func HandleDeleteNetwork(w http.ResponseWriter, r *http.Request, store *store.St
 	}
 
 	log.Printf("Network ID %d deleted successfully", networkID)
+	recordAudit(store, r, claims.UserID, auditNetworkDeleted, networkDetail(network))
+
+	if signaling != nil {
+		ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+		if err := topics.CloseNetwork(ctx, signaling, network.Name, keys); err != nil {
+			log.Printf("Error closing signaling topic for network %s: %v", network.Name, err)
+		}
+		cancel()
+	}
+
+	if network.Avatar != "" {
+		deleteAvatar(avatars, network.Avatar)
+	}
+
+	go func() {
+		ctx := context.WithoutCancel(r.Context())
+		for _, member := range members {
+			deprovisionMember(ctx, store.WithContext(ctx), member.UserID, member.Username, network, settings.TailnetDeprovision)
+		}
+	}()
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
@@ -0,0 +1,99 @@
+package routes
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jhead/lanscape/lanscaped/internal/store"
+)
+
+// maxPresenceBody bounds the size of one presence report
+const maxPresenceBody = 1 << 20
+
+// PresenceReportRequest represents a batch of presence changes posted by a
+// signaling server
+type PresenceReportRequest struct {
+	Events []PresenceEventRequest `json:"events"`
+	// Snapshot marks Online as every agent online in any topic; all others
+	// are marked offline
+	Snapshot bool                 `json:"snapshot,omitempty"`
+	Online   []PresenceKeyRequest `json:"online,omitempty"`
+}
+
+// PresenceKeyRequest represents an agent identity key in a topic
+type PresenceKeyRequest struct {
+	Topic     string `json:"topic"`
+	PublicKey string `json:"public_key"`
+}
+
+// PresenceEventRequest represents an agent coming online or going offline
+type PresenceEventRequest struct {
+	Topic     string    `json:"topic"`
+	PublicKey string    `json:"public_key"`
+	Online    bool      `json:"online"`
+	At        time.Time `json:"at"`
+}
+
+// HandleReportPresence handles POST /v1/presence
+// Ingests agents coming online and going offline in signaling topics. Only
+// the signaling server may report, with "Authorization: Bearer <token>";
+// the endpoint is disabled when no token is configured.
+func HandleReportPresence(w http.ResponseWriter, r *http.Request, dbStore *store.Store, token string) {
+	if token == "" {
+		http.Error(w, "Presence reporting is disabled", http.StatusNotFound)
+		return
+	}
+	given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req PresenceReportRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxPresenceBody)).Decode(&req); err != nil {
+		log.Printf("Error decoding presence report: %v", err)
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	report := store.PresenceReport{
+		Changes:  make([]store.PresenceChange, 0, len(req.Events)),
+		Snapshot: req.Snapshot,
+		At:       now,
+	}
+	for _, e := range req.Events {
+		if e.Topic == "" || e.PublicKey == "" {
+			http.Error(w, "Events need a topic and public_key", http.StatusBadRequest)
+			return
+		}
+		// Clocks drift; never record a change in the future
+		at := e.At
+		if at.IsZero() || at.After(now) {
+			at = now
+		}
+		report.Changes = append(report.Changes, store.PresenceChange{
+			PresenceKey: store.PresenceKey{Topic: e.Topic, PublicKey: e.PublicKey},
+			Online:      e.Online,
+			At:          at,
+		})
+	}
+	for _, k := range req.Online {
+		report.Online = append(report.Online, store.PresenceKey{Topic: k.Topic, PublicKey: k.PublicKey})
+	}
+
+	if err := dbStore.RecordPresence(report); err != nil {
+		log.Printf("Error recording presence: %v", err)
+		http.Error(w, "Failed to record presence", http.StatusInternalServerError)
+		return
+	}
+
+	if len(req.Events) > 0 || req.Snapshot {
+		log.Printf("Recorded %d presence events (snapshot: %t, online: %d)", len(req.Events), req.Snapshot, len(req.Online))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,169 @@
+package routes
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/jhead/lanscape/lanscaped/internal/api/middleware"
+	"github.com/jhead/lanscape/lanscaped/internal/authz"
+	"github.com/jhead/lanscape/lanscaped/internal/store"
+)
+
+// NetworkSettingsResponse represents a network's settings
+type NetworkSettingsResponse struct {
+	JoinApprovalRequired bool   `json:"join_approval_required"`
+	DefaultKeyExpiry     string `json:"default_key_expiry"`
+	ChatEnabled          bool   `json:"chat_enabled"`
+	SignalingTopology    string `json:"signaling_topology"`
+	TailnetDeprovision   string `json:"tailnet_deprovision"`
+}
+
+// UpdateNetworkSettingsRequest represents a change to a network's settings.
+// Omitted settings are left as they are.
+type UpdateNetworkSettingsRequest struct {
+	JoinApprovalRequired *bool   `json:"join_approval_required"`
+	DefaultKeyExpiry     *string `json:"default_key_expiry"` // Go duration, e.g. "12h"
+	ChatEnabled          *bool   `json:"chat_enabled"`
+	SignalingTopology    *string `json:"signaling_topology"`
+	TailnetDeprovision   *string `json:"tailnet_deprovision"`
+}
+
+// HandleGetNetworkSettings handles GET /v1/networks/{id}/settings
+func HandleGetNetworkSettings(w http.ResponseWriter, r *http.Request, dbStore *store.Store, authorizer *authz.Authorizer) {
+	log.Printf("Get network settings request from %s", r.RemoteAddr)
+
+	claims, ok := middleware.GetClaimsFromContext(r)
+	if !ok {
+		log.Printf("Failed to extract JWT claims from context")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	networkID, ok := authorizedNetworkID(w, r, authorizer, claims.UserID, authz.ViewSettings)
+	if !ok {
+		return
+	}
+
+	settings, ok := networkSettings(w, dbStore, networkID)
+	if !ok {
+		return
+	}
+
+	writeNetworkSettings(w, settings)
+}
+
+// HandleUpdateNetworkSettings handles PUT /v1/networks/{id}/settings
+// Changes the settings present in the request and returns them all.
+func HandleUpdateNetworkSettings(w http.ResponseWriter, r *http.Request, dbStore *store.Store, authorizer *authz.Authorizer) {
+	log.Printf("Update network settings request from %s", r.RemoteAddr)
+
+	claims, ok := middleware.GetClaimsFromContext(r)
+	if !ok {
+		log.Printf("Failed to extract JWT claims from context")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	networkID, ok := authorizedNetworkID(w, r, authorizer, claims.UserID, authz.ManageSettings)
+	if !ok {
+		return
+	}
+
+	// A misspelled setting should fail rather than silently change nothing
+	var req UpdateNetworkSettingsRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		log.Printf("Error decoding request: %v", err)
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	network, err := dbStore.GetNetworkByID(networkID)
+	if err != nil {
+		log.Printf("Error fetching network: %v", err)
+		http.Error(w, "Network not found", http.StatusNotFound)
+		return
+	}
+
+	settings, ok := networkSettings(w, dbStore, networkID)
+	if !ok {
+		return
+	}
+
+	changed := []string{}
+	if req.JoinApprovalRequired != nil {
+		settings.JoinApprovalRequired = *req.JoinApprovalRequired
+		changed = append(changed, "join_approval_required")
+	}
+	if req.DefaultKeyExpiry != nil {
+		expiry, err := time.ParseDuration(*req.DefaultKeyExpiry)
+		if err != nil {
+			http.Error(w, "Invalid default_key_expiry", http.StatusBadRequest)
+			return
+		}
+		settings.DefaultKeyExpiry = expiry
+		changed = append(changed, "default_key_expiry")
+	}
+	if req.ChatEnabled != nil {
+		settings.ChatEnabled = *req.ChatEnabled
+		changed = append(changed, "chat_enabled")
+	}
+	if req.SignalingTopology != nil {
+		settings.SignalingTopology = store.Topology(*req.SignalingTopology)
+		changed = append(changed, "signaling_topology")
+	}
+	if req.TailnetDeprovision != nil {
+		settings.TailnetDeprovision = store.Deprovision(*req.TailnetDeprovision)
+		changed = append(changed, "tailnet_deprovision")
+	}
+
+	if err := settings.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := dbStore.UpdateNetworkSettings(networkID, *settings); err != nil {
+		log.Printf("Error updating settings of network %d: %v", networkID, err)
+		http.Error(w, "Failed to update network settings", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("User %s (ID: %d) changed settings %v of network %s", claims.Username, claims.UserID, changed, network.Name)
+	detail := networkDetail(network)
+	detail["settings"] = changed
+	recordAudit(dbStore, r, claims.UserID, auditNetworkSettingsChanged, detail)
+
+	writeNetworkSettings(w, settings)
+}
+
+// networkSettings loads a network's settings, writing an error response on
+// failure
+func networkSettings(w http.ResponseWriter, dbStore *store.Store, networkID int64) (*store.NetworkSettings, bool) {
+	settings, err := dbStore.GetNetworkSettings(networkID)
+	if err != nil {
+		log.Printf("Error fetching settings of network %d: %v", networkID, err)
+		http.Error(w, "Failed to load network settings", http.StatusInternalServerError)
+		return nil, false
+	}
+	return settings, true
+}
+
+func writeNetworkSettings(w http.ResponseWriter, settings *store.NetworkSettings) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	response := NetworkSettingsResponse{
+		JoinApprovalRequired: settings.JoinApprovalRequired,
+		DefaultKeyExpiry:     settings.DefaultKeyExpiry.String(),
+		ChatEnabled:          settings.ChatEnabled,
+		SignalingTopology:    string(settings.SignalingTopology),
+		TailnetDeprovision:   string(settings.TailnetDeprovision),
+	}
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("Error encoding response: %v", err)
+	}
+}
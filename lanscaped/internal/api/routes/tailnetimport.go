@@ -0,0 +1,450 @@
+package routes
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jhead/lanscape/lanscaped/internal/api/middleware"
+	"github.com/jhead/lanscape/lanscaped/internal/authz"
+	"github.com/jhead/lanscape/lanscaped/internal/store"
+	"github.com/jhead/lanscape/lanscaped/internal/tailnet"
+	"github.com/jhead/lanscape/lanscaped/internal/topics"
+)
+
+// ImportTailnetResponse represents the result of importing a network's
+// Headscale
+type ImportTailnetResponse struct {
+	Users          []ImportedUserResponse `json:"users"`
+	DevicesCreated int                    `json:"devices_created"`
+	DevicesUpdated int                    `json:"devices_updated"`
+}
+
+// ImportedUserResponse represents one Headscale user in an import
+type ImportedUserResponse struct {
+	Username string `json:"username"`
+	// Status is the user's link to the account of the same name: pending
+	// until its owner accepts or declines it
+	Status string `json:"status"`
+	// UserID is the account of an accepted link
+	UserID  int64 `json:"user_id,omitempty"`
+	Devices int   `json:"devices"`
+}
+
+// ListTailnetLinksResponse represents the tailnet links waiting on the
+// caller
+type ListTailnetLinksResponse struct {
+	Links []TailnetLinkResponse `json:"links"`
+}
+
+// TailnetLinkResponse represents a Headscale user of a network named like
+// the caller
+type TailnetLinkResponse struct {
+	NetworkID     int64  `json:"network_id"`
+	NetworkName   string `json:"network_name"`
+	HeadscaleUser string `json:"headscale_user"`
+	ImportedAt    string `json:"imported_at"`
+}
+
+// ListDevicesResponse represents the devices of a network
+type ListDevicesResponse struct {
+	Devices []DeviceResponse `json:"devices"`
+}
+
+// DeviceResponse represents a node of a network's tailnet
+type DeviceResponse struct {
+	ID          int64    `json:"id"`
+	UserID      int64    `json:"user_id"`
+	Username    string   `json:"username"`
+	NodeID      string   `json:"node_id"`
+	Name        string   `json:"name"`
+	IPAddresses []string `json:"ip_addresses"`
+	LastSeen    string   `json:"last_seen,omitempty"`
+}
+
+// HandleImportTailnet handles POST /v1/networks/{id}/import
+// Imports the users and nodes of the network's Headscale, for networks
+// created on an established deployment. Each Headscale user is recorded as
+// a pending link to the lanscaped account of the same name, whether or not
+// it exists yet; the account's owner accepts it to join the network (see
+// HandleAcceptTailnetLink). Nodes are recorded as devices only for accepted
+// links whose account is still a member. Importing again picks up new users
+// and nodes.
+func HandleImportTailnet(w http.ResponseWriter, r *http.Request, dbStore *store.Store, authorizer *authz.Authorizer) {
+	log.Printf("Import tailnet request from %s", r.RemoteAddr)
+
+	claims, ok := middleware.GetClaimsFromContext(r)
+	if !ok {
+		log.Printf("Failed to extract JWT claims from context")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	networkID, ok := authorizedNetworkID(w, r, authorizer, claims.UserID, authz.ImportTailnet)
+	if !ok {
+		return
+	}
+
+	network, err := dbStore.GetNetworkByID(networkID)
+	if err != nil {
+		log.Printf("Error fetching network: %v", err)
+		http.Error(w, "Network not found", http.StatusNotFound)
+		return
+	}
+
+	headscaleClient := tailnet.NewClientWithEndpoint(network.HeadscaleEndpoint, network.APIKey).WithContext(r.Context())
+	headscaleUsers, err := headscaleClient.ListUsers()
+	if err != nil {
+		log.Printf("Error listing Headscale users: %v", err)
+		http.Error(w, "Failed to list Headscale users: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	nodes, err := headscaleClient.ListAllNodes()
+	if err != nil {
+		log.Printf("Error listing Headscale nodes: %v", err)
+		http.Error(w, "Failed to list Headscale nodes: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	nodesByUser := make(map[string][]tailnet.Node)
+	for _, node := range nodes {
+		if node.User != nil {
+			nodesByUser[node.User.Name] = append(nodesByUser[node.User.Name], node)
+		}
+	}
+
+	response := ImportTailnetResponse{Users: make([]ImportedUserResponse, 0, len(headscaleUsers))}
+	for _, headscaleUser := range headscaleUsers {
+		if strings.TrimSpace(headscaleUser.Name) == "" {
+			continue
+		}
+		imported, user, ok := importUser(w, dbStore, network, headscaleUser.Name)
+		if !ok {
+			return
+		}
+		if user == nil {
+			response.Users = append(response.Users, imported)
+			continue
+		}
+
+		for _, node := range nodesByUser[headscaleUser.Name] {
+			created, err := dbStore.UpsertDevice(nodeDevice(network.ID, user.ID, node))
+			if err != nil {
+				log.Printf("Error storing device %s of %s: %v", node.ID, user.Username, err)
+				http.Error(w, "Failed to store devices", http.StatusInternalServerError)
+				return
+			}
+			if created {
+				response.DevicesCreated++
+			} else {
+				response.DevicesUpdated++
+			}
+			imported.Devices++
+		}
+		response.Users = append(response.Users, imported)
+	}
+
+	log.Printf("User %s (ID: %d) imported %d users and %d devices from Headscale into network %s",
+		claims.Username, claims.UserID, len(response.Users), response.DevicesCreated+response.DevicesUpdated, network.Name)
+	detail := networkDetail(network)
+	detail["users"] = len(response.Users)
+	detail["devices"] = response.DevicesCreated + response.DevicesUpdated
+	recordAudit(dbStore, r, claims.UserID, auditNetworkImported, detail)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("Error encoding response: %v", err)
+	}
+}
+
+// importUser records the link of a Headscale user to the account of the
+// same name, returning the account if its owner accepted the link and is
+// still a member. It writes an error response on failure.
+func importUser(w http.ResponseWriter, dbStore *store.Store, network *store.Network, username string) (ImportedUserResponse, *store.User, bool) {
+	imported := ImportedUserResponse{Username: username}
+
+	link, err := dbStore.RecordTailnetLink(network.ID, username)
+	if err != nil {
+		log.Printf("Error recording tailnet link of %s: %v", username, err)
+		http.Error(w, "Failed to import users", http.StatusInternalServerError)
+		return imported, nil, false
+	}
+	imported.Status = string(link.Status)
+	if link.Status != store.TailnetLinkAccepted || link.UserID == 0 {
+		return imported, nil, true
+	}
+	imported.UserID = link.UserID
+
+	isMember, err := dbStore.IsUserInNetwork(link.UserID, network.ID)
+	if err != nil {
+		log.Printf("Error checking membership: %v", err)
+		http.Error(w, "Failed to import users", http.StatusInternalServerError)
+		return imported, nil, false
+	}
+	if !isMember {
+		return imported, nil, true
+	}
+	user, err := dbStore.GetUserByID(link.UserID)
+	if err != nil {
+		log.Printf("Error fetching linked user %d: %v", link.UserID, err)
+		http.Error(w, "Failed to import users", http.StatusInternalServerError)
+		return imported, nil, false
+	}
+	return imported, user, true
+}
+
+// HandleListTailnetLinks handles GET /v1/tailnet-links
+// Lists the Headscale users named like the caller that imports found and
+// that wait on the caller to accept or decline them
+func HandleListTailnetLinks(w http.ResponseWriter, r *http.Request, dbStore *store.Store) {
+	log.Printf("List tailnet links request from %s", r.RemoteAddr)
+
+	claims, ok := middleware.GetClaimsFromContext(r)
+	if !ok {
+		log.Printf("Failed to extract JWT claims from context")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	links, err := dbStore.ListPendingTailnetLinks(claims.Username)
+	if err != nil {
+		log.Printf("Error listing tailnet links: %v", err)
+		http.Error(w, "Failed to list tailnet links", http.StatusInternalServerError)
+		return
+	}
+
+	response := ListTailnetLinksResponse{Links: make([]TailnetLinkResponse, 0, len(links))}
+	for _, link := range links {
+		response.Links = append(response.Links, TailnetLinkResponse{
+			NetworkID:     link.NetworkID,
+			NetworkName:   link.NetworkName,
+			HeadscaleUser: link.HeadscaleUser,
+			ImportedAt:    link.CreatedAt.UTC().Format("2006-01-02T15:04:05Z"),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("Error encoding response: %v", err)
+	}
+}
+
+// HandleAcceptTailnetLink handles PUT /v1/tailnet-links/{id}
+// Accepts the link of network {id}'s Headscale user named like the caller:
+// the caller joins the network, is provisioned as if they had joined
+// themselves, and the Headscale user's nodes become their devices
+func HandleAcceptTailnetLink(w http.ResponseWriter, r *http.Request, dbStore *store.Store, signaling topics.Admin) {
+	log.Printf("Accept tailnet link request from %s", r.RemoteAddr)
+
+	claims, ok := middleware.GetClaimsFromContext(r)
+	if !ok {
+		log.Printf("Failed to extract JWT claims from context")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	network, ok := tailnetLinkNetwork(w, r, dbStore)
+	if !ok {
+		return
+	}
+	user, err := dbStore.GetUserByID(claims.UserID)
+	if err != nil {
+		log.Printf("Error fetching user: %v", err)
+		http.Error(w, "Failed to accept tailnet link", http.StatusInternalServerError)
+		return
+	}
+
+	if err := dbStore.AcceptTailnetLink(user, network.ID); err != nil {
+		log.Printf("Error accepting tailnet link: %v", err)
+		if strings.Contains(err.Error(), "not found") {
+			http.Error(w, "Tailnet link not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Failed to accept tailnet link", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("User %s (ID: %d) accepted the tailnet link of network %s", user.Username, user.ID, network.Name)
+	detail := networkDetail(network)
+	detail["tailnet_link"] = true
+	recordAudit(dbStore, r, user.ID, auditNetworkJoined, detail)
+
+	provisionMember(r.Context(), dbStore, signaling, user.ID, user.Username, network)
+
+	// The next import records them otherwise
+	devices := 0
+	headscaleClient := tailnet.NewClientWithEndpoint(network.HeadscaleEndpoint, network.APIKey).WithContext(r.Context())
+	nodes, err := headscaleClient.ListNodes(user.Username)
+	if err != nil {
+		log.Printf("Error listing Headscale nodes of %s: %v", user.Username, err)
+	}
+	for _, node := range nodes {
+		if _, err := dbStore.UpsertDevice(nodeDevice(network.ID, user.ID, node)); err != nil {
+			log.Printf("Error storing device %s of %s: %v", node.ID, user.Username, err)
+			continue
+		}
+		devices++
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	response := map[string]interface{}{
+		"success":    true,
+		"message":    "Tailnet link accepted",
+		"network_id": network.ID,
+		"devices":    devices,
+	}
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("Error encoding response: %v", err)
+	}
+}
+
+// HandleDeclineTailnetLink handles DELETE /v1/tailnet-links/{id}
+// Declines the link of network {id}'s Headscale user named like the caller;
+// later imports leave it declined
+func HandleDeclineTailnetLink(w http.ResponseWriter, r *http.Request, dbStore *store.Store) {
+	log.Printf("Decline tailnet link request from %s", r.RemoteAddr)
+
+	claims, ok := middleware.GetClaimsFromContext(r)
+	if !ok {
+		log.Printf("Failed to extract JWT claims from context")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	network, ok := tailnetLinkNetwork(w, r, dbStore)
+	if !ok {
+		return
+	}
+
+	if err := dbStore.DeclineTailnetLink(claims.Username, network.ID); err != nil {
+		log.Printf("Error declining tailnet link: %v", err)
+		if strings.Contains(err.Error(), "not found") {
+			http.Error(w, "Tailnet link not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Failed to decline tailnet link", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("User %s (ID: %d) declined the tailnet link of network %s", claims.Username, claims.UserID, network.Name)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	response := map[string]interface{}{
+		"success":    true,
+		"message":    "Tailnet link declined",
+		"network_id": network.ID,
+	}
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("Error encoding response: %v", err)
+	}
+}
+
+// tailnetLinkNetwork resolves the network of a tailnet link route
+func tailnetLinkNetwork(w http.ResponseWriter, r *http.Request, dbStore *store.Store) (*store.Network, bool) {
+	networkID, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid network ID", http.StatusBadRequest)
+		return nil, false
+	}
+
+	network, err := dbStore.GetNetworkByID(networkID)
+	if err != nil {
+		log.Printf("Error fetching network: %v", err)
+		http.Error(w, "Tailnet link not found", http.StatusNotFound)
+		return nil, false
+	}
+	return network, true
+}
+
+// nodeDevice returns the device record of a Headscale node
+func nodeDevice(networkID, userID int64, node tailnet.Node) store.Device {
+	device := store.Device{
+		NetworkID:   networkID,
+		UserID:      userID,
+		NodeID:      node.ID,
+		Name:        node.GivenName,
+		IPAddresses: node.IPAddresses,
+	}
+	if device.Name == "" {
+		device.Name = node.Name
+	}
+	// Headscale reports nodes it never saw with a zero time
+	if t, err := time.Parse(time.RFC3339Nano, node.LastSeen); err == nil && t.Year() > 1 {
+		device.LastSeen = &t
+	}
+	return device
+}
+
+// HandleListDevices handles GET /v1/networks/{id}/devices
+// Lists the tailnet devices of a network's members, as last imported from
+// its Headscale. Only members may list them.
+func HandleListDevices(w http.ResponseWriter, r *http.Request, dbStore *store.Store, authorizer *authz.Authorizer) {
+	log.Printf("List devices request from %s", r.RemoteAddr)
+
+	claims, ok := middleware.GetClaimsFromContext(r)
+	if !ok {
+		log.Printf("Failed to extract JWT claims from context")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	networkID, ok := authorizedNetworkID(w, r, authorizer, claims.UserID, authz.ViewMembers)
+	if !ok {
+		return
+	}
+
+	devices, err := dbStore.ListNetworkDevices(networkID)
+	if err != nil {
+		log.Printf("Error listing devices: %v", err)
+		http.Error(w, "Failed to list devices", http.StatusInternalServerError)
+		return
+	}
+
+	etag := newListETag()
+	for _, device := range devices {
+		etag.add(device.UpdatedAt, device.ID, device.Username)
+	}
+	if notModified(w, r, etag.String()) {
+		return
+	}
+
+	response := ListDevicesResponse{Devices: make([]DeviceResponse, 0, len(devices))}
+	for _, device := range devices {
+		response.Devices = append(response.Devices, deviceResponse(device))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("Error encoding response: %v", err)
+	}
+}
+
+// deviceResponse converts a device for a response
+func deviceResponse(device *store.Device) DeviceResponse {
+	d := DeviceResponse{
+		ID:          device.ID,
+		UserID:      device.UserID,
+		Username:    device.Username,
+		NodeID:      device.NodeID,
+		Name:        device.Name,
+		IPAddresses: device.IPAddresses,
+	}
+	if device.LastSeen != nil {
+		d.LastSeen = device.LastSeen.UTC().Format("2006-01-02T15:04:05Z")
+	}
+	return d
+}
@@ -0,0 +1,114 @@
+package routes
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/jhead/lanscape/lanscaped/internal/api/middleware"
+	"github.com/jhead/lanscape/lanscaped/internal/auth"
+	"github.com/jhead/lanscape/lanscaped/internal/authz"
+	"github.com/jhead/lanscape/lanscaped/internal/store"
+)
+
+// TopicKeysResponse represents a network's topic keys wrapped to one agent
+type TopicKeysResponse struct {
+	NetworkID int64  `json:"network_id"`
+	Network   string `json:"network"`
+	// Generation is the current key's, the one to seal new messages with
+	Generation int64              `json:"generation"`
+	Keys       []TopicKeyResponse `json:"keys"`
+}
+
+// TopicKeyResponse represents one generation of a topic key, wrapped to the
+// requesting agent's identity key
+type TopicKeyResponse struct {
+	Generation int64  `json:"generation"`
+	WrappedKey string `json:"wrapped_key"`
+	CreatedAt  string `json:"created_at"`
+}
+
+// HandleGetTopicKeys handles GET /v1/networks/{id}/keys?public_key=...
+// Returns the network's topic key, and recent ones members may still need to
+// read group messages, each wrapped to the caller's enrolled agent. The key
+// is rotated when the membership changed since it was generated. Keys from
+// before the caller joined are withheld.
+func HandleGetTopicKeys(w http.ResponseWriter, r *http.Request, dbStore *store.Store, authorizer *authz.Authorizer) {
+	log.Printf("Get topic keys request from %s", r.RemoteAddr)
+
+	claims, ok := middleware.GetClaimsFromContext(r)
+	if !ok {
+		log.Printf("Failed to extract JWT claims from context")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	networkID, ok := authorizedNetworkID(w, r, authorizer, claims.UserID, authz.Connect)
+	if !ok {
+		return
+	}
+
+	// Keys are only wrapped to the caller's own, unrevoked agents
+	publicKey := r.URL.Query().Get("public_key")
+	agent, err := dbStore.GetAgentByPublicKey(publicKey)
+	if err != nil || agent.UserID != claims.UserID {
+		http.Error(w, "Agent not found", http.StatusNotFound)
+		return
+	}
+	if agent.RevokedAt != nil {
+		http.Error(w, "Agent key has been revoked", http.StatusForbidden)
+		return
+	}
+
+	network, err := dbStore.GetNetworkByID(networkID)
+	if err != nil {
+		log.Printf("Error fetching network: %v", err)
+		http.Error(w, "Network not found", http.StatusNotFound)
+		return
+	}
+
+	joinedGeneration, err := dbStore.MembershipKeyGeneration(claims.UserID, networkID)
+	if err != nil {
+		log.Printf("Error fetching membership: %v", err)
+		http.Error(w, "Not a member of this network", http.StatusForbidden)
+		return
+	}
+
+	keys, err := dbStore.TopicKeys(networkID)
+	if err != nil {
+		log.Printf("Error getting topic keys: %v", err)
+		http.Error(w, "Failed to get topic keys", http.StatusInternalServerError)
+		return
+	}
+
+	response := TopicKeysResponse{
+		NetworkID:  networkID,
+		Network:    network.Name,
+		Generation: keys[0].Generation,
+		Keys:       make([]TopicKeyResponse, 0, len(keys)),
+	}
+	for _, key := range keys {
+		if key.Generation <= joinedGeneration {
+			break
+		}
+		wrapped, err := auth.WrapTopicKey(agent.PublicKey, key.Key, networkID, key.Generation)
+		if err != nil {
+			log.Printf("Error wrapping topic key: %v", err)
+			http.Error(w, "Failed to wrap topic key", http.StatusInternalServerError)
+			return
+		}
+		response.Keys = append(response.Keys, TopicKeyResponse{
+			Generation: key.Generation,
+			WrappedKey: wrapped,
+			CreatedAt:  key.CreatedAt.UTC().Format("2006-01-02T15:04:05Z"),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("Error encoding response: %v", err)
+	}
+}
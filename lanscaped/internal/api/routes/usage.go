@@ -0,0 +1,176 @@
+package routes
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/jhead/lanscape/lanscaped/internal/api/middleware"
+	"github.com/jhead/lanscape/lanscaped/internal/authz"
+	"github.com/jhead/lanscape/lanscaped/internal/store"
+)
+
+// maxUsageEntries bounds the peers in one usage report
+const maxUsageEntries = 1000
+
+// defaultUsageWindow is the stats window when no since parameter is given
+const defaultUsageWindow = 24 * time.Hour
+
+// UsageReportRequest represents a usage report posted by an agent
+type UsageReportRequest struct {
+	PeriodStart time.Time          `json:"period_start"`
+	PeriodEnd   time.Time          `json:"period_end"`
+	Peers       []PeerUsageRequest `json:"peers"`
+}
+
+// PeerUsageRequest represents usage with one peer on one topic
+type PeerUsageRequest struct {
+	Topic            string `json:"topic"`
+	Peer             string `json:"peer"`
+	BytesSent        int64  `json:"bytes_sent"`
+	BytesReceived    int64  `json:"bytes_received"`
+	MessagesSent     int64  `json:"messages_sent"`
+	MessagesReceived int64  `json:"messages_received"`
+}
+
+// NetworkUsageResponse represents aggregated usage stats for a network
+type NetworkUsageResponse struct {
+	NetworkID int64                `json:"network_id"`
+	Since     string               `json:"since"`
+	Topics    []TopicUsageResponse `json:"topics"`
+	Totals    TopicUsageResponse   `json:"totals"`
+}
+
+// TopicUsageResponse represents usage for a topic (or the network total)
+type TopicUsageResponse struct {
+	Topic            string `json:"topic,omitempty"`
+	BytesSent        int64  `json:"bytes_sent"`
+	BytesReceived    int64  `json:"bytes_received"`
+	MessagesSent     int64  `json:"messages_sent"`
+	MessagesReceived int64  `json:"messages_received"`
+	Peers            int64  `json:"peers,omitempty"`
+	Reporters        int64  `json:"reporters,omitempty"`
+}
+
+// HandleReportUsage handles POST /v1/networks/{id}/usage
+// Ingests a periodic usage report from an agent of a network member
+func HandleReportUsage(w http.ResponseWriter, r *http.Request, dbStore *store.Store, authorizer *authz.Authorizer) {
+	log.Printf("Usage report from %s", r.RemoteAddr)
+
+	claims, ok := middleware.GetClaimsFromContext(r)
+	if !ok {
+		log.Printf("Failed to extract JWT claims from context")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	networkID, ok := authorizedNetworkID(w, r, authorizer, claims.UserID, authz.ReportUsage)
+	if !ok {
+		return
+	}
+
+	var req UsageReportRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		log.Printf("Error decoding usage report: %v", err)
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if len(req.Peers) > maxUsageEntries {
+		http.Error(w, "Too many entries in usage report", http.StatusBadRequest)
+		return
+	}
+	if req.PeriodEnd.IsZero() || req.PeriodEnd.Before(req.PeriodStart) {
+		http.Error(w, "Invalid reporting period", http.StatusBadRequest)
+		return
+	}
+
+	entries := make([]store.UsageEntry, 0, len(req.Peers))
+	for _, p := range req.Peers {
+		if p.Topic == "" || p.BytesSent < 0 || p.BytesReceived < 0 || p.MessagesSent < 0 || p.MessagesReceived < 0 {
+			http.Error(w, "Invalid usage entry", http.StatusBadRequest)
+			return
+		}
+		entries = append(entries, store.UsageEntry{
+			Topic:            p.Topic,
+			Peer:             p.Peer,
+			BytesSent:        p.BytesSent,
+			BytesReceived:    p.BytesReceived,
+			MessagesSent:     p.MessagesSent,
+			MessagesReceived: p.MessagesReceived,
+		})
+	}
+
+	if err := dbStore.RecordUsage(networkID, claims.UserID, req.PeriodStart, req.PeriodEnd, entries); err != nil {
+		log.Printf("Error recording usage: %v", err)
+		http.Error(w, "Failed to record usage", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Recorded usage report from user %s (ID: %d) for network ID %d: %d entries", claims.Username, claims.UserID, networkID, len(entries))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleGetUsage handles GET /v1/networks/{id}/usage
+// Returns usage aggregated per topic since the optional RFC 3339 since parameter
+// (default: the last 24 hours)
+func HandleGetUsage(w http.ResponseWriter, r *http.Request, dbStore *store.Store, authorizer *authz.Authorizer) {
+	log.Printf("Get usage request from %s", r.RemoteAddr)
+
+	claims, ok := middleware.GetClaimsFromContext(r)
+	if !ok {
+		log.Printf("Failed to extract JWT claims from context")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	networkID, ok := authorizedNetworkID(w, r, authorizer, claims.UserID, authz.ViewUsage)
+	if !ok {
+		return
+	}
+
+	since := time.Now().Add(-defaultUsageWindow)
+	if s := r.URL.Query().Get("since"); s != "" {
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			http.Error(w, "Invalid since parameter", http.StatusBadRequest)
+			return
+		}
+		since = t
+	}
+
+	usage, err := dbStore.GetNetworkUsage(networkID, since)
+	if err != nil {
+		log.Printf("Error fetching usage: %v", err)
+		http.Error(w, "Failed to fetch usage", http.StatusInternalServerError)
+		return
+	}
+
+	response := NetworkUsageResponse{
+		NetworkID: networkID,
+		Since:     since.UTC().Format("2006-01-02T15:04:05Z"),
+		Topics:    make([]TopicUsageResponse, len(usage)),
+	}
+	for i, u := range usage {
+		response.Topics[i] = TopicUsageResponse{
+			Topic:            u.Topic,
+			BytesSent:        u.BytesSent,
+			BytesReceived:    u.BytesReceived,
+			MessagesSent:     u.MessagesSent,
+			MessagesReceived: u.MessagesReceived,
+			Peers:            u.Peers,
+			Reporters:        u.Reporters,
+		}
+		response.Totals.BytesSent += u.BytesSent
+		response.Totals.BytesReceived += u.BytesReceived
+		response.Totals.MessagesSent += u.MessagesSent
+		response.Totals.MessagesReceived += u.MessagesReceived
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("Error encoding response: %v", err)
+	}
+}
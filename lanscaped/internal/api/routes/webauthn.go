@@ -1,7 +1,6 @@
 package routes
 
 import (
-	"bytes"
 	"encoding/base64"
 	"encoding/json"
 	"io"
@@ -10,6 +9,8 @@ import (
 	"strconv"
 	"time"
 
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/jhead/lanscape/lanscaped/internal/api/middleware"
 	"github.com/jhead/lanscape/lanscaped/internal/auth"
 	"github.com/jhead/lanscape/lanscaped/internal/store"
 )
@@ -17,12 +18,19 @@ import (
 // BeginRegistrationRequest represents a request to begin WebAuthn registration
 type BeginRegistrationRequest struct {
 	Username string `json:"username"`
+	// Attachment prefers "platform" or "cross-platform" authenticators
+	Attachment string `json:"attachment,omitempty"`
+	// UserVerification may raise the configured requirement to "required"
+	UserVerification string `json:"user_verification,omitempty"`
+	// ClaimCode takes over an account created by a tailnet import of an
+	// earlier version
+	ClaimCode string `json:"claim_code,omitempty"`
 }
 
 // BeginRegistrationResponse represents the response from beginning registration
 type BeginRegistrationResponse struct {
-	Options map[string]interface{} `json:"options"`
-	Session string                 `json:"session"`
+	Options *protocol.CredentialCreation `json:"options"`
+	Session string                       `json:"session"`
 }
 
 // FinishRegistrationRequest represents a request to finish WebAuthn registration
@@ -44,12 +52,16 @@ type FinishRegistrationResponse struct {
 // BeginLoginRequest represents a request to begin WebAuthn login
 type BeginLoginRequest struct {
 	Username string `json:"username"`
+	// Attachment prefers "platform" or "cross-platform" authenticators
+	Attachment string `json:"attachment,omitempty"`
+	// UserVerification may raise the configured requirement to "required"
+	UserVerification string `json:"user_verification,omitempty"`
 }
 
 // BeginLoginResponse represents the response from beginning login
 type BeginLoginResponse struct {
-	Options map[string]interface{} `json:"options"`
-	Session string                 `json:"session"`
+	Options *protocol.CredentialAssertion `json:"options"`
+	Session string                        `json:"session"`
 }
 
 // FinishLoginRequest represents a request to finish WebAuthn login
@@ -88,7 +100,29 @@ func HandleBeginRegistration(w http.ResponseWriter, r *http.Request, webauthnSer
 		return
 	}
 
-	sessionData, options, err := webauthnService.BeginRegistration(req.Username)
+	opts, err := ceremonyOptions(req.Attachment, req.UserVerification)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Accounts created by tailnet imports of earlier versions are
+	// registered with their claim code
+	if user, err := dbStore.GetUserByUsername(req.Username); err == nil && user.PendingClaim {
+		valid, err := dbStore.CheckClaimCode(user.ID, req.ClaimCode)
+		if err != nil {
+			log.Printf("Error checking claim code: %v", err)
+			http.Error(w, "Failed to begin registration", http.StatusInternalServerError)
+			return
+		}
+		if !valid {
+			log.Printf("Rejected registration of imported user %s without a valid claim code", req.Username)
+			http.Error(w, "This account was imported and needs its claim code", http.StatusForbidden)
+			return
+		}
+	}
+
+	sessionData, options, err := webauthnService.BeginRegistration(req.Username, opts)
 	if err != nil {
 		log.Printf("Error beginning registration: %v", err)
 		http.Error(w, "Failed to begin registration", http.StatusInternalServerError)
@@ -97,7 +131,7 @@ func HandleBeginRegistration(w http.ResponseWriter, r *http.Request, webauthnSer
 
 	// Store session data in database with a unique ID
 	sessionID := base64.RawURLEncoding.EncodeToString([]byte(req.Username + time.Now().String()))
-	expiresAt := time.Now().Add(5 * time.Minute) // Sessions expire after 5 minutes
+	expiresAt := time.Now().Add(webauthnService.SessionTTL()) // Sessions expire with the ceremony
 
 	if err := dbStore.CreateSession(sessionID, req.Username, sessionData, expiresAt); err != nil {
 		log.Printf("Error creating session: %v", err)
@@ -105,26 +139,11 @@ func HandleBeginRegistration(w http.ResponseWriter, r *http.Request, webauthnSer
 		return
 	}
 
-	// Convert options to JSON-serializable format
-	optionsJSON, err := json.Marshal(options)
-	if err != nil {
-		log.Printf("Error marshaling options: %v", err)
-		http.Error(w, "Failed to prepare registration options", http.StatusInternalServerError)
-		return
-	}
-
-	var optionsMap map[string]interface{}
-	if err := json.Unmarshal(optionsJSON, &optionsMap); err != nil {
-		log.Printf("Error unmarshaling options: %v", err)
-		http.Error(w, "Failed to prepare registration options", http.StatusInternalServerError)
-		return
-	}
-
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 
 	response := BeginRegistrationResponse{
-		Options: optionsMap,
+		Options: options,
 		Session: sessionID,
 	}
 
@@ -182,24 +201,13 @@ func HandleFinishRegistration(w http.ResponseWriter, r *http.Request, webauthnSe
 		return
 	}
 
-	// Reconstruct the request body with just the response field for the library
-	// The library expects the credential creation response in the request body
-	// The response field contains the full credential creation response
-	newReq, err := http.NewRequest("POST", r.URL.String(), bytes.NewReader(req.Response))
-	if err != nil {
-		log.Printf("Error creating request: %v", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
-		return
-	}
-	newReq.Header.Set("Content-Type", "application/json")
-
 	// Remove session after use
 	if err := dbStore.DeleteSession(req.Session); err != nil {
 		log.Printf("Error deleting session: %v", err)
 		// Continue anyway as the session is already consumed
 	}
 
-	credential, err := webauthnService.FinishRegistration(req.Username, session.Data, newReq)
+	credential, err := webauthnService.FinishRegistrationFromJSON(req.Username, session.Data, req.Response)
 	if err != nil {
 		log.Printf("Error finishing registration: %v", err)
 		http.Error(w, "Failed to finish registration: "+err.Error(), http.StatusBadRequest)
@@ -215,6 +223,12 @@ func HandleFinishRegistration(w http.ResponseWriter, r *http.Request, webauthnSe
 		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
 		return
 	}
+	if user.PendingClaim {
+		if err := dbStore.ClaimUser(user.ID); err != nil {
+			log.Printf("Error claiming imported user %s: %v", user.Username, err)
+		}
+	}
+	recordAudit(dbStore, r, user.ID, auditAccountRegistered, nil)
 
 	// Generate JWT token without JID (network-specific tokens are minted on-demand)
 	// Empty JID for initial login token - network-specific tokens are generated when connecting
@@ -226,15 +240,7 @@ func HandleFinishRegistration(w http.ResponseWriter, r *http.Request, webauthnSe
 	}
 
 	// Set JWT token in cookie
-	http.SetCookie(w, &http.Cookie{
-		Name:     "jwt",
-		Value:    token,
-		Path:     "/",
-		MaxAge:   86400, // 24 hours
-		HttpOnly: true,
-		SameSite: http.SameSiteLaxMode,
-		Secure:   false, // Set to true in production with HTTPS
-	})
+	setTokenCookie(w, r, token, jwtService.AccessTokenTTL())
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
@@ -273,7 +279,13 @@ func HandleBeginLogin(w http.ResponseWriter, r *http.Request, webauthnService *a
 		return
 	}
 
-	sessionData, options, err := webauthnService.BeginLogin(req.Username)
+	opts, err := ceremonyOptions(req.Attachment, req.UserVerification)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	sessionData, options, err := webauthnService.BeginLogin(req.Username, opts)
 	if err != nil {
 		log.Printf("Error beginning login: %v", err)
 		http.Error(w, "Failed to begin login: "+err.Error(), http.StatusBadRequest)
@@ -282,7 +294,7 @@ func HandleBeginLogin(w http.ResponseWriter, r *http.Request, webauthnService *a
 
 	// Store session data in database with a unique ID
 	sessionID := base64.RawURLEncoding.EncodeToString([]byte(req.Username + time.Now().String()))
-	expiresAt := time.Now().Add(5 * time.Minute) // Sessions expire after 5 minutes
+	expiresAt := time.Now().Add(webauthnService.SessionTTL()) // Sessions expire with the ceremony
 
 	if err := dbStore.CreateSession(sessionID, req.Username, sessionData, expiresAt); err != nil {
 		log.Printf("Error creating session: %v", err)
@@ -290,26 +302,11 @@ func HandleBeginLogin(w http.ResponseWriter, r *http.Request, webauthnService *a
 		return
 	}
 
-	// Convert options to JSON-serializable format
-	optionsJSON, err := json.Marshal(options)
-	if err != nil {
-		log.Printf("Error marshaling options: %v", err)
-		http.Error(w, "Failed to prepare login options", http.StatusInternalServerError)
-		return
-	}
-
-	var optionsMap map[string]interface{}
-	if err := json.Unmarshal(optionsJSON, &optionsMap); err != nil {
-		log.Printf("Error unmarshaling options: %v", err)
-		http.Error(w, "Failed to prepare login options", http.StatusInternalServerError)
-		return
-	}
-
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 
 	response := BeginLoginResponse{
-		Options: optionsMap,
+		Options: options,
 		Session: sessionID,
 	}
 
@@ -367,22 +364,13 @@ func HandleFinishLogin(w http.ResponseWriter, r *http.Request, webauthnService *
 		return
 	}
 
-	// Reconstruct the request body with just the response field for the library
-	newReq, err := http.NewRequest("POST", r.URL.String(), bytes.NewReader(req.Response))
-	if err != nil {
-		log.Printf("Error creating request: %v", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
-		return
-	}
-	newReq.Header.Set("Content-Type", "application/json")
-
 	// Remove session after use
 	if err := dbStore.DeleteSession(req.Session); err != nil {
 		log.Printf("Error deleting session: %v", err)
 		// Continue anyway as the session is already consumed
 	}
 
-	credential, err := webauthnService.FinishLogin(req.Username, session.Data, newReq)
+	credential, err := webauthnService.FinishLoginFromJSON(req.Username, session.Data, req.Response)
 	if err != nil {
 		log.Printf("Error finishing login: %v", err)
 		http.Error(w, "Failed to finish login: "+err.Error(), http.StatusBadRequest)
@@ -398,6 +386,7 @@ func HandleFinishLogin(w http.ResponseWriter, r *http.Request, webauthnService *
 		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
 		return
 	}
+	recordAudit(dbStore, r, user.ID, auditAccountLogin, nil)
 
 	// Generate JWT token without JID (network-specific tokens are minted on-demand)
 	// Empty JID for initial login token - network-specific tokens are generated when connecting
@@ -409,15 +398,7 @@ func HandleFinishLogin(w http.ResponseWriter, r *http.Request, webauthnService *
 	}
 
 	// Set JWT token in cookie
-	http.SetCookie(w, &http.Cookie{
-		Name:     "jwt",
-		Value:    token,
-		Path:     "/",
-		MaxAge:   86400, // 24 hours
-		HttpOnly: true,
-		SameSite: http.SameSiteLaxMode,
-		Secure:   false, // Set to true in production with HTTPS
-	})
+	setTokenCookie(w, r, token, jwtService.AccessTokenTTL())
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
@@ -433,3 +414,30 @@ func HandleFinishLogin(w http.ResponseWriter, r *http.Request, webauthnService *
 		log.Printf("Error encoding finish login response: %v", err)
 	}
 }
+
+// ceremonyOptions parses a client's ceremony preferences
+func ceremonyOptions(attachment, userVerification string) (auth.CeremonyOptions, error) {
+	var opts auth.CeremonyOptions
+	var err error
+	if opts.Attachment, err = auth.ParseAttachment(attachment); err != nil {
+		return opts, err
+	}
+	if opts.UserVerification, err = auth.ParseUserVerification(userVerification); err != nil {
+		return opts, err
+	}
+	return opts, nil
+}
+
+// setTokenCookie stores a sign-in token in a cookie that lasts as long as
+// the token. It is only sent back over HTTPS when the sign-in used HTTPS.
+func setTokenCookie(w http.ResponseWriter, r *http.Request, token string, ttl time.Duration) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     "jwt",
+		Value:    token,
+		Path:     "/",
+		MaxAge:   int(ttl.Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		Secure:   middleware.IsHTTPS(r),
+	})
+}
@@ -2,28 +2,76 @@ package api
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"strings"
 	"time"
 
 	"github.com/jhead/lanscape/lanscaped/internal/api/middleware"
 	"github.com/jhead/lanscape/lanscaped/internal/api/routes"
 	"github.com/jhead/lanscape/lanscaped/internal/auth"
+	"github.com/jhead/lanscape/lanscaped/internal/authz"
+	"github.com/jhead/lanscape/lanscaped/internal/blob"
+	"github.com/jhead/lanscape/lanscaped/internal/buildinfo"
+	"github.com/jhead/lanscape/lanscaped/internal/certs"
+	"github.com/jhead/lanscape/lanscaped/internal/secrets"
 	"github.com/jhead/lanscape/lanscaped/internal/store"
+	"github.com/jhead/lanscape/lanscaped/internal/topics"
+	"github.com/jhead/lanscape/lanscaped/internal/tracing"
+	"github.com/jhead/lanscape/lanscaped/internal/webui"
 )
 
 // Server represents the HTTP server
 type Server struct {
 	httpServer      *http.Server
-	port            int
 	store           *store.Store
 	webauthnService *auth.WebAuthnService
 	jwtService      *auth.JWTService
+
+	// authz decides what users may do to networks
+	authz *authz.Authorizer
+
+	// deviceVerificationURI is the web UI page where users approve device sign-ins
+	deviceVerificationURI string
+
+	// topics restricts networks' signaling topics to their members and
+	// disconnects peers when membership changes; nil if no signaling server
+	// is configured
+	topics topics.Admin
+
+	// avatars holds uploaded network avatar images
+	avatars blob.Store
+
+	// presenceToken authenticates the signaling server's presence reports;
+	// reporting is disabled when empty
+	presenceToken string
+
+	// certs keeps the TLS certificate the API is served with; nil to serve
+	// plain HTTP, e.g. behind a proxy that terminates TLS
+	certs *certs.Manager
+
+	// maintenanceInterval is how often database maintenance runs; 0 never
+	maintenanceInterval time.Duration
+
+	// ui serves the web UI on every path the API does not; nil if lanscaped
+	// was built without it
+	ui *webui.UI
+
+	// stopTracing flushes spans not yet exported
+	stopTracing func(context.Context) error
 }
 
 // NewServer creates a new API server
 func NewServer(port int) (*Server, error) {
+	stopTracing, err := tracing.FromEnv()
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize tracing: %w", err)
+	}
+
 	// Initialize database store
 	dbStore, err := store.NewStore()
 	if err != nil {
@@ -42,37 +90,173 @@ func NewServer(port int) (*Server, error) {
 		return nil, fmt.Errorf("failed to initialize JWT service: %w", err)
 	}
 
-	return &Server{
-		port:            port,
-		store:           dbStore,
-		webauthnService: webauthnService,
-		jwtService:      jwtService,
-	}, nil
-}
+	deviceVerificationURI := os.Getenv("DEVICE_VERIFICATION_URI")
+	if deviceVerificationURI == "" {
+		origin := os.Getenv("WEBAUTHN_RP_ORIGIN")
+		if origin == "" {
+			origin = "http://localhost:5173"
+		}
+		deviceVerificationURI = strings.TrimSuffix(origin, "/") + "/device"
+	}
+
+	// ADMIN_USERS lists the usernames of administrators, who may view the
+	// live state of every network
+	authorizer := authz.New(dbStore, dbStore, nil)
+	var admins []string
+	for _, name := range strings.Split(os.Getenv("ADMIN_USERS"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			admins = append(admins, name)
+		}
+	}
+	authorizer.SetAdmins(dbStore, admins)
+
+	s := &Server{
+		store:                 dbStore,
+		webauthnService:       webauthnService,
+		jwtService:            jwtService,
+		authz:                 authorizer,
+		deviceVerificationURI: deviceVerificationURI,
+		stopTracing:           stopTracing,
+	}
+	client, err := topics.NewAdminClientFromEnv()
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize signaling admin client: %w", err)
+	}
+	if client != nil {
+		s.topics = client
+	}
+	if s.presenceToken, err = secrets.Get("PRESENCE_TOKEN"); err != nil {
+		return nil, err
+	}
+
+	avatars, source, err := blob.FromEnv()
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize avatar store: %w", err)
+	}
+	s.avatars = avatars
+	log.Printf("Storing network avatars in %s", source)
+
+	s.certs, err = certs.FromEnv()
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize ACME: %w", err)
+	}
+
+	security, err := middleware.SecurityHeadersFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	proxies, err := middleware.TrustedProxiesFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	limiter, err := middleware.RateLimiterFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	if limiter != nil {
+		log.Printf("Rate limiting clients to %g requests per second in bursts of %d", limiter.Rate, limiter.Burst)
+	}
+
+	// DB_MAINTENANCE_INTERVAL is how often the database is checked and
+	// vacuumed
+	s.maintenanceInterval = store.DefaultMaintenanceInterval
+	if v := os.Getenv("DB_MAINTENANCE_INTERVAL"); v != "" {
+		if s.maintenanceInterval, err = time.ParseDuration(v); err != nil || s.maintenanceInterval < 0 {
+			return nil, fmt.Errorf("invalid DB_MAINTENANCE_INTERVAL %q", v)
+		}
+	}
+
+	s.ui, err = webui.FromEnv()
+	if err != nil {
+		return nil, err
+	}
+	if s.ui != nil {
+		// The UI's pages load scripts and styles, while the API keeps the
+		// stricter policy
+		security.Override("/", s.ui.CSP)
+		for _, prefix := range webui.APIPrefixes {
+			security.Override(prefix, security.CSP)
+		}
+		log.Printf("Serving web UI from %s", s.ui.Source)
+	}
 
-// Start starts the HTTP server
-func (s *Server) Start() error {
 	mux := http.NewServeMux()
 
 	// Register routes
 	s.registerRoutes(mux)
 
-	// Add CORS middleware
-	handler := corsMiddleware(mux)
+	// Requests from trusted proxies are rewritten first so everything after
+	// sees the client's address and scheme. Security headers go on every
+	// response, CORS preflights included; preflights are not rate limited.
+	// Tracing wraps the mux itself, so spans are named after its routes.
+	handler := middleware.Chain(tracing.Handler(mux), proxies.Handler, security.Handler, corsMiddleware, limiter.Handler)
 
 	s.httpServer = &http.Server{
-		Addr:         fmt.Sprintf(":%d", s.port),
+		Addr:         fmt.Sprintf(":%d", port),
 		Handler:      handler,
 		ReadTimeout:  15 * time.Second,
 		WriteTimeout: 15 * time.Second,
 		IdleTimeout:  60 * time.Second,
 	}
+	if s.certs != nil {
+		s.httpServer.TLSConfig = &tls.Config{
+			GetCertificate: s.certs.GetCertificate,
+			NextProtos:     []string{"h2", "http/1.1"},
+		}
+	}
+
+	return s, nil
+}
 
+// Start starts the HTTP server on the configured port
+func (s *Server) Start() error {
+	ln, err := net.Listen("tcp", s.httpServer.Addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ln)
+}
+
+// SetSignalingAdmin replaces the client that manages networks' signaling
+// topics, e.g. with one for an embedded signaling server. It must be called
+// before the server starts.
+func (s *Server) SetSignalingAdmin(admin topics.Admin) {
+	s.topics = admin
+}
+
+// SetPresenceToken replaces the token the signaling server reports presence
+// with, e.g. for an embedded signaling server. It must be called before the
+// server starts.
+func (s *Server) SetPresenceToken(token string) {
+	s.presenceToken = token
+}
+
+// Serve serves the API on ln until Stop is called. It lets callers bind the
+// port themselves, e.g. to fail before starting anything else.
+func (s *Server) Serve(ln net.Listener) error {
 	// Start periodic cleanup of expired sessions
 	go s.startSessionCleanup()
+	if s.maintenanceInterval > 0 {
+		go s.startMaintenance()
+	}
+
+	if s.topics != nil {
+		go s.syncTopics()
+	} else {
+		log.Println("Warning: no signaling admin API configured (SIGNALING_ADMIN_URL); network topics are not restricted to members")
+	}
+
+	if s.certs != nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		s.httpServer.RegisterOnShutdown(cancel)
+		go s.certs.Run(ctx)
 
-	log.Printf("Starting server on port %d", s.port)
-	return s.httpServer.ListenAndServe()
+		log.Printf("Starting server with TLS on %s", ln.Addr())
+		return s.httpServer.ServeTLS(ln, "", "")
+	}
+
+	log.Printf("Starting server on %s", ln.Addr())
+	return s.httpServer.Serve(ln)
 }
 
 // startSessionCleanup runs periodic cleanup of expired sessions
@@ -86,6 +270,46 @@ func (s *Server) startSessionCleanup() {
 		} else {
 			log.Println("Cleaned up expired sessions")
 		}
+		if err := s.store.CleanupExpiredDeviceCodes(); err != nil {
+			log.Printf("Error cleaning up expired device codes: %v", err)
+		}
+		if err := s.store.CleanupExpiredJoinRequests(); err != nil {
+			log.Printf("Error cleaning up expired join requests: %v", err)
+		}
+		if err := s.store.CleanupExpiredInvitations(); err != nil {
+			log.Printf("Error cleaning up expired invitations: %v", err)
+		}
+	}
+}
+
+// startMaintenance runs periodic database maintenance
+func (s *Server) startMaintenance() {
+	ticker := time.NewTicker(s.maintenanceInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if _, err := s.store.Maintain(context.Background()); err != nil {
+			log.Printf("Error running database maintenance: %v", err)
+		}
+	}
+}
+
+// syncTopics registers the signaling topics of existing networks
+func (s *Server) syncTopics() {
+	networks, err := s.store.ListNetworks()
+	if err != nil {
+		log.Printf("Error listing networks for topic sync: %v", err)
+		return
+	}
+	names := make([]string, len(networks))
+	for i, network := range networks {
+		names[i] = network.Name
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if err := topics.Sync(ctx, s.topics, names); err == nil {
+		log.Printf("Registered signaling topics for %d networks", len(names))
 	}
 }
 
@@ -97,9 +321,10 @@ func corsMiddleware(next http.Handler) http.Handler {
 			origin = "*"
 		}
 		w.Header().Set("Access-Control-Allow-Origin", origin)
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
 		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
 		w.Header().Set("Access-Control-Allow-Credentials", "true")
+		w.Header().Set("Access-Control-Expose-Headers", "ETag, "+tracing.Header+", "+middleware.RateLimitHeaders)
 
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(http.StatusOK)
@@ -110,34 +335,51 @@ func corsMiddleware(next http.Handler) http.Handler {
 	})
 }
 
-// Stop gracefully stops the HTTP server
+// Stop gracefully stops the HTTP server, then closes the database once
+// in-flight requests are done with it and flushes their traces
 func (s *Server) Stop(ctx context.Context) error {
 	log.Println("Shutting down server...")
+	err := s.httpServer.Shutdown(ctx)
 	if err := s.store.Close(); err != nil {
 		log.Printf("Error closing database: %v", err)
 	}
-	return s.httpServer.Shutdown(ctx)
+	if err := s.stopTracing(ctx); err != nil {
+		log.Printf("Error flushing traces: %v", err)
+	}
+	return err
+}
+
+// storeFor returns the store for serving r, whose queries are traced as part
+// of the request. They are not canceled with it, since handlers expect their
+// writes to finish.
+func (s *Server) storeFor(r *http.Request) *store.Store {
+	return s.store.WithContext(context.WithoutCancel(r.Context()))
 }
 
 // registerRoutes registers all API routes
 func (s *Server) registerRoutes(mux *http.ServeMux) {
 	// Health check
-	mux.HandleFunc("GET /healthz", routes.HandleHealthz)
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		routes.HandleHealthz(w, r, s.storeFor(r))
+	})
+
+	// Build version, for diagnosing compatibility across a deployment
+	mux.Handle("GET /version", buildinfo.Handler())
 
 	// WebAuthn registration routes
 	mux.HandleFunc("POST /v1/webauthn/register/begin", func(w http.ResponseWriter, r *http.Request) {
-		routes.HandleBeginRegistration(w, r, s.webauthnService, s.store)
+		routes.HandleBeginRegistration(w, r, s.webauthnService, s.storeFor(r))
 	})
 	mux.HandleFunc("POST /v1/webauthn/register/finish", func(w http.ResponseWriter, r *http.Request) {
-		routes.HandleFinishRegistration(w, r, s.webauthnService, s.store, s.jwtService)
+		routes.HandleFinishRegistration(w, r, s.webauthnService, s.storeFor(r), s.jwtService)
 	})
 
 	// WebAuthn login routes
 	mux.HandleFunc("POST /v1/webauthn/login/begin", func(w http.ResponseWriter, r *http.Request) {
-		routes.HandleBeginLogin(w, r, s.webauthnService, s.store)
+		routes.HandleBeginLogin(w, r, s.webauthnService, s.storeFor(r))
 	})
 	mux.HandleFunc("POST /v1/webauthn/login/finish", func(w http.ResponseWriter, r *http.Request) {
-		routes.HandleFinishLogin(w, r, s.webauthnService, s.store, s.jwtService)
+		routes.HandleFinishLogin(w, r, s.webauthnService, s.storeFor(r), s.jwtService)
 	})
 
 	// Auth routes
@@ -145,20 +387,82 @@ func (s *Server) registerRoutes(mux *http.ServeMux) {
 
 	// Protected routes (require JWT)
 	jwtMiddleware := middleware.JWTAuthMiddleware(s.jwtService)
+
+	// Routes personal API tokens may also call, given the scope
+	scoped := middleware.ScopedAuthMiddleware(s.jwtService, s.store)
 	mux.Handle("GET /v1/auth/test", jwtMiddleware(http.HandlerFunc(routes.HandleAuthTest)))
 
 	// Network routes (require JWT)
-	mux.Handle("POST /v1/networks", jwtMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		routes.HandleCreateNetwork(w, r, s.store)
+	mux.Handle("POST /v1/networks", scoped(auth.ScopeNetworksWrite)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		routes.HandleCreateNetwork(w, r, s.storeFor(r), s.topics)
+	})))
+	mux.Handle("GET /v1/networks", scoped(auth.ScopeNetworksRead)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		routes.HandleListNetworks(w, r, s.storeFor(r))
+	})))
+	mux.Handle("GET /v1/networks/directory", scoped(auth.ScopeNetworksRead)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		routes.HandleNetworkDirectory(w, r, s.storeFor(r))
+	})))
+	mux.Handle("PUT /v1/networks/{id}/join", scoped(auth.ScopeNetworksWrite)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		routes.HandleJoinNetwork(w, r, s.storeFor(r), s.authz, s.topics)
 	})))
-	mux.Handle("GET /v1/networks", jwtMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		routes.HandleListNetworks(w, r, s.store)
+	mux.Handle("DELETE /v1/networks/{id}/join", scoped(auth.ScopeNetworksWrite)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		routes.HandleLeaveNetwork(w, r, s.storeFor(r), s.authz, s.topics)
 	})))
-	mux.Handle("PUT /v1/networks/{id}/join", jwtMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		routes.HandleJoinNetwork(w, r, s.store)
+	mux.Handle("GET /v1/networks/{id}/members", scoped(auth.ScopeNetworksRead)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		routes.HandleListMembers(w, r, s.storeFor(r), s.authz)
 	})))
-	mux.Handle("DELETE /v1/networks/{id}", jwtMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		routes.HandleDeleteNetwork(w, r, s.store)
+	mux.Handle("POST /v1/networks/{id}/members:batch", scoped(auth.ScopeNetworksWrite)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		routes.HandleMemberBatch(w, r, s.storeFor(r), s.authz, s.topics)
+	})))
+	mux.Handle("GET /v1/networks/{id}/settings", scoped(auth.ScopeNetworksRead)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		routes.HandleGetNetworkSettings(w, r, s.storeFor(r), s.authz)
+	})))
+	mux.Handle("PUT /v1/networks/{id}/settings", scoped(auth.ScopeNetworksWrite)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		routes.HandleUpdateNetworkSettings(w, r, s.storeFor(r), s.authz)
+	})))
+	mux.Handle("GET /v1/networks/{id}/join-requests", scoped(auth.ScopeNetworksRead)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		routes.HandleListJoinRequests(w, r, s.storeFor(r), s.authz)
+	})))
+	mux.Handle("PUT /v1/networks/{id}/join-requests/{user_id}", scoped(auth.ScopeNetworksWrite)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		routes.HandleApproveJoinRequest(w, r, s.storeFor(r), s.authz, s.topics)
+	})))
+	mux.Handle("DELETE /v1/networks/{id}/join-requests/{user_id}", scoped(auth.ScopeNetworksWrite)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		routes.HandleRejectJoinRequest(w, r, s.storeFor(r), s.authz)
+	})))
+	mux.Handle("GET /v1/invitations", scoped(auth.ScopeNetworksRead)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		routes.HandleListInvitations(w, r, s.storeFor(r))
+	})))
+	mux.Handle("PUT /v1/invitations/{id}", scoped(auth.ScopeNetworksWrite)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		routes.HandleAcceptInvitation(w, r, s.storeFor(r), s.topics)
+	})))
+	mux.Handle("DELETE /v1/invitations/{id}", scoped(auth.ScopeNetworksWrite)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		routes.HandleDeclineInvitation(w, r, s.storeFor(r))
+	})))
+	mux.Handle("DELETE /v1/networks/{id}", scoped(auth.ScopeNetworksWrite)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		routes.HandleDeleteNetwork(w, r, s.storeFor(r), s.authz, s.topics, s.avatars)
+	})))
+	mux.Handle("GET /v1/networks/{id}", scoped(auth.ScopeNetworksRead)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		routes.HandleGetNetwork(w, r, s.storeFor(r), s.authz)
+	})))
+	mux.Handle("PATCH /v1/networks/{id}", scoped(auth.ScopeNetworksWrite)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		routes.HandleUpdateNetwork(w, r, s.storeFor(r), s.authz)
+	})))
+	mux.Handle("GET /v1/networks/{id}/avatar", scoped(auth.ScopeNetworksRead)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		routes.HandleGetNetworkAvatar(w, r, s.storeFor(r), s.authz, s.avatars)
+	})))
+	mux.Handle("PUT /v1/networks/{id}/avatar", scoped(auth.ScopeNetworksWrite)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		routes.HandleUploadNetworkAvatar(w, r, s.storeFor(r), s.authz, s.avatars)
+	})))
+	mux.Handle("DELETE /v1/networks/{id}/avatar", scoped(auth.ScopeNetworksWrite)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		routes.HandleDeleteNetworkAvatar(w, r, s.storeFor(r), s.authz, s.avatars)
+	})))
+
+	// Usage routes (require JWT) - agents post usage reports, members read aggregated stats
+	mux.Handle("POST /v1/networks/{id}/usage", scoped(auth.ScopeNetworksWrite)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		routes.HandleReportUsage(w, r, s.storeFor(r), s.authz)
+	})))
+	mux.Handle("GET /v1/networks/{id}/usage", scoped(auth.ScopeNetworksRead)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		routes.HandleGetUsage(w, r, s.storeFor(r), s.authz)
 	})))
 
 	// API v1 routes
@@ -167,9 +471,89 @@ func (s *Server) registerRoutes(mux *http.ServeMux) {
 	// Me endpoint (require JWT)
 	mux.Handle("GET /v1/me", jwtMiddleware(http.HandlerFunc(routes.HandleMe)))
 
+	// Account timeline (require JWT) - audit events, agent enrollments, and presence
+	mux.Handle("GET /v1/me/activity", jwtMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		routes.HandleListActivity(w, r, s.storeFor(r))
+	})))
+
 	// Token endpoint (require JWT) - mints new JWT token with network-specific JID for XMPP auth
 	mux.Handle("GET /v1/auth/token", jwtMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		routes.HandleGetToken(w, r, s.jwtService, s.store)
+		routes.HandleGetToken(w, r, s.jwtService, s.storeFor(r), s.authz)
+	})))
+
+	// Device sign-in routes - devices without a browser (such as agents) get a
+	// code to show the user, then poll for a token once it is approved
+	mux.HandleFunc("POST /v1/device/code", func(w http.ResponseWriter, r *http.Request) {
+		routes.HandleRequestDeviceCode(w, r, s.storeFor(r), s.deviceVerificationURI)
+	})
+	mux.Handle("POST /v1/device/approve", jwtMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		routes.HandleApproveDevice(w, r, s.storeFor(r))
+	})))
+	mux.HandleFunc("POST /v1/device/token", func(w http.ResponseWriter, r *http.Request) {
+		routes.HandleDeviceToken(w, r, s.jwtService, s.storeFor(r))
+	})
+
+	// Agent enrollment (require JWT) - registers an agent identity key with the caller's account
+	mux.Handle("POST /v1/me/agents", jwtMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		routes.HandleRegisterAgent(w, r, s.storeFor(r))
+	})))
+	mux.Handle("GET /v1/me/agents", jwtMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		routes.HandleListAgents(w, r, s.storeFor(r))
+	})))
+	mux.Handle("PATCH /v1/me/agents/{id}", jwtMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		routes.HandleRenameAgent(w, r, s.storeFor(r))
+	})))
+	mux.Handle("DELETE /v1/me/agents/{id}", jwtMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		routes.HandleRevokeAgent(w, r, s.storeFor(r))
+	})))
+
+	// Personal API tokens (require JWT) - scoped tokens for automation,
+	// which cannot manage tokens themselves
+	mux.Handle("POST /v1/me/tokens", jwtMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		routes.HandleCreateAPIToken(w, r, s.storeFor(r))
+	})))
+	mux.Handle("GET /v1/me/tokens", jwtMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		routes.HandleListAPITokens(w, r, s.storeFor(r))
+	})))
+	mux.Handle("DELETE /v1/me/tokens/{id}", jwtMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		routes.HandleDeleteAPIToken(w, r, s.storeFor(r))
+	})))
+
+	// Revoked agent keys (public) - polled by signaling servers and agents
+	mux.HandleFunc("GET /v1/agents/revoked", func(w http.ResponseWriter, r *http.Request) {
+		routes.HandleListRevokedAgents(w, r, s.storeFor(r))
+	})
+
+	// Admin routes (require JWT and ADMIN_USERS) - live state of networks
+	// and the signaling server
+	mux.Handle("GET /v1/admin/live", scoped(auth.ScopeAdminLive)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		routes.HandleAdminLive(w, r, s.storeFor(r), s.authz, s.topics)
+	})))
+
+	// Database maintenance (require JWT and ADMIN_USERS) - the database's
+	// size and latest maintenance run, or run maintenance now
+	mux.Handle("GET /v1/admin/maintenance", scoped(auth.ScopeAdminMaintenance)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		routes.HandleGetMaintenance(w, r, s.storeFor(r), s.authz)
+	})))
+	mux.Handle("POST /v1/admin/maintenance", scoped(auth.ScopeAdminMaintenance)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		routes.HandleRunMaintenance(w, r, s.storeFor(r), s.authz)
+	})))
+
+	// Presence ingestion - the signaling server reports agents coming online
+	// and going offline, authenticated with PRESENCE_TOKEN
+	mux.HandleFunc("POST /v1/presence", func(w http.ResponseWriter, r *http.Request) {
+		routes.HandleReportPresence(w, r, s.storeFor(r), s.presenceToken)
+	})
+
+	// Attestation endpoint (require JWT) - signs a topic membership attestation for an agent key
+	mux.Handle("POST /v1/attestations", jwtMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		routes.HandleIssueAttestation(w, r, s.jwtService, s.storeFor(r), s.authz)
+	})))
+
+	// Topic key endpoint (require JWT) - wraps the network's group encryption
+	// keys to a member's agent key
+	mux.Handle("GET /v1/networks/{id}/keys", jwtMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		routes.HandleGetTopicKeys(w, r, s.storeFor(r), s.authz)
 	})))
 
 	// JWKS endpoints (public, no auth required)
@@ -179,11 +563,37 @@ func (s *Server) registerRoutes(mux *http.ServeMux) {
 	mux.HandleFunc("GET /v1/jwks", func(w http.ResponseWriter, r *http.Request) {
 		routes.HandleJWKS(w, r, s.jwtService)
 	})
+	mux.HandleFunc("GET /.well-known/lanscape.jwt.json", func(w http.ResponseWriter, r *http.Request) {
+		routes.HandleTokenMetadata(w, r, s.jwtService)
+	})
 
 	// Device routes (require JWT)
-	mux.Handle("POST /v1/devices/adopt", jwtMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		routes.HandleAdoptDevice(w, r, s.store)
+	mux.Handle("POST /v1/devices/adopt", scoped(auth.ScopeDevicesAdopt)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		routes.HandleAdoptDevice(w, r, s.storeFor(r), s.authz)
+	})))
+	mux.Handle("POST /v1/networks/{id}/import", scoped(auth.ScopeNetworksWrite)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		routes.HandleImportTailnet(w, r, s.storeFor(r), s.authz)
+	})))
+	mux.Handle("GET /v1/tailnet-links", scoped(auth.ScopeNetworksRead)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		routes.HandleListTailnetLinks(w, r, s.storeFor(r))
+	})))
+	mux.Handle("PUT /v1/tailnet-links/{id}", scoped(auth.ScopeNetworksWrite)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		routes.HandleAcceptTailnetLink(w, r, s.storeFor(r), s.topics)
+	})))
+	mux.Handle("DELETE /v1/tailnet-links/{id}", scoped(auth.ScopeNetworksWrite)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		routes.HandleDeclineTailnetLink(w, r, s.storeFor(r))
 	})))
+	mux.Handle("GET /v1/networks/{id}/devices", scoped(auth.ScopeDevicesRead)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		routes.HandleListDevices(w, r, s.storeFor(r), s.authz)
+	})))
+	mux.Handle("GET /v1/networks/{id}/devices/adopt/qr", scoped(auth.ScopeDevicesAdopt)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		routes.HandleAdoptQR(w, r, s.storeFor(r), s.authz)
+	})))
+
+	// Web UI - every other path, so client-side routes load the app
+	if s.ui != nil {
+		mux.Handle("GET /", s.ui)
+	}
 
 	log.Println("Routes registered")
 }
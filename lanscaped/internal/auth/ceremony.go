@@ -0,0 +1,143 @@
+package auth
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+// defaultCeremonyTimeout is how long a client has to complete a registration
+// or login ceremony
+const defaultCeremonyTimeout = 5 * time.Minute
+
+// CeremonyConfig configures WebAuthn registration and login ceremonies
+type CeremonyConfig struct {
+	// Timeout bounds a ceremony, both in the browser and at the server
+	Timeout time.Duration
+	// UserVerification is the minimum user verification required
+	UserVerification protocol.UserVerificationRequirement
+	// Attachment restricts registration to platform or cross-platform
+	// authenticators; empty allows either
+	Attachment protocol.AuthenticatorAttachment
+	// ExcludeCredentials stops an authenticator from being registered to
+	// the same user twice
+	ExcludeCredentials bool
+}
+
+// CeremonyOptions are a client's preferences for one ceremony. Zero values
+// use the configured defaults.
+type CeremonyOptions struct {
+	Attachment       protocol.AuthenticatorAttachment
+	UserVerification protocol.UserVerificationRequirement
+}
+
+// userVerificationRank orders user verification requirements from weakest to
+// strongest
+var userVerificationRank = map[protocol.UserVerificationRequirement]int{
+	protocol.VerificationDiscouraged: 0,
+	protocol.VerificationPreferred:   1,
+	protocol.VerificationRequired:    2,
+}
+
+// ParseUserVerification parses a user verification requirement; empty is
+// returned as is
+func ParseUserVerification(s string) (protocol.UserVerificationRequirement, error) {
+	uv := protocol.UserVerificationRequirement(s)
+	if _, ok := userVerificationRank[uv]; !ok && s != "" {
+		return "", fmt.Errorf("user verification must be required, preferred, or discouraged")
+	}
+	return uv, nil
+}
+
+// ParseAttachment parses an authenticator attachment; empty is returned as is
+func ParseAttachment(s string) (protocol.AuthenticatorAttachment, error) {
+	switch a := protocol.AuthenticatorAttachment(s); a {
+	case "", protocol.Platform, protocol.CrossPlatform:
+		return a, nil
+	default:
+		return "", fmt.Errorf("attachment must be platform or cross-platform")
+	}
+}
+
+// loadCeremonyConfig reads the ceremony configuration from the environment
+func loadCeremonyConfig() (CeremonyConfig, error) {
+	config := CeremonyConfig{
+		Timeout:            defaultCeremonyTimeout,
+		UserVerification:   protocol.VerificationPreferred,
+		ExcludeCredentials: true,
+	}
+
+	if v := os.Getenv("WEBAUTHN_TIMEOUT"); v != "" {
+		timeout, err := time.ParseDuration(v)
+		if err != nil || timeout <= 0 {
+			return config, fmt.Errorf("invalid WEBAUTHN_TIMEOUT %q", v)
+		}
+		config.Timeout = timeout
+	}
+
+	if v := os.Getenv("WEBAUTHN_USER_VERIFICATION"); v != "" {
+		uv, err := ParseUserVerification(v)
+		if err != nil {
+			return config, fmt.Errorf("invalid WEBAUTHN_USER_VERIFICATION: %w", err)
+		}
+		config.UserVerification = uv
+	}
+
+	attachment, err := ParseAttachment(os.Getenv("WEBAUTHN_ATTACHMENT"))
+	if err != nil {
+		return config, fmt.Errorf("invalid WEBAUTHN_ATTACHMENT: %w", err)
+	}
+	config.Attachment = attachment
+
+	if v := os.Getenv("WEBAUTHN_EXCLUDE_CREDENTIALS"); v != "" {
+		exclude, err := strconv.ParseBool(v)
+		if err != nil {
+			return config, fmt.Errorf("invalid WEBAUTHN_EXCLUDE_CREDENTIALS %q", v)
+		}
+		config.ExcludeCredentials = exclude
+	}
+
+	return config, nil
+}
+
+// timeouts enforces the ceremony timeout at the server as well as in the
+// browser
+func (c CeremonyConfig) timeouts() webauthn.TimeoutsConfig {
+	timeout := webauthn.TimeoutConfig{Enforce: true, Timeout: c.Timeout, TimeoutUVD: c.Timeout}
+	return webauthn.TimeoutsConfig{Login: timeout, Registration: timeout}
+}
+
+// userVerification returns the requirement for a ceremony. A client may ask
+// for stricter verification than configured, never for weaker.
+func (c CeremonyConfig) userVerification(opts CeremonyOptions) protocol.UserVerificationRequirement {
+	if userVerificationRank[opts.UserVerification] > userVerificationRank[c.UserVerification] {
+		return opts.UserVerification
+	}
+	return c.UserVerification
+}
+
+// attachment returns the authenticator attachment for a registration. A
+// client may only choose one when the configuration allows either.
+func (c CeremonyConfig) attachment(opts CeremonyOptions) protocol.AuthenticatorAttachment {
+	if c.Attachment != "" {
+		return c.Attachment
+	}
+	return opts.Attachment
+}
+
+// hints suggests the authenticator the browser should offer first for an
+// attachment
+func hints(attachment protocol.AuthenticatorAttachment) []protocol.PublicKeyCredentialHints {
+	switch attachment {
+	case protocol.Platform:
+		return []protocol.PublicKeyCredentialHints{protocol.PublicKeyCredentialHintClientDevice}
+	case protocol.CrossPlatform:
+		return []protocol.PublicKeyCredentialHints{protocol.PublicKeyCredentialHintSecurityKey}
+	default:
+		return nil
+	}
+}
@@ -3,20 +3,64 @@ package auth
 import (
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/x509"
+	"encoding/hex"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"log"
 	"os"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/jhead/lanscape/lanscaped/internal/secrets"
 )
 
+// SigningKeyID identifies the signing key in the JWKS and token headers
+const SigningKeyID = "lanscape-key-1"
+
+// Algorithms access tokens can be signed with, chosen by JWT_SIGNING_ALG
+const (
+	// AlgRS256 signs with the RSA key also published in the JWKS (default)
+	AlgRS256 = "RS256"
+	// AlgHS256 signs with JWT_HMAC_SECRET, for installs that would rather not
+	// manage an RSA key
+	AlgHS256 = "HS256"
+)
+
+// minHMACSecretLen is the shortest HS256 secret accepted: as long as the
+// hash output, as RFC 7518 requires
+const minHMACSecretLen = 32
+
+// minHMACSecretBytes is the fewest distinct bytes an HS256 secret may have,
+// to refuse placeholders such as a repeated character
+const minHMACSecretBytes = 8
+
+// ErrAlgorithmMismatch means a token names a signing algorithm other than
+// the configured one, as in an algorithm confusion attempt
+var ErrAlgorithmMismatch = errors.New("unexpected signing algorithm")
+
+// AttestationAudience marks a token as a topic membership attestation. Such
+// tokens are handed to other peers, so they are never accepted for API access.
+const AttestationAudience = "lanscape-attestation"
+
+// AttestationTTL is how long a membership attestation is valid
+const AttestationTTL = 24 * time.Hour
+
 // JWTService handles JWT token operations
 type JWTService struct {
+	// privateKey signs attestations, which peers verify with the JWKS, and
+	// also access tokens in RS256 mode
 	privateKey *rsa.PrivateKey
 	publicKey  *rsa.PublicKey
+	config     TokenConfig
+
+	// method, signingKey, verifyKey, and keyID sign and verify access tokens
+	method     jwt.SigningMethod
+	signingKey any
+	verifyKey  any
+	keyID      string
 }
 
 // Claims represents JWT claims
@@ -27,13 +71,31 @@ type Claims struct {
 	jwt.RegisteredClaims
 }
 
+// AttestationClaims represents a membership attestation: a statement that an
+// agent identity key belongs to a user who is a member of a network
+type AttestationClaims struct {
+	UserID    int64  `json:"user_id"`
+	Username  string `json:"username"`
+	Network   string `json:"network"`
+	PublicKey string `json:"public_key"` // agent ed25519 identity key, base64url
+	jwt.RegisteredClaims
+}
+
 // NewJWTService creates a new JWT service with RSA keys
 func NewJWTService() (*JWTService, error) {
 	var privateKey *rsa.PrivateKey
 	var err error
 
+	config, err := loadTokenConfig()
+	if err != nil {
+		return nil, err
+	}
+
 	// Try to load private key from environment
-	privateKeyPEM := os.Getenv("JWT_PRIVATE_KEY")
+	privateKeyPEM, err := secrets.Get("JWT_PRIVATE_KEY")
+	if err != nil {
+		return nil, err
+	}
 	if privateKeyPEM != "" {
 		block, _ := pem.Decode([]byte(privateKeyPEM))
 		if block == nil {
@@ -60,18 +122,98 @@ func NewJWTService() (*JWTService, error) {
 		if err != nil {
 			return nil, fmt.Errorf("failed to generate RSA key: %w", err)
 		}
-		log.Printf("WARNING: Generated new RSA key pair. Set JWT_PRIVATE_KEY env var for production!")
+		log.Printf("WARNING: Generated new RSA key pair. Set JWT_PRIVATE_KEY or JWT_PRIVATE_KEY_FILE for production!")
 	}
 
-	return &JWTService{
+	log.Printf("JWT lifetimes: access %s, network %s, device %s, clock skew %s",
+		config.AccessTokenTTL, config.NetworkTokenTTL, config.DeviceTokenTTL, config.ClockSkew)
+
+	j := &JWTService{
 		privateKey: privateKey,
 		publicKey:  &privateKey.PublicKey,
-	}, nil
+		config:     config,
+		method:     jwt.SigningMethodRS256,
+		signingKey: privateKey,
+		verifyKey:  &privateKey.PublicKey,
+		keyID:      SigningKeyID,
+	}
+	if err := j.loadSigningMode(privateKeyPEM != ""); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// loadSigningMode switches access tokens to HS256 if JWT_SIGNING_ALG asks
+// for it. Attestations stay RS256, since peers verify them with the public
+// key; haveRSAKey reports whether that key was configured or generated.
+func (j *JWTService) loadSigningMode(haveRSAKey bool) error {
+	alg := os.Getenv("JWT_SIGNING_ALG")
+	switch alg {
+	case "", AlgRS256:
+		return nil
+	case AlgHS256:
+	default:
+		return fmt.Errorf("invalid JWT_SIGNING_ALG %q: must be %s or %s", alg, AlgRS256, AlgHS256)
+	}
+
+	secret, err := secrets.Get("JWT_HMAC_SECRET")
+	if err != nil {
+		return err
+	}
+	if err := validateHMACSecret([]byte(secret)); err != nil {
+		return err
+	}
+
+	j.method = jwt.SigningMethodHS256
+	j.signingKey = []byte(secret)
+	j.verifyKey = []byte(secret)
+	j.keyID = hmacKeyID([]byte(secret))
+	log.Printf("Signing access tokens with HS256 (key ID %s)", j.keyID)
+	if !haveRSAKey {
+		log.Printf("Attestations are signed with a generated RSA key; peers' attestations are invalidated on every start")
+	}
+	return nil
+}
+
+// validateHMACSecret checks an HS256 secret is long and varied enough to
+// resist guessing
+func validateHMACSecret(secret []byte) error {
+	if len(secret) == 0 {
+		return fmt.Errorf("JWT_SIGNING_ALG is %s but JWT_HMAC_SECRET is not set", AlgHS256)
+	}
+	if len(secret) < minHMACSecretLen {
+		return fmt.Errorf("JWT_HMAC_SECRET must be at least %d bytes, got %d", minHMACSecretLen, len(secret))
+	}
+	distinct := make(map[byte]bool)
+	for _, b := range secret {
+		distinct[b] = true
+	}
+	if len(distinct) < minHMACSecretBytes {
+		return fmt.Errorf("JWT_HMAC_SECRET is too repetitive; generate one with e.g. `openssl rand -base64 32`")
+	}
+	return nil
+}
+
+// hmacKeyID derives a key ID from an HS256 secret, so tokens signed before
+// the secret changes are told apart without revealing it
+func hmacKeyID(secret []byte) string {
+	sum := sha256.Sum256(append([]byte("lanscape-hs256-kid:"), secret...))
+	return "hs256-" + hex.EncodeToString(sum[:8])
+}
+
+// AccessTokenTTL is the lifetime of sign-in tokens, for cookies holding them
+func (j *JWTService) AccessTokenTTL() time.Duration {
+	return j.config.AccessTokenTTL
 }
 
-// GenerateToken generates a JWT token for a user
+// GenerateToken generates a JWT token for a user. Tokens with a JID are
+// network tokens and use the network token lifetime.
 func (j *JWTService) GenerateToken(userID int64, username string, jid string) (string, error) {
-	expirationTime := time.Now().Add(24 * time.Hour) // Token expires in 24 hours
+	ttl := j.config.AccessTokenTTL
+	if jid != "" {
+		ttl = j.config.NetworkTokenTTL
+	}
+	expirationTime := time.Now().Add(ttl)
 
 	claims := &Claims{
 		UserID:   userID,
@@ -84,8 +226,7 @@ func (j *JWTService) GenerateToken(userID int64, username string, jid string) (s
 		},
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
-	tokenString, err := token.SignedString(j.privateKey)
+	tokenString, err := j.sign(claims)
 	if err != nil {
 		return "", fmt.Errorf("failed to sign token: %w", err)
 	}
@@ -93,16 +234,75 @@ func (j *JWTService) GenerateToken(userID int64, username string, jid string) (s
 	return tokenString, nil
 }
 
+// GenerateDeviceToken generates a long-lived access token for a device that
+// signed in through the device-code flow. Returns the token and its expiry.
+func (j *JWTService) GenerateDeviceToken(userID int64, username string) (string, time.Time, error) {
+	now := time.Now()
+	expirationTime := now.Add(j.config.DeviceTokenTTL)
+
+	claims := &Claims{
+		UserID:   userID,
+		Username: username,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(expirationTime),
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+		},
+	}
+
+	tokenString, err := j.sign(claims)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to sign token: %w", err)
+	}
+
+	return tokenString, expirationTime, nil
+}
+
+// GenerateAttestation signs a membership attestation binding an agent
+// identity key to a user and network. Returns the token and its expiry.
+func (j *JWTService) GenerateAttestation(userID int64, username, network, publicKey string) (string, time.Time, error) {
+	now := time.Now()
+	expirationTime := now.Add(AttestationTTL)
+
+	claims := &AttestationClaims{
+		UserID:    userID,
+		Username:  username,
+		Network:   network,
+		PublicKey: publicKey,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Audience:  jwt.ClaimStrings{AttestationAudience},
+			ExpiresAt: jwt.NewNumericDate(expirationTime),
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+		},
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = SigningKeyID
+	tokenString, err := token.SignedString(j.privateKey)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to sign attestation: %w", err)
+	}
+
+	return tokenString, expirationTime, nil
+}
+
 // ValidateToken validates a JWT token and returns the claims
 func (j *JWTService) ValidateToken(tokenString string) (*Claims, error) {
 	claims := &Claims{}
 
 	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		// Only the configured algorithm is accepted, so a token cannot pick
+		// how it is verified, e.g. HS256 keyed with the public RSA key
+		if token.Method.Alg() != j.method.Alg() {
+			return nil, fmt.Errorf("%w: %v", ErrAlgorithmMismatch, token.Header["alg"])
+		}
+		// Tokens issued before key IDs were set carry none
+		if kid, ok := token.Header["kid"]; ok && kid != j.keyID {
+			return nil, fmt.Errorf("unknown signing key: %v", kid)
 		}
-		return j.publicKey, nil
-	})
+		return j.verifyKey, nil
+	}, jwt.WithLeeway(j.config.ClockSkew))
 
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse token: %w", err)
@@ -112,6 +312,13 @@ func (j *JWTService) ValidateToken(tokenString string) (*Claims, error) {
 		return nil, fmt.Errorf("invalid token")
 	}
 
+	// Attestations are shared with peers and must not grant API access
+	for _, aud := range claims.Audience {
+		if aud == AttestationAudience {
+			return nil, fmt.Errorf("attestation cannot be used as an access token")
+		}
+	}
+
 	return claims, nil
 }
 
@@ -119,3 +326,16 @@ func (j *JWTService) ValidateToken(tokenString string) (*Claims, error) {
 func (j *JWTService) GetPublicKey() *rsa.PublicKey {
 	return j.publicKey
 }
+
+// AccessTokenKey returns the algorithm and key ID access tokens are signed
+// with
+func (j *JWTService) AccessTokenKey() (alg, kid string) {
+	return j.method.Alg(), j.keyID
+}
+
+// sign signs access token claims with the configured algorithm and key
+func (j *JWTService) sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(j.method, claims)
+	token.Header["kid"] = j.keyID
+	return token.SignedString(j.signingKey)
+}
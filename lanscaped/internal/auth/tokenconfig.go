@@ -0,0 +1,93 @@
+package auth
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// Default token lifetimes
+const (
+	defaultAccessTokenTTL  = 24 * time.Hour
+	defaultNetworkTokenTTL = 24 * time.Hour
+	// Devices such as agents run unattended, so their tokens outlive a
+	// browser's and stand in for a refresh token
+	defaultDeviceTokenTTL = 30 * 24 * time.Hour
+	defaultClockSkew      = 30 * time.Second
+)
+
+// maxClockSkew bounds the leeway, so a misconfiguration cannot keep expired
+// tokens valid for long
+const maxClockSkew = 5 * time.Minute
+
+// TokenConfig configures the lifetimes of issued tokens and the clock skew
+// tolerated when validating them
+type TokenConfig struct {
+	// AccessTokenTTL is the lifetime of browser sign-in tokens and their
+	// cookie
+	AccessTokenTTL time.Duration
+	// NetworkTokenTTL is the lifetime of tokens minted for one network
+	NetworkTokenTTL time.Duration
+	// DeviceTokenTTL is the lifetime of long-lived tokens issued through the
+	// device sign-in flow
+	DeviceTokenTTL time.Duration
+	// ClockSkew is the leeway allowed on expiry and not-before times
+	ClockSkew time.Duration
+}
+
+// loadTokenConfig reads the token configuration from the environment and
+// validates it
+func loadTokenConfig() (TokenConfig, error) {
+	config := TokenConfig{
+		AccessTokenTTL:  defaultAccessTokenTTL,
+		NetworkTokenTTL: defaultNetworkTokenTTL,
+		DeviceTokenTTL:  defaultDeviceTokenTTL,
+		ClockSkew:       defaultClockSkew,
+	}
+
+	durations := []struct {
+		env string
+		dst *time.Duration
+	}{
+		{"JWT_ACCESS_TTL", &config.AccessTokenTTL},
+		{"JWT_NETWORK_TOKEN_TTL", &config.NetworkTokenTTL},
+		{"JWT_DEVICE_TOKEN_TTL", &config.DeviceTokenTTL},
+		{"JWT_CLOCK_SKEW", &config.ClockSkew},
+	}
+	for _, d := range durations {
+		v := os.Getenv(d.env)
+		if v == "" {
+			continue
+		}
+		parsed, err := time.ParseDuration(v)
+		if err != nil {
+			return config, fmt.Errorf("invalid %s %q: %w", d.env, v, err)
+		}
+		*d.dst = parsed
+	}
+
+	if err := config.validate(); err != nil {
+		return config, err
+	}
+	return config, nil
+}
+
+// validate checks the lifetimes are usable
+func (c TokenConfig) validate() error {
+	for name, ttl := range map[string]time.Duration{
+		"JWT_ACCESS_TTL":        c.AccessTokenTTL,
+		"JWT_NETWORK_TOKEN_TTL": c.NetworkTokenTTL,
+		"JWT_DEVICE_TOKEN_TTL":  c.DeviceTokenTTL,
+	} {
+		if ttl < time.Minute {
+			return fmt.Errorf("%s must be at least 1m, got %s", name, ttl)
+		}
+	}
+	if c.ClockSkew < 0 || c.ClockSkew > maxClockSkew {
+		return fmt.Errorf("JWT_CLOCK_SKEW must be between 0 and %s, got %s", maxClockSkew, c.ClockSkew)
+	}
+	if c.DeviceTokenTTL < c.AccessTokenTTL {
+		return fmt.Errorf("JWT_DEVICE_TOKEN_TTL (%s) must not be shorter than JWT_ACCESS_TTL (%s)", c.DeviceTokenTTL, c.AccessTokenTTL)
+	}
+	return nil
+}
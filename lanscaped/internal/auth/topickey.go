@@ -0,0 +1,91 @@
+package auth
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"slices"
+)
+
+// topicKeyWrapLabel separates keys derived to wrap topic keys from other
+// uses of an agent's identity key
+const topicKeyWrapLabel = "lanscape topic key v1"
+
+// curve25519P is the field prime 2^255 - 19
+var curve25519P = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 255), big.NewInt(19))
+
+// WrapTopicKey encrypts a network's topic key to an agent's ed25519 identity
+// key (base64url), so only that agent can read it. The identity key is
+// converted to its X25519 form and an ephemeral X25519 exchange with it
+// derives an AES-256-GCM key. The result is base64url of the ephemeral
+// public key followed by the sealed topic key, bound to the network and
+// generation.
+func WrapTopicKey(publicKey string, key []byte, networkID, generation int64) (string, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(publicKey)
+	if err != nil || len(raw) != ed25519.PublicKeySize {
+		return "", fmt.Errorf("invalid agent public key")
+	}
+	recipient, err := ecdh.X25519().NewPublicKey(edwardsToMontgomery(raw))
+	if err != nil {
+		return "", fmt.Errorf("invalid agent public key: %w", err)
+	}
+
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate ephemeral key: %w", err)
+	}
+	shared, err := ephemeral.ECDH(recipient)
+	if err != nil {
+		return "", fmt.Errorf("failed to derive shared key: %w", err)
+	}
+
+	salt := slices.Concat(ephemeral.PublicKey().Bytes(), recipient.Bytes())
+	kek, err := hkdf.Key(sha256.New, shared, salt, topicKeyWrapLabel, 32)
+	if err != nil {
+		return "", err
+	}
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return "", err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+
+	// The derived key is used once, so a zero nonce is safe
+	nonce := make([]byte, aead.NonceSize())
+	aad := fmt.Appendf(nil, "%d:%d", networkID, generation)
+	sealed := aead.Seal(ephemeral.PublicKey().Bytes(), nonce, key, aad)
+	return base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// edwardsToMontgomery converts an ed25519 public key to the X25519 public
+// key of the same secret: u = (1 + y) / (1 - y) mod p
+func edwardsToMontgomery(publicKey []byte) []byte {
+	// y is little-endian with the sign of x in the top bit
+	le := slices.Clone(publicKey)
+	le[31] &= 0x7f
+	slices.Reverse(le)
+	y := new(big.Int).SetBytes(le)
+
+	one := big.NewInt(1)
+	num := new(big.Int).Add(one, y)
+	den := new(big.Int).Sub(one, y)
+	den.Mod(den, curve25519P)
+	den.ModInverse(den, curve25519P)
+	u := num.Mul(num, den)
+	u.Mod(u, curve25519P)
+
+	out := make([]byte, 32)
+	u.FillBytes(out)
+	slices.Reverse(out)
+	return out
+}
@@ -4,8 +4,8 @@ import (
 	"encoding/base64"
 	"fmt"
 	"log"
-	"net/http"
 	"os"
+	"time"
 
 	"github.com/go-webauthn/webauthn/protocol"
 	"github.com/go-webauthn/webauthn/webauthn"
@@ -16,6 +16,7 @@ import (
 type WebAuthnService struct {
 	webauthn *webauthn.WebAuthn
 	store    *store.Store
+	ceremony CeremonyConfig
 }
 
 // NewWebAuthnService creates a new WebAuthn service
@@ -30,10 +31,16 @@ func NewWebAuthnService(store *store.Store) (*WebAuthnService, error) {
 		rpOrigin = "http://localhost:5173"
 	}
 
+	ceremony, err := loadCeremonyConfig()
+	if err != nil {
+		return nil, err
+	}
+
 	config := &webauthn.Config{
 		RPDisplayName: "Lanscape",
 		RPID:          rpID,
 		RPOrigins:     []string{rpOrigin},
+		Timeouts:      ceremony.timeouts(),
 	}
 
 	w, err := webauthn.New(config)
@@ -41,14 +48,21 @@ func NewWebAuthnService(store *store.Store) (*WebAuthnService, error) {
 		return nil, fmt.Errorf("failed to create webauthn instance: %w", err)
 	}
 
-	log.Printf("WebAuthn initialized with RP ID: %s, Origin: %s", rpID, rpOrigin)
+	log.Printf("WebAuthn initialized with RP ID: %s, Origin: %s, timeout: %s, user verification: %s",
+		rpID, rpOrigin, ceremony.Timeout, ceremony.UserVerification)
 
 	return &WebAuthnService{
 		webauthn: w,
 		store:    store,
+		ceremony: ceremony,
 	}, nil
 }
 
+// SessionTTL is how long a ceremony's session stays valid
+func (s *WebAuthnService) SessionTTL() time.Duration {
+	return s.ceremony.Timeout
+}
+
 // WebAuthnUser implements the webauthn.User interface
 type WebAuthnUser struct {
 	ID          []byte
@@ -81,25 +95,12 @@ func (u *WebAuthnUser) WebAuthnCredentials() []webauthn.Credential {
 	return u.Credentials
 }
 
-// BeginRegistration starts a WebAuthn registration session
-func (s *WebAuthnService) BeginRegistration(username string) (*webauthn.SessionData, *protocol.CredentialCreation, error) {
-	// Check if user exists, if not create them
-	user, err := s.store.GetUserByUsername(username)
-	if err != nil {
-		// User doesn't exist, create them
-		user, err = s.store.CreateUser(username)
-		if err != nil {
-			return nil, nil, fmt.Errorf("failed to create user: %w", err)
-		}
-		log.Printf("Created new user: %s (ID: %d)", username, user.ID)
-	} else {
-		log.Printf("Found existing user: %s (ID: %d)", username, user.ID)
-	}
-
-	// Get existing credentials
+// loadWebAuthnUser builds the webauthn.User for a stored user and their
+// registered credentials
+func (s *WebAuthnService) loadWebAuthnUser(user *store.User) (*WebAuthnUser, error) {
 	creds, err := s.store.GetCredentialsByUserID(user.ID)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to get credentials: %w", err)
+		return nil, fmt.Errorf("failed to get credentials: %w", err)
 	}
 
 	// Convert to webauthn.Credential format
@@ -115,13 +116,46 @@ func (s *WebAuthnService) BeginRegistration(username string) (*webauthn.SessionD
 		}
 	}
 
-	webauthnUser := &WebAuthnUser{
+	return &WebAuthnUser{
 		ID:          []byte(fmt.Sprintf("%d", user.ID)),
 		Username:    user.Username,
 		Credentials: webauthnCreds,
+	}, nil
+}
+
+// BeginRegistration starts a WebAuthn registration session
+func (s *WebAuthnService) BeginRegistration(username string, opts CeremonyOptions) (*webauthn.SessionData, *protocol.CredentialCreation, error) {
+	// Check if user exists, if not create them
+	user, err := s.store.GetUserByUsername(username)
+	if err != nil {
+		// User doesn't exist, create them
+		user, err = s.store.CreateUser(username)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create user: %w", err)
+		}
+		log.Printf("Created new user: %s (ID: %d)", username, user.ID)
+	} else {
+		log.Printf("Found existing user: %s (ID: %d)", username, user.ID)
+	}
+
+	webauthnUser, err := s.loadWebAuthnUser(user)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	attachment := s.ceremony.attachment(opts)
+	registrationOpts := []webauthn.RegistrationOption{
+		webauthn.WithAuthenticatorSelection(protocol.AuthenticatorSelection{
+			AuthenticatorAttachment: attachment,
+			UserVerification:        s.ceremony.userVerification(opts),
+		}),
+		webauthn.WithPublicKeyCredentialHints(hints(attachment)),
+	}
+	if s.ceremony.ExcludeCredentials {
+		registrationOpts = append(registrationOpts, webauthn.WithExclusions(webauthn.Credentials(webauthnUser.Credentials).CredentialDescriptors()))
 	}
 
-	options, sessionData, err := s.webauthn.BeginRegistration(webauthnUser)
+	options, sessionData, err := s.webauthn.BeginRegistration(webauthnUser, registrationOpts...)
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to begin registration: %w", err)
 	}
@@ -130,38 +164,25 @@ func (s *WebAuthnService) BeginRegistration(username string) (*webauthn.SessionD
 	return sessionData, options, nil
 }
 
-// FinishRegistration completes a WebAuthn registration
-func (s *WebAuthnService) FinishRegistration(username string, sessionData *webauthn.SessionData, r *http.Request) (*webauthn.Credential, error) {
+// FinishRegistrationFromJSON completes a WebAuthn registration with the
+// authenticator's credential creation response, as JSON
+func (s *WebAuthnService) FinishRegistrationFromJSON(username string, sessionData *webauthn.SessionData, response []byte) (*webauthn.Credential, error) {
 	user, err := s.store.GetUserByUsername(username)
 	if err != nil {
 		return nil, fmt.Errorf("user not found: %w", err)
 	}
 
-	// Get existing credentials
-	creds, err := s.store.GetCredentialsByUserID(user.ID)
+	webauthnUser, err := s.loadWebAuthnUser(user)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get credentials: %w", err)
+		return nil, err
 	}
 
-	webauthnCreds := make([]webauthn.Credential, len(creds))
-	for i, cred := range creds {
-		webauthnCreds[i] = webauthn.Credential{
-			ID:        cred.CredentialID,
-			PublicKey: cred.PublicKey,
-			Flags: webauthn.CredentialFlags{
-				BackupEligible: cred.BackupEligible,
-				BackupState:    cred.BackupState,
-			},
-		}
-	}
-
-	webauthnUser := &WebAuthnUser{
-		ID:          []byte(fmt.Sprintf("%d", user.ID)),
-		Username:    user.Username,
-		Credentials: webauthnCreds,
+	parsed, err := protocol.ParseCredentialCreationResponseBytes(response)
+	if err != nil {
+		return nil, fmt.Errorf("invalid credential creation response: %w", err)
 	}
 
-	credential, err := s.webauthn.FinishRegistration(webauthnUser, *sessionData, r)
+	credential, err := s.webauthn.CreateCredential(webauthnUser, *sessionData, parsed)
 	if err != nil {
 		return nil, fmt.Errorf("failed to finish registration: %w", err)
 	}
@@ -184,42 +205,25 @@ func (s *WebAuthnService) FinishRegistration(username string, sessionData *webau
 }
 
 // BeginLogin starts a WebAuthn login session
-func (s *WebAuthnService) BeginLogin(username string) (*webauthn.SessionData, *protocol.CredentialAssertion, error) {
+func (s *WebAuthnService) BeginLogin(username string, opts CeremonyOptions) (*webauthn.SessionData, *protocol.CredentialAssertion, error) {
 	user, err := s.store.GetUserByUsername(username)
 	if err != nil {
 		return nil, nil, fmt.Errorf("user not found: %w", err)
 	}
 
-	// Get existing credentials
-	creds, err := s.store.GetCredentialsByUserID(user.ID)
+	webauthnUser, err := s.loadWebAuthnUser(user)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to get credentials: %w", err)
+		return nil, nil, err
 	}
 
-	if len(creds) == 0 {
+	if len(webauthnUser.Credentials) == 0 {
 		return nil, nil, fmt.Errorf("user has no registered credentials")
 	}
 
-	// Convert to webauthn.Credential format
-	webauthnCreds := make([]webauthn.Credential, len(creds))
-	for i, cred := range creds {
-		webauthnCreds[i] = webauthn.Credential{
-			ID:        cred.CredentialID,
-			PublicKey: cred.PublicKey,
-			Flags: webauthn.CredentialFlags{
-				BackupEligible: cred.BackupEligible,
-				BackupState:    cred.BackupState,
-			},
-		}
-	}
-
-	webauthnUser := &WebAuthnUser{
-		ID:          []byte(fmt.Sprintf("%d", user.ID)),
-		Username:    user.Username,
-		Credentials: webauthnCreds,
-	}
-
-	options, sessionData, err := s.webauthn.BeginLogin(webauthnUser)
+	options, sessionData, err := s.webauthn.BeginLogin(webauthnUser,
+		webauthn.WithUserVerification(s.ceremony.userVerification(opts)),
+		webauthn.WithAssertionPublicKeyCredentialHints(hints(opts.Attachment)),
+	)
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to begin login: %w", err)
 	}
@@ -228,40 +232,25 @@ func (s *WebAuthnService) BeginLogin(username string) (*webauthn.SessionData, *p
 	return sessionData, options, nil
 }
 
-// FinishLogin completes a WebAuthn login
-func (s *WebAuthnService) FinishLogin(username string, sessionData *webauthn.SessionData, r *http.Request) (*webauthn.Credential, error) {
+// FinishLoginFromJSON completes a WebAuthn login with the authenticator's
+// assertion response, as JSON
+func (s *WebAuthnService) FinishLoginFromJSON(username string, sessionData *webauthn.SessionData, response []byte) (*webauthn.Credential, error) {
 	user, err := s.store.GetUserByUsername(username)
 	if err != nil {
 		return nil, fmt.Errorf("user not found: %w", err)
 	}
 
-	// Get existing credentials
-	creds, err := s.store.GetCredentialsByUserID(user.ID)
+	webauthnUser, err := s.loadWebAuthnUser(user)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get credentials: %w", err)
-	}
-
-	webauthnCreds := make([]webauthn.Credential, len(creds))
-	for i, cred := range creds {
-		log.Printf("Loading credential for login: credential ID: %s, stored backupEligible: %v, stored backupState: %v",
-			base64.RawURLEncoding.EncodeToString(cred.CredentialID), cred.BackupEligible, cred.BackupState)
-		webauthnCreds[i] = webauthn.Credential{
-			ID:        cred.CredentialID,
-			PublicKey: cred.PublicKey,
-			Flags: webauthn.CredentialFlags{
-				BackupEligible: cred.BackupEligible,
-				BackupState:    cred.BackupState,
-			},
-		}
+		return nil, err
 	}
 
-	webauthnUser := &WebAuthnUser{
-		ID:          []byte(fmt.Sprintf("%d", user.ID)),
-		Username:    user.Username,
-		Credentials: webauthnCreds,
+	parsed, err := protocol.ParseCredentialRequestResponseBytes(response)
+	if err != nil {
+		return nil, fmt.Errorf("invalid assertion response: %w", err)
 	}
 
-	credential, err := s.webauthn.FinishLogin(webauthnUser, *sessionData, r)
+	credential, err := s.webauthn.ValidateLogin(webauthnUser, *sessionData, parsed)
 	if err != nil {
 		return nil, fmt.Errorf("failed to finish login: %w", err)
 	}
@@ -0,0 +1,233 @@
+// Package authz decides what users may do to networks and to lanscaped
+// itself. Routes ask an Authorizer before acting instead of checking
+// membership themselves, so a change to the policy applies to every route at
+// once.
+package authz
+
+import (
+	"fmt"
+
+	"github.com/jhead/lanscape/lanscaped/internal/store"
+)
+
+// Action is something a user can do to a resource
+type Action string
+
+const (
+	// ViewNetwork reads a network and its avatar, and finds it to join
+	ViewNetwork Action = "network.view"
+	// ViewMembers lists a network's members and their presence
+	ViewMembers Action = "network.view_members"
+	// ViewUsage reads a network's aggregated usage
+	ViewUsage Action = "network.view_usage"
+	// ReportUsage posts usage reports for a network
+	ReportUsage Action = "network.report_usage"
+	// JoinNetwork adds the user to a network
+	JoinNetwork Action = "network.join"
+	// LeaveNetwork removes the user from a network
+	LeaveNetwork Action = "network.leave"
+	// DeleteNetwork deletes a network for everyone
+	DeleteNetwork Action = "network.delete"
+	// Connect mints network tokens and agent attestations for a network
+	Connect Action = "network.connect"
+	// AdoptDevice adds a device to a network's tailnet
+	AdoptDevice Action = "network.adopt_device"
+	// ManagePolicy changes a network's access policy
+	ManagePolicy Action = "network.manage_policy"
+	// ViewSettings reads a network's settings
+	ViewSettings Action = "network.view_settings"
+	// ManageSettings changes a network's settings
+	ManageSettings Action = "network.manage_settings"
+	// ApproveJoin lists, approves, and rejects requests to join a network
+	ApproveJoin Action = "network.approve_join"
+	// ImportTailnet imports the users and nodes of a network's Headscale
+	ImportTailnet Action = "network.import_tailnet"
+	// ManageMembers invites other users to a network and removes them from
+	// it
+	ManageMembers Action = "network.manage_members"
+	// ViewLive reads the live state of every network and the signaling
+	// server
+	ViewLive Action = "admin.view_live"
+	// MaintainDatabase runs database maintenance and reads its reports
+	MaintainDatabase Action = "admin.maintain_database"
+)
+
+// Resource is what an action applies to; the zero Resource is lanscaped
+// itself
+type Resource struct {
+	NetworkID int64
+}
+
+// System is the resource of actions on lanscaped as a whole
+var System = Resource{}
+
+// Network returns the resource for a network
+func Network(id int64) Resource {
+	return Resource{NetworkID: id}
+}
+
+// Relation is how a user relates to a resource
+type Relation int
+
+const (
+	// Anyone is any signed-in user
+	Anyone Relation = iota
+	// Member is a member of the resource's network
+	Member
+	// Admin is a lanscaped administrator
+	Admin
+	// Viewer is anyone for a network that is not private, and a member or
+	// invited user of a private one. Others are not told the network exists.
+	Viewer
+)
+
+// String names a relation in denials
+func (r Relation) String() string {
+	switch r {
+	case Anyone:
+		return "signed in"
+	case Member:
+		return "a member of this network"
+	case Admin:
+		return "an administrator"
+	case Viewer:
+		return "a member of this network or invited to it"
+	default:
+		return fmt.Sprintf("relation %d", int(r))
+	}
+}
+
+// Policy maps each action to the relation a user needs to take it. Actions
+// missing from a policy are denied.
+type Policy map[Action]Relation
+
+// DefaultPolicy lets anyone see a network that is not private and join a
+// network they can see, its members do most else to it, and administrators
+// manage its members in bulk, import its tailnet, view the live state of
+// lanscaped, and maintain its database
+var DefaultPolicy = Policy{
+	ViewNetwork:      Viewer,
+	ViewMembers:      Member,
+	ViewUsage:        Member,
+	ReportUsage:      Member,
+	JoinNetwork:      Anyone,
+	LeaveNetwork:     Member,
+	DeleteNetwork:    Member,
+	Connect:          Member,
+	AdoptDevice:      Member,
+	ManagePolicy:     Member,
+	ViewSettings:     Member,
+	ManageSettings:   Member,
+	ApproveJoin:      Member,
+	ImportTailnet:    Admin,
+	ManageMembers:    Admin,
+	ViewLive:         Admin,
+	MaintainDatabase: Admin,
+}
+
+// Memberships answers whether a user is a member of a network or invited to
+// it
+type Memberships interface {
+	IsUserInNetwork(userID, networkID int64) (bool, error)
+	IsUserInvited(userID, networkID int64) (bool, error)
+}
+
+// Networks looks networks up, to check their visibility
+type Networks interface {
+	GetNetworkByID(id int64) (*store.Network, error)
+}
+
+// Users looks users up, to match them against the administrators
+type Users interface {
+	GetUserByID(id int64) (*store.User, error)
+}
+
+// Decision is the outcome of an authorization check
+type Decision struct {
+	Allowed bool
+	// Required is the relation the action needs, to explain a denial
+	Required Relation
+	// Hidden denials must not reveal that the resource exists
+	Hidden bool
+}
+
+// Reason explains a denial
+func (d Decision) Reason() string {
+	return "You must be " + d.Required.String()
+}
+
+// Authorizer decides actions against a policy
+type Authorizer struct {
+	memberships Memberships
+	networks    Networks
+	policy      Policy
+
+	users  Users
+	admins map[string]bool // usernames
+}
+
+// New creates an authorizer for policy; a nil policy uses DefaultPolicy
+func New(memberships Memberships, networks Networks, policy Policy) *Authorizer {
+	if policy == nil {
+		policy = DefaultPolicy
+	}
+	return &Authorizer{memberships: memberships, networks: networks, policy: policy}
+}
+
+// SetAdmins makes the users with the given usernames administrators. It
+// must be called before the authorizer is used.
+func (a *Authorizer) SetAdmins(users Users, usernames []string) {
+	a.users = users
+	a.admins = make(map[string]bool, len(usernames))
+	for _, name := range usernames {
+		a.admins[name] = true
+	}
+}
+
+// Can decides whether a user may take an action on a resource
+func (a *Authorizer) Can(userID int64, action Action, resource Resource) (Decision, error) {
+	required, ok := a.policy[action]
+	if !ok {
+		return Decision{Required: Member}, fmt.Errorf("no policy for action %s", action)
+	}
+
+	switch required {
+	case Anyone:
+		return Decision{Allowed: true, Required: required}, nil
+	case Member:
+		isMember, err := a.memberships.IsUserInNetwork(userID, resource.NetworkID)
+		if err != nil {
+			return Decision{Required: required}, fmt.Errorf("failed to check membership: %w", err)
+		}
+		return Decision{Allowed: isMember, Required: required}, nil
+	case Admin:
+		if len(a.admins) == 0 {
+			return Decision{Required: required}, nil
+		}
+		user, err := a.users.GetUserByID(userID)
+		if err != nil {
+			return Decision{Required: required}, fmt.Errorf("failed to look up user: %w", err)
+		}
+		return Decision{Allowed: a.admins[user.Username], Required: required}, nil
+	case Viewer:
+		network, err := a.networks.GetNetworkByID(resource.NetworkID)
+		if err != nil {
+			return Decision{Required: required, Hidden: true}, fmt.Errorf("failed to look up network: %w", err)
+		}
+		if network.Visibility != store.VisibilityPrivate {
+			return Decision{Allowed: true, Required: required}, nil
+		}
+		allowed, err := a.memberships.IsUserInNetwork(userID, resource.NetworkID)
+		if err != nil {
+			return Decision{Required: required, Hidden: true}, fmt.Errorf("failed to check membership: %w", err)
+		}
+		if !allowed {
+			if allowed, err = a.memberships.IsUserInvited(userID, resource.NetworkID); err != nil {
+				return Decision{Required: required, Hidden: true}, fmt.Errorf("failed to check invitation: %w", err)
+			}
+		}
+		return Decision{Allowed: allowed, Required: required, Hidden: !allowed}, nil
+	default:
+		return Decision{Required: required}, fmt.Errorf("unknown relation %s for action %s", required, action)
+	}
+}
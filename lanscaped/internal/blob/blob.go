@@ -0,0 +1,93 @@
+// Package blob stores uploaded files, such as network avatars, on disk or in
+// an S3-compatible bucket.
+package blob
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/jhead/lanscape/lanscaped/internal/sigv4"
+)
+
+// ErrNotFound is returned for keys with nothing stored
+var ErrNotFound = errors.New("blob not found")
+
+// Store holds blobs by key. Keys are slash-separated paths of letters,
+// digits, '-', '_', and '.', without empty, "." or ".." segments.
+type Store interface {
+	Put(ctx context.Context, key string, data []byte, contentType string) error
+	// Get returns a blob and its content type
+	Get(ctx context.Context, key string) ([]byte, string, error)
+	// Delete removes a blob; deleting a missing blob is not an error
+	Delete(ctx context.Context, key string) error
+}
+
+// FromEnv creates the store configured by AVATAR_STORE: a directory path,
+// or s3://bucket/prefix for an S3 bucket configured by S3_ENDPOINT,
+// AWS_REGION, AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, and
+// AWS_SESSION_TOKEN. It defaults to the avatars directory.
+func FromEnv() (Store, string, error) {
+	v := os.Getenv("AVATAR_STORE")
+	if v == "" {
+		v = "avatars"
+	}
+	if !strings.HasPrefix(v, "s3://") {
+		dir, err := NewDir(strings.TrimPrefix(v, "file://"))
+		if err != nil {
+			return nil, "", err
+		}
+		return dir, dir.root, nil
+	}
+
+	u, err := url.Parse(v)
+	if err != nil || u.Host == "" {
+		return nil, "", fmt.Errorf("invalid AVATAR_STORE %q: must be a directory or s3://bucket/prefix", v)
+	}
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		region = "us-east-1"
+	}
+	endpoint := os.Getenv("S3_ENDPOINT")
+	if endpoint == "" {
+		endpoint = "https://s3." + region + ".amazonaws.com"
+	}
+	creds, err := sigv4.CredentialsFromEnv()
+	if err != nil {
+		return nil, "", err
+	}
+	s3, err := NewS3(S3Config{
+		Endpoint:     endpoint,
+		Bucket:       u.Host,
+		Prefix:       strings.Trim(u.Path, "/"),
+		Region:       region,
+		AccessKey:    creds.AccessKey,
+		SecretKey:    creds.SecretKey,
+		SessionToken: creds.SessionToken,
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return s3, v, nil
+}
+
+// validKey checks that key is a relative path that stays inside the store
+func validKey(key string) error {
+	if key == "" {
+		return fmt.Errorf("invalid blob key %q", key)
+	}
+	for _, segment := range strings.Split(key, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return fmt.Errorf("invalid blob key %q", key)
+		}
+		for _, c := range segment {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+				return fmt.Errorf("invalid blob key %q", key)
+			}
+		}
+	}
+	return nil
+}
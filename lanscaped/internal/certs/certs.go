@@ -0,0 +1,322 @@
+// Package certs obtains and renews lanscaped's TLS certificate from an ACME
+// certificate authority such as Let's Encrypt, answering DNS-01 challenges
+// through a DNS provider. Unlike HTTP-01, DNS-01 works for instances only
+// reachable inside the tailnet, as long as their hostnames are in a public
+// zone the provider manages.
+package certs
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+// LetsEncrypt is the directory of Let's Encrypt's production CA
+const LetsEncrypt = "https://acme-v02.api.letsencrypt.org/directory"
+
+const (
+	// renewBefore is how long before expiry a certificate is renewed, or a
+	// third of its lifetime if that is shorter
+	renewBefore = 30 * 24 * time.Hour
+	// checkInterval is how often the certificate's expiry is checked
+	checkInterval = 12 * time.Hour
+	// retryInterval is how long to wait after a failed issuance
+	retryInterval = time.Hour
+	// issueTimeout bounds one issuance, DNS propagation included
+	issueTimeout = 15 * time.Minute
+)
+
+// Config configures a Manager
+type Config struct {
+	// Domains are the names on the certificate, e.g. lanscaped.example.com
+	// or *.example.com; the first names the cached files
+	Domains []string
+	// Email is the ACME account's contact address; optional
+	Email string
+	// DirectoryURL is the CA's ACME directory, defaults to LetsEncrypt
+	DirectoryURL string
+	// CacheDir holds the account key and the certificate between restarts
+	CacheDir string
+	// Provider publishes the DNS-01 challenge records
+	Provider DNSProvider
+	// PropagationTimeout is how long to wait for a challenge record to be
+	// visible in DNS before asking the CA to check it anyway
+	PropagationTimeout time.Duration
+}
+
+// Manager keeps a certificate for its domains, issuing it on first run and
+// renewing it before it expires
+type Manager struct {
+	config Config
+	cert   atomic.Pointer[tls.Certificate]
+}
+
+// NewManager creates a manager and loads the cached certificate, if any
+func NewManager(config Config) (*Manager, error) {
+	if len(config.Domains) == 0 {
+		return nil, errors.New("at least one domain is required")
+	}
+	if config.Provider == nil {
+		return nil, errors.New("a DNS provider is required")
+	}
+	if config.DirectoryURL == "" {
+		config.DirectoryURL = LetsEncrypt
+	}
+	if err := os.MkdirAll(config.CacheDir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create certificate cache: %w", err)
+	}
+
+	m := &Manager{config: config}
+	cert, err := tls.LoadX509KeyPair(m.certPath(), m.certPath())
+	if err == nil {
+		m.cert.Store(&cert)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		log.Printf("Ignoring cached certificate %s: %v", m.certPath(), err)
+	}
+	return m, nil
+}
+
+// GetCertificate returns the current certificate, for tls.Config
+func (m *Manager) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert := m.cert.Load()
+	if cert == nil {
+		return nil, errors.New("certificate not issued yet")
+	}
+	return cert, nil
+}
+
+// Run issues the certificate if there is none and renews it before it
+// expires, until ctx is done
+func (m *Manager) Run(ctx context.Context) {
+	for {
+		wait := checkInterval
+		if m.needsRenewal(time.Now()) {
+			if err := m.issue(ctx); err != nil {
+				log.Printf("Error issuing certificate for %s: %v", strings.Join(m.config.Domains, ", "), err)
+				wait = retryInterval
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// needsRenewal reports whether there is no certificate, it does not cover
+// the configured domains, or it expires soon
+func (m *Manager) needsRenewal(now time.Time) bool {
+	cert := m.cert.Load()
+	if cert == nil || cert.Leaf == nil {
+		return true
+	}
+	for _, domain := range m.config.Domains {
+		if cert.Leaf.VerifyHostname(strings.Replace(domain, "*", "wildcard", 1)) != nil {
+			return true
+		}
+	}
+	before := min(renewBefore, cert.Leaf.NotAfter.Sub(cert.Leaf.NotBefore)/3)
+	return now.Add(before).After(cert.Leaf.NotAfter)
+}
+
+// issue orders a certificate for the domains, answers their DNS-01
+// challenges, and caches the result
+func (m *Manager) issue(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, issueTimeout)
+	defer cancel()
+	log.Printf("Requesting certificate for %s from %s", strings.Join(m.config.Domains, ", "), m.config.DirectoryURL)
+
+	accountKey, err := m.accountKey()
+	if err != nil {
+		return err
+	}
+	client := &acme.Client{Key: accountKey, DirectoryURL: m.config.DirectoryURL}
+	account := &acme.Account{}
+	if m.config.Email != "" {
+		account.Contact = []string{"mailto:" + m.config.Email}
+	}
+	if _, err := client.Register(ctx, account, acme.AcceptTOS); err != nil && !errors.Is(err, acme.ErrAccountAlreadyExists) {
+		return fmt.Errorf("failed to register ACME account: %w", err)
+	}
+
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs(m.config.Domains...))
+	if err != nil {
+		return fmt.Errorf("failed to create order: %w", err)
+	}
+	orderURL := order.URI
+	for _, authzURL := range order.AuthzURLs {
+		if err := m.authorize(ctx, client, authzURL); err != nil {
+			return err
+		}
+	}
+	if order, err = client.WaitOrder(ctx, orderURL); err != nil {
+		return fmt.Errorf("order not ready: %w", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("failed to generate certificate key: %w", err)
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: m.config.Domains[0]},
+		DNSNames: m.config.Domains,
+	}, key)
+	if err != nil {
+		return fmt.Errorf("failed to create certificate request: %w", err)
+	}
+	chain, err := finalize(ctx, client, orderURL, order.FinalizeURL, csr)
+	if err != nil {
+		return err
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("failed to encode certificate key: %w", err)
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	for _, der := range chain {
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	cert, err := tls.X509KeyPair(data, data)
+	if err != nil {
+		return fmt.Errorf("CA returned an unusable certificate: %w", err)
+	}
+	if err := writeFile(m.certPath(), data); err != nil {
+		return fmt.Errorf("failed to cache certificate: %w", err)
+	}
+	m.cert.Store(&cert)
+
+	log.Printf("Issued certificate for %s, valid until %s", strings.Join(m.config.Domains, ", "), cert.Leaf.NotAfter.Format(time.RFC3339))
+	return nil
+}
+
+// finalize submits the certificate request of an order and returns the
+// issued chain
+func finalize(ctx context.Context, client *acme.Client, orderURL, finalizeURL string, csr []byte) ([][]byte, error) {
+	chain, _, err := client.CreateOrderCert(ctx, finalizeURL, csr, true)
+	if err == nil {
+		return chain, nil
+	}
+	// CreateOrderCert polls the order at the finalize response's Location,
+	// which some CAs leave out; poll it at its own URL instead
+	order, waitErr := client.WaitOrder(ctx, orderURL)
+	if waitErr != nil || order.Status != acme.StatusValid || order.CertURL == "" {
+		return nil, fmt.Errorf("failed to finalize order: %w", err)
+	}
+	chain, err = client.FetchCert(ctx, order.CertURL, true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch certificate: %w", err)
+	}
+	return chain, nil
+}
+
+// authorize proves control of one order identifier with a DNS-01 challenge
+func (m *Manager) authorize(ctx context.Context, client *acme.Client, authzURL string) error {
+	authz, err := client.GetAuthorization(ctx, authzURL)
+	if err != nil {
+		return fmt.Errorf("failed to fetch authorization: %w", err)
+	}
+	if authz.Status == acme.StatusValid {
+		return nil
+	}
+
+	var challenge *acme.Challenge
+	for _, c := range authz.Challenges {
+		if c.Type == "dns-01" {
+			challenge = c
+			break
+		}
+	}
+	if challenge == nil {
+		return fmt.Errorf("CA offered no dns-01 challenge for %s", authz.Identifier.Value)
+	}
+	value, err := client.DNS01ChallengeRecord(challenge.Token)
+	if err != nil {
+		return fmt.Errorf("failed to compute challenge record: %w", err)
+	}
+
+	// A wildcard is validated at its base domain
+	fqdn := "_acme-challenge." + strings.TrimPrefix(authz.Identifier.Value, "*.") + "."
+	if err := m.config.Provider.Present(ctx, fqdn, value); err != nil {
+		return fmt.Errorf("failed to publish challenge record %s: %w", fqdn, err)
+	}
+	defer func() {
+		// The context may have run out; cleanup gets its own
+		cleanupCtx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		if err := m.config.Provider.CleanUp(cleanupCtx, fqdn, value); err != nil {
+			log.Printf("Error removing challenge record %s: %v", fqdn, err)
+		}
+	}()
+
+	waitForRecord(ctx, fqdn, value, m.config.PropagationTimeout)
+	if _, err := client.Accept(ctx, challenge); err != nil {
+		return fmt.Errorf("failed to accept challenge for %s: %w", authz.Identifier.Value, err)
+	}
+	if _, err := client.WaitAuthorization(ctx, authz.URI); err != nil {
+		return fmt.Errorf("challenge for %s failed: %w", authz.Identifier.Value, err)
+	}
+	return nil
+}
+
+// accountKey loads the ACME account key, generating it on first use
+func (m *Manager) accountKey() (crypto.Signer, error) {
+	path := filepath.Join(m.config.CacheDir, "acme_account.key")
+	data, err := os.ReadFile(path)
+	if err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("invalid ACME account key %s", path)
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read ACME account key: %w", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate ACME account key: %w", err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode ACME account key: %w", err)
+	}
+	if err := writeFile(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})); err != nil {
+		return nil, fmt.Errorf("failed to save ACME account key: %w", err)
+	}
+	return key, nil
+}
+
+// certPath is the cached key and certificate chain, in one PEM file
+func (m *Manager) certPath() string {
+	name := strings.ReplaceAll(m.config.Domains[0], "*", "_")
+	return filepath.Join(m.config.CacheDir, name+".pem")
+}
+
+// writeFile replaces a private file atomically
+func writeFile(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
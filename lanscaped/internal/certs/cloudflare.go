@@ -0,0 +1,143 @@
+package certs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// cloudflareAPI is the Cloudflare API base URL
+const cloudflareAPI = "https://api.cloudflare.com/client/v4"
+
+// Cloudflare publishes challenge records in zones hosted by Cloudflare. The
+// API token needs Zone:Read and DNS:Edit on the zone.
+type Cloudflare struct {
+	token      string
+	baseURL    string
+	httpClient *http.Client
+}
+
+// NewCloudflare creates a provider authenticating with an API token
+func NewCloudflare(token string) (*Cloudflare, error) {
+	if token == "" {
+		return nil, errors.New("CLOUDFLARE_API_TOKEN is required for the cloudflare DNS provider")
+	}
+	return &Cloudflare{
+		token:      token,
+		baseURL:    cloudflareAPI,
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+// cloudflareRecord is a DNS record in the Cloudflare API
+type cloudflareRecord struct {
+	ID      string `json:"id,omitempty"`
+	Type    string `json:"type"`
+	Name    string `json:"name"`
+	Content string `json:"content"`
+	TTL     int    `json:"ttl"`
+}
+
+// Present creates a TXT record
+func (c *Cloudflare) Present(ctx context.Context, fqdn, value string) error {
+	zoneID, err := c.zoneID(ctx, fqdn)
+	if err != nil {
+		return err
+	}
+	record := cloudflareRecord{Type: "TXT", Name: strings.TrimSuffix(fqdn, "."), Content: value, TTL: 120}
+	return c.do(ctx, http.MethodPost, "/zones/"+zoneID+"/dns_records", record, nil)
+}
+
+// CleanUp deletes the TXT records with value
+func (c *Cloudflare) CleanUp(ctx context.Context, fqdn, value string) error {
+	zoneID, err := c.zoneID(ctx, fqdn)
+	if err != nil {
+		return err
+	}
+	query := url.Values{"type": {"TXT"}, "name": {strings.TrimSuffix(fqdn, ".")}, "content": {value}}
+	var records []cloudflareRecord
+	if err := c.do(ctx, http.MethodGet, "/zones/"+zoneID+"/dns_records?"+query.Encode(), nil, &records); err != nil {
+		return err
+	}
+	for _, record := range records {
+		if err := c.do(ctx, http.MethodDelete, "/zones/"+zoneID+"/dns_records/"+record.ID, nil, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// zoneID finds the zone fqdn is in, trying each parent domain
+func (c *Cloudflare) zoneID(ctx context.Context, fqdn string) (string, error) {
+	for _, zone := range parentZones(fqdn) {
+		query := url.Values{"name": {strings.TrimSuffix(zone, ".")}}
+		var zones []struct {
+			ID string `json:"id"`
+		}
+		if err := c.do(ctx, http.MethodGet, "/zones?"+query.Encode(), nil, &zones); err != nil {
+			return "", err
+		}
+		if len(zones) > 0 {
+			return zones[0].ID, nil
+		}
+	}
+	return "", fmt.Errorf("no Cloudflare zone found for %s", fqdn)
+}
+
+// do sends a request and decodes the result of the response envelope into
+// result, if given
+func (c *Cloudflare) do(ctx context.Context, method, path string, body, result any) error {
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("failed to encode request: %w", err)
+		}
+		reqBody = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, reqBody)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var envelope struct {
+		Success bool            `json:"success"`
+		Result  json.RawMessage `json:"result"`
+		Errors  []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&envelope); err != nil {
+		return fmt.Errorf("Cloudflare API error: status %d", resp.StatusCode)
+	}
+	if !envelope.Success {
+		var messages []string
+		for _, e := range envelope.Errors {
+			messages = append(messages, e.Message)
+		}
+		return fmt.Errorf("Cloudflare API error: status %d: %s", resp.StatusCode, strings.Join(messages, "; "))
+	}
+	if result != nil {
+		if err := json.Unmarshal(envelope.Result, result); err != nil {
+			return fmt.Errorf("failed to decode response: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package certs
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jhead/lanscape/lanscaped/internal/secrets"
+	"github.com/jhead/lanscape/lanscaped/internal/sigv4"
+)
+
+// DNSProvider publishes the TXT records of DNS-01 challenges. Names are
+// fully qualified, with the trailing dot.
+type DNSProvider interface {
+	// Present creates a TXT record for fqdn with value, alongside any
+	// others already there
+	Present(ctx context.Context, fqdn, value string) error
+	// CleanUp removes the TXT record Present created
+	CleanUp(ctx context.Context, fqdn, value string) error
+}
+
+// defaultPropagationTimeout is how long to wait for a challenge record to
+// be visible before the CA is asked to check it anyway
+const defaultPropagationTimeout = 2 * time.Minute
+
+// FromEnv creates the manager configured by ACME_DOMAINS, ACME_EMAIL,
+// ACME_DIRECTORY, ACME_CACHE, ACME_DNS_PROVIDER, and
+// ACME_DNS_PROPAGATION_TIMEOUT, or returns nil if ACME_DOMAINS is unset
+func FromEnv() (*Manager, error) {
+	var domains []string
+	for _, domain := range strings.Split(os.Getenv("ACME_DOMAINS"), ",") {
+		if domain = strings.TrimSpace(domain); domain != "" {
+			domains = append(domains, strings.ToLower(strings.TrimSuffix(domain, ".")))
+		}
+	}
+	if len(domains) == 0 {
+		return nil, nil
+	}
+
+	provider, err := providerFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	cacheDir := os.Getenv("ACME_CACHE")
+	if cacheDir == "" {
+		cacheDir = "certs"
+	}
+	propagation := defaultPropagationTimeout
+	if v := os.Getenv("ACME_DNS_PROPAGATION_TIMEOUT"); v != "" {
+		if propagation, err = time.ParseDuration(v); err != nil || propagation < 0 {
+			return nil, fmt.Errorf("invalid ACME_DNS_PROPAGATION_TIMEOUT %q", v)
+		}
+	}
+
+	return NewManager(Config{
+		Domains:            domains,
+		Email:              os.Getenv("ACME_EMAIL"),
+		DirectoryURL:       os.Getenv("ACME_DIRECTORY"),
+		CacheDir:           cacheDir,
+		Provider:           provider,
+		PropagationTimeout: propagation,
+	})
+}
+
+// providerFromEnv creates the DNS provider named by ACME_DNS_PROVIDER
+func providerFromEnv() (DNSProvider, error) {
+	switch name := os.Getenv("ACME_DNS_PROVIDER"); name {
+	case "cloudflare":
+		token, err := secrets.Get("CLOUDFLARE_API_TOKEN")
+		if err != nil {
+			return nil, err
+		}
+		return NewCloudflare(token)
+	case "route53":
+		creds, err := sigv4.CredentialsFromEnv()
+		if err != nil {
+			return nil, err
+		}
+		return NewRoute53(Route53Config{
+			HostedZoneID: os.Getenv("ROUTE53_HOSTED_ZONE_ID"),
+			AccessKey:    creds.AccessKey,
+			SecretKey:    creds.SecretKey,
+			SessionToken: creds.SessionToken,
+		})
+	case "rfc2136":
+		tsigSecret, err := secrets.Get("RFC2136_TSIG_SECRET")
+		if err != nil {
+			return nil, err
+		}
+		return NewRFC2136(RFC2136Config{
+			Nameserver:    os.Getenv("RFC2136_NAMESERVER"),
+			Zone:          os.Getenv("RFC2136_ZONE"),
+			TSIGKey:       os.Getenv("RFC2136_TSIG_KEY"),
+			TSIGSecret:    tsigSecret,
+			TSIGAlgorithm: os.Getenv("RFC2136_TSIG_ALGORITHM"),
+		})
+	case "":
+		return nil, fmt.Errorf("ACME_DNS_PROVIDER is required with ACME_DOMAINS")
+	default:
+		return nil, fmt.Errorf("invalid ACME_DNS_PROVIDER %q: must be cloudflare, route53, or rfc2136", name)
+	}
+}
+
+// waitForRecord polls DNS until fqdn has a TXT record with value or timeout
+// passes. Resolvers inside a tailnet may never see the public record, so
+// running out of time is only logged.
+func waitForRecord(ctx context.Context, fqdn, value string, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	for {
+		records, _ := net.DefaultResolver.LookupTXT(ctx, fqdn)
+		for _, record := range records {
+			if record == value {
+				return
+			}
+		}
+		select {
+		case <-ctx.Done():
+			log.Printf("Challenge record %s not visible after %s; asking the CA to check it anyway", fqdn, timeout)
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// parentZones returns the candidate zones of fqdn, longest first, e.g.
+// a.example.com., example.com., com. for a.example.com.
+func parentZones(fqdn string) []string {
+	var zones []string
+	for name := fqdn; strings.Contains(strings.TrimSuffix(name, "."), "."); {
+		zones = append(zones, name)
+		name = name[strings.Index(name, ".")+1:]
+	}
+	return zones
+}
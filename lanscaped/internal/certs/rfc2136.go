@@ -0,0 +1,134 @@
+package certs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// RFC2136Config configures an RFC 2136 provider
+type RFC2136Config struct {
+	// Nameserver is the primary server of the zone, host or host:port
+	Nameserver string
+	// Zone is the zone the domains are in; found from the nameserver's SOA
+	// records when empty
+	Zone string
+	// TSIGKey and TSIGSecret (base64) sign updates; both or neither
+	TSIGKey    string
+	TSIGSecret string
+	// TSIGAlgorithm defaults to hmac-sha256
+	TSIGAlgorithm string
+}
+
+// RFC2136 publishes challenge records with RFC 2136 dynamic updates, as
+// BIND, Knot, PowerDNS, and most self-hosted nameservers accept
+type RFC2136 struct {
+	config RFC2136Config
+	client *dns.Client
+}
+
+// NewRFC2136 creates a provider updating a nameserver
+func NewRFC2136(config RFC2136Config) (*RFC2136, error) {
+	if config.Nameserver == "" {
+		return nil, errors.New("RFC2136_NAMESERVER is required for the rfc2136 DNS provider")
+	}
+	if _, _, err := net.SplitHostPort(config.Nameserver); err != nil {
+		config.Nameserver = net.JoinHostPort(config.Nameserver, "53")
+	}
+	if (config.TSIGKey == "") != (config.TSIGSecret == "") {
+		return nil, errors.New("RFC2136_TSIG_KEY and RFC2136_TSIG_SECRET must be set together")
+	}
+	if config.Zone != "" {
+		config.Zone = dns.Fqdn(config.Zone)
+	}
+	client := &dns.Client{Net: "tcp", Timeout: 10 * time.Second}
+	if config.TSIGKey != "" {
+		config.TSIGKey = dns.Fqdn(config.TSIGKey)
+		switch alg := strings.ToLower(strings.TrimSuffix(config.TSIGAlgorithm, ".")); alg {
+		case "", "hmac-sha256":
+			config.TSIGAlgorithm = dns.HmacSHA256
+		case "hmac-sha512":
+			config.TSIGAlgorithm = dns.HmacSHA512
+		case "hmac-sha1":
+			config.TSIGAlgorithm = dns.HmacSHA1
+		default:
+			return nil, fmt.Errorf("invalid RFC2136_TSIG_ALGORITHM %q: must be hmac-sha256, hmac-sha512, or hmac-sha1", config.TSIGAlgorithm)
+		}
+		client.TsigSecret = map[string]string{config.TSIGKey: config.TSIGSecret}
+	}
+	return &RFC2136{config: config, client: client}, nil
+}
+
+// Present adds a TXT record
+func (r *RFC2136) Present(ctx context.Context, fqdn, value string) error {
+	return r.update(ctx, fqdn, value, false)
+}
+
+// CleanUp removes the TXT record
+func (r *RFC2136) CleanUp(ctx context.Context, fqdn, value string) error {
+	return r.update(ctx, fqdn, value, true)
+}
+
+// update adds or removes the TXT record fqdn with value
+func (r *RFC2136) update(ctx context.Context, fqdn, value string, remove bool) error {
+	zone, err := r.zone(ctx, fqdn)
+	if err != nil {
+		return err
+	}
+	record := &dns.TXT{
+		Hdr: dns.RR_Header{Name: fqdn, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+		Txt: []string{value},
+	}
+
+	msg := new(dns.Msg)
+	msg.SetUpdate(zone)
+	if remove {
+		msg.Remove([]dns.RR{record})
+	} else {
+		msg.Insert([]dns.RR{record})
+	}
+	resp, err := r.exchange(ctx, msg)
+	if err != nil {
+		return fmt.Errorf("failed to update %s: %w", r.config.Nameserver, err)
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("%s refused the update: %s", r.config.Nameserver, dns.RcodeToString[resp.Rcode])
+	}
+	return nil
+}
+
+// zone returns the configured zone, or the closest parent of fqdn the
+// nameserver has an SOA record for
+func (r *RFC2136) zone(ctx context.Context, fqdn string) (string, error) {
+	if r.config.Zone != "" {
+		return r.config.Zone, nil
+	}
+	for _, name := range parentZones(fqdn) {
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, dns.TypeSOA)
+		resp, err := r.exchange(ctx, msg)
+		if err != nil {
+			return "", fmt.Errorf("failed to find the zone of %s: %w", fqdn, err)
+		}
+		for _, answer := range resp.Answer {
+			if soa, ok := answer.(*dns.SOA); ok && strings.EqualFold(soa.Hdr.Name, name) {
+				return soa.Hdr.Name, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("%s has no zone for %s; set RFC2136_ZONE", r.config.Nameserver, fqdn)
+}
+
+// exchange sends msg to the nameserver, signed if a TSIG key is configured
+func (r *RFC2136) exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	if r.config.TSIGKey != "" {
+		msg.SetTsig(r.config.TSIGKey, r.config.TSIGAlgorithm, 300, time.Now().Unix())
+	}
+	resp, _, err := r.client.ExchangeContext(ctx, msg, r.config.Nameserver)
+	return resp, err
+}
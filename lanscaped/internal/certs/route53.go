@@ -0,0 +1,184 @@
+package certs
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jhead/lanscape/lanscaped/internal/sigv4"
+)
+
+// route53API is the Route 53 API endpoint, which is global and signed for
+// us-east-1
+const route53API = "https://route53.amazonaws.com/2013-04-01"
+
+// Route53Config configures a Route 53 provider
+type Route53Config struct {
+	// HostedZoneID is the zone the domains are in, e.g. Z0123456789ABCDEFGHIJ
+	HostedZoneID string
+	AccessKey    string
+	SecretKey    string
+	SessionToken string // for temporary credentials; optional
+}
+
+// Route53 publishes challenge records in an AWS Route 53 hosted zone. The
+// credentials need route53:ChangeResourceRecordSets and
+// route53:ListResourceRecordSets on the zone.
+type Route53 struct {
+	config     Route53Config
+	baseURL    string
+	httpClient *http.Client
+}
+
+// NewRoute53 creates a provider for a hosted zone
+func NewRoute53(config Route53Config) (*Route53, error) {
+	config.HostedZoneID = strings.TrimPrefix(config.HostedZoneID, "/hostedzone/")
+	if config.HostedZoneID == "" {
+		return nil, errors.New("ROUTE53_HOSTED_ZONE_ID is required for the route53 DNS provider")
+	}
+	if config.AccessKey == "" || config.SecretKey == "" {
+		return nil, errors.New("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY are required for the route53 DNS provider")
+	}
+	return &Route53{
+		config:     config,
+		baseURL:    route53API,
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+// route53RecordSet is a resource record set in the Route 53 API
+type route53RecordSet struct {
+	Name    string          `xml:"Name"`
+	Type    string          `xml:"Type"`
+	TTL     int             `xml:"TTL"`
+	Records []route53Record `xml:"ResourceRecords>ResourceRecord"`
+}
+
+// route53Record is one value of a record set; TXT values are quoted
+type route53Record struct {
+	Value string `xml:"Value"`
+}
+
+// Present adds value to the TXT record set of fqdn. Route 53 replaces
+// whole record sets, so the values already there are kept.
+func (r *Route53) Present(ctx context.Context, fqdn, value string) error {
+	set, err := r.txtSet(ctx, fqdn)
+	if err != nil {
+		return err
+	}
+	quoted := strconv.Quote(value)
+	for _, record := range set.Records {
+		if record.Value == quoted {
+			return nil
+		}
+	}
+	set.Records = append(set.Records, route53Record{Value: quoted})
+	return r.change(ctx, "UPSERT", set)
+}
+
+// CleanUp removes value from the TXT record set of fqdn, deleting the set
+// if it was the last value
+func (r *Route53) CleanUp(ctx context.Context, fqdn, value string) error {
+	set, err := r.txtSet(ctx, fqdn)
+	if err != nil {
+		return err
+	}
+	quoted := strconv.Quote(value)
+	var kept []route53Record
+	for _, record := range set.Records {
+		if record.Value != quoted {
+			kept = append(kept, record)
+		}
+	}
+	switch {
+	case len(kept) == len(set.Records):
+		return nil
+	case len(kept) == 0:
+		// A deletion must match the set exactly
+		return r.change(ctx, "DELETE", set)
+	default:
+		set.Records = kept
+		return r.change(ctx, "UPSERT", set)
+	}
+}
+
+// txtSet returns the TXT record set of fqdn, empty if there is none
+func (r *Route53) txtSet(ctx context.Context, fqdn string) (route53RecordSet, error) {
+	query := url.Values{"name": {fqdn}, "type": {"TXT"}, "maxitems": {"1"}}
+	path := "/hostedzone/" + r.config.HostedZoneID + "/rrset?" + query.Encode()
+	var result struct {
+		RecordSets []route53RecordSet `xml:"ResourceRecordSets>ResourceRecordSet"`
+	}
+	if err := r.do(ctx, http.MethodGet, path, nil, &result); err != nil {
+		return route53RecordSet{}, err
+	}
+	for _, set := range result.RecordSets {
+		if set.Type == "TXT" && strings.EqualFold(set.Name, fqdn) {
+			return set, nil
+		}
+	}
+	return route53RecordSet{Name: fqdn, Type: "TXT", TTL: 60}, nil
+}
+
+// change applies one change to a record set
+func (r *Route53) change(ctx context.Context, action string, set route53RecordSet) error {
+	type change struct {
+		Action    string           `xml:"Action"`
+		RecordSet route53RecordSet `xml:"ResourceRecordSet"`
+	}
+	type changeRequest struct {
+		XMLName xml.Name `xml:"https://route53.amazonaws.com/doc/2013-04-01/ ChangeResourceRecordSetsRequest"`
+		Changes []change `xml:"ChangeBatch>Changes>Change"`
+	}
+	body := changeRequest{Changes: []change{{Action: action, RecordSet: set}}}
+	return r.do(ctx, http.MethodPost, "/hostedzone/"+r.config.HostedZoneID+"/rrset", body, nil)
+}
+
+// do sends a signed request and decodes the XML response into result, if
+// given
+func (r *Route53) do(ctx context.Context, method, path string, body, result any) error {
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = xml.Marshal(body); err != nil {
+			return fmt.Errorf("failed to encode request: %w", err)
+		}
+		data = append([]byte(xml.Header), data...)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, r.baseURL+path, bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/xml")
+	}
+	sigv4.Sign(req, data, sigv4.Credentials{
+		AccessKey:    r.config.AccessKey,
+		SecretKey:    r.config.SecretKey,
+		SessionToken: r.config.SessionToken,
+	}, "us-east-1", "route53", time.Now())
+
+	resp, err := r.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("Route 53 API error: status %d, body: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+	if result != nil {
+		if err := xml.NewDecoder(resp.Body).Decode(result); err != nil {
+			return fmt.Errorf("failed to decode response: %w", err)
+		}
+	}
+	return nil
+}
@@ -4,12 +4,14 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
 
 	"github.com/jhead/lanscape/lanscaped/internal/api"
+	"github.com/jhead/lanscape/lanscaped/internal/buildinfo"
 )
 
 // ServerConfig holds lanscaped server configuration
@@ -19,7 +21,7 @@ type ServerConfig struct {
 
 // Run starts the lanscaped server with the specified configuration
 func Run(config ServerConfig) {
-	log.Println("Initializing lanscaped server...")
+	log.Printf("Initializing lanscaped server %s...", buildinfo.Get())
 
 	// Create and start server
 	server, err := api.NewServer(config.Port)
@@ -37,7 +39,7 @@ func Run(config ServerConfig) {
 
 	// Start server in a goroutine
 	go func() {
-		if err := server.Start(); err != nil && err != context.Canceled {
+		if err := server.Start(); err != nil && err != http.ErrServerClosed {
 			log.Fatalf("Server error: %v", err)
 		}
 	}()
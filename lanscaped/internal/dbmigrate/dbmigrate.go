@@ -0,0 +1,415 @@
+// Package dbmigrate copies a lanscaped SQLite database into Postgres, ahead
+// of a Postgres backend for the store, which only opens SQLite so far
+package dbmigrate
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+
+	_ "github.com/lib/pq"
+)
+
+// table is a table to copy, with its columns in the order they are copied
+type table struct {
+	name    string
+	columns []string
+	// serial marks tables whose id is an identity column; its sequence is
+	// moved past the copied IDs
+	serial bool
+}
+
+// tables lists every table in an order where referenced rows are copied
+// before the rows referencing them
+var tables = []table{
+	{"users", []string{"id", "username", "claim_code", "created_at"}, true},
+	{"webauthn_credentials", []string{"id", "user_id", "credential_id", "public_key", "counter", "backup_eligible", "backup_state", "created_at"}, true},
+	{"webauthn_sessions", []string{"id", "username", "session_data", "created_at", "expires_at"}, false},
+	{"networks", []string{"id", "name", "headscale_endpoint", "api_key", "description", "visibility", "metadata", "avatar", "created_at", "updated_at"}, true},
+	{"memberships", []string{"id", "user_id", "network_id", "created_at", "key_generation"}, true},
+	{"usage_records", []string{"id", "network_id", "user_id", "topic", "peer", "bytes_sent", "bytes_received", "messages_sent", "messages_received", "period_start", "period_end", "created_at"}, true},
+	{"device_codes", []string{"device_code", "user_code", "user_id", "created_at", "expires_at"}, false},
+	{"agents", []string{"id", "user_id", "public_key", "name", "version", "created_at", "revoked_at"}, true},
+	{"presence", []string{"public_key", "topic", "online", "changed_at"}, false},
+	{"presence_events", []string{"id", "public_key", "topic", "online", "at"}, true},
+	{"audit_events", []string{"id", "user_id", "action", "detail", "created_at"}, true},
+	{"network_settings", []string{"network_id", "key", "value", "updated_at"}, false},
+	{"join_requests", []string{"network_id", "user_id", "created_at"}, false},
+	{"invitations", []string{"network_id", "user_id", "invited_by", "created_at"}, false},
+	{"tailnet_links", []string{"network_id", "headscale_user", "status", "user_id", "created_at"}, false},
+	{"devices", []string{"id", "network_id", "user_id", "node_id", "name", "ip_addresses", "last_seen", "created_at", "updated_at"}, true},
+	{"api_tokens", []string{"id", "user_id", "name", "token_hash", "scopes", "created_at", "last_used_at"}, true},
+	{"topic_keys", []string{"network_id", "generation", "key", "members", "created_at"}, false},
+}
+
+// selectQuery reads every row of the table from SQLite, in column order
+func (t table) selectQuery() string {
+	return fmt.Sprintf("SELECT %s FROM %s", strings.Join(t.columns, ", "), t.name)
+}
+
+// byteaColumns are the binary columns; SQLite may hand back any other column
+// as bytes too, which are copied as text
+var byteaColumns = map[string]bool{
+	"webauthn_credentials.credential_id": true,
+	"webauthn_credentials.public_key":    true,
+	"webauthn_sessions.session_data":     true,
+	"topic_keys.key":                     true,
+}
+
+// postgresSchema mirrors the SQLite schema in Postgres
+var postgresSchema = []string{
+	`CREATE TABLE IF NOT EXISTS users (
+		id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+		username TEXT NOT NULL UNIQUE,
+		claim_code TEXT,
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`,
+	`CREATE TABLE IF NOT EXISTS webauthn_credentials (
+		id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+		user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		credential_id BYTEA NOT NULL UNIQUE,
+		public_key BYTEA NOT NULL,
+		counter BIGINT NOT NULL DEFAULT 0,
+		backup_eligible INTEGER NOT NULL DEFAULT 0,
+		backup_state INTEGER NOT NULL DEFAULT 0,
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`,
+	`CREATE TABLE IF NOT EXISTS webauthn_sessions (
+		id TEXT PRIMARY KEY,
+		username TEXT NOT NULL,
+		session_data BYTEA NOT NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		expires_at TIMESTAMP NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_webauthn_credentials_user_id ON webauthn_credentials(user_id)`,
+	`CREATE INDEX IF NOT EXISTS idx_webauthn_sessions_expires_at ON webauthn_sessions(expires_at)`,
+	`CREATE INDEX IF NOT EXISTS idx_webauthn_sessions_username ON webauthn_sessions(username, created_at)`,
+	`CREATE TABLE IF NOT EXISTS networks (
+		id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+		name TEXT NOT NULL UNIQUE,
+		headscale_endpoint TEXT NOT NULL,
+		api_key TEXT,
+		description TEXT NOT NULL DEFAULT '',
+		visibility TEXT NOT NULL DEFAULT 'unlisted',
+		metadata TEXT NOT NULL DEFAULT '{}',
+		avatar TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP
+	)`,
+	`CREATE TABLE IF NOT EXISTS memberships (
+		id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+		user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		network_id BIGINT NOT NULL REFERENCES networks(id) ON DELETE CASCADE,
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		key_generation BIGINT NOT NULL DEFAULT 0,
+		UNIQUE(user_id, network_id)
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_memberships_user_id ON memberships(user_id)`,
+	`CREATE INDEX IF NOT EXISTS idx_memberships_network_id ON memberships(network_id)`,
+	`CREATE TABLE IF NOT EXISTS usage_records (
+		id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+		network_id BIGINT NOT NULL REFERENCES networks(id) ON DELETE CASCADE,
+		user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		topic TEXT NOT NULL,
+		peer TEXT NOT NULL,
+		bytes_sent BIGINT NOT NULL DEFAULT 0,
+		bytes_received BIGINT NOT NULL DEFAULT 0,
+		messages_sent BIGINT NOT NULL DEFAULT 0,
+		messages_received BIGINT NOT NULL DEFAULT 0,
+		period_start TIMESTAMP NOT NULL,
+		period_end TIMESTAMP NOT NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_usage_records_network_period ON usage_records(network_id, period_end)`,
+	`CREATE TABLE IF NOT EXISTS device_codes (
+		device_code TEXT PRIMARY KEY,
+		user_code TEXT NOT NULL UNIQUE,
+		user_id BIGINT REFERENCES users(id) ON DELETE CASCADE,
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		expires_at TIMESTAMP NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS agents (
+		id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+		user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		public_key TEXT NOT NULL UNIQUE,
+		name TEXT NOT NULL DEFAULT '',
+		version TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		revoked_at TIMESTAMP
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_agents_user_id ON agents(user_id)`,
+	`CREATE TABLE IF NOT EXISTS presence (
+		public_key TEXT NOT NULL,
+		topic TEXT NOT NULL,
+		online INTEGER NOT NULL DEFAULT 0,
+		changed_at TIMESTAMP NOT NULL,
+		PRIMARY KEY (public_key, topic)
+	)`,
+	`CREATE TABLE IF NOT EXISTS presence_events (
+		id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+		public_key TEXT NOT NULL,
+		topic TEXT NOT NULL,
+		online INTEGER NOT NULL,
+		at TIMESTAMP NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_presence_events_public_key_at ON presence_events(public_key, at)`,
+	`CREATE TABLE IF NOT EXISTS audit_events (
+		id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+		user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		action TEXT NOT NULL,
+		detail TEXT NOT NULL DEFAULT '{}',
+		created_at TIMESTAMP NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_audit_events_user_id_created_at ON audit_events(user_id, created_at)`,
+	`CREATE TABLE IF NOT EXISTS network_settings (
+		network_id BIGINT NOT NULL REFERENCES networks(id) ON DELETE CASCADE,
+		key TEXT NOT NULL,
+		value TEXT NOT NULL,
+		updated_at TIMESTAMP NOT NULL,
+		PRIMARY KEY (network_id, key)
+	)`,
+	`CREATE TABLE IF NOT EXISTS join_requests (
+		network_id BIGINT NOT NULL REFERENCES networks(id) ON DELETE CASCADE,
+		user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		created_at TIMESTAMP NOT NULL,
+		PRIMARY KEY (network_id, user_id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS invitations (
+		network_id BIGINT NOT NULL REFERENCES networks(id) ON DELETE CASCADE,
+		user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		invited_by BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		created_at TIMESTAMP NOT NULL,
+		PRIMARY KEY (network_id, user_id)
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_invitations_user_id ON invitations(user_id)`,
+	`CREATE TABLE IF NOT EXISTS tailnet_links (
+		network_id BIGINT NOT NULL REFERENCES networks(id) ON DELETE CASCADE,
+		headscale_user TEXT NOT NULL,
+		status TEXT NOT NULL,
+		user_id BIGINT REFERENCES users(id) ON DELETE SET NULL,
+		created_at TIMESTAMP NOT NULL,
+		PRIMARY KEY (network_id, headscale_user)
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_tailnet_links_headscale_user ON tailnet_links(headscale_user)`,
+	`CREATE TABLE IF NOT EXISTS devices (
+		id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+		network_id BIGINT NOT NULL REFERENCES networks(id) ON DELETE CASCADE,
+		user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		node_id TEXT NOT NULL,
+		name TEXT NOT NULL DEFAULT '',
+		ip_addresses TEXT NOT NULL DEFAULT '[]',
+		last_seen TIMESTAMP,
+		created_at TIMESTAMP NOT NULL,
+		updated_at TIMESTAMP,
+		UNIQUE (network_id, node_id)
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_devices_user_id ON devices(user_id)`,
+	`CREATE TABLE IF NOT EXISTS api_tokens (
+		id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+		user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		name TEXT NOT NULL,
+		token_hash TEXT NOT NULL UNIQUE,
+		scopes TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL,
+		last_used_at TIMESTAMP
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_api_tokens_user_id ON api_tokens(user_id)`,
+	`CREATE TABLE IF NOT EXISTS topic_keys (
+		network_id BIGINT NOT NULL REFERENCES networks(id) ON DELETE CASCADE,
+		generation BIGINT NOT NULL,
+		key BYTEA NOT NULL,
+		members TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL,
+		PRIMARY KEY (network_id, generation)
+	)`,
+}
+
+// TableCount is the number of rows copied for a table
+type TableCount struct {
+	Table string
+	Rows  int64
+}
+
+// CopyToPostgres copies every table of a SQLite database into a Postgres
+// database, creating the schema if needed. It refuses a source that fails
+// SQLite's integrity or foreign key checks and a destination that already
+// holds data, and checks the row counts of every table match before
+// committing. With dryRun, everything is done but the copy is rolled back.
+func CopyToPostgres(src *sql.DB, postgresURL string, dryRun bool) ([]TableCount, error) {
+	if err := checkSource(src); err != nil {
+		return nil, err
+	}
+
+	dst, err := sql.Open("postgres", postgresURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open postgres: %w", err)
+	}
+	defer dst.Close()
+
+	if err := dst.Ping(); err != nil {
+		return nil, fmt.Errorf("failed to connect to postgres: %w", err)
+	}
+
+	// The whole copy, schema included, is one transaction, so a failed or
+	// dry run leaves the destination untouched
+	tx, err := dst.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, query := range postgresSchema {
+		if _, err := tx.Exec(query); err != nil {
+			return nil, fmt.Errorf("failed to create postgres schema: %w", err)
+		}
+	}
+
+	counts := make([]TableCount, 0, len(tables))
+	for _, t := range tables {
+		var existing int64
+		if err := tx.QueryRow("SELECT COUNT(*) FROM " + t.name).Scan(&existing); err != nil {
+			return nil, fmt.Errorf("failed to count %s in postgres: %w", t.name, err)
+		}
+		if existing > 0 {
+			return nil, fmt.Errorf("postgres table %s already has %d rows; migrate into an empty database", t.name, existing)
+		}
+
+		copied, err := copyTable(src, tx, t)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := verifyCount(src, tx, t, copied); err != nil {
+			return nil, err
+		}
+		counts = append(counts, TableCount{Table: t.name, Rows: copied})
+		log.Printf("Copied %d rows of %s", copied, t.name)
+	}
+
+	if dryRun {
+		log.Println("Dry run; rolling back")
+		return counts, nil
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit copy: %w", err)
+	}
+	return counts, nil
+}
+
+// checkSource runs SQLite's integrity and foreign key checks, so broken or
+// orphaned rows are found before anything is copied
+func checkSource(src *sql.DB) error {
+	var result string
+	if err := src.QueryRow("PRAGMA integrity_check").Scan(&result); err != nil {
+		return fmt.Errorf("failed to check sqlite integrity: %w", err)
+	}
+	if result != "ok" {
+		return fmt.Errorf("sqlite integrity check failed: %s", result)
+	}
+
+	rows, err := src.Query("PRAGMA foreign_key_check")
+	if err != nil {
+		return fmt.Errorf("failed to check sqlite foreign keys: %w", err)
+	}
+	defer rows.Close()
+
+	orphans := make(map[string]int)
+	for rows.Next() {
+		var table, parent string
+		var rowID sql.NullInt64
+		var fkID int64
+		if err := rows.Scan(&table, &rowID, &parent, &fkID); err != nil {
+			return fmt.Errorf("failed to scan foreign key check: %w", err)
+		}
+		orphans[table+" -> "+parent]++
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating foreign key check: %w", err)
+	}
+
+	if len(orphans) > 0 {
+		var problems []string
+		for ref, n := range orphans {
+			problems = append(problems, fmt.Sprintf("%s (%d rows)", ref, n))
+		}
+		return fmt.Errorf("sqlite has rows referencing missing rows: %s", strings.Join(problems, ", "))
+	}
+	return nil
+}
+
+// copyTable copies every row of a table and returns how many were copied
+func copyTable(src *sql.DB, tx *sql.Tx, t table) (int64, error) {
+	columns := strings.Join(t.columns, ", ")
+	placeholders := make([]string, len(t.columns))
+	for i := range placeholders {
+		placeholders[i] = fmt.Sprintf("$%d", i+1)
+	}
+
+	insert, err := tx.Prepare(fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", t.name, columns, strings.Join(placeholders, ", ")))
+	if err != nil {
+		return 0, fmt.Errorf("failed to prepare insert into %s: %w", t.name, err)
+	}
+	defer insert.Close()
+
+	rows, err := src.Query(t.selectQuery())
+	if err != nil {
+		return 0, fmt.Errorf("failed to read %s: %w", t.name, err)
+	}
+	defer rows.Close()
+
+	values := make([]any, len(t.columns))
+	ptrs := make([]any, len(t.columns))
+	for i := range values {
+		ptrs[i] = &values[i]
+	}
+
+	var copied int64
+	for rows.Next() {
+		if err := rows.Scan(ptrs...); err != nil {
+			return copied, fmt.Errorf("failed to scan %s: %w", t.name, err)
+		}
+		for i, v := range values {
+			if b, ok := v.([]byte); ok && !byteaColumns[t.name+"."+t.columns[i]] {
+				values[i] = string(b)
+			}
+		}
+		if _, err := insert.Exec(values...); err != nil {
+			return copied, fmt.Errorf("failed to copy row %d of %s: %w", copied+1, t.name, err)
+		}
+		copied++
+	}
+	if err := rows.Err(); err != nil {
+		return copied, fmt.Errorf("error iterating %s: %w", t.name, err)
+	}
+
+	if t.serial {
+		// Rows were inserted with their IDs, which does not advance the
+		// identity sequence
+		if _, err := tx.Exec(fmt.Sprintf(
+			"SELECT setval(pg_get_serial_sequence('%s', 'id'), COALESCE(MAX(id), 0) + 1, false) FROM %s",
+			t.name, t.name,
+		)); err != nil {
+			return copied, fmt.Errorf("failed to advance %s id sequence: %w", t.name, err)
+		}
+	}
+
+	return copied, nil
+}
+
+// verifyCount checks a table has as many rows in both databases as were
+// copied
+func verifyCount(src *sql.DB, tx *sql.Tx, t table, copied int64) error {
+	var srcCount, dstCount int64
+	if err := src.QueryRow("SELECT COUNT(*) FROM " + t.name).Scan(&srcCount); err != nil {
+		return fmt.Errorf("failed to count %s in sqlite: %w", t.name, err)
+	}
+	if err := tx.QueryRow("SELECT COUNT(*) FROM " + t.name).Scan(&dstCount); err != nil {
+		return fmt.Errorf("failed to count %s in postgres: %w", t.name, err)
+	}
+	if srcCount != copied || dstCount != copied {
+		return fmt.Errorf("row count mismatch for %s: sqlite has %d, copied %d, postgres has %d", t.name, srcCount, copied, dstCount)
+	}
+	return nil
+}
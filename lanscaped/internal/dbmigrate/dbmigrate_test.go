@@ -0,0 +1,133 @@
+package dbmigrate
+
+import (
+	"database/sql"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/jhead/lanscape/lanscaped/internal/store"
+)
+
+// openSource opens a new SQLite database brought up to lanscaped's current
+// schema, the way migrate-db opens its source
+func openSource(t *testing.T, dbURL string) *sql.DB {
+	t.Helper()
+	src, err := store.Open(dbURL)
+	if err != nil {
+		t.Fatalf("store.Open: %v", err)
+	}
+	t.Cleanup(func() { src.Close() })
+	return src.DB()
+}
+
+// sqliteColumns lists a SQLite table's columns
+func sqliteColumns(t *testing.T, db *sql.DB, name string) []string {
+	t.Helper()
+	rows, err := db.Query("SELECT name FROM pragma_table_info(?)", name)
+	if err != nil {
+		t.Fatalf("reading columns of %s: %v", name, err)
+	}
+	defer rows.Close()
+	var columns []string
+	for rows.Next() {
+		var column string
+		if err := rows.Scan(&column); err != nil {
+			t.Fatal(err)
+		}
+		columns = append(columns, column)
+	}
+	return columns
+}
+
+// postgresColumns lists the columns postgresSchema creates a table with
+func postgresColumns(t *testing.T, name string) []string {
+	t.Helper()
+	prefix := "CREATE TABLE IF NOT EXISTS " + name + " ("
+	for _, query := range postgresSchema {
+		body, ok := strings.CutPrefix(query, prefix)
+		if !ok {
+			continue
+		}
+		var columns []string
+		for _, line := range strings.Split(body, "\n") {
+			// Table constraints such as PRIMARY KEY (...) are upper case
+			column, _, _ := strings.Cut(strings.TrimSpace(line), " ")
+			column, _, _ = strings.Cut(column, "(")
+			if column == "" || column == ")" || column == strings.ToUpper(column) {
+				continue
+			}
+			columns = append(columns, column)
+		}
+		return columns
+	}
+	t.Fatalf("postgresSchema does not create %s", name)
+	return nil
+}
+
+// TestTablesMatchSchema checks that the tables copied, and their columns,
+// are exactly those of lanscaped's SQLite schema and exist in the Postgres
+// schema, so a renamed or added column fails here rather than mid-migration
+func TestTablesMatchSchema(t *testing.T) {
+	src := openSource(t, "file:"+filepath.Join(t.TempDir(), "lanscaped.db")+"?_foreign_keys=on")
+	if err := checkSource(src); err != nil {
+		t.Fatalf("checkSource of a new database: %v", err)
+	}
+
+	rows, err := src.Query("SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sqliteTables []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			t.Fatal(err)
+		}
+		sqliteTables = append(sqliteTables, name)
+	}
+	rows.Close()
+
+	copied := make(map[string]bool, len(tables))
+	for _, tbl := range tables {
+		copied[tbl.name] = true
+
+		columns := sqliteColumns(t, src, tbl.name)
+		if len(columns) == 0 {
+			t.Errorf("%s is copied but not in the SQLite schema", tbl.name)
+			continue
+		}
+		got, want := slices.Sorted(slices.Values(tbl.columns)), slices.Sorted(slices.Values(columns))
+		if !slices.Equal(got, want) {
+			t.Errorf("%s copies columns %v, SQLite has %v", tbl.name, got, want)
+		}
+		if pg := postgresColumns(t, tbl.name); !slices.Equal(slices.Sorted(slices.Values(pg)), want) {
+			t.Errorf("%s has columns %v in Postgres, SQLite has %v", tbl.name, slices.Sorted(slices.Values(pg)), want)
+		}
+
+		rows, err := src.Query(tbl.selectQuery())
+		if err != nil {
+			t.Errorf("reading %s: %v", tbl.name, err)
+			continue
+		}
+		rows.Close()
+	}
+	for _, name := range sqliteTables {
+		if !copied[name] {
+			t.Errorf("SQLite table %s is not copied", name)
+		}
+	}
+}
+
+func TestCheckSourceRejectsOrphans(t *testing.T) {
+	// Without foreign keys enforced, SQLite stores a membership of a user
+	// that does not exist
+	src := openSource(t, "file:"+filepath.Join(t.TempDir(), "lanscaped.db"))
+	if _, err := src.Exec("INSERT INTO memberships (user_id, network_id) VALUES (42, 42)"); err != nil {
+		t.Fatalf("inserting orphan: %v", err)
+	}
+	if err := checkSource(src); err == nil || !strings.Contains(err.Error(), "memberships -> ") {
+		t.Fatalf("checkSource = %v, want the orphaned memberships", err)
+	}
+}
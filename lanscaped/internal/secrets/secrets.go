@@ -0,0 +1,55 @@
+// Package secrets reads configuration secrets, such as the JWT signing key
+// and API tokens, from the environment or from files. Reading them from
+// files keeps them out of the environment, where child processes, crash
+// reports, and process listings can see them.
+package secrets
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Get returns the secret name, read from the first of:
+//
+//   - the environment variable name
+//   - the file named by the environment variable name_FILE
+//   - the systemd credential name, which LoadCredential=name:/path places in
+//     $CREDENTIALS_DIRECTORY
+//
+// Trailing newlines are trimmed from files. It returns an empty string if
+// the secret is not set anywhere, and an error if name and name_FILE are
+// both set or the file cannot be read.
+func Get(name string) (string, error) {
+	value, hasValue := os.LookupEnv(name)
+	path, hasPath := os.LookupEnv(name + "_FILE")
+	switch {
+	case hasValue && hasPath:
+		return "", fmt.Errorf("set only one of %s and %s_FILE", name, name)
+	case hasValue:
+		return value, nil
+	case hasPath:
+		return readFile(path, name+"_FILE")
+	}
+
+	dir := os.Getenv("CREDENTIALS_DIRECTORY")
+	if dir == "" {
+		return "", nil
+	}
+	value, err := readFile(filepath.Join(dir, name), "credential "+name)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	return value, err
+}
+
+// readFile reads a secret from path, which source names in errors
+func readFile(path, source string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", source, err)
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
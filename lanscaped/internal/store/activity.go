@@ -0,0 +1,96 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Activity types for events derived from agents and presence rather than
+// the audit log
+const (
+	ActivityAgentEnrolled = "agent.enrolled"
+	ActivityAgentRevoked  = "agent.revoked"
+	ActivityAgentOnline   = "agent.online"
+	ActivityAgentOffline  = "agent.offline"
+)
+
+// ActivityEntry is one event in a user's account timeline
+type ActivityEntry struct {
+	ActivityCursor
+	Type   string
+	Detail map[string]any
+}
+
+// ActivityCursor is the position of an entry in the timeline. Entries are
+// ordered newest first by time, then by the table they come from and their
+// ID within it.
+type ActivityCursor struct {
+	At     time.Time
+	Source string
+	ID     int64
+}
+
+// activityQuery merges the audit log, agent enrollments and revocations, and
+// presence transitions of a user's agents into one timeline
+const activityQuery = `
+SELECT at, source, id, type, detail FROM (
+	SELECT created_at AS at, 'audit' AS source, id, action AS type, detail
+	FROM audit_events WHERE user_id = ?1
+	UNION ALL
+	SELECT created_at, 'agent', id, '` + ActivityAgentEnrolled + `',
+	       json_object('agent_id', id, 'name', name, 'public_key', public_key)
+	FROM agents WHERE user_id = ?1
+	UNION ALL
+	SELECT revoked_at, 'agent_revoked', id, '` + ActivityAgentRevoked + `',
+	       json_object('agent_id', id, 'name', name, 'public_key', public_key)
+	FROM agents WHERE user_id = ?1 AND revoked_at IS NOT NULL
+	UNION ALL
+	SELECT p.at, 'presence', p.id,
+	       CASE WHEN p.online THEN '` + ActivityAgentOnline + `' ELSE '` + ActivityAgentOffline + `' END,
+	       json_object('agent_id', a.id, 'name', a.name, 'topic', p.topic)
+	FROM presence_events p INNER JOIN agents a ON a.public_key = p.public_key
+	WHERE a.user_id = ?1
+)
+WHERE (at, source, id) < (?2, ?3, ?4)
+ORDER BY at DESC, source DESC, id DESC
+LIMIT ?5`
+
+// ListActivity returns up to limit entries of a user's timeline that come
+// after before, or the newest entries if before is nil
+func (s *Store) ListActivity(userID int64, before *ActivityCursor, limit int) ([]*ActivityEntry, error) {
+	// Every entry sorts below a time far in the future
+	at, source, id := "9999-12-31T23:59:59Z", "", int64(0)
+	if before != nil {
+		at, source, id = formatTime(before.At), before.Source, before.ID
+	}
+
+	rows, err := s.db.QueryContext(s.ctx, activityQuery, userID, at, source, id, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list activity: %w", err)
+	}
+	defer rows.Close()
+
+	entries := []*ActivityEntry{}
+	for rows.Next() {
+		var entry ActivityEntry
+		var at, detail string
+		if err := rows.Scan(&at, &entry.Source, &entry.ID, &entry.Type, &detail); err != nil {
+			return nil, fmt.Errorf("failed to scan activity: %w", err)
+		}
+		var err error
+		if entry.At, err = parseTime(at); err != nil {
+			return nil, fmt.Errorf("failed to parse activity time: %w", err)
+		}
+		if err := json.Unmarshal([]byte(detail), &entry.Detail); err != nil {
+			return nil, fmt.Errorf("failed to decode activity detail: %w", err)
+		}
+		entries = append(entries, &entry)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating activity: %w", err)
+	}
+
+	return entries, nil
+}
@@ -0,0 +1,214 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Agent represents an agent identity key enrolled by a user
+type Agent struct {
+	ID        int64
+	UserID    int64
+	PublicKey string // ed25519 identity key, base64url
+	Name      string
+	Version   string // agent build version reported at its last enrollment
+	CreatedAt time.Time
+	RevokedAt *time.Time // nil unless the user revoked the key
+}
+
+// agentColumns is the column list scanned by scanAgent
+const agentColumns = "id, user_id, public_key, name, version, created_at, revoked_at"
+
+// RegisterAgent enrolls an agent identity key for a user, recording the
+// version the agent reports. Registering a key the user already enrolled
+// updates its name and version; a key enrolled by another user or revoked
+// is rejected.
+func (s *Store) RegisterAgent(userID int64, publicKey, name, version string) (*Agent, error) {
+	existing, err := s.GetAgentByPublicKey(publicKey)
+	if err == nil {
+		if existing.UserID != userID {
+			return nil, fmt.Errorf("agent key is registered to another user")
+		}
+		if existing.RevokedAt != nil {
+			return nil, fmt.Errorf("agent key has been revoked")
+		}
+		if _, err := s.db.ExecContext(s.ctx, "UPDATE agents SET name = ?, version = ? WHERE id = ?", name, version, existing.ID); err != nil {
+			return nil, fmt.Errorf("failed to update agent: %w", err)
+		}
+		existing.Name = name
+		existing.Version = version
+		return existing, nil
+	}
+
+	result, err := s.db.ExecContext(s.ctx,
+		"INSERT INTO agents (user_id, public_key, name, version, created_at) VALUES (?, ?, ?, ?, ?)",
+		userID, publicKey, name, version, now(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to register agent: %w", err)
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get agent ID: %w", err)
+	}
+
+	return s.scanAgent(s.db.QueryRowContext(s.ctx, "SELECT "+agentColumns+" FROM agents WHERE id = ?", id))
+}
+
+// ListAgentKeys returns the identity keys of all of a user's agents,
+// including revoked ones
+func (s *Store) ListAgentKeys(userID int64) ([]string, error) {
+	return s.queryAgentKeys("SELECT public_key FROM agents WHERE user_id = ?", userID)
+}
+
+// ListNetworkAgentKeys returns the identity keys of all agents of a network's
+// members, including revoked ones
+func (s *Store) ListNetworkAgentKeys(networkID int64) ([]string, error) {
+	return s.queryAgentKeys(
+		`SELECT a.public_key FROM agents a
+		 INNER JOIN memberships m ON a.user_id = m.user_id
+		 WHERE m.network_id = ?`,
+		networkID,
+	)
+}
+
+// queryAgentKeys runs a query that selects agent public keys
+func (s *Store) queryAgentKeys(query string, args ...any) ([]string, error) {
+	rows, err := s.db.QueryContext(s.ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list agent keys: %w", err)
+	}
+	defer rows.Close()
+
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, fmt.Errorf("failed to scan agent key: %w", err)
+		}
+		keys = append(keys, key)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating agent keys: %w", err)
+	}
+	return keys, nil
+}
+
+// GetAgentByPublicKey retrieves an enrolled agent by its identity key
+func (s *Store) GetAgentByPublicKey(publicKey string) (*Agent, error) {
+	return s.scanAgent(s.db.QueryRowContext(s.ctx, "SELECT "+agentColumns+" FROM agents WHERE public_key = ?", publicKey))
+}
+
+// ListAgents lists the agents a user has enrolled, including revoked ones
+func (s *Store) ListAgents(userID int64) ([]*Agent, error) {
+	rows, err := s.db.QueryContext(s.ctx,
+		"SELECT "+agentColumns+" FROM agents WHERE user_id = ? ORDER BY created_at DESC",
+		userID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list agents: %w", err)
+	}
+	defer rows.Close()
+
+	var agents []*Agent
+	for rows.Next() {
+		agent, err := s.scanAgent(rows)
+		if err != nil {
+			return nil, err
+		}
+		agents = append(agents, agent)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating agents: %w", err)
+	}
+
+	return agents, nil
+}
+
+// RenameAgent renames one of a user's agents
+func (s *Store) RenameAgent(userID, agentID int64, name string) error {
+	result, err := s.db.ExecContext(s.ctx, "UPDATE agents SET name = ? WHERE id = ? AND user_id = ?", name, agentID, userID)
+	if err != nil {
+		return fmt.Errorf("failed to rename agent: %w", err)
+	}
+	return expectOneRow(result, "agent not found")
+}
+
+// RevokeAgent revokes one of a user's agents. The key stays on record so it
+// keeps being rejected and cannot be enrolled again.
+func (s *Store) RevokeAgent(userID, agentID int64) error {
+	result, err := s.db.ExecContext(s.ctx,
+		"UPDATE agents SET revoked_at = ? WHERE id = ? AND user_id = ? AND revoked_at IS NULL",
+		now(), agentID, userID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to revoke agent: %w", err)
+	}
+	return expectOneRow(result, "agent not found")
+}
+
+// ListRevokedAgentKeys returns the identity keys of every revoked agent
+func (s *Store) ListRevokedAgentKeys() ([]string, error) {
+	rows, err := s.db.QueryContext(s.ctx, "SELECT public_key FROM agents WHERE revoked_at IS NOT NULL ORDER BY revoked_at")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list revoked agents: %w", err)
+	}
+	defer rows.Close()
+
+	keys := []string{}
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, fmt.Errorf("failed to scan revoked agent: %w", err)
+		}
+		keys = append(keys, key)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating revoked agents: %w", err)
+	}
+
+	return keys, nil
+}
+
+// scanAgent scans one row of agentColumns
+func (s *Store) scanAgent(row interface{ Scan(...any) error }) (*Agent, error) {
+	var agent Agent
+	var createdAt string
+	var revokedAt sql.NullString
+
+	err := row.Scan(&agent.ID, &agent.UserID, &agent.PublicKey, &agent.Name, &agent.Version, &createdAt, &revokedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("agent not found")
+		}
+		return nil, fmt.Errorf("failed to get agent: %w", err)
+	}
+
+	if agent.CreatedAt, err = parseTime(createdAt); err != nil {
+		return nil, fmt.Errorf("failed to parse agent created_at: %w", err)
+	}
+	if revokedAt.Valid {
+		t, err := parseTime(revokedAt.String)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse agent revoked_at: %w", err)
+		}
+		agent.RevokedAt = &t
+	}
+	return &agent, nil
+}
+
+// expectOneRow returns an error with message if result affected no rows
+func expectOneRow(result sql.Result, message string) error {
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+	if rowsAffected == 0 {
+		return fmt.Errorf("%s", message)
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// APIToken represents a personal API token a user created for automation.
+// Only the token's hash is stored.
+type APIToken struct {
+	ID         int64
+	UserID     int64
+	Name       string
+	Scopes     []string
+	CreatedAt  time.Time
+	LastUsedAt *time.Time // nil until the token is first used
+}
+
+// apiTokenColumns is the column list scanned by scanAPIToken
+const apiTokenColumns = "id, user_id, name, scopes, created_at, last_used_at"
+
+// apiTokenTouchInterval is how stale last_used_at may get, so busy tokens
+// do not write on every request
+const apiTokenTouchInterval = time.Minute
+
+// CreateAPIToken stores a personal API token by its hash
+func (s *Store) CreateAPIToken(userID int64, name, hash string, scopes []string) (*APIToken, error) {
+	result, err := s.db.ExecContext(s.ctx,
+		"INSERT INTO api_tokens (user_id, name, token_hash, scopes, created_at) VALUES (?, ?, ?, ?, ?)",
+		userID, name, hash, strings.Join(scopes, " "), now(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create API token: %w", err)
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get API token ID: %w", err)
+	}
+
+	return s.scanAPIToken(s.db.QueryRowContext(s.ctx, "SELECT "+apiTokenColumns+" FROM api_tokens WHERE id = ?", id))
+}
+
+// GetAPITokenByHash retrieves a personal API token by its hash
+func (s *Store) GetAPITokenByHash(hash string) (*APIToken, error) {
+	return s.scanAPIToken(s.db.QueryRowContext(s.ctx, "SELECT "+apiTokenColumns+" FROM api_tokens WHERE token_hash = ?", hash))
+}
+
+// ListAPITokens lists a user's personal API tokens, newest first
+func (s *Store) ListAPITokens(userID int64) ([]*APIToken, error) {
+	rows, err := s.db.QueryContext(s.ctx,
+		"SELECT "+apiTokenColumns+" FROM api_tokens WHERE user_id = ? ORDER BY created_at DESC, id DESC",
+		userID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list API tokens: %w", err)
+	}
+	defer rows.Close()
+
+	var tokens []*APIToken
+	for rows.Next() {
+		token, err := s.scanAPIToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating API tokens: %w", err)
+	}
+
+	return tokens, nil
+}
+
+// TouchAPIToken records that a token was used, at most once per
+// apiTokenTouchInterval
+func (s *Store) TouchAPIToken(id int64) error {
+	t := time.Now()
+	_, err := s.db.ExecContext(s.ctx,
+		"UPDATE api_tokens SET last_used_at = ? WHERE id = ? AND (last_used_at IS NULL OR last_used_at < ?)",
+		formatTime(t), id, formatTime(t.Add(-apiTokenTouchInterval)),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update API token: %w", err)
+	}
+	return nil
+}
+
+// DeleteAPIToken deletes one of a user's personal API tokens, revoking it
+func (s *Store) DeleteAPIToken(userID, tokenID int64) error {
+	result, err := s.db.ExecContext(s.ctx, "DELETE FROM api_tokens WHERE id = ? AND user_id = ?", tokenID, userID)
+	if err != nil {
+		return fmt.Errorf("failed to delete API token: %w", err)
+	}
+	return expectOneRow(result, "API token not found")
+}
+
+// scanAPIToken scans one row of apiTokenColumns
+func (s *Store) scanAPIToken(row interface{ Scan(...any) error }) (*APIToken, error) {
+	var token APIToken
+	var scopes, createdAt string
+	var lastUsedAt sql.NullString
+
+	err := row.Scan(&token.ID, &token.UserID, &token.Name, &scopes, &createdAt, &lastUsedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("API token not found")
+		}
+		return nil, fmt.Errorf("failed to get API token: %w", err)
+	}
+
+	token.Scopes = strings.Fields(scopes)
+	if token.CreatedAt, err = parseTime(createdAt); err != nil {
+		return nil, fmt.Errorf("failed to parse API token created_at: %w", err)
+	}
+	if lastUsedAt.Valid {
+		t, err := parseTime(lastUsedAt.String)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse API token last_used_at: %w", err)
+		}
+		token.LastUsedAt = &t
+	}
+	return &token, nil
+}
@@ -0,0 +1,26 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// RecordAuditEvent records an action on a user's account. detail holds
+// whatever identifies what the action applied to, such as a network name.
+func (s *Store) RecordAuditEvent(userID int64, action string, detail map[string]any) error {
+	if detail == nil {
+		detail = map[string]any{}
+	}
+	data, err := json.Marshal(detail)
+	if err != nil {
+		return fmt.Errorf("failed to encode audit detail: %w", err)
+	}
+	_, err = s.db.ExecContext(s.ctx,
+		"INSERT INTO audit_events (user_id, action, detail, created_at) VALUES (?, ?, ?, ?)",
+		userID, action, string(data), now(),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to record audit event: %w", err)
+	}
+	return nil
+}
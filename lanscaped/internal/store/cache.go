@@ -0,0 +1,162 @@
+package store
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultCacheTTL is how long user, network, and membership lookups are
+// cached
+const DefaultCacheTTL = 30 * time.Second
+
+// CacheStats counts lookups answered from the cache and from the database
+type CacheStats struct {
+	Hits   uint64
+	Misses uint64
+}
+
+// HitRate is the fraction of lookups answered from the cache
+func (c CacheStats) HitRate() float64 {
+	if total := c.Hits + c.Misses; total > 0 {
+		return float64(c.Hits) / float64(total)
+	}
+	return 0
+}
+
+// membershipKey identifies a user's membership in a network
+type membershipKey struct {
+	UserID    int64
+	NetworkID int64
+}
+
+// lookupCache caches the lookups made on nearly every authenticated request.
+// Writes through the store invalidate the entries they change; the TTL bounds
+// how stale an entry can get otherwise. A zero TTL disables caching.
+type lookupCache struct {
+	ttl    time.Duration
+	hits   atomic.Uint64
+	misses atomic.Uint64
+
+	users       *ttlMap[int64, User]
+	usernames   *ttlMap[string, User]
+	networks    *ttlMap[int64, Network]
+	memberships *ttlMap[membershipKey, bool]
+}
+
+func newLookupCache(ttl time.Duration) *lookupCache {
+	return &lookupCache{
+		ttl:         ttl,
+		users:       newTTLMap[int64, User](),
+		usernames:   newTTLMap[string, User](),
+		networks:    newTTLMap[int64, Network](),
+		memberships: newTTLMap[membershipKey, bool](),
+	}
+}
+
+// cached looks a key up in m, calling load and caching its result on a miss
+func cached[K comparable, V any](c *lookupCache, m *ttlMap[K, V], key K, load func() (V, error)) (V, error) {
+	if c.ttl <= 0 {
+		return load()
+	}
+	if v, ok := m.get(key); ok {
+		c.hits.Add(1)
+		return v, nil
+	}
+	c.misses.Add(1)
+	gen := m.generation()
+	v, err := load()
+	if err != nil {
+		return v, err
+	}
+	m.set(key, v, c.ttl, gen)
+	return v, nil
+}
+
+// invalidateNetwork drops a network and every membership in it
+func (c *lookupCache) invalidateNetwork(networkID int64) {
+	c.networks.delete(networkID)
+	c.memberships.deleteFunc(func(k membershipKey) bool { return k.NetworkID == networkID })
+}
+
+// stats returns the hit and miss counts
+func (c *lookupCache) stats() CacheStats {
+	return CacheStats{Hits: c.hits.Load(), Misses: c.misses.Load()}
+}
+
+// ttlMap is a map whose entries expire
+type ttlMap[K comparable, V any] struct {
+	mu        sync.Mutex
+	entries   map[K]ttlEntry[V]
+	nextSweep time.Time
+	// gen counts invalidations, so a load that raced one is not cached
+	gen uint64
+}
+
+type ttlEntry[V any] struct {
+	value   V
+	expires time.Time
+}
+
+func newTTLMap[K comparable, V any]() *ttlMap[K, V] {
+	return &ttlMap[K, V]{entries: make(map[K]ttlEntry[V])}
+}
+
+func (m *ttlMap[K, V]) get(key K) (V, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.entries[key]
+	if !ok || time.Now().After(e.expires) {
+		delete(m.entries, key)
+		var zero V
+		return zero, false
+	}
+	return e.value, true
+}
+
+func (m *ttlMap[K, V]) generation() uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.gen
+}
+
+// set caches a value loaded at generation gen, unless an invalidation
+// happened since
+func (m *ttlMap[K, V]) set(key K, value V, ttl time.Duration, gen uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if gen != m.gen {
+		return
+	}
+	now := time.Now()
+	// Expired entries of keys never looked up again are swept once per TTL,
+	// so the map stays bounded by the keys used within about one TTL
+	if now.After(m.nextSweep) {
+		for k, e := range m.entries {
+			if now.After(e.expires) {
+				delete(m.entries, k)
+			}
+		}
+		m.nextSweep = now.Add(ttl)
+	}
+	m.entries[key] = ttlEntry[V]{value: value, expires: now.Add(ttl)}
+}
+
+func (m *ttlMap[K, V]) delete(key K) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.gen++
+	delete(m.entries, key)
+}
+
+// deleteFunc removes every entry whose key matches
+func (m *ttlMap[K, V]) deleteFunc(match func(K) bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.gen++
+	for k := range m.entries {
+		if match(k) {
+			delete(m.entries, k)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package store
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Device is a node of a network's tailnet, owned by one of its users
+type Device struct {
+	ID        int64
+	NetworkID int64
+	UserID    int64
+	Username  string
+	// NodeID is the node's ID in the network's Headscale
+	NodeID      string
+	Name        string
+	IPAddresses []string
+	LastSeen    *time.Time // nil if Headscale never saw the node online
+	CreatedAt   time.Time
+	// UpdatedAt is when the device was recorded or last changed
+	UpdatedAt time.Time
+}
+
+// deviceColumns is the column list scanned by scanDevice
+const deviceColumns = `d.id, d.network_id, d.user_id, u.username, d.node_id, d.name,
+	d.ip_addresses, d.last_seen, d.created_at, d.updated_at`
+
+// UpsertDevice records a tailnet node as a device of a network, or updates
+// the device already recorded for the node. It reports whether the device
+// is new. updated_at only moves if the device changed, so importing an
+// unchanged tailnet again leaves device lists' ETags alone.
+func (s *Store) UpsertDevice(device Device) (created bool, err error) {
+	addresses, err := json.Marshal(device.IPAddresses)
+	if err != nil {
+		return false, fmt.Errorf("failed to encode IP addresses: %w", err)
+	}
+	if device.IPAddresses == nil {
+		addresses = []byte("[]")
+	}
+	var lastSeen any
+	if device.LastSeen != nil {
+		lastSeen = formatTime(*device.LastSeen)
+	}
+
+	var count int
+	err = s.db.QueryRowContext(s.ctx,
+		"SELECT COUNT(*) FROM devices WHERE network_id = ? AND node_id = ?",
+		device.NetworkID, device.NodeID,
+	).Scan(&count)
+	if err != nil {
+		return false, fmt.Errorf("failed to check device: %w", err)
+	}
+
+	_, err = s.db.ExecContext(s.ctx,
+		`INSERT INTO devices (network_id, user_id, node_id, name, ip_addresses, last_seen, created_at, updated_at)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		 ON CONFLICT (network_id, node_id) DO UPDATE SET
+		 	user_id = excluded.user_id,
+		 	name = excluded.name,
+		 	ip_addresses = excluded.ip_addresses,
+		 	last_seen = excluded.last_seen,
+		 	updated_at = CASE
+		 		WHEN devices.user_id IS excluded.user_id AND devices.name IS excluded.name
+		 			AND devices.ip_addresses IS excluded.ip_addresses AND devices.last_seen IS excluded.last_seen
+		 		THEN devices.updated_at ELSE excluded.updated_at END`,
+		device.NetworkID, device.UserID, device.NodeID, device.Name, string(addresses), lastSeen, now(), now(),
+	)
+	if err != nil {
+		return false, fmt.Errorf("failed to store device: %w", err)
+	}
+	return count == 0, nil
+}
+
+// ListNetworkDevices lists the devices of a network by owner, then name
+func (s *Store) ListNetworkDevices(networkID int64) ([]*Device, error) {
+	rows, err := s.db.QueryContext(s.ctx,
+		`SELECT `+deviceColumns+`
+		 FROM devices d
+		 INNER JOIN users u ON u.id = d.user_id
+		 WHERE d.network_id = ?
+		 ORDER BY u.username, d.name, d.id`,
+		networkID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list devices: %w", err)
+	}
+	defer rows.Close()
+
+	var devices []*Device
+	for rows.Next() {
+		device, err := scanDevice(rows)
+		if err != nil {
+			return nil, err
+		}
+		devices = append(devices, device)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating devices: %w", err)
+	}
+
+	return devices, nil
+}
+
+// DeleteUserDevices forgets a user's devices in a network, e.g. when they
+// leave it
+func (s *Store) DeleteUserDevices(userID, networkID int64) error {
+	_, err := s.db.ExecContext(s.ctx, "DELETE FROM devices WHERE user_id = ? AND network_id = ?", userID, networkID)
+	if err != nil {
+		return fmt.Errorf("failed to delete devices: %w", err)
+	}
+	return nil
+}
+
+// scanDevice scans one row of deviceColumns
+func scanDevice(row interface{ Scan(...any) error }) (*Device, error) {
+	var device Device
+	var addresses, createdAt, updatedAt string
+	var lastSeen sql.NullString
+
+	err := row.Scan(&device.ID, &device.NetworkID, &device.UserID, &device.Username, &device.NodeID,
+		&device.Name, &addresses, &lastSeen, &createdAt, &updatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan device: %w", err)
+	}
+
+	if err := json.Unmarshal([]byte(addresses), &device.IPAddresses); err != nil {
+		return nil, fmt.Errorf("failed to decode device IP addresses: %w", err)
+	}
+	if device.CreatedAt, err = parseTime(createdAt); err != nil {
+		return nil, fmt.Errorf("failed to parse device created_at: %w", err)
+	}
+	if device.UpdatedAt, err = parseTime(updatedAt); err != nil {
+		return nil, fmt.Errorf("failed to parse device updated_at: %w", err)
+	}
+	if lastSeen.Valid {
+		t, err := parseTime(lastSeen.String)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse device last_seen: %w", err)
+		}
+		device.LastSeen = &t
+	}
+	return &device, nil
+}
@@ -0,0 +1,91 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// DeviceCode is a pending device authorization: a device polls with the
+// device code while its user approves the user code from a signed-in session
+type DeviceCode struct {
+	DeviceCode string
+	UserCode   string
+	UserID     int64 // 0 until approved
+	ExpiresAt  time.Time
+}
+
+// CreateDeviceCode stores a new pending device authorization
+func (s *Store) CreateDeviceCode(deviceCode, userCode string, expiresAt time.Time) error {
+	_, err := s.db.ExecContext(s.ctx,
+		"INSERT INTO device_codes (device_code, user_code, created_at, expires_at) VALUES (?, ?, ?, ?)",
+		deviceCode, userCode, now(), formatTime(expiresAt),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create device code: %w", err)
+	}
+	return nil
+}
+
+// GetDeviceCode retrieves an unexpired device authorization by device code
+func (s *Store) GetDeviceCode(deviceCode string) (*DeviceCode, error) {
+	var code DeviceCode
+	var userID sql.NullInt64
+	var expiresAt string
+
+	err := s.db.QueryRowContext(s.ctx,
+		"SELECT device_code, user_code, user_id, expires_at FROM device_codes WHERE device_code = ? AND expires_at > ?",
+		deviceCode, now(),
+	).Scan(&code.DeviceCode, &code.UserCode, &userID, &expiresAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("device code not found")
+		}
+		return nil, fmt.Errorf("failed to get device code: %w", err)
+	}
+
+	code.UserID = userID.Int64
+	if code.ExpiresAt, err = parseTime(expiresAt); err != nil {
+		return nil, fmt.Errorf("failed to parse device code expires_at: %w", err)
+	}
+	return &code, nil
+}
+
+// ApproveDeviceCode grants a pending, unexpired device authorization to a user
+func (s *Store) ApproveDeviceCode(userCode string, userID int64) error {
+	result, err := s.db.ExecContext(s.ctx,
+		"UPDATE device_codes SET user_id = ? WHERE user_code = ? AND user_id IS NULL AND expires_at > ?",
+		userID, userCode, now(),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to approve device code: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("device code not found")
+	}
+
+	return nil
+}
+
+// DeleteDeviceCode removes a device authorization once its token is issued
+func (s *Store) DeleteDeviceCode(deviceCode string) error {
+	if _, err := s.db.ExecContext(s.ctx, "DELETE FROM device_codes WHERE device_code = ?", deviceCode); err != nil {
+		return fmt.Errorf("failed to delete device code: %w", err)
+	}
+	return nil
+}
+
+// CleanupExpiredDeviceCodes removes all expired device authorizations
+func (s *Store) CleanupExpiredDeviceCodes() error {
+	_, err := s.db.ExecContext(s.ctx, "DELETE FROM device_codes WHERE expires_at <= ?", now())
+	if err != nil {
+		return fmt.Errorf("failed to cleanup expired device codes: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// faultsFromEnv returns the store query delay for resilience testing from
+// FAULT_STORE_DELAY, seeded with FAULT_SEED or a random seed that is logged
+// so the run can be repeated. It returns nil if FAULT_STORE_DELAY is unset.
+func faultsFromEnv() (*queryDelay, error) {
+	v := os.Getenv("FAULT_STORE_DELAY")
+	if v == "" {
+		return nil, nil
+	}
+	max, err := time.ParseDuration(v)
+	if err != nil || max <= 0 {
+		return nil, fmt.Errorf("invalid FAULT_STORE_DELAY %q: must be a positive duration", v)
+	}
+
+	seed := time.Now().UnixNano()
+	if v := os.Getenv("FAULT_SEED"); v != "" {
+		if seed, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid FAULT_SEED %q: %w", v, err)
+		}
+	}
+	log.Printf("WARNING: Injecting faults, do not use in production: delaying store queries up to %s (FAULT_SEED=%d)", max, seed)
+	return &queryDelay{max: max, rand: rand.New(rand.NewSource(seed))}, nil
+}
+
+// queryDelay delays every statement by a random duration up to max
+type queryDelay struct {
+	max time.Duration
+
+	mu   sync.Mutex
+	rand *rand.Rand
+}
+
+// wait sleeps for the next delay or until ctx is done
+func (d *queryDelay) wait(ctx context.Context) error {
+	d.mu.Lock()
+	delay := time.Duration(d.rand.Int63n(int64(d.max) + 1))
+	d.mu.Unlock()
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// openDelayed opens the SQLite database at dbURL through a driver that
+// delays every statement with delay, and traces it like openTraced
+func openDelayed(dbURL string, delay *queryDelay) *sql.DB {
+	return sql.OpenDB(delayedConnector{Connector: tracedConnector{dbURL: dbURL}, delay: delay})
+}
+
+// delayedConnector wraps the connections another connector opens in
+// delayedConn
+type delayedConnector struct {
+	driver.Connector
+	delay *queryDelay
+}
+
+func (c delayedConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &delayedConn{Conn: conn, delay: c.delay}, nil
+}
+
+// delayedConn is a database connection that waits before running,
+// preparing, or beginning anything
+type delayedConn struct {
+	driver.Conn
+	delay *queryDelay
+}
+
+func (c *delayedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if err := c.delay.wait(ctx); err != nil {
+		return nil, err
+	}
+	return execContext(ctx, c.Conn, query, args)
+}
+
+func (c *delayedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if err := c.delay.wait(ctx); err != nil {
+		return nil, err
+	}
+	return queryContext(ctx, c.Conn, query, args)
+}
+
+func (c *delayedConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	if err := c.delay.wait(ctx); err != nil {
+		return nil, err
+	}
+	return prepareContext(ctx, c.Conn, query)
+}
+
+func (c *delayedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if err := c.delay.wait(ctx); err != nil {
+		return nil, err
+	}
+	return beginTx(ctx, c.Conn, opts)
+}
+
+func (c *delayedConn) Ping(ctx context.Context) error {
+	return ping(ctx, c.Conn)
+}
@@ -0,0 +1,125 @@
+package store
+
+import (
+	"fmt"
+	"time"
+)
+
+// InvitationTTL is how long an invitation to join a network waits for the
+// invited user to accept it before it is cleaned up
+const InvitationTTL = 30 * 24 * time.Hour
+
+// Invitation is a user invited to join a network, who becomes a member only
+// by accepting it
+type Invitation struct {
+	NetworkID   int64
+	NetworkName string
+	UserID      int64
+	// InvitedBy is the username of who invited the user
+	InvitedBy string
+	CreatedAt time.Time
+}
+
+// ListInvitations lists the invitations a user has not yet accepted or
+// declined, oldest first
+func (s *Store) ListInvitations(userID int64) ([]*Invitation, error) {
+	rows, err := s.db.QueryContext(s.ctx,
+		`SELECT i.network_id, n.name, i.user_id, u.username, i.created_at
+		 FROM invitations i
+		 INNER JOIN networks n ON n.id = i.network_id
+		 INNER JOIN users u ON u.id = i.invited_by
+		 WHERE i.user_id = ?
+		 ORDER BY i.created_at, i.network_id`,
+		userID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list invitations: %w", err)
+	}
+	defer rows.Close()
+
+	var invitations []*Invitation
+	for rows.Next() {
+		var inv Invitation
+		var createdAt string
+		if err := rows.Scan(&inv.NetworkID, &inv.NetworkName, &inv.UserID, &inv.InvitedBy, &createdAt); err != nil {
+			return nil, fmt.Errorf("failed to scan invitation: %w", err)
+		}
+		var err error
+		if inv.CreatedAt, err = parseTime(createdAt); err != nil {
+			return nil, fmt.Errorf("failed to parse invitation created_at: %w", err)
+		}
+		invitations = append(invitations, &inv)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating invitations: %w", err)
+	}
+
+	return invitations, nil
+}
+
+// IsUserInvited reports whether a user has a pending invitation to a network
+func (s *Store) IsUserInvited(userID, networkID int64) (bool, error) {
+	var count int
+	err := s.db.QueryRowContext(s.ctx,
+		"SELECT COUNT(*) FROM invitations WHERE user_id = ? AND network_id = ?",
+		userID, networkID,
+	).Scan(&count)
+	if err != nil {
+		return false, fmt.Errorf("failed to check invitation: %w", err)
+	}
+	return count > 0, nil
+}
+
+// AcceptInvitation makes the user of a pending invitation a member of the
+// network, settling any request they made to join it
+func (s *Store) AcceptInvitation(userID, networkID int64) error {
+	defer s.cache.memberships.delete(membershipKey{userID, networkID})
+
+	tx, err := s.db.BeginTx(s.ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(s.ctx, "DELETE FROM invitations WHERE network_id = ? AND user_id = ?", networkID, userID)
+	if err != nil {
+		return fmt.Errorf("failed to accept invitation: %w", err)
+	}
+	if err := expectOneRow(result, "invitation not found"); err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(s.ctx,
+		"INSERT INTO memberships (user_id, network_id, created_at, key_generation) VALUES (?, ?, ?, "+currentKeyGeneration+") ON CONFLICT (user_id, network_id) DO NOTHING",
+		userID, networkID, now(), networkID,
+	); err != nil {
+		return fmt.Errorf("failed to join network: %w", err)
+	}
+	if _, err := tx.ExecContext(s.ctx, "DELETE FROM join_requests WHERE network_id = ? AND user_id = ?", networkID, userID); err != nil {
+		return fmt.Errorf("failed to settle join request: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit invitation: %w", err)
+	}
+	return nil
+}
+
+// DeleteInvitation removes a pending invitation without accepting it
+func (s *Store) DeleteInvitation(userID, networkID int64) error {
+	result, err := s.db.ExecContext(s.ctx, "DELETE FROM invitations WHERE network_id = ? AND user_id = ?", networkID, userID)
+	if err != nil {
+		return fmt.Errorf("failed to delete invitation: %w", err)
+	}
+	return expectOneRow(result, "invitation not found")
+}
+
+// CleanupExpiredInvitations removes invitations older than InvitationTTL
+func (s *Store) CleanupExpiredInvitations() error {
+	cutoff := formatTime(time.Now().Add(-InvitationTTL))
+	if _, err := s.db.ExecContext(s.ctx, "DELETE FROM invitations WHERE created_at <= ?", cutoff); err != nil {
+		return fmt.Errorf("failed to cleanup expired invitations: %w", err)
+	}
+	return nil
+}
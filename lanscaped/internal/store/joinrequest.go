@@ -0,0 +1,118 @@
+package store
+
+import (
+	"fmt"
+	"time"
+)
+
+// JoinRequestTTL is how long a request to join a network waits for approval
+// before it is cleaned up
+const JoinRequestTTL = 30 * 24 * time.Hour
+
+// JoinRequest is a user waiting for approval to join a network
+type JoinRequest struct {
+	NetworkID int64
+	UserID    int64
+	Username  string
+	CreatedAt time.Time
+}
+
+// RequestToJoin records a user asking to join a network. Asking again keeps
+// the original request.
+func (s *Store) RequestToJoin(userID, networkID int64) error {
+	_, err := s.db.ExecContext(s.ctx,
+		`INSERT INTO join_requests (network_id, user_id, created_at) VALUES (?, ?, ?)
+		 ON CONFLICT (network_id, user_id) DO NOTHING`,
+		networkID, userID, now(),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to request to join network: %w", err)
+	}
+	return nil
+}
+
+// ListJoinRequests lists the requests to join a network, oldest first
+func (s *Store) ListJoinRequests(networkID int64) ([]*JoinRequest, error) {
+	rows, err := s.db.QueryContext(s.ctx,
+		`SELECT j.network_id, j.user_id, u.username, j.created_at
+		 FROM join_requests j
+		 INNER JOIN users u ON u.id = j.user_id
+		 WHERE j.network_id = ?
+		 ORDER BY j.created_at, j.user_id`,
+		networkID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list join requests: %w", err)
+	}
+	defer rows.Close()
+
+	var requests []*JoinRequest
+	for rows.Next() {
+		var req JoinRequest
+		var createdAt string
+		if err := rows.Scan(&req.NetworkID, &req.UserID, &req.Username, &createdAt); err != nil {
+			return nil, fmt.Errorf("failed to scan join request: %w", err)
+		}
+		var err error
+		if req.CreatedAt, err = parseTime(createdAt); err != nil {
+			return nil, fmt.Errorf("failed to parse join request created_at: %w", err)
+		}
+		requests = append(requests, &req)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating join requests: %w", err)
+	}
+
+	return requests, nil
+}
+
+// ApproveJoinRequest makes the user of a pending join request a member of
+// the network
+func (s *Store) ApproveJoinRequest(userID, networkID int64) error {
+	defer s.cache.memberships.delete(membershipKey{userID, networkID})
+
+	tx, err := s.db.BeginTx(s.ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(s.ctx, "DELETE FROM join_requests WHERE network_id = ? AND user_id = ?", networkID, userID)
+	if err != nil {
+		return fmt.Errorf("failed to approve join request: %w", err)
+	}
+	if err := expectOneRow(result, "join request not found"); err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(s.ctx,
+		"INSERT INTO memberships (user_id, network_id, created_at, key_generation) VALUES (?, ?, ?, "+currentKeyGeneration+") ON CONFLICT (user_id, network_id) DO NOTHING",
+		userID, networkID, now(), networkID,
+	); err != nil {
+		return fmt.Errorf("failed to join network: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit join request approval: %w", err)
+	}
+	return nil
+}
+
+// DeleteJoinRequest removes a pending join request without approving it
+func (s *Store) DeleteJoinRequest(userID, networkID int64) error {
+	result, err := s.db.ExecContext(s.ctx, "DELETE FROM join_requests WHERE network_id = ? AND user_id = ?", networkID, userID)
+	if err != nil {
+		return fmt.Errorf("failed to delete join request: %w", err)
+	}
+	return expectOneRow(result, "join request not found")
+}
+
+// CleanupExpiredJoinRequests removes join requests older than JoinRequestTTL
+func (s *Store) CleanupExpiredJoinRequests() error {
+	cutoff := formatTime(time.Now().Add(-JoinRequestTTL))
+	if _, err := s.db.ExecContext(s.ctx, "DELETE FROM join_requests WHERE created_at <= ?", cutoff); err != nil {
+		return fmt.Errorf("failed to cleanup expired join requests: %w", err)
+	}
+	return nil
+}
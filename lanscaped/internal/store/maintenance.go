@@ -0,0 +1,212 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// DefaultMaintenanceInterval is how often database maintenance runs by
+// default
+const DefaultMaintenanceInterval = 24 * time.Hour
+
+// maxIntegrityErrors bounds the problems PRAGMA integrity_check reports
+const maxIntegrityErrors = 100
+
+// ErrMaintenanceRunning means maintenance was requested while a run was
+// already in progress
+var ErrMaintenanceRunning = errors.New("database maintenance already running")
+
+// autoVacuumIncremental is PRAGMA auto_vacuum's value for incremental mode
+const autoVacuumIncremental = 2
+
+// DatabaseStats describes the size of the database file
+type DatabaseStats struct {
+	PageSize      int64 // bytes per page
+	PageCount     int64 // pages in the file
+	FreelistCount int64 // unused pages, reclaimable by vacuuming
+}
+
+// SizeBytes is the size of the database file
+func (d DatabaseStats) SizeBytes() int64 {
+	return d.PageSize * d.PageCount
+}
+
+// FreeBytes is the space held by unused pages
+func (d DatabaseStats) FreeBytes() int64 {
+	return d.PageSize * d.FreelistCount
+}
+
+// MaintenanceReport is the outcome of one maintenance run
+type MaintenanceReport struct {
+	StartedAt time.Time
+	Duration  time.Duration
+	// Integrity lists the problems PRAGMA integrity_check found, empty if
+	// the database is intact. A damaged database is not vacuumed.
+	Integrity []string
+	// Converted is set when the run switched the database to incremental
+	// auto-vacuum, which takes one full VACUUM
+	Converted bool
+	// FreedPages is how many unused pages were returned to the filesystem
+	FreedPages int64
+	Before     DatabaseStats
+	After      DatabaseStats
+}
+
+// Healthy reports whether the integrity check passed
+func (r *MaintenanceReport) Healthy() bool {
+	return len(r.Integrity) == 0
+}
+
+// maintenance serializes maintenance runs and keeps the latest report
+type maintenance struct {
+	running sync.Mutex
+	mu      sync.Mutex
+	last    *MaintenanceReport
+}
+
+// Maintain checks the database's integrity, returns its unused pages to the
+// filesystem, and records and logs its size before and after. Databases created
+// without incremental auto-vacuum are converted by a full VACUUM on their
+// first run, which locks the database while it rewrites the file. Returns
+// ErrMaintenanceRunning if another run is in progress.
+func (s *Store) Maintain(ctx context.Context) (*MaintenanceReport, error) {
+	if !s.maintenance.running.TryLock() {
+		return nil, ErrMaintenanceRunning
+	}
+	defer s.maintenance.running.Unlock()
+
+	report := &MaintenanceReport{StartedAt: time.Now()}
+	var err error
+	if report.Before, err = s.DatabaseStats(ctx); err != nil {
+		return nil, err
+	}
+
+	if report.Integrity, err = s.checkIntegrity(ctx); err != nil {
+		return nil, err
+	}
+	if report.Healthy() {
+		if report.Converted, err = s.enableIncrementalVacuum(ctx); err != nil {
+			return nil, err
+		}
+		if err := s.incrementalVacuum(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	if report.After, err = s.DatabaseStats(ctx); err != nil {
+		return nil, err
+	}
+	report.FreedPages = max(report.Before.PageCount-report.After.PageCount, 0)
+	report.Duration = time.Since(report.StartedAt)
+
+	if !report.Healthy() {
+		log.Printf("Database integrity check FAILED with %d problems, skipped vacuum: %v", len(report.Integrity), report.Integrity)
+	}
+	log.Printf("Database maintenance took %s: %d bytes in %d pages of %d bytes (%d free), %d pages freed",
+		report.Duration.Round(time.Millisecond), report.After.SizeBytes(), report.After.PageCount,
+		report.After.PageSize, report.After.FreelistCount, report.FreedPages)
+
+	s.maintenance.mu.Lock()
+	s.maintenance.last = report
+	s.maintenance.mu.Unlock()
+	return report, nil
+}
+
+// LastMaintenance returns the report of the latest maintenance run, or nil
+// if maintenance has not run since startup
+func (s *Store) LastMaintenance() *MaintenanceReport {
+	s.maintenance.mu.Lock()
+	defer s.maintenance.mu.Unlock()
+	return s.maintenance.last
+}
+
+// DatabaseStats returns the current size of the database file
+func (s *Store) DatabaseStats(ctx context.Context) (DatabaseStats, error) {
+	var stats DatabaseStats
+	for _, p := range []struct {
+		pragma string
+		dest   *int64
+	}{
+		{"page_size", &stats.PageSize},
+		{"page_count", &stats.PageCount},
+		{"freelist_count", &stats.FreelistCount},
+	} {
+		if err := s.db.QueryRowContext(ctx, "PRAGMA "+p.pragma).Scan(p.dest); err != nil {
+			return DatabaseStats{}, fmt.Errorf("failed to read %s: %w", p.pragma, err)
+		}
+	}
+	return stats, nil
+}
+
+// checkIntegrity runs PRAGMA integrity_check and returns the problems found
+func (s *Store) checkIntegrity(ctx context.Context) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx, fmt.Sprintf("PRAGMA integrity_check(%d)", maxIntegrityErrors))
+	if err != nil {
+		return nil, fmt.Errorf("failed to check integrity: %w", err)
+	}
+	defer rows.Close()
+
+	var problems []string
+	for rows.Next() {
+		var result string
+		if err := rows.Scan(&result); err != nil {
+			return nil, fmt.Errorf("failed to scan integrity check: %w", err)
+		}
+		if result != "ok" {
+			problems = append(problems, result)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to check integrity: %w", err)
+	}
+	return problems, nil
+}
+
+// enableIncrementalVacuum switches the database to incremental auto-vacuum
+// if it is not already, and reports whether it did. The mode only changes
+// when the file is rewritten, so this runs a full VACUUM.
+func (s *Store) enableIncrementalVacuum(ctx context.Context) (bool, error) {
+	var mode int
+	if err := s.db.QueryRowContext(ctx, "PRAGMA auto_vacuum").Scan(&mode); err != nil {
+		return false, fmt.Errorf("failed to read auto_vacuum: %w", err)
+	}
+	if mode == autoVacuumIncremental {
+		return false, nil
+	}
+
+	log.Printf("Converting database to incremental auto-vacuum (auto_vacuum was %d), running a full VACUUM", mode)
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return false, fmt.Errorf("failed to get connection: %w", err)
+	}
+	defer conn.Close()
+	// The pragma and VACUUM must run on the same connection
+	if _, err := conn.ExecContext(ctx, "PRAGMA auto_vacuum = INCREMENTAL"); err != nil {
+		return false, fmt.Errorf("failed to set auto_vacuum: %w", err)
+	}
+	if _, err := conn.ExecContext(ctx, "VACUUM"); err != nil {
+		return false, fmt.Errorf("failed to vacuum: %w", err)
+	}
+	return true, nil
+}
+
+// incrementalVacuum returns every unused page to the filesystem
+func (s *Store) incrementalVacuum(ctx context.Context) error {
+	// Each step of the statement frees one page, so it must be read to the
+	// end rather than executed
+	rows, err := s.db.QueryContext(ctx, "PRAGMA incremental_vacuum")
+	if err != nil {
+		return fmt.Errorf("failed to vacuum: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to vacuum: %w", err)
+	}
+	return nil
+}
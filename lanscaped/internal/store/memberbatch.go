@@ -0,0 +1,154 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// MemberBatchResult is what a membership batch did for one username
+type MemberBatchResult struct {
+	Username string
+	// User is the account, nil if the username has none
+	User *User
+	// Member is set when inviting a user who already is a member
+	Member bool
+	// Changed is set if the user was invited to, or removed from, the
+	// network, and unset if they already were, or were neither a member nor
+	// invited
+	Changed bool
+}
+
+// InviteMembers invites the users named in usernames to a network in one
+// transaction, on behalf of invitedBy. Invited users become members only
+// once they accept (see AcceptInvitation). Usernames without an account,
+// and users already members, are reported and left alone.
+func (s *Store) InviteMembers(networkID, invitedBy int64, usernames []string) ([]MemberBatchResult, error) {
+	tx, err := s.db.BeginTx(s.ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	results := make([]MemberBatchResult, 0, len(usernames))
+	for _, username := range usernames {
+		result := MemberBatchResult{Username: username}
+		if result.User, err = s.txUserByUsername(tx, username); err != nil {
+			return nil, err
+		}
+		if result.User == nil {
+			results = append(results, result)
+			continue
+		}
+
+		var count int
+		if err := tx.QueryRowContext(s.ctx,
+			"SELECT COUNT(*) FROM memberships WHERE user_id = ? AND network_id = ?",
+			result.User.ID, networkID,
+		).Scan(&count); err != nil {
+			return nil, fmt.Errorf("failed to check membership of %s: %w", username, err)
+		}
+		if result.Member = count > 0; result.Member {
+			results = append(results, result)
+			continue
+		}
+
+		invited, err := tx.ExecContext(s.ctx,
+			"INSERT INTO invitations (network_id, user_id, invited_by, created_at) VALUES (?, ?, ?, ?) ON CONFLICT (network_id, user_id) DO NOTHING",
+			networkID, result.User.ID, invitedBy, now(),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to invite %s: %w", username, err)
+		}
+		if result.Changed, err = affectedAny(invited); err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit invitations: %w", err)
+	}
+	return results, nil
+}
+
+// RemoveMembers removes the users named in usernames from a network in one
+// transaction, forgetting their devices in it and withdrawing invitations to
+// it. Changed is set only for users who were members.
+func (s *Store) RemoveMembers(networkID int64, usernames []string) ([]MemberBatchResult, error) {
+	defer s.invalidateMemberships(networkID)
+
+	tx, err := s.db.BeginTx(s.ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	results := make([]MemberBatchResult, 0, len(usernames))
+	for _, username := range usernames {
+		result := MemberBatchResult{Username: username}
+		if result.User, err = s.txUserByUsername(tx, username); err != nil {
+			return nil, err
+		}
+		if result.User == nil {
+			results = append(results, result)
+			continue
+		}
+
+		left, err := tx.ExecContext(s.ctx, "DELETE FROM memberships WHERE user_id = ? AND network_id = ?", result.User.ID, networkID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to remove member %s: %w", username, err)
+		}
+		if result.Changed, err = affectedAny(left); err != nil {
+			return nil, err
+		}
+		if _, err := tx.ExecContext(s.ctx, "DELETE FROM devices WHERE user_id = ? AND network_id = ?", result.User.ID, networkID); err != nil {
+			return nil, fmt.Errorf("failed to delete devices of %s: %w", username, err)
+		}
+		if _, err := tx.ExecContext(s.ctx, "DELETE FROM invitations WHERE network_id = ? AND user_id = ?", networkID, result.User.ID); err != nil {
+			return nil, fmt.Errorf("failed to withdraw invitation of %s: %w", username, err)
+		}
+		results = append(results, result)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit removals: %w", err)
+	}
+	return results, nil
+}
+
+// invalidateMemberships drops every cached membership in a network
+func (s *Store) invalidateMemberships(networkID int64) {
+	s.cache.memberships.deleteFunc(func(k membershipKey) bool { return k.NetworkID == networkID })
+}
+
+// txUserByUsername reads a user by username within tx, returning nil if
+// there is none
+func (s *Store) txUserByUsername(tx *sql.Tx, username string) (*User, error) {
+	var user User
+	var createdAt string
+
+	err := tx.QueryRowContext(s.ctx,
+		"SELECT id, username, created_at, claim_code IS NOT NULL FROM users WHERE username = ?",
+		username,
+	).Scan(&user.ID, &user.Username, &createdAt, &user.PendingClaim)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user: %w", err)
+	}
+
+	if user.CreatedAt, err = parseTime(createdAt); err != nil {
+		return nil, fmt.Errorf("failed to parse user created_at: %w", err)
+	}
+	return &user, nil
+}
+
+// affectedAny reports whether a statement changed any rows
+func affectedAny(result sql.Result) (bool, error) {
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to get rows affected: %w", err)
+	}
+	return rowsAffected > 0, nil
+}
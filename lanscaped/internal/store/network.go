@@ -2,18 +2,115 @@ package store
 
 import (
 	"database/sql"
+	"encoding/json"
 	"fmt"
+	"maps"
 	"strings"
 	"time"
+	"unicode/utf8"
 )
 
+// Visibility is who can find a network, and how they can join it
+type Visibility string
+
+const (
+	// VisibilityPublic networks are listed in the directory, for anyone to
+	// find and join
+	VisibilityPublic Visibility = "public"
+	// VisibilityUnlisted networks are left out of the directory, but anyone
+	// who knows one can join it
+	VisibilityUnlisted Visibility = "unlisted"
+	// VisibilityPrivate networks are hidden from everyone but their members,
+	// and joining one takes a request that a member approves
+	VisibilityPrivate Visibility = "private"
+)
+
+// MaxDescriptionLength bounds a network's description, in characters
+const MaxDescriptionLength = 500
+
+// Limits on a network's metadata labels
+const (
+	MaxMetadataLabels      = 32
+	MaxMetadataKeyLength   = 63  // bytes
+	MaxMetadataValueLength = 256 // characters
+)
+
+// maxSearchTerms bounds the words of a directory search
+const maxSearchTerms = 8
+
 // Network represents a network in the database
 type Network struct {
 	ID                int64
 	Name              string
 	HeadscaleEndpoint string
 	APIKey            string
-	CreatedAt         time.Time
+	Listing
+	// Avatar is the blob key of the network's avatar image, empty if it
+	// has none
+	Avatar    string
+	CreatedAt time.Time
+	// UpdatedAt is when the network was created or last changed
+	UpdatedAt time.Time
+}
+
+// Listing is how a network presents itself to users
+type Listing struct {
+	Description string
+	Visibility  Visibility
+	// Metadata are free-form labels, such as a game or a region
+	Metadata map[string]string
+}
+
+// networkColumns are the columns scanNetwork reads, in order
+const networkColumns = "id, name, headscale_endpoint, api_key, description, visibility, metadata, avatar, created_at, updated_at"
+
+// Validate checks a network's description, visibility, and metadata
+func (l Listing) Validate() error {
+	if utf8.RuneCountInString(l.Description) > MaxDescriptionLength {
+		return fmt.Errorf("description must be at most %d characters", MaxDescriptionLength)
+	}
+	switch l.Visibility {
+	case VisibilityPublic, VisibilityUnlisted, VisibilityPrivate:
+	default:
+		return fmt.Errorf("visibility must be %s, %s, or %s", VisibilityPublic, VisibilityUnlisted, VisibilityPrivate)
+	}
+	return validateMetadata(l.Metadata)
+}
+
+// validateMetadata checks metadata labels. Keys are lowercase letters,
+// digits, '-', '_', and '.', starting with a letter or digit, like DNS
+// labels, so they are safe to show and to filter on.
+func validateMetadata(metadata map[string]string) error {
+	if len(metadata) > MaxMetadataLabels {
+		return fmt.Errorf("metadata may have at most %d labels", MaxMetadataLabels)
+	}
+	for key, value := range metadata {
+		if key == "" || len(key) > MaxMetadataKeyLength {
+			return fmt.Errorf("metadata keys must be 1 to %d characters", MaxMetadataKeyLength)
+		}
+		for i, c := range key {
+			alnum := c >= 'a' && c <= 'z' || c >= '0' && c <= '9'
+			if !alnum && (i == 0 || c != '-' && c != '_' && c != '.') {
+				return fmt.Errorf("metadata key %q must be lowercase letters, digits, '-', '_', and '.', starting with a letter or digit", key)
+			}
+		}
+		if !utf8.ValidString(value) || utf8.RuneCountInString(value) > MaxMetadataValueLength {
+			return fmt.Errorf("metadata value of %q must be at most %d characters", key, MaxMetadataValueLength)
+		}
+	}
+	return nil
+}
+
+// encodeMetadata encodes metadata for the metadata column
+func encodeMetadata(metadata map[string]string) (string, error) {
+	if metadata == nil {
+		metadata = map[string]string{}
+	}
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode metadata: %w", err)
+	}
+	return string(data), nil
 }
 
 // Membership represents a user-network membership
@@ -25,10 +122,19 @@ type Membership struct {
 }
 
 // CreateNetwork creates a new network
-func (s *Store) CreateNetwork(name, headscaleEndpoint, apiKey string) (*Network, error) {
-	result, err := s.db.Exec(
-		"INSERT INTO networks (name, headscale_endpoint, api_key) VALUES (?, ?, ?)",
-		name, headscaleEndpoint, apiKey,
+func (s *Store) CreateNetwork(name, headscaleEndpoint, apiKey string, listing Listing) (*Network, error) {
+	if err := listing.Validate(); err != nil {
+		return nil, err
+	}
+	metadata, err := encodeMetadata(listing.Metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	createdAt := now()
+	result, err := s.db.ExecContext(s.ctx,
+		"INSERT INTO networks (name, headscale_endpoint, api_key, description, visibility, metadata, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		name, headscaleEndpoint, apiKey, listing.Description, string(listing.Visibility), metadata, createdAt, createdAt,
 	)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create network: %w", err)
@@ -44,77 +150,141 @@ func (s *Store) CreateNetwork(name, headscaleEndpoint, apiKey string) (*Network,
 
 // GetNetworkByID retrieves a network by ID
 func (s *Store) GetNetworkByID(id int64) (*Network, error) {
-	var network Network
-	var createdAt string
-
-	err := s.db.QueryRow(
-		"SELECT id, name, headscale_endpoint, api_key, created_at FROM networks WHERE id = ?",
-		id,
-	).Scan(&network.ID, &network.Name, &network.HeadscaleEndpoint, &network.APIKey, &createdAt)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil, fmt.Errorf("network not found")
+	network, err := cached(s.cache, s.cache.networks, id, func() (Network, error) {
+		network, err := s.queryNetworkByID(id)
+		if err != nil {
+			return Network{}, err
 		}
-		return nil, fmt.Errorf("failed to get network: %w", err)
+		return *network, nil
+	})
+	if err != nil {
+		return nil, err
 	}
-
-	network.CreatedAt, _ = time.Parse("2006-01-02 15:04:05", createdAt)
+	// The cached copy must not change with the caller's
+	network.Metadata = maps.Clone(network.Metadata)
 	return &network, nil
 }
 
+// queryNetworkByID reads a network by ID from the database
+func (s *Store) queryNetworkByID(id int64) (*Network, error) {
+	return scanNetwork(s.db.QueryRowContext(s.ctx, "SELECT "+networkColumns+" FROM networks WHERE id = ?", id))
+}
+
 // GetNetworkByName retrieves a network by name
 func (s *Store) GetNetworkByName(name string) (*Network, error) {
-	var network Network
-	var createdAt string
+	return scanNetwork(s.db.QueryRowContext(s.ctx, "SELECT "+networkColumns+" FROM networks WHERE name = ?", name))
+}
 
-	err := s.db.QueryRow(
-		"SELECT id, name, headscale_endpoint, api_key, created_at FROM networks WHERE name = ?",
-		name,
-	).Scan(&network.ID, &network.Name, &network.HeadscaleEndpoint, &network.APIKey, &createdAt)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil, fmt.Errorf("network not found")
-		}
-		return nil, fmt.Errorf("failed to get network: %w", err)
+// ListNetworks lists all networks
+func (s *Store) ListNetworks() ([]*Network, error) {
+	return s.queryNetworks("SELECT " + networkColumns + " FROM networks ORDER BY created_at DESC")
+}
+
+// ListNetworksVisibleTo lists the networks a user can see: every network
+// that is not private, and the private ones they are a member of
+func (s *Store) ListNetworksVisibleTo(userID int64) ([]*Network, error) {
+	return s.queryNetworks(
+		`SELECT `+networkColumns+` FROM networks
+		 WHERE visibility != ? OR id IN (SELECT network_id FROM memberships WHERE user_id = ?)
+		 ORDER BY created_at DESC`,
+		string(VisibilityPrivate), userID,
+	)
+}
+
+// SearchNetworks lists up to limit public networks whose name or
+// description contains every word of query, ignoring case. An empty query
+// lists every public network.
+func (s *Store) SearchNetworks(query string, limit int) ([]*Network, error) {
+	conditions := []string{"visibility = ?"}
+	args := []any{string(VisibilityPublic)}
+
+	terms := strings.Fields(strings.ToLower(query))
+	if len(terms) > maxSearchTerms {
+		terms = terms[:maxSearchTerms]
+	}
+	for _, term := range terms {
+		pattern := "%" + likeEscaper.Replace(term) + "%"
+		conditions = append(conditions, `(LOWER(name) LIKE ? ESCAPE '\' OR LOWER(description) LIKE ? ESCAPE '\')`)
+		args = append(args, pattern, pattern)
 	}
+	args = append(args, limit)
 
-	network.CreatedAt, _ = time.Parse("2006-01-02 15:04:05", createdAt)
-	return &network, nil
+	return s.queryNetworks(
+		"SELECT "+networkColumns+" FROM networks WHERE "+strings.Join(conditions, " AND ")+" ORDER BY name LIMIT ?",
+		args...,
+	)
 }
 
-// ListNetworks lists all networks
-func (s *Store) ListNetworks() ([]*Network, error) {
-	rows, err := s.db.Query(
-		"SELECT id, name, headscale_endpoint, api_key, created_at FROM networks ORDER BY created_at DESC",
+// likeEscaper escapes the wildcards of a LIKE pattern
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// UpdateNetworkListing changes a network's description, visibility, and
+// metadata
+func (s *Store) UpdateNetworkListing(id int64, listing Listing) error {
+	if err := listing.Validate(); err != nil {
+		return err
+	}
+	metadata, err := encodeMetadata(listing.Metadata)
+	if err != nil {
+		return err
+	}
+	defer s.cache.networks.delete(id)
+
+	result, err := s.db.ExecContext(s.ctx,
+		"UPDATE networks SET description = ?, visibility = ?, metadata = ?, updated_at = ? WHERE id = ?",
+		listing.Description, string(listing.Visibility), metadata, now(), id,
 	)
 	if err != nil {
-		return nil, fmt.Errorf("failed to list networks: %w", err)
+		return fmt.Errorf("failed to update network: %w", err)
 	}
-	defer rows.Close()
 
-	var networks []*Network
-	for rows.Next() {
-		var network Network
-		var createdAt string
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
 
-		if err := rows.Scan(&network.ID, &network.Name, &network.HeadscaleEndpoint, &network.APIKey, &createdAt); err != nil {
-			return nil, fmt.Errorf("failed to scan network: %w", err)
-		}
+	if rowsAffected == 0 {
+		return fmt.Errorf("network not found")
+	}
+
+	return nil
+}
+
+// SetNetworkAvatar changes the blob key of a network's avatar, empty to
+// remove it, and returns the key it replaced so the caller can delete that
+// blob
+func (s *Store) SetNetworkAvatar(id int64, avatar string) (string, error) {
+	defer s.cache.networks.delete(id)
 
-		network.CreatedAt, _ = time.Parse("2006-01-02 15:04:05", createdAt)
-		networks = append(networks, &network)
+	tx, err := s.db.BeginTx(s.ctx, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to begin transaction: %w", err)
 	}
+	defer tx.Rollback()
 
-	if err := rows.Err(); err != nil {
-		return nil, fmt.Errorf("error iterating networks: %w", err)
+	var previous string
+	err = tx.QueryRowContext(s.ctx, "SELECT avatar FROM networks WHERE id = ?", id).Scan(&previous)
+	if err == sql.ErrNoRows {
+		return "", fmt.Errorf("network not found")
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to get network avatar: %w", err)
 	}
 
-	return networks, nil
+	if _, err := tx.ExecContext(s.ctx, "UPDATE networks SET avatar = ?, updated_at = ? WHERE id = ?", avatar, now(), id); err != nil {
+		return "", fmt.Errorf("failed to update network avatar: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return "", fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return previous, nil
 }
 
 // DeleteNetwork deletes a network (cascades to memberships)
 func (s *Store) DeleteNetwork(id int64) error {
-	result, err := s.db.Exec("DELETE FROM networks WHERE id = ?", id)
+	defer s.cache.invalidateNetwork(id)
+
+	result, err := s.db.ExecContext(s.ctx, "DELETE FROM networks WHERE id = ?", id)
 	if err != nil {
 		return fmt.Errorf("failed to delete network: %w", err)
 	}
@@ -133,9 +303,11 @@ func (s *Store) DeleteNetwork(id int64) error {
 
 // JoinNetwork creates a membership record for a user joining a network
 func (s *Store) JoinNetwork(userID, networkID int64) error {
-	_, err := s.db.Exec(
-		"INSERT INTO memberships (user_id, network_id) VALUES (?, ?)",
-		userID, networkID,
+	defer s.cache.memberships.delete(membershipKey{userID, networkID})
+
+	_, err := s.db.ExecContext(s.ctx,
+		"INSERT INTO memberships (user_id, network_id, created_at, key_generation) VALUES (?, ?, ?, "+currentKeyGeneration+")",
+		userID, networkID, now(), networkID,
 	)
 	if err != nil {
 		// Check if it's a unique constraint violation (user already in network)
@@ -149,32 +321,105 @@ func (s *Store) JoinNetwork(userID, networkID int64) error {
 	return nil
 }
 
+// LeaveNetwork removes a user's membership record from a network
+func (s *Store) LeaveNetwork(userID, networkID int64) error {
+	defer s.cache.memberships.delete(membershipKey{userID, networkID})
+
+	result, err := s.db.ExecContext(s.ctx,
+		"DELETE FROM memberships WHERE user_id = ? AND network_id = ?",
+		userID, networkID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to leave network: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("user is not a member of this network")
+	}
+
+	return nil
+}
+
 // GetUserNetworks retrieves all networks a user is a member of
 func (s *Store) GetUserNetworks(userID int64) ([]*Network, error) {
-	rows, err := s.db.Query(
-		`SELECT n.id, n.name, n.headscale_endpoint, n.api_key, n.created_at 
-		 FROM networks n
-		 INNER JOIN memberships m ON n.id = m.network_id
-		 WHERE m.user_id = ?
-		 ORDER BY n.created_at DESC`,
+	networks, err := s.queryNetworks(
+		`SELECT `+networkColumns+` FROM networks
+		 WHERE id IN (SELECT network_id FROM memberships WHERE user_id = ?)
+		 ORDER BY created_at DESC`,
 		userID,
 	)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get user networks: %w", err)
 	}
+	return networks, nil
+}
+
+// IsUserInNetwork checks if a user is a member of a network
+func (s *Store) IsUserInNetwork(userID, networkID int64) (bool, error) {
+	return cached(s.cache, s.cache.memberships, membershipKey{userID, networkID}, func() (bool, error) {
+		return s.queryUserInNetwork(userID, networkID)
+	})
+}
+
+// queryUserInNetwork reads whether a user is a member of a network from the
+// database
+func (s *Store) queryUserInNetwork(userID, networkID int64) (bool, error) {
+	var count int
+	err := s.db.QueryRowContext(s.ctx,
+		"SELECT COUNT(*) FROM memberships WHERE user_id = ? AND network_id = ?",
+		userID, networkID,
+	).Scan(&count)
+	if err != nil {
+		return false, fmt.Errorf("failed to check membership: %w", err)
+	}
+
+	return count > 0, nil
+}
+
+// CountNetworkMembers counts the members of every network with any
+func (s *Store) CountNetworkMembers() (map[int64]int64, error) {
+	rows, err := s.db.QueryContext(s.ctx, "SELECT network_id, COUNT(*) FROM memberships GROUP BY network_id")
+	if err != nil {
+		return nil, fmt.Errorf("failed to count network members: %w", err)
+	}
 	defer rows.Close()
 
-	var networks []*Network
+	counts := make(map[int64]int64)
 	for rows.Next() {
-		var network Network
-		var createdAt string
-
-		if err := rows.Scan(&network.ID, &network.Name, &network.HeadscaleEndpoint, &network.APIKey, &createdAt); err != nil {
-			return nil, fmt.Errorf("failed to scan network: %w", err)
+		var networkID, n int64
+		if err := rows.Scan(&networkID, &n); err != nil {
+			return nil, fmt.Errorf("failed to scan network members: %w", err)
 		}
+		counts[networkID] = n
+	}
 
-		network.CreatedAt, _ = time.Parse("2006-01-02 15:04:05", createdAt)
-		networks = append(networks, &network)
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating network members: %w", err)
+	}
+
+	return counts, nil
+}
+
+// queryNetworks runs a query selecting networkColumns and scans every row
+func (s *Store) queryNetworks(query string, args ...any) ([]*Network, error) {
+	rows, err := s.db.QueryContext(s.ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list networks: %w", err)
+	}
+	defer rows.Close()
+
+	var networks []*Network
+	for rows.Next() {
+		network, err := scanNetwork(rows)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
 	}
 
 	if err := rows.Err(); err != nil {
@@ -184,16 +429,30 @@ func (s *Store) GetUserNetworks(userID int64) ([]*Network, error) {
 	return networks, nil
 }
 
-// IsUserInNetwork checks if a user is a member of a network
-func (s *Store) IsUserInNetwork(userID, networkID int64) (bool, error) {
-	var count int
-	err := s.db.QueryRow(
-		"SELECT COUNT(*) FROM memberships WHERE user_id = ? AND network_id = ?",
-		userID, networkID,
-	).Scan(&count)
+// scanNetwork scans one row of networkColumns
+func scanNetwork(row interface{ Scan(...any) error }) (*Network, error) {
+	var network Network
+	var apiKey sql.NullString
+	var visibility, metadata, createdAt, updatedAt string
+
+	err := row.Scan(&network.ID, &network.Name, &network.HeadscaleEndpoint, &apiKey, &network.Description, &visibility, &metadata, &network.Avatar, &createdAt, &updatedAt)
 	if err != nil {
-		return false, fmt.Errorf("failed to check membership: %w", err)
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("network not found")
+		}
+		return nil, fmt.Errorf("failed to get network: %w", err)
 	}
 
-	return count > 0, nil
+	network.APIKey = apiKey.String
+	network.Visibility = Visibility(visibility)
+	if err := json.Unmarshal([]byte(metadata), &network.Metadata); err != nil {
+		return nil, fmt.Errorf("failed to parse network metadata: %w", err)
+	}
+	if network.CreatedAt, err = parseTime(createdAt); err != nil {
+		return nil, fmt.Errorf("failed to parse network created_at: %w", err)
+	}
+	if network.UpdatedAt, err = parseTime(updatedAt); err != nil {
+		return nil, fmt.Errorf("failed to parse network updated_at: %w", err)
+	}
+	return &network, nil
 }
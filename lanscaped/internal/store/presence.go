@@ -0,0 +1,266 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// PresenceKey is an agent identity key in a signaling topic
+type PresenceKey struct {
+	Topic     string
+	PublicKey string
+}
+
+// PresenceChange is an agent coming online or going offline in a topic
+type PresenceChange struct {
+	PresenceKey
+	Online bool
+	At     time.Time
+}
+
+// PresenceReport is a batch of presence changes from a signaling server
+type PresenceReport struct {
+	Changes []PresenceChange
+	// Snapshot marks Online as every key online as of At; all other keys
+	// are marked offline once Changes are applied
+	Snapshot bool
+	Online   []PresenceKey
+	At       time.Time
+}
+
+// AgentPresence is where an agent is online and when it was last seen
+type AgentPresence struct {
+	Topics   []string  // topics the agent is online in
+	LastSeen time.Time // latest time it came online or went offline
+}
+
+// Member is a network member and whether any of their agents is online in
+// the network's topic
+type Member struct {
+	UserID   int64
+	Username string
+	JoinedAt time.Time
+	Online   bool
+	LastSeen *time.Time // nil if no agent of the member was ever seen
+}
+
+// RecordPresence applies a presence report. Keys of agents that are not
+// enrolled are ignored, and only actual transitions are recorded.
+func (s *Store) RecordPresence(report PresenceReport) error {
+	tx, err := s.db.BeginTx(s.ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, c := range report.Changes {
+		if err := setPresence(s.ctx, tx, c.PresenceKey, c.Online, c.At); err != nil {
+			return err
+		}
+	}
+
+	if report.Snapshot {
+		online := make(map[PresenceKey]bool, len(report.Online))
+		for _, k := range report.Online {
+			online[k] = true
+		}
+
+		rows, err := tx.QueryContext(s.ctx, "SELECT topic, public_key FROM presence WHERE online = 1")
+		if err != nil {
+			return fmt.Errorf("failed to list online agents: %w", err)
+		}
+		var stale []PresenceKey
+		for rows.Next() {
+			var k PresenceKey
+			if err := rows.Scan(&k.Topic, &k.PublicKey); err != nil {
+				rows.Close()
+				return fmt.Errorf("failed to scan presence: %w", err)
+			}
+			if !online[k] {
+				stale = append(stale, k)
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("error iterating presence: %w", err)
+		}
+
+		for _, k := range stale {
+			if err := setPresence(s.ctx, tx, k, false, report.At); err != nil {
+				return err
+			}
+		}
+		for k := range online {
+			if err := setPresence(s.ctx, tx, k, true, report.At); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit presence: %w", err)
+	}
+	return nil
+}
+
+// setPresence records a key's state in a topic if it changed
+func setPresence(ctx context.Context, tx *sql.Tx, k PresenceKey, online bool, at time.Time) error {
+	var current bool
+	err := tx.QueryRowContext(ctx, "SELECT online FROM presence WHERE public_key = ? AND topic = ?", k.PublicKey, k.Topic).Scan(&current)
+	switch {
+	case err == sql.ErrNoRows:
+		if !online {
+			return nil
+		}
+		var enrolled int
+		if err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM agents WHERE public_key = ?", k.PublicKey).Scan(&enrolled); err != nil {
+			return fmt.Errorf("failed to look up agent: %w", err)
+		}
+		if enrolled == 0 {
+			return nil
+		}
+	case err != nil:
+		return fmt.Errorf("failed to get presence: %w", err)
+	case current == online:
+		return nil
+	}
+
+	ts := formatTime(at)
+	if _, err := tx.ExecContext(ctx,
+		`INSERT INTO presence (public_key, topic, online, changed_at) VALUES (?, ?, ?, ?)
+		 ON CONFLICT (public_key, topic) DO UPDATE SET online = excluded.online, changed_at = excluded.changed_at`,
+		k.PublicKey, k.Topic, online, ts,
+	); err != nil {
+		return fmt.Errorf("failed to record presence: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx,
+		"INSERT INTO presence_events (public_key, topic, online, at) VALUES (?, ?, ?, ?)",
+		k.PublicKey, k.Topic, online, ts,
+	); err != nil {
+		return fmt.Errorf("failed to record presence event: %w", err)
+	}
+	return nil
+}
+
+// GetAgentPresence returns the presence of a user's agents, keyed by
+// identity key. Agents never seen online are missing.
+func (s *Store) GetAgentPresence(userID int64) (map[string]*AgentPresence, error) {
+	rows, err := s.db.QueryContext(s.ctx,
+		`SELECT p.public_key, p.topic, p.online, p.changed_at
+		 FROM presence p
+		 INNER JOIN agents a ON a.public_key = p.public_key
+		 WHERE a.user_id = ?
+		 ORDER BY p.topic`,
+		userID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get agent presence: %w", err)
+	}
+	defer rows.Close()
+
+	presence := make(map[string]*AgentPresence)
+	for rows.Next() {
+		var key, topic, changedAt string
+		var online bool
+		if err := rows.Scan(&key, &topic, &online, &changedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan presence: %w", err)
+		}
+		p, ok := presence[key]
+		if !ok {
+			p = &AgentPresence{Topics: []string{}}
+			presence[key] = p
+		}
+		if online {
+			p.Topics = append(p.Topics, topic)
+		}
+		t, err := parseTime(changedAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse presence changed_at: %w", err)
+		}
+		if t.After(p.LastSeen) {
+			p.LastSeen = t
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating presence: %w", err)
+	}
+
+	return presence, nil
+}
+
+// ListNetworkMembers lists a network's members with their presence in topic,
+// the network's signaling topic
+func (s *Store) ListNetworkMembers(networkID int64, topic string) ([]*Member, error) {
+	rows, err := s.db.QueryContext(s.ctx,
+		`SELECT u.id, u.username, m.created_at,
+		        COALESCE(MAX(p.online), 0), MAX(p.changed_at)
+		 FROM memberships m
+		 INNER JOIN users u ON u.id = m.user_id
+		 LEFT JOIN agents a ON a.user_id = u.id
+		 LEFT JOIN presence p ON p.public_key = a.public_key AND p.topic = ?
+		 WHERE m.network_id = ?
+		 GROUP BY u.id, u.username, m.created_at
+		 ORDER BY u.username`,
+		topic, networkID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list members: %w", err)
+	}
+	defer rows.Close()
+
+	var members []*Member
+	for rows.Next() {
+		var member Member
+		var joinedAt string
+		var lastSeen sql.NullString
+		if err := rows.Scan(&member.UserID, &member.Username, &joinedAt, &member.Online, &lastSeen); err != nil {
+			return nil, fmt.Errorf("failed to scan member: %w", err)
+		}
+		var err error
+		if member.JoinedAt, err = parseTime(joinedAt); err != nil {
+			return nil, fmt.Errorf("failed to parse member joined_at: %w", err)
+		}
+		if lastSeen.Valid {
+			t, err := parseTime(lastSeen.String)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse member last seen: %w", err)
+			}
+			member.LastSeen = &t
+		}
+		members = append(members, &member)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating members: %w", err)
+	}
+
+	return members, nil
+}
+
+// CountOnlineAgents counts the enrolled agents online in each topic
+func (s *Store) CountOnlineAgents() (map[string]int64, error) {
+	rows, err := s.db.QueryContext(s.ctx, "SELECT topic, COUNT(*) FROM presence WHERE online = 1 GROUP BY topic")
+	if err != nil {
+		return nil, fmt.Errorf("failed to count online agents: %w", err)
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int64)
+	for rows.Next() {
+		var topic string
+		var n int64
+		if err := rows.Scan(&topic, &n); err != nil {
+			return nil, fmt.Errorf("failed to scan online agents: %w", err)
+		}
+		counts[topic] = n
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating online agents: %w", err)
+	}
+
+	return counts, nil
+}
@@ -1,10 +1,14 @@
 package store
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
 	"log"
+	"os"
+	"strconv"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-webauthn/webauthn/webauthn"
@@ -19,7 +23,64 @@ type Session struct {
 	ExpiresAt time.Time
 }
 
-// CreateSession creates a new session
+// Default limits on the WebAuthn session table
+const (
+	DefaultSessionsPerUser = 5
+	DefaultMaxSessions     = 10000
+)
+
+// SessionStats describes the WebAuthn session table and what was evicted
+// from it since startup
+type SessionStats struct {
+	Count        int64
+	PerUserLimit int
+	Limit        int
+	Created      uint64
+	// EvictedPerUser counts sessions evicted because their username had
+	// more than PerUserLimit, EvictedOverflow those evicted because the
+	// table had more than Limit
+	EvictedPerUser  uint64
+	EvictedOverflow uint64
+	Expired         uint64
+}
+
+// sessionLimits bounds the WebAuthn session table, which anyone can grow by
+// beginning registrations, and counts what it evicts
+type sessionLimits struct {
+	perUser int
+	max     int
+
+	created         atomic.Uint64
+	evictedPerUser  atomic.Uint64
+	evictedOverflow atomic.Uint64
+	expired         atomic.Uint64
+}
+
+// sessionLimitsFromEnv reads WEBAUTHN_SESSIONS_PER_USER and
+// WEBAUTHN_SESSIONS_MAX, falling back to the defaults if unset
+func sessionLimitsFromEnv() (*sessionLimits, error) {
+	limits := &sessionLimits{perUser: DefaultSessionsPerUser, max: DefaultMaxSessions}
+	for name, limit := range map[string]*int{
+		"WEBAUTHN_SESSIONS_PER_USER": &limits.perUser,
+		"WEBAUTHN_SESSIONS_MAX":      &limits.max,
+	} {
+		v := os.Getenv(name)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid %s %q: must be a positive integer", name, v)
+		}
+		*limit = n
+	}
+	return limits, nil
+}
+
+// CreateSession creates a new session. A username keeps only its newest
+// sessions up to the per-user limit, and once the table is over its limit
+// the sessions closest to expiring are evicted, so begin requests spammed for
+// one username or for many cannot grow the database without bound.
 func (s *Store) CreateSession(sessionID, username string, sessionData *webauthn.SessionData, expiresAt time.Time) error {
 	// Serialize session data to JSON
 	dataJSON, err := json.Marshal(sessionData)
@@ -27,15 +88,64 @@ func (s *Store) CreateSession(sessionID, username string, sessionData *webauthn.
 		return fmt.Errorf("failed to marshal session data: %w", err)
 	}
 
-	_, err = s.db.Exec(
-		"INSERT INTO webauthn_sessions (id, username, session_data, expires_at) VALUES (?, ?, ?, ?)",
-		sessionID, username, dataJSON, expiresAt,
+	tx, err := s.db.BeginTx(s.ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(s.ctx,
+		"INSERT INTO webauthn_sessions (id, username, session_data, created_at, expires_at) VALUES (?, ?, ?, ?, ?)",
+		sessionID, username, dataJSON, now(), formatTime(expiresAt),
 	)
 	if err != nil {
 		return fmt.Errorf("failed to create session: %w", err)
 	}
 
+	result, err := tx.ExecContext(s.ctx,
+		`DELETE FROM webauthn_sessions WHERE username = ? AND id NOT IN (
+			SELECT id FROM webauthn_sessions WHERE username = ? ORDER BY created_at DESC, rowid DESC LIMIT ?
+		)`,
+		username, username, s.sessions.perUser,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to evict sessions for user: %w", err)
+	}
+	evictedPerUser, _ := result.RowsAffected()
+
+	var count int64
+	if err := tx.QueryRowContext(s.ctx, "SELECT COUNT(*) FROM webauthn_sessions").Scan(&count); err != nil {
+		return fmt.Errorf("failed to count sessions: %w", err)
+	}
+	var evictedOverflow int64
+	if excess := count - int64(s.sessions.max); excess > 0 {
+		// Expired sessions sort first, so they go before any live one
+		result, err := tx.ExecContext(s.ctx,
+			`DELETE FROM webauthn_sessions WHERE id IN (
+				SELECT id FROM webauthn_sessions WHERE id != ? ORDER BY expires_at, rowid LIMIT ?
+			)`,
+			sessionID, excess,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to evict sessions: %w", err)
+		}
+		evictedOverflow, _ = result.RowsAffected()
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	s.sessions.created.Add(1)
 	log.Printf("Created session %s for user %s, expires at %v", sessionID, username, expiresAt)
+	if evictedPerUser > 0 {
+		s.sessions.evictedPerUser.Add(uint64(evictedPerUser))
+		log.Printf("Evicted %d oldest session(s) for user %s over the limit of %d", evictedPerUser, username, s.sessions.perUser)
+	}
+	if evictedOverflow > 0 {
+		s.sessions.evictedOverflow.Add(uint64(evictedOverflow))
+		log.Printf("Session table over the limit of %d; evicted %d session(s)", s.sessions.max, evictedOverflow)
+	}
 	return nil
 }
 
@@ -45,7 +155,7 @@ func (s *Store) GetSession(sessionID string) (*Session, error) {
 	var dataJSON []byte
 	var createdAt, expiresAt string
 
-	err := s.db.QueryRow(
+	err := s.db.QueryRowContext(s.ctx,
 		"SELECT id, username, session_data, created_at, expires_at FROM webauthn_sessions WHERE id = ?",
 		sessionID,
 	).Scan(&session.ID, &session.Username, &dataJSON, &createdAt, &expiresAt)
@@ -56,21 +166,15 @@ func (s *Store) GetSession(sessionID string) (*Session, error) {
 		return nil, fmt.Errorf("failed to get session: %w", err)
 	}
 
-	// Parse expiration time (SQLite stores as datetime string)
-	var parseErr error
-	session.ExpiresAt, parseErr = time.Parse("2006-01-02 15:04:05", expiresAt)
-	if parseErr != nil {
-		// Try with timezone format
-		session.ExpiresAt, parseErr = time.Parse(time.RFC3339, expiresAt)
-		if parseErr != nil {
-			return nil, fmt.Errorf("failed to parse expiration time: %w", parseErr)
-		}
+	if session.ExpiresAt, err = parseTime(expiresAt); err != nil {
+		return nil, fmt.Errorf("failed to parse expiration time: %w", err)
 	}
 
 	// Check if session is expired
 	if time.Now().After(session.ExpiresAt) {
 		// Delete expired session
 		_ = s.DeleteSession(sessionID)
+		s.sessions.expired.Add(1)
 		return nil, fmt.Errorf("session expired")
 	}
 
@@ -80,21 +184,15 @@ func (s *Store) GetSession(sessionID string) (*Session, error) {
 		return nil, fmt.Errorf("failed to unmarshal session data: %w", err)
 	}
 
-	session.CreatedAt, parseErr = time.Parse("2006-01-02 15:04:05", createdAt)
-	if parseErr != nil {
-		// Try with timezone format
-		session.CreatedAt, parseErr = time.Parse(time.RFC3339, createdAt)
-		if parseErr != nil {
-			// If parsing fails, just use current time
-			session.CreatedAt = time.Now()
-		}
+	if session.CreatedAt, err = parseTime(createdAt); err != nil {
+		return nil, fmt.Errorf("failed to parse creation time: %w", err)
 	}
 	return &session, nil
 }
 
 // DeleteSession deletes a session by ID
 func (s *Store) DeleteSession(sessionID string) error {
-	result, err := s.db.Exec("DELETE FROM webauthn_sessions WHERE id = ?", sessionID)
+	result, err := s.db.ExecContext(s.ctx, "DELETE FROM webauthn_sessions WHERE id = ?", sessionID)
 	if err != nil {
 		return fmt.Errorf("failed to delete session: %w", err)
 	}
@@ -107,13 +205,31 @@ func (s *Store) DeleteSession(sessionID string) error {
 
 // CleanupExpiredSessions removes all expired sessions
 func (s *Store) CleanupExpiredSessions() error {
-	result, err := s.db.Exec("DELETE FROM webauthn_sessions WHERE expires_at < ?", time.Now())
+	result, err := s.db.ExecContext(s.ctx, "DELETE FROM webauthn_sessions WHERE expires_at < ?", now())
 	if err != nil {
 		return fmt.Errorf("failed to cleanup expired sessions: %w", err)
 	}
 	rowsAffected, _ := result.RowsAffected()
 	if rowsAffected > 0 {
+		s.sessions.expired.Add(uint64(rowsAffected))
 		log.Printf("Cleaned up %d expired session(s)", rowsAffected)
 	}
 	return nil
 }
+
+// SessionStats returns the size of the WebAuthn session table and how many
+// sessions were created, evicted, and expired since startup
+func (s *Store) SessionStats(ctx context.Context) (SessionStats, error) {
+	stats := SessionStats{
+		PerUserLimit:    s.sessions.perUser,
+		Limit:           s.sessions.max,
+		Created:         s.sessions.created.Load(),
+		EvictedPerUser:  s.sessions.evictedPerUser.Load(),
+		EvictedOverflow: s.sessions.evictedOverflow.Load(),
+		Expired:         s.sessions.expired.Load(),
+	}
+	if err := s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM webauthn_sessions").Scan(&stats.Count); err != nil {
+		return SessionStats{}, fmt.Errorf("failed to count sessions: %w", err)
+	}
+	return stats, nil
+}
@@ -0,0 +1,185 @@
+package store
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+)
+
+// Topology is a hint to a network's agents about how to connect to peers
+type Topology string
+
+const (
+	// TopologyAuto leaves the choice to the agents
+	TopologyAuto Topology = "auto"
+	// TopologyMesh connects every peer directly to every other
+	TopologyMesh Topology = "mesh"
+	// TopologyRelay routes peer traffic through a relay, for networks whose
+	// peers rarely connect directly
+	TopologyRelay Topology = "relay"
+)
+
+// Deprovision is what happens to a user's Headscale account when they stop
+// being a member of a network
+type Deprovision string
+
+const (
+	// DeprovisionNone leaves the account and its devices as they are
+	DeprovisionNone Deprovision = "none"
+	// DeprovisionExpire logs the user's devices out and expires their
+	// preauth keys, keeping the account so rejoining restores it
+	DeprovisionExpire Deprovision = "expire"
+	// DeprovisionDelete deletes the user's devices and account
+	DeprovisionDelete Deprovision = "delete"
+)
+
+// Bounds on a network's default preauth key expiry
+const (
+	MinKeyExpiry = 5 * time.Minute
+	MaxKeyExpiry = 90 * 24 * time.Hour
+)
+
+// Keys of the settings in network_settings
+const (
+	settingJoinApprovalRequired = "join_approval_required"
+	settingDefaultKeyExpiry     = "default_key_expiry"
+	settingChatEnabled          = "chat_enabled"
+	settingSignalingTopology    = "signaling_topology"
+	settingTailnetDeprovision   = "tailnet_deprovision"
+)
+
+// NetworkSettings are the settings of a network
+type NetworkSettings struct {
+	// JoinApprovalRequired turns joins into requests a member must approve
+	JoinApprovalRequired bool
+	// DefaultKeyExpiry is how long preauth keys for adopted devices last
+	DefaultKeyExpiry time.Duration
+	// ChatEnabled allows minting chat (XMPP) tokens for the network
+	ChatEnabled bool
+	// SignalingTopology is passed on to agents with their attestations
+	SignalingTopology Topology
+	// TailnetDeprovision applies to members' Headscale accounts when they
+	// leave or the network is deleted
+	TailnetDeprovision Deprovision
+}
+
+// DefaultNetworkSettings are the settings of a network that never changed
+// them
+var DefaultNetworkSettings = NetworkSettings{
+	JoinApprovalRequired: false,
+	DefaultKeyExpiry:     24 * time.Hour,
+	ChatEnabled:          true,
+	SignalingTopology:    TopologyAuto,
+	TailnetDeprovision:   DeprovisionNone,
+}
+
+// Validate checks that settings are within bounds
+func (n NetworkSettings) Validate() error {
+	if n.DefaultKeyExpiry < MinKeyExpiry || n.DefaultKeyExpiry > MaxKeyExpiry {
+		return fmt.Errorf("default key expiry must be between %s and %s", MinKeyExpiry, MaxKeyExpiry)
+	}
+	switch n.SignalingTopology {
+	case TopologyAuto, TopologyMesh, TopologyRelay:
+	default:
+		return fmt.Errorf("signaling topology must be %s, %s, or %s", TopologyAuto, TopologyMesh, TopologyRelay)
+	}
+	switch n.TailnetDeprovision {
+	case DeprovisionNone, DeprovisionExpire, DeprovisionDelete:
+	default:
+		return fmt.Errorf("tailnet deprovision must be %s, %s, or %s", DeprovisionNone, DeprovisionExpire, DeprovisionDelete)
+	}
+	return nil
+}
+
+// values encodes settings as network_settings rows
+func (n NetworkSettings) values() map[string]string {
+	return map[string]string{
+		settingJoinApprovalRequired: strconv.FormatBool(n.JoinApprovalRequired),
+		settingDefaultKeyExpiry:     n.DefaultKeyExpiry.String(),
+		settingChatEnabled:          strconv.FormatBool(n.ChatEnabled),
+		settingSignalingTopology:    string(n.SignalingTopology),
+		settingTailnetDeprovision:   string(n.TailnetDeprovision),
+	}
+}
+
+// set decodes one network_settings row into n
+func (n *NetworkSettings) set(key, value string) error {
+	var err error
+	switch key {
+	case settingJoinApprovalRequired:
+		n.JoinApprovalRequired, err = strconv.ParseBool(value)
+	case settingDefaultKeyExpiry:
+		n.DefaultKeyExpiry, err = time.ParseDuration(value)
+	case settingChatEnabled:
+		n.ChatEnabled, err = strconv.ParseBool(value)
+	case settingSignalingTopology:
+		n.SignalingTopology = Topology(value)
+	case settingTailnetDeprovision:
+		n.TailnetDeprovision = Deprovision(value)
+	default:
+		// Left behind by a newer version, or a removed setting
+	}
+	return err
+}
+
+// GetNetworkSettings returns a network's settings, with defaults for those
+// never set. A stored value that no longer parses or validates falls back to
+// its default rather than failing every request that needs the settings.
+func (s *Store) GetNetworkSettings(networkID int64) (*NetworkSettings, error) {
+	rows, err := s.db.QueryContext(s.ctx, "SELECT key, value FROM network_settings WHERE network_id = ?", networkID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get network settings: %w", err)
+	}
+	defer rows.Close()
+
+	settings := DefaultNetworkSettings
+	for rows.Next() {
+		var key, value string
+		if err := rows.Scan(&key, &value); err != nil {
+			return nil, fmt.Errorf("failed to scan network setting: %w", err)
+		}
+		candidate := settings
+		if err := candidate.set(key, value); err != nil || candidate.Validate() != nil {
+			log.Printf("Ignoring invalid setting %s=%q of network %d", key, value, networkID)
+			continue
+		}
+		settings = candidate
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating network settings: %w", err)
+	}
+
+	return &settings, nil
+}
+
+// UpdateNetworkSettings stores all of a network's settings
+func (s *Store) UpdateNetworkSettings(networkID int64, settings NetworkSettings) error {
+	if err := settings.Validate(); err != nil {
+		return err
+	}
+
+	tx, err := s.db.BeginTx(s.ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	updatedAt := now()
+	for key, value := range settings.values() {
+		_, err := tx.ExecContext(s.ctx,
+			`INSERT INTO network_settings (network_id, key, value, updated_at) VALUES (?, ?, ?, ?)
+			 ON CONFLICT (network_id, key) DO UPDATE SET value = excluded.value, updated_at = excluded.updated_at`,
+			networkID, key, value, updatedAt,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to update network setting %s: %w", key, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit network settings: %w", err)
+	}
+	return nil
+}
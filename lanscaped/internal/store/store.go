@@ -1,32 +1,98 @@
 package store
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"log"
 	"os"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/jhead/lanscape/lanscaped/internal/secrets"
 )
 
 // Store represents the database store
 type Store struct {
-	db *sql.DB
+	db          *sql.DB
+	cache       *lookupCache
+	maintenance *maintenance
+	sessions    *sessionLimits
+	// ctx carries the trace of the request the store is used for, see
+	// WithContext
+	ctx context.Context
+}
+
+// DatabaseURL returns the database to use from DATABASE_URL, which may hold
+// a password and so is read with secrets.Get, or a local SQLite file by
+// default
+func DatabaseURL() (string, error) {
+	dbURL, err := secrets.Get("DATABASE_URL")
+	if err != nil || dbURL != "" {
+		return dbURL, err
+	}
+	return "file:lanscaped.db?_foreign_keys=on", nil
 }
 
-// NewStore creates a new database store
+// NewStore creates a new database store for DatabaseURL. Lookups are cached
+// for STORE_CACHE_TTL, or DefaultCacheTTL if unset; 0 disables the cache.
+// WebAuthn sessions are limited per username by WEBAUTHN_SESSIONS_PER_USER
+// and in total by WEBAUTHN_SESSIONS_MAX, see CreateSession.
+// For resilience testing, FAULT_STORE_DELAY delays every query by up to that
+// long.
 func NewStore() (*Store, error) {
-	dbURL := os.Getenv("DATABASE_URL")
-	if dbURL == "" {
-		dbURL = "file:lanscaped.db?_foreign_keys=on"
+	ttl := DefaultCacheTTL
+	if v := os.Getenv("STORE_CACHE_TTL"); v != "" {
+		var err error
+		if ttl, err = time.ParseDuration(v); err != nil {
+			return nil, fmt.Errorf("invalid STORE_CACHE_TTL %q: %w", v, err)
+		}
+	}
+
+	sessions, err := sessionLimitsFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	dbURL, err := DatabaseURL()
+	if err != nil {
+		return nil, err
+	}
+	delay, err := faultsFromEnv()
+	if err != nil {
+		return nil, err
 	}
 
-	db, err := sql.Open("sqlite3", dbURL)
+	var store *Store
+	if delay != nil {
+		store, err = open(openDelayed(dbURL, delay))
+	} else {
+		store, err = Open(dbURL)
+	}
 	if err != nil {
-		return nil, fmt.Errorf("failed to open database: %w", err)
+		return nil, err
 	}
+	store.cache = newLookupCache(ttl)
+	store.sessions = sessions
+	return store, nil
+}
+
+// Open opens the SQLite database at dbURL and migrates it to the current
+// schema
+func Open(dbURL string) (*Store, error) {
+	return open(openTraced(dbURL))
+}
 
-	store := &Store{db: db}
+// open migrates db to the current schema and creates a store for it
+func open(db *sql.DB) (*Store, error) {
+	store := &Store{
+		db:          db,
+		cache:       newLookupCache(0),
+		maintenance: &maintenance{},
+		sessions:    &sessionLimits{perUser: DefaultSessionsPerUser, max: DefaultMaxSessions},
+		ctx:         context.Background(),
+	}
 
 	if err := store.migrate(); err != nil {
 		return nil, fmt.Errorf("failed to migrate database: %w", err)
@@ -36,6 +102,15 @@ func NewStore() (*Store, error) {
 	return store, nil
 }
 
+// WithContext returns a store sharing s's database and cache whose queries
+// run with ctx, so they are traced as part of the request ctx belongs to and
+// are abandoned if it is canceled
+func (s *Store) WithContext(ctx context.Context) *Store {
+	scoped := *s
+	scoped.ctx = ctx
+	return &scoped
+}
+
 // Close closes the database connection
 func (s *Store) Close() error {
 	return s.db.Close()
@@ -47,6 +122,7 @@ func (s *Store) migrate() error {
 		`CREATE TABLE IF NOT EXISTS users (
 			id INTEGER PRIMARY KEY AUTOINCREMENT,
 			username TEXT NOT NULL UNIQUE,
+			claim_code TEXT,
 			created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
 		)`,
 		`CREATE TABLE IF NOT EXISTS webauthn_credentials (
@@ -70,28 +146,168 @@ func (s *Store) migrate() error {
 		`CREATE INDEX IF NOT EXISTS idx_webauthn_credentials_user_id ON webauthn_credentials(user_id)`,
 		`CREATE INDEX IF NOT EXISTS idx_webauthn_credentials_credential_id ON webauthn_credentials(credential_id)`,
 		`CREATE INDEX IF NOT EXISTS idx_webauthn_sessions_expires_at ON webauthn_sessions(expires_at)`,
+		`CREATE INDEX IF NOT EXISTS idx_webauthn_sessions_username ON webauthn_sessions(username, created_at)`,
 		`CREATE TABLE IF NOT EXISTS networks (
 			id INTEGER PRIMARY KEY AUTOINCREMENT,
 			name TEXT NOT NULL UNIQUE,
 			headscale_endpoint TEXT NOT NULL,
 			api_key TEXT,
-			created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+			description TEXT NOT NULL DEFAULT '',
+			visibility TEXT NOT NULL DEFAULT 'unlisted',
+			metadata TEXT NOT NULL DEFAULT '{}',
+			avatar TEXT NOT NULL DEFAULT '',
+			created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			updated_at DATETIME
 		)`,
 		`CREATE TABLE IF NOT EXISTS memberships (
 			id INTEGER PRIMARY KEY AUTOINCREMENT,
 			user_id INTEGER NOT NULL,
 			network_id INTEGER NOT NULL,
 			created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			key_generation INTEGER NOT NULL DEFAULT 0,
 			UNIQUE(user_id, network_id),
 			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
 			FOREIGN KEY (network_id) REFERENCES networks(id) ON DELETE CASCADE
 		)`,
 		`CREATE INDEX IF NOT EXISTS idx_memberships_user_id ON memberships(user_id)`,
 		`CREATE INDEX IF NOT EXISTS idx_memberships_network_id ON memberships(network_id)`,
+		`CREATE TABLE IF NOT EXISTS usage_records (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			network_id INTEGER NOT NULL,
+			user_id INTEGER NOT NULL,
+			topic TEXT NOT NULL,
+			peer TEXT NOT NULL,
+			bytes_sent INTEGER NOT NULL DEFAULT 0,
+			bytes_received INTEGER NOT NULL DEFAULT 0,
+			messages_sent INTEGER NOT NULL DEFAULT 0,
+			messages_received INTEGER NOT NULL DEFAULT 0,
+			period_start DATETIME NOT NULL,
+			period_end DATETIME NOT NULL,
+			created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (network_id) REFERENCES networks(id) ON DELETE CASCADE,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_usage_records_network_period ON usage_records(network_id, period_end)`,
+		`CREATE TABLE IF NOT EXISTS device_codes (
+			device_code TEXT PRIMARY KEY,
+			user_code TEXT NOT NULL UNIQUE,
+			user_id INTEGER,
+			created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			expires_at DATETIME NOT NULL,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+		)`,
+		`CREATE TABLE IF NOT EXISTS agents (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL,
+			public_key TEXT NOT NULL UNIQUE,
+			name TEXT NOT NULL DEFAULT '',
+			version TEXT NOT NULL DEFAULT '',
+			created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			revoked_at DATETIME,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_agents_user_id ON agents(user_id)`,
+		`CREATE TABLE IF NOT EXISTS presence (
+			public_key TEXT NOT NULL,
+			topic TEXT NOT NULL,
+			online INTEGER NOT NULL DEFAULT 0,
+			changed_at DATETIME NOT NULL,
+			PRIMARY KEY (public_key, topic)
+		)`,
+		`CREATE TABLE IF NOT EXISTS presence_events (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			public_key TEXT NOT NULL,
+			topic TEXT NOT NULL,
+			online INTEGER NOT NULL,
+			at DATETIME NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_presence_events_public_key_at ON presence_events(public_key, at)`,
+		`CREATE TABLE IF NOT EXISTS audit_events (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL,
+			action TEXT NOT NULL,
+			detail TEXT NOT NULL DEFAULT '{}',
+			created_at DATETIME NOT NULL,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_audit_events_user_id_created_at ON audit_events(user_id, created_at)`,
+		`CREATE TABLE IF NOT EXISTS network_settings (
+			network_id INTEGER NOT NULL,
+			key TEXT NOT NULL,
+			value TEXT NOT NULL,
+			updated_at DATETIME NOT NULL,
+			PRIMARY KEY (network_id, key),
+			FOREIGN KEY (network_id) REFERENCES networks(id) ON DELETE CASCADE
+		)`,
+		`CREATE TABLE IF NOT EXISTS join_requests (
+			network_id INTEGER NOT NULL,
+			user_id INTEGER NOT NULL,
+			created_at DATETIME NOT NULL,
+			PRIMARY KEY (network_id, user_id),
+			FOREIGN KEY (network_id) REFERENCES networks(id) ON DELETE CASCADE,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+		)`,
+		`CREATE TABLE IF NOT EXISTS invitations (
+			network_id INTEGER NOT NULL,
+			user_id INTEGER NOT NULL,
+			invited_by INTEGER NOT NULL,
+			created_at DATETIME NOT NULL,
+			PRIMARY KEY (network_id, user_id),
+			FOREIGN KEY (network_id) REFERENCES networks(id) ON DELETE CASCADE,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+			FOREIGN KEY (invited_by) REFERENCES users(id) ON DELETE CASCADE
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_invitations_user_id ON invitations(user_id)`,
+		`CREATE TABLE IF NOT EXISTS tailnet_links (
+			network_id INTEGER NOT NULL,
+			headscale_user TEXT NOT NULL,
+			status TEXT NOT NULL,
+			user_id INTEGER,
+			created_at DATETIME NOT NULL,
+			PRIMARY KEY (network_id, headscale_user),
+			FOREIGN KEY (network_id) REFERENCES networks(id) ON DELETE CASCADE,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE SET NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_tailnet_links_headscale_user ON tailnet_links(headscale_user)`,
+		`CREATE TABLE IF NOT EXISTS devices (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			network_id INTEGER NOT NULL,
+			user_id INTEGER NOT NULL,
+			node_id TEXT NOT NULL,
+			name TEXT NOT NULL DEFAULT '',
+			ip_addresses TEXT NOT NULL DEFAULT '[]',
+			last_seen DATETIME,
+			created_at DATETIME NOT NULL,
+			updated_at DATETIME,
+			UNIQUE(network_id, node_id),
+			FOREIGN KEY (network_id) REFERENCES networks(id) ON DELETE CASCADE,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_devices_user_id ON devices(user_id)`,
+		`CREATE TABLE IF NOT EXISTS api_tokens (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL,
+			name TEXT NOT NULL,
+			token_hash TEXT NOT NULL UNIQUE,
+			scopes TEXT NOT NULL,
+			created_at DATETIME NOT NULL,
+			last_used_at DATETIME,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_api_tokens_user_id ON api_tokens(user_id)`,
+		`CREATE TABLE IF NOT EXISTS topic_keys (
+			network_id INTEGER NOT NULL,
+			generation INTEGER NOT NULL,
+			key BLOB NOT NULL,
+			members TEXT NOT NULL,
+			created_at DATETIME NOT NULL,
+			PRIMARY KEY (network_id, generation),
+			FOREIGN KEY (network_id) REFERENCES networks(id) ON DELETE CASCADE
+		)`,
 	}
 
 	for _, query := range queries {
-		if _, err := s.db.Exec(query); err != nil {
+		if _, err := s.db.ExecContext(s.ctx, query); err != nil {
 			return fmt.Errorf("failed to execute migration: %w", err)
 		}
 	}
@@ -99,14 +315,14 @@ func (s *Store) migrate() error {
 	// Migrate existing webauthn_credentials table to add backup flags if they don't exist
 	// SQLite doesn't support ALTER TABLE ADD COLUMN IF NOT EXISTS, so we check first
 	var count int
-	err := s.db.QueryRow("SELECT COUNT(*) FROM pragma_table_info('webauthn_credentials') WHERE name='backup_eligible'").Scan(&count)
+	err := s.db.QueryRowContext(s.ctx, "SELECT COUNT(*) FROM pragma_table_info('webauthn_credentials') WHERE name='backup_eligible'").Scan(&count)
 	if err == nil && count == 0 {
 		log.Println("Adding backup_eligible and backup_state columns to webauthn_credentials table")
-		if _, err := s.db.Exec("ALTER TABLE webauthn_credentials ADD COLUMN backup_eligible INTEGER NOT NULL DEFAULT 0"); err != nil {
+		if _, err := s.db.ExecContext(s.ctx, "ALTER TABLE webauthn_credentials ADD COLUMN backup_eligible INTEGER NOT NULL DEFAULT 0"); err != nil {
 			// Column might already exist, log but don't fail
 			log.Printf("Note: backup_eligible column migration: %v", err)
 		}
-		if _, err := s.db.Exec("ALTER TABLE webauthn_credentials ADD COLUMN backup_state INTEGER NOT NULL DEFAULT 0"); err != nil {
+		if _, err := s.db.ExecContext(s.ctx, "ALTER TABLE webauthn_credentials ADD COLUMN backup_state INTEGER NOT NULL DEFAULT 0"); err != nil {
 			// Column might already exist, log but don't fail
 			log.Printf("Note: backup_state column migration: %v", err)
 		}
@@ -114,19 +330,117 @@ func (s *Store) migrate() error {
 
 	// Migrate networks table to add api_key column if it doesn't exist
 	var networkCount int
-	err = s.db.QueryRow("SELECT COUNT(*) FROM pragma_table_info('networks') WHERE name='api_key'").Scan(&networkCount)
+	err = s.db.QueryRowContext(s.ctx, "SELECT COUNT(*) FROM pragma_table_info('networks') WHERE name='api_key'").Scan(&networkCount)
 	if err == nil && networkCount == 0 {
 		log.Println("Adding api_key column to networks table")
-		if _, err := s.db.Exec("ALTER TABLE networks ADD COLUMN api_key TEXT"); err != nil {
+		if _, err := s.db.ExecContext(s.ctx, "ALTER TABLE networks ADD COLUMN api_key TEXT"); err != nil {
 			// Column might already exist, log but don't fail
 			log.Printf("Note: api_key column migration: %v", err)
 		}
 	}
 
+	// Migrate networks table to add the directory listing and profile
+	// columns if they don't exist. Existing networks stay out of the
+	// directory.
+	for _, c := range []struct{ column, definition string }{
+		{"description", "TEXT NOT NULL DEFAULT ''"},
+		{"visibility", "TEXT NOT NULL DEFAULT 'unlisted'"},
+		{"metadata", "TEXT NOT NULL DEFAULT '{}'"},
+		{"avatar", "TEXT NOT NULL DEFAULT ''"},
+	} {
+		column, definition := c.column, c.definition
+		var count int
+		err = s.db.QueryRowContext(s.ctx, "SELECT COUNT(*) FROM pragma_table_info('networks') WHERE name = ?", column).Scan(&count)
+		if err == nil && count == 0 {
+			log.Printf("Adding %s column to networks table", column)
+			if _, err := s.db.ExecContext(s.ctx, "ALTER TABLE networks ADD COLUMN "+column+" "+definition); err != nil {
+				// Column might already exist, log but don't fail
+				log.Printf("Note: %s column migration: %v", column, err)
+			}
+		}
+	}
+
+	// Migrate users table to add claim_code column if it doesn't exist
+	var userCount int
+	err = s.db.QueryRowContext(s.ctx, "SELECT COUNT(*) FROM pragma_table_info('users') WHERE name='claim_code'").Scan(&userCount)
+	if err == nil && userCount == 0 {
+		log.Println("Adding claim_code column to users table")
+		if _, err := s.db.ExecContext(s.ctx, "ALTER TABLE users ADD COLUMN claim_code TEXT"); err != nil {
+			// Column might already exist, log but don't fail
+			log.Printf("Note: claim_code column migration: %v", err)
+		}
+	}
+
+	// Migrate agents table to add revoked_at column if it doesn't exist
+	var agentCount int
+	err = s.db.QueryRowContext(s.ctx, "SELECT COUNT(*) FROM pragma_table_info('agents') WHERE name='revoked_at'").Scan(&agentCount)
+	if err == nil && agentCount == 0 {
+		log.Println("Adding revoked_at column to agents table")
+		if _, err := s.db.ExecContext(s.ctx, "ALTER TABLE agents ADD COLUMN revoked_at DATETIME"); err != nil {
+			// Column might already exist, log but don't fail
+			log.Printf("Note: revoked_at column migration: %v", err)
+		}
+	}
+
+	// Migrate agents table to add version column if it doesn't exist
+	err = s.db.QueryRowContext(s.ctx, "SELECT COUNT(*) FROM pragma_table_info('agents') WHERE name='version'").Scan(&agentCount)
+	if err == nil && agentCount == 0 {
+		log.Println("Adding version column to agents table")
+		if _, err := s.db.ExecContext(s.ctx, "ALTER TABLE agents ADD COLUMN version TEXT NOT NULL DEFAULT ''"); err != nil {
+			// Column might already exist, log but don't fail
+			log.Printf("Note: version column migration: %v", err)
+		}
+	}
+
+	// Migrate networks and devices tables to add updated_at columns if they
+	// don't exist, starting at each row's creation
+	for _, table := range []string{"networks", "devices"} {
+		var count int
+		err = s.db.QueryRowContext(s.ctx, "SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = 'updated_at'", table).Scan(&count)
+		if err == nil && count == 0 {
+			log.Printf("Adding updated_at column to %s table", table)
+			if _, err := s.db.ExecContext(s.ctx, "ALTER TABLE "+table+" ADD COLUMN updated_at DATETIME"); err != nil {
+				// Column might already exist, log but don't fail
+				log.Printf("Note: %s updated_at column migration: %v", table, err)
+			}
+		}
+		if _, err := s.db.ExecContext(s.ctx, "UPDATE "+table+" SET updated_at = created_at WHERE updated_at IS NULL"); err != nil {
+			return fmt.Errorf("failed to fill %s updated_at: %w", table, err)
+		}
+	}
+
+	if err := s.migrateTimestamps(); err != nil {
+		return err
+	}
+
+	// Migrate memberships table to add key_generation column if it doesn't
+	// exist, withholding the topic keys generated before each member joined
+	var membershipCount int
+	err = s.db.QueryRowContext(s.ctx, "SELECT COUNT(*) FROM pragma_table_info('memberships') WHERE name='key_generation'").Scan(&membershipCount)
+	if err == nil && membershipCount == 0 {
+		log.Println("Adding key_generation column to memberships table")
+		if _, err := s.db.ExecContext(s.ctx, "ALTER TABLE memberships ADD COLUMN key_generation INTEGER NOT NULL DEFAULT 0"); err != nil {
+			return fmt.Errorf("failed to add memberships key_generation: %w", err)
+		}
+		if _, err := s.db.ExecContext(s.ctx,
+			`UPDATE memberships SET key_generation = (
+				SELECT COALESCE(MAX(t.generation), 0) FROM topic_keys t
+				WHERE t.network_id = memberships.network_id AND t.created_at < memberships.created_at
+			)`,
+		); err != nil {
+			return fmt.Errorf("failed to fill memberships key_generation: %w", err)
+		}
+	}
+
 	log.Println("Database migrations completed")
 	return nil
 }
 
+// CacheStats returns how many lookups were answered from the cache
+func (s *Store) CacheStats() CacheStats {
+	return s.cache.stats()
+}
+
 // DB returns the underlying database connection
 func (s *Store) DB() *sql.DB {
 	return s.db
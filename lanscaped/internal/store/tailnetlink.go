@@ -0,0 +1,157 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// TailnetLinkStatus is how the owner of an account answered a link to a
+// Headscale user of the same name
+type TailnetLinkStatus string
+
+// Statuses of a tailnet link
+const (
+	TailnetLinkPending  TailnetLinkStatus = "pending"
+	TailnetLinkAccepted TailnetLinkStatus = "accepted"
+	TailnetLinkDeclined TailnetLinkStatus = "declined"
+)
+
+// TailnetLink ties a user of a network's Headscale, found by a tailnet
+// import, to the lanscaped account of the same name. Imports only record
+// links; the account's owner accepts one to join the network with the
+// Headscale user's nodes as their devices.
+type TailnetLink struct {
+	NetworkID     int64
+	NetworkName   string
+	HeadscaleUser string
+	Status        TailnetLinkStatus
+	// UserID is the account that accepted the link, 0 until then
+	UserID    int64
+	CreatedAt time.Time
+}
+
+// RecordTailnetLink records a pending link for a Headscale user of a
+// network, returning the link, which is the existing one if the user was
+// imported before
+func (s *Store) RecordTailnetLink(networkID int64, headscaleUser string) (*TailnetLink, error) {
+	if _, err := s.db.ExecContext(s.ctx,
+		`INSERT INTO tailnet_links (network_id, headscale_user, status, created_at) VALUES (?, ?, ?, ?)
+		 ON CONFLICT (network_id, headscale_user) DO NOTHING`,
+		networkID, headscaleUser, TailnetLinkPending, now(),
+	); err != nil {
+		return nil, fmt.Errorf("failed to record tailnet link: %w", err)
+	}
+
+	link, err := s.scanTailnetLink(s.db.QueryRowContext(s.ctx,
+		`SELECT l.network_id, n.name, l.headscale_user, l.status, COALESCE(l.user_id, 0), l.created_at
+		 FROM tailnet_links l
+		 INNER JOIN networks n ON n.id = l.network_id
+		 WHERE l.network_id = ? AND l.headscale_user = ?`,
+		networkID, headscaleUser,
+	))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get tailnet link: %w", err)
+	}
+	return link, nil
+}
+
+// ListPendingTailnetLinks lists the links waiting on the owner of the
+// account named username, oldest first
+func (s *Store) ListPendingTailnetLinks(username string) ([]*TailnetLink, error) {
+	rows, err := s.db.QueryContext(s.ctx,
+		`SELECT l.network_id, n.name, l.headscale_user, l.status, COALESCE(l.user_id, 0), l.created_at
+		 FROM tailnet_links l
+		 INNER JOIN networks n ON n.id = l.network_id
+		 WHERE l.headscale_user = ? AND l.status = ?
+		 ORDER BY l.created_at, l.network_id`,
+		username, TailnetLinkPending,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tailnet links: %w", err)
+	}
+	defer rows.Close()
+
+	var links []*TailnetLink
+	for rows.Next() {
+		link, err := s.scanTailnetLink(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan tailnet link: %w", err)
+		}
+		links = append(links, link)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating tailnet links: %w", err)
+	}
+
+	return links, nil
+}
+
+// AcceptTailnetLink accepts the pending link of a network to the Headscale
+// user named like user, making user a member of the network
+func (s *Store) AcceptTailnetLink(user *User, networkID int64) error {
+	defer s.cache.memberships.delete(membershipKey{user.ID, networkID})
+
+	tx, err := s.db.BeginTx(s.ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(s.ctx,
+		"UPDATE tailnet_links SET status = ?, user_id = ? WHERE network_id = ? AND headscale_user = ? AND status = ?",
+		TailnetLinkAccepted, user.ID, networkID, user.Username, TailnetLinkPending,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to accept tailnet link: %w", err)
+	}
+	if err := expectOneRow(result, "tailnet link not found"); err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(s.ctx,
+		"INSERT INTO memberships (user_id, network_id, created_at, key_generation) VALUES (?, ?, ?, "+currentKeyGeneration+") ON CONFLICT (user_id, network_id) DO NOTHING",
+		user.ID, networkID, now(), networkID,
+	); err != nil {
+		return fmt.Errorf("failed to join network: %w", err)
+	}
+	if _, err := tx.ExecContext(s.ctx, "DELETE FROM join_requests WHERE network_id = ? AND user_id = ?", networkID, user.ID); err != nil {
+		return fmt.Errorf("failed to settle join request: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit tailnet link: %w", err)
+	}
+	return nil
+}
+
+// DeclineTailnetLink declines the pending link of a network to the
+// Headscale user named username; later imports leave it declined
+func (s *Store) DeclineTailnetLink(username string, networkID int64) error {
+	result, err := s.db.ExecContext(s.ctx,
+		"UPDATE tailnet_links SET status = ? WHERE network_id = ? AND headscale_user = ? AND status = ?",
+		TailnetLinkDeclined, networkID, username, TailnetLinkPending,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to decline tailnet link: %w", err)
+	}
+	return expectOneRow(result, "tailnet link not found")
+}
+
+// scanTailnetLink scans a link selected with its network's name
+func (s *Store) scanTailnetLink(row interface{ Scan(...any) error }) (*TailnetLink, error) {
+	var link TailnetLink
+	var createdAt string
+	if err := row.Scan(&link.NetworkID, &link.NetworkName, &link.HeadscaleUser, &link.Status, &link.UserID, &createdAt); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("tailnet link not found")
+		}
+		return nil, err
+	}
+	var err error
+	if link.CreatedAt, err = parseTime(createdAt); err != nil {
+		return nil, fmt.Errorf("failed to parse tailnet link created_at: %w", err)
+	}
+	return &link, nil
+}
@@ -0,0 +1,116 @@
+package store
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// timeFormat is how timestamps are stored: RFC3339 in UTC, to the second.
+// Every stored timestamp has the same width and zone, so they also compare
+// correctly as text in SQL.
+const timeFormat = "2006-01-02T15:04:05Z"
+
+// timeLayouts are the layouts parseTime accepts. The driver returns DATETIME
+// columns as RFC3339 with fractional seconds; values it does not convert,
+// such as the result of MAX(), come back as stored, which for rows written
+// before timestamps were standardized is one of SQLite's layouts.
+var timeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04:05.999999999-07:00",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999",
+}
+
+// formatTime formats t for storage
+func formatTime(t time.Time) string {
+	return t.UTC().Format(timeFormat)
+}
+
+// now returns the current time formatted for storage
+func now() string {
+	return formatTime(time.Now())
+}
+
+// parseTime parses a timestamp column into UTC. Layouts without a zone are
+// UTC, like SQLite's CURRENT_TIMESTAMP.
+func parseTime(s string) (time.Time, error) {
+	for _, layout := range timeLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid timestamp %q", s)
+}
+
+// timestampColumns are the columns holding timestamps, which
+// migrateTimestamps rewrites in timeFormat
+var timestampColumns = map[string][]string{
+	"users":                {"created_at"},
+	"webauthn_credentials": {"created_at"},
+	"webauthn_sessions":    {"created_at", "expires_at"},
+	"networks":             {"created_at", "updated_at"},
+	"memberships":          {"created_at"},
+	"usage_records":        {"period_start", "period_end", "created_at"},
+	"device_codes":         {"created_at", "expires_at"},
+	"agents":               {"created_at", "revoked_at"},
+	"presence":             {"changed_at"},
+	"presence_events":      {"at"},
+	"audit_events":         {"created_at"},
+	"network_settings":     {"updated_at"},
+	"join_requests":        {"created_at"},
+	"invitations":          {"created_at"},
+	"tailnet_links":        {"created_at"},
+	"devices":              {"last_seen", "created_at", "updated_at"},
+	"api_tokens":           {"created_at", "last_used_at"},
+	"topic_keys":           {"created_at"},
+}
+
+// timestampsVersion is the user_version of databases whose timestamps are
+// all in timeFormat
+const timestampsVersion = 1
+
+// migrateTimestamps rewrites timestamps stored before they were
+// standardized: SQLite's CURRENT_TIMESTAMP layout, and times the driver
+// stored with the server's local offset, which compared wrongly as text
+// against UTC ones. It runs once per database.
+func (s *Store) migrateTimestamps() error {
+	var version int
+	if err := s.db.QueryRowContext(s.ctx, "PRAGMA user_version").Scan(&version); err != nil {
+		return fmt.Errorf("failed to read schema version: %w", err)
+	}
+	if version >= timestampsVersion {
+		return nil
+	}
+
+	tx, err := s.db.BeginTx(s.ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	for table, columns := range timestampColumns {
+		for _, column := range columns {
+			// strftime converts offsets to UTC; values it cannot parse are
+			// left for parseTime to report
+			query := fmt.Sprintf(
+				`UPDATE %[1]s SET %[2]s = COALESCE(strftime('%%Y-%%m-%%dT%%H:%%M:%%SZ', %[2]s), %[2]s)
+				 WHERE %[2]s IS NOT NULL AND %[2]s NOT GLOB '[0-9][0-9][0-9][0-9]-[0-9][0-9]-[0-9][0-9]T[0-9][0-9]:[0-9][0-9]:[0-9][0-9]Z'`,
+				table, column,
+			)
+			result, err := tx.ExecContext(s.ctx, query)
+			if err != nil {
+				return fmt.Errorf("failed to migrate %s.%s: %w", table, column, err)
+			}
+			if n, _ := result.RowsAffected(); n > 0 {
+				log.Printf("Rewrote %d timestamps in %s.%s as RFC3339 UTC", n, table, column)
+			}
+		}
+	}
+
+	if _, err := tx.ExecContext(s.ctx, fmt.Sprintf("PRAGMA user_version = %d", timestampsVersion)); err != nil {
+		return fmt.Errorf("failed to set schema version: %w", err)
+	}
+	return tx.Commit()
+}
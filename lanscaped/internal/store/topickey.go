@@ -0,0 +1,162 @@
+package store
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+const (
+	// TopicKeySize is the length of a topic key, an AES-256 key
+	TopicKeySize = 32
+
+	// TopicKeyHistory is how many generations of a network's topic key are
+	// kept, so members can still read group messages sealed with a key
+	// rotated away moments ago
+	TopicKeyHistory = 4
+)
+
+// currentKeyGeneration is the SQL for the current topic key generation of
+// the network bound to its parameter, 0 if it has none. It is recorded on
+// each new membership, so keys generated before the member joined are
+// withheld whatever the clock says.
+const currentKeyGeneration = "(SELECT COALESCE(MAX(generation), 0) FROM topic_keys WHERE network_id = ?)"
+
+// TopicKey is one generation of the symmetric key a network's members seal
+// group messages with
+type TopicKey struct {
+	NetworkID  int64
+	Generation int64
+	Key        []byte
+	CreatedAt  time.Time
+}
+
+// TopicKeys returns a network's topic keys, newest first, rotating to a new
+// generation first if the membership changed since the current one was
+// generated: a member joined or left, or a member's agent was revoked. Keys
+// are rotated when next requested rather than on every change, so a batch
+// of changes rotates once.
+func (s *Store) TopicKeys(networkID int64) ([]*TopicKey, error) {
+	tx, err := s.db.BeginTx(s.ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	members, err := s.txMembershipDigest(tx, networkID)
+	if err != nil {
+		return nil, err
+	}
+
+	var generation int64
+	var current string
+	err = tx.QueryRowContext(s.ctx,
+		"SELECT generation, members FROM topic_keys WHERE network_id = ? ORDER BY generation DESC LIMIT 1",
+		networkID,
+	).Scan(&generation, &current)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, fmt.Errorf("failed to get topic key: %w", err)
+	}
+
+	if err == sql.ErrNoRows || current != members {
+		key := make([]byte, TopicKeySize)
+		if _, err := rand.Read(key); err != nil {
+			return nil, fmt.Errorf("failed to generate topic key: %w", err)
+		}
+		// A concurrent request may have rotated already; its key serves
+		if _, err := tx.ExecContext(s.ctx,
+			"INSERT INTO topic_keys (network_id, generation, key, members, created_at) VALUES (?, ?, ?, ?, ?) ON CONFLICT (network_id, generation) DO NOTHING",
+			networkID, generation+1, key, members, now(),
+		); err != nil {
+			return nil, fmt.Errorf("failed to rotate topic key: %w", err)
+		}
+		if _, err := tx.ExecContext(s.ctx,
+			"DELETE FROM topic_keys WHERE network_id = ? AND generation <= ?",
+			networkID, generation+1-TopicKeyHistory,
+		); err != nil {
+			return nil, fmt.Errorf("failed to delete old topic keys: %w", err)
+		}
+	}
+
+	rows, err := tx.QueryContext(s.ctx,
+		"SELECT generation, key, created_at FROM topic_keys WHERE network_id = ? ORDER BY generation DESC",
+		networkID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list topic keys: %w", err)
+	}
+	defer rows.Close()
+
+	var keys []*TopicKey
+	for rows.Next() {
+		key := &TopicKey{NetworkID: networkID}
+		var createdAt string
+		if err := rows.Scan(&key.Generation, &key.Key, &createdAt); err != nil {
+			return nil, fmt.Errorf("failed to scan topic key: %w", err)
+		}
+		if key.CreatedAt, err = parseTime(createdAt); err != nil {
+			return nil, fmt.Errorf("failed to parse topic key created_at: %w", err)
+		}
+		keys = append(keys, key)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating topic keys: %w", err)
+	}
+	rows.Close()
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit topic keys: %w", err)
+	}
+	return keys, nil
+}
+
+// txMembershipDigest hashes who may hold a network's topic key: its members
+// and their revoked agent keys
+func (s *Store) txMembershipDigest(tx *sql.Tx, networkID int64) (string, error) {
+	rows, err := tx.QueryContext(s.ctx,
+		`SELECT 'u:' || user_id FROM memberships WHERE network_id = ?
+		 UNION ALL
+		 SELECT 'r:' || a.public_key FROM agents a
+		 INNER JOIN memberships m ON a.user_id = m.user_id
+		 WHERE m.network_id = ? AND a.revoked_at IS NOT NULL
+		 ORDER BY 1`,
+		networkID, networkID,
+	)
+	if err != nil {
+		return "", fmt.Errorf("failed to list members: %w", err)
+	}
+	defer rows.Close()
+
+	h := sha256.New()
+	for rows.Next() {
+		var entry string
+		if err := rows.Scan(&entry); err != nil {
+			return "", fmt.Errorf("failed to scan member: %w", err)
+		}
+		h.Write([]byte(entry + "\n"))
+	}
+	if err := rows.Err(); err != nil {
+		return "", fmt.Errorf("error iterating members: %w", err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// MembershipKeyGeneration returns the topic key generation that was current
+// when a user joined a network. Only later generations are theirs to read.
+func (s *Store) MembershipKeyGeneration(userID, networkID int64) (int64, error) {
+	var generation int64
+	err := s.db.QueryRowContext(s.ctx,
+		"SELECT key_generation FROM memberships WHERE user_id = ? AND network_id = ?",
+		userID, networkID,
+	).Scan(&generation)
+	if err == sql.ErrNoRows {
+		return 0, fmt.Errorf("user is not a member of this network")
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to get membership: %w", err)
+	}
+	return generation, nil
+}
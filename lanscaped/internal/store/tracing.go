@@ -0,0 +1,183 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"strings"
+
+	sqlite3 "github.com/mattn/go-sqlite3"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer starts the spans of store queries
+var tracer = otel.Tracer("github.com/jhead/lanscape/lanscaped/internal/store")
+
+// openTraced opens the SQLite database at dbURL through a driver that traces
+// every statement run as part of a traced request
+func openTraced(dbURL string) *sql.DB {
+	return sql.OpenDB(tracedConnector{dbURL: dbURL})
+}
+
+// tracedConnector opens SQLite connections wrapped in tracedConn
+type tracedConnector struct {
+	dbURL string
+}
+
+func (c tracedConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Driver().Open(c.dbURL)
+	if err != nil {
+		return nil, err
+	}
+	return &tracedConn{Conn: conn}, nil
+}
+
+func (c tracedConnector) Driver() driver.Driver {
+	return &sqlite3.SQLiteDriver{}
+}
+
+// tracedConn is a database connection that records a span for each statement
+// whose context already carries one. Statements outside a request, such as
+// migrations and background sweeps, are not traced.
+type tracedConn struct {
+	driver.Conn
+}
+
+func (c *tracedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	ctx, span, ok := startQuery(ctx, query)
+	if !ok {
+		return execContext(ctx, c.Conn, query, args)
+	}
+	defer span.End()
+	result, err := execContext(ctx, c.Conn, query, args)
+	if err != nil {
+		failQuery(span, err)
+		return nil, err
+	}
+	if n, err := result.RowsAffected(); err == nil {
+		span.SetAttributes(attribute.Int64("db.rows_affected", n))
+	}
+	return result, nil
+}
+
+func (c *tracedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	ctx, span, ok := startQuery(ctx, query)
+	if !ok {
+		return queryContext(ctx, c.Conn, query, args)
+	}
+	rows, err := queryContext(ctx, c.Conn, query, args)
+	if err != nil {
+		failQuery(span, err)
+		span.End()
+		return nil, err
+	}
+	// SQLite steps through the results as they are read, so the query runs
+	// until its rows are closed
+	return &tracedRows{Rows: rows, span: span}, nil
+}
+
+func (c *tracedConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	return prepareContext(ctx, c.Conn, query)
+}
+
+func (c *tracedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	return beginTx(ctx, c.Conn, opts)
+}
+
+func (c *tracedConn) Ping(ctx context.Context) error {
+	return ping(ctx, c.Conn)
+}
+
+// startQuery starts a span for query if ctx is part of a trace, and reports
+// whether it did
+func startQuery(ctx context.Context, query string) (context.Context, trace.Span, bool) {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return ctx, nil, false
+	}
+	operation, _, _ := strings.Cut(strings.TrimSpace(query), " ")
+	operation = strings.ToUpper(operation)
+	ctx, span := tracer.Start(ctx, "sqlite "+operation,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("db.system.name", "sqlite"),
+			attribute.String("db.operation.name", operation),
+			attribute.String("db.query.text", query),
+		))
+	return ctx, span, true
+}
+
+// failQuery records a statement's error on its span
+func failQuery(span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+// execContext runs query on conn, or returns driver.ErrSkip so database/sql
+// prepares it instead if conn cannot run statements directly
+func execContext(ctx context.Context, conn driver.Conn, query string, args []driver.NamedValue) (driver.Result, error) {
+	execer, ok := conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	return execer.ExecContext(ctx, query, args)
+}
+
+// queryContext runs query on conn, or returns driver.ErrSkip so database/sql
+// prepares it instead if conn cannot run queries directly
+func queryContext(ctx context.Context, conn driver.Conn, query string, args []driver.NamedValue) (driver.Rows, error) {
+	queryer, ok := conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	return queryer.QueryContext(ctx, query, args)
+}
+
+// prepareContext prepares query on conn, with ctx if conn supports it
+func prepareContext(ctx context.Context, conn driver.Conn, query string) (driver.Stmt, error) {
+	if preparer, ok := conn.(driver.ConnPrepareContext); ok {
+		return preparer.PrepareContext(ctx, query)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return conn.Prepare(query)
+}
+
+// beginTx begins a transaction on conn, with ctx and opts if conn supports
+// them
+func beginTx(ctx context.Context, conn driver.Conn, opts driver.TxOptions) (driver.Tx, error) {
+	if beginner, ok := conn.(driver.ConnBeginTx); ok {
+		return beginner.BeginTx(ctx, opts)
+	}
+	if opts.Isolation != 0 || opts.ReadOnly {
+		return nil, errors.New("store: driver does not support transaction options")
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return conn.Begin()
+}
+
+// ping checks conn if it supports it
+func ping(ctx context.Context, conn driver.Conn) error {
+	if pinger, ok := conn.(driver.Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+	return nil
+}
+
+// tracedRows ends a query's span when its rows are closed
+type tracedRows struct {
+	driver.Rows
+	span trace.Span
+}
+
+func (r *tracedRows) Close() error {
+	err := r.Rows.Close()
+	r.span.End()
+	return err
+}
@@ -0,0 +1,89 @@
+package store
+
+import (
+	"fmt"
+	"time"
+)
+
+// UsageEntry is application data one agent exchanged with one peer on a topic
+type UsageEntry struct {
+	Topic            string
+	Peer             string
+	BytesSent        int64
+	BytesReceived    int64
+	MessagesSent     int64
+	MessagesReceived int64
+}
+
+// TopicUsage is usage aggregated over all reports for a topic
+type TopicUsage struct {
+	Topic            string
+	BytesSent        int64
+	BytesReceived    int64
+	MessagesSent     int64
+	MessagesReceived int64
+	Peers            int64 // distinct peers reported
+	Reporters        int64 // distinct users whose agents reported
+}
+
+// RecordUsage stores one agent usage report for a network
+func (s *Store) RecordUsage(networkID, userID int64, periodStart, periodEnd time.Time, entries []UsageEntry) error {
+	tx, err := s.db.BeginTx(s.ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	start := formatTime(periodStart)
+	end := formatTime(periodEnd)
+	createdAt := now()
+	for _, e := range entries {
+		_, err := tx.ExecContext(s.ctx,
+			`INSERT INTO usage_records
+			 (network_id, user_id, topic, peer, bytes_sent, bytes_received, messages_sent, messages_received, period_start, period_end, created_at)
+			 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			networkID, userID, e.Topic, e.Peer, e.BytesSent, e.BytesReceived, e.MessagesSent, e.MessagesReceived, start, end, createdAt,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to record usage: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit usage: %w", err)
+	}
+	return nil
+}
+
+// GetNetworkUsage aggregates a network's usage per topic for reporting
+// periods ending at or after since
+func (s *Store) GetNetworkUsage(networkID int64, since time.Time) ([]*TopicUsage, error) {
+	rows, err := s.db.QueryContext(s.ctx,
+		`SELECT topic, SUM(bytes_sent), SUM(bytes_received), SUM(messages_sent), SUM(messages_received),
+		        COUNT(DISTINCT peer), COUNT(DISTINCT user_id)
+		 FROM usage_records
+		 WHERE network_id = ? AND period_end >= ?
+		 GROUP BY topic
+		 ORDER BY topic`,
+		networkID, formatTime(since),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get network usage: %w", err)
+	}
+	defer rows.Close()
+
+	var usage []*TopicUsage
+	for rows.Next() {
+		var u TopicUsage
+		if err := rows.Scan(&u.Topic, &u.BytesSent, &u.BytesReceived, &u.MessagesSent, &u.MessagesReceived, &u.Peers, &u.Reporters); err != nil {
+			return nil, fmt.Errorf("failed to scan usage: %w", err)
+		}
+		usage = append(usage, &u)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating usage: %w", err)
+	}
+
+	return usage, nil
+}
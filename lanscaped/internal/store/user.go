@@ -1,7 +1,10 @@
 package store
 
 import (
+	"crypto/sha256"
+	"crypto/subtle"
 	"database/sql"
+	"encoding/hex"
 	"fmt"
 	"time"
 )
@@ -11,13 +14,16 @@ type User struct {
 	ID        int64
 	Username  string
 	CreatedAt time.Time
+	// PendingClaim is set on users created by tailnet imports of earlier
+	// versions until their owner registers a passkey with the claim code
+	PendingClaim bool
 }
 
 // CreateUser creates a new user
 func (s *Store) CreateUser(username string) (*User, error) {
-	result, err := s.db.Exec(
-		"INSERT INTO users (username) VALUES (?)",
-		username,
+	result, err := s.db.ExecContext(s.ctx,
+		"INSERT INTO users (username, created_at) VALUES (?, ?)",
+		username, now(),
 	)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create user: %w", err)
@@ -33,13 +39,28 @@ func (s *Store) CreateUser(username string) (*User, error) {
 
 // GetUserByID retrieves a user by ID
 func (s *Store) GetUserByID(id int64) (*User, error) {
+	user, err := cached(s.cache, s.cache.users, id, func() (User, error) {
+		user, err := s.queryUserByID(id)
+		if err != nil {
+			return User{}, err
+		}
+		return *user, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// queryUserByID reads a user by ID from the database
+func (s *Store) queryUserByID(id int64) (*User, error) {
 	var user User
 	var createdAt string
 
-	err := s.db.QueryRow(
-		"SELECT id, username, created_at FROM users WHERE id = ?",
+	err := s.db.QueryRowContext(s.ctx,
+		"SELECT id, username, created_at, claim_code IS NOT NULL FROM users WHERE id = ?",
 		id,
-	).Scan(&user.ID, &user.Username, &createdAt)
+	).Scan(&user.ID, &user.Username, &createdAt, &user.PendingClaim)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, fmt.Errorf("user not found")
@@ -47,19 +68,36 @@ func (s *Store) GetUserByID(id int64) (*User, error) {
 		return nil, fmt.Errorf("failed to get user: %w", err)
 	}
 
-	user.CreatedAt, _ = time.Parse("2006-01-02 15:04:05", createdAt)
+	if user.CreatedAt, err = parseTime(createdAt); err != nil {
+		return nil, fmt.Errorf("failed to parse user created_at: %w", err)
+	}
 	return &user, nil
 }
 
 // GetUserByUsername retrieves a user by username
 func (s *Store) GetUserByUsername(username string) (*User, error) {
+	user, err := cached(s.cache, s.cache.usernames, username, func() (User, error) {
+		user, err := s.queryUserByUsername(username)
+		if err != nil {
+			return User{}, err
+		}
+		return *user, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// queryUserByUsername reads a user by username from the database
+func (s *Store) queryUserByUsername(username string) (*User, error) {
 	var user User
 	var createdAt string
 
-	err := s.db.QueryRow(
-		"SELECT id, username, created_at FROM users WHERE username = ?",
+	err := s.db.QueryRowContext(s.ctx,
+		"SELECT id, username, created_at, claim_code IS NOT NULL FROM users WHERE username = ?",
 		username,
-	).Scan(&user.ID, &user.Username, &createdAt)
+	).Scan(&user.ID, &user.Username, &createdAt, &user.PendingClaim)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, fmt.Errorf("user not found")
@@ -67,6 +105,45 @@ func (s *Store) GetUserByUsername(username string) (*User, error) {
 		return nil, fmt.Errorf("failed to get user: %w", err)
 	}
 
-	user.CreatedAt, _ = time.Parse("2006-01-02 15:04:05", createdAt)
+	if user.CreatedAt, err = parseTime(createdAt); err != nil {
+		return nil, fmt.Errorf("failed to parse user created_at: %w", err)
+	}
 	return &user, nil
 }
+
+// CheckClaimCode reports whether claimCode claims a pending user
+func (s *Store) CheckClaimCode(userID int64, claimCode string) (bool, error) {
+	var stored sql.NullString
+	err := s.db.QueryRowContext(s.ctx, "SELECT claim_code FROM users WHERE id = ?", userID).Scan(&stored)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return false, fmt.Errorf("user not found")
+		}
+		return false, fmt.Errorf("failed to get claim code: %w", err)
+	}
+	if !stored.Valid {
+		return false, nil
+	}
+	return subtle.ConstantTimeCompare([]byte(stored.String), []byte(hashClaimCode(claimCode))) == 1, nil
+}
+
+// ClaimUser marks a pending user as claimed by its owner
+func (s *Store) ClaimUser(userID int64) error {
+	user, err := s.GetUserByID(userID)
+	if err != nil {
+		return err
+	}
+	defer s.cache.users.delete(userID)
+	defer s.cache.usernames.delete(user.Username)
+
+	if _, err := s.db.ExecContext(s.ctx, "UPDATE users SET claim_code = NULL WHERE id = ?", userID); err != nil {
+		return fmt.Errorf("failed to claim user: %w", err)
+	}
+	return nil
+}
+
+// hashClaimCode returns the stored form of a claim code
+func hashClaimCode(claimCode string) string {
+	sum := sha256.Sum256([]byte(claimCode))
+	return hex.EncodeToString(sum[:])
+}
@@ -27,9 +27,9 @@ func (s *Store) CreateCredential(userID int64, credentialID, publicKey []byte, b
 		backupStateInt = 1
 	}
 
-	result, err := s.db.Exec(
-		"INSERT INTO webauthn_credentials (user_id, credential_id, public_key, backup_eligible, backup_state) VALUES (?, ?, ?, ?, ?)",
-		userID, credentialID, publicKey, backupEligibleInt, backupStateInt,
+	result, err := s.db.ExecContext(s.ctx,
+		"INSERT INTO webauthn_credentials (user_id, credential_id, public_key, backup_eligible, backup_state, created_at) VALUES (?, ?, ?, ?, ?, ?)",
+		userID, credentialID, publicKey, backupEligibleInt, backupStateInt, now(),
 	)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create credential: %w", err)
@@ -48,7 +48,7 @@ func (s *Store) GetCredentialByID(id int64) (*WebAuthnCredential, error) {
 	var cred WebAuthnCredential
 	var backupEligibleInt, backupStateInt int
 
-	err := s.db.QueryRow(
+	err := s.db.QueryRowContext(s.ctx,
 		"SELECT id, user_id, credential_id, public_key, counter, backup_eligible, backup_state FROM webauthn_credentials WHERE id = ?",
 		id,
 	).Scan(&cred.ID, &cred.UserID, &cred.CredentialID, &cred.PublicKey, &cred.Counter, &backupEligibleInt, &backupStateInt)
@@ -69,7 +69,7 @@ func (s *Store) GetCredentialByCredentialID(credentialID []byte) (*WebAuthnCrede
 	var cred WebAuthnCredential
 	var backupEligibleInt, backupStateInt int
 
-	err := s.db.QueryRow(
+	err := s.db.QueryRowContext(s.ctx,
 		"SELECT id, user_id, credential_id, public_key, counter, backup_eligible, backup_state FROM webauthn_credentials WHERE credential_id = ?",
 		credentialID,
 	).Scan(&cred.ID, &cred.UserID, &cred.CredentialID, &cred.PublicKey, &cred.Counter, &backupEligibleInt, &backupStateInt)
@@ -87,7 +87,7 @@ func (s *Store) GetCredentialByCredentialID(credentialID []byte) (*WebAuthnCrede
 
 // GetCredentialsByUserID retrieves all credentials for a user
 func (s *Store) GetCredentialsByUserID(userID int64) ([]*WebAuthnCredential, error) {
-	rows, err := s.db.Query(
+	rows, err := s.db.QueryContext(s.ctx,
 		"SELECT id, user_id, credential_id, public_key, counter, backup_eligible, backup_state FROM webauthn_credentials WHERE user_id = ?",
 		userID,
 	)
@@ -113,7 +113,7 @@ func (s *Store) GetCredentialsByUserID(userID int64) ([]*WebAuthnCredential, err
 
 // UpdateCredentialCounter updates the counter for a credential
 func (s *Store) UpdateCredentialCounter(credentialID []byte, counter uint32) error {
-	_, err := s.db.Exec(
+	_, err := s.db.ExecContext(s.ctx,
 		"UPDATE webauthn_credentials SET counter = ? WHERE credential_id = ?",
 		counter, credentialID,
 	)
@@ -2,13 +2,21 @@ package tailnet
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	neturl "net/url"
 	"os"
+	"slices"
 	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/jhead/lanscape/lanscaped/internal/secrets"
 )
 
 // Client represents a Headscale REST API client
@@ -16,6 +24,9 @@ type Client struct {
 	baseURL    string
 	apiKey     string
 	httpClient *http.Client
+	// ctx carries the trace of the request the client is used for, see
+	// WithContext
+	ctx context.Context
 }
 
 // NewClient creates a new Headscale client with default endpoint from environment
@@ -25,7 +36,10 @@ func NewClient() (*Client, error) {
 		endpoint = "http://localhost:8080"
 	}
 
-	apiKey := os.Getenv("HEADSCALE_API_KEY")
+	apiKey, err := secrets.Get("HEADSCALE_API_KEY")
+	if err != nil {
+		return nil, err
+	}
 
 	log.Printf("Headscale client initialized with endpoint: %s", endpoint)
 
@@ -39,11 +53,33 @@ func NewClientWithEndpoint(endpoint, apiKey string) *Client {
 		baseURL: endpoint,
 		apiKey:  apiKey,
 		httpClient: &http.Client{
-			Timeout: 10 * time.Second,
+			Timeout:   10 * time.Second,
+			Transport: tracedTransport,
 		},
+		ctx: context.Background(),
 	}
 }
 
+// tracedTransport records a span for each Headscale API call made as part
+// of a traced request, and passes the trace on to Headscale
+var tracedTransport = otelhttp.NewTransport(http.DefaultTransport,
+	otelhttp.WithFilter(func(r *http.Request) bool {
+		return trace.SpanContextFromContext(r.Context()).IsValid()
+	}),
+	otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+		return "headscale " + r.Method
+	}),
+)
+
+// WithContext returns a client for the same Headscale whose calls are made
+// with ctx, so they are traced as part of the request ctx belongs to and are
+// abandoned if it is canceled
+func (c *Client) WithContext(ctx context.Context) *Client {
+	scoped := *c
+	scoped.ctx = ctx
+	return &scoped
+}
+
 // CreateUserRequest represents the request to create a user in Headscale
 type CreateUserRequest struct {
 	Name string `json:"name"`
@@ -68,13 +104,16 @@ type HeadscaleUserResponse struct {
 
 // HeadscaleUsersListResponse represents the response from listing users (with name filter)
 type HeadscaleUsersListResponse struct {
-	Users []struct {
-		ID          string `json:"id"`
-		Name        string `json:"name"`
-		CreatedAt   string `json:"createdAt,omitempty"`
-		DisplayName string `json:"displayName,omitempty"`
-		Email       string `json:"email,omitempty"`
-	} `json:"users"`
+	Users []HeadscaleUser `json:"users"`
+}
+
+// HeadscaleUser represents a user in a Headscale users list
+type HeadscaleUser struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	CreatedAt   string `json:"createdAt,omitempty"`
+	DisplayName string `json:"displayName,omitempty"`
+	Email       string `json:"email,omitempty"`
 }
 
 // CreateUser creates a new user in Headscale
@@ -90,7 +129,7 @@ func (c *Client) CreateUser(username string) (*CreateUserResponse, error) {
 		return nil, fmt.Errorf("failed to marshal request: %w", err)
 	}
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
+	req, err := http.NewRequestWithContext(c.ctx, "POST", url, bytes.NewBuffer(jsonData))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
@@ -134,12 +173,9 @@ func (c *Client) CreateUser(username string) (*CreateUserResponse, error) {
 		return &userResp, nil
 	}
 
-	if resp.StatusCode == http.StatusConflict {
+	if isUserConflict(resp.StatusCode, body) {
 		log.Printf("User already exists in Headscale: %s", username)
-		// User already exists, return a success response
-		return &CreateUserResponse{
-			Name: username,
-		}, nil
+		return nil, fmt.Errorf("%w: %s", ErrUserExists, username)
 	}
 
 	return nil, fmt.Errorf("headscale API error: status %d, body: %s", resp.StatusCode, string(body))
@@ -147,9 +183,9 @@ func (c *Client) CreateUser(username string) (*CreateUserResponse, error) {
 
 // GetUser retrieves a user by name from Headscale
 func (c *Client) GetUser(username string) (*CreateUserResponse, error) {
-	url := fmt.Sprintf("%s/api/v1/user?name=%s", c.baseURL, username)
+	url := fmt.Sprintf("%s/api/v1/user?name=%s", c.baseURL, neturl.QueryEscape(username))
 
-	req, err := http.NewRequest("GET", url, nil)
+	req, err := http.NewRequestWithContext(c.ctx, "GET", url, nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
@@ -175,8 +211,14 @@ func (c *Client) GetUser(username string) (*CreateUserResponse, error) {
 	if resp.StatusCode == http.StatusOK {
 		// Try to parse as users list response (most common format)
 		var usersListResp HeadscaleUsersListResponse
-		if err := json.Unmarshal(body, &usersListResp); err == nil && len(usersListResp.Users) > 0 {
-			user := usersListResp.Users[0]
+		if err := json.Unmarshal(body, &usersListResp); err == nil && usersListResp.Users != nil {
+			// Headscale answers an empty list rather than 404, and versions
+			// that ignore the name filter list every user
+			i := slices.IndexFunc(usersListResp.Users, func(u HeadscaleUser) bool { return u.Name == username })
+			if i < 0 {
+				return nil, fmt.Errorf("%w: %s", ErrUserNotFound, username)
+			}
+			user := usersListResp.Users[i]
 			if user.ID == "" {
 				log.Printf("Warning: User ID is empty in users list response")
 				return nil, fmt.Errorf("user ID is empty in Headscale response")
@@ -217,7 +259,7 @@ func (c *Client) GetUser(username string) (*CreateUserResponse, error) {
 	}
 
 	if resp.StatusCode == http.StatusNotFound {
-		return nil, fmt.Errorf("user not found: %s", username)
+		return nil, fmt.Errorf("%w: %s", ErrUserNotFound, username)
 	}
 
 	return nil, fmt.Errorf("headscale API error: status %d, body: %s", resp.StatusCode, string(body))
@@ -264,7 +306,7 @@ func (c *Client) CreatePreauthKey(userID uint64, reusable bool, ephemeral bool,
 		return nil, fmt.Errorf("failed to marshal request: %w", err)
 	}
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
+	req, err := http.NewRequestWithContext(c.ctx, "POST", url, bytes.NewBuffer(jsonData))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
@@ -0,0 +1,172 @@
+package tailnet
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// Node represents a device registered with Headscale
+type Node struct {
+	ID          string         `json:"id"`
+	Name        string         `json:"name"`
+	GivenName   string         `json:"givenName,omitempty"`
+	Online      bool           `json:"online,omitempty"`
+	Expiry      string         `json:"expiry,omitempty"`
+	IPAddresses []string       `json:"ipAddresses,omitempty"`
+	LastSeen    string         `json:"lastSeen,omitempty"`
+	User        *HeadscaleUser `json:"user,omitempty"`
+}
+
+// HeadscaleNodesListResponse represents the response from listing nodes
+type HeadscaleNodesListResponse struct {
+	Nodes []Node `json:"nodes"`
+}
+
+// PreauthKey represents a preauth key of a Headscale user
+type PreauthKey struct {
+	ID         string `json:"id"`
+	Key        string `json:"key"`
+	Reusable   bool   `json:"reusable"`
+	Used       bool   `json:"used"`
+	Expiration string `json:"expiration"`
+}
+
+// HeadscalePreauthKeysListResponse represents the response from listing
+// preauth keys
+type HeadscalePreauthKeysListResponse struct {
+	PreAuthKeys []PreauthKey `json:"preAuthKeys"`
+}
+
+// ExpirePreauthKeyRequest represents the request to expire a preauth key
+type ExpirePreauthKeyRequest struct {
+	User uint64 `json:"user"`
+	Key  string `json:"key"`
+}
+
+// ListNodes lists the nodes of a user by name
+func (c *Client) ListNodes(username string) ([]Node, error) {
+	body, err := c.do("GET", "/api/v1/node?user="+url.QueryEscape(username), nil)
+	if err != nil {
+		return nil, err
+	}
+	var nodesResp HeadscaleNodesListResponse
+	if err := json.Unmarshal(body, &nodesResp); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal response: %w", err)
+	}
+	return nodesResp.Nodes, nil
+}
+
+// ListAllNodes lists every node of every user
+func (c *Client) ListAllNodes() ([]Node, error) {
+	body, err := c.do("GET", "/api/v1/node", nil)
+	if err != nil {
+		return nil, err
+	}
+	var nodesResp HeadscaleNodesListResponse
+	if err := json.Unmarshal(body, &nodesResp); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal response: %w", err)
+	}
+	return nodesResp.Nodes, nil
+}
+
+// ListUsers lists every user
+func (c *Client) ListUsers() ([]HeadscaleUser, error) {
+	body, err := c.do("GET", "/api/v1/user", nil)
+	if err != nil {
+		return nil, err
+	}
+	var usersResp HeadscaleUsersListResponse
+	if err := json.Unmarshal(body, &usersResp); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal response: %w", err)
+	}
+	return usersResp.Users, nil
+}
+
+// ExpireNode expires a node's key, logging the device out of the tailnet
+// until it authenticates again
+func (c *Client) ExpireNode(nodeID string) error {
+	log.Printf("Expiring node in Headscale: %s", nodeID)
+	_, err := c.do("POST", "/api/v1/node/"+url.PathEscape(nodeID)+"/expire", nil)
+	return err
+}
+
+// DeleteNode removes a node from the tailnet
+func (c *Client) DeleteNode(nodeID string) error {
+	log.Printf("Deleting node from Headscale: %s", nodeID)
+	_, err := c.do("DELETE", "/api/v1/node/"+url.PathEscape(nodeID), nil)
+	return err
+}
+
+// ListPreauthKeys lists the preauth keys of a user by user ID
+func (c *Client) ListPreauthKeys(userID uint64) ([]PreauthKey, error) {
+	body, err := c.do("GET", "/api/v1/preauthkey?user="+strconv.FormatUint(userID, 10), nil)
+	if err != nil {
+		return nil, err
+	}
+	var keysResp HeadscalePreauthKeysListResponse
+	if err := json.Unmarshal(body, &keysResp); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal response: %w", err)
+	}
+	return keysResp.PreAuthKeys, nil
+}
+
+// ExpirePreauthKey expires a preauth key so no more devices can register
+// with it
+func (c *Client) ExpirePreauthKey(userID uint64, key string) error {
+	log.Printf("Expiring preauth key in Headscale for user ID: %d", userID)
+	_, err := c.do("POST", "/api/v1/preauthkey/expire", ExpirePreauthKeyRequest{User: userID, Key: key})
+	return err
+}
+
+// DeleteUser deletes a user by ID. Headscale refuses to delete users that
+// still have nodes.
+func (c *Client) DeleteUser(userID string) error {
+	log.Printf("Deleting user from Headscale: %s", userID)
+	_, err := c.do("DELETE", "/api/v1/user/"+url.PathEscape(userID), nil)
+	return err
+}
+
+// do sends a request to the Headscale API and returns the body of a
+// successful response
+func (c *Client) do(method, path string, reqBody any) ([]byte, error) {
+	var reader io.Reader
+	if reqBody != nil {
+		jsonData, err := json.Marshal(reqBody)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal request: %w", err)
+		}
+		reader = bytes.NewReader(jsonData)
+	}
+
+	req, err := http.NewRequestWithContext(c.ctx, method, c.baseURL+path, reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	if c.apiKey != "" {
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.apiKey))
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return nil, fmt.Errorf("headscale API error: status %d, body: %s", resp.StatusCode, string(body))
+	}
+	return body, nil
+}
@@ -0,0 +1,158 @@
+package tailnet
+
+import (
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Platform is an operating system a device can be onboarded from
+type Platform string
+
+// Platforms with onboarding instructions
+const (
+	PlatformLinux   Platform = "linux"
+	PlatformMacOS   Platform = "macos"
+	PlatformWindows Platform = "windows"
+	PlatformIOS     Platform = "ios"
+	PlatformAndroid Platform = "android"
+)
+
+// Platforms lists every platform, in the order instructions are returned
+var Platforms = []Platform{PlatformLinux, PlatformMacOS, PlatformWindows, PlatformIOS, PlatformAndroid}
+
+// DeepLinkScheme is the URL scheme the Lanscape apps register for enrollment
+const DeepLinkScheme = "lanscape"
+
+// Enrollment is what a device needs to join a network's tailnet
+type Enrollment struct {
+	LoginServer string    // the network's Headscale endpoint
+	AuthKey     string    // a preauth key for the user
+	Expires     time.Time // when AuthKey expires
+	Hostname    string    // optional name for the device
+}
+
+// Instructions tells a user how to onboard a device on one platform
+type Instructions struct {
+	Platform Platform
+	// Steps are done in order; Commands are run as part of them
+	Steps    []string
+	Commands []string
+	// DeepLink opens a Lanscape app ready to enroll, on platforms with one
+	DeepLink string
+}
+
+// DeepLink returns a lanscape://adopt link carrying the enrollment, for
+// mobile apps and QR codes
+func (e Enrollment) DeepLink() string {
+	q := url.Values{}
+	q.Set("server", e.LoginServer)
+	q.Set("key", e.AuthKey)
+	if !e.Expires.IsZero() {
+		q.Set("expires", strconv.FormatInt(e.Expires.Unix(), 10))
+	}
+	if name := e.hostname(); name != "" {
+		q.Set("hostname", name)
+	}
+	return DeepLinkScheme + "://adopt?" + q.Encode()
+}
+
+// TailscaleUp returns the tailscale up command enrolling a device
+func (e Enrollment) TailscaleUp() string {
+	args := []string{"tailscale", "up",
+		"--login-server=" + shellQuote(e.LoginServer),
+		"--authkey=" + shellQuote(e.AuthKey),
+	}
+	if name := e.hostname(); name != "" {
+		args = append(args, "--hostname="+name)
+	}
+	return strings.Join(args, " ")
+}
+
+// Instructions returns the onboarding instructions for a platform, or false
+// if there are none
+func (e Enrollment) Instructions(platform Platform) (Instructions, bool) {
+	up := e.TailscaleUp()
+	switch platform {
+	case PlatformLinux:
+		return Instructions{
+			Platform: platform,
+			Steps: []string{
+				"Install Tailscale",
+				"Join the network",
+			},
+			Commands: []string{
+				"curl -fsSL https://tailscale.com/install.sh | sh",
+				"sudo " + up,
+			},
+		}, true
+	case PlatformMacOS:
+		return Instructions{
+			Platform: platform,
+			Steps: []string{
+				"Install Tailscale with Homebrew, or the standalone app from tailscale.com",
+				"Join the network from a terminal",
+			},
+			Commands: []string{
+				"brew install tailscale && sudo brew services start tailscale",
+				up,
+			},
+		}, true
+	case PlatformWindows:
+		return Instructions{
+			Platform: platform,
+			Steps: []string{
+				"Download and install Tailscale from https://tailscale.com/download/windows",
+				"Open PowerShell as Administrator",
+				"Join the network; --unattended keeps it connected when you sign out of Windows",
+			},
+			Commands: []string{
+				up + " --unattended",
+			},
+		}, true
+	case PlatformIOS, PlatformAndroid:
+		return Instructions{
+			Platform: platform,
+			Steps: []string{
+				"Install the Lanscape app",
+				"Open the link on this device, or scan its QR code, to join the network",
+			},
+			DeepLink: e.DeepLink(),
+		}, true
+	default:
+		return Instructions{}, false
+	}
+}
+
+// hostnameInvalid matches characters not allowed in a device hostname
+var hostnameInvalid = regexp.MustCompile(`[^a-z0-9-]+`)
+
+// hostname returns the device name as a valid hostname label, or empty
+func (e Enrollment) hostname() string {
+	name := hostnameInvalid.ReplaceAllString(strings.ToLower(e.Hostname), "-")
+	name = strings.Trim(name, "-")
+	if len(name) > 63 {
+		name = strings.TrimRight(name[:63], "-")
+	}
+	return name
+}
+
+// shellQuote single-quotes a value for POSIX shells and PowerShell when it
+// holds anything beyond characters safe in both. The two escape quotes
+// differently, so quotes are percent-encoded instead, which leaves the URLs
+// and keys passed here meaning the same.
+func shellQuote(s string) string {
+	safe := true
+	for _, r := range s {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_.:/@=+,", r)) {
+			safe = false
+			break
+		}
+	}
+	if safe && s != "" {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", "%27") + "'"
+}
@@ -0,0 +1,538 @@
+// Package tailnettest runs an in-memory fake of the Headscale API, so the
+// handlers that manage a network's tailnet can be exercised end-to-end
+// without a Headscale container. It serves the user, preauth key, and node
+// endpoints tailnet.Client calls over HTTP, with sequential IDs and
+// predictable keys, and lets devices register the way tailscaled would.
+package tailnettest
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jhead/lanscape/lanscaped/internal/tailnet"
+)
+
+// Server is a fake Headscale. Its zero value is not usable; create one with
+// NewServer.
+type Server struct {
+	// URL is the Headscale endpoint, for tailnet.NewClientWithEndpoint or a
+	// network's headscale_endpoint
+	URL string
+	// APIKey is the bearer token requests must carry; any is accepted when
+	// empty
+	APIKey string
+
+	srv *httptest.Server
+	mux *http.ServeMux
+
+	mu    sync.Mutex
+	now   func() time.Time
+	seq   map[string]uint64 // last ID handed out, by kind
+	users []*user
+	keys  []*preauthKey
+	nodes []*node
+	fail  map[string][]int // statuses the next requests to "METHOD path" fail with
+}
+
+type user struct {
+	id        uint64
+	name      string
+	createdAt time.Time
+}
+
+type preauthKey struct {
+	id         uint64
+	key        string
+	userID     uint64
+	reusable   bool
+	ephemeral  bool
+	used       bool
+	expiration time.Time // zero never expires
+	createdAt  time.Time
+}
+
+type node struct {
+	id        uint64
+	name      string
+	givenName string
+	userID    uint64
+	ips       []string
+	online    bool
+	ephemeral bool
+	expiry    time.Time // zero never expires
+	lastSeen  time.Time
+}
+
+// NewServer starts a fake Headscale requiring apiKey, which the caller
+// must Close
+func NewServer(apiKey string) *Server {
+	s := &Server{
+		APIKey: apiKey,
+		now:    time.Now,
+		seq:    make(map[string]uint64),
+		fail:   make(map[string][]int),
+	}
+	s.mux = http.NewServeMux()
+	s.mux.HandleFunc("GET /api/v1/user", s.handleListUsers)
+	s.mux.HandleFunc("POST /api/v1/user", s.handleCreateUser)
+	s.mux.HandleFunc("DELETE /api/v1/user/{id}", s.handleDeleteUser)
+	s.mux.HandleFunc("GET /api/v1/preauthkey", s.handleListPreauthKeys)
+	s.mux.HandleFunc("POST /api/v1/preauthkey", s.handleCreatePreauthKey)
+	s.mux.HandleFunc("POST /api/v1/preauthkey/expire", s.handleExpirePreauthKey)
+	s.mux.HandleFunc("GET /api/v1/node", s.handleListNodes)
+	s.mux.HandleFunc("POST /api/v1/node/{id}/expire", s.handleExpireNode)
+	s.mux.HandleFunc("DELETE /api/v1/node/{id}", s.handleDeleteNode)
+
+	s.srv = httptest.NewServer(s)
+	s.URL = s.srv.URL
+	return s
+}
+
+// Close shuts the server down
+func (s *Server) Close() {
+	s.srv.Close()
+}
+
+// Client returns a tailnet client for the server
+func (s *Server) Client() *tailnet.Client {
+	return tailnet.NewClientWithEndpoint(s.URL, s.APIKey)
+}
+
+// SetNow replaces the clock used for creation times, key and node expiry,
+// and last seen times, for tests that need them fixed
+func (s *Server) SetNow(now func() time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.now = now
+}
+
+// Fail makes the next request to method and path, such as "DELETE" and
+// "/api/v1/node/1", fail with status instead of being served. Calls queue
+// up, failing that many requests in turn.
+func (s *Server) Fail(method, path string, status int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k := method + " " + path
+	s.fail[k] = append(s.fail[k], status)
+}
+
+// ServeHTTP serves the Headscale API, so the fake can also be mounted on
+// another server
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.APIKey != "" && r.Header.Get("Authorization") != "Bearer "+s.APIKey {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	s.mu.Lock()
+	k := r.Method + " " + r.URL.Path
+	if statuses := s.fail[k]; len(statuses) > 0 {
+		s.fail[k] = statuses[1:]
+		s.mu.Unlock()
+		writeError(w, statuses[0], "injected failure")
+		return
+	}
+	s.mu.Unlock()
+
+	s.mux.ServeHTTP(w, r)
+}
+
+// AddUser creates a user, as if through the API
+func (s *Server) AddUser(name string) tailnet.HeadscaleUser {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if u := s.userByName(name); u != nil {
+		return s.userJSON(u)
+	}
+	return s.userJSON(s.addUser(name))
+}
+
+// Register enrolls a device with a preauth key the way tailscale up does,
+// returning its node. It fails if the key is unknown, expired, or a used
+// single-use key.
+func (s *Server) Register(authKey, hostname string) (tailnet.Node, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := slices.IndexFunc(s.keys, func(k *preauthKey) bool { return k.key == authKey })
+	if i < 0 {
+		return tailnet.Node{}, fmt.Errorf("unknown preauth key")
+	}
+	k := s.keys[i]
+	now := s.now()
+	if !k.expiration.IsZero() && !k.expiration.After(now) {
+		return tailnet.Node{}, fmt.Errorf("preauth key expired")
+	}
+	if k.used && !k.reusable {
+		return tailnet.Node{}, fmt.Errorf("preauth key already used")
+	}
+	k.used = true
+
+	id := s.nextID("node")
+	n := &node{
+		id:        id,
+		name:      hostname,
+		givenName: s.givenName(hostname),
+		userID:    k.userID,
+		ips: []string{
+			netip.AddrFrom4([4]byte{100, 64, byte(id >> 8), byte(id)}).String(),
+			fmt.Sprintf("fd7a:115c:a1e0::%x", id),
+		},
+		online:    true,
+		ephemeral: k.ephemeral,
+		lastSeen:  now,
+	}
+	s.nodes = append(s.nodes, n)
+	return s.nodeJSON(n), nil
+}
+
+// SetOnline marks a node connected or not, updating when it was last seen.
+// Ephemeral nodes are removed when they go offline, as Headscale does.
+func (s *Server) SetOnline(nodeID string, online bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := s.nodeByID(nodeID)
+	if n == nil {
+		return fmt.Errorf("node not found: %s", nodeID)
+	}
+	if !online && n.ephemeral {
+		s.deleteNode(n.id)
+		return nil
+	}
+	n.online = online
+	n.lastSeen = s.now()
+	return nil
+}
+
+// Users returns every user, in order of creation
+func (s *Server) Users() []tailnet.HeadscaleUser {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	users := make([]tailnet.HeadscaleUser, 0, len(s.users))
+	for _, u := range s.users {
+		users = append(users, s.userJSON(u))
+	}
+	return users
+}
+
+// Nodes returns every node, in order of registration
+func (s *Server) Nodes() []tailnet.Node {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.listNodes(nil)
+}
+
+func (s *Server) handleListUsers(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	name := r.URL.Query().Get("name")
+	resp := tailnet.HeadscaleUsersListResponse{Users: []tailnet.HeadscaleUser{}}
+	for _, u := range s.users {
+		if name == "" || u.name == name {
+			resp.Users = append(resp.Users, s.userJSON(u))
+		}
+	}
+	writeJSON(w, resp)
+}
+
+func (s *Server) handleCreateUser(w http.ResponseWriter, r *http.Request) {
+	var req tailnet.CreateUserRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Name == "" {
+		writeError(w, http.StatusBadRequest, "invalid user name")
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.userByName(req.Name) != nil {
+		writeError(w, http.StatusConflict, "user already exists")
+		return
+	}
+	var resp tailnet.HeadscaleUserResponse
+	resp.User = s.userJSON(s.addUser(req.Name))
+	writeJSON(w, resp)
+}
+
+func (s *Server) handleDeleteUser(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id, _ := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	i := slices.IndexFunc(s.users, func(u *user) bool { return u.id == id })
+	if i < 0 {
+		writeError(w, http.StatusNotFound, "user not found")
+		return
+	}
+	if slices.ContainsFunc(s.nodes, func(n *node) bool { return n.userID == id }) {
+		writeError(w, http.StatusInternalServerError, "user not empty: node(s) found")
+		return
+	}
+	s.users = slices.Delete(s.users, i, i+1)
+	s.keys = slices.DeleteFunc(s.keys, func(k *preauthKey) bool { return k.userID == id })
+	writeJSON(w, struct{}{})
+}
+
+func (s *Server) handleListPreauthKeys(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(r.URL.Query().Get("user"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid user")
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	resp := tailnet.HeadscalePreauthKeysListResponse{PreAuthKeys: []tailnet.PreauthKey{}}
+	for _, k := range s.keys {
+		if k.userID == id {
+			resp.PreAuthKeys = append(resp.PreAuthKeys, tailnet.PreauthKey{
+				ID:         strconv.FormatUint(k.id, 10),
+				Key:        k.key,
+				Reusable:   k.reusable,
+				Used:       k.used,
+				Expiration: timestamp(k.expiration),
+			})
+		}
+	}
+	writeJSON(w, resp)
+}
+
+func (s *Server) handleCreatePreauthKey(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		User       json.Number `json:"user"`
+		Reusable   bool        `json:"reusable"`
+		Ephemeral  bool        `json:"ephemeral"`
+		Expiration string      `json:"expiration"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request")
+		return
+	}
+	var expiration time.Time
+	if req.Expiration != "" {
+		var err error
+		if expiration, err = time.Parse(time.RFC3339, req.Expiration); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid expiration")
+			return
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := s.userByID(req.User.String())
+	if u == nil {
+		writeError(w, http.StatusNotFound, "user not found")
+		return
+	}
+	id := s.nextID("preauthkey")
+	sum := sha256.Sum256([]byte("preauthkey/" + strconv.FormatUint(id, 10)))
+	k := &preauthKey{
+		id:         id,
+		key:        hex.EncodeToString(sum[:24]),
+		userID:     u.id,
+		reusable:   req.Reusable,
+		ephemeral:  req.Ephemeral,
+		expiration: expiration,
+		createdAt:  s.now(),
+	}
+	s.keys = append(s.keys, k)
+
+	var resp tailnet.CreatePreauthKeyResponse
+	resp.PreAuthKey.Key = k.key
+	resp.PreAuthKey.User.ID = strconv.FormatUint(u.id, 10)
+	resp.PreAuthKey.User.Name = u.name
+	resp.PreAuthKey.Reusable = k.reusable
+	resp.PreAuthKey.Ephemeral = k.ephemeral
+	resp.PreAuthKey.Expiration = timestamp(k.expiration)
+	writeJSON(w, resp)
+}
+
+func (s *Server) handleExpirePreauthKey(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		User json.Number `json:"user"`
+		Key  string      `json:"key"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request")
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := slices.IndexFunc(s.keys, func(k *preauthKey) bool {
+		return k.key == req.Key && strconv.FormatUint(k.userID, 10) == req.User.String()
+	})
+	if i < 0 {
+		writeError(w, http.StatusNotFound, "preauth key not found")
+		return
+	}
+	s.keys[i].expiration = s.now()
+	writeJSON(w, struct{}{})
+}
+
+func (s *Server) handleListNodes(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var include func(*node) bool
+	if name := r.URL.Query().Get("user"); name != "" {
+		u := s.userByName(name)
+		include = func(n *node) bool { return u != nil && n.userID == u.id }
+	}
+	writeJSON(w, tailnet.HeadscaleNodesListResponse{Nodes: s.listNodes(include)})
+}
+
+func (s *Server) handleExpireNode(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := s.nodeByID(r.PathValue("id"))
+	if n == nil {
+		writeError(w, http.StatusNotFound, "node not found")
+		return
+	}
+	n.expiry = s.now()
+	n.online = false
+	writeJSON(w, map[string]tailnet.Node{"node": s.nodeJSON(n)})
+}
+
+func (s *Server) handleDeleteNode(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := s.nodeByID(r.PathValue("id"))
+	if n == nil {
+		writeError(w, http.StatusNotFound, "node not found")
+		return
+	}
+	s.deleteNode(n.id)
+	writeJSON(w, struct{}{})
+}
+
+// nextID returns the next ID of a kind; each kind is numbered from 1
+func (s *Server) nextID(kind string) uint64 {
+	s.seq[kind]++
+	return s.seq[kind]
+}
+
+func (s *Server) addUser(name string) *user {
+	u := &user{id: s.nextID("user"), name: name, createdAt: s.now()}
+	s.users = append(s.users, u)
+	return u
+}
+
+func (s *Server) userByName(name string) *user {
+	i := slices.IndexFunc(s.users, func(u *user) bool { return u.name == name })
+	if i < 0 {
+		return nil
+	}
+	return s.users[i]
+}
+
+func (s *Server) userByID(id string) *user {
+	i := slices.IndexFunc(s.users, func(u *user) bool { return strconv.FormatUint(u.id, 10) == id })
+	if i < 0 {
+		return nil
+	}
+	return s.users[i]
+}
+
+func (s *Server) nodeByID(id string) *node {
+	i := slices.IndexFunc(s.nodes, func(n *node) bool { return strconv.FormatUint(n.id, 10) == id })
+	if i < 0 {
+		return nil
+	}
+	return s.nodes[i]
+}
+
+// deleteNode removes a node
+func (s *Server) deleteNode(id uint64) {
+	s.nodes = slices.DeleteFunc(s.nodes, func(n *node) bool { return n.id == id })
+}
+
+// givenName returns hostname as a DNS label no other node has, suffixed
+// with a number if it is taken
+func (s *Server) givenName(hostname string) string {
+	base := strings.Trim(strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-' {
+			return r
+		}
+		return '-'
+	}, strings.ToLower(hostname)), "-")
+	if base == "" {
+		base = "node"
+	}
+	name := base
+	for i := 1; slices.ContainsFunc(s.nodes, func(n *node) bool { return n.givenName == name }); i++ {
+		name = base + "-" + strconv.Itoa(i)
+	}
+	return name
+}
+
+func (s *Server) listNodes(include func(*node) bool) []tailnet.Node {
+	nodes := []tailnet.Node{}
+	for _, n := range s.nodes {
+		if include == nil || include(n) {
+			nodes = append(nodes, s.nodeJSON(n))
+		}
+	}
+	return nodes
+}
+
+func (s *Server) userJSON(u *user) tailnet.HeadscaleUser {
+	return tailnet.HeadscaleUser{
+		ID:        strconv.FormatUint(u.id, 10),
+		Name:      u.name,
+		CreatedAt: timestamp(u.createdAt),
+	}
+}
+
+func (s *Server) nodeJSON(n *node) tailnet.Node {
+	node := tailnet.Node{
+		ID:          strconv.FormatUint(n.id, 10),
+		Name:        n.name,
+		GivenName:   n.givenName,
+		Online:      n.online,
+		Expiry:      timestamp(n.expiry),
+		IPAddresses: slices.Clone(n.ips),
+		LastSeen:    timestamp(n.lastSeen),
+	}
+	if u := s.userByID(strconv.FormatUint(n.userID, 10)); u != nil {
+		user := s.userJSON(u)
+		node.User = &user
+	}
+	return node
+}
+
+// timestamp formats t as Headscale does, empty for the zero time
+func timestamp(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError answers with status and a gRPC gateway error body, like
+// Headscale's
+func writeError(w http.ResponseWriter, status int, message string) {
+	code := 2 // UNKNOWN
+	switch status {
+	case http.StatusBadRequest:
+		code = 3 // INVALID_ARGUMENT
+	case http.StatusNotFound:
+		code = 5 // NOT_FOUND
+	case http.StatusConflict:
+		code = 6 // ALREADY_EXISTS
+	case http.StatusUnauthorized:
+		code = 16 // UNAUTHENTICATED
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]any{"code": code, "message": message, "details": []any{}})
+}
@@ -0,0 +1,179 @@
+package tailnettest_test
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/jhead/lanscape/lanscaped/internal/tailnet"
+	"github.com/jhead/lanscape/lanscaped/internal/tailnet/tailnettest"
+)
+
+func TestEnsureUser(t *testing.T) {
+	s := tailnettest.NewServer("secret")
+	defer s.Close()
+	c := s.Client()
+
+	created, err := c.EnsureUser("alice")
+	if err != nil {
+		t.Fatalf("EnsureUser: %v", err)
+	}
+	again, err := c.EnsureUser("alice")
+	if err != nil {
+		t.Fatalf("EnsureUser again: %v", err)
+	}
+	if again.ID != created.ID || again.Name != "alice" {
+		t.Fatalf("EnsureUser again = %+v, want %+v", again, created)
+	}
+
+	// A create that loses a race to another process finds the user instead
+	s.AddUser("bob")
+	s.Fail("GET", "/api/v1/user", http.StatusNotFound)
+	bob, err := c.EnsureUser("bob")
+	if err != nil {
+		t.Fatalf("EnsureUser after conflict: %v", err)
+	}
+	if bob.Name != "bob" {
+		t.Fatalf("EnsureUser after conflict = %+v", bob)
+	}
+
+	users, err := c.ListUsers()
+	if err != nil {
+		t.Fatalf("ListUsers: %v", err)
+	}
+	if len(users) != 2 {
+		t.Fatalf("ListUsers = %+v, want alice and bob", users)
+	}
+
+	if _, err := c.GetUser("carol"); !errors.Is(err, tailnet.ErrUserNotFound) {
+		t.Fatalf("GetUser of a missing user = %v, want ErrUserNotFound", err)
+	}
+	if _, err := tailnet.NewClientWithEndpoint(s.URL, "wrong").ListUsers(); err == nil {
+		t.Fatal("ListUsers with the wrong API key succeeded")
+	}
+}
+
+func TestPreauthKeys(t *testing.T) {
+	s := tailnettest.NewServer("secret")
+	defer s.Close()
+	c := s.Client()
+
+	user, err := c.EnsureUser("alice")
+	if err != nil {
+		t.Fatalf("EnsureUser: %v", err)
+	}
+	userID, _ := strconv.ParseUint(user.ID, 10, 64)
+
+	expiration := time.Now().Add(time.Hour)
+	key, err := c.CreatePreauthKey(userID, false, true, &expiration)
+	if err != nil {
+		t.Fatalf("CreatePreauthKey: %v", err)
+	}
+	if key.PreAuthKey.User.Name != "alice" || key.PreAuthKey.Reusable || !key.PreAuthKey.Ephemeral {
+		t.Fatalf("CreatePreauthKey = %+v", key.PreAuthKey)
+	}
+
+	if _, err := s.Register(key.PreAuthKey.Key, "laptop"); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	if _, err := s.Register(key.PreAuthKey.Key, "phone"); err == nil {
+		t.Fatal("a single-use key registered a second device")
+	}
+
+	reusable, err := c.CreatePreauthKey(userID, true, false, nil)
+	if err != nil {
+		t.Fatalf("CreatePreauthKey reusable: %v", err)
+	}
+	if err := c.ExpirePreauthKey(userID, reusable.PreAuthKey.Key); err != nil {
+		t.Fatalf("ExpirePreauthKey: %v", err)
+	}
+	if _, err := s.Register(reusable.PreAuthKey.Key, "desktop"); err == nil {
+		t.Fatal("an expired key registered a device")
+	}
+
+	keys, err := c.ListPreauthKeys(userID)
+	if err != nil {
+		t.Fatalf("ListPreauthKeys: %v", err)
+	}
+	if len(keys) != 2 || !keys[0].Used || keys[1].Used || keys[1].Expiration == "" {
+		t.Fatalf("ListPreauthKeys = %+v, want the used key and the expired one", keys)
+	}
+}
+
+func TestNodes(t *testing.T) {
+	s := tailnettest.NewServer("secret")
+	defer s.Close()
+	c := s.Client()
+
+	register := func(username, hostname string) tailnet.Node {
+		t.Helper()
+		user, err := c.EnsureUser(username)
+		if err != nil {
+			t.Fatalf("EnsureUser: %v", err)
+		}
+		userID, _ := strconv.ParseUint(user.ID, 10, 64)
+		key, err := c.CreatePreauthKey(userID, false, false, nil)
+		if err != nil {
+			t.Fatalf("CreatePreauthKey: %v", err)
+		}
+		node, err := s.Register(key.PreAuthKey.Key, hostname)
+		if err != nil {
+			t.Fatalf("Register: %v", err)
+		}
+		return node
+	}
+	laptop := register("alice", "Alice's Laptop")
+	register("alice", "Alice's Laptop")
+	phone := register("bob", "phone")
+
+	nodes, err := c.ListNodes("alice")
+	if err != nil {
+		t.Fatalf("ListNodes: %v", err)
+	}
+	if len(nodes) != 2 || nodes[0].GivenName != "alice-s-laptop" || nodes[1].GivenName != "alice-s-laptop-1" {
+		t.Fatalf("ListNodes(alice) = %+v, want two laptops with distinct names", nodes)
+	}
+	if nodes[0].User == nil || nodes[0].User.Name != "alice" || !nodes[0].Online || len(nodes[0].IPAddresses) != 2 {
+		t.Fatalf("ListNodes(alice)[0] = %+v", nodes[0])
+	}
+	if nodes, err := c.ListNodes("carol"); err != nil || len(nodes) != 0 {
+		t.Fatalf("ListNodes(carol) = %+v, %v; want none", nodes, err)
+	}
+
+	if err := c.ExpireNode(laptop.ID); err != nil {
+		t.Fatalf("ExpireNode: %v", err)
+	}
+	all, err := c.ListAllNodes()
+	if err != nil {
+		t.Fatalf("ListAllNodes: %v", err)
+	}
+	if len(all) != 3 || all[0].Expiry == "" || all[0].Online {
+		t.Fatalf("ListAllNodes after expiring %s = %+v", laptop.ID, all)
+	}
+
+	// Headscale refuses to delete a user with nodes
+	if err := c.DeleteUser(phone.User.ID); err == nil {
+		t.Fatal("DeleteUser with a node succeeded")
+	}
+	s.Fail("DELETE", "/api/v1/node/"+phone.ID, http.StatusInternalServerError)
+	if err := c.DeleteNode(phone.ID); err == nil {
+		t.Fatal("DeleteNode succeeded despite an injected failure")
+	}
+	if err := c.DeleteNode(phone.ID); err != nil {
+		t.Fatalf("DeleteNode: %v", err)
+	}
+	if err := c.DeleteNode(phone.ID); err == nil {
+		t.Fatal("DeleteNode of a deleted node succeeded")
+	}
+	if err := c.DeleteUser(phone.User.ID); err != nil {
+		t.Fatalf("DeleteUser: %v", err)
+	}
+	if nodes := s.Nodes(); len(nodes) != 2 {
+		t.Fatalf("Nodes = %+v, want alice's two", nodes)
+	}
+	if users := s.Users(); len(users) != 1 || users[0].Name != "alice" {
+		t.Fatalf("Users = %+v, want alice", users)
+	}
+}
@@ -0,0 +1,73 @@
+package tailnet
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// ErrUserExists is returned by CreateUser when Headscale already has a user
+// of that name
+var ErrUserExists = errors.New("user already exists")
+
+// ErrUserNotFound is returned by GetUser when Headscale has no user of that
+// name
+var ErrUserNotFound = errors.New("user not found")
+
+// ensureUsers deduplicates concurrent EnsureUser calls for the same user of
+// the same Headscale. Networks sharing a Headscale share its users, so calls
+// are keyed by endpoint rather than by network.
+var ensureUsers singleflight.Group
+
+// EnsureUser returns the Headscale user of a name, creating it if it does
+// not exist. Joining a network and adopting a device both provision the
+// user, often at the same time: concurrent calls in this process share one
+// provisioning, and a create that loses the race to another process falls
+// back to looking the user up.
+func (c *Client) EnsureUser(username string) (*CreateUserResponse, error) {
+	user, err, _ := ensureUsers.Do(c.baseURL+"\x00"+username, func() (any, error) {
+		return c.ensureUser(username)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return user.(*CreateUserResponse), nil
+}
+
+// ensureUser gets, creates, then gets again a user
+func (c *Client) ensureUser(username string) (*CreateUserResponse, error) {
+	user, err := c.GetUser(username)
+	if err == nil {
+		return user, nil
+	}
+	if !errors.Is(err, ErrUserNotFound) {
+		return nil, err
+	}
+
+	user, err = c.CreateUser(username)
+	if err == nil && user.ID != "" {
+		return user, nil
+	}
+	if err != nil && !errors.Is(err, ErrUserExists) {
+		return nil, err
+	}
+
+	// Created elsewhere in the meantime, or the create response had no ID
+	return c.GetUser(username)
+}
+
+// isUserConflict reports whether a failed create user response means the
+// user already exists. Newer Headscale versions answer 409, older ones 500
+// with the database's unique constraint error.
+func isUserConflict(status int, body []byte) bool {
+	if status == http.StatusConflict {
+		return true
+	}
+	if status < http.StatusBadRequest {
+		return false
+	}
+	body = bytes.ToLower(body)
+	return bytes.Contains(body, []byte("already exists")) || bytes.Contains(body, []byte("unique constraint"))
+}
@@ -0,0 +1,248 @@
+// Package topics keeps each network's signaling topic in step with the
+// network's membership: the topic admits only members, and peers of users
+// who lose membership are removed at once
+package topics
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jhead/lanscape/lanscaped/internal/auth"
+	"github.com/jhead/lanscape/lanscaped/internal/secrets"
+)
+
+// AuthorizerMembers is the signaling authorizer that admits peers presenting
+// a lanscaped membership attestation for the topic's network
+const AuthorizerMembers = "members"
+
+// ACL is a signaling topic's access policy, as the signaling admin API takes it
+type ACL struct {
+	RequireAuth bool   `json:"requireAuth"`
+	Authorizer  string `json:"authorizer,omitempty"`
+	Network     string `json:"network,omitempty"`
+	AppRelay    bool   `json:"appRelay,omitempty"`
+}
+
+// DefaultACL returns the ACL template applied to a network's topic when the
+// network is created: peers must prove their identity key and present an
+// attestation of membership in the network. Members may relay small payloads
+// through the signaling server when they cannot connect directly.
+func DefaultACL(network string) ACL {
+	return ACL{
+		RequireAuth: true,
+		Authorizer:  AuthorizerMembers,
+		Network:     network,
+		AppRelay:    true,
+	}
+}
+
+// TopicForNetwork returns the signaling topic of a network, which is named
+// after it like the network in its attestations
+func TopicForNetwork(network string) string {
+	return network
+}
+
+// Admin manages signaling topics
+type Admin interface {
+	// SetACL replaces the ACL of a topic
+	SetACL(ctx context.Context, topic string, acl ACL) error
+	// Kick disconnects the peers with the given identity keys from a topic,
+	// or every peer if all is set, and bans the keys until banUntil
+	Kick(ctx context.Context, topic string, publicKeys []string, all bool, banUntil time.Time) error
+	// Unban lifts the bans on identity keys in a topic
+	Unban(ctx context.Context, topic string, publicKeys []string) error
+	// Stats reports the signaling server's topics and their relay results
+	// over the last window
+	Stats(ctx context.Context, window time.Duration) (*Stats, error)
+}
+
+// Stats is a snapshot of a signaling server's topics, as its admin API
+// reports them
+type Stats struct {
+	WindowSeconds int64        `json:"windowSeconds"`
+	Topics        []TopicStats `json:"topics"`
+}
+
+// TopicStats describes one signaling topic
+type TopicStats struct {
+	Topic      string   `json:"topic"`
+	Peers      int      `json:"peers"`
+	Observers  int      `json:"observers"`
+	PublicKeys []string `json:"publicKeys"`
+	// Relays counts relay attempts by result ("delivered", "dropped", ...)
+	Relays map[string]int64 `json:"relays"`
+}
+
+// RegisterNetwork applies the default ACL to a network's topic
+func RegisterNetwork(ctx context.Context, a Admin, network string) error {
+	return a.SetACL(ctx, TopicForNetwork(network), DefaultACL(network))
+}
+
+// RemoveMember disconnects a former member's agents from a network's topic.
+// Their attestations stay valid until they expire, so the keys are banned
+// from the topic until then.
+func RemoveMember(ctx context.Context, a Admin, network string, publicKeys []string) error {
+	if len(publicKeys) == 0 {
+		return nil
+	}
+	return a.Kick(ctx, TopicForNetwork(network), publicKeys, false, time.Now().Add(auth.AttestationTTL))
+}
+
+// AddMember lifts bans left on a returning member's agents
+func AddMember(ctx context.Context, a Admin, network string, publicKeys []string) error {
+	if len(publicKeys) == 0 {
+		return nil
+	}
+	return a.Unban(ctx, TopicForNetwork(network), publicKeys)
+}
+
+// CloseNetwork disconnects every peer from a deleted network's topic and
+// bans its members' agents until their attestations expire. The topic keeps
+// its ACL, so it stays closed.
+func CloseNetwork(ctx context.Context, a Admin, network string, publicKeys []string) error {
+	return a.Kick(ctx, TopicForNetwork(network), publicKeys, true, time.Now().Add(auth.AttestationTTL))
+}
+
+// Sync registers the topics of existing networks, covering networks created
+// before a signaling admin was configured or while signaling was unreachable. It
+// keeps going past failures and returns the first one.
+func Sync(ctx context.Context, a Admin, networks []string) error {
+	var first error
+	for _, network := range networks {
+		if err := RegisterNetwork(ctx, a, network); err != nil {
+			log.Printf("Failed to register signaling topic for network %s: %v", network, err)
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	return first
+}
+
+// AdminClient is an Admin for the signaling server's admin API
+type AdminClient struct {
+	baseURL    string
+	token      string
+	httpClient *http.Client
+}
+
+// NewAdminClient creates a client for the signaling admin API at baseURL,
+// authenticating with the server's ADMIN_TOKEN
+func NewAdminClient(baseURL, token string) *AdminClient {
+	return &AdminClient{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		token:   token,
+		httpClient: &http.Client{
+			Timeout: 10 * time.Second,
+		},
+	}
+}
+
+// NewAdminClientFromEnv creates a client from SIGNALING_ADMIN_URL and
+// SIGNALING_ADMIN_TOKEN, or returns nil if SIGNALING_ADMIN_URL is unset
+func NewAdminClientFromEnv() (*AdminClient, error) {
+	endpoint := os.Getenv("SIGNALING_ADMIN_URL")
+	if endpoint == "" {
+		return nil, nil
+	}
+	token, err := secrets.Get("SIGNALING_ADMIN_TOKEN")
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Signaling admin client initialized with endpoint: %s", endpoint)
+	return NewAdminClient(endpoint, token), nil
+}
+
+// SetACL replaces the ACL of a topic
+func (c *AdminClient) SetACL(ctx context.Context, topic string, acl ACL) error {
+	if err := c.do(ctx, http.MethodPut, topic, "acl", acl); err != nil {
+		return fmt.Errorf("failed to set topic ACL: %w", err)
+	}
+	return nil
+}
+
+// Kick disconnects peers from a topic and bans their keys
+func (c *AdminClient) Kick(ctx context.Context, topic string, publicKeys []string, all bool, banUntil time.Time) error {
+	req := struct {
+		PublicKeys []string  `json:"publicKeys"`
+		All        bool      `json:"all"`
+		BanUntil   time.Time `json:"banUntil"`
+		Reason     string    `json:"reason"`
+	}{publicKeys, all, banUntil, "no longer a network member"}
+	if err := c.do(ctx, http.MethodPost, topic, "kick", req); err != nil {
+		return fmt.Errorf("failed to kick peers: %w", err)
+	}
+	return nil
+}
+
+// Unban lifts the bans on identity keys in a topic
+func (c *AdminClient) Unban(ctx context.Context, topic string, publicKeys []string) error {
+	req := struct {
+		PublicKeys []string `json:"publicKeys"`
+	}{publicKeys}
+	if err := c.do(ctx, http.MethodPost, topic, "unban", req); err != nil {
+		return fmt.Errorf("failed to lift bans: %w", err)
+	}
+	return nil
+}
+
+// Stats fetches the signaling server's topic and relay stats
+func (c *AdminClient) Stats(ctx context.Context, window time.Duration) (*Stats, error) {
+	endpoint := fmt.Sprintf("%s/admin/stats?window=%s", c.baseURL, url.QueryEscape(window.String()))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch signaling stats: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("failed to fetch signaling stats: status %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+
+	var stats Stats
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		return nil, fmt.Errorf("failed to decode signaling stats: %w", err)
+	}
+	return &stats, nil
+}
+
+// do sends a JSON request to /admin/topics/{topic}/{action}
+func (c *AdminClient) do(ctx context.Context, method, topic, action string, body any) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	endpoint := fmt.Sprintf("%s/admin/topics/%s/%s", c.baseURL, url.PathEscape(topic), action)
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+c.token)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("status %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+// Package tracing sets up OpenTelemetry tracing for lanscaped. Every API
+// request gets a trace, with spans for the store queries and Headscale calls
+// made while serving it, and its trace ID is returned in the X-Trace-Id
+// header and logged so a failed request can be matched to its trace.
+//
+// Traces are exported over OTLP/HTTP when OTEL_EXPORTER_OTLP_ENDPOINT or
+// OTEL_EXPORTER_OTLP_TRACES_ENDPOINT is set, configured by the standard
+// OTEL_* environment variables. Otherwise trace IDs are still generated for
+// logs and responses, but spans are not exported.
+package tracing
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/felixge/httpsnoop"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/jhead/lanscape/lanscaped/internal/buildinfo"
+)
+
+// Header is the response header carrying the request's trace ID
+const Header = "X-Trace-Id"
+
+// serviceName names lanscaped's spans unless OTEL_SERVICE_NAME overrides it
+const serviceName = "lanscaped"
+
+// FromEnv installs the global tracer provider and propagators, exporting
+// spans if an OTLP endpoint is configured. The returned function flushes
+// pending spans and stops exporting.
+func FromEnv() (func(context.Context) error, error) {
+	ctx := context.Background()
+	res, err := resource.New(ctx,
+		resource.WithAttributes(
+			attribute.String("service.name", serviceName),
+			attribute.String("service.version", buildinfo.Get().Version),
+		),
+		// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES take precedence
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := []sdktrace.TracerProviderOption{sdktrace.WithResource(res)}
+	if endpoint := exportEndpoint(); endpoint != "" {
+		exporter, err := otlptracehttp.New(ctx)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, sdktrace.WithBatcher(exporter))
+		log.Printf("Exporting traces to %s", endpoint)
+	}
+
+	provider := sdktrace.NewTracerProvider(opts...)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return provider.Shutdown, nil
+}
+
+// exportEndpoint returns the configured OTLP endpoint for traces, empty if
+// none is
+func exportEndpoint() string {
+	if endpoint := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"); endpoint != "" {
+		return endpoint
+	}
+	return os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+}
+
+// Handler traces each request to next, continuing a trace the caller passed
+// in a traceparent header. It must wrap the http.ServeMux directly, so spans
+// can be named after the route pattern the mux matched.
+func Handler(next http.Handler) http.Handler {
+	return otelhttp.NewHandler(logged(next), serviceName, otelhttp.WithSpanNameFormatter(spanName))
+}
+
+// spanName names a request's span after its route, e.g.
+// "GET /v1/networks/{id}", or just its method until the route is known
+func spanName(_ string, r *http.Request) string {
+	if r.Pattern != "" {
+		return r.Pattern
+	}
+	return r.Method
+}
+
+// logged sets the X-Trace-Id header on each response and logs the request
+// with its trace ID once it is served
+func logged(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceID := trace.SpanContextFromContext(r.Context()).TraceID().String()
+		w.Header().Set(Header, traceID)
+
+		m := httpsnoop.CaptureMetrics(next, w, r)
+
+		log.Printf("%s %s: %d in %s (trace %s)", r.Method, r.URL.Path, m.Code, m.Duration.Round(time.Millisecond), traceID)
+	})
+}
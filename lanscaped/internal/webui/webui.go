@@ -0,0 +1,171 @@
+// Package webui serves the web UI from lanscaped, so a deployment is one
+// binary and the UI shares the API's origin, which WebAuthn requires to match
+// WEBAUTHN_RP_ORIGIN. Assets are embedded at build time from dist, which is
+// empty in the repository: copy packages/webui/dist into it before building
+// lanscaped to include the UI.
+package webui
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+//go:embed all:dist
+var embedded embed.FS
+
+// DefaultCSP is the Content-Security-Policy of the UI's pages. Besides its
+// own origin, the UI connects to the local agent.
+const DefaultCSP = "default-src 'self'; script-src 'self'; style-src 'self' 'unsafe-inline'; " +
+	"img-src 'self' data: blob:; font-src 'self' data:; " +
+	"connect-src 'self' http://localhost:* http://127.0.0.1:* ws://localhost:* ws://127.0.0.1:*; " +
+	"frame-ancestors 'none'; base-uri 'self'; form-action 'self'"
+
+// APIPrefixes are the paths of the API rather than the UI. The UI answers
+// them with 404 instead of index.html, so a mistyped API route is not
+// mistaken for a page.
+var APIPrefixes = []string{"/v1/", "/.well-known/", "/healthz"}
+
+// UI serves the web UI
+type UI struct {
+	http.Handler
+	// CSP is the Content-Security-Policy the UI's pages need; empty when
+	// proxying to a dev server, whose pages have inline scripts
+	CSP string
+	// Source describes where the UI is served from, for logging
+	Source string
+}
+
+// FromEnv creates the UI from WEBUI_DEV_URL, WEBUI_DIR, and WEBUI_CSP. With
+// WEBUI_DEV_URL it proxies to a dev server such as `vite`; with WEBUI_DIR it
+// serves the assets in that directory; otherwise it serves the embedded
+// assets. It returns nil when neither variable is set and no assets are
+// embedded.
+func FromEnv() (*UI, error) {
+	var ui *UI
+	if v := os.Getenv("WEBUI_DEV_URL"); v != "" {
+		target, err := url.Parse(v)
+		if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+			return nil, fmt.Errorf("invalid WEBUI_DEV_URL %q: must be an http or https URL", v)
+		}
+		ui = &UI{Handler: NewDevProxy(target), Source: "dev server " + target.String()}
+	} else if dir := os.Getenv("WEBUI_DIR"); dir != "" {
+		handler, err := NewStatic(os.DirFS(dir))
+		if err != nil {
+			return nil, fmt.Errorf("invalid WEBUI_DIR %q: %w", dir, err)
+		}
+		ui = &UI{Handler: handler, CSP: DefaultCSP, Source: dir}
+	} else {
+		assets, err := fs.Sub(embedded, "dist")
+		if err != nil {
+			return nil, fmt.Errorf("failed to open embedded web UI: %w", err)
+		}
+		handler, err := NewStatic(assets)
+		if err != nil {
+			// Built without the UI
+			return nil, nil
+		}
+		ui = &UI{Handler: handler, CSP: DefaultCSP, Source: "embedded assets"}
+	}
+
+	if v, ok := os.LookupEnv("WEBUI_CSP"); ok {
+		ui.CSP = v
+	}
+	return ui, nil
+}
+
+// NewStatic serves the built UI in assets. Paths that are not files get
+// index.html so the UI can route them itself, except paths that look like a
+// missing asset. Hashed assets under assets/ are cached indefinitely and
+// everything else is revalidated, so a new build takes effect on reload.
+func NewStatic(assets fs.FS) (http.Handler, error) {
+	if _, err := fs.Stat(assets, "index.html"); err != nil {
+		return nil, fmt.Errorf("web UI has no index.html: %w", err)
+	}
+	files := http.FileServerFS(assets)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isAPIPath(r.URL.Path) {
+			http.NotFound(w, r)
+			return
+		}
+
+		name := strings.TrimPrefix(path.Clean(r.URL.Path), "/")
+		if name != "" && name != "index.html" {
+			if info, err := fs.Stat(assets, name); err == nil && !info.IsDir() {
+				if strings.HasPrefix(name, "assets/") {
+					w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+				} else {
+					w.Header().Set("Cache-Control", "no-cache")
+				}
+				files.ServeHTTP(w, r)
+				return
+			}
+			if path.Ext(name) != "" && !strings.Contains(r.Header.Get("Accept"), "text/html") {
+				http.NotFound(w, r)
+				return
+			}
+		}
+
+		// FileServer would redirect /index.html to /, so the page is served
+		// directly
+		index, err := fs.ReadFile(assets, "index.html")
+		if err != nil {
+			log.Printf("Error reading web UI index.html: %v", err)
+			http.Error(w, "Web UI unavailable", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-cache")
+		http.ServeContent(w, r, "index.html", time.Time{}, bytes.NewReader(index))
+	}), nil
+}
+
+// NewDevProxy proxies the UI to a dev server at target, including its hot
+// reload websocket
+func NewDevProxy(target *url.URL) http.Handler {
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(target)
+			pr.SetXForwarded()
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Printf("Error proxying %s to web UI dev server: %v", r.URL.Path, err)
+			http.Error(w, "Web UI dev server unavailable", http.StatusBadGateway)
+		},
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isAPIPath(r.URL.Path) {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Header.Get("Upgrade") != "" {
+			// The server's timeouts would otherwise close the hot reload
+			// websocket
+			rc := http.NewResponseController(w)
+			rc.SetReadDeadline(time.Time{})
+			rc.SetWriteDeadline(time.Time{})
+		}
+		proxy.ServeHTTP(w, r)
+	})
+}
+
+// isAPIPath reports whether a path belongs to the API
+func isAPIPath(p string) bool {
+	for _, prefix := range APIPrefixes {
+		if strings.HasPrefix(p, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,33 @@
+// Package lanscaped runs the lanscaped API server inside another Go program.
+// It is configured from the same environment variables as the lanscaped
+// command (DATABASE_URL, JWT_PRIVATE_KEY, WEBAUTHN_*), except for the port.
+package lanscaped
+
+import (
+	"github.com/jhead/lanscape/lanscaped/internal/api"
+	"github.com/jhead/lanscape/lanscaped/internal/topics"
+)
+
+// Server is the lanscaped API server. Start or Serve it, then Stop it to
+// shut down and close the database.
+type Server = api.Server
+
+// NewServer opens the database and creates a server for the given port
+func NewServer(port int) (*Server, error) {
+	return api.NewServer(port)
+}
+
+// TopicACL is the access policy lanscaped applies to each network's signaling
+// topic
+type TopicACL = topics.ACL
+
+// SignalingAdmin manages network topics on a signaling server. Replace the
+// default admin API client with Server.SetSignalingAdmin.
+type SignalingAdmin = topics.Admin
+
+// SignalingStats is a signaling server's topics and relay results, as
+// SignalingAdmin.Stats reports them
+type SignalingStats = topics.Stats
+
+// SignalingTopicStats describes one topic in SignalingStats
+type SignalingTopicStats = topics.TopicStats
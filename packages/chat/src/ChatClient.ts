@@ -80,6 +80,12 @@ export interface ChatClientConfig {
    * WebSocket URL for the agent (e.g., 'ws://localhost:8082')
    */
   agentUrl: string
+
+  /**
+   * Local token of an agent running with -strict-local
+   * (the contents of <data-dir>/local-token)
+   */
+  localToken?: string
   
   /**
    * Optional persistence provider.
@@ -105,6 +111,12 @@ export interface ChatClientAdvancedConfig {
    * WebSocket URL for the agent (e.g., 'ws://localhost:8082')
    */
   agentUrl: string
+
+  /**
+   * Local token of an agent running with -strict-local
+   * (the contents of <data-dir>/local-token)
+   */
+  localToken?: string
   
   /**
    * Optional persistence provider.
@@ -360,6 +372,7 @@ export class ChatClient {
       // Create transport and connect
       const transport = new WebSocketTransport({
         agentUrl: agentUrl,
+        localToken: this.config.localToken,
       })
       this.transport = transport
 
@@ -13,8 +13,8 @@ export type {
   Network,
 } from './ChatClient'
 
-export { WebSocketTransport } from './transport'
-export type { WebSocketTransportConfig, PeerTransport } from './transport'
+export { WebSocketTransport, closeReasonFromCode, isRetryableClose } from './transport'
+export type { WebSocketTransportConfig, PeerTransport, CloseReason } from './transport'
 
 export { YjsSync } from './sync'
 export type { AwarenessState } from './sync'
@@ -8,12 +8,62 @@ export type PeerTransportEventType =
   | 'peer-disconnected'
   | 'message'
   | 'error'
+  | 'closed'
+  | 'health'
+
+/**
+ * Why the agent or signaling server closed a connection. Matches the close
+ * reasons shared by the Go signaling server and agent.
+ */
+export type CloseReason =
+  | 'auth-failed'
+  | 'draining'
+  | 'rate-limited'
+  | 'protocol-error'
+  | 'superseded'
+
+/**
+ * WebSocket close codes for each close reason
+ */
+export const CLOSE_CODES: Record<CloseReason, number> = {
+  'auth-failed': 4001,
+  draining: 4002,
+  'rate-limited': 4003,
+  'protocol-error': 4004,
+  superseded: 4005,
+}
+
+/**
+ * Returns the close reason for a WebSocket close code, if it is one of ours
+ */
+export function closeReasonFromCode(code: number): CloseReason | undefined {
+  return (Object.keys(CLOSE_CODES) as CloseReason[]).find((reason) => CLOSE_CODES[reason] === code)
+}
+
+/**
+ * Whether a client should reconnect after a close with this reason
+ */
+export function isRetryableClose(reason: CloseReason): boolean {
+  return reason === 'draining' || reason === 'rate-limited'
+}
+
+/**
+ * The agent's health from its latest heartbeat
+ */
+export interface AgentHealth {
+  signalingConnected: boolean
+  peers: number // peers with an open data channel
+  tailscaleUp: boolean
+  intervalMs: number // until the next heartbeat
+}
 
 export interface PeerTransportEvent {
   type: PeerTransportEventType
   peerId?: string
   data?: ArrayBuffer
   error?: Error
+  closeReason?: CloseReason // 'closed' events: why, if the server said
+  health?: AgentHealth // 'health' events
 }
 
 export type PeerTransportListener = (event: PeerTransportEvent) => void
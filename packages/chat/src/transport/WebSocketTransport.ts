@@ -1,7 +1,16 @@
-import { PeerTransport, PeerTransportEvent, PeerTransportListener, Peer } from './PeerTransport'
+import {
+  PeerTransport,
+  PeerTransportEvent,
+  PeerTransportListener,
+  Peer,
+  AgentHealth,
+  closeReasonFromCode,
+  isRetryableClose,
+} from './PeerTransport'
 
 export interface WebSocketTransportConfig {
   agentUrl: string // e.g., 'ws://localhost:8082'
+  localToken?: string // required by agents running with -strict-local
 }
 
 // Protocol message types
@@ -12,11 +21,12 @@ interface BrowserMessage {
 }
 
 interface AgentMessage {
-  type: 'data' | 'peer-connected' | 'peer-disconnected' | 'error' | 'welcome'
+  type: 'data' | 'peer-connected' | 'peer-disconnected' | 'error' | 'welcome' | 'heartbeat'
   peerId?: string
   selfId?: string
   data?: string | ArrayBuffer // Base64 string from Go, or ArrayBuffer for fallback
   error?: string
+  health?: AgentHealth
 }
 
 /**
@@ -29,6 +39,7 @@ export class WebSocketTransport implements PeerTransport {
   private listeners = new Set<PeerTransportListener>()
   private selfId: string | null = null
   private connectedPeers = new Set<string>()
+  private health: AgentHealth | null = null
   private config: WebSocketTransportConfig
   private reconnectAttempts = 0
   private maxReconnectAttempts = 5
@@ -55,9 +66,15 @@ export class WebSocketTransport implements PeerTransport {
     const wsUrl = this.config.agentUrl
     console.log('[WebSocketTransport] Connecting to agent:', wsUrl)
 
+    // Browsers cannot set headers on a WebSocket, so the token goes in the query
+    const url = new URL(wsUrl)
+    if (this.config.localToken) {
+      url.searchParams.set('token', this.config.localToken)
+    }
+
     return new Promise((resolve, reject) => {
       try {
-        this.ws = new WebSocket(wsUrl)
+        this.ws = new WebSocket(url)
 
         this.ws.onopen = () => {
           console.log('[WebSocketTransport] Connected to agent')
@@ -77,12 +94,24 @@ export class WebSocketTransport implements PeerTransport {
           }
         }
 
-        this.ws.onclose = () => {
-          console.log('[WebSocketTransport] Disconnected from agent')
+        this.ws.onclose = (event) => {
+          const reason = closeReasonFromCode(event.code)
+          console.log('[WebSocketTransport] Disconnected from agent', { code: event.code, reason: event.reason })
           this.ws = null
-          if (!this.destroyed) {
-            this.attemptReconnect()
+          this.health = null
+          this.emit({ type: 'closed', closeReason: reason })
+          if (this.destroyed) {
+            return
+          }
+          if (reason && !isRetryableClose(reason)) {
+            console.log('[WebSocketTransport] Not reconnecting after close:', reason)
+            return
           }
+          if (reason === 'draining') {
+            // The server is going away on purpose; start over with a quick retry
+            this.reconnectAttempts = 0
+          }
+          this.attemptReconnect()
         }
       } catch (error) {
         reject(error)
@@ -211,6 +240,13 @@ export class WebSocketTransport implements PeerTransport {
           }
           break
 
+        case 'heartbeat':
+          if (msg.health) {
+            this.health = msg.health
+            this.emit({ type: 'health', health: msg.health })
+          }
+          break
+
         case 'error':
           console.error('[WebSocketTransport] Agent error:', msg.error)
           this.emit({
@@ -252,6 +288,14 @@ export class WebSocketTransport implements PeerTransport {
     return this.selfId
   }
 
+  /**
+   * The agent's health from its latest heartbeat, or null when not connected
+   * to the agent or before the first heartbeat
+   */
+  getAgentHealth(): AgentHealth | null {
+    return this.health
+  }
+
   getConnectedPeers(): Peer[] {
     return Array.from(this.connectedPeers).map((id) => ({
       id,
@@ -4,7 +4,10 @@ export type {
   PeerTransportEventType,
   PeerTransportListener,
   Peer,
+  CloseReason,
+  AgentHealth,
 } from './PeerTransport'
+export { CLOSE_CODES, closeReasonFromCode, isRetryableClose } from './PeerTransport'
 
 export { WebSocketTransport } from './WebSocketTransport'
 export type { WebSocketTransportConfig } from './WebSocketTransport'
@@ -4,6 +4,7 @@ import { NetworkProvider } from './contexts/NetworkContext'
 import { AuthForm } from './components/AuthForm'
 import { Dashboard } from './components/Dashboard'
 import { NetworkManager } from './components/NetworkManager'
+import { DeviceApproval } from './components/DeviceApproval'
 
 function App() {
   const { isAuthenticated } = useAuth()
@@ -15,6 +16,7 @@ function App() {
           <Routes>
             <Route path="/chat" element={<Dashboard />} />
             <Route path="/networks" element={<NetworkManager />} />
+            <Route path="/device" element={<DeviceApproval />} />
             <Route path="/" element={<Navigate to="/chat" replace />} />
           </Routes>
         </NetworkProvider>
@@ -0,0 +1,66 @@
+import { useState } from 'react'
+import { useSearchParams } from 'react-router-dom'
+import { approveDevice } from '../utils/api'
+import { StatusMessage } from './StatusMessage'
+import type { StatusType } from '../types'
+
+// DeviceApproval lets a signed-in user approve the code a device, such as
+// `lanscape-agent login`, displayed while it waits to sign in
+export function DeviceApproval() {
+  const [searchParams] = useSearchParams()
+  const [userCode, setUserCode] = useState(searchParams.get('code') || '')
+  const [status, setStatus] = useState<{ type: StatusType; message: string | null }>({
+    type: null,
+    message: null,
+  })
+  const [loading, setLoading] = useState(false)
+
+  const handleApprove = async () => {
+    const code = userCode.trim().toUpperCase()
+    if (!code) {
+      setStatus({ type: 'error', message: 'Enter the code shown on your device' })
+      return
+    }
+
+    try {
+      setLoading(true)
+      setStatus({ type: 'info', message: 'Approving...' })
+      await approveDevice(code)
+      setStatus({ type: 'success', message: 'Device approved. You can return to it now.' })
+    } catch (error) {
+      console.error('Device approval error:', error)
+      setStatus({
+        type: 'error',
+        message: error instanceof Error ? error.message : 'Failed to approve device',
+      })
+    } finally {
+      setLoading(false)
+    }
+  }
+
+  return (
+    <div className="container">
+      <h1>Sign in a device</h1>
+      <div className="card">
+        <div className="form-group">
+          <label htmlFor="user-code">Code shown on your device</label>
+          <input
+            type="text"
+            id="user-code"
+            placeholder="ABCD-EFGH"
+            value={userCode}
+            onChange={(e) => setUserCode(e.target.value)}
+            disabled={loading}
+            onKeyDown={(e) => e.key === 'Enter' && handleApprove()}
+          />
+        </div>
+        <div className="button-group">
+          <button type="button" onClick={handleApprove} disabled={loading}>
+            Approve
+          </button>
+        </div>
+        <StatusMessage type={status.type} message={status.message} />
+      </div>
+    </div>
+  )
+}
@@ -157,6 +157,7 @@ class ChatClient {
         return await getCurrentUser()
       },
       agentUrl: agentUrl,
+      localToken: import.meta.env.VITE_AGENT_TOKEN,
       persistence: persistence,
     })
 
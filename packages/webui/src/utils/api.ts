@@ -327,3 +327,23 @@ export async function adoptDevice(networkId: number, name?: string, platform?: s
   console.log('[API] Device adoption completed, preauth key created')
   return result
 }
+
+// Approve a device-code sign-in, such as `lanscape-agent login`
+export async function approveDevice(userCode: string): Promise<void> {
+  console.log('[API] Approving device sign-in')
+  const response = await fetch(`${API_BASE_URL}/v1/device/approve`, {
+    method: 'POST',
+    headers: {
+      'Content-Type': 'application/json',
+    },
+    credentials: 'include',
+    body: JSON.stringify({ user_code: userCode }),
+  })
+
+  if (!response.ok) {
+    const errorText = await response.text()
+    throw new Error(errorText || 'Failed to approve device')
+  }
+
+  console.log('[API] Device sign-in approved')
+}
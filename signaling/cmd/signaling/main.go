@@ -2,18 +2,35 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 	"time"
 
-	"github.com/jhead/lanscape/signaling/internal/handler"
+	"github.com/jhead/lanscape/signaling/pkg/buildinfo"
+	"github.com/jhead/lanscape/signaling/pkg/natscluster"
+	"github.com/jhead/lanscape/signaling/pkg/rediscluster"
+	"github.com/jhead/lanscape/signaling/pkg/service"
 	"github.com/jhead/lanscape/signaling/pkg/signaling"
+	"github.com/jhead/lanscape/signaling/pkg/turnrelay"
+	"github.com/nats-io/nats.go"
 )
 
 func main() {
+	if len(os.Args) > 1 && (os.Args[1] == "-version" || os.Args[1] == "--version") {
+		fmt.Println("signaling", buildinfo.Get())
+		return
+	}
+
 	logger := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
 		Level: getLogLevel(),
 	}))
@@ -25,16 +42,223 @@ func main() {
 
 	server := signaling.NewServer(logger)
 
-	mux := http.NewServeMux()
-	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("ok"))
-	})
-	mux.HandleFunc("GET /ws/{topic}", handler.HandleSignaling(server, logger))
+	relayLog, err := openRelayLog()
+	if err != nil {
+		logger.Error("failed to open relay log", "error", err)
+		os.Exit(1)
+	}
+	if relayLog != nil {
+		defer relayLog.Close()
+		server.SetRelayLog(relayLog)
+		logger.Info("relay log enabled", "path", os.Getenv("RELAY_LOG"))
+	}
+
+	if url := os.Getenv("REVOCATION_URL"); url != "" {
+		interval := time.Minute
+		if v := os.Getenv("REVOCATION_REFRESH"); v != "" {
+			if interval, err = time.ParseDuration(v); err != nil {
+				logger.Error("invalid REVOCATION_REFRESH", "error", err)
+				os.Exit(1)
+			}
+		}
+		revocations := signaling.NewRevocationList(url, logger)
+		server.SetRevocations(revocations)
+		go revocations.Run(context.Background(), interval)
+		logger.Info("rejecting revoked identities", "url", url, "refresh", interval.String())
+	}
+
+	acls, err := openTopicACLs()
+	if err != nil {
+		logger.Error("failed to load topic ACLs", "error", err)
+		os.Exit(1)
+	}
+	if url := os.Getenv("ATTESTATION_JWKS_URL"); url != "" {
+		acls.SetAuthorizer(signaling.AuthorizerMembers, signaling.NewMemberAuthorizer(url, logger))
+		logger.Info("checking network membership attestations", "jwks", url)
+	}
+	if v := os.Getenv("DEFAULT_TOPIC_ACL"); v != "" {
+		acl, err := parseDefaultACL(v)
+		if err != nil {
+			logger.Error("invalid DEFAULT_TOPIC_ACL", "error", err)
+			os.Exit(1)
+		}
+		acls.SetDefault(acl)
+		logger.Info("applying default ACL to topics without one", "acl", v)
+	}
+	server.SetACLs(acls)
+
+	presence, err := openPresenceReporter(logger)
+	if err != nil {
+		logger.Error("invalid presence reporting config", "error", err)
+		os.Exit(1)
+	}
+	if presence != nil {
+		server.SetPresence(presence)
+	}
+
+	webhooks, err := openWebhooks(logger)
+	if err != nil {
+		logger.Error("invalid webhook config", "error", err)
+		os.Exit(1)
+	}
+	if webhooks != nil {
+		server.SetWebhooks(webhooks)
+	}
+
+	audit, err := openAudit(logger)
+	if err != nil {
+		logger.Error("invalid audit log config", "error", err)
+		os.Exit(1)
+	}
+	if audit != nil {
+		defer audit.Close()
+		server.SetAudit(audit)
+	}
+
+	limiter, err := openRateLimiter(logger)
+	if err != nil {
+		logger.Error("invalid rate limit config", "error", err)
+		os.Exit(1)
+	}
+	if limiter != nil {
+		server.SetRateLimiter(limiter)
+	}
+
+	appRelayMaxSize, appRelayLimiter, err := openAppRelay(logger)
+	if err != nil {
+		logger.Error("invalid app-relay config", "error", err)
+		os.Exit(1)
+	}
+	server.SetAppRelay(appRelayMaxSize, appRelayLimiter)
+
+	httpLimiter, err := openHTTPRateLimiter(logger)
+	if err != nil {
+		logger.Error("invalid HTTP rate limit config", "error", err)
+		os.Exit(1)
+	}
+
+	turn, relay, err := openTURN(logger)
+	if err != nil {
+		logger.Error("invalid TURN config", "error", err)
+		os.Exit(1)
+	}
+	if turn != nil {
+		server.SetTURN(turn)
+	}
+	if relay != nil {
+		defer relay.Close()
+	}
+
+	faults, err := openFaults(logger)
+	if err != nil {
+		logger.Error("invalid fault injection config", "error", err)
+		os.Exit(1)
+	}
+	if faults != nil {
+		server.SetFaults(faults)
+	}
+
+	resumeGrace, err := parseResumeGrace()
+	if err != nil {
+		logger.Error("invalid resume config", "error", err)
+		os.Exit(1)
+	}
+	server.SetResumeGrace(resumeGrace)
+
+	relayHold, err := parseRelayHold()
+	if err != nil {
+		logger.Error("invalid relay hold config", "error", err)
+		os.Exit(1)
+	}
+	server.SetRelayHold(relayHold)
+
+	drainGrace, err := parseDrainGrace()
+	if err != nil {
+		logger.Error("invalid drain config", "error", err)
+		os.Exit(1)
+	}
+	server.SetDrainGrace(drainGrace)
+
+	conn, err := parseConnLimits(logger)
+	if err != nil {
+		logger.Error("invalid connection config", "error", err)
+		os.Exit(1)
+	}
+	server.SetSendQueueSize(conn.sendQueueSize)
+
+	cluster, err := openCluster(server, logger)
+	if err != nil {
+		logger.Error("invalid cluster config", "error", err)
+		os.Exit(1)
+	}
+	if cluster != nil {
+		server.SetCluster(cluster)
+	}
+
+	trustedProxies, err := service.ParseTrustedProxies(os.Getenv("TRUSTED_PROXIES"))
+	if err != nil {
+		logger.Error("invalid TRUSTED_PROXIES", "error", err)
+		os.Exit(1)
+	}
+
+	allowedOrigins, err := service.ParseAllowedOrigins(os.Getenv("ALLOWED_ORIGINS"))
+	if err != nil {
+		logger.Error("invalid ALLOWED_ORIGINS", "error", err)
+		os.Exit(1)
+	}
+	if len(allowedOrigins) > 0 {
+		logger.Info("restricting browser origins", "origins", allowedOrigins)
+	}
+
+	adminToken, err := getSecret("ADMIN_TOKEN")
+	if err != nil {
+		logger.Error("invalid ADMIN_TOKEN", "error", err)
+		os.Exit(1)
+	}
+	clientToken, err := getSecret("CLIENT_TOKEN")
+	if err != nil {
+		logger.Error("invalid CLIENT_TOKEN", "error", err)
+		os.Exit(1)
+	}
+
+	wtAddr, wtTLS, err := parseWebTransport()
+	if err != nil {
+		logger.Error("invalid WebTransport config", "error", err)
+		os.Exit(1)
+	}
+
+	serviceConfig := service.Config{
+		RelayLog:        relayLog,
+		AdminToken:      adminToken,
+		ClientToken:     clientToken,
+		AllowedOrigins:  allowedOrigins,
+		TrustedProxies:  trustedProxies,
+		HTTPRateLimiter: httpLimiter,
+		MaxMessageSize:  conn.maxMessageSize,
+		WriteTimeout:    conn.writeTimeout,
+		PingInterval:    conn.pingInterval,
+	}
+	handler := service.NewHandler(server, serviceConfig, logger)
+	if clientToken != "" {
+		logger.Info("requiring a client token to connect")
+	}
+
+	closeWebTransport := func() error { return nil }
+	if wtAddr != "" {
+		wt := service.NewWebTransportServer(server, serviceConfig, wtAddr, wtTLS, logger)
+		closeWebTransport = wt.Close
+		go func() {
+			logger.Info("starting webtransport listener", "addr", wtAddr)
+			if err := wt.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				logger.Error("webtransport server error", "error", err)
+				os.Exit(1)
+			}
+		}()
+	}
 
 	httpServer := &http.Server{
 		Addr:         ":" + port,
-		Handler:      corsMiddleware(mux),
+		Handler:      handler,
 		ReadTimeout:  15 * time.Second,
 		WriteTimeout: 15 * time.Second,
 		IdleTimeout:  60 * time.Second,
@@ -46,15 +270,25 @@ func main() {
 		signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
 		<-sigChan
 
-		logger.Info("shutting down server")
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		logger.Info("shutting down server", "drainGrace", drainGrace)
+		ctx, cancel := context.WithTimeout(context.Background(), drainGrace+10*time.Second)
 		defer cancel()
+		if err := server.Drain(ctx); err != nil {
+			logger.Warn("connections still open after drain", "error", err)
+		}
+		presence.Flush(ctx)
+		webhooks.Flush(ctx)
+		audit.Flush(ctx)
+		cluster.Flush(ctx)
+		if err := closeWebTransport(); err != nil {
+			logger.Error("webtransport shutdown error", "error", err)
+		}
 		if err := httpServer.Shutdown(ctx); err != nil {
 			logger.Error("shutdown error", "error", err)
 		}
 	}()
 
-	logger.Info("starting signaling server", "port", port)
+	logger.Info("starting signaling server", "port", port, "version", buildinfo.Get().Version)
 	if err := httpServer.ListenAndServe(); err != http.ErrServerClosed {
 		logger.Error("server error", "error", err)
 		os.Exit(1)
@@ -62,27 +296,553 @@ func main() {
 	logger.Info("server stopped")
 }
 
-// corsMiddleware adds CORS headers for WebSocket connections
-func corsMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		origin := r.Header.Get("Origin")
-		if origin == "" {
-			origin = "*"
-		}
-		w.Header().Set("Access-Control-Allow-Origin", origin)
-		w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
-		w.Header().Set("Access-Control-Allow-Credentials", "true")
+// parseWebTransport returns the UDP address to serve WebTransport signaling
+// on from WEBTRANSPORT_ADDR, and the certificate it is served with from
+// TLS_CERT_FILE and TLS_KEY_FILE, since WebTransport requires TLS. The
+// address is empty if WEBTRANSPORT_ADDR is unset.
+func parseWebTransport() (string, *tls.Config, error) {
+	addr := os.Getenv("WEBTRANSPORT_ADDR")
+	if addr == "" {
+		return "", nil, nil
+	}
+	certFile, keyFile := os.Getenv("TLS_CERT_FILE"), os.Getenv("TLS_KEY_FILE")
+	if certFile == "" || keyFile == "" {
+		return "", nil, errors.New("WEBTRANSPORT_ADDR requires TLS_CERT_FILE and TLS_KEY_FILE")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+	return addr, &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+}
+
+// openRelayLog opens the relay log configured by RELAY_LOG, or returns nil if
+// it is unset
+func openRelayLog() (*signaling.RelayLog, error) {
+	path := os.Getenv("RELAY_LOG")
+	if path == "" {
+		return nil, nil
+	}
 
-		if r.Method == "OPTIONS" {
-			w.WriteHeader(http.StatusOK)
-			return
+	maxSizeMB := 100
+	if v := os.Getenv("RELAY_LOG_MAX_SIZE"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, err
+		}
+		maxSizeMB = n
+	}
+	maxFiles := 5
+	if v := os.Getenv("RELAY_LOG_MAX_FILES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, err
 		}
+		maxFiles = n
+	}
 
-		next.ServeHTTP(w, r)
+	return signaling.NewRelayLog(signaling.RelayLogConfig{
+		Path:     path,
+		MaxSize:  int64(maxSizeMB) * 1024 * 1024,
+		MaxFiles: maxFiles,
 	})
 }
 
+// openTopicACLs loads the topic ACLs saved at TOPIC_ACLS, or returns an
+// in-memory table if it is unset
+func openTopicACLs() (*signaling.ACLTable, error) {
+	path := os.Getenv("TOPIC_ACLS")
+	if path == "" {
+		return signaling.NewACLTable(), nil
+	}
+	return signaling.LoadACLTable(path)
+}
+
+// parseDefaultACL parses DEFAULT_TOPIC_ACL: "open" leaves topics without an
+// ACL open, "auth" requires a proven identity key, and "members" also
+// requires an attestation of membership in the lanscaped network named like
+// the topic. Like the ACLs lanscaped registers, members also permits
+// app-relays.
+func parseDefaultACL(v string) (*signaling.TopicACL, error) {
+	switch v {
+	case "open":
+		return nil, nil
+	case "auth":
+		return &signaling.TopicACL{RequireAuth: true}, nil
+	case "members":
+		if os.Getenv("ATTESTATION_JWKS_URL") == "" {
+			return nil, fmt.Errorf("%q requires ATTESTATION_JWKS_URL", v)
+		}
+		return &signaling.TopicACL{RequireAuth: true, Authorizer: signaling.AuthorizerMembers, AppRelay: true}, nil
+	default:
+		return nil, fmt.Errorf("%q is not open, auth, or members", v)
+	}
+}
+
+// parseResumeGrace returns how long a dropped peer can resume its peer ID
+// from RESUME_GRACE, 0 to disable resumption
+func parseResumeGrace() (time.Duration, error) {
+	v := os.Getenv("RESUME_GRACE")
+	if v == "" {
+		return signaling.DefaultResumeGrace, nil
+	}
+	grace, err := time.ParseDuration(v)
+	if err != nil || grace < 0 {
+		return 0, fmt.Errorf("invalid RESUME_GRACE %q: must be a duration, 0 to disable", v)
+	}
+	return grace, nil
+}
+
+// parseRelayHold returns how long relays to a peer that just disconnected
+// are held from RELAY_HOLD, 0 (the default) to not hold them
+func parseRelayHold() (time.Duration, error) {
+	v := os.Getenv("RELAY_HOLD")
+	if v == "" {
+		return 0, nil
+	}
+	hold, err := time.ParseDuration(v)
+	if err != nil || hold < 0 {
+		return 0, fmt.Errorf("invalid RELAY_HOLD %q: must be a duration, 0 to disable", v)
+	}
+	return hold, nil
+}
+
+// parseDrainGrace returns how long peers get to move to another server on
+// shutdown from DRAIN_GRACE, 0 (the default) to close their connections
+// right away
+func parseDrainGrace() (time.Duration, error) {
+	v := os.Getenv("DRAIN_GRACE")
+	if v == "" {
+		return 0, nil
+	}
+	grace, err := time.ParseDuration(v)
+	if err != nil || grace < 0 {
+		return 0, fmt.Errorf("invalid DRAIN_GRACE %q: must be a duration, 0 to disable", v)
+	}
+	return grace, nil
+}
+
+// connLimits tunes signaling connections, e.g. for large session
+// descriptions or high-latency links. Zero fields take the defaults.
+type connLimits struct {
+	maxMessageSize int
+	writeTimeout   time.Duration
+	pingInterval   time.Duration
+	sendQueueSize  int
+}
+
+// parseConnLimits reads the largest frame read from a client from
+// MAX_MESSAGE_SIZE, the time each write to a client may take from
+// WRITE_TIMEOUT, how often clients are pinged from PING_INTERVAL, and the
+// messages queued for each peer from SEND_QUEUE_SIZE
+func parseConnLimits(logger *slog.Logger) (connLimits, error) {
+	var limits connLimits
+	var err error
+	if limits.maxMessageSize, err = parsePositiveInt("MAX_MESSAGE_SIZE"); err != nil {
+		return limits, err
+	}
+	if limits.sendQueueSize, err = parsePositiveInt("SEND_QUEUE_SIZE"); err != nil {
+		return limits, err
+	}
+	if limits.writeTimeout, err = parsePositiveDuration("WRITE_TIMEOUT"); err != nil {
+		return limits, err
+	}
+	if limits.pingInterval, err = parsePositiveDuration("PING_INTERVAL"); err != nil {
+		return limits, err
+	}
+	if limits != (connLimits{}) {
+		logger.Info("tuning signaling connections",
+			"maxMessageSize", limits.maxMessageSize,
+			"writeTimeout", limits.writeTimeout,
+			"pingInterval", limits.pingInterval,
+			"sendQueueSize", limits.sendQueueSize,
+		)
+	}
+	return limits, nil
+}
+
+// parsePositiveInt reads a positive integer from name, 0 if it is unset
+func parsePositiveInt(name string) (int, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("invalid %s %q: must be a positive integer", name, v)
+	}
+	return n, nil
+}
+
+// parsePositiveDuration reads a positive duration from name, 0 if it is
+// unset
+func parsePositiveDuration(name string) (time.Duration, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid %s %q: must be a positive duration", name, v)
+	}
+	return d, nil
+}
+
+// openPresenceReporter starts reporting presence to PRESENCE_URL, or returns
+// nil if it is unset
+func openPresenceReporter(logger *slog.Logger) (*signaling.PresenceReporter, error) {
+	url := os.Getenv("PRESENCE_URL")
+	if url == "" {
+		return nil, nil
+	}
+
+	grace := 15 * time.Second
+	if v := os.Getenv("PRESENCE_GRACE"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid PRESENCE_GRACE: %w", err)
+		}
+		grace = d
+	}
+	snapshot := 5 * time.Minute
+	if v := os.Getenv("PRESENCE_SNAPSHOT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid PRESENCE_SNAPSHOT: %w", err)
+		}
+		snapshot = d
+	}
+
+	token, err := getSecret("PRESENCE_TOKEN")
+	if err != nil {
+		return nil, err
+	}
+	presence := signaling.NewPresenceReporter(url, token, grace, logger)
+	go presence.Run(context.Background(), snapshot)
+	logger.Info("reporting presence", "url", url, "grace", grace.String(), "snapshot", snapshot.String())
+	return presence, nil
+}
+
+// openWebhooks starts posting topic lifecycle events to the URLs in
+// WEBHOOK_URLS, signed with WEBHOOK_SECRET, or returns nil if it is unset
+func openWebhooks(logger *slog.Logger) (*signaling.Webhooks, error) {
+	urls, err := signaling.ParseWebhookURLs(os.Getenv("WEBHOOK_URLS"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid WEBHOOK_URLS: %w", err)
+	}
+	if len(urls) == 0 {
+		return nil, nil
+	}
+
+	secret, err := getSecret("WEBHOOK_SECRET")
+	if err != nil {
+		return nil, err
+	}
+	if secret == "" {
+		return nil, fmt.Errorf("WEBHOOK_SECRET is required with WEBHOOK_URLS")
+	}
+	webhooks := signaling.NewWebhooks(urls, secret, logger)
+	go webhooks.Run(context.Background())
+	logger.Info("posting topic events to webhooks", "urls", urls)
+	return webhooks, nil
+}
+
+// openAudit opens the audit log, recording the events in AUDIT_EVENTS (all
+// when unset) to the file AUDIT_LOG ("-" for stdout) and the URL
+// AUDIT_WEBHOOK_URL, signed with AUDIT_WEBHOOK_SECRET. It returns nil if
+// neither is set.
+func openAudit(logger *slog.Logger) (*signaling.AuditLog, error) {
+	types, err := signaling.ParseAuditEventTypes(os.Getenv("AUDIT_EVENTS"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid AUDIT_EVENTS: %w", err)
+	}
+
+	var sinks []signaling.AuditSink
+	switch path := os.Getenv("AUDIT_LOG"); path {
+	case "":
+	case "-":
+		sinks = append(sinks, signaling.NewAuditWriter(os.Stdout))
+		logger.Info("audit log enabled", "path", "stdout")
+	default:
+		maxSizeMB := 100
+		if v := os.Getenv("AUDIT_LOG_MAX_SIZE"); v != "" {
+			if maxSizeMB, err = strconv.Atoi(v); err != nil {
+				return nil, fmt.Errorf("invalid AUDIT_LOG_MAX_SIZE: %w", err)
+			}
+		}
+		maxFiles := 5
+		if v := os.Getenv("AUDIT_LOG_MAX_FILES"); v != "" {
+			if maxFiles, err = strconv.Atoi(v); err != nil {
+				return nil, fmt.Errorf("invalid AUDIT_LOG_MAX_FILES: %w", err)
+			}
+		}
+		file, err := signaling.NewAuditFile(path, int64(maxSizeMB)*1024*1024, maxFiles)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, file)
+		logger.Info("audit log enabled", "path", path)
+	}
+
+	if v := os.Getenv("AUDIT_WEBHOOK_URL"); v != "" {
+		urls, err := signaling.ParseWebhookURLs(v)
+		if err != nil || len(urls) != 1 {
+			return nil, fmt.Errorf("invalid AUDIT_WEBHOOK_URL: want one http or https URL")
+		}
+		secret, err := getSecret("AUDIT_WEBHOOK_SECRET")
+		if err != nil {
+			return nil, err
+		}
+		if secret == "" {
+			return nil, fmt.Errorf("AUDIT_WEBHOOK_SECRET is required with AUDIT_WEBHOOK_URL")
+		}
+		webhook := signaling.NewAuditWebhook(urls[0], secret, logger)
+		go webhook.Run(context.Background())
+		sinks = append(sinks, webhook)
+		logger.Info("posting audit events to webhook", "url", urls[0])
+	}
+
+	if len(sinks) == 0 {
+		return nil, nil
+	}
+	return signaling.NewAuditLog(types, sinks...), nil
+}
+
+// openRateLimiter limits relays per peer to RELAY_RATE messages per second
+// in bursts of RELAY_BURST, and per client IP to RELAY_IP_RATE in bursts of
+// RELAY_IP_BURST. It returns nil if both rates are 0.
+func openRateLimiter(logger *slog.Logger) (*signaling.RateLimiter, error) {
+	peer, err := parseRateLimit("RELAY_RATE", "RELAY_BURST", signaling.RateLimit{Rate: 20, Burst: 100})
+	if err != nil {
+		return nil, err
+	}
+	ip, err := parseRateLimit("RELAY_IP_RATE", "RELAY_IP_BURST", signaling.RateLimit{Rate: 100, Burst: 500})
+	if err != nil {
+		return nil, err
+	}
+	if peer.Rate == 0 && ip.Rate == 0 {
+		return nil, nil
+	}
+	logger.Info("rate limiting relays",
+		"peerRate", peer.Rate, "peerBurst", peer.Burst,
+		"ipRate", ip.Rate, "ipBurst", ip.Burst,
+	)
+	return signaling.NewRateLimiter(peer, ip), nil
+}
+
+// openAppRelay reads the app-relay limits: payloads of up to
+// APP_RELAY_MAX_SIZE bytes (0 refuses app-relays), APP_RELAY_RATE per second
+// in bursts of APP_RELAY_BURST per peer, and APP_RELAY_IP_RATE in bursts of
+// APP_RELAY_IP_BURST per client IP. The limiter is nil if both rates are 0.
+func openAppRelay(logger *slog.Logger) (int, *signaling.RateLimiter, error) {
+	maxSize := signaling.DefaultAppRelayMaxSize
+	if v := os.Getenv("APP_RELAY_MAX_SIZE"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return 0, nil, fmt.Errorf("invalid APP_RELAY_MAX_SIZE: %q", v)
+		}
+		maxSize = n
+	}
+	if maxSize == 0 {
+		logger.Info("app-relays disabled")
+		return 0, nil, nil
+	}
+	peer, err := parseRateLimit("APP_RELAY_RATE", "APP_RELAY_BURST", signaling.DefaultAppRelayPeerRate)
+	if err != nil {
+		return 0, nil, err
+	}
+	ip, err := parseRateLimit("APP_RELAY_IP_RATE", "APP_RELAY_IP_BURST", signaling.DefaultAppRelayIPRate)
+	if err != nil {
+		return 0, nil, err
+	}
+	logger.Info("accepting app-relays in topics that permit them",
+		"maxSize", maxSize,
+		"peerRate", peer.Rate, "peerBurst", peer.Burst,
+		"ipRate", ip.Rate, "ipBurst", ip.Burst,
+	)
+	if peer.Rate == 0 && ip.Rate == 0 {
+		return maxSize, nil, nil
+	}
+	return maxSize, signaling.NewRateLimiter(peer, ip), nil
+}
+
+// openHTTPRateLimiter limits HTTP requests, WebSocket handshakes included,
+// per client IP to HTTP_RATE per second in bursts of HTTP_BURST. It returns
+// nil if HTTP_RATE is 0.
+func openHTTPRateLimiter(logger *slog.Logger) (*signaling.IPRateLimiter, error) {
+	limit, err := parseRateLimit("HTTP_RATE", "HTTP_BURST", signaling.RateLimit{Rate: 10, Burst: 50})
+	if err != nil {
+		return nil, err
+	}
+	if limit.Rate == 0 {
+		return nil, nil
+	}
+	logger.Info("rate limiting HTTP requests", "rate", limit.Rate, "burst", limit.Burst)
+	return signaling.NewIPRateLimiter(limit), nil
+}
+
+// parseRateLimit reads a rate limit from the rate and burst variables,
+// falling back to def for unset ones
+func parseRateLimit(rateVar, burstVar string, def signaling.RateLimit) (signaling.RateLimit, error) {
+	limit := def
+	if v := os.Getenv(rateVar); v != "" {
+		rate, err := strconv.ParseFloat(v, 64)
+		if err != nil || rate < 0 {
+			return limit, fmt.Errorf("invalid %s: %q", rateVar, v)
+		}
+		limit.Rate = rate
+	}
+	if v := os.Getenv(burstVar); v != "" {
+		burst, err := strconv.Atoi(v)
+		if err != nil || burst < 1 {
+			return limit, fmt.Errorf("invalid %s: %q", burstVar, v)
+		}
+		limit.Burst = burst
+	}
+	return limit, nil
+}
+
+// openTURN vends credentials for the TURN servers at TURN_URLS, which share
+// TURN_SECRET with this server, and for the embedded TURN server when
+// TURN_LISTEN is set, valid for TURN_TTL (24h by default). The embedded
+// server only needs TURN_SECRET to share it with other TURN servers; a
+// random one is used otherwise. It returns nil if neither is configured.
+func openTURN(logger *slog.Logger) (*signaling.TURNCredentials, *turnrelay.Server, error) {
+	urls, err := signaling.ParseTURNURLs(os.Getenv("TURN_URLS"))
+	if err != nil {
+		return nil, nil, err
+	}
+	var relayConfig *turnrelay.Config
+	if listen := os.Getenv("TURN_LISTEN"); listen != "" {
+		if relayConfig, err = parseTURNRelayConfig(listen); err != nil {
+			return nil, nil, err
+		}
+		relayURLs, err := relayConfig.URLs()
+		if err != nil {
+			return nil, nil, err
+		}
+		urls = append(urls, relayURLs...)
+	}
+	if len(urls) == 0 {
+		return nil, nil, nil
+	}
+
+	secret, err := getSecret("TURN_SECRET")
+	if err != nil {
+		return nil, nil, err
+	}
+	if secret == "" {
+		if relayConfig == nil || os.Getenv("TURN_URLS") != "" {
+			return nil, nil, fmt.Errorf("TURN_SECRET is required with TURN_URLS")
+		}
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, fmt.Errorf("failed to generate TURN secret: %w", err)
+		}
+		secret = hex.EncodeToString(b)
+	}
+	var ttl time.Duration
+	if v := os.Getenv("TURN_TTL"); v != "" {
+		if ttl, err = time.ParseDuration(v); err != nil || ttl <= 0 {
+			return nil, nil, fmt.Errorf("invalid TURN_TTL: %q", v)
+		}
+	}
+	turn := signaling.NewTURNCredentials(urls, secret, ttl)
+
+	var relay *turnrelay.Server
+	if relayConfig != nil {
+		if relay, err = turnrelay.Start(*relayConfig, turn, logger); err != nil {
+			return nil, nil, err
+		}
+		logger.Info("running embedded TURN server", "listen", relayConfig.Listen, "publicIP", relayConfig.PublicIP.String())
+	}
+	logger.Info("vending TURN credentials", "urls", urls, "ttl", turn.TTL().String())
+	return turn, relay, nil
+}
+
+// parseTURNRelayConfig reads the embedded TURN server's config: its public
+// address from TURN_PUBLIC_IP, its realm from TURN_REALM, its relay ports
+// from TURN_RELAY_PORTS, e.g. 49152-65535, and whether it may relay to
+// private addresses from TURN_RELAY_PRIVATE
+func parseTURNRelayConfig(listen string) (*turnrelay.Config, error) {
+	config := &turnrelay.Config{Listen: listen, Realm: os.Getenv("TURN_REALM")}
+	config.PublicIP = net.ParseIP(os.Getenv("TURN_PUBLIC_IP"))
+	if config.PublicIP == nil {
+		return nil, fmt.Errorf("TURN_PUBLIC_IP is required with TURN_LISTEN")
+	}
+	if v := os.Getenv("TURN_RELAY_PORTS"); v != "" {
+		var err error
+		if config.MinPort, config.MaxPort, err = turnrelay.ParsePortRange(v); err != nil {
+			return nil, fmt.Errorf("invalid TURN_RELAY_PORTS: %w", err)
+		}
+	}
+	if v := os.Getenv("TURN_RELAY_PRIVATE"); v != "" {
+		allow, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid TURN_RELAY_PRIVATE: %q", v)
+		}
+		config.AllowPrivate = allow
+	}
+	return config, nil
+}
+
+// openCluster shares topics with the other servers on REDIS_URL or NATS_URL,
+// or returns nil if neither is set
+func openCluster(server *signaling.Server, logger *slog.Logger) (*signaling.Cluster, error) {
+	redisURL, err := getSecret("REDIS_URL")
+	if err != nil {
+		return nil, err
+	}
+	natsURL, err := getSecret("NATS_URL")
+	if err != nil {
+		return nil, err
+	}
+	if redisURL == "" && natsURL == "" {
+		return nil, nil
+	}
+	if redisURL != "" && natsURL != "" {
+		return nil, fmt.Errorf("set only one of REDIS_URL and NATS_URL")
+	}
+
+	heartbeat := 5 * time.Second
+	if v := os.Getenv("CLUSTER_HEARTBEAT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CLUSTER_HEARTBEAT: %w", err)
+		}
+		heartbeat = d
+	}
+	snapshot := time.Minute
+	if v := os.Getenv("CLUSTER_SNAPSHOT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CLUSTER_SNAPSHOT: %w", err)
+		}
+		snapshot = d
+	}
+
+	var backend signaling.Backend
+	transport := "Redis"
+	if redisURL != "" {
+		if backend, err = rediscluster.New(redisURL, os.Getenv("REDIS_CHANNEL")); err != nil {
+			return nil, err
+		}
+	} else {
+		var opts []nats.Option
+		if creds := os.Getenv("NATS_CREDS"); creds != "" {
+			opts = append(opts, nats.UserCredentials(creds))
+		}
+		if backend, err = natscluster.New(natsURL, os.Getenv("NATS_SUBJECT"), opts...); err != nil {
+			return nil, err
+		}
+		transport = "NATS"
+	}
+	cluster := signaling.NewCluster(server, backend, logger)
+	go cluster.Run(context.Background(), heartbeat, snapshot)
+	logger.Info("sharing topics through "+transport, "instance", cluster.ID, "heartbeat", heartbeat.String(), "snapshot", snapshot.String())
+	return cluster, nil
+}
+
 // getLogLevel returns the log level from environment or default
 func getLogLevel() slog.Level {
 	level := os.Getenv("LOG_LEVEL")
@@ -97,3 +857,27 @@ func getLogLevel() slog.Level {
 		return slog.LevelInfo
 	}
 }
+
+// openFaults injects failures for resilience testing from FAULT_RELAY_DROP,
+// the percentage of relays to drop, seeded with FAULT_SEED or a random seed
+// that is logged so the run can be repeated. It returns nil if
+// FAULT_RELAY_DROP is unset.
+func openFaults(logger *slog.Logger) (*signaling.Faults, error) {
+	v := os.Getenv("FAULT_RELAY_DROP")
+	if v == "" {
+		return nil, nil
+	}
+	percent, err := strconv.ParseFloat(v, 64)
+	if err != nil || percent < 0 || percent > 100 {
+		return nil, fmt.Errorf("FAULT_RELAY_DROP must be a percentage from 0 to 100")
+	}
+
+	seed := time.Now().UnixNano()
+	if v := os.Getenv("FAULT_SEED"); v != "" {
+		if seed, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid FAULT_SEED: %w", err)
+		}
+	}
+	logger.Warn("injecting faults; do not use in production", "relayDropPercent", percent, "seed", seed)
+	return &signaling.Faults{RelayDrop: percent / 100, Seed: seed}, nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// getSecret returns the secret name, such as a token, from the environment
+// variable name, the file named by name_FILE, or the systemd credential
+// name (LoadCredential=name:/path) in $CREDENTIALS_DIRECTORY, in that order.
+// Reading it from a file keeps it out of the environment, where process
+// listings and child processes can see it. Trailing newlines are trimmed
+// from files. It returns an empty string if the secret is not set anywhere.
+func getSecret(name string) (string, error) {
+	value, hasValue := os.LookupEnv(name)
+	path, hasPath := os.LookupEnv(name + "_FILE")
+	switch {
+	case hasValue && hasPath:
+		return "", fmt.Errorf("set only one of %s and %s_FILE", name, name)
+	case hasValue:
+		return value, nil
+	case hasPath:
+		return readSecretFile(path, name+"_FILE")
+	}
+
+	dir := os.Getenv("CREDENTIALS_DIRECTORY")
+	if dir == "" {
+		return "", nil
+	}
+	value, err := readSecretFile(filepath.Join(dir, name), "credential "+name)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	return value, err
+}
+
+// readSecretFile reads a secret from path, which source names in errors
+func readSecretFile(path, source string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", source, err)
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
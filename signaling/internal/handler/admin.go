@@ -0,0 +1,295 @@
+package handler
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/jhead/lanscape/signaling/pkg/signaling"
+)
+
+// HandleRelayLogExport returns an HTTP handler that streams the relay log as
+// JSON lines. Requests must carry "Authorization: Bearer <token>" and may
+// filter with the topic, peer, and since (RFC 3339) query parameters.
+func HandleRelayLogExport(relayLog *signaling.RelayLog, token string, logger *slog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r, token) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		filter := signaling.RelayLogFilter{
+			Topic: r.URL.Query().Get("topic"),
+			Peer:  r.URL.Query().Get("peer"),
+		}
+		if since := r.URL.Query().Get("since"); since != "" {
+			t, err := time.Parse(time.RFC3339, since)
+			if err != nil {
+				http.Error(w, "invalid since: must be RFC 3339", http.StatusBadRequest)
+				return
+			}
+			filter.Since = t
+		}
+
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		if err := relayLog.Export(w, filter); err != nil {
+			logger.Error("relay log export failed", "error", err)
+		}
+	}
+}
+
+// defaultStatsWindow is the window of GET /admin/stats without ?window
+const defaultStatsWindow = 5 * time.Minute
+
+// HandleStats returns an HTTP handler that reports the server's topics, their
+// peers, and relay results per topic over the last window (a duration, 5m by
+// default, at most 1h). Requests must carry "Authorization: Bearer <token>".
+func HandleStats(server *signaling.Server, token string, logger *slog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r, token) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		window := defaultStatsWindow
+		if v := r.URL.Query().Get("window"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d <= 0 {
+				http.Error(w, "invalid window: must be a positive duration", http.StatusBadRequest)
+				return
+			}
+			window = d
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(server.Stats(window)); err != nil {
+			logger.Error("failed to write stats", "error", err)
+		}
+	}
+}
+
+// HandleTopics returns an HTTP handler that lists the server's topics with
+// their peer counts and creation times. Requests must carry
+// "Authorization: Bearer <token>".
+func HandleTopics(server *signaling.Server, token string, logger *slog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r, token) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		topics := server.Topics()
+		if topics == nil {
+			topics = []signaling.TopicSummary{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(map[string][]signaling.TopicSummary{"topics": topics}); err != nil {
+			logger.Error("failed to write topics", "error", err)
+		}
+	}
+}
+
+// HandleTopicPeers returns an HTTP handler that lists the peers of
+// /admin/topics/{topic}/peers: who they are, where they connected from, and
+// for how long. Requests must carry "Authorization: Bearer <token>".
+func HandleTopicPeers(server *signaling.Server, token string, logger *slog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r, token) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		peers, ok := server.TopicPeers(r.PathValue("topic"))
+		if !ok {
+			http.Error(w, "topic not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(map[string][]signaling.PeerSummary{"peers": peers}); err != nil {
+			logger.Error("failed to write peers", "error", err)
+		}
+	}
+}
+
+// HandleDisconnectPeer returns an HTTP handler that force-disconnects
+// /admin/peers/{peer} from every topic it is in, closing its connections
+// with disconnected and the optional reason query parameter. It responds
+// with the topics the peer was in. Unlike a kick, nothing stops the peer
+// from connecting again. Requests must carry "Authorization: Bearer <token>".
+func HandleDisconnectPeer(server *signaling.Server, token string, logger *slog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r, token) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		peerID := r.PathValue("peer")
+
+		topics := server.Disconnect(peerID, r.URL.Query().Get("reason"))
+		if len(topics) == 0 {
+			http.Error(w, "peer not found", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string][]string{"topics": topics})
+	}
+}
+
+// HandleDrain returns an HTTP handler that reports (GET) or starts (POST)
+// the server's drain mode. Starting it refuses new joins and asks connected
+// peers to move to other servers; the server keeps running until it is shut
+// down, so deploy tooling can poll until no peers are left first. It
+// responds with a signaling.DrainStatus. Requests must carry
+// "Authorization: Bearer <token>".
+func HandleDrain(server *signaling.Server, token string, logger *slog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r, token) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Method == http.MethodPost && server.StartDrain() {
+			logger.Info("drain started by admin API", "remote", r.RemoteAddr)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(server.DrainStatus())
+	}
+}
+
+// HandleTopicACL returns an HTTP handler that reads (GET), replaces (PUT),
+// or removes (DELETE) the ACL of /admin/topics/{topic}/acl. Requests must
+// carry "Authorization: Bearer <token>". PUT takes a signaling.TopicACL.
+func HandleTopicACL(acls *signaling.ACLTable, token string, logger *slog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r, token) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		topicID := r.PathValue("topic")
+
+		switch r.Method {
+		case http.MethodGet:
+			acl, ok := acls.Get(topicID)
+			if !ok {
+				http.Error(w, "topic has no ACL", http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(acl)
+
+		case http.MethodPut:
+			var acl signaling.TopicACL
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxMetadataSize)).Decode(&acl); err != nil {
+				http.Error(w, "invalid ACL", http.StatusBadRequest)
+				return
+			}
+			if err := acls.Set(topicID, acl); err != nil {
+				logger.Error("failed to set topic ACL", "topic", topicID, "error", err)
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			logger.Info("topic ACL set", "topic", topicID, "requireAuth", acl.RequireAuth, "authorizer", acl.Authorizer, "network", acl.Network)
+			w.WriteHeader(http.StatusNoContent)
+
+		case http.MethodDelete:
+			if err := acls.Delete(topicID); err != nil {
+				logger.Error("failed to remove topic ACL", "topic", topicID, "error", err)
+				http.Error(w, "failed to remove ACL", http.StatusInternalServerError)
+				return
+			}
+			logger.Info("topic ACL removed", "topic", topicID)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}
+}
+
+// kickRequest is the body of POST /admin/topics/{topic}/kick
+type kickRequest struct {
+	// PublicKeys are the identity keys (base64url) to remove and ban
+	PublicKeys []string `json:"publicKeys"`
+	// All removes every peer in the topic; only PublicKeys are banned
+	All bool `json:"all"`
+	// BanUntil bans PublicKeys from rejoining until then; zero bans nothing
+	BanUntil time.Time `json:"banUntil"`
+	// Reason is sent to the removed peers in the close frame
+	Reason string `json:"reason"`
+}
+
+// HandleTopicKick returns an HTTP handler that removes peers from
+// /admin/topics/{topic}/kick, closing their connections with
+// membership-revoked, and optionally bans their keys from rejoining. It
+// responds with the IDs of the removed peers. Requests must carry
+// "Authorization: Bearer <token>".
+func HandleTopicKick(server *signaling.Server, token string, logger *slog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r, token) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		topicID := r.PathValue("topic")
+
+		var req kickRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, DefaultMaxMessageSize)).Decode(&req); err != nil {
+			http.Error(w, "invalid kick request", http.StatusBadRequest)
+			return
+		}
+		if !req.All && len(req.PublicKeys) == 0 {
+			http.Error(w, "publicKeys or all required", http.StatusBadRequest)
+			return
+		}
+
+		// Ban first, so a kicked peer cannot rejoin before the ban applies
+		if !req.BanUntil.IsZero() && len(req.PublicKeys) > 0 {
+			if err := server.ACLs().Ban(topicID, req.PublicKeys, req.BanUntil); err != nil {
+				logger.Error("failed to ban identity keys", "topic", topicID, "error", err)
+				http.Error(w, "failed to ban keys", http.StatusInternalServerError)
+				return
+			}
+		}
+		kicked := server.Kick(topicID, req.PublicKeys, req.All, req.Reason)
+		logger.Info("kicked peers from topic", "topic", topicID, "kicked", len(kicked), "banned", len(req.PublicKeys), "banUntil", req.BanUntil)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string][]string{"kicked": kicked})
+	}
+}
+
+// HandleTopicUnban returns an HTTP handler that lifts the bans on the
+// identity keys in {"publicKeys": [...]} for /admin/topics/{topic}/unban.
+// Requests must carry "Authorization: Bearer <token>".
+func HandleTopicUnban(acls *signaling.ACLTable, token string, logger *slog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r, token) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		topicID := r.PathValue("topic")
+
+		var req struct {
+			PublicKeys []string `json:"publicKeys"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, DefaultMaxMessageSize)).Decode(&req); err != nil {
+			http.Error(w, "invalid unban request", http.StatusBadRequest)
+			return
+		}
+		if err := acls.Unban(topicID, req.PublicKeys); err != nil {
+			logger.Error("failed to lift bans", "topic", topicID, "error", err)
+			http.Error(w, "failed to lift bans", http.StatusInternalServerError)
+			return
+		}
+		logger.Info("lifted bans on identity keys", "topic", topicID, "keys", len(req.PublicKeys))
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// authorized checks the request's bearer token in constant time
+func authorized(r *http.Request, token string) bool {
+	const prefix = "Bearer "
+	header := r.Header.Get("Authorization")
+	if len(header) <= len(prefix) || header[:len(prefix)] != prefix {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(header[len(prefix):]), []byte(token)) == 1
+}
@@ -0,0 +1,80 @@
+package handler
+
+import (
+	"context"
+	"crypto/subtle"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/jhead/lanscape/signaling/pkg/signaling"
+	"nhooyr.io/websocket"
+)
+
+// tokenProtocolPrefix prefixes the client token when it is sent as a
+// WebSocket subprotocol, which browsers can set where they cannot set an
+// Authorization header
+const tokenProtocolPrefix = "lanscape.token."
+
+// acceptOptions returns the options to accept a WebSocket with. The CBOR
+// encoding is selected when offered, then JSON. Clients offer the JSON
+// subprotocol alongside their token so the server has a protocol to select
+// without echoing the token back; a browser fails the handshake if it
+// offered subprotocols and the server selects none, so the token
+// subprotocol is selected as a last resort. accept has already checked the
+// origin.
+func acceptOptions(r *http.Request) *websocket.AcceptOptions {
+	opts := &websocket.AcceptOptions{
+		OriginPatterns: []string{"*"},
+		Subprotocols:   []string{signaling.CBORSubprotocol, signaling.Subprotocol},
+	}
+	for _, protocol := range offeredProtocols(r) {
+		if strings.HasPrefix(protocol, tokenProtocolPrefix) {
+			opts.Subprotocols = append(opts.Subprotocols, protocol)
+		}
+	}
+	return opts
+}
+
+// offeredProtocols returns the subprotocols in Sec-WebSocket-Protocol
+func offeredProtocols(r *http.Request) []string {
+	var protocols []string
+	for _, header := range r.Header.Values("Sec-WebSocket-Protocol") {
+		for _, protocol := range strings.Split(header, ",") {
+			if protocol = strings.TrimSpace(protocol); protocol != "" {
+				protocols = append(protocols, protocol)
+			}
+		}
+	}
+	return protocols
+}
+
+// clientToken returns the token a client presented in an Authorization
+// bearer header, a lanscape.token.<token> subprotocol, or the token query
+// parameter, in that order
+func clientToken(r *http.Request) string {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return token
+	}
+	for _, protocol := range offeredProtocols(r) {
+		if token, ok := strings.CutPrefix(protocol, tokenProtocolPrefix); ok {
+			return token
+		}
+	}
+	return r.URL.Query().Get("token")
+}
+
+// authenticate checks that a client presented token, which is not required
+// when empty. Clients without it are sent an unauthorized error, audited
+// against topicID if they asked for one, and closed with CloseAuthFailed,
+// so they know not to retry with the same token.
+func authenticate(ctx context.Context, c conn, encoding signaling.Encoding, r *http.Request, server *signaling.Server, topicID, token string, logger *slog.Logger) bool {
+	if token == "" || subtle.ConstantTimeCompare([]byte(clientToken(r)), []byte(token)) == 1 {
+		return true
+	}
+	logger.Info("rejected client without a valid token", "remote", r.RemoteAddr)
+	server.AuditError(topicID, "", r.RemoteAddr, "unauthorized", "missing or invalid client token")
+	sendError(ctx, c, encoding, "unauthorized", "missing or invalid client token", "")
+	c.Close(signaling.CloseAuthFailed, "invalid token")
+	return false
+}
@@ -0,0 +1,65 @@
+package handler
+
+import (
+	"context"
+
+	"github.com/jhead/lanscape/signaling/pkg/signaling"
+	"nhooyr.io/websocket"
+)
+
+// conn is a client's signaling connection, carrying one encoded message per
+// frame: a WebSocket, or a WebTransport session
+type conn interface {
+	// Read returns the next frame from the client
+	Read(ctx context.Context) ([]byte, error)
+	// Write sends one frame to the client
+	Write(ctx context.Context, data []byte) error
+	// Ping checks that the client is still there
+	Ping(ctx context.Context) error
+	// Close ends the connection, telling the client why
+	Close(reason signaling.CloseReason, detail string) error
+	// Dropped reports whether a read ending with err means the connection
+	// dropped, rather than the client closing it, so its peer may resume
+	Dropped(err error) bool
+}
+
+// wsConn is a WebSocket connection sending frames of the type its encoding
+// uses
+type wsConn struct {
+	ws       *websocket.Conn
+	encoding signaling.Encoding
+}
+
+func (c wsConn) Read(ctx context.Context) ([]byte, error) {
+	_, data, err := c.ws.Read(ctx)
+	return data, err
+}
+
+func (c wsConn) Write(ctx context.Context, data []byte) error {
+	return c.ws.Write(ctx, c.encoding.MessageType(), data)
+}
+
+func (c wsConn) Ping(ctx context.Context) error {
+	return c.ws.Ping(ctx)
+}
+
+func (c wsConn) Close(reason signaling.CloseReason, detail string) error {
+	return signaling.Close(c.ws, reason, detail)
+}
+
+func (c wsConn) Dropped(err error) bool {
+	switch websocket.CloseStatus(err) {
+	case websocket.StatusNormalClosure, websocket.StatusGoingAway:
+		return false
+	}
+	return err != nil
+}
+
+// writeMessage encodes v and writes it to c in one frame
+func writeMessage(ctx context.Context, c conn, encoding signaling.Encoding, v any) error {
+	data, err := encoding.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.Write(ctx, data)
+}
@@ -0,0 +1,297 @@
+package handler
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jhead/lanscape/signaling/pkg/signaling"
+)
+
+// maxSubscriptions bounds the topics one multiplexed connection may join
+const maxSubscriptions = 16
+
+// muxConn is a WebSocket connection carrying several topic subscriptions.
+// Each subscription is a separate peer in its topic; every frame carries the
+// topic it belongs to.
+type muxConn struct {
+	conn     conn
+	encoding signaling.Encoding
+	server   *signaling.Server
+	out      chan any
+	subs     map[string]*signaling.PeerConn // topic -> peer, owned by the reader
+	remote   string                         // client address
+	opts     Options
+	logger   *slog.Logger
+}
+
+// HandleMultiplexed returns an HTTP handler for multiplexed signaling
+// connections. Clients connect to /ws and join topics with subscribe frames;
+// relay frames name the topic they are sent in. When token is set, clients
+// must present it before subscribing. origins and opts apply as in
+// HandleSignaling.
+func HandleMultiplexed(server *signaling.Server, token string, origins []string, opts Options, logger *slog.Logger) http.HandlerFunc {
+	opts = opts.withDefaults()
+	return func(w http.ResponseWriter, r *http.Request) {
+		ws, err := accept(w, r, origins)
+		if err != nil {
+			logger.Error("websocket accept failed", "remote", r.RemoteAddr, "error", err)
+			return
+		}
+		ws.SetReadLimit(int64(opts.MaxMessageSize))
+		encoding := signaling.ParseSubprotocol(ws.Subprotocol())
+		conn := wsConn{ws, encoding}
+
+		if !server.AcceptingJoins() {
+			conn.Close(signaling.CloseDraining, "")
+			return
+		}
+
+		if !authenticate(r.Context(), conn, encoding, r, server, "", token, logger) {
+			return
+		}
+
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+
+		m := &muxConn{
+			conn:     conn,
+			encoding: encoding,
+			server:   server,
+			out:      make(chan any, 64),
+			subs:     make(map[string]*signaling.PeerConn),
+			remote:   r.RemoteAddr,
+			opts:     opts,
+			logger:   logger,
+		}
+		defer m.unsubscribeAll()
+
+		logger.Info("multiplexed websocket connected", "remote", r.RemoteAddr, "encoding", encoding)
+
+		// Start writer goroutine (single writer per connection)
+		go func() {
+			m.writerLoop(ctx, server.Draining())
+			cancel()
+		}()
+
+		// Reader loop blocks until disconnect
+		m.readerLoop(ctx)
+
+		logger.Info("multiplexed websocket disconnected", "topics", len(m.subs))
+	}
+}
+
+// writerLoop is the single goroutine that writes to the WebSocket connection.
+// It closes the connection when the server starts draining.
+func (m *muxConn) writerLoop(ctx context.Context, draining <-chan struct{}) {
+	ticker := time.NewTicker(m.opts.PingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-draining:
+			m.conn.Close(signaling.CloseDraining, "")
+			return
+		case msg := <-m.out:
+			writeCtx, cancel := context.WithTimeout(ctx, m.opts.WriteTimeout)
+			err := writeMessage(writeCtx, m.conn, m.encoding, msg)
+			cancel()
+			if err != nil {
+				m.logger.Debug("write failed", "error", err)
+				return
+			}
+		case <-ticker.C:
+			if err := m.conn.Ping(ctx); err != nil {
+				m.logger.Debug("ping failed", "error", err)
+				return
+			}
+		}
+	}
+}
+
+// readerLoop reads frames and dispatches subscribe, unsubscribe, and relay messages
+func (m *muxConn) readerLoop(ctx context.Context) {
+	for {
+		var msg signaling.InboundMessage
+		if err := readMessage(ctx, m.conn, m.encoding, &msg); err != nil {
+			return
+		}
+
+		if msg.Topic == "" {
+			m.sendError(ctx, "", "missing_topic", "topic field required", msg.MsgID)
+			continue
+		}
+
+		switch msg.Type {
+		case "subscribe":
+			m.subscribe(ctx, msg)
+
+		case "sync":
+			pc, ok := m.subs[msg.Topic]
+			if !ok {
+				m.sendError(ctx, msg.Topic, "not_subscribed", "not subscribed to topic", msg.MsgID)
+				continue
+			}
+			if !m.server.Resync(msg.Topic, pc.ID) {
+				m.sendError(ctx, msg.Topic, "dropped", "delivery failed", msg.MsgID)
+			}
+
+		case "unsubscribe":
+			if pc, ok := m.subs[msg.Topic]; ok {
+				delete(m.subs, msg.Topic)
+				m.server.Leave(pc.ID, msg.Topic)
+			}
+
+		default:
+			if !signaling.IsRelayType(msg.Type) {
+				m.sendError(ctx, msg.Topic, "invalid_type", "unknown message type", msg.MsgID)
+				continue
+			}
+			if msg.To == "" {
+				m.sendError(ctx, msg.Topic, "missing_target", "to field required", msg.MsgID)
+				continue
+			}
+			pc, ok := m.subs[msg.Topic]
+			if !ok {
+				m.sendError(ctx, msg.Topic, "not_subscribed", "not subscribed to topic", msg.MsgID)
+				continue
+			}
+
+			result := m.server.Relay(msg.Topic, pc.ID, msg.To, msg.Type, msg.Payload, msg.MsgID)
+			if code, message := relayError(result); code != "" {
+				m.sendError(ctx, msg.Topic, code, message, msg.MsgID)
+			} else if msg.Ack && msg.MsgID != "" && result == signaling.RelayDelivered {
+				m.enqueue(ctx, signaling.OutboundMessage{Type: "ack", MsgID: msg.MsgID, Topic: msg.Topic})
+			}
+		}
+	}
+}
+
+// subscribe joins a topic and forwards its events to the connection
+func (m *muxConn) subscribe(ctx context.Context, msg signaling.InboundMessage) {
+	if !m.server.AcceptingJoins() {
+		m.sendError(ctx, msg.Topic, "server_draining", "server is draining; reconnect to subscribe", msg.MsgID)
+		return
+	}
+	if pc, ok := m.subs[msg.Topic]; ok {
+		select {
+		case <-pc.Done():
+			// Kicked from the topic; the subscription is gone
+			delete(m.subs, msg.Topic)
+		default:
+			m.sendError(ctx, msg.Topic, "already_subscribed", "already subscribed to topic", msg.MsgID)
+			return
+		}
+	}
+	if len(m.subs) >= maxSubscriptions {
+		m.sendError(ctx, msg.Topic, "too_many_subscriptions", "subscription limit reached", msg.MsgID)
+		return
+	}
+	metadata, err := parseMetadata(string(msg.Metadata))
+	if err != nil {
+		m.sendError(ctx, msg.Topic, "invalid_metadata", err.Error(), msg.MsgID)
+		return
+	}
+	observer, err := parseRole(msg.Role)
+	if err != nil {
+		m.sendError(ctx, msg.Topic, "invalid_role", err.Error(), msg.MsgID)
+		return
+	}
+	if key := revokedKey(m.server, metadata, ""); key != "" {
+		m.logger.Info("rejected revoked identity", "topic", msg.Topic, "publicKey", key)
+		m.sendError(ctx, msg.Topic, "identity_revoked", "identity key has been revoked", msg.MsgID)
+		return
+	}
+
+	// Subscriptions cannot prove an identity key, so only open topics admit them
+	if err := m.server.Authorize(msg.Topic, "", metadata); err != nil {
+		m.logger.Info("subscription refused by topic ACL", "topic", msg.Topic, "error", err)
+		m.sendError(ctx, msg.Topic, aclErrorCode(err), err.Error(), msg.MsgID)
+		return
+	}
+
+	var pc *signaling.PeerConn
+	var existingPeers []signaling.PeerRecord
+	if observer {
+		pc, existingPeers = m.server.Observe(msg.Topic)
+	} else {
+		pc, existingPeers = m.server.Join(msg.Topic, metadata)
+	}
+	m.server.Connected(pc, m.remote, false)
+	m.subs[msg.Topic] = pc
+
+	// Queue welcome and peer list before forwarding topic events so they arrive first
+	m.enqueue(ctx, signaling.OutboundMessage{
+		Type:       "welcome",
+		SelfID:     pc.ID,
+		Topic:      msg.Topic,
+		MsgID:      msg.MsgID,
+		Hints:      serverHints(m.server, m.opts, maxSubscriptions),
+		ICEServers: m.server.TURN().ICEServers(pc.ID, time.Now()),
+	})
+	m.enqueue(ctx, signaling.OutboundMessage{Type: "peer-list", Peers: existingPeers, Topic: msg.Topic, Seq: pc.JoinSeq})
+	go m.forward(ctx, pc)
+
+	m.logger.Info("subscribed to topic", "peer", pc.ID, "topic", msg.Topic, "observer", observer)
+}
+
+// forward copies a subscription's outbound messages to the connection, tagged
+// with its topic, and tells the client if the server kicks the subscription
+func (m *muxConn) forward(ctx context.Context, pc *signaling.PeerConn) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-pc.Done():
+			if reason, detail, kicked := pc.Kicked(); kicked {
+				m.queueError(ctx, pc.TopicID, pc.ID, strings.ReplaceAll(string(reason), "-", "_"), detail, "")
+			}
+			return
+		case msg := <-pc.Send:
+			msg.Topic = pc.TopicID
+			m.enqueue(ctx, msg)
+		}
+	}
+}
+
+// enqueue hands a frame to the writer
+func (m *muxConn) enqueue(ctx context.Context, msg any) {
+	select {
+	case m.out <- msg:
+	case <-ctx.Done():
+	}
+}
+
+// unsubscribeAll leaves every subscribed topic
+func (m *muxConn) unsubscribeAll() {
+	for topic, pc := range m.subs {
+		m.server.Leave(pc.ID, topic)
+	}
+}
+
+// sendError queues an error frame for the client (best-effort) about one of
+// its subscriptions, if it has one to topic. Only the reader may call it,
+// since it reads subs.
+func (m *muxConn) sendError(ctx context.Context, topic, code, message, msgID string) {
+	var peerID string
+	if pc, ok := m.subs[topic]; ok {
+		peerID = pc.ID
+	}
+	m.queueError(ctx, topic, peerID, code, message, msgID)
+}
+
+// queueError audits an error to the subscription peerID and queues it
+func (m *muxConn) queueError(ctx context.Context, topic, peerID, code, message, msgID string) {
+	m.server.AuditError(topic, peerID, m.remote, code, message)
+	m.enqueue(ctx, signaling.ErrorMessage{
+		Type:    "error",
+		Code:    code,
+		Message: message,
+		MsgID:   msgID,
+		Topic:   topic,
+	})
+}
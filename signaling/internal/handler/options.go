@@ -0,0 +1,41 @@
+package handler
+
+import "time"
+
+const (
+	// DefaultMaxMessageSize is the largest frame read from a client, 64KB
+	// for SDP
+	DefaultMaxMessageSize = 64 * 1024
+	// DefaultWriteTimeout bounds each write to a client
+	DefaultWriteTimeout = 5 * time.Second
+	// DefaultPingInterval is how often connections are pinged
+	DefaultPingInterval = 30 * time.Second
+)
+
+// Options tunes the signaling protocol, e.g. for clients with large session
+// descriptions or on high-latency links. Zero fields take the defaults.
+type Options struct {
+	// MaxMessageSize is the largest frame read from a client; larger ones
+	// close the connection
+	MaxMessageSize int
+	// WriteTimeout bounds each write to a client; a client that does not
+	// take a message in time is disconnected
+	WriteTimeout time.Duration
+	// PingInterval is how often connections are pinged, keeping proxies
+	// from closing idle ones and detecting dead clients
+	PingInterval time.Duration
+}
+
+// withDefaults fills the zero fields of o with the defaults
+func (o Options) withDefaults() Options {
+	if o.MaxMessageSize <= 0 {
+		o.MaxMessageSize = DefaultMaxMessageSize
+	}
+	if o.WriteTimeout <= 0 {
+		o.WriteTimeout = DefaultWriteTimeout
+	}
+	if o.PingInterval <= 0 {
+		o.PingInterval = DefaultPingInterval
+	}
+	return o
+}
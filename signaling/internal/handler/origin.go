@@ -0,0 +1,51 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"nhooyr.io/websocket"
+)
+
+// OriginAllowed reports whether a browser Origin matches one of patterns:
+// patterns containing "://" match the whole origin, others only its host,
+// both with path.Match syntax. Any origin is allowed when patterns is empty.
+func OriginAllowed(origin string, patterns []string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	for _, pattern := range patterns {
+		target := u.Host
+		if strings.Contains(pattern, "://") {
+			target = origin
+		}
+		if ok, _ := path.Match(strings.ToLower(pattern), strings.ToLower(target)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// accept accepts a WebSocket if the browser that opened it, if any, is on
+// the server's own host or an origin matching origins, and responds 403
+// otherwise
+func accept(w http.ResponseWriter, r *http.Request, origins []string) (*websocket.Conn, error) {
+	if origin := r.Header.Get("Origin"); origin != "" && !sameHost(r, origin) && !OriginAllowed(origin, origins) {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return nil, fmt.Errorf("origin %q not allowed", origin)
+	}
+	return websocket.Accept(w, r, acceptOptions(r))
+}
+
+// sameHost reports whether origin is on the host the request was sent to
+func sameHost(r *http.Request, origin string) bool {
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
@@ -0,0 +1,286 @@
+package handler
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/jhead/lanscape/signaling/pkg/signaling"
+)
+
+// SessionHeader carries the secret of an SSE session on the requests that
+// send its messages
+const SessionHeader = "Lanscape-Session"
+
+// errLeft ends an SSE session whose client left with a DELETE, so its peer
+// leaves rather than being held for resumption
+var errLeft = errors.New("client left")
+
+// errClosed ends an SSE session the server closed
+var errClosed = errors.New("closed by server")
+
+// SSESessions are the open SSE sessions, so the requests carrying a client's
+// messages find the event stream they belong to
+type SSESessions struct {
+	mu sync.Mutex
+	// byID holds each session under its secret, and under its peer ID once
+	// the peer has joined
+	byID map[string]*sseConn
+}
+
+// NewSSESessions returns an empty session table
+func NewSSESessions() *SSESessions {
+	return &SSESessions{byID: make(map[string]*sseConn)}
+}
+
+func (s *SSESessions) add(id string, c *sseConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.byID[id] = c
+}
+
+func (s *SSESessions) remove(c *sseConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, other := range s.byID {
+		if other == c {
+			delete(s.byID, id)
+		}
+	}
+}
+
+func (s *SSESessions) get(id string) *sseConn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.byID[id]
+}
+
+// HandleSSE returns an HTTP handler for signaling over Server-Sent Events,
+// a fallback for networks whose proxies block WebSockets. Clients open an
+// event stream at /sse/{topic} with the same query parameters as
+// HandleSignaling, and send their messages with HandleSSESend. The stream
+// starts with a session event holding the secret those requests present.
+// Messages are always JSON. token, origins, and opts apply as in
+// HandleSignaling.
+func HandleSSE(sessions *SSESessions, server *signaling.Server, token string, origins []string, opts Options, logger *slog.Logger) http.HandlerFunc {
+	opts = opts.withDefaults()
+	return func(w http.ResponseWriter, r *http.Request) {
+		if origin := r.Header.Get("Origin"); origin != "" && !sameHost(r, origin) && !OriginAllowed(origin, origins) {
+			http.Error(w, "origin not allowed", http.StatusForbidden)
+			logger.Error("sse stream refused", "remote", r.RemoteAddr, "error", fmt.Errorf("origin %q not allowed", origin))
+			return
+		}
+
+		join, err := parseJoin(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		secret, err := newSessionSecret()
+		if err != nil {
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			logger.Error("failed to create sse session", "error", err)
+			return
+		}
+		c := &sseConn{
+			w:        w,
+			rc:       http.NewResponseController(w),
+			sessions: sessions,
+			topicID:  join.topicID,
+			secret:   secret,
+			opts:     opts,
+			frames:   make(chan []byte),
+			done:     make(chan struct{}),
+		}
+		sessions.add(secret, c)
+		defer sessions.remove(c)
+		defer c.end()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-store")
+		// Keep nginx from buffering the stream
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+
+		ctx, cancel := context.WithTimeout(r.Context(), opts.WriteTimeout)
+		err = c.event(ctx, "session", struct {
+			Session string `json:"session"`
+		}{secret})
+		cancel()
+		if err != nil {
+			logger.Debug("failed to send sse session", "remote", r.RemoteAddr, "error", err)
+			return
+		}
+
+		serveTopic(r.Context(), c, signaling.EncodingJSON, r, server, join, token, "sse", opts, logger)
+	}
+}
+
+// HandleSSESend returns an HTTP handler for the messages of SSE sessions.
+// Clients POST one message to /sse/{topic}/{id}, where id is their peer ID
+// once they have been welcomed, or the session secret before, with the
+// secret in the Lanscape-Session header. Routing on the peer ID lets a load
+// balancer send them to the server holding the stream. A DELETE ends the
+// session, leaving the topic. Messages are limited to the session's
+// MaxMessageSize.
+func HandleSSESend(sessions *SSESessions, logger *slog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c := sessions.get(r.PathValue("id"))
+		if c == nil || c.topicID != r.PathValue("topic") ||
+			subtle.ConstantTimeCompare([]byte(r.Header.Get(SessionHeader)), []byte(c.secret)) != 1 {
+			http.Error(w, "unknown session", http.StatusNotFound)
+			return
+		}
+
+		if r.Method == http.MethodDelete {
+			c.fail(errLeft)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, int64(c.opts.MaxMessageSize)))
+		if err != nil {
+			http.Error(w, "message too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		select {
+		case c.frames <- data:
+			w.WriteHeader(http.StatusNoContent)
+		case <-c.done:
+			http.Error(w, "session ended", http.StatusGone)
+		case <-r.Context().Done():
+		}
+	}
+}
+
+// newSessionSecret returns a random session secret
+func newSessionSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// sseConn is an event stream carrying messages to a client, with the
+// client's messages arriving in separate requests
+type sseConn struct {
+	w        http.ResponseWriter
+	rc       *http.ResponseController
+	sessions *SSESessions
+	topicID  string
+	secret   string
+	opts     Options
+
+	frames chan []byte
+	done   chan struct{}
+	once   sync.Once
+	err    error // why reading ended, set before done is closed
+
+	writeMu sync.Mutex
+	ended   bool // the handler has returned, so the stream is gone
+}
+
+// joined indexes the session under the peer ID it was welcomed with
+func (c *sseConn) joined(peerID string) {
+	c.sessions.add(peerID, c)
+}
+
+// end stops writes once the handler returns, since the writer may still be
+// running
+func (c *sseConn) end() {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.ended = true
+}
+
+// fail ends reading with err
+func (c *sseConn) fail(err error) {
+	c.once.Do(func() {
+		c.err = err
+		close(c.done)
+	})
+}
+
+func (c *sseConn) Read(ctx context.Context) ([]byte, error) {
+	select {
+	case frame := <-c.frames:
+		return frame, nil
+	case <-c.done:
+		return nil, c.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Write sends data as a message event. Encoded JSON holds no newlines, so it
+// fits on one data line.
+func (c *sseConn) Write(ctx context.Context, data []byte) error {
+	return c.write(ctx, "data: "+string(data)+"\n\n")
+}
+
+// Ping sends a comment, which clients ignore, so idle proxies keep the
+// stream open and a client that went away is found
+func (c *sseConn) Ping(ctx context.Context) error {
+	return c.write(ctx, ": ping\n\n")
+}
+
+// Close sends a close event with the reason's WebSocket close code and text,
+// and ends the stream
+func (c *sseConn) Close(reason signaling.CloseReason, detail string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), c.opts.WriteTimeout)
+	defer cancel()
+	err := c.event(ctx, "close", struct {
+		Code   int    `json:"code"`
+		Reason string `json:"reason"`
+	}{int(reason.Code()), reason.Text(detail)})
+	c.fail(errClosed)
+	return err
+}
+
+// Dropped reports whether the stream ended other than by the client leaving
+func (c *sseConn) Dropped(err error) bool {
+	return err != nil && !errors.Is(err, errLeft)
+}
+
+// event sends v as an event named name
+func (c *sseConn) event(ctx context.Context, name string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.write(ctx, "event: "+name+"\ndata: "+string(data)+"\n\n")
+}
+
+// write writes s to the stream and flushes it, within ctx's deadline. The
+// deadline replaces the HTTP server's write timeout, which would otherwise
+// end the stream.
+func (c *sseConn) write(ctx context.Context, s string) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.ended {
+		return net.ErrClosed
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(c.opts.WriteTimeout)
+	}
+	if err := c.rc.SetWriteDeadline(deadline); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(c.w, s); err != nil {
+		return err
+	}
+	return c.rc.Flush()
+}
@@ -0,0 +1,56 @@
+package handler
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/jhead/lanscape/signaling/pkg/signaling"
+)
+
+// maxTURNUsernameLength bounds the user a client asks to embed in TURN
+// credentials; peer IDs are well under it
+const maxTURNUsernameLength = 128
+
+// turnCredentialsResponse is the response to GET /turn-credentials, in the
+// TURN REST API format coturn documents
+type turnCredentialsResponse struct {
+	Username string   `json:"username"`
+	Password string   `json:"password"`
+	TTL      int64    `json:"ttl"` // seconds
+	URIs     []string `json:"uris"`
+}
+
+// HandleTURNCredentials returns an HTTP handler that mints TURN credentials,
+// for clients that need them before or without joining a topic. The optional
+// username query parameter is embedded in the credentials' username. When
+// token is set, clients must present it as they would to connect.
+func HandleTURNCredentials(turn *signaling.TURNCredentials, token string, logger *slog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if token != "" && subtle.ConstantTimeCompare([]byte(clientToken(r)), []byte(token)) != 1 {
+			logger.Info("refused TURN credentials without a valid token", "remote", r.RemoteAddr)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		user := r.URL.Query().Get("username")
+		if len(user) > maxTURNUsernameLength {
+			http.Error(w, "username too long", http.StatusBadRequest)
+			return
+		}
+
+		servers := turn.ICEServers(user, time.Now())
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		if err := json.NewEncoder(w).Encode(turnCredentialsResponse{
+			Username: servers[0].Username,
+			Password: servers[0].Credential,
+			TTL:      int64(turn.TTL().Seconds()),
+			URIs:     servers[0].URLs,
+		}); err != nil {
+			logger.Error("failed to write TURN credentials", "error", err)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package handler
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+
+	"github.com/jhead/lanscape/signaling/pkg/signaling"
+	"github.com/quic-go/webtransport-go"
+)
+
+// frameHeaderSize is the length prefix of each message on a WebTransport
+// stream: the message's size as a 4-byte big-endian integer
+const frameHeaderSize = 4
+
+// HandleWebTransport returns an HTTP/3 handler for WebTransport signaling
+// sessions. Clients open a session at /wt/{topic} with the same query
+// parameters as HandleSignaling, plus encoding=cbor to select CBOR, since
+// WebTransport has no subprotocols. The server opens one bidirectional
+// stream carrying every message in order, each prefixed with its length.
+// Clients may also send messages in datagrams, one per datagram, for those
+// that tolerate loss, such as ICE candidates, so a lost packet does not hold
+// them up behind the stream. token, origins, and opts apply as in
+// HandleSignaling.
+func HandleWebTransport(wt *webtransport.Server, server *signaling.Server, token string, origins []string, opts Options, logger *slog.Logger) http.HandlerFunc {
+	opts = opts.withDefaults()
+	return func(w http.ResponseWriter, r *http.Request) {
+		if origin := r.Header.Get("Origin"); origin != "" && !sameHost(r, origin) && !OriginAllowed(origin, origins) {
+			http.Error(w, "origin not allowed", http.StatusForbidden)
+			logger.Error("webtransport upgrade failed", "remote", r.RemoteAddr, "error", fmt.Errorf("origin %q not allowed", origin))
+			return
+		}
+
+		join, err := parseJoin(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		encoding := signaling.EncodingJSON
+		switch v := r.URL.Query().Get("encoding"); v {
+		case "", string(signaling.EncodingJSON):
+		case string(signaling.EncodingCBOR):
+			encoding = signaling.EncodingCBOR
+		default:
+			http.Error(w, fmt.Sprintf("unknown encoding %q", v), http.StatusBadRequest)
+			return
+		}
+
+		session, err := wt.Upgrade(w, r)
+		if err != nil {
+			logger.Error("webtransport upgrade failed", "remote", r.RemoteAddr, "error", err)
+			return
+		}
+		defer session.CloseWithError(0, "")
+
+		stream, err := session.OpenStream()
+		if err != nil {
+			logger.Debug("failed to open webtransport stream", "remote", r.RemoteAddr, "error", err)
+			return
+		}
+		c := newWTConn(session, stream, opts.MaxMessageSize)
+
+		serveTopic(session.Context(), c, encoding, r, server, join, token, "webtransport", opts, logger)
+	}
+}
+
+// wtConn is a WebTransport session read from its stream and datagrams and
+// written to its stream
+type wtConn struct {
+	session *webtransport.Session
+	stream  *webtransport.Stream
+	maxSize int // largest frame read
+
+	frames chan []byte
+	done   chan struct{}
+	once   sync.Once
+	err    error // why reading ended, set before done is closed
+
+	writeMu sync.Mutex
+}
+
+// newWTConn starts reading the session's stream and datagrams, closing the
+// session on a frame over maxSize bytes
+func newWTConn(session *webtransport.Session, stream *webtransport.Stream, maxSize int) *wtConn {
+	c := &wtConn{
+		session: session,
+		stream:  stream,
+		maxSize: maxSize,
+		frames:  make(chan []byte),
+		done:    make(chan struct{}),
+	}
+	go c.readStream()
+	go c.readDatagrams()
+	return c
+}
+
+// readStream reads length-prefixed frames from the stream until it ends
+func (c *wtConn) readStream() {
+	var header [frameHeaderSize]byte
+	for {
+		if _, err := io.ReadFull(c.stream, header[:]); err != nil {
+			c.fail(err)
+			return
+		}
+		size := binary.BigEndian.Uint32(header[:])
+		if int64(size) > int64(c.maxSize) {
+			c.Close(signaling.CloseProtocolError, "message too large")
+			c.fail(fmt.Errorf("%d byte frame exceeds the %d byte limit", size, c.maxSize))
+			return
+		}
+		frame := make([]byte, size)
+		if _, err := io.ReadFull(c.stream, frame); err != nil {
+			c.fail(err)
+			return
+		}
+		if !c.deliver(frame) {
+			return
+		}
+	}
+}
+
+// readDatagrams reads one frame per datagram until the session ends. Reading
+// fails on the stream, which ends with the session, so errors here are not
+// reported.
+func (c *wtConn) readDatagrams() {
+	for {
+		frame, err := c.session.ReceiveDatagram(c.session.Context())
+		if err != nil {
+			return
+		}
+		if !c.deliver(frame) {
+			return
+		}
+	}
+}
+
+// deliver hands a frame to Read, returning false once reading has ended
+func (c *wtConn) deliver(frame []byte) bool {
+	select {
+	case c.frames <- frame:
+		return true
+	case <-c.done:
+		return false
+	}
+}
+
+// fail ends reading with err
+func (c *wtConn) fail(err error) {
+	c.once.Do(func() {
+		c.err = err
+		close(c.done)
+	})
+}
+
+func (c *wtConn) Read(ctx context.Context) ([]byte, error) {
+	select {
+	case frame := <-c.frames:
+		return frame, nil
+	case <-c.done:
+		return nil, c.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (c *wtConn) Write(ctx context.Context, data []byte) error {
+	frame := make([]byte, frameHeaderSize+len(data))
+	binary.BigEndian.PutUint32(frame, uint32(len(data)))
+	copy(frame[frameHeaderSize:], data)
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	deadline, _ := ctx.Deadline()
+	c.stream.SetWriteDeadline(deadline)
+	_, err := c.stream.Write(frame)
+	return err
+}
+
+// Ping reports whether the session is still open. QUIC keep-alives find
+// clients that went away.
+func (c *wtConn) Ping(ctx context.Context) error {
+	return c.session.Context().Err()
+}
+
+// Close closes the session with the reason's WebSocket close code as its
+// error code, and the same text
+func (c *wtConn) Close(reason signaling.CloseReason, detail string) error {
+	return c.session.CloseWithError(webtransport.SessionErrorCode(reason.Code()), reason.Text(detail))
+}
+
+func (c *wtConn) Dropped(err error) bool {
+	var sessionErr *webtransport.SessionError
+	if errors.As(err, &sessionErr) && sessionErr.Remote && sessionErr.ErrorCode == 0 {
+		return false
+	}
+	return err != nil && !errors.Is(err, io.EOF)
+}
@@ -2,78 +2,359 @@ package handler
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"log/slog"
 	"net/http"
+	"net/url"
+	"slices"
 	"time"
 
+	"github.com/jhead/lanscape/signaling/pkg/buildinfo"
 	"github.com/jhead/lanscape/signaling/pkg/signaling"
-	"nhooyr.io/websocket"
-	"nhooyr.io/websocket/wsjson"
 )
 
 const (
-	maxMessageSize = 64 * 1024 // 64KB for SDP
-	writeTimeout   = 5 * time.Second
-	pingInterval   = 30 * time.Second
+	maxMetadataSize  = 4 * 1024 // 4KB for peer metadata
+	challengeTimeout = 10 * time.Second
 )
 
+// features lists the optional protocol features this server supports
+var features = []string{"stable-id", "observer", "multiplex", "close-codes", "membership-seq", "peer-info", "cbor", "ack", "server-draining"}
+
+// serverHints returns the hints sent in a welcome on a connection with opts.
+// maxTopics is set only for multiplexed connections. App-relay is advertised
+// if server accepts it.
+func serverHints(server *signaling.Server, opts Options, maxTopics int) *signaling.ServerHints {
+	hints := &signaling.ServerHints{
+		MaxMessageSize:  opts.MaxMessageSize,
+		MaxMetadataSize: maxMetadataSize,
+		PingIntervalMs:  opts.PingInterval.Milliseconds(),
+		SendQueueSize:   server.SendQueueSize(),
+		RelayTimeoutMs:  signaling.RelayTimeout.Milliseconds(),
+		MaxTopics:       maxTopics,
+		Features:        features,
+		Version:         buildinfo.Get().Version,
+	}
+	if size := server.AppRelayMaxSize(); size > 0 {
+		hints.Features = append(slices.Clip(hints.Features), "app-relay")
+		hints.AppRelayMaxSize = size
+	}
+	return hints
+}
+
 // HandleSignaling returns an HTTP handler for WebSocket signaling connections.
-// Clients connect to /ws/{topic} to join a signaling topic.
-func HandleSignaling(server *signaling.Server, logger *slog.Logger) http.HandlerFunc {
+// Clients connect to /ws/{topic} to join a signaling topic. Clients that pass
+// a publicKey query parameter must answer a signed challenge and are given a
+// stable peer ID derived from the key. Clients that pass the resume token
+// from an earlier welcome get their peer ID back if it is still held. When
+// token is set, clients must present it before joining. Browsers on other
+// origins are refused unless they match origins, if any are given. opts
+// tunes the protocol.
+func HandleSignaling(server *signaling.Server, token string, origins []string, opts Options, logger *slog.Logger) http.HandlerFunc {
+	opts = opts.withDefaults()
 	return func(w http.ResponseWriter, r *http.Request) {
-		topicID := r.PathValue("topic")
-		if topicID == "" {
-			http.Error(w, "topic required", http.StatusBadRequest)
+		join, err := parseJoin(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
-		conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
-			OriginPatterns: []string{"*"}, // TODO: configure for production
-		})
+		ws, err := accept(w, r, origins)
 		if err != nil {
-			logger.Error("websocket accept failed", "error", err)
+			logger.Error("websocket accept failed", "remote", r.RemoteAddr, "error", err)
 			return
 		}
-		conn.SetReadLimit(maxMessageSize)
-
-		ctx := r.Context()
-		pc, existingPeers := server.Join(topicID, nil)
-		defer server.Leave(pc.ID, topicID)
-
-		// Send welcome message with self ID
-		if err := wsjson.Write(ctx, conn, signaling.OutboundMessage{
-			Type:   "welcome",
-			SelfID: pc.ID,
-		}); err != nil {
-			logger.Debug("failed to send welcome", "peer", pc.ID, "error", err)
+		ws.SetReadLimit(int64(opts.MaxMessageSize))
+		encoding := signaling.ParseSubprotocol(ws.Subprotocol())
+
+		serveTopic(r.Context(), wsConn{ws, encoding}, encoding, r, server, join, token, "websocket", opts, logger)
+	}
+}
+
+// joinRequest is what a client asks for when it connects to a topic
+type joinRequest struct {
+	topicID  string
+	metadata json.RawMessage
+	observer bool
+}
+
+// parseJoin reads the topic from the path, and the metadata, peer info, and
+// role from the query
+func parseJoin(r *http.Request) (joinRequest, error) {
+	join := joinRequest{topicID: r.PathValue("topic")}
+	if join.topicID == "" {
+		return join, errors.New("topic required")
+	}
+
+	var err error
+	if join.metadata, err = parseMetadata(r.URL.Query().Get("metadata")); err != nil {
+		return join, err
+	}
+	if join.metadata, err = withQueryPeerInfo(join.metadata, r.URL.Query()); err != nil {
+		return join, err
+	}
+	if join.observer, err = parseRole(r.URL.Query().Get("role")); err != nil {
+		return join, err
+	}
+	return join, nil
+}
+
+// serveTopic authenticates the client on c, joins or resumes its peer in the
+// topic, and relays messages until the connection ends. transport names the
+// kind of connection in logs.
+func serveTopic(ctx context.Context, c conn, encoding signaling.Encoding, r *http.Request, server *signaling.Server, join joinRequest, token, transport string, opts Options, logger *slog.Logger) {
+	topicID, observer := join.topicID, join.observer
+
+	// A draining server refuses joins and resumptions alike
+	if !server.AcceptingJoins() {
+		c.Close(signaling.CloseDraining, "")
+		return
+	}
+
+	if !authenticate(ctx, c, encoding, r, server, topicID, token, logger) {
+		return
+	}
+
+	if key := revokedKey(server, join.metadata, r.URL.Query().Get("publicKey")); key != "" {
+		logger.Info("rejected revoked identity", "topic", topicID, "publicKey", key)
+		server.AuditError(topicID, "", r.RemoteAddr, "identity_revoked", "identity key has been revoked")
+		sendError(ctx, c, encoding, "identity_revoked", "identity key has been revoked", "")
+		c.Close(signaling.CloseAuthFailed, "identity revoked")
+		return
+	}
+
+	// A client whose connection dropped gets its peer ID back with the
+	// resume token from its last welcome, and falls back to a fresh join
+	pc, existingPeers, listSeq, resumed := resumePeer(server, topicID, r.URL.Query().Get("resume"), observer, logger)
+	if !resumed {
+		var ok bool
+		if pc, existingPeers, ok = joinTopic(ctx, c, encoding, r, server, topicID, join.metadata, observer, logger); !ok {
 			return
 		}
+		listSeq = pc.JoinSeq
+	}
+	// Leaving or holding the peer for resumption depends on how the
+	// connection ends; if the welcome is never sent, it just leaves
+	var readErr error
+	welcomed := false
+	defer func() { server.Disconnected(pc, welcomed && c.Dropped(readErr)) }()
+	server.Connected(pc, r.RemoteAddr, resumed)
 
-		// Send peer list
-		if err := wsjson.Write(ctx, conn, signaling.OutboundMessage{
-			Type:  "peer-list",
-			Peers: existingPeers,
-		}); err != nil {
-			logger.Debug("failed to send peer-list", "peer", pc.ID, "error", err)
-			return
+	// Send welcome message with self ID, server hints, TURN credentials,
+	// and a resume token
+	if err := writeMessage(ctx, c, encoding, signaling.OutboundMessage{
+		Type:        "welcome",
+		SelfID:      pc.ID,
+		Hints:       withResume(serverHints(server, opts, 0), server),
+		ICEServers:  server.TURN().ICEServers(pc.ID, time.Now()),
+		ResumeToken: server.ResumeToken(pc),
+		Resumed:     resumed,
+	}); err != nil {
+		logger.Debug("failed to send welcome", "peer", pc.ID, "error", err)
+		return
+	}
+	welcomed = true
+	// Connections whose client sends on separate requests route them by
+	// peer ID
+	if j, ok := c.(interface{ joined(peerID string) }); ok {
+		j.joined(pc.ID)
+	}
+
+	// Send peer list
+	if err := writeMessage(ctx, c, encoding, signaling.OutboundMessage{
+		Type:  "peer-list",
+		Peers: existingPeers,
+		Seq:   listSeq,
+	}); err != nil {
+		logger.Debug("failed to send peer-list", "peer", pc.ID, "error", err)
+		return
+	}
+
+	logger.Info(transport+" connected", "peer", pc.ID, "topic", topicID, "observer", observer, "resumed", resumed, "hostname", pc.Info.Hostname, "remote", r.RemoteAddr, "encoding", encoding)
+
+	// Start writer goroutine (single writer per connection)
+	go writerLoop(ctx, c, encoding, pc, server.Draining(), opts, logger)
+
+	// Reader loop blocks until disconnect
+	readErr = readerLoop(ctx, c, encoding, pc, server, topicID, logger)
+
+	logger.Info(transport+" disconnected", "peer", pc.ID, "topic", topicID)
+}
+
+// joinTopic proves the client's identity key if it gave one, checks the
+// topic ACL, and joins the topic. On failure it reports the error to the
+// client, closes the connection, and returns false.
+func joinTopic(ctx context.Context, c conn, encoding signaling.Encoding, r *http.Request, server *signaling.Server, topicID string, metadata json.RawMessage, observer bool, logger *slog.Logger) (*signaling.PeerConn, []signaling.PeerRecord, bool) {
+	// Observers never prove a key, so only open topics admit them
+	publicKey := r.URL.Query().Get("publicKey")
+	var peerID string
+	var err error
+	if !observer && publicKey != "" {
+		if peerID, err = proveIdentity(ctx, c, encoding, topicID, publicKey); err != nil {
+			logger.Info("join challenge failed", "topic", topicID, "error", err)
+			server.AuditError(topicID, "", r.RemoteAddr, "challenge_failed", err.Error())
+			sendError(ctx, c, encoding, "challenge_failed", err.Error(), "")
+			c.Close(signaling.CloseAuthFailed, "challenge failed")
+			return nil, nil, false
 		}
+	} else {
+		publicKey = ""
+	}
+	if err := server.Authorize(topicID, publicKey, metadata); err != nil {
+		logger.Info("join refused by topic ACL", "topic", topicID, "publicKey", publicKey, "error", err)
+		server.AuditError(topicID, "", r.RemoteAddr, aclErrorCode(err), err.Error())
+		sendError(ctx, c, encoding, aclErrorCode(err), err.Error(), "")
+		c.Close(signaling.CloseAuthFailed, "not authorized")
+		return nil, nil, false
+	}
 
-		logger.Info("websocket connected", "peer", pc.ID, "topic", topicID)
+	var pc *signaling.PeerConn
+	var existingPeers []signaling.PeerRecord
+	if observer {
+		pc, existingPeers = server.Observe(topicID)
+	} else if peerID != "" {
+		pc, existingPeers, err = server.JoinWithKey(publicKey, peerID, topicID, metadata)
+		if err != nil {
+			server.AuditError(topicID, peerID, r.RemoteAddr, "peer_id_in_use", "peer ID already in topic")
+			sendError(ctx, c, encoding, "peer_id_in_use", "peer ID already in topic", "")
+			c.Close(signaling.CloseAuthFailed, "peer ID in use")
+			return nil, nil, false
+		}
+	} else {
+		pc, existingPeers = server.Join(topicID, metadata)
+	}
+	return pc, existingPeers, true
+}
 
-		// Start writer goroutine (single writer per connection)
-		go writerLoop(ctx, conn, pc, logger)
+// resumePeer reattaches the client to the peer its resume token was issued
+// to, if it gave one that is still usable. It returns the peer, records of
+// the other peers, the sequence number for its peer-list, and whether it
+// resumed.
+func resumePeer(server *signaling.Server, topicID, token string, observer bool, logger *slog.Logger) (*signaling.PeerConn, []signaling.PeerRecord, uint64, bool) {
+	if token == "" || observer {
+		return nil, nil, 0, false
+	}
+	pc, existingPeers, seq, err := server.Resume(topicID, token)
+	if err != nil {
+		logger.Info("resume refused, joining as a new peer", "topic", topicID, "error", err)
+		return nil, nil, 0, false
+	}
+	return pc, existingPeers, seq, true
+}
 
-		// Reader loop blocks until disconnect
-		readerLoop(ctx, conn, pc, server, topicID, logger)
+// withResume advertises resumption in hints if server supports it
+func withResume(hints *signaling.ServerHints, server *signaling.Server) *signaling.ServerHints {
+	if grace := server.ResumeGrace(); grace > 0 {
+		hints.Features = append(slices.Clip(hints.Features), "resume")
+		hints.ResumeGraceMs = grace.Milliseconds()
+	}
+	return hints
+}
+
+// proveIdentity challenges the client to sign a nonce with the key it claims
+// and returns the peer ID derived from that key
+func proveIdentity(ctx context.Context, c conn, encoding signaling.Encoding, topicID, publicKey string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, challengeTimeout)
+	defer cancel()
+
+	nonce := signaling.NewChallenge()
+	if err := writeMessage(ctx, c, encoding, signaling.OutboundMessage{Type: "challenge", Nonce: nonce}); err != nil {
+		return "", err
+	}
+
+	var msg signaling.InboundMessage
+	if err := readMessage(ctx, c, encoding, &msg); err != nil {
+		return "", err
+	}
+	if msg.Type != "challenge-response" {
+		return "", errors.New("expected challenge-response")
+	}
+	return signaling.VerifyJoinProof(publicKey, topicID, nonce, msg.Signature)
+}
+
+// parseRole validates the optional role query parameter and reports whether
+// it selects a read-only observer
+func parseRole(role string) (bool, error) {
+	switch role {
+	case "", "participant":
+		return false, nil
+	case "observer":
+		return true, nil
+	}
+	return false, errors.New("role must be participant or observer")
+}
+
+// parseMetadata validates the optional metadata query parameter.
+// Metadata is opaque to the server but must be a bounded JSON object.
+func parseMetadata(raw string) (json.RawMessage, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	if len(raw) > maxMetadataSize {
+		return nil, errors.New("metadata too large")
+	}
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(raw), &obj); err != nil {
+		return nil, errors.New("metadata must be a JSON object")
+	}
+	var info signaling.PeerInfo
+	if err := json.Unmarshal([]byte(raw), &info); err != nil {
+		return nil, errors.New("metadata hostname, displayName, and tailscaleIp must be strings")
+	}
+	if err := info.Validate(); err != nil {
+		return nil, err
+	}
+	return json.RawMessage(raw), nil
+}
+
+// withQueryPeerInfo adds the peer info in the optional hostname,
+// displayName, and tailscaleIp query parameters to metadata, for clients
+// that would rather not build a metadata object
+func withQueryPeerInfo(metadata json.RawMessage, query url.Values) (json.RawMessage, error) {
+	info := signaling.PeerInfo{
+		Hostname:    query.Get("hostname"),
+		DisplayName: query.Get("displayName"),
+		TailscaleIP: query.Get("tailscaleIp"),
+	}
+	if err := info.Validate(); err != nil {
+		return nil, err
+	}
+	metadata, err := signaling.WithPeerInfo(metadata, info)
+	if err != nil {
+		return nil, err
+	}
+	if len(metadata) > maxMetadataSize {
+		return nil, errors.New("metadata too large")
+	}
+	return metadata, nil
+}
+
+// revokedKey returns the identity key a joining peer proves or advertises if
+// lanscaped has revoked it, or empty if the peer may join
+func revokedKey(server *signaling.Server, metadata json.RawMessage, publicKey string) string {
+	if server.Revoked(publicKey) {
+		return publicKey
+	}
+	if key := signaling.MetadataPublicKey(metadata); server.Revoked(key) {
+		return key
+	}
+	return ""
+}
 
-		logger.Info("websocket disconnected", "peer", pc.ID, "topic", topicID)
+// aclErrorCode returns the error code for a join refused by a topic ACL
+func aclErrorCode(err error) string {
+	if errors.Is(err, signaling.ErrAuthRequired) {
+		return "auth_required"
 	}
+	return "not_authorized"
 }
 
-// writerLoop is the single goroutine that writes to the WebSocket connection.
-// It drains the peer's Send channel and handles ping/keepalive.
-func writerLoop(ctx context.Context, conn *websocket.Conn, pc *signaling.PeerConn, logger *slog.Logger) {
-	ticker := time.NewTicker(pingInterval)
+// writerLoop is the single goroutine that writes to the connection.
+// It drains the peer's Send channel and handles ping/keepalive, and closes the
+// connection when the server starts draining or kicks the peer.
+func writerLoop(ctx context.Context, c conn, encoding signaling.Encoding, pc *signaling.PeerConn, draining <-chan struct{}, opts Options, logger *slog.Logger) {
+	ticker := time.NewTicker(opts.PingInterval)
 	defer ticker.Stop()
 
 	for {
@@ -81,10 +362,16 @@ func writerLoop(ctx context.Context, conn *websocket.Conn, pc *signaling.PeerCon
 		case <-ctx.Done():
 			return
 		case <-pc.Done():
+			if reason, detail, kicked := pc.Kicked(); kicked {
+				c.Close(reason, detail)
+			}
+			return
+		case <-draining:
+			c.Close(signaling.CloseDraining, "")
 			return
 		case msg := <-pc.Send:
-			writeCtx, cancel := context.WithTimeout(ctx, writeTimeout)
-			err := wsjson.Write(writeCtx, conn, msg)
+			writeCtx, cancel := context.WithTimeout(ctx, opts.WriteTimeout)
+			err := writeMessage(writeCtx, c, encoding, msg)
 			cancel()
 			if err != nil {
 				logger.Debug("write failed", "peer", pc.ID, "error", err)
@@ -92,7 +379,7 @@ func writerLoop(ctx context.Context, conn *websocket.Conn, pc *signaling.PeerCon
 				return
 			}
 		case <-ticker.C:
-			if err := conn.Ping(ctx); err != nil {
+			if err := c.Ping(ctx); err != nil {
 				logger.Debug("ping failed", "peer", pc.ID, "error", err)
 				pc.Cancel()
 				return
@@ -101,48 +388,96 @@ func writerLoop(ctx context.Context, conn *websocket.Conn, pc *signaling.PeerCon
 	}
 }
 
-// readerLoop reads messages from the WebSocket and routes them via the server.
-func readerLoop(ctx context.Context, conn *websocket.Conn, pc *signaling.PeerConn, server *signaling.Server, topicID string, logger *slog.Logger) {
+// readerLoop reads messages from the connection and routes them via the
+// server. It returns the read error that ended the connection, or nil if
+// the topic is gone.
+func readerLoop(ctx context.Context, c conn, encoding signaling.Encoding, pc *signaling.PeerConn, server *signaling.Server, topicID string, logger *slog.Logger) error {
+	// fail sends the client an error and audits it
+	fail := func(code, message, msgID string) {
+		server.AuditError(topicID, pc.ID, pc.RemoteAddr(), code, message)
+		sendError(ctx, c, encoding, code, message, msgID)
+	}
 	for {
 		var msg signaling.InboundMessage
-		if err := wsjson.Read(ctx, conn, &msg); err != nil {
-			// Connection closed or error - exit gracefully
-			return
+		if err := readMessage(ctx, c, encoding, &msg); err != nil {
+			return err
+		}
+
+		// A client that missed membership events asks for a fresh peer list
+		if msg.Type == "sync" {
+			if !server.Resync(topicID, pc.ID) {
+				fail("dropped", "delivery failed", msg.MsgID)
+			}
+			continue
 		}
 
 		// Validate message type
 		if !signaling.IsRelayType(msg.Type) {
-			sendError(ctx, conn, "invalid_type", "unknown message type", msg.MsgID)
+			fail("invalid_type", "unknown message type", msg.MsgID)
 			continue
 		}
 
 		// Validate target for relay types
 		if msg.To == "" {
-			sendError(ctx, conn, "missing_target", "to field required", msg.MsgID)
+			fail("missing_target", "to field required", msg.MsgID)
 			continue
 		}
 
 		// Relay the message
 		result := server.Relay(topicID, pc.ID, msg.To, msg.Type, msg.Payload, msg.MsgID)
-		switch result {
-		case signaling.RelayDelivered:
-			// Success - no response needed
-		case signaling.RelayTargetNotFound:
-			sendError(ctx, conn, "target_not_found", "peer not found", msg.MsgID)
-		case signaling.RelayDropped:
-			sendError(ctx, conn, "dropped", "delivery failed", msg.MsgID)
-		case signaling.RelayInvalidType:
-			sendError(ctx, conn, "invalid_type", "unknown message type", msg.MsgID)
-		case signaling.RelayTopicNotFound:
+		if result == signaling.RelayTopicNotFound {
 			// Topic gone - disconnect
-			return
+			return nil
 		}
+		if code, message := relayError(result); code != "" {
+			fail(code, message, msg.MsgID)
+		} else if msg.Ack && msg.MsgID != "" && result == signaling.RelayDelivered {
+			_ = writeMessage(ctx, c, encoding, signaling.OutboundMessage{Type: "ack", MsgID: msg.MsgID})
+		}
+	}
+}
+
+// relayError returns the error code and message reported to the sender for a
+// failed relay, or an empty code if it was delivered or held
+func relayError(result signaling.RelayResult) (code, message string) {
+	switch result {
+	case signaling.RelayTargetNotFound:
+		return "target_not_found", "peer not found"
+	case signaling.RelayDropped:
+		return "dropped", "delivery failed"
+	case signaling.RelayInvalidType:
+		return "invalid_type", "unknown message type"
+	case signaling.RelayTopicNotFound:
+		return "topic_not_found", "topic not found"
+	case signaling.RelayForbidden:
+		return "forbidden", "observers cannot relay"
+	case signaling.RelayRateLimited:
+		return "rate_limited", "relay rate limit exceeded"
+	case signaling.RelayNotAllowed:
+		return "not_allowed", "app-relay not permitted in topic"
+	case signaling.RelayTooLarge:
+		return "too_large", "app-relay payload too large"
+	}
+	return "", ""
+}
+
+// readMessage reads one message in the connection's encoding, closing the
+// connection with CloseProtocolError if the frame is not one
+func readMessage(ctx context.Context, c conn, encoding signaling.Encoding, msg *signaling.InboundMessage) error {
+	data, err := c.Read(ctx)
+	if err != nil {
+		return err
+	}
+	if err := encoding.Unmarshal(data, msg); err != nil {
+		c.Close(signaling.CloseProtocolError, "invalid "+string(encoding)+" message")
+		return err
 	}
+	return nil
 }
 
 // sendError sends an error message to the client (best-effort)
-func sendError(ctx context.Context, conn *websocket.Conn, code, message, msgID string) {
-	_ = wsjson.Write(ctx, conn, signaling.ErrorMessage{
+func sendError(ctx context.Context, c conn, encoding signaling.Encoding, code, message, msgID string) {
+	_ = writeMessage(ctx, c, encoding, signaling.ErrorMessage{
 		Type:    "error",
 		Code:    code,
 		Message: message,
@@ -0,0 +1,107 @@
+// Package buildinfo reports the version of the running binary, so
+// compatibility issues can be diagnosed across a deployment. Release builds
+// set Version, Commit, and Date with the linker:
+//
+//	go build -ldflags "-X github.com/jhead/lanscape/signaling/pkg/buildinfo.Version=1.2.0 \
+//	  -X github.com/jhead/lanscape/signaling/pkg/buildinfo.Commit=$(git rev-parse HEAD) \
+//	  -X github.com/jhead/lanscape/signaling/pkg/buildinfo.Date=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+//
+// Otherwise they fall back to what the Go toolchain recorded in the binary.
+package buildinfo
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"strings"
+)
+
+// Set with -ldflags "-X"; empty values fall back to debug.ReadBuildInfo
+var (
+	Version string // semantic version, e.g. 1.2.0
+	Commit  string // git commit hash
+	Date    string // build time, RFC3339
+)
+
+// Info describes a build
+type Info struct {
+	Version   string   `json:"version"`
+	Commit    string   `json:"commit,omitempty"`
+	Date      string   `json:"date,omitempty"`
+	GoVersion string   `json:"goVersion"`
+	Features  []string `json:"features,omitempty"` // build tags the binary was built with
+}
+
+// Get returns the running binary's build info
+func Get() Info {
+	info := Info{
+		Version:   Version,
+		Commit:    Commit,
+		Date:      Date,
+		GoVersion: runtime.Version(),
+	}
+	build, ok := debug.ReadBuildInfo()
+	if !ok {
+		if info.Version == "" {
+			info.Version = "unknown"
+		}
+		return info
+	}
+
+	if info.Version == "" {
+		info.Version = strings.TrimPrefix(build.Main.Version, "v")
+	}
+	if info.Version == "" {
+		info.Version = "(devel)"
+	}
+	for _, setting := range build.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			if info.Commit == "" {
+				info.Commit = setting.Value
+			}
+		case "vcs.time":
+			if info.Date == "" {
+				info.Date = setting.Value
+			}
+		case "-tags":
+			for _, tag := range strings.Split(setting.Value, ",") {
+				if tag = strings.TrimSpace(tag); tag != "" {
+					info.Features = append(info.Features, tag)
+				}
+			}
+		}
+	}
+	return info
+}
+
+// String formats info for --version output, e.g.
+// "1.2.0 (commit 0123456789ab, built 2025-01-02T03:04:05Z, go1.23.4)"
+func (info Info) String() string {
+	details := []string{}
+	if info.Commit != "" {
+		commit := info.Commit
+		if len(commit) > 12 {
+			commit = commit[:12]
+		}
+		details = append(details, "commit "+commit)
+	}
+	if info.Date != "" {
+		details = append(details, "built "+info.Date)
+	}
+	details = append(details, info.GoVersion)
+	if len(info.Features) > 0 {
+		details = append(details, "features "+strings.Join(info.Features, ","))
+	}
+	return fmt.Sprintf("%s (%s)", info.Version, strings.Join(details, ", "))
+}
+
+// Handler serves Get as JSON, for GET /version
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(Get())
+	})
+}
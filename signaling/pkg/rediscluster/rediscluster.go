@@ -0,0 +1,79 @@
+// Package rediscluster shares signaling topics between servers through Redis
+// pub/sub. It is kept out of package signaling so clients of the signaling
+// types do not depend on a Redis client.
+package rediscluster
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jhead/lanscape/signaling/pkg/signaling"
+	"github.com/redis/go-redis/v9"
+)
+
+// DefaultChannel is the pub/sub channel servers share topics on
+const DefaultChannel = "lanscape:signaling"
+
+// Backend is a signaling.Backend publishing to one Redis channel
+type Backend struct {
+	client  *redis.Client
+	channel string
+}
+
+// New connects to the Redis server at url, e.g. redis://:password@host:6379/0,
+// and shares topics on channel, DefaultChannel if empty. Servers sharing a
+// Redis server form separate clusters on separate channels.
+func New(url, channel string) (*Backend, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Redis URL: %w", err)
+	}
+	if channel == "" {
+		channel = DefaultChannel
+	}
+	return &Backend{client: redis.NewClient(opts), channel: channel}, nil
+}
+
+// Publish sends msg to every subscribed server
+func (b *Backend) Publish(ctx context.Context, msg []byte) error {
+	return b.client.Publish(ctx, b.channel, msg).Err()
+}
+
+// Subscribe subscribes to the channel and waits for Redis to confirm it
+func (b *Backend) Subscribe(ctx context.Context) (signaling.Subscription, error) {
+	pubsub := b.client.Subscribe(ctx, b.channel)
+	if _, err := pubsub.Receive(ctx); err != nil {
+		pubsub.Close()
+		return nil, err
+	}
+	return &subscription{pubsub: pubsub}, nil
+}
+
+// Close closes the connections to Redis
+func (b *Backend) Close() error {
+	return b.client.Close()
+}
+
+// subscription receives the messages on the channel. It fails on the first
+// connection error rather than letting the client resubscribe on its own,
+// so the cluster knows messages may have been missed.
+type subscription struct {
+	pubsub *redis.PubSub
+}
+
+func (s *subscription) Receive(ctx context.Context) ([]byte, error) {
+	for {
+		msg, err := s.pubsub.Receive(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if m, ok := msg.(*redis.Message); ok {
+			return []byte(m.Payload), nil
+		}
+		// Pongs and subscription confirmations
+	}
+}
+
+func (s *subscription) Close() error {
+	return s.pubsub.Close()
+}
@@ -0,0 +1,94 @@
+package service
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// ParseTrustedProxies parses a comma-separated list of addresses and CIDR
+// ranges, such as "127.0.0.1, 10.0.0.0/8", for Config.TrustedProxies
+func ParseTrustedProxies(s string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		if strings.Contains(field, "/") {
+			prefix, err := netip.ParsePrefix(field)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(field)
+		if err != nil {
+			return nil, err
+		}
+		addr = addr.Unmap()
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, nil
+}
+
+// trustedProxyMiddleware sets RemoteAddr to the client address that a
+// trusted proxy forwarded in X-Forwarded-For (or X-Real-IP), so logs show
+// clients rather than the proxy. The headers are ignored from anyone else,
+// since any client can send them.
+func trustedProxyMiddleware(prefixes []netip.Prefix, next http.Handler) http.Handler {
+	if len(prefixes) == 0 {
+		return next
+	}
+	trusted := func(addr netip.Addr) bool {
+		addr = addr.Unmap()
+		for _, prefix := range prefixes {
+			if prefix.Contains(addr) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.RemoteAddr
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		peer, err := netip.ParseAddr(host)
+		if err != nil || !trusted(peer) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		var hops []string
+		for _, header := range r.Header.Values("X-Forwarded-For") {
+			hops = append(hops, strings.Split(header, ",")...)
+		}
+		if len(hops) == 0 {
+			if realIP := r.Header.Get("X-Real-IP"); realIP != "" {
+				hops = []string{realIP}
+			}
+		}
+
+		// Each proxy appends the address it received from, so the client is
+		// the last address that is not itself a trusted proxy
+		var client netip.Addr
+		for i := len(hops) - 1; i >= 0; i-- {
+			addr, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+			if err != nil {
+				break
+			}
+			client = addr.Unmap()
+			if !trusted(client) {
+				break
+			}
+		}
+		if client.IsValid() {
+			r.RemoteAddr = client.String()
+		}
+		next.ServeHTTP(w, r)
+	})
+}
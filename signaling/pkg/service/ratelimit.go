@@ -0,0 +1,50 @@
+package service
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jhead/lanscape/signaling/pkg/signaling"
+)
+
+// rateLimitHeaders are the headers rateLimitMiddleware sets, which browsers
+// may only read cross-origin if they are exposed
+const rateLimitHeaders = "Retry-After, X-RateLimit-Limit, X-RateLimit-Remaining, X-RateLimit-Reset"
+
+// rateLimitMiddleware limits requests per client IP with limiter, so one
+// client cannot flood the server with handshakes. Every limited response
+// says how to pace further requests: X-RateLimit-Limit is the burst,
+// X-RateLimit-Remaining the requests left in it, and X-RateLimit-Reset the
+// seconds until it is full again. Refused requests get a 429 with
+// Retry-After. Health checks are not limited.
+func rateLimitMiddleware(limiter *signaling.IPRateLimiter, next http.Handler) http.Handler {
+	if limiter == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		status := limiter.Take(r.RemoteAddr, time.Now())
+		h := w.Header()
+		h.Set("X-RateLimit-Limit", strconv.Itoa(status.Limit))
+		h.Set("X-RateLimit-Remaining", strconv.Itoa(status.Remaining))
+		h.Set("X-RateLimit-Reset", ceilSeconds(status.Reset))
+		if !status.Allowed() {
+			h.Set("Retry-After", ceilSeconds(status.RetryAfter))
+			http.Error(w, "rate limited", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ceilSeconds formats d as whole seconds, rounded up so clients waiting that
+// long are not refused again
+func ceilSeconds(d time.Duration) string {
+	return strconv.FormatInt(int64(math.Ceil(d.Seconds())), 10)
+}
@@ -0,0 +1,155 @@
+// Package service serves a signaling server over HTTP the way cmd/signaling
+// does, so other programs can run it in-process.
+package service
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/jhead/lanscape/signaling/internal/handler"
+	"github.com/jhead/lanscape/signaling/pkg/buildinfo"
+	"github.com/jhead/lanscape/signaling/pkg/signaling"
+)
+
+// Config holds the optional parts of the HTTP API
+type Config struct {
+	// RelayLog is exported at /admin/relay-log when AdminToken is also set
+	RelayLog *signaling.RelayLog
+	// AdminToken enables the admin API: stats, topic and peer inspection,
+	// disconnects, and draining; topic ACLs, kicks, and bans are
+	// managed under /admin/topics/{topic} when the server has an ACL table
+	AdminToken string
+	// ClientToken is a shared secret clients must present to connect to
+	// the signaling endpoints; anyone may connect when empty
+	ClientToken string
+	// AllowedOrigins are the browser origins allowed to connect and to make
+	// cross-origin requests, as patterns parsed by ParseAllowedOrigins; any
+	// origin is allowed when empty
+	AllowedOrigins []string
+	// TrustedProxies are the reverse proxies whose X-Forwarded-For header
+	// is believed, so logs show the client's address instead of theirs
+	TrustedProxies []netip.Prefix
+	// HTTPRateLimiter limits HTTP requests, WebSocket handshakes included,
+	// per client IP; requests are unlimited when nil
+	HTTPRateLimiter *signaling.IPRateLimiter
+	// MaxMessageSize is the largest frame read from a signaling client, in
+	// bytes; zero uses handler.DefaultMaxMessageSize
+	MaxMessageSize int
+	// WriteTimeout bounds each write to a signaling client; zero uses
+	// handler.DefaultWriteTimeout
+	WriteTimeout time.Duration
+	// PingInterval is how often signaling clients are pinged; zero uses
+	// handler.DefaultPingInterval
+	PingInterval time.Duration
+}
+
+// handlerOptions returns the signaling protocol options in c
+func (c Config) handlerOptions() handler.Options {
+	return handler.Options{
+		MaxMessageSize: c.MaxMessageSize,
+		WriteTimeout:   c.WriteTimeout,
+		PingInterval:   c.PingInterval,
+	}
+}
+
+// NewHandler returns the HTTP handler for server: the health check, the
+// build version, the per-topic and multiplexed WebSocket endpoints, the SSE
+// fallback for clients that cannot open a WebSocket, TURN credentials when
+// the server vends them, and the admin API
+func NewHandler(server *signaling.Server, config Config, logger *slog.Logger) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		// Load balancers stop sending new clients to a draining server
+		if !server.AcceptingJoins() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("draining"))
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ok"))
+	})
+	mux.Handle("GET /version", buildinfo.Handler())
+	mux.HandleFunc("GET /ws/{topic}", handler.HandleSignaling(server, config.ClientToken, config.AllowedOrigins, config.handlerOptions(), logger))
+	mux.HandleFunc("GET /ws", handler.HandleMultiplexed(server, config.ClientToken, config.AllowedOrigins, config.handlerOptions(), logger))
+	sessions := handler.NewSSESessions()
+	mux.HandleFunc("GET /sse/{topic}", handler.HandleSSE(sessions, server, config.ClientToken, config.AllowedOrigins, config.handlerOptions(), logger))
+	mux.HandleFunc("POST /sse/{topic}/{id}", handler.HandleSSESend(sessions, logger))
+	mux.HandleFunc("DELETE /sse/{topic}/{id}", handler.HandleSSESend(sessions, logger))
+	if turn := server.TURN(); turn != nil {
+		mux.HandleFunc("GET /turn-credentials", handler.HandleTURNCredentials(turn, config.ClientToken, logger))
+	}
+	if config.AdminToken != "" {
+		mux.HandleFunc("GET /admin/stats", handler.HandleStats(server, config.AdminToken, logger))
+		mux.HandleFunc("GET /admin/topics", handler.HandleTopics(server, config.AdminToken, logger))
+		mux.HandleFunc("GET /admin/topics/{topic}/peers", handler.HandleTopicPeers(server, config.AdminToken, logger))
+		mux.HandleFunc("DELETE /admin/peers/{peer}", handler.HandleDisconnectPeer(server, config.AdminToken, logger))
+		mux.HandleFunc("GET /admin/drain", handler.HandleDrain(server, config.AdminToken, logger))
+		mux.HandleFunc("POST /admin/drain", handler.HandleDrain(server, config.AdminToken, logger))
+	}
+	if config.RelayLog != nil && config.AdminToken != "" {
+		mux.HandleFunc("GET /admin/relay-log", handler.HandleRelayLogExport(config.RelayLog, config.AdminToken, logger))
+	}
+	if acls := server.ACLs(); acls != nil && config.AdminToken != "" {
+		aclHandler := handler.HandleTopicACL(acls, config.AdminToken, logger)
+		mux.HandleFunc("GET /admin/topics/{topic}/acl", aclHandler)
+		mux.HandleFunc("PUT /admin/topics/{topic}/acl", aclHandler)
+		mux.HandleFunc("DELETE /admin/topics/{topic}/acl", aclHandler)
+		mux.HandleFunc("POST /admin/topics/{topic}/kick", handler.HandleTopicKick(server, config.AdminToken, logger))
+		mux.HandleFunc("POST /admin/topics/{topic}/unban", handler.HandleTopicUnban(acls, config.AdminToken, logger))
+	}
+	// CORS preflights are answered before the rate limit, so they are free
+	return trustedProxyMiddleware(config.TrustedProxies, corsMiddleware(config.AllowedOrigins, rateLimitMiddleware(config.HTTPRateLimiter, mux)))
+}
+
+// ParseAllowedOrigins parses a comma-separated list of origin patterns, such
+// as "chat.example.com, https://*.example.com", for Config.AllowedOrigins.
+// Patterns use path.Match syntax and match an origin's host, or the whole
+// origin if they contain "://".
+func ParseAllowedOrigins(s string) ([]string, error) {
+	var patterns []string
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		if _, err := path.Match(field, ""); err != nil {
+			return nil, fmt.Errorf("invalid origin pattern %q: %w", field, err)
+		}
+		patterns = append(patterns, field)
+	}
+	return patterns, nil
+}
+
+// corsMiddleware adds CORS headers for WebSocket connections, SSE sessions,
+// and TURN credential requests. Origins that do not match origins get none, so
+// browsers refuse them.
+func corsMiddleware(origins []string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			origin = "*"
+		}
+		if origin == "*" || handler.OriginAllowed(origin, origins) {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, "+handler.SessionHeader)
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+			w.Header().Set("Access-Control-Expose-Headers", rateLimitHeaders)
+		}
+		if len(origins) > 0 {
+			w.Header().Add("Vary", "Origin")
+		}
+
+		if r.Method == "OPTIONS" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
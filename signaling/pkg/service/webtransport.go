@@ -0,0 +1,42 @@
+package service
+
+import (
+	"crypto/tls"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/jhead/lanscape/signaling/internal/handler"
+	"github.com/jhead/lanscape/signaling/pkg/signaling"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/webtransport-go"
+)
+
+// webTransportKeepAlive is how often QUIC pings an idle WebTransport
+// session, well within the default 30 second idle timeout, so sessions of
+// clients that went away end the way unanswered WebSocket pings do
+const webTransportKeepAlive = 15 * time.Second
+
+// NewWebTransportServer returns an HTTP/3 server for WebTransport signaling
+// at /wt/{topic} on the UDP address addr, an alternative to the WebSocket
+// endpoints that holds up better on lossy networks and suits browsers that
+// prefer WebTransport. WebTransport requires TLS, so tlsConfig must hold the
+// server's certificate. The client token, allowed origins, and HTTP rate
+// limit are enforced as by NewHandler. Start it with ListenAndServe and stop
+// it with Close once the server has drained.
+func NewWebTransportServer(server *signaling.Server, config Config, addr string, tlsConfig *tls.Config, logger *slog.Logger) *webtransport.Server {
+	wt := &webtransport.Server{
+		H3: http3.Server{
+			Addr:       addr,
+			TLSConfig:  tlsConfig,
+			QUICConfig: &quic.Config{KeepAlivePeriod: webTransportKeepAlive},
+		},
+		// HandleWebTransport checks origins the way the WebSocket endpoints do
+		CheckOrigin: func(*http.Request) bool { return true },
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/wt/{topic}", handler.HandleWebTransport(wt, server, config.ClientToken, config.AllowedOrigins, config.handlerOptions(), logger))
+	wt.H3.Handler = rateLimitMiddleware(config.HTTPRateLimiter, mux)
+	return wt
+}
@@ -0,0 +1,316 @@
+package signaling
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// AuthorizerMembers is the authorizer that admits only members of the
+// topic's lanscaped network, proven by a membership attestation
+const AuthorizerMembers = "members"
+
+var (
+	// ErrAuthRequired is returned by Authorize when a topic requires a proven
+	// identity key and the peer joined without one
+	ErrAuthRequired = errors.New("topic requires an authenticated identity")
+	// ErrNotAuthorized is returned by Authorize when the topic's authorizer
+	// refused the peer
+	ErrNotAuthorized = errors.New("not authorized for topic")
+)
+
+// TopicACL restricts who may join a topic. Topics without one get the
+// table's default ACL, or are open to anyone if it has none, as before ACLs
+// existed.
+type TopicACL struct {
+	// RequireAuth admits only peers that prove an identity key with the join
+	// challenge; observers and multiplexed subscriptions cannot, so they are
+	// refused
+	RequireAuth bool `json:"requireAuth"`
+	// Authorizer names the check applied to authenticated peers, such as
+	// AuthorizerMembers. Empty admits every authenticated peer.
+	Authorizer string `json:"authorizer,omitempty"`
+	// Network is the lanscaped network the members authorizer checks
+	Network string `json:"network,omitempty"`
+	// AppRelay lets peers in the topic send each other small application
+	// payloads through the server when they cannot connect directly. Topics
+	// without an ACL never allow it.
+	AppRelay bool `json:"appRelay,omitempty"`
+}
+
+// Authorizer decides whether a peer that proved publicKey may join a topic
+// with acl. metadata is the peer's join metadata.
+type Authorizer interface {
+	Authorize(acl TopicACL, publicKey string, metadata json.RawMessage) error
+}
+
+// ACLTable holds the topic ACLs, the authorizers they name, and the identity
+// keys banned from topics. When it has a file, every change is written to
+// it, so ACLs and bans survive restarts and topics are not left open while
+// lanscaped registers them again.
+type ACLTable struct {
+	mu          sync.RWMutex
+	acls        map[string]TopicACL
+	bans        map[string]map[string]time.Time // topic -> public key -> banned until
+	authorizers map[string]Authorizer
+	path        string
+	// defaultACL applies to topics without an ACL; nil leaves them open
+	defaultACL *TopicACL
+}
+
+// aclFile is the saved form of an ACLTable
+type aclFile struct {
+	ACLs map[string]TopicACL             `json:"acls"`
+	Bans map[string]map[string]time.Time `json:"bans,omitempty"`
+}
+
+// NewACLTable creates an empty table kept in memory only
+func NewACLTable() *ACLTable {
+	return &ACLTable{
+		acls:        make(map[string]TopicACL),
+		bans:        make(map[string]map[string]time.Time),
+		authorizers: make(map[string]Authorizer),
+	}
+}
+
+// LoadACLTable opens the table saved at path, or an empty one if the file
+// does not exist yet
+func LoadACLTable(path string) (*ACLTable, error) {
+	t := NewACLTable()
+	t.path = path
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return t, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read topic ACLs: %w", err)
+	}
+	var file aclFile
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&file); err != nil {
+		// Files saved before bans were added hold only the ACLs
+		file = aclFile{}
+		if err := json.Unmarshal(data, &file.ACLs); err != nil {
+			return nil, fmt.Errorf("failed to parse topic ACLs: %w", err)
+		}
+	}
+	if file.ACLs != nil {
+		t.acls = file.ACLs
+	}
+	if file.Bans != nil {
+		t.bans = file.Bans
+	}
+	return t, nil
+}
+
+// SetAuthorizer registers the authorizer ACLs refer to by name
+func (t *ACLTable) SetAuthorizer(name string, a Authorizer) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.authorizers[name] = a
+}
+
+// SetDefault sets the ACL of topics without one, so topics nobody registered
+// are not open to anyone; nil opens them again. A default naming the members
+// authorizer without a network binds each topic to the lanscaped network of
+// the same name, the way lanscaped names network topics. The default is not
+// saved with the table.
+func (t *ACLTable) SetDefault(acl *TopicACL) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.defaultACL = acl
+}
+
+// Get returns the ACL of a topic, if it has one
+func (t *ACLTable) Get(topicID string) (TopicACL, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	acl, ok := t.acls[topicID]
+	return acl, ok
+}
+
+// AppRelayAllowed reports whether the ACL of a topic, or the default ACL if
+// it has none, permits app-relays. A nil table permits none.
+func (t *ACLTable) AppRelayAllowed(topicID string) bool {
+	if t == nil {
+		return false
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if acl, ok := t.acls[topicID]; ok {
+		return acl.AppRelay
+	}
+	return t.defaultACL != nil && t.defaultACL.AppRelay
+}
+
+// Set replaces the ACL of a topic. It applies to peers that join afterwards;
+// peers already in the topic stay.
+func (t *ACLTable) Set(topicID string, acl TopicACL) error {
+	if acl.Authorizer == AuthorizerMembers && acl.Network == "" {
+		return errors.New("members authorizer requires a network")
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	prev, existed := t.acls[topicID]
+	t.acls[topicID] = acl
+	if err := t.save(); err != nil {
+		if existed {
+			t.acls[topicID] = prev
+		} else {
+			delete(t.acls, topicID)
+		}
+		return err
+	}
+	return nil
+}
+
+// Delete removes the ACL of a topic, opening it to anyone
+func (t *ACLTable) Delete(topicID string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	prev, existed := t.acls[topicID]
+	if !existed {
+		return nil
+	}
+	delete(t.acls, topicID)
+	if err := t.save(); err != nil {
+		t.acls[topicID] = prev
+		return err
+	}
+	return nil
+}
+
+// Ban refuses the identity keys (base64url) in the topic until the given
+// time, whether or not the topic has an ACL. It is used when a user loses
+// membership of a network, whose attestations stay valid until they expire.
+func (t *ACLTable) Ban(topicID string, publicKeys []string, until time.Time) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	prev := t.bans[topicID]
+	bans := make(map[string]time.Time, len(prev)+len(publicKeys))
+	for key, u := range prev {
+		bans[key] = u
+	}
+	for _, key := range publicKeys {
+		bans[key] = until
+	}
+	t.bans[topicID] = bans
+	if err := t.save(); err != nil {
+		t.bans[topicID] = prev
+		return err
+	}
+	return nil
+}
+
+// Unban lifts the bans on identity keys in a topic, e.g. when their user
+// rejoins the network
+func (t *ACLTable) Unban(topicID string, publicKeys []string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	prev, ok := t.bans[topicID]
+	if !ok {
+		return nil
+	}
+	bans := make(map[string]time.Time, len(prev))
+	for key, u := range prev {
+		bans[key] = u
+	}
+	for _, key := range publicKeys {
+		delete(bans, key)
+	}
+	t.bans[topicID] = bans
+	if err := t.save(); err != nil {
+		t.bans[topicID] = prev
+		return err
+	}
+	return nil
+}
+
+// banned reports whether key is banned from the topic. Callers hold mu.
+func (t *ACLTable) banned(topicID, key string) bool {
+	until, ok := t.bans[topicID][key]
+	return ok && key != "" && time.Now().Before(until)
+}
+
+// Authorize checks a joining peer against the topic's bans and ACL.
+// publicKey is the key the peer proved, empty if it proved none. An ACL
+// naming an authorizer that is not registered refuses everyone.
+func (t *ACLTable) Authorize(topicID, publicKey string, metadata json.RawMessage) error {
+	if t == nil {
+		return nil
+	}
+	t.mu.RLock()
+	acl, ok := t.acls[topicID]
+	if !ok && t.defaultACL != nil {
+		acl, ok = *t.defaultACL, true
+		if acl.Authorizer == AuthorizerMembers && acl.Network == "" {
+			acl.Network = topicID
+		}
+	}
+	authorizer := t.authorizers[acl.Authorizer]
+	banned := t.banned(topicID, publicKey) || t.banned(topicID, MetadataPublicKey(metadata))
+	t.mu.RUnlock()
+
+	if banned {
+		return fmt.Errorf("%w: membership revoked", ErrNotAuthorized)
+	}
+	if !ok {
+		return nil
+	}
+	if acl.RequireAuth && publicKey == "" {
+		return ErrAuthRequired
+	}
+	if acl.Authorizer == "" {
+		return nil
+	}
+	if publicKey == "" {
+		return ErrAuthRequired
+	}
+	if authorizer == nil {
+		return fmt.Errorf("%w: authorizer %q is not configured", ErrNotAuthorized, acl.Authorizer)
+	}
+	if err := authorizer.Authorize(acl, publicKey, metadata); err != nil {
+		return fmt.Errorf("%w: %v", ErrNotAuthorized, err)
+	}
+	return nil
+}
+
+// save writes the ACLs and current bans to the table's file, if it has one,
+// dropping expired bans. Callers hold mu.
+func (t *ACLTable) save() error {
+	now := time.Now()
+	for topicID, bans := range t.bans {
+		for key, until := range bans {
+			if !now.Before(until) {
+				delete(bans, key)
+			}
+		}
+		if len(bans) == 0 {
+			delete(t.bans, topicID)
+		}
+	}
+	if t.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(aclFile{ACLs: t.acls, Bans: t.bans}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(t.path), 0o700); err != nil {
+		return fmt.Errorf("failed to save topic ACLs: %w", err)
+	}
+	tmp := t.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return fmt.Errorf("failed to save topic ACLs: %w", err)
+	}
+	if err := os.Rename(tmp, t.path); err != nil {
+		return fmt.Errorf("failed to save topic ACLs: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package signaling
+
+import "time"
+
+// AppRelayType is the relay type carrying small application payloads between
+// peers that could not establish a WebRTC connection, so they keep working
+// over the signaling server instead of not at all
+const AppRelayType = "app-relay"
+
+// DefaultAppRelayMaxSize is the largest app-relay payload accepted, in bytes
+const DefaultAppRelayMaxSize = 1024
+
+var (
+	// DefaultAppRelayPeerRate limits the app-relays each peer sends
+	DefaultAppRelayPeerRate = RateLimit{Rate: 1, Burst: 5}
+	// DefaultAppRelayIPRate limits the app-relays each client IP sends
+	DefaultAppRelayIPRate = RateLimit{Rate: 5, Burst: 20}
+)
+
+// appRelay bounds the application payloads peers relay through the server.
+// They are far tighter than the limits on signaling relays: the server is a
+// last resort for a trickle of data, not a replacement for the data channel.
+type appRelay struct {
+	maxSize int
+	limiter *RateLimiter
+}
+
+// SetAppRelay accepts app-relay payloads of up to maxSize bytes, as often as
+// limiter allows, in topics whose ACL permits them (see TopicACL.AppRelay).
+// A maxSize of 0 refuses them everywhere; a nil limiter leaves only the
+// relay rate limit. Must be called before the server starts handling
+// connections.
+func (s *Server) SetAppRelay(maxSize int, limiter *RateLimiter) {
+	s.appRelay = appRelay{maxSize: maxSize, limiter: limiter}
+}
+
+// AppRelayMaxSize returns the largest app-relay payload accepted, or 0 if
+// app-relays are refused
+func (s *Server) AppRelayMaxSize() int {
+	return s.appRelay.maxSize
+}
+
+// checkAppRelay applies the topic policy, size limit, and rate limit to an
+// app-relay from a peer, returning RelayDelivered if it may proceed
+func (s *Server) checkAppRelay(topicID string, from *PeerConn, size int, now time.Time) RelayResult {
+	if s.appRelay.maxSize <= 0 || !s.acls.AppRelayAllowed(topicID) {
+		return RelayNotAllowed
+	}
+	if size > s.appRelay.maxSize {
+		return RelayTooLarge
+	}
+	if from != nil && !s.appRelay.limiter.Allow(from.ID, from.RemoteAddr(), now) {
+		s.logger.Debug("app-relay rate limited", "from", from.ID, "topic", topicID, "remote", from.RemoteAddr())
+		return RelayRateLimited
+	}
+	return RelayDelivered
+}
@@ -0,0 +1,156 @@
+package signaling
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// attestationAudience marks lanscaped tokens that attest network membership
+const attestationAudience = "lanscape-attestation"
+
+// jwksRefreshInterval rate-limits JWKS refetches triggered by unknown key IDs
+const jwksRefreshInterval = time.Minute
+
+// attestationClaims are the claims of a lanscaped membership attestation
+type attestationClaims struct {
+	Username  string `json:"username"`
+	Network   string `json:"network"`
+	PublicKey string `json:"public_key"`
+	jwt.RegisteredClaims
+}
+
+// MemberAuthorizer admits peers that present a lanscaped membership
+// attestation for the ACL's network, bound to the identity key they proved.
+// Peers carry the attestation in their join metadata as
+// {"attestation": "..."}, as the agent already does for its peers.
+type MemberAuthorizer struct {
+	jwksURL string
+	client  *http.Client
+	logger  *slog.Logger
+
+	mu        sync.Mutex
+	keys      map[string]*rsa.PublicKey // kid -> key
+	lastFetch time.Time
+}
+
+// NewMemberAuthorizer creates an authorizer that checks attestations against
+// lanscaped's key set at jwksURL
+func NewMemberAuthorizer(jwksURL string, logger *slog.Logger) *MemberAuthorizer {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return &MemberAuthorizer{
+		jwksURL: jwksURL,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		logger:  logger,
+		keys:    make(map[string]*rsa.PublicKey),
+	}
+}
+
+// Authorize implements Authorizer
+func (a *MemberAuthorizer) Authorize(acl TopicACL, publicKey string, metadata json.RawMessage) error {
+	var m struct {
+		Attestation string `json:"attestation"`
+	}
+	if len(metadata) > 0 {
+		json.Unmarshal(metadata, &m)
+	}
+	if m.Attestation == "" {
+		return errors.New("no membership attestation presented")
+	}
+
+	var claims attestationClaims
+	_, err := jwt.ParseWithClaims(m.Attestation, &claims, a.key,
+		jwt.WithValidMethods([]string{jwt.SigningMethodRS256.Alg()}),
+		jwt.WithAudience(attestationAudience),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		return fmt.Errorf("invalid attestation: %w", err)
+	}
+	if claims.Network != acl.Network {
+		return fmt.Errorf("attestation is for network %q, not %q", claims.Network, acl.Network)
+	}
+	if claims.PublicKey != publicKey {
+		return errors.New("attestation is for a different identity key")
+	}
+	return nil
+}
+
+// key returns the verification key for a token, refreshing the JWKS when the
+// key ID is unknown
+func (a *MemberAuthorizer) key(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if key, ok := a.keys[kid]; ok {
+		return key, nil
+	}
+	if time.Since(a.lastFetch) < jwksRefreshInterval {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	if err := a.fetch(); err != nil {
+		return nil, err
+	}
+	if key, ok := a.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// fetch replaces the cached keys with the current JWKS. Caller must hold a.mu.
+func (a *MemberAuthorizer) fetch() error {
+	a.lastFetch = time.Now()
+
+	resp, err := a.client.Get(a.jwksURL)
+	if err != nil {
+		return fmt.Errorf("failed to fetch JWKS: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to fetch JWKS: status %d", resp.StatusCode)
+	}
+
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return fmt.Errorf("failed to parse JWKS: %w", err)
+	}
+
+	keys := make(map[string]*rsa.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			continue
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			continue
+		}
+		keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	a.keys = keys
+	a.logger.Info("fetched attestation keys", "url", a.jwksURL, "keys", len(keys))
+	return nil
+}
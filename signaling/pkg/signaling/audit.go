@@ -0,0 +1,374 @@
+package signaling
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Audit event types
+const (
+	// AuditJoin is recorded when a peer or observer joins a topic on this
+	// server, or resumes its connection
+	AuditJoin = "join"
+	// AuditLeave is recorded when a peer or observer leaves a topic, is
+	// kicked, or is not resumed in time
+	AuditLeave = "leave"
+	// AuditRelay is recorded for every relay a peer on this server sends,
+	// with its result
+	AuditRelay = "relay"
+	// AuditError is recorded when a client is sent an error, e.g. for a bad
+	// token or a refused join
+	AuditError = "error"
+)
+
+// AuditEventTypes lists every audit event type
+var AuditEventTypes = []string{AuditJoin, AuditLeave, AuditRelay, AuditError}
+
+// AuditEvent is one entry of the audit log. Payloads and metadata are never
+// recorded.
+type AuditEvent struct {
+	Time  time.Time `json:"time"`
+	Type  string    `json:"type"`
+	Topic string    `json:"topic,omitempty"`
+	// Peer is the peer that joined, left, sent a relay, or was sent an
+	// error, unset for errors before it joined
+	Peer string `json:"peer,omitempty"`
+	// IP is the client address the peer connected from
+	IP string `json:"ip,omitempty"`
+	// PublicKey is the identity key the peer proved, if any
+	PublicKey string `json:"public_key,omitempty"`
+	Observer  bool   `json:"observer,omitempty"`
+	Resumed   bool   `json:"resumed,omitempty"`
+
+	// To, MessageType, Size, and Result describe a relay
+	To          string `json:"to,omitempty"`
+	MessageType string `json:"message_type,omitempty"`
+	Size        int    `json:"size,omitempty"`
+	Result      string `json:"result,omitempty"`
+
+	// Code and Message describe an error, or why a peer was kicked
+	Code    string `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// AuditSink stores audit events. Record is called on the signaling path, so
+// sinks must not wait on the network.
+type AuditSink interface {
+	Record(event AuditEvent)
+}
+
+// AuditLog records joins, leaves, relays, and errors for abuse
+// investigation, separately from the server's debug logging, to any number
+// of sinks. A nil AuditLog records nothing.
+type AuditLog struct {
+	sinks []AuditSink
+	types map[string]bool
+}
+
+// NewAuditLog returns an audit log recording events of types, or every type
+// if none are given, to sinks
+func NewAuditLog(types []string, sinks ...AuditSink) *AuditLog {
+	if len(types) == 0 {
+		types = AuditEventTypes
+	}
+	l := &AuditLog{sinks: sinks, types: make(map[string]bool)}
+	for _, t := range types {
+		l.types[t] = true
+	}
+	return l
+}
+
+// ParseAuditEventTypes parses a comma-separated list of audit event types,
+// such as "join,leave,error"
+func ParseAuditEventTypes(v string) ([]string, error) {
+	var types []string
+	for _, t := range strings.Split(v, ",") {
+		t = strings.TrimSpace(t)
+		if t == "" {
+			continue
+		}
+		if !slices.Contains(AuditEventTypes, t) {
+			return nil, fmt.Errorf("unknown audit event type %q", t)
+		}
+		types = append(types, t)
+	}
+	return types, nil
+}
+
+// record stamps event and passes it to every sink, if its type is recorded
+func (l *AuditLog) record(event AuditEvent) {
+	if l == nil || !l.types[event.Type] {
+		return
+	}
+	event.Time = time.Now().UTC()
+	for _, sink := range l.sinks {
+		sink.Record(event)
+	}
+}
+
+// Flush delivers the events sinks have queued, e.g. once the server has
+// drained on shutdown
+func (l *AuditLog) Flush(ctx context.Context) {
+	if l == nil {
+		return
+	}
+	for _, sink := range l.sinks {
+		if f, ok := sink.(interface{ Flush(context.Context) }); ok {
+			f.Flush(ctx)
+		}
+	}
+}
+
+// Close closes the sinks that hold files
+func (l *AuditLog) Close() error {
+	if l == nil {
+		return nil
+	}
+	var errs []error
+	for _, sink := range l.sinks {
+		if c, ok := sink.(io.Closer); ok {
+			errs = append(errs, c.Close())
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// SetAudit records joins, leaves, relays, and errors to log. Must be called
+// before the server starts handling connections.
+func (s *Server) SetAudit(log *AuditLog) {
+	s.audit = log
+}
+
+// Connected records the client address pc connected from, once its
+// connection has joined or resumed it, and audits the join
+func (s *Server) Connected(pc *PeerConn, remoteAddr string, resumed bool) {
+	pc.SetRemoteAddr(remoteAddr)
+	s.audit.record(AuditEvent{
+		Type:      AuditJoin,
+		Topic:     pc.TopicID,
+		Peer:      pc.ID,
+		IP:        clientIP(remoteAddr),
+		PublicKey: pc.PublicKey,
+		Observer:  pc.Observer,
+		Resumed:   resumed,
+	})
+}
+
+// AuditError records that a client was sent an error. peerID is empty if
+// the client had not joined topicID yet.
+func (s *Server) AuditError(topicID, peerID, remoteAddr, code, message string) {
+	s.audit.record(AuditEvent{
+		Type:    AuditError,
+		Topic:   topicID,
+		Peer:    peerID,
+		IP:      clientIP(remoteAddr),
+		Code:    code,
+		Message: message,
+	})
+}
+
+// auditLeave records pc leaving its topic, with the reason it was kicked
+func (s *Server) auditLeave(pc *PeerConn) {
+	event := AuditEvent{
+		Type:      AuditLeave,
+		Topic:     pc.TopicID,
+		Peer:      pc.ID,
+		IP:        clientIP(pc.RemoteAddr()),
+		PublicKey: pc.PublicKey,
+		Observer:  pc.Observer,
+	}
+	if reason, detail, kicked := pc.Kicked(); kicked {
+		event.Code = string(reason)
+		event.Message = detail
+	}
+	s.audit.record(event)
+}
+
+// auditRelay records a relay sent by a peer on this server
+func (s *Server) auditRelay(topicID, fromPeerID, toPeerID, msgType string, size int, result RelayResult) {
+	if s.audit == nil {
+		return
+	}
+	var remoteAddr string
+	if val, ok := s.topics.Load(topicID); ok {
+		if from := val.(*Topic).GetPeer(fromPeerID); from != nil {
+			remoteAddr = from.RemoteAddr()
+		}
+	}
+	s.audit.record(AuditEvent{
+		Type:        AuditRelay,
+		Topic:       topicID,
+		Peer:        fromPeerID,
+		IP:          clientIP(remoteAddr),
+		To:          toPeerID,
+		MessageType: msgType,
+		Size:        size,
+		Result:      result.String(),
+	})
+}
+
+// clientIP strips the port from a client address
+func clientIP(remoteAddr string) string {
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		return host
+	}
+	return remoteAddr
+}
+
+// AuditFile is an audit sink appending JSON lines to a file, rotated like
+// the relay log
+type AuditFile struct {
+	file *rotatingFile
+}
+
+// NewAuditFile opens (or appends to) the audit log file at path. It is
+// rotated once it grows past maxSize bytes (0 disables rotation), keeping
+// maxFiles rotated files.
+func NewAuditFile(path string, maxSize int64, maxFiles int) (*AuditFile, error) {
+	file, err := openRotatingFile("audit log", path, maxSize, maxFiles)
+	if err != nil {
+		return nil, err
+	}
+	return &AuditFile{file: file}, nil
+}
+
+func (f *AuditFile) Record(event AuditEvent) {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	f.file.write(append(line, '\n'))
+}
+
+// Close closes the file
+func (f *AuditFile) Close() error {
+	return f.file.close()
+}
+
+// AuditWriter is an audit sink writing JSON lines to a writer, such as
+// stdout for a log collector
+type AuditWriter struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// NewAuditWriter returns a sink writing to w
+func NewAuditWriter(w io.Writer) *AuditWriter {
+	return &AuditWriter{enc: json.NewEncoder(w)}
+}
+
+func (w *AuditWriter) Record(event AuditEvent) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.enc.Encode(event)
+}
+
+// AuditWebhook is an audit sink posting events in batches to a URL, signed
+// like topic webhooks (see SignWebhook). Events wait in a bounded queue
+// while the URL is unreachable; once it is full, the oldest are dropped.
+type AuditWebhook struct {
+	url    string
+	secret []byte
+	client *http.Client
+	logger *slog.Logger
+
+	// sendMu keeps deliveries in order
+	sendMu sync.Mutex
+
+	mu      sync.Mutex
+	queue   []AuditEvent
+	dropped int // events dropped from a full queue, in total
+	warned  int // dropped when last warned about
+	wake    chan struct{}
+}
+
+// auditDelivery is the body posted to an audit webhook
+type auditDelivery struct {
+	Events []AuditEvent `json:"events"`
+}
+
+// NewAuditWebhook returns a sink posting to url, signed with secret. Start
+// delivering with Run.
+func NewAuditWebhook(url, secret string, logger *slog.Logger) *AuditWebhook {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return &AuditWebhook{
+		url:    url,
+		secret: []byte(secret),
+		client: &http.Client{Timeout: 10 * time.Second},
+		logger: logger,
+		wake:   make(chan struct{}, 1),
+	}
+}
+
+func (w *AuditWebhook) Record(event AuditEvent) {
+	w.mu.Lock()
+	if len(w.queue) >= maxWebhookQueue {
+		w.queue = w.queue[1:]
+		w.dropped++
+	}
+	w.queue = append(w.queue, event)
+	w.mu.Unlock()
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run delivers events as they are recorded until ctx is done
+func (w *AuditWebhook) Run(ctx context.Context) {
+	retry := time.NewTicker(webhookRetryInterval)
+	defer retry.Stop()
+	for {
+		select {
+		case <-w.wake:
+		case <-retry.C:
+		case <-ctx.Done():
+			return
+		}
+		w.Flush(ctx)
+	}
+}
+
+// Flush delivers the queued events in batches until the queue is empty or a
+// delivery fails, leaving the rest queued for the next attempt
+func (w *AuditWebhook) Flush(ctx context.Context) {
+	w.sendMu.Lock()
+	defer w.sendMu.Unlock()
+
+	for {
+		w.mu.Lock()
+		if w.dropped > w.warned {
+			w.logger.Warn("audit webhook queue full, dropped events", "url", w.url, "dropped", w.dropped-w.warned)
+			w.warned = w.dropped
+		}
+		batch := slices.Clone(w.queue[:min(len(w.queue), maxWebhookBatch)])
+		droppedBefore := w.dropped
+		w.mu.Unlock()
+		if len(batch) == 0 {
+			return
+		}
+
+		if err := postSigned(ctx, w.client, w.url, w.secret, auditDelivery{Events: batch}); err != nil {
+			w.logger.Warn("failed to deliver audit events", "url", w.url, "error", err, "events", len(batch))
+			return
+		}
+
+		w.mu.Lock()
+		// Events dropped from a full queue while posting shifted it
+		delivered := max(len(batch)-(w.dropped-droppedBefore), 0)
+		w.queue = w.queue[delivered:]
+		w.mu.Unlock()
+	}
+}
@@ -0,0 +1,100 @@
+package signaling
+
+import (
+	"errors"
+	"strings"
+
+	"nhooyr.io/websocket"
+)
+
+// CloseReason says why a WebSocket was closed, so clients can pick a
+// reconnect strategy instead of guessing from a generic close. It is shared
+// by the signaling server, the agent's browser server, and their clients.
+// Each reason has its own close code in the private 4000-4999 range, and the
+// close frame's reason text starts with the reason name.
+type CloseReason string
+
+const (
+	// CloseAuthFailed means credentials or an identity proof were rejected;
+	// reconnecting with the same ones fails again
+	CloseAuthFailed CloseReason = "auth-failed"
+	// CloseDraining means the server is shutting down; reconnect right away
+	CloseDraining CloseReason = "draining"
+	// CloseRateLimited means the client exceeded a connection or message
+	// limit; reconnect after backing off
+	CloseRateLimited CloseReason = "rate-limited"
+	// CloseProtocolError means the client sent something the server could
+	// not accept; reconnecting without changes fails again
+	CloseProtocolError CloseReason = "protocol-error"
+	// CloseSuperseded means a newer connection replaced this one; do not
+	// reconnect
+	CloseSuperseded CloseReason = "superseded"
+	// CloseMembershipRevoked means the peer's user is no longer a member of
+	// the topic's network; do not reconnect
+	CloseMembershipRevoked CloseReason = "membership-revoked"
+	// CloseDisconnected means an operator disconnected the peer; do not
+	// reconnect automatically
+	CloseDisconnected CloseReason = "disconnected"
+)
+
+var closeCodes = map[CloseReason]websocket.StatusCode{
+	CloseAuthFailed:    4001,
+	CloseDraining:      4002,
+	CloseRateLimited:   4003,
+	CloseProtocolError: 4004,
+	CloseSuperseded:    4005,
+
+	CloseMembershipRevoked: 4006,
+	CloseDisconnected:      4007,
+}
+
+// maxCloseReasonText is the longest reason text a close frame can carry
+const maxCloseReasonText = 123
+
+// Code returns the WebSocket close code for the reason
+func (r CloseReason) Code() websocket.StatusCode {
+	if code, ok := closeCodes[r]; ok {
+		return code
+	}
+	return websocket.StatusInternalError
+}
+
+// Retryable reports whether a client should reconnect after this close
+func (r CloseReason) Retryable() bool {
+	return r == CloseDraining || r == CloseRateLimited
+}
+
+// Text returns the reason text a close with r carries: the reason name,
+// followed by detail if given
+func (r CloseReason) Text(detail string) string {
+	text := string(r)
+	if detail != "" {
+		text += ": " + detail
+	}
+	if len(text) > maxCloseReasonText {
+		text = text[:maxCloseReasonText]
+	}
+	return text
+}
+
+// Close closes conn with the reason's code and text
+func Close(conn *websocket.Conn, reason CloseReason, detail string) error {
+	return conn.Close(reason.Code(), reason.Text(detail))
+}
+
+// ParseClose returns the reason and detail from the error a read returned
+// when the remote end closed the connection. ok is false if the connection
+// was not closed with one of the known reasons.
+func ParseClose(err error) (reason CloseReason, detail string, ok bool) {
+	var closeErr websocket.CloseError
+	if !errors.As(err, &closeErr) {
+		return "", "", false
+	}
+	for r, code := range closeCodes {
+		if code == closeErr.Code {
+			detail = strings.TrimPrefix(strings.TrimPrefix(closeErr.Reason, string(r)), ": ")
+			return r, detail, true
+		}
+	}
+	return "", "", false
+}
@@ -0,0 +1,542 @@
+package signaling
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+)
+
+// maxClusterQueue bounds the events waiting to be published. Older events
+// are dropped; the snapshot published after a drop corrects the other
+// servers' view of this one's peers.
+const maxClusterQueue = 1000
+
+// clusterRetryInterval is how long a failed subscription waits to resubscribe
+const clusterRetryInterval = 5 * time.Second
+
+// clusterExpiry is how many heartbeat intervals a server may go silent
+// before the others drop its peers
+const clusterExpiry = 3
+
+// Backend carries messages between the signaling servers of a cluster. Every
+// server subscribed receives every message published, in the order it was
+// published, including its own.
+type Backend interface {
+	Publish(ctx context.Context, msg []byte) error
+	// Subscribe returns once the subscription is active
+	Subscribe(ctx context.Context) (Subscription, error)
+}
+
+// Subscription receives the messages published to a Backend
+type Subscription interface {
+	// Receive blocks until a message arrives, ctx is done, or the
+	// subscription fails
+	Receive(ctx context.Context) ([]byte, error)
+	Close() error
+}
+
+// clusterEvent is published to tell the other servers about this one's peers
+type clusterEvent struct {
+	Type     string `json:"type"`
+	Instance string `json:"instance"`
+	Topic    string `json:"topic,omitempty"`
+
+	// join and leave
+	Peer   *clusterPeer `json:"peer,omitempty"`
+	PeerID string       `json:"peerId,omitempty"`
+	Seq    uint64       `json:"seq,omitempty"` // JoinSeq of the peer leaving
+
+	// relay
+	From    string          `json:"from,omitempty"`
+	To      string          `json:"to,omitempty"`
+	MsgType string          `json:"msgType,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+	MsgID   string          `json:"msgId,omitempty"`
+
+	// kick, and disconnect with PeerID
+	PublicKeys []string `json:"publicKeys,omitempty"`
+	All        bool     `json:"all,omitempty"`
+	Detail     string   `json:"detail,omitempty"`
+
+	// snapshot: every local participant, by topic
+	Topics map[string][]clusterPeer `json:"topics,omitempty"`
+}
+
+// clusterPeer is a participant as other servers see it. Seq is its JoinSeq,
+// which tells a peer's connections apart, so a leave that arrives after the
+// peer reconnected does not remove it.
+type clusterPeer struct {
+	PeerRecord
+	Seq uint64 `json:"seq"`
+}
+
+// Cluster event types
+const (
+	clusterHello      = "hello"     // a server subscribed and wants snapshots
+	clusterHeartbeat  = "heartbeat" // a server is still up
+	clusterSnapshot   = "snapshot"  // a server's participants
+	clusterBye        = "bye"       // a server is shutting down
+	clusterJoin       = "join"
+	clusterLeave      = "leave"
+	clusterRelay      = "relay"
+	clusterKick       = "kick"
+	clusterDisconnect = "disconnect"
+)
+
+// Cluster shares topics between signaling servers through a Backend, so
+// peers connected to different servers in the same topic see each other and
+// can relay to each other. Each server announces its participants joining
+// and leaving, forwards relays to peers connected elsewhere, and publishes a
+// snapshot of its participants when a server starts, after a dropped event,
+// and every snapshot interval. A server that misses heartbeats has its peers
+// dropped by the others.
+//
+// Presence, ACLs, revocations, and bans stay local to each server, so
+// servers in a cluster should share their configuration. A nil cluster
+// shares nothing.
+type Cluster struct {
+	// ID identifies this server in the cluster
+	ID string
+
+	server  *Server
+	backend Backend
+	logger  *slog.Logger
+
+	// sendMu keeps events in order
+	sendMu sync.Mutex
+
+	mu     sync.Mutex
+	queue  []clusterEvent
+	resync bool
+	wake   chan struct{}
+
+	seenMu sync.Mutex
+	seen   map[string]time.Time // last message from each other server
+}
+
+// NewCluster creates a cluster member for server. Set it on the server with
+// SetCluster and start it with Run.
+func NewCluster(server *Server, backend Backend, logger *slog.Logger) *Cluster {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return &Cluster{
+		ID:      ulid.Make().String(),
+		server:  server,
+		backend: backend,
+		logger:  logger,
+		wake:    make(chan struct{}, 1),
+		seen:    make(map[string]time.Time),
+	}
+}
+
+// SetCluster shares the server's topics with the rest of cluster. Must be
+// called before the server starts handling connections.
+func (s *Server) SetCluster(cluster *Cluster) {
+	s.cluster = cluster
+}
+
+// Run publishes events as they happen and handles the other servers' events
+// until ctx is done, sending a heartbeat every interval and a snapshot every
+// snapshotInterval
+func (c *Cluster) Run(ctx context.Context, interval, snapshotInterval time.Duration) {
+	go c.publishLoop(ctx, interval, snapshotInterval)
+
+	for {
+		sub, err := c.backend.Subscribe(ctx)
+		if err == nil {
+			c.logger.Info("subscribed to cluster", "instance", c.ID)
+			// Missed events are recovered from snapshots, ours and theirs
+			c.enqueue(clusterEvent{Type: clusterHello})
+			c.requestSnapshot()
+			err = c.receive(ctx, sub)
+			sub.Close()
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		c.logger.Warn("cluster subscription failed", "error", err)
+		select {
+		case <-time.After(clusterRetryInterval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// publishLoop sends queued events, heartbeats, and snapshots, and drops the
+// peers of servers gone silent
+func (c *Cluster) publishLoop(ctx context.Context, interval, snapshotInterval time.Duration) {
+	heartbeat := time.NewTicker(interval)
+	defer heartbeat.Stop()
+	snapshot := time.NewTicker(snapshotInterval)
+	defer snapshot.Stop()
+
+	for {
+		select {
+		case <-c.wake:
+		case <-heartbeat.C:
+			c.enqueue(clusterEvent{Type: clusterHeartbeat})
+			c.expire(time.Now().Add(-clusterExpiry * interval))
+		case <-snapshot.C:
+			c.requestSnapshot()
+		case <-ctx.Done():
+			return
+		}
+		c.send(ctx)
+	}
+}
+
+// receive handles messages until the subscription fails
+func (c *Cluster) receive(ctx context.Context, sub Subscription) error {
+	for {
+		msg, err := sub.Receive(ctx)
+		if err != nil {
+			return err
+		}
+		var event clusterEvent
+		if err := json.Unmarshal(msg, &event); err != nil {
+			c.logger.Warn("ignoring invalid cluster event", "error", err)
+			continue
+		}
+		if event.Instance == c.ID || event.Instance == "" {
+			continue
+		}
+		c.handle(event)
+	}
+}
+
+// handle applies another server's event
+func (c *Cluster) handle(event clusterEvent) {
+	c.seenMu.Lock()
+	_, known := c.seen[event.Instance]
+	if event.Type == clusterBye {
+		delete(c.seen, event.Instance)
+	} else {
+		c.seen[event.Instance] = time.Now()
+	}
+	c.seenMu.Unlock()
+
+	if !known && event.Type != clusterBye {
+		c.logger.Info("cluster server joined", "instance", event.Instance)
+		if event.Type != clusterHello && event.Type != clusterSnapshot {
+			// Started before we subscribed, or came back after we dropped
+			// it; ask for its peers
+			c.enqueue(clusterEvent{Type: clusterHello})
+		}
+	}
+
+	s := c.server
+	switch event.Type {
+	case clusterHello:
+		c.requestSnapshot()
+	case clusterSnapshot:
+		s.applySnapshot(event.Instance, event.Topics)
+	case clusterBye:
+		c.logger.Info("cluster server left", "instance", event.Instance)
+		s.removeInstance(event.Instance)
+	case clusterJoin:
+		if event.Peer != nil {
+			s.addRemote(event.Instance, event.Topic, *event.Peer)
+		}
+	case clusterLeave:
+		s.removeRemote(event.Instance, event.Topic, event.PeerID, event.Seq)
+	case clusterRelay:
+		s.deliverRemote(event)
+	case clusterKick:
+		s.kick(event.Topic, event.PublicKeys, event.All, event.Detail)
+	case clusterDisconnect:
+		s.disconnect(event.PeerID, event.Detail)
+	}
+}
+
+// expire drops the peers of servers not heard from since cutoff
+func (c *Cluster) expire(cutoff time.Time) {
+	var expired []string
+	c.seenMu.Lock()
+	for instance, at := range c.seen {
+		if at.Before(cutoff) {
+			expired = append(expired, instance)
+			delete(c.seen, instance)
+		}
+	}
+	c.seenMu.Unlock()
+
+	for _, instance := range expired {
+		c.logger.Warn("cluster server stopped responding", "instance", instance)
+		c.server.removeInstance(instance)
+	}
+}
+
+// joined announces a local participant
+func (c *Cluster) joined(pc *PeerConn) {
+	if c == nil {
+		return
+	}
+	c.enqueue(clusterEvent{Type: clusterJoin, Topic: pc.TopicID, Peer: &clusterPeer{pc.ToRecord(), pc.JoinSeq}})
+}
+
+// left announces that a local participant left
+func (c *Cluster) left(pc *PeerConn) {
+	if c == nil || pc.Observer {
+		return
+	}
+	c.enqueue(clusterEvent{Type: clusterLeave, Topic: pc.TopicID, PeerID: pc.ID, Seq: pc.JoinSeq})
+}
+
+// kick has the other servers kick their peers matching publicKeys or all
+func (c *Cluster) kick(topicID string, publicKeys []string, all bool, detail string) {
+	if c == nil {
+		return
+	}
+	c.enqueue(clusterEvent{Type: clusterKick, Topic: topicID, PublicKeys: publicKeys, All: all, Detail: detail})
+}
+
+// disconnect has the other servers disconnect peerID from their topics
+func (c *Cluster) disconnect(peerID, detail string) {
+	if c == nil {
+		return
+	}
+	c.enqueue(clusterEvent{Type: clusterDisconnect, PeerID: peerID, Detail: detail})
+}
+
+// relay forwards a relay to a peer connected to another server. Returns
+// false if the queue is full.
+func (c *Cluster) relay(topicID, fromPeerID, toPeerID, msgType string, payload json.RawMessage, msgID string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.queue) >= maxClusterQueue {
+		return false
+	}
+	c.push(clusterEvent{
+		Type:    clusterRelay,
+		Topic:   topicID,
+		From:    fromPeerID,
+		To:      toPeerID,
+		MsgType: msgType,
+		Payload: payload,
+		MsgID:   msgID,
+	})
+	return true
+}
+
+// requestSnapshot has the next send include a snapshot
+func (c *Cluster) requestSnapshot() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.resync = true
+	c.signal()
+}
+
+// enqueue adds an event and wakes the sender
+func (c *Cluster) enqueue(event clusterEvent) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.queue) >= maxClusterQueue {
+		c.queue = c.queue[1:]
+		c.resync = true
+	}
+	c.push(event)
+}
+
+// push appends an event and wakes the sender. Callers must hold mu.
+func (c *Cluster) push(event clusterEvent) {
+	event.Instance = c.ID
+	c.queue = append(c.queue, event)
+	c.signal()
+}
+
+// signal wakes the sender. Callers must hold mu.
+func (c *Cluster) signal() {
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Flush publishes the queued events and tells the other servers this one is
+// leaving the cluster, e.g. once the server has drained on shutdown
+func (c *Cluster) Flush(ctx context.Context) {
+	if c == nil {
+		return
+	}
+	c.enqueue(clusterEvent{Type: clusterBye})
+	c.send(ctx)
+}
+
+// send publishes the queued events, after a snapshot if one is due. Events
+// that fail to publish are dropped, and a snapshot is published once the
+// backend recovers.
+func (c *Cluster) send(ctx context.Context) {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+
+	c.mu.Lock()
+	events := c.queue
+	resync := c.resync
+	c.queue = nil
+	c.resync = false
+	c.mu.Unlock()
+
+	if resync {
+		// Taken after dequeuing, so the snapshot reflects every queued
+		// join and leave and they are harmless to apply after it
+		snapshot := clusterEvent{Type: clusterSnapshot, Instance: c.ID, Topics: c.server.localRecords()}
+		events = append([]clusterEvent{snapshot}, events...)
+	}
+
+	for i, event := range events {
+		msg, err := json.Marshal(event)
+		if err != nil {
+			c.logger.Error("failed to encode cluster event", "type", event.Type, "error", err)
+			continue
+		}
+		if err := c.backend.Publish(ctx, msg); err != nil {
+			c.logger.Warn("failed to publish cluster events", "error", err, "dropped", len(events)-i)
+			c.requestSnapshot()
+			return
+		}
+	}
+}
+
+// localRecords returns the local participants by topic
+func (s *Server) localRecords() map[string][]clusterPeer {
+	topics := make(map[string][]clusterPeer)
+	s.topics.Range(func(key, value any) bool {
+		topic := value.(*Topic)
+		topic.peers.Range(func(key, value any) bool {
+			if pc := value.(*PeerConn); !pc.Observer {
+				topics[topic.ID] = append(topics[topic.ID], clusterPeer{pc.ToRecord(), pc.JoinSeq})
+			}
+			return true
+		})
+		return true
+	})
+	return topics
+}
+
+// addRemote adds a peer connected to another server to its topic, creating
+// the topic if it doesn't exist. A peer already added is left alone, and a
+// peer with a new connection replaces its old one.
+func (s *Server) addRemote(instance, topicID string, peer clusterPeer) {
+	record := peer.PeerRecord
+	for {
+		val, _ := s.topics.LoadOrStore(topicID, NewTopic(topicID))
+		topic := val.(*Topic)
+
+		if rp, ok := topic.getRemote(record.ID); ok && rp.instance == instance {
+			if rp.joinSeq == peer.Seq {
+				return
+			}
+			// Its leave was lost or is still on its way
+			s.removeRemote(instance, topicID, record.ID, rp.joinSeq)
+			continue
+		}
+
+		dropped, err := topic.AddRemote(instance, record, peer.Seq)
+		if err == errTopicClosed {
+			s.topics.CompareAndDelete(topicID, topic)
+			continue
+		}
+		if err != nil {
+			// The ID is connected here or to another server too; the
+			// leave of the stale connection is still on its way
+			s.logger.Warn("ignoring remote peer with an ID already in the topic",
+				"peer", record.ID, "topic", topicID, "instance", instance)
+			return
+		}
+		for _, peerID := range dropped {
+			s.logger.Debug("dropped peer-joined notification", "to", peerID, "from", record.ID)
+		}
+		s.logger.Debug("remote peer joined topic", "peer", record.ID, "topic", topicID, "instance", instance)
+		return
+	}
+}
+
+// removeRemote removes a peer connected to another server from its topic
+func (s *Server) removeRemote(instance, topicID, peerID string, joinSeq uint64) {
+	val, ok := s.topics.Load(topicID)
+	if !ok {
+		return
+	}
+	topic := val.(*Topic)
+
+	removed, dropped, empty := topic.RemoveRemote(instance, peerID, joinSeq)
+	if !removed {
+		return
+	}
+	if empty {
+		s.topics.CompareAndDelete(topicID, topic)
+	}
+	for _, to := range dropped {
+		s.logger.Debug("dropped peer-left notification", "to", to, "from", peerID)
+	}
+	s.logger.Debug("remote peer left topic", "peer", peerID, "topic", topicID, "instance", instance)
+}
+
+// removeInstance removes every peer connected to another server
+func (s *Server) removeInstance(instance string) {
+	s.topics.Range(func(key, value any) bool {
+		topic := value.(*Topic)
+		for _, rp := range topic.remotePeers(instance) {
+			s.removeRemote(instance, topic.ID, rp.record.ID, rp.joinSeq)
+		}
+		return true
+	})
+}
+
+// applySnapshot makes the peers of another server match its snapshot
+func (s *Server) applySnapshot(instance string, topics map[string][]clusterPeer) {
+	s.topics.Range(func(key, value any) bool {
+		topic := value.(*Topic)
+		current := make(map[string]uint64)
+		for _, peer := range topics[topic.ID] {
+			current[peer.ID] = peer.Seq
+		}
+		for _, rp := range topic.remotePeers(instance) {
+			if seq, ok := current[rp.record.ID]; !ok || seq != rp.joinSeq {
+				s.removeRemote(instance, topic.ID, rp.record.ID, rp.joinSeq)
+			}
+		}
+		return true
+	})
+
+	for topicID, peers := range topics {
+		for _, peer := range peers {
+			s.addRemote(instance, topicID, peer)
+		}
+	}
+}
+
+// deliverRemote delivers a relay forwarded by another server to a local
+// peer. It never blocks, so one slow peer cannot hold up the cluster.
+func (s *Server) deliverRemote(event clusterEvent) {
+	if !IsRelayType(event.MsgType) {
+		return
+	}
+	val, ok := s.topics.Load(event.Topic)
+	if !ok {
+		return
+	}
+	target := val.(*Topic).GetPeer(event.To)
+	if target == nil || target.Observer {
+		s.logger.Debug("remote relay target not found", "from", event.From, "to", event.To, "type", event.MsgType)
+		return
+	}
+
+	msg := OutboundMessage{
+		Type:    event.MsgType,
+		From:    event.From,
+		Payload: event.Payload,
+		MsgID:   event.MsgID,
+	}
+	if !target.TrySend(msg) {
+		s.logger.Debug("remote relay dropped", "from", event.From, "to", event.To, "type", event.MsgType)
+		return
+	}
+	s.logger.Debug("remote relay delivered", "from", event.From, "to", event.To, "type", event.MsgType)
+}
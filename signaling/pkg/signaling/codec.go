@@ -0,0 +1,110 @@
+package signaling
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	"github.com/fxamacker/cbor/v2"
+	"nhooyr.io/websocket"
+)
+
+// WebSocket subprotocols that select how signaling messages are encoded.
+// Clients offer the encodings they support; the server selects CBOR when
+// offered, and JSON otherwise.
+const (
+	Subprotocol     = "lanscape.signaling"
+	CBORSubprotocol = "lanscape.signaling.cbor"
+)
+
+// Encoding is how signaling messages are encoded on a connection. JSON is
+// sent in text frames. CBOR is sent in binary frames, with the same field
+// names as JSON; payload and metadata stay opaque JSON, carried as byte
+// strings so the server relays them without parsing them.
+type Encoding string
+
+const (
+	EncodingJSON Encoding = "json"
+	EncodingCBOR Encoding = "cbor"
+)
+
+// ParseSubprotocol returns the encoding a negotiated subprotocol selects.
+// Connections without one, or with another such as a token subprotocol,
+// use JSON.
+func ParseSubprotocol(name string) Encoding {
+	if name == CBORSubprotocol {
+		return EncodingCBOR
+	}
+	return EncodingJSON
+}
+
+// Subprotocol returns the WebSocket subprotocol that selects e
+func (e Encoding) Subprotocol() string {
+	if e == EncodingCBOR {
+		return CBORSubprotocol
+	}
+	return Subprotocol
+}
+
+// MessageType returns the WebSocket frame type e is sent in
+func (e Encoding) MessageType() websocket.MessageType {
+	if e == EncodingCBOR {
+		return websocket.MessageBinary
+	}
+	return websocket.MessageText
+}
+
+// Marshal encodes v
+func (e Encoding) Marshal(v any) ([]byte, error) {
+	if e == EncodingCBOR {
+		return cbor.Marshal(v)
+	}
+	return json.Marshal(v)
+}
+
+// Unmarshal decodes data into v. CBOR messages are checked to carry valid
+// JSON in their payload and metadata, since they are relayed to JSON clients
+// as is.
+func (e Encoding) Unmarshal(data []byte, v any) error {
+	if e != EncodingCBOR {
+		return json.Unmarshal(data, v)
+	}
+	if err := cbor.Unmarshal(data, v); err != nil {
+		return err
+	}
+	switch msg := v.(type) {
+	case *InboundMessage:
+		return validRawJSON(msg.Payload, msg.Metadata)
+	case *OutboundMessage:
+		return validRawJSON(msg.Payload, msg.Metadata)
+	}
+	return nil
+}
+
+// Write encodes v and writes it to conn in one frame
+func (e Encoding) Write(ctx context.Context, conn *websocket.Conn, v any) error {
+	data, err := e.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return conn.Write(ctx, e.MessageType(), data)
+}
+
+// Read reads one frame from conn and decodes it into v
+func (e Encoding) Read(ctx context.Context, conn *websocket.Conn, v any) error {
+	_, data, err := conn.Read(ctx)
+	if err != nil {
+		return err
+	}
+	return e.Unmarshal(data, v)
+}
+
+// validRawJSON returns an error if any of values is set but is not JSON
+func validRawJSON(values ...json.RawMessage) error {
+	for _, value := range values {
+		if len(value) > 0 && !json.Valid(value) {
+			return errors.New("payload and metadata must be JSON")
+		}
+	}
+	return nil
+}
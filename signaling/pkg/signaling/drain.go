@@ -0,0 +1,164 @@
+package signaling
+
+import (
+	"context"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// drain tracks the server's drain mode: once started, the server refuses
+// new joins and waits for its peers to move to other servers
+type drain struct {
+	grace time.Duration
+
+	mu    sync.Mutex
+	since time.Time // zero until draining starts
+}
+
+// DrainStatus describes the server's drain mode for the admin API
+type DrainStatus struct {
+	Draining bool `json:"draining"`
+	// Since is when draining started, unset if it has not
+	Since   *time.Time `json:"since,omitempty"`
+	GraceMs int64      `json:"graceMs"`
+	// Peers counts the participants and observers still connected
+	Peers int `json:"peers"`
+}
+
+// SetDrainGrace gives peers grace to move to another server once draining
+// starts, before Drain closes their connections. 0, the default, closes
+// them as soon as Drain is called. Must be called before the server starts
+// handling connections.
+func (s *Server) SetDrainGrace(grace time.Duration) {
+	s.drain.grace = max(grace, 0)
+}
+
+// StartDrain puts the server in drain mode ahead of a shutdown, for rolling
+// deploys: it refuses new joins and resumptions, and sends every connected
+// peer a server-draining message asking it to reconnect after a random
+// delay within the first half of the drain grace, so peers move to other
+// servers spread out instead of all at once. Connections stay open until
+// Drain closes them. Returns false if the server was already draining.
+func (s *Server) StartDrain() bool {
+	s.drain.mu.Lock()
+	if !s.drain.since.IsZero() {
+		s.drain.mu.Unlock()
+		return false
+	}
+	s.drain.since = time.Now().UTC()
+	s.drain.mu.Unlock()
+
+	// Clients reconnect elsewhere, so there is nothing to hold peers for
+	s.expireAllDetached()
+
+	notified := 0
+	s.localPeers(func(pc *PeerConn) {
+		msg := OutboundMessage{Type: "server-draining", ReconnectAfterMs: s.reconnectAfter().Milliseconds()}
+		if pc.TrySend(msg) {
+			notified++
+		}
+	})
+	s.logger.Info("draining", "grace", s.drain.grace, "notified", notified)
+	return true
+}
+
+// AcceptingJoins reports whether the server admits new joins, which it
+// stops doing once draining starts
+func (s *Server) AcceptingJoins() bool {
+	s.drain.mu.Lock()
+	defer s.drain.mu.Unlock()
+	return s.drain.since.IsZero()
+}
+
+// DrainStatus returns the server's drain mode and how many peers are still
+// connected to it
+func (s *Server) DrainStatus() DrainStatus {
+	status := DrainStatus{GraceMs: s.drain.grace.Milliseconds()}
+	s.drain.mu.Lock()
+	if since := s.drain.since; !since.IsZero() {
+		status.Draining = true
+		status.Since = &since
+	}
+	s.drain.mu.Unlock()
+	s.localPeers(func(*PeerConn) { status.Peers++ })
+	return status
+}
+
+// Drain shuts the server down: it starts draining if that has not already
+// begun, waits for peers to leave on their own until the drain grace has
+// passed since draining started, then tells connection handlers to close
+// the remaining connections with CloseDraining so their clients reconnect
+// elsewhere. It waits until every local peer has left or ctx is done.
+func (s *Server) Drain(ctx context.Context) error {
+	s.StartDrain()
+	s.drain.mu.Lock()
+	deadline := s.drain.since.Add(s.drain.grace)
+	s.drain.mu.Unlock()
+
+	if wait := time.Until(deadline); wait > 0 {
+		graceCtx, cancel := context.WithTimeout(ctx, wait)
+		err := s.waitEmpty(graceCtx)
+		cancel()
+		if err == nil {
+			s.logger.Info("all peers left during drain grace")
+		}
+	}
+
+	s.drainOnce.Do(func() { close(s.draining) })
+	s.expireAllDetached()
+	return s.waitEmpty(ctx)
+}
+
+// Draining returns a channel that is closed once Drain starts closing
+// connections
+func (s *Server) Draining() <-chan struct{} {
+	return s.draining
+}
+
+// drainStarted reports whether draining has started
+func (s *Server) drainStarted() bool {
+	return !s.AcceptingJoins()
+}
+
+// reconnectAfter returns a random delay within the first half of the drain
+// grace for a peer to reconnect after
+func (s *Server) reconnectAfter() time.Duration {
+	if window := s.drain.grace / 2; window > 0 {
+		return rand.N(window)
+	}
+	return 0
+}
+
+// waitEmpty waits until every local peer has left or ctx is done
+func (s *Server) waitEmpty(ctx context.Context) error {
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		empty := true
+		s.topics.Range(func(_, value any) bool {
+			empty = value.(*Topic).IsEmpty()
+			return empty
+		})
+		if empty {
+			return nil
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// localPeers calls fn for every participant and observer connected to this
+// server
+func (s *Server) localPeers(fn func(pc *PeerConn)) {
+	s.topics.Range(func(_, value any) bool {
+		value.(*Topic).peers.Range(func(_, peer any) bool {
+			fn(peer.(*PeerConn))
+			return true
+		})
+		return true
+	})
+}
@@ -0,0 +1,37 @@
+package signaling
+
+import (
+	"math/rand"
+	"sync"
+)
+
+// Faults injects failures into the server for resilience testing, so
+// clients' retry and reconnect logic can be exercised on purpose. Choices
+// come from a generator seeded with Seed, so a failing run can be repeated.
+// It is safe for concurrent use; a nil Faults injects nothing.
+type Faults struct {
+	// RelayDrop is the fraction of relays, from 0 to 1, dropped as if the
+	// target's queue were full
+	RelayDrop float64
+	Seed      int64
+
+	once sync.Once
+	mu   sync.Mutex
+	rand *rand.Rand
+}
+
+// dropRelay reports whether to drop the next relay
+func (f *Faults) dropRelay() bool {
+	if f == nil || f.RelayDrop <= 0 {
+		return false
+	}
+	return f.chance() < f.RelayDrop
+}
+
+// chance returns the next number in [0, 1) from the seeded generator
+func (f *Faults) chance() float64 {
+	f.once.Do(func() { f.rand = rand.New(rand.NewSource(f.Seed)) })
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.rand.Float64()
+}
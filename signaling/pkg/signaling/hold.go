@@ -0,0 +1,148 @@
+package signaling
+
+import (
+	"sync"
+	"time"
+)
+
+// relayHold keeps relays addressed to peers that just left their topic, or
+// whose detached connection's queue is full, for a short window. If a peer
+// with the same ID comes back in time, by resuming or rejoining with a
+// stable ID, the held relays are delivered to it, so ICE candidates and
+// offers sent across a brief reconnect are not lost.
+type relayHold struct {
+	window time.Duration
+
+	mu    sync.Mutex
+	peers map[heldPeer]*heldRelays
+}
+
+// heldPeer identifies a peer relays are held for
+type heldPeer struct {
+	topic string
+	peer  string
+}
+
+// heldRelays are the relays held for one peer until timer expires them
+type heldRelays struct {
+	msgs  []OutboundMessage
+	timer *time.Timer
+}
+
+// SetRelayHold holds relays to peers that just disconnected for window, and
+// delivers them if the peer reconnects in time. 0, the default, disables
+// holding. Must be called before the server starts handling connections.
+func (s *Server) SetRelayHold(window time.Duration) {
+	if window <= 0 {
+		s.hold = nil
+		return
+	}
+	s.hold = &relayHold{window: window, peers: make(map[heldPeer]*heldRelays)}
+}
+
+// RelayHold returns how long relays to disconnected peers are held, or 0 if
+// they are not
+func (s *Server) RelayHold() time.Duration {
+	if s.hold == nil {
+		return 0
+	}
+	return s.hold.window
+}
+
+// holdRelay holds msg for toPeerID, which just disconnected from topicID,
+// and reports whether it was held
+func (s *Server) holdRelay(topicID, toPeerID string, msg OutboundMessage) bool {
+	if s.hold == nil {
+		return false
+	}
+	key := heldPeer{topic: topicID, peer: toPeerID}
+	s.hold.mu.Lock()
+	defer s.hold.mu.Unlock()
+	held := s.hold.peers[key]
+	// Held relays must fit in the peer's send queue when they are flushed
+	if held == nil || len(held.msgs) >= s.SendQueueSize() {
+		return false
+	}
+	held.msgs = append(held.msgs, msg)
+	return true
+}
+
+// disconnected starts holding relays for a peer that left or detached. A
+// peer already held for keeps its relays and gets a new window.
+func (s *Server) disconnected(topicID, peerID string) {
+	if s.hold == nil {
+		return
+	}
+	key := heldPeer{topic: topicID, peer: peerID}
+	s.hold.mu.Lock()
+	defer s.hold.mu.Unlock()
+	if held := s.hold.peers[key]; held != nil {
+		held.timer.Reset(s.hold.window)
+		return
+	}
+	held := &heldRelays{}
+	held.timer = time.AfterFunc(s.hold.window, func() { s.expireHeld(key, held) })
+	s.hold.peers[key] = held
+}
+
+// flushHeld delivers the relays held for pc, which just joined or resumed
+func (s *Server) flushHeld(pc *PeerConn) {
+	if s.hold == nil {
+		return
+	}
+	key := heldPeer{topic: pc.TopicID, peer: pc.ID}
+	s.hold.mu.Lock()
+	held := s.hold.peers[key]
+	delete(s.hold.peers, key)
+	s.hold.mu.Unlock()
+	if held == nil {
+		return
+	}
+	held.timer.Stop()
+
+	delivered := 0
+	for _, msg := range held.msgs {
+		if pc.TrySend(msg) {
+			delivered++
+		} else {
+			s.heldDropped(pc.TopicID, msg)
+		}
+	}
+	if len(held.msgs) > 0 {
+		s.logger.Info("delivered held relays", "peer", pc.ID, "topic", pc.TopicID, "delivered", delivered, "held", len(held.msgs))
+	}
+}
+
+// expireHeld drops the relays held for a peer that did not come back
+func (s *Server) expireHeld(key heldPeer, held *heldRelays) {
+	s.hold.mu.Lock()
+	if s.hold.peers[key] != held {
+		s.hold.mu.Unlock()
+		return
+	}
+	delete(s.hold.peers, key)
+	msgs := held.msgs
+	s.hold.mu.Unlock()
+
+	for _, msg := range msgs {
+		s.heldDropped(key.topic, msg)
+	}
+	if len(msgs) > 0 {
+		s.logger.Debug("held relays expired", "peer", key.peer, "topic", key.topic, "dropped", len(msgs))
+	}
+}
+
+// heldDropped tells the sender of a held relay that could not be delivered,
+// if it asked to hear about the relay by giving a message ID
+func (s *Server) heldDropped(topicID string, msg OutboundMessage) {
+	if msg.MsgID == "" {
+		return
+	}
+	val, ok := s.topics.Load(topicID)
+	if !ok {
+		return
+	}
+	if from := val.(*Topic).GetPeer(msg.From); from != nil {
+		from.TrySend(OutboundMessage{Type: "error", Code: "dropped", Message: "delivery failed", MsgID: msg.MsgID})
+	}
+}
@@ -0,0 +1,50 @@
+package signaling
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// DerivePeerID returns the stable peer ID for an ed25519 public key: the
+// hex-encoded first 16 bytes of its SHA-256, the same as the agent's key
+// fingerprint
+func DerivePeerID(publicKey ed25519.PublicKey) string {
+	sum := sha256.Sum256(publicKey)
+	return hex.EncodeToString(sum[:16])
+}
+
+// NewChallenge returns a random nonce for a join challenge
+func NewChallenge() string {
+	nonce := make([]byte, 32)
+	rand.Read(nonce)
+	return base64.RawURLEncoding.EncodeToString(nonce)
+}
+
+// ChallengeSigningInput returns the bytes a client signs to prove possession
+// of its key when joining a topic. Binding the topic prevents a response
+// from being replayed into another topic.
+func ChallengeSigningInput(topicID, nonce string) []byte {
+	return []byte("lanscape-join\n" + topicID + "\n" + nonce)
+}
+
+// VerifyJoinProof checks a challenge response and returns the derived peer ID.
+// publicKey and signature are base64url-encoded.
+func VerifyJoinProof(publicKey, topicID, nonce, signature string) (string, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(publicKey)
+	if err != nil || len(raw) != ed25519.PublicKeySize {
+		return "", errors.New("invalid public key")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil {
+		return "", fmt.Errorf("invalid signature encoding: %w", err)
+	}
+	if !ed25519.Verify(raw, ChallengeSigningInput(topicID, nonce), sig) {
+		return "", errors.New("signature verification failed")
+	}
+	return DerivePeerID(raw), nil
+}
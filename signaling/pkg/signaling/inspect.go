@@ -0,0 +1,169 @@
+package signaling
+
+import (
+	"sort"
+	"time"
+)
+
+// TopicSummary describes a topic for the admin API
+type TopicSummary struct {
+	Topic string `json:"topic"`
+	// Peers counts participants; Observers are counted separately
+	Peers     int `json:"peers"`
+	Observers int `json:"observers"`
+	// RemotePeers counts participants connected to other servers in the
+	// cluster
+	RemotePeers int       `json:"remotePeers"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+// PeerSummary describes a peer in a topic for the admin API. Peers connected
+// to other servers in the cluster carry the Instance they are connected to
+// and only what their peer records tell: ID and PeerInfo.
+type PeerSummary struct {
+	ID string `json:"id"`
+	PeerInfo
+	// PublicKey is the identity key the peer proved; empty if none
+	PublicKey  string `json:"publicKey,omitempty"`
+	Observer   bool   `json:"observer,omitempty"`
+	RemoteAddr string `json:"remoteAddr,omitempty"`
+	// ConnectedAt is when the peer joined; ConnectedSeconds is how long ago
+	ConnectedAt      *time.Time `json:"connectedAt,omitempty"`
+	ConnectedSeconds int64      `json:"connectedSeconds,omitempty"`
+	Instance         string     `json:"instance,omitempty"`
+}
+
+// Topics returns a summary of every topic, sorted by ID
+func (s *Server) Topics() []TopicSummary {
+	var topics []TopicSummary
+	s.topics.Range(func(key, value any) bool {
+		topic := value.(*Topic)
+		summary := TopicSummary{Topic: topic.ID, CreatedAt: topic.CreatedAt}
+		topic.peers.Range(func(key, value any) bool {
+			if value.(*PeerConn).Observer {
+				summary.Observers++
+			} else {
+				summary.Peers++
+			}
+			return true
+		})
+		summary.RemotePeers = len(topic.remoteRecords())
+		topics = append(topics, summary)
+		return true
+	})
+	sort.Slice(topics, func(i, j int) bool { return topics[i].Topic < topics[j].Topic })
+	return topics
+}
+
+// TopicPeers returns the peers of a topic, local and remote, sorted by
+// connection time with remote peers last. Returns false if there is no such
+// topic.
+func (s *Server) TopicPeers(topicID string) ([]PeerSummary, bool) {
+	val, ok := s.topics.Load(topicID)
+	if !ok {
+		return nil, false
+	}
+	topic := val.(*Topic)
+	now := time.Now()
+
+	var local []*PeerConn
+	topic.peers.Range(func(key, value any) bool {
+		local = append(local, value.(*PeerConn))
+		return true
+	})
+	sort.Slice(local, func(i, j int) bool { return local[i].ConnectedAt.Before(local[j].ConnectedAt) })
+
+	peers := make([]PeerSummary, 0, len(local))
+	for _, pc := range local {
+		connectedAt := pc.ConnectedAt
+		peers = append(peers, PeerSummary{
+			ID:               pc.ID,
+			PeerInfo:         pc.Info,
+			PublicKey:        pc.PublicKey,
+			Observer:         pc.Observer,
+			RemoteAddr:       pc.RemoteAddr(),
+			ConnectedAt:      &connectedAt,
+			ConnectedSeconds: int64(now.Sub(connectedAt) / time.Second),
+		})
+	}
+
+	var remote []PeerSummary
+	topic.remote.Range(func(key, value any) bool {
+		rp := value.(remotePeer)
+		remote = append(remote, PeerSummary{
+			ID:       rp.record.ID,
+			PeerInfo: MetadataPeerInfo(rp.record.Metadata),
+			Instance: rp.instance,
+		})
+		return true
+	})
+	sort.Slice(remote, func(i, j int) bool { return remote[i].ID < remote[j].ID })
+	return append(peers, remote...), true
+}
+
+// Disconnect removes peerID from every topic it is in, closing its
+// connections with CloseDisconnected and detail. A peer connected to other
+// servers in the cluster is disconnected there too. Returns the topics the
+// peer was found in, here or elsewhere in the cluster.
+func (s *Server) Disconnect(peerID, detail string) []string {
+	var topics []string
+	s.topics.Range(func(key, value any) bool {
+		topic := value.(*Topic)
+		if _, ok := topic.getRemote(peerID); ok {
+			topics = append(topics, topic.ID)
+		}
+		return true
+	})
+	if len(topics) > 0 {
+		s.cluster.disconnect(peerID, detail)
+	}
+	topics = append(topics, s.disconnect(peerID, detail)...)
+	sort.Strings(topics)
+	return topics
+}
+
+// disconnect removes peerID from every local topic it is in and returns
+// those topics
+func (s *Server) disconnect(peerID, detail string) []string {
+	var topics []*Topic
+	s.topics.Range(func(key, value any) bool {
+		if topic := value.(*Topic); topic.GetPeer(peerID) != nil {
+			topics = append(topics, topic)
+		}
+		return true
+	})
+
+	var removed []string
+	for _, topic := range topics {
+		if s.evict(topic, peerID, CloseDisconnected, detail) {
+			removed = append(removed, topic.ID)
+			s.logger.Info("disconnected peer", "peer", peerID, "topic", topic.ID, "detail", detail)
+		}
+	}
+	return removed
+}
+
+// evict removes a local peer from topic on the server's initiative, closing
+// its connection with reason and detail. Returns false if it already left.
+func (s *Server) evict(topic *Topic, peerID string, reason CloseReason, detail string) bool {
+	removed, dropped, empty := topic.RemovePeer(peerID)
+	if removed == nil {
+		return false
+	}
+	removed.kick(reason, detail)
+	if empty {
+		s.topics.CompareAndDelete(topic.ID, topic)
+	}
+	for _, to := range dropped {
+		s.logger.Debug("dropped peer-left notification", "to", to, "from", peerID)
+	}
+	if !removed.Observer {
+		s.presence.Offline(topic.ID, removed.PublicKey)
+		s.webhooks.peerLeft(removed)
+		s.cluster.left(removed)
+	}
+	if empty {
+		s.webhooks.topicEmpty(topic.ID)
+	}
+	return true
+}
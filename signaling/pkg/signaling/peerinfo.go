@@ -0,0 +1,75 @@
+package signaling
+
+import (
+	"encoding/json"
+	"errors"
+	"net/netip"
+	"unicode/utf8"
+)
+
+// maxPeerInfoLength bounds each PeerInfo field, the longest a DNS name can be
+const maxPeerInfoLength = 253
+
+// PeerInfo is how a peer describes itself to other peers for display. It is
+// carried in the peer's metadata as {"hostname", "displayName",
+// "tailscaleIp"}, alongside whatever else the client put there, and is
+// unauthenticated.
+type PeerInfo struct {
+	Hostname    string `json:"hostname,omitempty"`
+	DisplayName string `json:"displayName,omitempty"`
+	TailscaleIP string `json:"tailscaleIp,omitempty"`
+}
+
+// Validate checks that fields are bounded text and TailscaleIP, if set, is
+// an IP address
+func (p PeerInfo) Validate() error {
+	for _, field := range []string{p.Hostname, p.DisplayName, p.TailscaleIP} {
+		if len(field) > maxPeerInfoLength || !utf8.ValidString(field) {
+			return errors.New("peer info fields must be text of at most 253 bytes")
+		}
+	}
+	if p.TailscaleIP != "" {
+		if _, err := netip.ParseAddr(p.TailscaleIP); err != nil {
+			return errors.New("tailscaleIp must be an IP address")
+		}
+	}
+	return nil
+}
+
+// IsZero reports whether no field is set
+func (p PeerInfo) IsZero() bool {
+	return p == PeerInfo{}
+}
+
+// MetadataPeerInfo returns the PeerInfo in a peer's join metadata. Fields
+// that are missing or not strings are left empty.
+func MetadataPeerInfo(metadata json.RawMessage) PeerInfo {
+	var info PeerInfo
+	if len(metadata) > 0 {
+		json.Unmarshal(metadata, &info)
+	}
+	return info
+}
+
+// WithPeerInfo returns metadata, a JSON object or nil, with the set fields of
+// info added, replacing any of the same name
+func WithPeerInfo(metadata json.RawMessage, info PeerInfo) (json.RawMessage, error) {
+	if info.IsZero() {
+		return metadata, nil
+	}
+	fields := map[string]json.RawMessage{}
+	if len(metadata) > 0 {
+		if err := json.Unmarshal(metadata, &fields); err != nil {
+			return nil, errors.New("metadata must be a JSON object")
+		}
+	}
+	set := func(name, value string) {
+		if value != "" {
+			fields[name], _ = json.Marshal(value)
+		}
+	}
+	set("hostname", info.Hostname)
+	set("displayName", info.DisplayName)
+	set("tailscaleIp", info.TailscaleIP)
+	return json.Marshal(fields)
+}
@@ -0,0 +1,272 @@
+package signaling
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxPresenceQueue bounds the events held while lanscaped is unreachable.
+// Older events are dropped; the snapshot sent on recovery corrects the state.
+const maxPresenceQueue = 1000
+
+// presenceRetryInterval is how often a failed report is retried
+const presenceRetryInterval = 10 * time.Second
+
+// PresenceEvent reports that an identity key came online or went offline in
+// a topic
+type PresenceEvent struct {
+	Topic     string    `json:"topic"`
+	PublicKey string    `json:"public_key"`
+	Online    bool      `json:"online"`
+	At        time.Time `json:"at"`
+}
+
+// PresenceEntry is an identity key online in a topic
+type PresenceEntry struct {
+	Topic     string `json:"topic"`
+	PublicKey string `json:"public_key"`
+}
+
+// presenceReport is the body posted to lanscaped's /v1/presence. With Snapshot set, Online
+// lists every key online in any topic, and lanscaped marks all others
+// offline after applying Events.
+type presenceReport struct {
+	Events   []PresenceEvent `json:"events"`
+	Snapshot bool            `json:"snapshot,omitempty"`
+	Online   []PresenceEntry `json:"online,omitempty"`
+}
+
+// PresenceReporter pushes participants' proven identity keys coming online
+// and going offline per topic to lanscaped. A key that goes offline is only
+// reported once it has stayed offline for the grace period, so a peer that
+// reconnects right away is never reported offline. A full snapshot is sent
+// on start, after a failed report, and every snapshot interval, so lanscaped
+// recovers from missed events and restarts. A nil reporter reports nothing.
+type PresenceReporter struct {
+	url    string
+	token  string
+	grace  time.Duration
+	client *http.Client
+	logger *slog.Logger
+
+	// sendMu keeps reports in order
+	sendMu sync.Mutex
+
+	mu       sync.Mutex
+	conns    map[PresenceEntry]int         // live connections per key and topic
+	reported map[PresenceEntry]bool        // keys last reported online
+	pending  map[PresenceEntry]*time.Timer // offline reports waiting out the grace period
+	queue    []PresenceEvent
+	resync   bool
+	wake     chan struct{}
+}
+
+// NewPresenceReporter creates a reporter that posts to url with
+// "Authorization: Bearer <token>"
+func NewPresenceReporter(url, token string, grace time.Duration, logger *slog.Logger) *PresenceReporter {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return &PresenceReporter{
+		url:      url,
+		token:    token,
+		grace:    grace,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		logger:   logger,
+		conns:    make(map[PresenceEntry]int),
+		reported: make(map[PresenceEntry]bool),
+		pending:  make(map[PresenceEntry]*time.Timer),
+		resync:   true,
+		wake:     make(chan struct{}, 1),
+	}
+}
+
+// Online records a connection of an identity key to a topic
+func (p *PresenceReporter) Online(topicID, publicKey string) {
+	if p == nil || publicKey == "" {
+		return
+	}
+	k := PresenceEntry{Topic: topicID, PublicKey: publicKey}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.conns[k]++
+	if timer, ok := p.pending[k]; ok {
+		// Reconnected within the grace period; it was never reported offline
+		timer.Stop()
+		delete(p.pending, k)
+	}
+	if !p.reported[k] {
+		p.reported[k] = true
+		p.enqueue(PresenceEvent{Topic: topicID, PublicKey: publicKey, Online: true, At: time.Now().UTC()})
+	}
+}
+
+// Offline records that a connection of an identity key left a topic. The key
+// is reported offline once it has had no connections for the grace period.
+func (p *PresenceReporter) Offline(topicID, publicKey string) {
+	if p == nil || publicKey == "" {
+		return
+	}
+	k := PresenceEntry{Topic: topicID, PublicKey: publicKey}
+	at := time.Now().UTC()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conns[k]--; p.conns[k] > 0 {
+		return
+	}
+	delete(p.conns, k)
+	if _, ok := p.pending[k]; ok {
+		return
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(p.grace, func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		// Stop does not catch a timer that already fired, so check it is
+		// still the pending one
+		if p.pending[k] != timer {
+			return
+		}
+		delete(p.pending, k)
+		p.reportOffline(k, at)
+	})
+	p.pending[k] = timer
+}
+
+// reportOffline queues an offline event for a key reported online. Callers
+// must hold mu.
+func (p *PresenceReporter) reportOffline(k PresenceEntry, at time.Time) {
+	if !p.reported[k] {
+		return
+	}
+	delete(p.reported, k)
+	p.enqueue(PresenceEvent{Topic: k.Topic, PublicKey: k.PublicKey, Online: false, At: at})
+}
+
+// enqueue adds an event and wakes the sender. Callers must hold mu.
+func (p *PresenceReporter) enqueue(event PresenceEvent) {
+	if len(p.queue) >= maxPresenceQueue {
+		p.queue = p.queue[1:]
+		p.resync = true
+	}
+	p.queue = append(p.queue, event)
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run sends events as they happen and a snapshot every interval until ctx is
+// done
+func (p *PresenceReporter) Run(ctx context.Context, snapshotInterval time.Duration) {
+	snapshot := time.NewTicker(snapshotInterval)
+	defer snapshot.Stop()
+	retry := time.NewTicker(presenceRetryInterval)
+	defer retry.Stop()
+
+	p.send(ctx)
+	for {
+		select {
+		case <-p.wake:
+		case <-snapshot.C:
+			p.mu.Lock()
+			p.resync = true
+			p.mu.Unlock()
+		case <-retry.C:
+		case <-ctx.Done():
+			return
+		}
+		p.send(ctx)
+	}
+}
+
+// Flush reports every key still in its grace period offline and sends all
+// queued events, e.g. once the server has drained on shutdown
+func (p *PresenceReporter) Flush(ctx context.Context) {
+	if p == nil {
+		return
+	}
+	now := time.Now().UTC()
+	p.mu.Lock()
+	for k, timer := range p.pending {
+		timer.Stop()
+		delete(p.pending, k)
+		p.reportOffline(k, now)
+	}
+	p.mu.Unlock()
+	p.send(ctx)
+}
+
+// send posts the queued events, with a snapshot if one is due. On failure the
+// events are queued again and the next report carries a snapshot.
+func (p *PresenceReporter) send(ctx context.Context) {
+	p.sendMu.Lock()
+	defer p.sendMu.Unlock()
+
+	p.mu.Lock()
+	report := presenceReport{Events: p.queue, Snapshot: p.resync}
+	if report.Snapshot {
+		report.Online = make([]PresenceEntry, 0, len(p.reported))
+		for k := range p.reported {
+			report.Online = append(report.Online, k)
+		}
+	}
+	p.queue = nil
+	p.resync = false
+	p.mu.Unlock()
+
+	if len(report.Events) == 0 && !report.Snapshot {
+		return
+	}
+	if report.Events == nil {
+		report.Events = []PresenceEvent{}
+	}
+
+	if err := p.post(ctx, report); err != nil {
+		p.logger.Warn("failed to report presence", "error", err, "events", len(report.Events))
+		p.mu.Lock()
+		p.queue = append(report.Events, p.queue...)
+		if over := len(p.queue) - maxPresenceQueue; over > 0 {
+			p.queue = p.queue[over:]
+		}
+		p.resync = true
+		p.mu.Unlock()
+		return
+	}
+	p.logger.Debug("reported presence", "events", len(report.Events), "snapshot", report.Snapshot)
+}
+
+// post sends one report to lanscaped
+func (p *PresenceReporter) post(ctx context.Context, report presenceReport) error {
+	body, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+p.token)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("status %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
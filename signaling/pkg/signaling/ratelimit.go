@@ -0,0 +1,197 @@
+package signaling
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// rateLimitSweepInterval is how often idle buckets are forgotten
+const rateLimitSweepInterval = time.Minute
+
+// RateLimit is a token bucket: Rate messages per second on average, in
+// bursts of up to Burst. A zero Rate disables the limit.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// RateLimiter limits relays per peer and per source IP, so one client cannot
+// flood the server and starve other peers. It is safe for concurrent use; a
+// nil RateLimiter allows everything.
+type RateLimiter struct {
+	peer RateLimit
+	ip   RateLimit
+
+	mu        sync.Mutex
+	peers     map[string]*tokenBucket // by peer ID
+	ips       map[string]*tokenBucket // by client IP
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter creates a limiter with a bucket per peer and per source IP
+func NewRateLimiter(peer, ip RateLimit) *RateLimiter {
+	return &RateLimiter{
+		peer:      peer,
+		ip:        ip,
+		peers:     make(map[string]*tokenBucket),
+		ips:       make(map[string]*tokenBucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// Allow takes a token from the buckets of peerID and of the IP in
+// remoteAddr, or reports false without taking any if either has none left.
+// An empty remoteAddr is only limited per peer.
+func (l *RateLimiter) Allow(peerID, remoteAddr string, now time.Time) bool {
+	if l == nil {
+		return true
+	}
+	ip := remoteAddr
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		ip = host
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastSweep) >= rateLimitSweepInterval {
+		l.sweep(now)
+	}
+
+	var peerBucket, ipBucket *tokenBucket
+	if l.peer.Rate > 0 {
+		peerBucket = l.bucket(l.peers, peerID, l.peer, now)
+		if peerBucket.tokens < 1 {
+			return false
+		}
+	}
+	if l.ip.Rate > 0 && ip != "" {
+		ipBucket = l.bucket(l.ips, ip, l.ip, now)
+		if ipBucket.tokens < 1 {
+			return false
+		}
+	}
+	if peerBucket != nil {
+		peerBucket.tokens--
+	}
+	if ipBucket != nil {
+		ipBucket.tokens--
+	}
+	return true
+}
+
+// bucket returns the bucket for key in buckets, refilled up to now
+func (l *RateLimiter) bucket(buckets map[string]*tokenBucket, key string, limit RateLimit, now time.Time) *tokenBucket {
+	b, ok := buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(limit.Burst), last: now}
+		buckets[key] = b
+		return b
+	}
+	b.refill(limit, now)
+	return b
+}
+
+// sweep forgets buckets that have refilled, since a new bucket starts full
+func (l *RateLimiter) sweep(now time.Time) {
+	l.lastSweep = now
+	sweepBuckets(l.peers, l.peer, now)
+	sweepBuckets(l.ips, l.ip, now)
+}
+
+// refill adds the tokens earned since the bucket was last used
+func (b *tokenBucket) refill(limit RateLimit, now time.Time) {
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = min(b.tokens+elapsed.Seconds()*limit.Rate, float64(limit.Burst))
+		b.last = now
+	}
+}
+
+// sweepBuckets forgets the buckets that have refilled
+func sweepBuckets(buckets map[string]*tokenBucket, limit RateLimit, now time.Time) {
+	for key, b := range buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*limit.Rate >= float64(limit.Burst) {
+			delete(buckets, key)
+		}
+	}
+}
+
+// RateLimitStatus is the state of a client's bucket after a request, for
+// telling the client how to pace itself
+type RateLimitStatus struct {
+	Limit     int           // the bucket's burst
+	Remaining int           // whole requests left in the bucket
+	Reset     time.Duration // until the bucket is full again
+	// RetryAfter is how long until the next request is allowed; zero if
+	// this one was
+	RetryAfter time.Duration
+}
+
+// Allowed reports whether the request was allowed
+func (s RateLimitStatus) Allowed() bool {
+	return s.RetryAfter == 0
+}
+
+// IPRateLimiter limits requests per client IP, such as HTTP requests,
+// reporting the state of each client's bucket. It is safe for concurrent
+// use; a nil IPRateLimiter allows everything.
+type IPRateLimiter struct {
+	limit RateLimit
+
+	mu        sync.Mutex
+	ips       map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+// NewIPRateLimiter creates a limiter with a bucket per client IP
+func NewIPRateLimiter(limit RateLimit) *IPRateLimiter {
+	return &IPRateLimiter{limit: limit, ips: make(map[string]*tokenBucket), lastSweep: time.Now()}
+}
+
+// Take takes a token from the bucket of the IP in remoteAddr if it has one,
+// and returns the bucket's state
+func (l *IPRateLimiter) Take(remoteAddr string, now time.Time) RateLimitStatus {
+	if l == nil {
+		return RateLimitStatus{}
+	}
+	ip := remoteAddr
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		ip = host
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastSweep) >= rateLimitSweepInterval {
+		l.lastSweep = now
+		sweepBuckets(l.ips, l.limit, now)
+	}
+
+	b, ok := l.ips[ip]
+	if !ok {
+		b = &tokenBucket{tokens: float64(l.limit.Burst), last: now}
+		l.ips[ip] = b
+	}
+	b.refill(l.limit, now)
+
+	status := RateLimitStatus{Limit: l.limit.Burst}
+	if b.tokens < 1 {
+		status.RetryAfter = l.refillTime(1 - b.tokens)
+	} else {
+		b.tokens--
+	}
+	status.Remaining = int(b.tokens)
+	status.Reset = l.refillTime(float64(l.limit.Burst) - b.tokens)
+	return status
+}
+
+// refillTime returns how long the bucket takes to earn tokens
+func (l *IPRateLimiter) refillTime(tokens float64) time.Duration {
+	return time.Duration(tokens / l.limit.Rate * float64(time.Second))
+}
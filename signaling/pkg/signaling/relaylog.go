@@ -0,0 +1,114 @@
+package signaling
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// RelayLogEntry records one relay attempt. Payloads are never logged, only
+// their size.
+type RelayLogEntry struct {
+	Time   time.Time `json:"time"`
+	Topic  string    `json:"topic"`
+	From   string    `json:"from"`
+	To     string    `json:"to"`
+	Type   string    `json:"type"`
+	Size   int       `json:"size"`
+	Result string    `json:"result"`
+}
+
+// RelayLogConfig configures the relay audit log
+type RelayLogConfig struct {
+	Path string
+	// MaxSize is the size in bytes at which the file is rotated (0 disables rotation)
+	MaxSize int64
+	// MaxFiles is the number of rotated files to keep alongside the active one
+	MaxFiles int
+}
+
+// RelayLogFilter selects entries to export; zero fields match everything
+type RelayLogFilter struct {
+	Topic string
+	Peer  string // matches From or To
+	Since time.Time
+}
+
+// RelayLog is an append-only, rotating JSON-lines log of relay attempts
+type RelayLog struct {
+	file *rotatingFile
+}
+
+// NewRelayLog opens (or appends to) the relay log
+func NewRelayLog(config RelayLogConfig) (*RelayLog, error) {
+	file, err := openRotatingFile("relay log", config.Path, config.MaxSize, config.MaxFiles)
+	if err != nil {
+		return nil, err
+	}
+	return &RelayLog{file: file}, nil
+}
+
+// Record appends an entry, rotating the file when it grows past MaxSize
+func (l *RelayLog) Record(entry RelayLogEntry) {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	l.file.write(append(line, '\n'))
+}
+
+// Export writes matching entries from the rotated and active files, oldest
+// first, as JSON lines
+func (l *RelayLog) Export(w io.Writer, filter RelayLogFilter) error {
+	// Hold the lock so rotation cannot shift files mid-export
+	l.file.mu.Lock()
+	defer l.file.mu.Unlock()
+
+	for _, path := range l.file.paths() {
+		if err := exportFile(w, path, filter); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exportFile copies the matching lines of one log file to w
+func exportFile(w io.Writer, path string, filter RelayLogFilter) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open relay log: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry RelayLogEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+		if filter.Topic != "" && entry.Topic != filter.Topic {
+			continue
+		}
+		if filter.Peer != "" && entry.From != filter.Peer && entry.To != filter.Peer {
+			continue
+		}
+		if !filter.Since.IsZero() && entry.Time.Before(filter.Since) {
+			continue
+		}
+		if _, err := w.Write(append(scanner.Bytes(), '\n')); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// Close closes the log file
+func (l *RelayLog) Close() error {
+	return l.file.close()
+}
@@ -0,0 +1,268 @@
+package signaling
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultResumeGrace is how long a peer whose connection dropped is held
+// for its client to resume by default: long enough to ride out a network
+// switch, short enough that other peers soon learn a client is really gone
+const DefaultResumeGrace = 15 * time.Second
+
+var (
+	// ErrResumeInvalid means a resume token is malformed, forged, or was
+	// issued for another topic or by another server
+	ErrResumeInvalid = errors.New("invalid resume token")
+	// ErrResumeExpired means the peer a resume token was issued to has left,
+	// because its grace window ran out or it was removed
+	ErrResumeExpired = errors.New("resume token expired")
+)
+
+// resumer holds the peers whose connections dropped for a grace window, so
+// a client that reconnects with the resume token from its welcome gets its
+// peer ID back without other peers seeing it leave and rejoin
+type resumer struct {
+	grace time.Duration
+	key   []byte // signs tokens; random, so tokens only resume on this server
+
+	mu       sync.Mutex
+	detached map[*PeerConn]*time.Timer // expire into a leave
+}
+
+// SetResumeGrace lets peers whose connection drops resume their peer ID by
+// reconnecting within grace. 0 disables resumption. Must be called before
+// the server starts handling connections.
+func (s *Server) SetResumeGrace(grace time.Duration) {
+	if grace <= 0 {
+		s.resume = nil
+		return
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic("crypto/rand failed: " + err.Error())
+	}
+	s.resume = &resumer{grace: grace, key: key, detached: make(map[*PeerConn]*time.Timer)}
+}
+
+// ResumeGrace returns how long a dropped peer can resume, or 0 if
+// resumption is disabled
+func (s *Server) ResumeGrace() time.Duration {
+	if s.resume == nil {
+		return 0
+	}
+	return s.resume.grace
+}
+
+// ResumeToken issues a token pc's client can present to Resume after its
+// connection drops. Each token replaces the ones issued before it. Returns
+// empty if resumption is disabled or pc is an observer.
+func (s *Server) ResumeToken(pc *PeerConn) string {
+	if s.resume == nil || pc.Observer {
+		return ""
+	}
+	nonce := NewChallenge()
+	pc.resumeNonce.Store(&nonce)
+	return s.resume.sign(pc.ID, nonce, pc.TopicID)
+}
+
+// Disconnected is called when pc's connection ends. If resumable, pc was
+// issued a resume token, and resumption is enabled, pc stays in its topic
+// for the grace window, so other peers see no churn if its client resumes,
+// and leaves once the window runs out. Otherwise pc leaves right away.
+// Nothing happens if a resumed connection has already replaced pc.
+func (s *Server) Disconnected(pc *PeerConn, resumable bool) {
+	_, _, kicked := pc.Kicked()
+	if s.drainStarted() {
+		resumable = false
+	}
+	if s.resume == nil || !resumable || kicked || pc.resumeNonce.Load() == nil {
+		s.leave(pc)
+		return
+	}
+
+	val, ok := s.topics.Load(pc.TopicID)
+	if !ok || val.(*Topic).GetPeer(pc.ID) != pc {
+		return
+	}
+	s.disconnected(pc.TopicID, pc.ID)
+	s.resume.detach(pc, func() {
+		s.logger.Info("resume grace expired", "peer", pc.ID, "topic", pc.TopicID)
+		s.leave(pc)
+	})
+	s.logger.Info("peer detached, awaiting resume", "peer", pc.ID, "topic", pc.TopicID, "grace", s.resume.grace)
+}
+
+// Resume reattaches a client to the peer its resume token was issued to,
+// replacing that peer's connection under the same ID without announcing a
+// leave or join. It returns the new connection, records of the other peers,
+// and the sequence number for its peer-list. Messages queued for the old
+// connection, other than membership events the peer-list supersedes, move
+// to the new one, and the old connection, if still open, is closed with
+// CloseSuperseded. Returns ErrResumeInvalid or ErrResumeExpired if the
+// token cannot be used, or the ACL error if the peer may no longer join.
+func (s *Server) Resume(topicID, token string) (*PeerConn, []PeerRecord, uint64, error) {
+	if s.resume == nil {
+		return nil, nil, 0, ErrResumeInvalid
+	}
+	peerID, nonce, tokenTopic, ok := s.resume.verify(token)
+	if !ok || tokenTopic != topicID {
+		return nil, nil, 0, ErrResumeInvalid
+	}
+	val, ok := s.topics.Load(topicID)
+	if !ok {
+		return nil, nil, 0, ErrResumeExpired
+	}
+	topic := val.(*Topic)
+	old := topic.GetPeer(peerID)
+	if old == nil || !old.resumableWith(nonce) {
+		return nil, nil, 0, ErrResumeExpired
+	}
+	if err := s.Authorize(topicID, old.PublicKey, old.Metadata); err != nil {
+		return nil, nil, 0, err
+	}
+
+	pc := s.newPeerConn(old.ID, topicID, old.Metadata)
+	pc.PublicKey = old.PublicKey
+	// Other servers in the cluster know the peer by its join's sequence number
+	pc.JoinSeq = old.JoinSeq
+	records, seq, ok := topic.replacePeer(old, pc)
+	if !ok {
+		return nil, nil, 0, ErrResumeExpired
+	}
+	s.resume.attach(old)
+	old.kick(CloseSuperseded, "resumed by a new connection")
+
+	moved := 0
+drain:
+	for {
+		select {
+		case msg := <-old.Send:
+			if !isMembershipEvent(msg.Type) && pc.TrySend(msg) {
+				moved++
+			}
+		default:
+			break drain
+		}
+	}
+
+	s.logger.Info("peer resumed", "peer", pc.ID, "topic", topicID, "seq", seq, "queued", moved)
+	s.flushHeld(pc)
+	return pc, records, seq, nil
+}
+
+// expireDetached removes a detached peer holding peerID in topic right
+// away, so a client reconnecting without a usable token can take the ID.
+// Returns false if no detached peer holds it.
+func (s *Server) expireDetached(topic *Topic, peerID string) bool {
+	pc := topic.GetPeer(peerID)
+	if pc == nil || s.resume == nil || !s.resume.attach(pc) {
+		return false
+	}
+	s.leave(pc)
+	return true
+}
+
+// expireAllDetached removes every detached peer right away, for draining
+func (s *Server) expireAllDetached() {
+	if s.resume == nil {
+		return
+	}
+	for _, pc := range s.resume.attachAll() {
+		s.leave(pc)
+	}
+}
+
+// detach holds pc until the grace window runs out, then calls expire
+func (r *resumer) detach(pc *PeerConn, expire func()) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.detached[pc] = time.AfterFunc(r.grace, func() {
+		r.mu.Lock()
+		_, held := r.detached[pc]
+		delete(r.detached, pc)
+		r.mu.Unlock()
+		if held {
+			expire()
+		}
+	})
+}
+
+// attach stops holding pc and reports whether it was held
+func (r *resumer) attach(pc *PeerConn) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	timer, held := r.detached[pc]
+	if held {
+		timer.Stop()
+		delete(r.detached, pc)
+	}
+	return held
+}
+
+// attachAll stops holding every peer and returns them
+func (r *resumer) attachAll() []*PeerConn {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var peers []*PeerConn
+	for pc, timer := range r.detached {
+		timer.Stop()
+		peers = append(peers, pc)
+	}
+	clear(r.detached)
+	return peers
+}
+
+// sign returns the token "<payload>.<mac>", both base64url, where payload
+// is "<peer ID>\n<nonce>\n<topic>"
+func (r *resumer) sign(peerID, nonce, topicID string) string {
+	payload := []byte(peerID + "\n" + nonce + "\n" + topicID)
+	return base64.RawURLEncoding.EncodeToString(payload) + "." +
+		base64.RawURLEncoding.EncodeToString(r.mac(payload))
+}
+
+// verify checks a token's signature and returns what it was issued for
+func (r *resumer) verify(token string) (peerID, nonce, topicID string, ok bool) {
+	encPayload, encMAC, found := strings.Cut(token, ".")
+	if !found {
+		return "", "", "", false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encPayload)
+	if err != nil {
+		return "", "", "", false
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(encMAC)
+	if err != nil || !hmac.Equal(mac, r.mac(payload)) {
+		return "", "", "", false
+	}
+	parts := strings.SplitN(string(payload), "\n", 3)
+	if len(parts) != 3 {
+		return "", "", "", false
+	}
+	return parts[0], parts[1], parts[2], true
+}
+
+func (r *resumer) mac(payload []byte) []byte {
+	h := hmac.New(sha256.New, r.key)
+	h.Write(payload)
+	return h.Sum(nil)
+}
+
+// resumableWith reports whether nonce is the one in pc's latest resume token
+func (pc *PeerConn) resumableWith(nonce string) bool {
+	p := pc.resumeNonce.Load()
+	return p != nil && subtle.ConstantTimeCompare([]byte(*p), []byte(nonce)) == 1
+}
+
+// isMembershipEvent reports whether msgType describes topic membership,
+// which a fresh peer-list supersedes
+func isMembershipEvent(msgType string) bool {
+	return msgType == "peer-list" || msgType == "peer-joined" || msgType == "peer-left"
+}
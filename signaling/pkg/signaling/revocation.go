@@ -0,0 +1,107 @@
+package signaling
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// RevocationList holds the identity keys lanscaped has revoked, fetched from
+// its /v1/agents/revoked endpoint. If a refresh fails the previous list stays
+// in effect. A nil list revokes nothing.
+type RevocationList struct {
+	url    string
+	client *http.Client
+	logger *slog.Logger
+
+	mu   sync.RWMutex
+	keys map[string]bool // base64url public key -> revoked
+}
+
+// NewRevocationList creates an empty list that refreshes from url
+func NewRevocationList(url string, logger *slog.Logger) *RevocationList {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return &RevocationList{
+		url:    url,
+		client: &http.Client{Timeout: 10 * time.Second},
+		logger: logger,
+		keys:   make(map[string]bool),
+	}
+}
+
+// Revoked reports whether a base64url identity key has been revoked
+func (l *RevocationList) Revoked(publicKey string) bool {
+	if l == nil || publicKey == "" {
+		return false
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.keys[publicKey]
+}
+
+// Refresh replaces the list with the keys lanscaped currently revokes
+func (l *RevocationList) Refresh(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, l.url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to fetch revoked keys: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to fetch revoked keys: status %d", resp.StatusCode)
+	}
+
+	var body struct {
+		Revoked []string `json:"revoked"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return fmt.Errorf("failed to parse revoked keys: %w", err)
+	}
+
+	keys := make(map[string]bool, len(body.Revoked))
+	for _, key := range body.Revoked {
+		keys[key] = true
+	}
+	l.mu.Lock()
+	l.keys = keys
+	l.mu.Unlock()
+	return nil
+}
+
+// Run refreshes the list now and then every interval until ctx is done
+func (l *RevocationList) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := l.Refresh(ctx); err != nil {
+			l.logger.Warn("failed to refresh revoked identity keys", "error", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// MetadataPublicKey returns the identity key a peer advertised in its join
+// metadata as {"publicKey": "..."}, or empty if it advertised none
+func MetadataPublicKey(metadata json.RawMessage) string {
+	if len(metadata) == 0 {
+		return ""
+	}
+	var m struct {
+		PublicKey string `json:"publicKey"`
+	}
+	json.Unmarshal(metadata, &m)
+	return m.PublicKey
+}
@@ -0,0 +1,104 @@
+package signaling
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// rotatingFile is an append-only file that is rotated, path -> path.1 ->
+// path.2 ..., once it grows past maxSize
+type rotatingFile struct {
+	mu       sync.Mutex
+	name     string // what the file holds, for errors
+	path     string
+	maxSize  int64 // 0 disables rotation
+	maxFiles int   // rotated files kept alongside the active one
+	file     *os.File
+	size     int64
+}
+
+// openRotatingFile opens (or appends to) the file at path
+func openRotatingFile(name, path string, maxSize int64, maxFiles int) (*rotatingFile, error) {
+	f := &rotatingFile{name: name, path: path, maxSize: maxSize, maxFiles: maxFiles}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// write appends line, rotating the file first if it would grow past maxSize
+func (f *rotatingFile) write(line []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return
+	}
+	if f.maxSize > 0 && f.size+int64(len(line)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return
+		}
+	}
+
+	n, _ := f.file.Write(line)
+	f.size += int64(n)
+}
+
+// paths returns the rotated files and the active one, oldest first. Callers
+// reading them should hold mu so rotation cannot shift them.
+func (f *rotatingFile) paths() []string {
+	paths := make([]string, 0, f.maxFiles+1)
+	for i := f.maxFiles; i >= 1; i-- {
+		paths = append(paths, fmt.Sprintf("%s.%d", f.path, i))
+	}
+	return append(paths, f.path)
+}
+
+// open opens the active file for appending
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", f.name, err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to stat %s: %w", f.name, err)
+	}
+
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+// rotate shifts path -> path.1 -> path.2 ... and reopens. Caller must hold mu.
+func (f *rotatingFile) rotate() error {
+	f.file.Close()
+	f.file = nil
+
+	if f.maxFiles > 0 {
+		os.Remove(fmt.Sprintf("%s.%d", f.path, f.maxFiles))
+		for i := f.maxFiles - 1; i >= 1; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1))
+		}
+		os.Rename(f.path, f.path+".1")
+	} else {
+		os.Remove(f.path)
+	}
+
+	return f.open()
+}
+
+// close closes the file
+func (f *rotatingFile) close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
@@ -1,10 +1,15 @@
 package signaling
 
 import (
+	"crypto/ed25519"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"log/slog"
 	"sync"
 	"time"
+
+	"github.com/oklog/ulid/v2"
 )
 
 // RelayResult indicates the outcome of a relay attempt
@@ -16,12 +21,70 @@ const (
 	RelayTargetNotFound
 	RelayTopicNotFound
 	RelayInvalidType
+	RelayForbidden
+	RelayRateLimited
+	// RelayHeld means the target just disconnected and the relay is held
+	// for it in case it reconnects (see SetRelayHold)
+	RelayHeld
+	// RelayNotAllowed means the topic's policy does not permit app-relays
+	RelayNotAllowed
+	// RelayTooLarge means an app-relay payload exceeded the size limit
+	RelayTooLarge
 )
 
+// String returns the result as recorded in the relay log
+func (r RelayResult) String() string {
+	switch r {
+	case RelayDelivered:
+		return "delivered"
+	case RelayDropped:
+		return "dropped"
+	case RelayTargetNotFound:
+		return "target_not_found"
+	case RelayTopicNotFound:
+		return "topic_not_found"
+	case RelayInvalidType:
+		return "invalid_type"
+	case RelayForbidden:
+		return "forbidden"
+	case RelayRateLimited:
+		return "rate_limited"
+	case RelayHeld:
+		return "held"
+	case RelayNotAllowed:
+		return "not_allowed"
+	case RelayTooLarge:
+		return "too_large"
+	default:
+		return "unknown"
+	}
+}
+
 // Server manages topics and peer routing for WebRTC signaling
 type Server struct {
-	topics sync.Map // map[string]*Topic
-	logger *slog.Logger
+	topics      sync.Map // map[string]*Topic
+	relayLog    *RelayLog
+	audit       *AuditLog
+	relayStats  relayStats
+	revocations *RevocationList
+	acls        *ACLTable
+	presence    *PresenceReporter
+	webhooks    *Webhooks
+	cluster     *Cluster
+	limiter     *RateLimiter
+	turn        *TURNCredentials
+	faults      *Faults
+	resume      *resumer
+	hold        *relayHold
+	appRelay    appRelay
+	// sendQueueSize is how many messages each peer may have queued; 0 is
+	// DefaultSendQueueSize
+	sendQueueSize int
+	logger        *slog.Logger
+
+	drain     *drain
+	draining  chan struct{}
+	drainOnce sync.Once
 }
 
 // NewServer creates a new signaling server
@@ -29,40 +92,181 @@ func NewServer(logger *slog.Logger) *Server {
 	if logger == nil {
 		logger = slog.Default()
 	}
-	return &Server{logger: logger}
+	return &Server{
+		logger:   logger,
+		drain:    &drain{},
+		draining: make(chan struct{}),
+		appRelay: appRelay{
+			maxSize: DefaultAppRelayMaxSize,
+			limiter: NewRateLimiter(DefaultAppRelayPeerRate, DefaultAppRelayIPRate),
+		},
+	}
+}
+
+// SetRelayLog records every relay attempt to log. Must be called before the
+// server starts handling connections.
+func (s *Server) SetRelayLog(log *RelayLog) {
+	s.relayLog = log
+}
+
+// SetRevocations rejects joins by identity keys on list. Must be called
+// before the server starts handling connections.
+func (s *Server) SetRevocations(list *RevocationList) {
+	s.revocations = list
+}
+
+// Revoked reports whether lanscaped has revoked an identity key
+func (s *Server) Revoked(publicKey string) bool {
+	return s.revocations.Revoked(publicKey)
+}
+
+// SetACLs restricts joins to the topics in table to the peers its ACLs admit
+func (s *Server) SetACLs(table *ACLTable) {
+	s.acls = table
+}
+
+// ACLs returns the topic ACL table, or nil if joins are unrestricted
+func (s *Server) ACLs() *ACLTable {
+	return s.acls
+}
+
+// Authorize checks a joining peer against its topic's ACL. publicKey is the
+// identity key the peer proved, empty if it proved none.
+func (s *Server) Authorize(topicID, publicKey string, metadata json.RawMessage) error {
+	return s.acls.Authorize(topicID, publicKey, metadata)
+}
+
+// SetPresence reports participants' proven identity keys joining and
+// leaving topics to reporter. Must be called before the server starts
+// handling connections.
+func (s *Server) SetPresence(reporter *PresenceReporter) {
+	s.presence = reporter
+}
+
+// SetRateLimiter limits the relays peers send with limiter. Must be called
+// before the server starts handling connections.
+func (s *Server) SetRateLimiter(limiter *RateLimiter) {
+	s.limiter = limiter
+}
+
+// SetSendQueueSize queues up to size outbound messages per peer instead of
+// DefaultSendQueueSize, letting bursts of ICE candidates through to peers
+// on slow links at the cost of memory per peer. Must be called before the
+// server starts handling connections.
+func (s *Server) SetSendQueueSize(size int) {
+	s.sendQueueSize = size
+}
+
+// SendQueueSize returns how many outbound messages each peer may have queued
+func (s *Server) SendQueueSize() int {
+	if s.sendQueueSize <= 0 {
+		return DefaultSendQueueSize
+	}
+	return s.sendQueueSize
+}
+
+// newPeerConn creates a peer connection with the server's send queue size
+func (s *Server) newPeerConn(id, topicID string, metadata json.RawMessage) *PeerConn {
+	return newPeerConn(id, topicID, metadata, s.SendQueueSize())
+}
+
+// SetTURN hands out credentials for TURN servers minted by turn in every
+// welcome. Must be called before the server starts handling connections.
+func (s *Server) SetTURN(turn *TURNCredentials) {
+	s.turn = turn
+}
+
+// SetFaults injects the failures described by faults, for resilience
+// testing. Must be called before the server starts handling connections.
+func (s *Server) SetFaults(faults *Faults) {
+	s.faults = faults
+}
+
+// TURN returns the TURN credential minter, or nil if none is configured
+func (s *Server) TURN() *TURNCredentials {
+	return s.turn
 }
 
 // Join adds a peer to a topic, creating the topic if it doesn't exist.
 // Returns the new peer connection and records of existing peers.
 // Broadcasts peer-joined to existing peers (best-effort).
 func (s *Server) Join(topicID string, metadata json.RawMessage) (*PeerConn, []PeerRecord) {
-	pc := NewPeerConn(topicID, metadata)
+	// ULIDs never collide, so joining cannot fail
+	pc, records, _ := s.JoinWithID(ulid.Make().String(), topicID, metadata)
+	return pc, records
+}
 
-	// Get or create topic
-	val, _ := s.topics.LoadOrStore(topicID, NewTopic(topicID))
-	topic := val.(*Topic)
+// JoinWithID adds a peer with a given ID to a topic, like Join. It returns
+// ErrPeerIDTaken if the ID is already in the topic.
+func (s *Server) JoinWithID(peerID, topicID string, metadata json.RawMessage) (*PeerConn, []PeerRecord, error) {
+	return s.join(s.newPeerConn(peerID, topicID, metadata))
+}
 
-	// Add peer, get existing peers (both pointers and records)
-	existingPtrs, existingRecords := topic.AddPeer(pc)
+// JoinWithKey adds a peer that proved an identity key, with the peer ID
+// derived from it, like JoinWithID
+func (s *Server) JoinWithKey(publicKey, peerID, topicID string, metadata json.RawMessage) (*PeerConn, []PeerRecord, error) {
+	pc := s.newPeerConn(peerID, topicID, metadata)
+	pc.PublicKey = publicKey
+	return s.join(pc)
+}
 
-	// Broadcast peer-joined to existing peers (best-effort, no re-fetch needed)
-	msg := OutboundMessage{
-		Type:     "peer-joined",
-		PeerID:   pc.ID,
-		Metadata: metadata,
-	}
-	for _, peer := range existingPtrs {
-		if !peer.TrySend(msg) {
-			s.logger.Debug("dropped peer-joined notification", "to", peer.ID, "from", pc.ID)
+// Observe adds a read-only observer to a topic. Observers receive the peer
+// list and peer-joined/peer-left events but are invisible to other peers and
+// can neither relay nor be relayed to.
+func (s *Server) Observe(topicID string) (*PeerConn, []PeerRecord) {
+	pc := s.newPeerConn(ulid.Make().String(), topicID, nil)
+	pc.Observer = true
+	// ULIDs never collide, so joining cannot fail
+	_, records, _ := s.join(pc)
+	return pc, records
+}
+
+// join adds a peer to its topic and announces it unless it is an observer
+func (s *Server) join(pc *PeerConn) (*PeerConn, []PeerRecord, error) {
+	topicID := pc.TopicID
+
+	for {
+		// Get or create topic
+		val, loaded := s.topics.LoadOrStore(topicID, NewTopic(topicID))
+		topic := val.(*Topic)
+
+		existingRecords, dropped, err := topic.AddPeer(pc)
+		if errors.Is(err, errTopicClosed) {
+			// The last peer left while this one was joining; start a new topic
+			s.topics.CompareAndDelete(topicID, topic)
+			continue
+		}
+		if errors.Is(err, ErrPeerIDTaken) && s.expireDetached(topic, pc.ID) {
+			// The ID's client reconnected without resuming; it leaves and rejoins
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if !loaded {
+			s.webhooks.topicCreated(topicID)
 		}
-	}
 
-	s.logger.Info("peer joined topic",
-		"peer", pc.ID,
-		"topic", topicID,
-		"existingPeers", len(existingRecords),
-	)
-	return pc, existingRecords
+		if pc.Observer {
+			s.logger.Info("observer joined topic", "peer", pc.ID, "topic", topicID, "seq", pc.JoinSeq)
+			return pc, existingRecords, nil
+		}
+		for _, peerID := range dropped {
+			s.logger.Debug("dropped peer-joined notification", "to", peerID, "from", pc.ID)
+		}
+		s.presence.Online(topicID, pc.PublicKey)
+		s.webhooks.peerJoined(pc)
+		s.cluster.joined(pc)
+
+		s.logger.Info("peer joined topic",
+			"peer", pc.ID,
+			"topic", topicID,
+			"seq", pc.JoinSeq,
+			"existingPeers", len(existingRecords),
+		)
+		s.flushHeld(pc)
+		return pc, existingRecords, nil
+	}
 }
 
 // Leave removes a peer from a topic and cleans up empty topics.
@@ -74,36 +278,152 @@ func (s *Server) Leave(peerID, topicID string) {
 	}
 	topic := val.(*Topic)
 
-	removed, remaining := topic.RemovePeer(peerID)
+	removed, dropped, empty := topic.RemovePeer(peerID)
 	if removed == nil {
 		return
 	}
+	s.left(topic, removed, dropped, empty)
+}
+
+// leave removes pc from its topic like Leave, unless a resumed connection
+// has replaced it
+func (s *Server) leave(pc *PeerConn) {
+	val, ok := s.topics.Load(pc.TopicID)
+	if !ok {
+		return
+	}
+	topic := val.(*Topic)
+
+	removed, dropped, empty := topic.removePeerConn(pc)
+	if !removed {
+		return
+	}
+	s.left(topic, pc, dropped, empty)
+}
+
+// left cancels a peer removed from topic, deletes the topic if it is empty,
+// and reports the leave
+func (s *Server) left(topic *Topic, removed *PeerConn, dropped []string, empty bool) {
 	removed.Cancel()
+	s.auditLeave(removed)
 
-	// Cleanup empty topic (race with concurrent Join is acceptable)
-	if topic.IsEmpty() {
-		s.topics.Delete(topicID)
-		s.logger.Debug("deleted empty topic", "topic", topicID)
+	// An empty topic is closed, so a concurrent join creates a new one
+	if empty {
+		s.topics.CompareAndDelete(topic.ID, topic)
+		s.logger.Debug("deleted empty topic", "topic", topic.ID)
 	}
 
-	// Broadcast peer-left to remaining peers (best-effort)
-	msg := OutboundMessage{
-		Type:   "peer-left",
-		PeerID: peerID,
+	if removed.Observer {
+		s.logger.Info("observer left topic", "peer", removed.ID, "topic", topic.ID)
+		if empty {
+			s.webhooks.topicEmpty(topic.ID)
+		}
+		return
+	}
+	for _, to := range dropped {
+		s.logger.Debug("dropped peer-left notification", "to", to, "from", removed.ID)
+	}
+	s.presence.Offline(topic.ID, removed.PublicKey)
+	s.webhooks.peerLeft(removed)
+	if empty {
+		s.webhooks.topicEmpty(topic.ID)
 	}
-	for _, peer := range remaining {
-		if !peer.TrySend(msg) {
-			s.logger.Debug("dropped peer-left notification", "to", peer.ID, "from", peerID)
+	s.cluster.left(removed)
+	// A kicked peer may not come back, so nothing is held for it
+	if _, _, kicked := removed.Kicked(); !kicked {
+		s.disconnected(topic.ID, removed.ID)
+	}
+
+	s.logger.Info("peer left topic", "peer", removed.ID, "topic", topic.ID)
+}
+
+// Kick removes peers from a topic and has their connections closed with
+// CloseMembershipRevoked. It removes the peers whose proven or advertised
+// identity key is in publicKeys (base64url), or every peer if all is set, and
+// returns the IDs of the peers removed. With a cluster, the other servers
+// kick their peers too, and the IDs returned are only this server's.
+func (s *Server) Kick(topicID string, publicKeys []string, all bool, detail string) []string {
+	s.cluster.kick(topicID, publicKeys, all, detail)
+	return s.kick(topicID, publicKeys, all, detail)
+}
+
+// kick removes the local peers matching publicKeys or all
+func (s *Server) kick(topicID string, publicKeys []string, all bool, detail string) []string {
+	val, ok := s.topics.Load(topicID)
+	if !ok {
+		return nil
+	}
+	topic := val.(*Topic)
+
+	keys := make(map[string]bool, len(publicKeys))
+	ids := make(map[string]bool, len(publicKeys))
+	for _, key := range publicKeys {
+		keys[key] = true
+		if raw, err := base64.RawURLEncoding.DecodeString(key); err == nil && len(raw) == ed25519.PublicKeySize {
+			ids[DerivePeerID(raw)] = true
 		}
 	}
 
-	s.logger.Info("peer left topic", "peer", peerID, "topic", topicID)
+	var matched []string
+	topic.peers.Range(func(key, value any) bool {
+		pc := value.(*PeerConn)
+		if all || ids[pc.ID] || keys[MetadataPublicKey(pc.Metadata)] {
+			matched = append(matched, pc.ID)
+		}
+		return true
+	})
+
+	var kicked []string
+	for _, peerID := range matched {
+		if !s.evict(topic, peerID, CloseMembershipRevoked, detail) {
+			continue
+		}
+		kicked = append(kicked, peerID)
+		s.logger.Info("kicked peer from topic", "peer", peerID, "topic", topicID, "detail", detail)
+	}
+	return kicked
+}
+
+// Resync queues a fresh peer-list for a peer, so a client that saw a gap in
+// membership sequence numbers can reconcile its view of the topic. Returns
+// false if the peer is not in the topic or its queue is full.
+func (s *Server) Resync(topicID, peerID string) bool {
+	val, ok := s.topics.Load(topicID)
+	if !ok {
+		return false
+	}
+	topic := val.(*Topic)
+	pc := topic.GetPeer(peerID)
+	if pc == nil {
+		return false
+	}
+	return topic.Resync(pc)
 }
 
-// Relay routes an offer/answer/ice-candidate message to a target peer.
+// Relay routes an offer/answer/ice-candidate or app-relay message to a
+// target peer.
 // The `from` field is set by the server (never trust client-supplied from).
 // Returns a RelayResult indicating the outcome.
 func (s *Server) Relay(topicID, fromPeerID, toPeerID, msgType string, payload json.RawMessage, msgID string) RelayResult {
+	result := s.relay(topicID, fromPeerID, toPeerID, msgType, payload, msgID)
+	s.relayStats.record(topicID, result, time.Now())
+	s.auditRelay(topicID, fromPeerID, toPeerID, msgType, len(payload), result)
+	if s.relayLog != nil {
+		s.relayLog.Record(RelayLogEntry{
+			Time:   time.Now().UTC(),
+			Topic:  topicID,
+			From:   fromPeerID,
+			To:     toPeerID,
+			Type:   msgType,
+			Size:   len(payload),
+			Result: result.String(),
+		})
+	}
+	return result
+}
+
+// relay performs a relay attempt without logging it
+func (s *Server) relay(topicID, fromPeerID, toPeerID, msgType string, payload json.RawMessage, msgID string) RelayResult {
 	if !IsRelayType(msgType) {
 		return RelayInvalidType
 	}
@@ -114,8 +434,32 @@ func (s *Server) Relay(topicID, fromPeerID, toPeerID, msgType string, payload js
 	}
 	topic := val.(*Topic)
 
+	// Observers can neither send nor receive relays
+	from := topic.GetPeer(fromPeerID)
+	if from != nil && from.Observer {
+		return RelayForbidden
+	}
+	if msgType == AppRelayType {
+		if result := s.checkAppRelay(topicID, from, len(payload), time.Now()); result != RelayDelivered {
+			return result
+		}
+	}
+	if from != nil && !s.limiter.Allow(from.ID, from.RemoteAddr(), time.Now()) {
+		s.logger.Debug("relay rate limited",
+			"from", fromPeerID,
+			"to", toPeerID,
+			"type", msgType,
+			"remote", from.RemoteAddr(),
+		)
+		return RelayRateLimited
+	}
 	target := topic.GetPeer(toPeerID)
-	if target == nil {
+	if target == nil && s.cluster != nil {
+		if _, ok := topic.getRemote(toPeerID); ok {
+			return s.relayRemote(topicID, fromPeerID, toPeerID, msgType, payload, msgID)
+		}
+	}
+	if target != nil && target.Observer {
 		return RelayTargetNotFound
 	}
 
@@ -125,9 +469,29 @@ func (s *Server) Relay(topicID, fromPeerID, toPeerID, msgType string, payload js
 		Payload: payload,
 		MsgID:   msgID,
 	}
+	// A target that just disconnected may be back in a moment
+	if target == nil {
+		if s.holdRelay(topicID, toPeerID, msg) {
+			s.logger.Debug("relay held for disconnected peer", "from", fromPeerID, "to", toPeerID, "type", msgType)
+			return RelayHeld
+		}
+		return RelayTargetNotFound
+	}
+	if s.faults.dropRelay() {
+		s.logger.Debug("relay dropped by fault injection",
+			"from", fromPeerID,
+			"to", toPeerID,
+			"type", msgType,
+		)
+		return RelayDropped
+	}
 
 	// Send with timeout, not holding any lock
-	if err := target.SendWithTimeout(msg, 100*time.Millisecond); err != nil {
+	if err := target.SendWithTimeout(msg, RelayTimeout); err != nil {
+		if s.holdRelay(topicID, toPeerID, msg) {
+			s.logger.Debug("relay held for detached peer", "from", fromPeerID, "to", toPeerID, "type", msgType)
+			return RelayHeld
+		}
 		s.logger.Debug("relay dropped",
 			"from", fromPeerID,
 			"to", toPeerID,
@@ -144,3 +508,24 @@ func (s *Server) Relay(topicID, fromPeerID, toPeerID, msgType string, payload js
 	)
 	return RelayDelivered
 }
+
+// relayRemote forwards a relay to a peer connected to another server in the
+// cluster. It counts as delivered once queued for publishing, like a local
+// relay once queued for the target.
+func (s *Server) relayRemote(topicID, fromPeerID, toPeerID, msgType string, payload json.RawMessage, msgID string) RelayResult {
+	if !s.cluster.relay(topicID, fromPeerID, toPeerID, msgType, payload, msgID) {
+		s.logger.Debug("relay dropped",
+			"from", fromPeerID,
+			"to", toPeerID,
+			"type", msgType,
+			"error", "cluster queue full",
+		)
+		return RelayDropped
+	}
+	s.logger.Debug("relay forwarded",
+		"from", fromPeerID,
+		"to", toPeerID,
+		"type", msgType,
+	)
+	return RelayDelivered
+}
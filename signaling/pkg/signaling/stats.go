@@ -0,0 +1,152 @@
+package signaling
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// MaxStatsWindow is the longest window relay results are counted over
+const MaxStatsWindow = time.Hour
+
+// statsBucketWidth is the resolution of the stats window
+const statsBucketWidth = time.Minute
+
+// RelayCounts counts relay attempts by result, keyed by RelayResult.String
+type RelayCounts map[string]int64
+
+// Stats is a snapshot of the server's topics and recent relays
+type Stats struct {
+	// WindowSeconds is the window the relay counts cover
+	WindowSeconds int64        `json:"windowSeconds"`
+	Topics        []TopicStats `json:"topics"`
+}
+
+// TopicStats describes one topic. Topics whose peers have all left appear
+// while relays in them are still within the window.
+type TopicStats struct {
+	Topic string `json:"topic"`
+	// Peers counts participants; Observers are counted separately
+	Peers     int `json:"peers"`
+	Observers int `json:"observers"`
+	// RemotePeers counts participants connected to other servers in the
+	// cluster, which are not in Peers or PublicKeys
+	RemotePeers int `json:"remotePeers"`
+	// PublicKeys are the identity keys of peers that proved one
+	PublicKeys []string    `json:"publicKeys"`
+	Relays     RelayCounts `json:"relays"`
+}
+
+// relayStats counts relay results per topic in one-minute buckets covering
+// MaxStatsWindow
+type relayStats struct {
+	mu      sync.Mutex
+	buckets [int(MaxStatsWindow / statsBucketWidth)]relayBucket
+}
+
+type relayBucket struct {
+	start  time.Time
+	counts map[string]RelayCounts // by topic
+}
+
+// record counts one relay attempt
+func (r *relayStats) record(topic string, result RelayResult, now time.Time) {
+	start := now.Truncate(statsBucketWidth)
+	i := int(start.Unix()/int64(statsBucketWidth/time.Second)) % len(r.buckets)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	b := &r.buckets[i]
+	if !b.start.Equal(start) {
+		// The bucket last held a minute that has left the window
+		*b = relayBucket{start: start, counts: make(map[string]RelayCounts)}
+	}
+	counts := b.counts[topic]
+	if counts == nil {
+		counts = make(RelayCounts)
+		b.counts[topic] = counts
+	}
+	counts[result.String()]++
+}
+
+// snapshot sums the buckets within window of now, by topic
+func (r *relayStats) snapshot(window time.Duration, now time.Time) map[string]RelayCounts {
+	since := now.Truncate(statsBucketWidth).Add(-window + statsBucketWidth)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	totals := make(map[string]RelayCounts)
+	for _, b := range r.buckets {
+		if b.start.Before(since) || b.start.After(now) {
+			continue
+		}
+		for topic, counts := range b.counts {
+			sum := totals[topic]
+			if sum == nil {
+				sum = make(RelayCounts)
+				totals[topic] = sum
+			}
+			for result, n := range counts {
+				sum[result] += n
+			}
+		}
+	}
+	return totals
+}
+
+// Stats returns the topics with connected peers and the relays within
+// window, which is clamped to MaxStatsWindow and rounded to whole minutes
+func (s *Server) Stats(window time.Duration) Stats {
+	window = min(max(window.Round(statsBucketWidth), statsBucketWidth), MaxStatsWindow)
+	relays := s.relayStats.snapshot(window, time.Now())
+
+	byTopic := make(map[string]*TopicStats)
+	s.topics.Range(func(key, value any) bool {
+		topic := value.(*Topic)
+		ts := &TopicStats{Topic: topic.ID, PublicKeys: []string{}}
+		topic.peers.Range(func(key, value any) bool {
+			pc := value.(*PeerConn)
+			if pc.Observer {
+				ts.Observers++
+				return true
+			}
+			ts.Peers++
+			if pc.PublicKey != "" {
+				ts.PublicKeys = append(ts.PublicKeys, pc.PublicKey)
+			}
+			return true
+		})
+		topic.remote.Range(func(key, value any) bool {
+			ts.RemotePeers++
+			return true
+		})
+		if ts.Peers > 0 || ts.Observers > 0 || ts.RemotePeers > 0 {
+			sort.Strings(ts.PublicKeys)
+			byTopic[topic.ID] = ts
+		}
+		return true
+	})
+	for topic, counts := range relays {
+		ts := byTopic[topic]
+		if ts == nil {
+			ts = &TopicStats{Topic: topic, PublicKeys: []string{}}
+			byTopic[topic] = ts
+		}
+		ts.Relays = counts
+	}
+
+	stats := Stats{
+		WindowSeconds: int64(window / time.Second),
+		Topics:        make([]TopicStats, 0, len(byTopic)),
+	}
+	for _, ts := range byTopic {
+		if ts.Relays == nil {
+			ts.Relays = RelayCounts{}
+		}
+		stats.Topics = append(stats.Topics, *ts)
+	}
+	sort.Slice(stats.Topics, func(i, j int) bool { return stats.Topics[i].Topic < stats.Topics[j].Topic })
+	return stats
+}
@@ -1,46 +1,290 @@
 package signaling
 
-import "sync"
+import (
+	"errors"
+	"sync"
+	"time"
+)
 
-// Topic represents a signaling room that peers can join
+// errTopicClosed is returned by AddPeer once the topic's last peer has left;
+// the joining peer must join a fresh topic instead
+var errTopicClosed = errors.New("topic closed")
+
+// Topic represents a signaling room that peers can join.
+//
+// Every join or leave of a participant gets the next topic sequence number,
+// starting at 1. The change, the snapshot of other peers, and the
+// announcement to them happen under one lock, so each peer's peer-list
+// reflects exactly the changes up to its own join's sequence number and it
+// receives peer-joined/peer-left for every later change, in order. A gap in
+// the numbers means an announcement was dropped on a full queue.
+//
+// With a Cluster, a topic also holds the remote peers connected to other
+// signaling servers in the cluster. Their joins and leaves are sequenced and
+// announced to local peers like local ones, in the order this server learns
+// of them.
 type Topic struct {
-	ID    string
-	peers sync.Map // map[string]*PeerConn
+	ID string
+	// CreatedAt is when the first peer joined
+	CreatedAt time.Time
+
+	peers  sync.Map // map[string]*PeerConn, read without mu by relays
+	remote sync.Map // map[string]remotePeer, read without mu by relays
+
+	mu     sync.Mutex // serializes membership changes
+	seq    uint64     // sequence number of the last membership change
+	closed bool       // set when the last peer leaves
+}
+
+// remotePeer is a participant connected to another server in the cluster
+type remotePeer struct {
+	record   PeerRecord
+	instance string // ID of the server it is connected to
+	joinSeq  uint64 // its JoinSeq there, which tells its connections apart
 }
 
 // NewTopic creates a new topic with the given ID
 func NewTopic(id string) *Topic {
-	return &Topic{ID: id}
+	return &Topic{ID: id, CreatedAt: time.Now().UTC()}
 }
 
-// AddPeer adds a peer to the topic and returns existing peers.
-// Returns both pointers (for broadcasting) and records (for peer-list response).
-// Snapshot is taken BEFORE adding the new peer.
-func (t *Topic) AddPeer(pc *PeerConn) (ptrs []*PeerConn, records []PeerRecord) {
-	// Snapshot existing peers before adding the new one
+// AddPeer adds a peer to the topic, records its join sequence number in
+// pc.JoinSeq, and announces it to existing peers with peer-joined unless it
+// is an observer. It returns records of the existing peers for the new
+// peer's peer-list, excluding observers, which are invisible to other peers,
+// and the IDs of peers whose queue was too full for the announcement.
+// Returns ErrPeerIDTaken if a peer with the same ID is already in the topic.
+func (t *Topic) AddPeer(pc *PeerConn) (records []PeerRecord, dropped []string, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return nil, nil, errTopicClosed
+	}
+	if _, remote := t.remote.Load(pc.ID); remote {
+		return nil, nil, ErrPeerIDTaken
+	}
+	if _, loaded := t.peers.LoadOrStore(pc.ID, pc); loaded {
+		return nil, nil, ErrPeerIDTaken
+	}
+	// Observers are invisible, so their joins and leaves are not sequenced
+	if !pc.Observer {
+		t.seq++
+	}
+	pc.JoinSeq = t.seq
+
+	msg := OutboundMessage{Type: "peer-joined", PeerID: pc.ID, Metadata: pc.Metadata, Seq: t.seq}
 	t.peers.Range(func(key, value any) bool {
 		p := value.(*PeerConn)
-		ptrs = append(ptrs, p)
-		records = append(records, p.ToRecord())
+		if p == pc {
+			return true
+		}
+		if !p.Observer {
+			records = append(records, p.ToRecord())
+		}
+		if !pc.Observer && !p.TrySend(msg) {
+			dropped = append(dropped, p.ID)
+		}
 		return true
 	})
-	t.peers.Store(pc.ID, pc)
-	return ptrs, records
+	records = append(records, t.remoteRecords()...)
+	return records, dropped, nil
 }
 
-// RemovePeer removes a peer from the topic.
-// Returns the removed peer and remaining peers (for broadcasting peer-left).
-func (t *Topic) RemovePeer(peerID string) (removed *PeerConn, remaining []*PeerConn) {
+// RemovePeer removes a peer from the topic and announces it to the remaining
+// peers with peer-left unless it is an observer. It returns the removed peer,
+// or nil if it was not in the topic, and the IDs of peers whose queue was too
+// full for the announcement. empty is true if the topic has no peers left; it
+// is then closed to new peers.
+func (t *Topic) RemovePeer(peerID string) (removed *PeerConn, dropped []string, empty bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
 	val, loaded := t.peers.LoadAndDelete(peerID)
 	if !loaded {
-		return nil, nil
+		return nil, nil, false
 	}
 	removed = val.(*PeerConn)
+	dropped, empty = t.announceLeave(removed)
+	return removed, dropped, empty
+}
+
+// removePeerConn removes pc from the topic like RemovePeer, but only if it
+// is still the connection holding its ID, so a connection replaced by a
+// resumed one cannot remove its replacement
+func (t *Topic) removePeerConn(pc *PeerConn) (removed bool, dropped []string, empty bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.peers.CompareAndDelete(pc.ID, pc) {
+		return false, nil, false
+	}
+	dropped, empty = t.announceLeave(pc)
+	return true, dropped, empty
+}
+
+// replacePeer swaps old for pc under the same ID without announcing
+// anything, so other peers see no leave or join. It returns records of the
+// other peers and the current sequence number for pc's peer-list, and ok
+// false if old no longer holds its ID.
+func (t *Topic) replacePeer(old, pc *PeerConn) (records []PeerRecord, seq uint64, ok bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.peers.CompareAndSwap(old.ID, old, pc) {
+		return nil, 0, false
+	}
+	t.peers.Range(func(key, value any) bool {
+		if p := value.(*PeerConn); p != pc && !p.Observer {
+			records = append(records, p.ToRecord())
+		}
+		return true
+	})
+	records = append(records, t.remoteRecords()...)
+	return records, t.seq, true
+}
+
+// announceLeave sequences the removal of a peer already deleted from peers
+// and announces it to the remaining peers. Must be called with mu held.
+func (t *Topic) announceLeave(removed *PeerConn) (dropped []string, empty bool) {
+	peerID := removed.ID
+	if !removed.Observer {
+		t.seq++
+	}
+
+	msg := OutboundMessage{Type: "peer-left", PeerID: peerID, Seq: t.seq}
+	empty = true
+	t.peers.Range(func(key, value any) bool {
+		empty = false
+		p := value.(*PeerConn)
+		if !removed.Observer && !p.TrySend(msg) {
+			dropped = append(dropped, p.ID)
+		}
+		return true
+	})
+	empty = empty && !t.hasRemote()
+	t.closed = empty
+	return dropped, empty
+}
+
+// AddRemote adds a peer connected to another server in the cluster and
+// announces it to the local peers with peer-joined. It returns the IDs of
+// peers whose queue was too full for the announcement, and ErrPeerIDTaken
+// if a peer with the same ID is already in the topic.
+func (t *Topic) AddRemote(instance string, record PeerRecord, joinSeq uint64) (dropped []string, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return nil, errTopicClosed
+	}
+	if _, local := t.peers.Load(record.ID); local {
+		return nil, ErrPeerIDTaken
+	}
+	if _, loaded := t.remote.LoadOrStore(record.ID, remotePeer{record: record, instance: instance, joinSeq: joinSeq}); loaded {
+		return nil, ErrPeerIDTaken
+	}
+	t.seq++
+
+	msg := OutboundMessage{Type: "peer-joined", PeerID: record.ID, Metadata: record.Metadata, Seq: t.seq}
+	t.peers.Range(func(key, value any) bool {
+		p := value.(*PeerConn)
+		if !p.TrySend(msg) {
+			dropped = append(dropped, p.ID)
+		}
+		return true
+	})
+	return dropped, nil
+}
+
+// RemoveRemote removes a peer connected to another server in the cluster
+// and announces it to the local peers with peer-left, like RemovePeer.
+// Only the connection of instance with joinSeq is removed, so a stale leave
+// cannot remove a peer that has since reconnected.
+func (t *Topic) RemoveRemote(instance, peerID string, joinSeq uint64) (removed bool, dropped []string, empty bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	val, ok := t.remote.Load(peerID)
+	if !ok || val.(remotePeer).instance != instance || val.(remotePeer).joinSeq != joinSeq {
+		return false, nil, false
+	}
+	t.remote.Delete(peerID)
+	t.seq++
+
+	msg := OutboundMessage{Type: "peer-left", PeerID: peerID, Seq: t.seq}
+	empty = true
+	t.peers.Range(func(key, value any) bool {
+		empty = false
+		p := value.(*PeerConn)
+		if !p.TrySend(msg) {
+			dropped = append(dropped, p.ID)
+		}
+		return true
+	})
+	empty = empty && !t.hasRemote()
+	t.closed = empty
+	return true, dropped, empty
+}
+
+// remotePeers returns the remote peers connected to instance
+func (t *Topic) remotePeers(instance string) []remotePeer {
+	var peers []remotePeer
+	t.remote.Range(func(key, value any) bool {
+		if rp := value.(remotePeer); rp.instance == instance {
+			peers = append(peers, rp)
+		}
+		return true
+	})
+	return peers
+}
+
+// getRemote returns a remote peer by ID
+func (t *Topic) getRemote(peerID string) (remotePeer, bool) {
+	val, ok := t.remote.Load(peerID)
+	if !ok {
+		return remotePeer{}, false
+	}
+	return val.(remotePeer), true
+}
+
+// remoteRecords returns records of the remote peers
+func (t *Topic) remoteRecords() []PeerRecord {
+	var records []PeerRecord
+	t.remote.Range(func(key, value any) bool {
+		records = append(records, value.(remotePeer).record)
+		return true
+	})
+	return records
+}
+
+// hasRemote reports whether the topic has any remote peers
+func (t *Topic) hasRemote() bool {
+	found := false
+	t.remote.Range(func(key, value any) bool {
+		found = true
+		return false
+	})
+	return found
+}
+
+// Resync queues a fresh peer-list for pc with the current sequence number.
+// It is queued under the topic lock, so the announcements that follow it
+// carry later sequence numbers. Returns false if pc's queue is full.
+func (t *Topic) Resync(pc *PeerConn) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var records []PeerRecord
 	t.peers.Range(func(key, value any) bool {
-		remaining = append(remaining, value.(*PeerConn))
+		p := value.(*PeerConn)
+		if p != pc && !p.Observer {
+			records = append(records, p.ToRecord())
+		}
 		return true
 	})
-	return removed, remaining
+	records = append(records, t.remoteRecords()...)
+	return pc.TrySend(OutboundMessage{Type: "peer-list", Peers: records, Seq: t.seq})
 }
 
 // GetPeer returns a peer by ID, or nil if not found.
@@ -53,7 +297,7 @@ func (t *Topic) GetPeer(peerID string) *PeerConn {
 	return val.(*PeerConn)
 }
 
-// IsEmpty returns true if the topic has no peers
+// IsEmpty returns true if the topic has no local peers
 func (t *Topic) IsEmpty() bool {
 	empty := true
 	t.peers.Range(func(key, value any) bool {
@@ -0,0 +1,238 @@
+package signaling
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"runtime"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+const churnTopic = "churn"
+
+func newTestServer(queueSize int) *Server {
+	s := NewServer(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	s.SetSendQueueSize(queueSize)
+	s.SetResumeGrace(time.Minute)
+	return s
+}
+
+// churnedPeer is what one short-lived peer saw of the topic
+type churnedPeer struct {
+	id      string
+	joinSeq uint64
+	joined  []PeerRecord
+	// resumed peers replaced their connection after joining; resumeSeq and
+	// resumed are the sequence number and peer-list the new one got
+	resumeSeq uint64
+	resumed   []PeerRecord
+	// events are the membership events queued for the peer's last
+	// connection before it left
+	events []OutboundMessage
+}
+
+// churn runs workers goroutines that each join, sometimes resume, and leave
+// the topic rounds times, returning what every peer saw
+func churn(t *testing.T, s *Server, workers, rounds int) []*churnedPeer {
+	t.Helper()
+
+	peers := make([]*churnedPeer, workers*rounds)
+	errs := make(chan error, workers)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for r := 0; r < rounds; r++ {
+				p := &churnedPeer{id: fmt.Sprintf("peer-%d-%d", w, r)}
+				pc, records, err := s.JoinWithID(p.id, churnTopic, nil)
+				if err != nil {
+					errs <- fmt.Errorf("join %s: %w", p.id, err)
+					return
+				}
+				p.joinSeq, p.joined = pc.JoinSeq, records
+
+				if r%2 == 1 {
+					token := s.ResumeToken(pc)
+					s.Disconnected(pc, true)
+					resumed, records, seq, err := s.Resume(churnTopic, token)
+					if err != nil {
+						errs <- fmt.Errorf("resume %s: %w", p.id, err)
+						return
+					}
+					pc, p.resumeSeq, p.resumed = resumed, seq, records
+				}
+
+				runtime.Gosched()
+				s.Leave(p.id, churnTopic)
+				p.events = drainMembership(pc)
+				peers[w*rounds+r] = p
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	return peers
+}
+
+// drainMembership returns the membership events queued for pc
+func drainMembership(pc *PeerConn) []OutboundMessage {
+	var msgs []OutboundMessage
+	for {
+		select {
+		case msg := <-pc.Send:
+			if isMembershipEvent(msg.Type) {
+				msgs = append(msgs, msg)
+			}
+		default:
+			return msgs
+		}
+	}
+}
+
+// recordIDs returns the sorted IDs of records
+func recordIDs(records []PeerRecord) []string {
+	ids := []string{}
+	for _, r := range records {
+		ids = append(ids, r.ID)
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+// TestTopicMembershipUnderChurn checks, with an observer watching every
+// change, that concurrent joins, resumes, and leaves are numbered without
+// gaps and that every peer-list and announcement matches that history
+func TestTopicMembershipUnderChurn(t *testing.T) {
+	const workers, rounds = 8, 40
+	changes := 2 * workers * rounds
+	s := newTestServer(changes + 1)
+
+	observer, records := s.Observe(churnTopic)
+	if len(records) != 0 {
+		t.Fatalf("observer got %d peers in a new topic", len(records))
+	}
+
+	// Drain the observer while peers churn, like a connection's writer would
+	var seen []OutboundMessage
+	stop, collected := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(collected)
+		for {
+			select {
+			case msg := <-observer.Send:
+				seen = append(seen, msg)
+			case <-stop:
+				seen = append(seen, drainMembership(observer)...)
+				return
+			}
+		}
+	}()
+
+	peers := churn(t, s, workers, rounds)
+	close(stop)
+	<-collected
+
+	if len(seen) != changes {
+		t.Fatalf("observer saw %d changes, want %d", len(seen), changes)
+	}
+
+	// Replay the history, keeping the membership after each change
+	members := map[string]bool{}
+	states := [][]string{{}}
+	for i, msg := range seen {
+		if msg.Seq != uint64(i+1) {
+			t.Fatalf("change %d has seq %d, want %d", i, msg.Seq, i+1)
+		}
+		switch msg.Type {
+		case "peer-joined":
+			if members[msg.PeerID] {
+				t.Fatalf("seq %d: %s joined twice", msg.Seq, msg.PeerID)
+			}
+			members[msg.PeerID] = true
+		case "peer-left":
+			if !members[msg.PeerID] {
+				t.Fatalf("seq %d: %s left without joining", msg.Seq, msg.PeerID)
+			}
+			delete(members, msg.PeerID)
+		default:
+			t.Fatalf("seq %d: unexpected %s", msg.Seq, msg.Type)
+		}
+		state := make([]string, 0, len(members))
+		for id := range members {
+			state = append(state, id)
+		}
+		slices.Sort(state)
+		states = append(states, state)
+	}
+	if len(members) != 0 {
+		t.Fatalf("%d peers never left", len(members))
+	}
+
+	left := make(map[string]uint64, len(peers))
+	for _, msg := range seen {
+		if msg.Type == "peer-left" {
+			left[msg.PeerID] = msg.Seq
+		}
+	}
+
+	for _, p := range peers {
+		if got, want := recordIDs(p.joined), states[p.joinSeq-1]; !slices.Equal(got, want) {
+			t.Fatalf("%s joined at seq %d with peers %v, want %v", p.id, p.joinSeq, got, want)
+		}
+
+		// The connection that left saw every change after its peer-list
+		// and before its own leave, in order
+		from := p.joinSeq
+		if p.resumeSeq != 0 {
+			if got, want := recordIDs(p.resumed), without(states[p.resumeSeq], p.id); !slices.Equal(got, want) {
+				t.Fatalf("%s resumed at seq %d with peers %v, want %v", p.id, p.resumeSeq, got, want)
+			}
+			from = p.resumeSeq
+		}
+		want := seen[from : left[p.id]-1]
+		if len(p.events) != len(want) {
+			t.Fatalf("%s got %d changes between seq %d and its leave at %d, want %d", p.id, len(p.events), from, left[p.id], len(want))
+		}
+		for i, msg := range p.events {
+			if msg.Seq != want[i].Seq || msg.Type != want[i].Type || msg.PeerID != want[i].PeerID {
+				t.Fatalf("%s got %s %s at seq %d, want %s %s at seq %d", p.id, msg.Type, msg.PeerID, msg.Seq, want[i].Type, want[i].PeerID, want[i].Seq)
+			}
+		}
+	}
+}
+
+// TestTopicRecreatedUnderChurn checks that a topic emptied and closed while
+// peers join is replaced by a fresh one, with every peer's announcements in
+// sequence order after its join
+func TestTopicRecreatedUnderChurn(t *testing.T) {
+	const workers, rounds = 8, 100
+	s := newTestServer(2*workers*rounds + 1)
+
+	for _, p := range churn(t, s, workers, rounds) {
+		from := p.joinSeq
+		if p.resumeSeq != 0 {
+			from = p.resumeSeq
+		}
+		for _, msg := range p.events {
+			if msg.Seq <= from {
+				t.Fatalf("%s got %s %s at seq %d, not after seq %d", p.id, msg.Type, msg.PeerID, msg.Seq, from)
+			}
+			from = msg.Seq
+		}
+	}
+	if _, ok := s.topics.Load(churnTopic); ok {
+		t.Fatal("topic left behind after every peer left")
+	}
+}
+
+// without returns a copy of ids leaving out id
+func without(ids []string, id string) []string {
+	return slices.DeleteFunc(slices.Clone(ids), func(other string) bool { return other == id })
+}
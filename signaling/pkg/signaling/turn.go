@@ -0,0 +1,106 @@
+package signaling
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultTURNTTL is how long TURN credentials are valid by default. TURN
+// servers check them on every allocation refresh, so they must outlast the
+// connections relayed with them.
+const DefaultTURNTTL = 24 * time.Hour
+
+// ICEServer is a STUN or TURN server for clients to gather candidates from,
+// shaped like WebRTC's RTCIceServer
+type ICEServer struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username,omitempty"`
+	Credential string   `json:"credential,omitempty"`
+}
+
+// TURNCredentials mints short-lived credentials for TURN servers that share
+// a secret with the signaling server, following the TURN REST API convention
+// coturn implements with use-auth-secret: the username is the expiry as a
+// Unix time and a user ID, and the password is the base64 HMAC-SHA1 of the
+// username keyed by the secret. Clients behind NATs that defeat direct
+// connections fall back to relaying through the TURN servers without ever
+// knowing the secret.
+type TURNCredentials struct {
+	urls   []string
+	secret []byte
+	ttl    time.Duration
+}
+
+// NewTURNCredentials mints credentials for the TURN servers at urls, such as
+// turn:turn.example.com:3478 or turns:turn.example.com:5349?transport=tcp,
+// valid for ttl, or DefaultTURNTTL if ttl is 0
+func NewTURNCredentials(urls []string, secret string, ttl time.Duration) *TURNCredentials {
+	if ttl <= 0 {
+		ttl = DefaultTURNTTL
+	}
+	return &TURNCredentials{urls: urls, secret: []byte(secret), ttl: ttl}
+}
+
+// TTL is how long minted credentials are valid
+func (t *TURNCredentials) TTL() time.Duration {
+	return t.ttl
+}
+
+// ICEServers returns the TURN servers with credentials for user, such as a
+// peer ID, valid from now. It returns nil if t is nil, so callers need not
+// check whether TURN is configured.
+func (t *TURNCredentials) ICEServers(user string, now time.Time) []ICEServer {
+	if t == nil {
+		return nil
+	}
+	username := strconv.FormatInt(now.Add(t.ttl).Unix(), 10)
+	if user != "" {
+		username += ":" + user
+	}
+	return []ICEServer{{
+		URLs:       t.urls,
+		Username:   username,
+		Credential: t.password(username),
+	}}
+}
+
+// Password returns the password for a username minted by ICEServers, for
+// TURN servers that check credentials in process. It returns false if the
+// username is malformed or expired at now.
+func (t *TURNCredentials) Password(username string, now time.Time) (string, bool) {
+	expiry, _, _ := strings.Cut(username, ":")
+	unix, err := strconv.ParseInt(expiry, 10, 64)
+	if err != nil || now.Unix() > unix {
+		return "", false
+	}
+	return t.password(username), true
+}
+
+// password is the base64 HMAC-SHA1 of username keyed by the secret
+func (t *TURNCredentials) password(username string) string {
+	mac := hmac.New(sha1.New, t.secret)
+	mac.Write([]byte(username))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// ParseTURNURLs parses a comma-separated list of TURN server URLs, such as
+// "turn:turn.example.com:3478, turns:turn.example.com:5349"
+func ParseTURNURLs(s string) ([]string, error) {
+	var urls []string
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		if !strings.HasPrefix(field, "turn:") && !strings.HasPrefix(field, "turns:") {
+			return nil, fmt.Errorf("invalid TURN URL %q: must start with turn: or turns:", field)
+		}
+		urls = append(urls, field)
+	}
+	return urls, nil
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"errors"
 	"log/slog"
+	"sync/atomic"
 	"time"
 
 	"github.com/oklog/ulid/v2"
@@ -13,28 +14,70 @@ import (
 var (
 	ErrPeerGone    = errors.New("peer gone")
 	ErrSendTimeout = errors.New("send timeout")
+	ErrPeerIDTaken = errors.New("peer ID already in topic")
+)
+
+const (
+	// DefaultSendQueueSize is how many outbound messages a peer may have
+	// queued, unless the server is configured otherwise (see
+	// Server.SetSendQueueSize)
+	DefaultSendQueueSize = 16
+	// RelayTimeout is how long a relay waits on a full queue before it is
+	// dropped
+	RelayTimeout = 100 * time.Millisecond
 )
 
 // PeerConn represents a live connected peer
 type PeerConn struct {
-	ID       string
-	TopicID  string
-	Metadata json.RawMessage
-	Send     chan OutboundMessage // buffered, never closed
-	ctx      context.Context
-	cancel   context.CancelFunc
+	ID        string
+	TopicID   string
+	Metadata  json.RawMessage
+	Info      PeerInfo             // friendly description from Metadata
+	PublicKey string               // identity key the peer proved, base64url; empty if none
+	Observer  bool                 // read-only: sees membership events, never relays
+	JoinSeq   uint64               // topic sequence number of the join, sent with the peer-list
+	Send      chan OutboundMessage // buffered, never closed
+	// ConnectedAt is when the peer connected
+	ConnectedAt time.Time
+	ctx         context.Context
+	cancel      context.CancelFunc
+
+	remoteAddr atomic.Pointer[string]   // client address, for the admin API
+	kicked     atomic.Pointer[kickInfo] // why the server removed the peer, if it did
+
+	resumeNonce atomic.Pointer[string] // nonce in the latest resume token issued
+}
+
+// kickInfo records why the server removed a peer
+type kickInfo struct {
+	reason CloseReason
+	detail string
 }
 
 // NewPeerConn creates a new peer connection with a server-generated ULID
 func NewPeerConn(topicID string, metadata json.RawMessage) *PeerConn {
+	return NewPeerConnWithID(ulid.Make().String(), topicID, metadata)
+}
+
+// NewPeerConnWithID creates a new peer connection with a given ID, such as
+// one derived from a proven identity key
+func NewPeerConnWithID(id, topicID string, metadata json.RawMessage) *PeerConn {
+	return newPeerConn(id, topicID, metadata, DefaultSendQueueSize)
+}
+
+// newPeerConn creates a peer connection queueing up to queueSize messages
+func newPeerConn(id, topicID string, metadata json.RawMessage, queueSize int) *PeerConn {
 	ctx, cancel := context.WithCancel(context.Background())
 	return &PeerConn{
-		ID:       ulid.Make().String(),
+		ID:       id,
 		TopicID:  topicID,
 		Metadata: metadata,
-		Send:     make(chan OutboundMessage, 16),
-		ctx:      ctx,
-		cancel:   cancel,
+		Info:     MetadataPeerInfo(metadata),
+		Send:     make(chan OutboundMessage, queueSize),
+
+		ConnectedAt: time.Now().UTC(),
+		ctx:         ctx,
+		cancel:      cancel,
 	}
 }
 
@@ -72,6 +115,35 @@ func (pc *PeerConn) Cancel() { pc.cancel() }
 // Done returns a channel that closes when the peer is cancelled
 func (pc *PeerConn) Done() <-chan struct{} { return pc.ctx.Done() }
 
+// kick records that the server removed the peer, then cancels it
+func (pc *PeerConn) kick(reason CloseReason, detail string) {
+	pc.kicked.Store(&kickInfo{reason: reason, detail: detail})
+	pc.cancel()
+}
+
+// Kicked reports whether the server removed the peer with Server.Kick or
+// Server.Disconnect, and the reason to close its connection with. It is
+// settled once Done is closed.
+func (pc *PeerConn) Kicked() (reason CloseReason, detail string, ok bool) {
+	if p := pc.kicked.Load(); p != nil {
+		return p.reason, p.detail, true
+	}
+	return "", "", false
+}
+
+// SetRemoteAddr records the client address the peer connected from
+func (pc *PeerConn) SetRemoteAddr(addr string) {
+	pc.remoteAddr.Store(&addr)
+}
+
+// RemoteAddr returns the client address the peer connected from, if known
+func (pc *PeerConn) RemoteAddr() string {
+	if p := pc.remoteAddr.Load(); p != nil {
+		return *p
+	}
+	return ""
+}
+
 // ToRecord converts the live peer to a transferable record
 func (pc *PeerConn) ToRecord() PeerRecord {
 	return PeerRecord{ID: pc.ID, Metadata: pc.Metadata}
@@ -89,6 +161,19 @@ type InboundMessage struct {
 	To      string          `json:"to"`
 	Payload json.RawMessage `json:"payload"`
 	MsgID   string          `json:"msgId,omitempty"`
+	// Ack asks for an ack once a relay with a MsgID is delivered
+	Ack bool `json:"ack,omitempty"`
+
+	// Topic selects the subscription on a multiplexed connection; Metadata
+	// is the peer metadata for a subscribe
+	Topic    string          `json:"topic,omitempty"`
+	Metadata json.RawMessage `json:"metadata,omitempty"`
+
+	// Signature answers a join challenge
+	Signature string `json:"signature,omitempty"`
+
+	// Role is "observer" to subscribe read-only on a multiplexed connection
+	Role string `json:"role,omitempty"`
 }
 
 // OutboundMessage represents a message from server to client
@@ -101,6 +186,44 @@ type OutboundMessage struct {
 	Metadata json.RawMessage `json:"metadata,omitempty"`
 	Payload  json.RawMessage `json:"payload,omitempty"`
 	MsgID    string          `json:"msgId,omitempty"`
+	Topic    string          `json:"topic,omitempty"` // set on multiplexed connections
+	Nonce    string          `json:"nonce,omitempty"` // join challenge
+	Hints    *ServerHints    `json:"hints,omitempty"` // set on welcome
+	Seq      uint64          `json:"seq,omitempty"`   // topic sequence number on peer-list, peer-joined, peer-left
+
+	// ICEServers are TURN servers with short-lived credentials, set on
+	// welcome when the server vends them
+	ICEServers []ICEServer `json:"iceServers,omitempty"`
+
+	// ResumeToken lets the client get its peer ID back after its connection
+	// drops, set on welcome when the server supports it; Resumed is set on
+	// the welcome of a connection that did so
+	ResumeToken string `json:"resumeToken,omitempty"`
+	Resumed     bool   `json:"resumed,omitempty"`
+
+	// ReconnectAfterMs is set on server-draining: how long the client
+	// should wait before reconnecting, to another server
+	ReconnectAfterMs int64 `json:"reconnectAfterMs,omitempty"`
+
+	// Code and Message describe an error, for clients that read the
+	// server's ErrorMessage frames as an OutboundMessage
+	Code    string `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// ServerHints describes the limits and features of the server a client
+// joined, so clients can configure themselves instead of assuming defaults
+type ServerHints struct {
+	MaxMessageSize  int      `json:"maxMessageSize"`            // bytes per frame
+	MaxMetadataSize int      `json:"maxMetadataSize"`           // bytes of peer metadata
+	PingIntervalMs  int64    `json:"pingIntervalMs"`            // how often the server pings
+	SendQueueSize   int      `json:"sendQueueSize"`             // messages queued per peer
+	RelayTimeoutMs  int64    `json:"relayTimeoutMs"`            // wait on a full queue before dropping
+	MaxTopics       int      `json:"maxTopics,omitempty"`       // subscriptions per multiplexed connection
+	Features        []string `json:"features,omitempty"`        // optional protocol features supported
+	Version         string   `json:"version,omitempty"`         // server build version
+	ResumeGraceMs   int64    `json:"resumeGraceMs,omitempty"`   // how long a dropped peer can resume
+	AppRelayMaxSize int      `json:"appRelayMaxSize,omitempty"` // bytes per app-relay payload
 }
 
 // ErrorMessage represents an error response to the client
@@ -109,11 +232,12 @@ type ErrorMessage struct {
 	Code    string `json:"code"`
 	Message string `json:"message"`
 	MsgID   string `json:"msgId,omitempty"`
+	Topic   string `json:"topic,omitempty"` // set on multiplexed connections
 }
 
 // IsRelayType returns true if the message type is a valid relay type
 func IsRelayType(t string) bool {
-	return t == "offer" || t == "answer" || t == "ice-candidate"
+	return t == "offer" || t == "answer" || t == "ice-candidate" || t == AppRelayType
 }
 
 // Logger returns a child logger with peer context
@@ -0,0 +1,301 @@
+package signaling
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+)
+
+// Webhook event types
+const (
+	// WebhookTopicCreated is sent when a peer joins a topic that had none
+	WebhookTopicCreated = "topic-created"
+	// WebhookTopicEmpty is sent when the last peer leaves a topic
+	WebhookTopicEmpty = "topic-empty"
+	// WebhookPeerJoined is sent when a peer joins a topic
+	WebhookPeerJoined = "peer-joined"
+	// WebhookPeerLeft is sent when a peer leaves a topic or is removed
+	WebhookPeerLeft = "peer-left"
+)
+
+// Webhook request headers
+const (
+	// WebhookTimestampHeader carries the Unix time a delivery was signed at
+	WebhookTimestampHeader = "X-Lanscape-Timestamp"
+	// WebhookSignatureHeader carries "sha256=" and the hex HMAC-SHA256 of
+	// the timestamp, a ".", and the body, keyed with the webhook secret
+	WebhookSignatureHeader = "X-Lanscape-Signature"
+)
+
+// maxWebhookQueue bounds the events held per URL while it is unreachable.
+// Older events are dropped.
+const maxWebhookQueue = 1000
+
+// maxWebhookBatch bounds the events posted in one delivery
+const maxWebhookBatch = 100
+
+// webhookRetryInterval is how often a failed delivery is retried
+const webhookRetryInterval = 10 * time.Second
+
+// WebhookEvent is a change in a topic's membership. With a cluster, each
+// server reports the peers connected to it, and a topic's creation or
+// emptying is reported by the server whose peer caused it. Observers are
+// not reported as peers, but count toward a topic being non-empty.
+type WebhookEvent struct {
+	// ID is unique per event, so receivers can skip redelivered ones
+	ID    string    `json:"id"`
+	Type  string    `json:"type"`
+	Topic string    `json:"topic"`
+	At    time.Time `json:"at"`
+	// Peer is the peer that joined or left, unset for topic events
+	Peer string `json:"peer,omitempty"`
+	// PublicKey is the identity key the peer proved, if any
+	PublicKey string `json:"public_key,omitempty"`
+}
+
+// webhookDelivery is the body posted to webhook URLs
+type webhookDelivery struct {
+	Events []WebhookEvent `json:"events"`
+}
+
+// Webhooks posts topic lifecycle events to URLs as they happen, signed with
+// a shared secret, so other systems can track live presence without
+// polling. Each URL gets the events in order, in batches, and failed
+// deliveries are retried. A nil Webhooks sends nothing.
+type Webhooks struct {
+	targets []*webhookTarget
+	secret  []byte
+	client  *http.Client
+	logger  *slog.Logger
+}
+
+// webhookTarget is a URL and the events waiting to be delivered to it
+type webhookTarget struct {
+	url string
+
+	// sendMu keeps deliveries in order
+	sendMu sync.Mutex
+
+	mu      sync.Mutex
+	queue   []WebhookEvent
+	dropped int // events dropped from a full queue since the last warning
+	wake    chan struct{}
+}
+
+// NewWebhooks creates webhooks posting to urls, signed with secret
+func NewWebhooks(urls []string, secret string, logger *slog.Logger) *Webhooks {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	w := &Webhooks{
+		secret: []byte(secret),
+		client: &http.Client{Timeout: 10 * time.Second},
+		logger: logger,
+	}
+	for _, url := range urls {
+		w.targets = append(w.targets, &webhookTarget{url: url, wake: make(chan struct{}, 1)})
+	}
+	return w
+}
+
+// ParseWebhookURLs parses a comma-separated list of http or https URLs
+func ParseWebhookURLs(v string) ([]string, error) {
+	var urls []string
+	for _, url := range strings.Split(v, ",") {
+		url = strings.TrimSpace(url)
+		if url == "" {
+			continue
+		}
+		if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+			return nil, fmt.Errorf("webhook URL %q: must be http or https", url)
+		}
+		urls = append(urls, url)
+	}
+	return urls, nil
+}
+
+// SetWebhooks posts topic lifecycle events to webhooks. Must be called
+// before the server starts handling connections.
+func (s *Server) SetWebhooks(webhooks *Webhooks) {
+	s.webhooks = webhooks
+}
+
+// topicCreated reports a topic's first peer
+func (w *Webhooks) topicCreated(topicID string) {
+	w.emit(WebhookEvent{Type: WebhookTopicCreated, Topic: topicID})
+}
+
+// topicEmpty reports a topic's last peer leaving
+func (w *Webhooks) topicEmpty(topicID string) {
+	w.emit(WebhookEvent{Type: WebhookTopicEmpty, Topic: topicID})
+}
+
+// peerJoined reports pc joining its topic
+func (w *Webhooks) peerJoined(pc *PeerConn) {
+	w.emit(WebhookEvent{Type: WebhookPeerJoined, Topic: pc.TopicID, Peer: pc.ID, PublicKey: pc.PublicKey})
+}
+
+// peerLeft reports pc leaving its topic
+func (w *Webhooks) peerLeft(pc *PeerConn) {
+	w.emit(WebhookEvent{Type: WebhookPeerLeft, Topic: pc.TopicID, Peer: pc.ID, PublicKey: pc.PublicKey})
+}
+
+// emit queues event for every URL and wakes their senders
+func (w *Webhooks) emit(event WebhookEvent) {
+	if w == nil {
+		return
+	}
+	event.ID = ulid.Make().String()
+	event.At = time.Now().UTC()
+	for _, t := range w.targets {
+		t.mu.Lock()
+		if len(t.queue) >= maxWebhookQueue {
+			t.queue = t.queue[1:]
+			t.dropped++
+		}
+		t.queue = append(t.queue, event)
+		t.mu.Unlock()
+		select {
+		case t.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Run delivers events to every URL as they happen until ctx is done
+func (w *Webhooks) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, t := range w.targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.run(ctx, t)
+		}()
+	}
+	wg.Wait()
+}
+
+// run delivers events to t until ctx is done
+func (w *Webhooks) run(ctx context.Context, t *webhookTarget) {
+	retry := time.NewTicker(webhookRetryInterval)
+	defer retry.Stop()
+	for {
+		select {
+		case <-t.wake:
+		case <-retry.C:
+		case <-ctx.Done():
+			return
+		}
+		w.send(ctx, t)
+	}
+}
+
+// Flush delivers all queued events, e.g. once the server has drained on
+// shutdown
+func (w *Webhooks) Flush(ctx context.Context) {
+	if w == nil {
+		return
+	}
+	for _, t := range w.targets {
+		w.send(ctx, t)
+	}
+}
+
+// send delivers t's queued events in batches until the queue is empty or a
+// delivery fails, leaving the rest queued for the next attempt
+func (w *Webhooks) send(ctx context.Context, t *webhookTarget) {
+	t.sendMu.Lock()
+	defer t.sendMu.Unlock()
+
+	for {
+		t.mu.Lock()
+		if t.dropped > 0 {
+			w.logger.Warn("webhook queue full, dropped events", "url", t.url, "dropped", t.dropped)
+			t.dropped = 0
+		}
+		batch := t.queue[:min(len(t.queue), maxWebhookBatch)]
+		t.mu.Unlock()
+		if len(batch) == 0 {
+			return
+		}
+
+		if err := w.post(ctx, t.url, batch); err != nil {
+			w.logger.Warn("failed to deliver webhook", "url", t.url, "error", err, "events", len(batch))
+			return
+		}
+		w.logger.Debug("delivered webhook", "url", t.url, "events", len(batch))
+
+		t.mu.Lock()
+		// Events dropped from a full queue while posting shifted it
+		delivered := len(batch) - t.droppedSince(batch)
+		t.queue = t.queue[delivered:]
+		t.mu.Unlock()
+	}
+}
+
+// droppedSince returns how many events of batch, the head of the queue when
+// it was taken, are no longer in the queue. Callers must hold mu.
+func (t *webhookTarget) droppedSince(batch []WebhookEvent) int {
+	for i, event := range batch {
+		if len(t.queue) > 0 && t.queue[0].ID == event.ID {
+			return i
+		}
+	}
+	return len(batch)
+}
+
+// post sends one batch of events to url
+func (w *Webhooks) post(ctx context.Context, url string, events []WebhookEvent) error {
+	return postSigned(ctx, w.client, url, w.secret, webhookDelivery{Events: events})
+}
+
+// postSigned posts v as JSON to url, signed with secret in the webhook
+// headers
+func postSigned(ctx context.Context, client *http.Client, url string, secret []byte, v any) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookTimestampHeader, timestamp)
+	req.Header.Set(WebhookSignatureHeader, SignWebhook(secret, timestamp, body))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("status %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// SignWebhook returns the WebhookSignatureHeader value for a delivery of
+// body signed at timestamp, for receivers to compare with hmac.Equal
+func SignWebhook(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,208 @@
+// Package turnrelay runs a TURN server in process, so small deployments get
+// relay fallback without running coturn. It accepts the credentials the
+// signaling server hands out, so only clients that could fetch them can
+// relay. It is kept out of package signaling so clients of the signaling
+// types do not depend on a TURN server.
+package turnrelay
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jhead/lanscape/signaling/pkg/signaling"
+	"github.com/pion/logging"
+	"github.com/pion/turn/v4"
+)
+
+// DefaultRealm is the realm credentials are checked in if none is set
+const DefaultRealm = "lanscape"
+
+// Config configures an embedded TURN server
+type Config struct {
+	// Listen is the UDP and TCP address clients connect to, e.g. ":3478"
+	Listen string
+	// PublicIP is the address clients and peers reach the server at; it is
+	// advertised in the TURN URLs and as the address of every relay
+	PublicIP net.IP
+	// Realm is the authentication realm, DefaultRealm if empty
+	Realm string
+	// MinPort and MaxPort bound the ports relays are allocated on; any free
+	// port is used when they are 0
+	MinPort, MaxPort uint16
+	// AllowPrivate allows relaying to private addresses, such as other hosts
+	// on the server's LAN. Loopback, link-local, and multicast addresses are
+	// always refused.
+	AllowPrivate bool
+}
+
+// ParsePortRange parses a relay port range such as "49152-65535"
+func ParsePortRange(s string) (min, max uint16, err error) {
+	lo, hi, ok := strings.Cut(s, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid port range %q: want min-max", s)
+	}
+	minPort, err := strconv.ParseUint(lo, 10, 16)
+	if err != nil || minPort == 0 {
+		return 0, 0, fmt.Errorf("invalid port range %q: bad minimum", s)
+	}
+	maxPort, err := strconv.ParseUint(hi, 10, 16)
+	if err != nil || maxPort < minPort {
+		return 0, 0, fmt.Errorf("invalid port range %q: bad maximum", s)
+	}
+	return uint16(minPort), uint16(maxPort), nil
+}
+
+// URLs returns the TURN URLs clients reach the server at, over UDP and TCP
+func (c Config) URLs() ([]string, error) {
+	_, port, err := net.SplitHostPort(c.Listen)
+	if err != nil {
+		return nil, fmt.Errorf("invalid listen address %q: %w", c.Listen, err)
+	}
+	if c.PublicIP == nil {
+		return nil, fmt.Errorf("a public IP is required")
+	}
+	host := net.JoinHostPort(c.PublicIP.String(), port)
+	return []string{
+		"turn:" + host + "?transport=udp",
+		"turn:" + host + "?transport=tcp",
+	}, nil
+}
+
+// Server is a running embedded TURN server
+type Server struct {
+	server *turn.Server
+}
+
+// Start listens on config.Listen and relays for clients presenting
+// credentials minted by credentials
+func Start(config Config, credentials *signaling.TURNCredentials, logger *slog.Logger) (*Server, error) {
+	if config.PublicIP == nil {
+		return nil, fmt.Errorf("a public IP is required")
+	}
+	realm := config.Realm
+	if realm == "" {
+		realm = DefaultRealm
+	}
+
+	udpConn, err := net.ListenPacket("udp", config.Listen)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for TURN over UDP: %w", err)
+	}
+	tcpListener, err := net.Listen("tcp", config.Listen)
+	if err != nil {
+		udpConn.Close()
+		return nil, fmt.Errorf("failed to listen for TURN over TCP: %w", err)
+	}
+
+	server, err := turn.NewServer(turn.ServerConfig{
+		Realm:         realm,
+		LoggerFactory: loggerFactory{logger},
+		AuthHandler: func(username, realm string, srcAddr net.Addr) ([]byte, bool) {
+			password, ok := credentials.Password(username, time.Now())
+			if !ok {
+				logger.Debug("refused TURN credentials", "username", username, "remote", srcAddr.String())
+				return nil, false
+			}
+			return turn.GenerateAuthKey(username, realm, password), true
+		},
+		PacketConnConfigs: []turn.PacketConnConfig{{
+			PacketConn:            udpConn,
+			RelayAddressGenerator: relayAddressGenerator(config),
+			PermissionHandler:     permissionHandler(config.AllowPrivate),
+		}},
+		ListenerConfigs: []turn.ListenerConfig{{
+			Listener:              tcpListener,
+			RelayAddressGenerator: relayAddressGenerator(config),
+			PermissionHandler:     permissionHandler(config.AllowPrivate),
+		}},
+	})
+	if err != nil {
+		udpConn.Close()
+		tcpListener.Close()
+		return nil, fmt.Errorf("failed to start TURN server: %w", err)
+	}
+	return &Server{server: server}, nil
+}
+
+// Allocations returns the number of relays currently allocated
+func (s *Server) Allocations() int {
+	return s.server.AllocationCount()
+}
+
+// Close stops the server and every relay it allocated
+func (s *Server) Close() error {
+	return s.server.Close()
+}
+
+// relayAddressGenerator allocates relays on all interfaces, advertised at
+// the public IP, within the configured port range if any
+func relayAddressGenerator(config Config) turn.RelayAddressGenerator {
+	if config.MinPort != 0 {
+		return &turn.RelayAddressGeneratorPortRange{
+			RelayAddress: config.PublicIP,
+			Address:      "0.0.0.0",
+			MinPort:      config.MinPort,
+			MaxPort:      config.MaxPort,
+		}
+	}
+	return &turn.RelayAddressGeneratorStatic{
+		RelayAddress: config.PublicIP,
+		Address:      "0.0.0.0",
+	}
+}
+
+// permissionHandler refuses relaying to addresses a client could not reach
+// on its own, so the relay cannot be used to probe the server's host or
+// network
+func permissionHandler(allowPrivate bool) turn.PermissionHandler {
+	return func(_ net.Addr, peerIP net.IP) bool {
+		switch {
+		case peerIP.IsLoopback(), peerIP.IsUnspecified(), peerIP.IsMulticast(),
+			peerIP.IsLinkLocalUnicast(), peerIP.IsLinkLocalMulticast():
+			return false
+		case peerIP.IsPrivate():
+			return allowPrivate
+		}
+		return true
+	}
+}
+
+// loggerFactory logs the TURN server's messages to a slog.Logger. Trace and
+// debug messages, which the TURN server logs per packet, are dropped.
+type loggerFactory struct {
+	logger *slog.Logger
+}
+
+// NewLogger returns a logger for one of the TURN server's subsystems
+func (f loggerFactory) NewLogger(scope string) logging.LeveledLogger {
+	return leveledLogger{f.logger.With("component", "turn", "scope", scope)}
+}
+
+// leveledLogger adapts a slog.Logger to the TURN server's logging interface
+type leveledLogger struct {
+	logger *slog.Logger
+}
+
+func (l leveledLogger) Trace(string)          {}
+func (l leveledLogger) Tracef(string, ...any) {}
+func (l leveledLogger) Debug(string)          {}
+func (l leveledLogger) Debugf(string, ...any) {}
+func (l leveledLogger) Info(msg string)       { l.logger.Info(msg) }
+func (l leveledLogger) Warn(msg string)       { l.logger.Warn(msg) }
+func (l leveledLogger) Error(msg string)      { l.logger.Error(msg) }
+
+func (l leveledLogger) Infof(format string, args ...any) {
+	l.logger.Info(fmt.Sprintf(format, args...))
+}
+
+func (l leveledLogger) Warnf(format string, args ...any) {
+	l.logger.Warn(fmt.Sprintf(format, args...))
+}
+
+func (l leveledLogger) Errorf(format string, args ...any) {
+	l.logger.Error(fmt.Sprintf(format, args...))
+}